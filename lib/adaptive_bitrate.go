@@ -0,0 +1,225 @@
+package main
+
+import (
+	"log"
+	"os"
+	"time"
+
+	"github.com/pion/interceptor/pkg/cc"
+	"github.com/pion/webrtc/v4"
+)
+
+// qualityRung is one rendition of every camera: camera n's frames for it
+// are in cameraDirectories[n] + Suffix, encoded from the same source as the
+// other rungs with aligned GOPs
+type qualityRung struct {
+	Name    string
+	Bitrate int // bits per second the rendition needs
+	Suffix  string
+}
+
+// qualityLadder lists the renditions from best to worst. The first is the
+// camera directory itself; a camera without a rendition stays on the next
+// better one it has.
+var qualityLadder = []qualityRung{
+	{Name: "high", Bitrate: 2500000, Suffix: ""},
+	{Name: "medium", Bitrate: 1200000, Suffix: "_medium"},
+	{Name: "low", Bitrate: 500000, Suffix: "_low"},
+}
+
+// peerBandwidth is what one peer's link is estimated to carry
+type peerBandwidth struct {
+	estimator cc.BandwidthEstimator // from TWCC feedback, nil without adaptiveBitrateEnabled
+	remb      int                   // last REMB estimate, from peers without TWCC
+	rembAt    time.Time
+	limit     int // the peer's cap, 0 for none, see bandwidth_cap.go
+}
+
+// estimate returns the lower of the TWCC and recent REMB estimates, or 0 if
+// there is neither
+func (b *peerBandwidth) estimate(now time.Time) int {
+	estimate := 0
+	if b.estimator != nil {
+		estimate = b.estimator.GetTargetBitrate()
+	}
+	if b.remb > 0 && now.Sub(b.rembAt) <= abrREMBMaxAge && (estimate == 0 || b.remb < estimate) {
+		estimate = b.remb
+	}
+	return estimate
+}
+
+// captureEstimator receives the bandwidth estimator of a peer connection
+// being created, like captureStats
+func (w *WebRTCManager) captureEstimator(id string, estimator cc.BandwidthEstimator) {
+	w.newEstimator = estimator
+}
+
+// recordREMB stores a REMB estimate received on peerConnection
+func (w *WebRTCManager) recordREMB(peerID string, peerConnection *webrtc.PeerConnection, bitrate float32) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if bandwidth, ok := w.bandwidth[peerID]; ok && w.peerConnections[peerID] == peerConnection {
+		bandwidth.remb = int(bitrate)
+		bandwidth.rembAt = time.Now()
+	}
+}
+
+// PeerBandwidth returns the bits per second peerID's link is estimated to
+// carry, if there is an estimate
+func (w *WebRTCManager) PeerBandwidth(peerID string) (int, bool) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	bandwidth, ok := w.bandwidth[peerID]
+	if !ok {
+		return 0, false
+	}
+	estimate := bandwidth.estimate(time.Now())
+	return estimate, estimate > 0
+}
+
+// slowestPeerBandwidth returns the lowest estimate of the connected peers,
+// each lowered to its cap
+func (w *WebRTCManager) slowestPeerBandwidth() (int, bool) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	now := time.Now()
+	slowest, found := 0, false
+	for peerID := range w.transports {
+		bandwidth, ok := w.bandwidth[peerID]
+		if !ok {
+			continue
+		}
+		if estimate := bandwidth.budget(now); estimate > 0 && (!found || estimate < slowest) {
+			slowest, found = estimate, true
+		}
+	}
+	return slowest, found
+}
+
+// StartAdaptiveBitrate switches every camera to the best quality rung the
+// slowest connected peer can take, so video degrades on a bad cellular link
+// instead of stalling. Peers share the tracks, so one slow peer lowers the
+// quality for all of them.
+func (w *WebRTCManager) StartAdaptiveBitrate() {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if w.stopABR != nil {
+		return
+	}
+	w.stopABR = make(chan struct{})
+	go w.abrLoop(w.stopABR)
+}
+
+func (w *WebRTCManager) abrLoop(stop chan struct{}) {
+	ticker := time.NewTicker(abrInterval)
+	defer ticker.Stop()
+
+	// When the estimate first allowed the next better rung
+	var upgradeSince time.Time
+	for {
+		select {
+		case <-stop:
+			return
+		case now := <-ticker.C:
+			estimate, ok := w.slowestPeerBandwidth()
+			if !ok {
+				upgradeSince = time.Time{}
+				continue
+			}
+			metrics.SetGauge("abr.estimate_bps", int64(estimate))
+
+			current := int(w.rung.Load())
+			switch target := rungFor(estimate); {
+			case target > current:
+				upgradeSince = time.Time{}
+				w.setQuality(target, estimate)
+			case target < current && float64(estimate) >= float64(qualityLadder[current-1].Bitrate)*abrUpgradeHeadroom:
+				// One rung at a time, each after abrUpgradeHold
+				if upgradeSince.IsZero() {
+					upgradeSince = now
+				} else if now.Sub(upgradeSince) >= abrUpgradeHold {
+					upgradeSince = time.Time{}
+					w.setQuality(current-1, estimate)
+				}
+			default:
+				upgradeSince = time.Time{}
+			}
+		}
+	}
+}
+
+// rungFor returns the best rung estimate bits per second can carry
+func rungFor(estimate int) int {
+	for i, rung := range qualityLadder {
+		if estimate >= rung.Bitrate {
+			return i
+		}
+	}
+	return len(qualityLadder) - 1
+}
+
+// setQuality moves every output to the given rung's rendition of its camera
+func (w *WebRTCManager) setQuality(rung int, estimate int) {
+	w.switchMu.Lock()
+	defer w.switchMu.Unlock()
+
+	previous := int(w.rung.Swap(int32(rung)))
+	log.Printf("Estimated bandwidth %d kbps, switching from %s to %s quality",
+		estimate/1000, qualityLadder[previous].Name, qualityLadder[rung].Name)
+	if rung > previous {
+		metrics.Inc("abr.downgrades")
+	} else {
+		metrics.Inc("abr.upgrades")
+	}
+	metrics.SetGauge("abr.rung", int64(rung))
+
+	for _, output := range w.allOutputs() {
+		cameraNumber := int(output.camera.Load())
+		directory, ok := cameraDirectories[cameraNumber]
+		if _, fromSource := w.cameraFactory(cameraNumber); !ok || fromSource {
+			continue
+		}
+		directory = w.rendition(directory)
+		files, err := findH264Files(directory)
+		if err != nil {
+			log.Printf("Failed to load %s: %v", directory, err)
+			continue
+		}
+		if output.streamer.switchRendition(files) {
+			log.Printf("Streaming %s", directory)
+		}
+	}
+}
+
+// rendition returns the directory of the current rung's frames for the
+// camera in directory, falling back to better rungs the camera lacks
+func (w *WebRTCManager) rendition(directory string) string {
+	return renditionAt(directory, int(w.rung.Load()))
+}
+
+// renditionAt returns the directory of rung's frames for the camera in
+// directory, falling back to better rungs the camera lacks
+func renditionAt(directory string, rung int) string {
+	for i := rung; i > 0; i-- {
+		candidate := directory + qualityLadder[i].Suffix
+		if info, err := os.Stat(candidate); err == nil && info.IsDir() {
+			return candidate
+		}
+	}
+	return directory
+}
+
+// switchRendition continues the stream from files, another rendition of the
+// camera streamed, see fileSource.switchRendition. Returns false if files
+// are already streamed, or the camera has a registered source.
+func (v *VideoStreamer) switchRendition(files []string) bool {
+	source, ok := v.Source().(*fileSource)
+	if !ok {
+		return false
+	}
+	return source.switchRendition(files)
+}
@@ -0,0 +1,160 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"time"
+)
+
+// Adaptive frame rate: encoding every frame is the costly part of codec
+// fallback (see transcoder.go), and the transcoded peers' links may not
+// carry transcodeBitrate. While such peers are connected, the transcoders'
+// frame rate is lowered a step of frameRateSteps when an encoder falls
+// adaptiveFPSMaxLag behind, or further when the slowest transcoded peer's
+// estimate cannot carry the step's bitrate; the bitrate follows the frame
+// rate, keeping the bits per frame. It is restored a step at a time after
+// adaptiveFPSHold without pressure. A new frame rate restarts the encoders
+// from a keyframe. H.264 peers are unaffected; their quality follows
+// adaptive bitrate instead.
+
+// frameRateSteps lists the frame rates the transcoders encode, from the
+// stream's own down
+var frameRateSteps = []int{30, 20, 15, 10}
+
+// frameRateBitrate returns the bitrate of encoding fps frames per second
+func frameRateBitrate(fps int) int {
+	return transcodeBitrate * fps / frameRateSteps[0]
+}
+
+// frameRateStepFor returns the step with the highest frame rate estimate
+// bits per second can carry
+func frameRateStepFor(estimate int) int {
+	for i, fps := range frameRateSteps {
+		if estimate >= frameRateBitrate(fps) {
+			return i
+		}
+	}
+	return len(frameRateSteps) - 1
+}
+
+// StartAdaptiveFrameRate lowers the transcoders' frame rate under CPU or
+// bandwidth pressure, and restores it once the pressure eases
+func (w *WebRTCManager) StartAdaptiveFrameRate() {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if w.stopFPS != nil || codecFallback == "" {
+		return
+	}
+	w.stopFPS = make(chan struct{})
+	go w.frameRateLoop(w.stopFPS)
+}
+
+func (w *WebRTCManager) frameRateLoop(stop chan struct{}) {
+	ticker := time.NewTicker(adaptiveFPSInterval)
+	defer ticker.Stop()
+
+	step := 0
+	// When the pressure last eased enough for the next better step
+	var restoreSince time.Time
+	for {
+		select {
+		case <-stop:
+			return
+		case now := <-ticker.C:
+			estimate, transcoded := w.transcodedPeerBandwidth()
+			if !transcoded {
+				// The next transcoded peer starts at the full frame rate
+				if step != 0 {
+					step = 0
+					w.setFrameRate(step, "no transcoded peers")
+				}
+				restoreSince = time.Time{}
+				continue
+			}
+			lag := w.transcoderLag()
+			metrics.SetGauge("transcode.lag_ms", lag.Milliseconds())
+
+			target, reason := step, ""
+			if lag > adaptiveFPSMaxLag && step < len(frameRateSteps)-1 {
+				target, reason = step+1, fmt.Sprintf("encoder %v behind", lag.Round(time.Millisecond))
+			}
+			if estimate > 0 {
+				if fits := frameRateStepFor(estimate); fits > target {
+					target, reason = fits, fmt.Sprintf("estimated bandwidth %d kbps", estimate/1000)
+				}
+			}
+
+			switch {
+			case target > step:
+				restoreSince = time.Time{}
+				step = target
+				w.setFrameRate(step, reason)
+			case step > 0 && lag <= adaptiveFPSMaxLag/2 &&
+				(estimate == 0 || float64(estimate) >= float64(frameRateBitrate(frameRateSteps[step-1]))*abrUpgradeHeadroom):
+				if restoreSince.IsZero() {
+					restoreSince = now
+				} else if now.Sub(restoreSince) >= adaptiveFPSHold {
+					restoreSince = time.Time{}
+					step--
+					w.setFrameRate(step, "pressure eased")
+				}
+			default:
+				restoreSince = time.Time{}
+			}
+		}
+	}
+}
+
+// transcodedPeerBandwidth returns the lowest estimate of the peers
+// receiving codecFallback, each lowered to its cap, 0 without estimates;
+// transcoded is false if there are none
+func (w *WebRTCManager) transcodedPeerBandwidth() (slowest int, transcoded bool) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	now := time.Now()
+	for peerID := range w.transcodedPeers {
+		bandwidth, ok := w.bandwidth[peerID]
+		if !ok {
+			continue
+		}
+		if estimate := bandwidth.budget(now); estimate > 0 && (slowest == 0 || estimate < slowest) {
+			slowest = estimate
+		}
+	}
+	return slowest, len(w.transcodedPeers) > 0
+}
+
+// transcoderLag returns how far behind the stream the slowest encoder is
+func (w *WebRTCManager) transcoderLag() time.Duration {
+	var lag time.Duration
+	for _, output := range w.allOutputs() {
+		if output.transcoder != nil {
+			lag = max(lag, output.transcoder.lag())
+		}
+	}
+	return lag
+}
+
+// setFrameRate has every transcoder encode the given step's frame rate
+func (w *WebRTCManager) setFrameRate(step int, reason string) {
+	fps := frameRateSteps[step]
+	previous := int(w.fpsStep.Swap(int32(step)))
+	if step == previous {
+		return
+	}
+	log.Printf("Transcoding at %d FPS instead of %d (%s)", fps, frameRateSteps[previous], reason)
+	if step > previous {
+		metrics.Inc("transcode.fps_lowered")
+	} else {
+		metrics.Inc("transcode.fps_restored")
+	}
+	metrics.SetGauge("transcode.fps", int64(fps))
+
+	for _, output := range w.allOutputs() {
+		if output.transcoder != nil {
+			output.transcoder.setFrameRate(fps)
+		}
+	}
+}
@@ -0,0 +1,148 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"strings"
+)
+
+// Admin commands accepted on <thingName>/admin
+const (
+	AdminDisconnectAll    = "disconnect-all-peers"
+	AdminEnterMaintenance = "enter-maintenance"
+	AdminExitMaintenance  = "exit-maintenance"
+	AdminStartLogStream   = "start-log-stream"
+	AdminStopLogStream    = "stop-log-stream"
+	AdminListPeers        = "list-peers"
+)
+
+// AdminCommand is the payload on <thingName>/admin. A bare command name is
+// accepted too, its ack then carries no ID.
+type AdminCommand struct {
+	ID      string `json:"id,omitempty"`
+	Command string `json:"command"`
+	// Level is the lowest log level start-log-stream sends, default "info"
+	Level string `json:"level,omitempty"`
+}
+
+func parseAdminCommand(payload []byte) (AdminCommand, error) {
+	trimmed := strings.TrimSpace(string(payload))
+	if !strings.HasPrefix(trimmed, "{") {
+		return AdminCommand{Command: trimmed}, nil
+	}
+
+	var cmd AdminCommand
+	if err := json.Unmarshal(payload, &cmd); err != nil {
+		return AdminCommand{}, err
+	}
+	return cmd, nil
+}
+
+func (m *MQTTClient) handleAdmin(topic string, payload []byte) {
+	cmd, err := parseAdminCommand(payload)
+	if err != nil {
+		log.Printf("Failed to parse admin command from %s: %v", topic, err)
+		m.sendAdminAck(AdminAck{OK: false, Error: fmt.Sprintf("invalid command: %v", err)})
+		return
+	}
+
+	log.Printf("Admin command received: %s", cmd.Command)
+	ack := AdminAck{ID: cmd.ID, Command: cmd.Command, OK: true}
+
+	switch cmd.Command {
+	case AdminDisconnectAll:
+		ack.Peers = m.disconnectAllPeers()
+	case AdminEnterMaintenance:
+		m.webrtcManager.SetMaintenance(true)
+		auditSetting("maintenance", "true", TriggerAdmin, cmd.ID)
+	case AdminExitMaintenance:
+		m.webrtcManager.SetMaintenance(false)
+		auditSetting("maintenance", "false", TriggerAdmin, cmd.ID)
+	case AdminStartLogStream:
+		if err := m.startLogStream(cmd.Level); err != nil {
+			ack.OK = false
+			ack.Error = err.Error()
+		}
+	case AdminStopLogStream:
+		if logStream != nil {
+			logStream.Stop()
+		}
+	case AdminListPeers:
+		// The list itself, with each peer's metadata, is on <thingName>/peers
+		ack.Peers = len(m.webrtcManager.Peers().Peers)
+		m.retain(deviceTopic("peers"), func() { m.publishPeers(m.webrtcManager.Peers()) })
+	default:
+		ack.OK = false
+		ack.Error = fmt.Sprintf("unknown command %q", cmd.Command)
+	}
+
+	m.sendAdminAck(ack)
+}
+
+// disconnectAllPeers tells every connected peer the robot is going away and
+// closes its connection, returning how many were closed
+func (m *MQTTClient) disconnectAllPeers() int {
+	peerIDs := m.webrtcManager.PeerIDs()
+	for _, peerID := range peerIDs {
+		topic := peerTopic(peerID, "disconnecting")
+		if err := m.publish(topic, []byte("robot")); err != nil {
+			log.Printf("Failed to notify %s of disconnect: %v", peerID, err)
+		}
+		m.dropPeer(peerID)
+	}
+	return len(peerIDs)
+}
+
+// startLogStream streams backend logs to <thingName>/logs. Who may start
+// it, and read the topic, is up to the broker's ACLs for the admin and logs
+// topics.
+func (m *MQTTClient) startLogStream(level string) error {
+	if logStream == nil {
+		return fmt.Errorf("log streaming is disabled")
+	}
+	if level == "" {
+		level = LogLevelInfo
+	}
+
+	topic := deviceTopic("logs")
+	started := logStream.Start(level, func(line LogLine) error {
+		// publish would log a missing connection, feeding the stream itself
+		if m.client == nil {
+			return errNotConnected
+		}
+		payload, err := json.Marshal(line)
+		if err != nil {
+			return err
+		}
+		return m.publish(topic, payload)
+	})
+	if !started {
+		return fmt.Errorf("unknown log level %q", level)
+	}
+	return nil
+}
+
+// publishConfigAudit sends a configuration change to <thingName>/audit/config
+func (m *MQTTClient) publishConfigAudit(event ConfigAudit) {
+	payload, err := json.Marshal(event)
+	if err != nil {
+		log.Printf("Failed to marshal config audit: %v", err)
+		return
+	}
+	if err := m.publish(deviceTopic("audit/config"), payload); err != nil {
+		log.Printf("Failed to publish config audit: %v", err)
+	}
+}
+
+func (m *MQTTClient) sendAdminAck(ack AdminAck) {
+	ack.Schema = AdminAckSchema
+	payload, err := json.Marshal(ack)
+	if err != nil {
+		log.Printf("Failed to marshal admin ack: %v", err)
+		return
+	}
+	if err := m.publish(deviceTopic("admin/ack"), payload); err != nil {
+		log.Printf("Failed to send admin ack: %v", err)
+	}
+}
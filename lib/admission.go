@@ -0,0 +1,69 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+)
+
+// Peer admission policies, see peerAdmissionPolicy
+const (
+	AdmitReject      = "reject"
+	AdmitEvictOldest = "evict-oldest"
+)
+
+// Offer error codes, see OfferError
+const (
+	OfferErrorPeerLimit   = "peer_limit"
+	OfferErrorMaintenance = "maintenance"
+)
+
+// errPeerLimit is returned for offers from new peers while maxPeers peers
+// are connected
+var errPeerLimit = errors.New("peer limit reached")
+
+// admissionFull reports whether peerID would take a new connection while
+// the maxPeers are in use, with w.mu held. A peer replacing its own
+// connection is always admitted.
+func (w *WebRTCManager) admissionFull(peerID string) bool {
+	if maxPeers <= 0 {
+		return false
+	}
+	if _, exists := w.peerConnections[peerID]; exists {
+		return false
+	}
+	return len(w.peerConnections) >= maxPeers
+}
+
+// oldestViewer returns the viewer connected longest, the one
+// AdmitEvictOldest disconnects, or "" if no viewer is connected, with w.mu
+// held. Operators are never evicted.
+func (w *WebRTCManager) oldestViewer() string {
+	oldest := ""
+	for id := range w.peerConnections {
+		if w.peerRoles[id] != RoleViewer {
+			continue
+		}
+		if oldest == "" || w.peerCreated[id].Before(w.peerCreated[oldest]) {
+			oldest = id
+		}
+	}
+	return oldest
+}
+
+// offerError describes why ProcessOffer turned peerID away, for err
+// returned by it; ok is false for failures the peer is not told about
+func offerError(peerID string, err error) (OfferError, bool) {
+	switch {
+	case errors.Is(err, errPeerLimit):
+		return OfferError{
+			Schema:   OfferErrorSchema,
+			PeerID:   peerID,
+			Code:     OfferErrorPeerLimit,
+			Message:  fmt.Sprintf("%d peers already connected", maxPeers),
+			MaxPeers: maxPeers,
+		}, true
+	case errors.Is(err, errMaintenance):
+		return OfferError{Schema: OfferErrorSchema, PeerID: peerID, Code: OfferErrorMaintenance, Message: err.Error()}, true
+	}
+	return OfferError{}, false
+}
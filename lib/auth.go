@@ -0,0 +1,187 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// Offer authentication modes, see offerAuthMode
+const (
+	AuthNone     = ""
+	AuthJWT      = "jwt"
+	AuthEndpoint = "endpoint"
+)
+
+// maxAuthResponseSize bounds the auth endpoint response body read for a role
+const maxAuthResponseSize = 64 * 1024
+
+// errMissingToken is returned for offers without a token when auth is on
+var errMissingToken = errors.New("offer has no auth token")
+
+// errNoJWTSecret refuses jwt mode without a secret: an empty HMAC key would
+// let anyone sign tokens, operator ones included
+var errNoJWTSecret = errors.New("offerAuthMode is jwt but offerAuthJWTSecret is empty")
+
+// checkOfferAuth reports a configuration offerAuthMode cannot be trusted
+// with, for RMCSInit to refuse
+func checkOfferAuth() error {
+	if offerAuthMode == AuthJWT && offerAuthJWTSecret == "" {
+		return errNoJWTSecret
+	}
+	return nil
+}
+
+// OfferEnvelope is the JSON form of an MQTT offer, used to send a token,
+// the peer's metadata or a resume token along with the SDP. A bare SDP
+// string is still accepted as an offer without any.
+type OfferEnvelope struct {
+	SDP      string        `json:"sdp"`
+	Token    string        `json:"token,omitempty"`
+	Metadata *PeerMetadata `json:"metadata,omitempty"`
+	// Resume is the token of the session the offer resumes, see resume.go
+	Resume string `json:"resume,omitempty"`
+}
+
+// parseOffer reads an offer payload, either form
+func parseOffer(payload []byte) (OfferEnvelope, error) {
+	if !strings.HasPrefix(strings.TrimSpace(string(payload)), "{") {
+		return OfferEnvelope{SDP: string(payload)}, nil
+	}
+
+	var envelope OfferEnvelope
+	if err := json.Unmarshal(payload, &envelope); err != nil {
+		return OfferEnvelope{}, fmt.Errorf("invalid offer envelope: %v", err)
+	}
+	return envelope, nil
+}
+
+// authorizeOffer checks peerID's token according to offerAuthMode and
+// returns the role it grants, see grantedRole
+func authorizeOffer(peerID string, token string) (string, error) {
+	if offerAuthMode == AuthNone {
+		return defaultPeerRole, nil
+	}
+	if token == "" {
+		return "", errMissingToken
+	}
+
+	var (
+		role string
+		err  error
+	)
+	switch offerAuthMode {
+	case AuthJWT:
+		if offerAuthJWTSecret == "" {
+			return "", errNoJWTSecret
+		}
+		role, err = validateJWT(token, []byte(offerAuthJWTSecret), time.Now())
+	case AuthEndpoint:
+		role, err = validateTokenAtEndpoint(offerAuthEndpoint, peerID, token)
+	default:
+		err = fmt.Errorf("unknown auth mode %q", offerAuthMode)
+	}
+	if err != nil {
+		return "", err
+	}
+	return grantedRole(role), nil
+}
+
+// jwtClaims are the registered claims checked on operator tokens, plus the
+// optional role the token grants
+type jwtClaims struct {
+	ExpiresAt int64  `json:"exp"`
+	NotBefore int64  `json:"nbf"`
+	Role      string `json:"role"`
+}
+
+// validateJWT verifies an HS256-signed JWT and its exp and nbf claims, and
+// returns its role claim
+func validateJWT(token string, secret []byte, now time.Time) (string, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return "", fmt.Errorf("malformed JWT")
+	}
+
+	headerJSON, err := base64.RawURLEncoding.DecodeString(parts[0])
+	if err != nil {
+		return "", fmt.Errorf("malformed JWT header: %v", err)
+	}
+	var header struct {
+		Alg string `json:"alg"`
+	}
+	if err := json.Unmarshal(headerJSON, &header); err != nil {
+		return "", fmt.Errorf("malformed JWT header: %v", err)
+	}
+	// Only the configured algorithm, never "none"
+	if header.Alg != "HS256" {
+		return "", fmt.Errorf("unsupported JWT algorithm %q", header.Alg)
+	}
+
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return "", fmt.Errorf("malformed JWT signature: %v", err)
+	}
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(parts[0] + "." + parts[1]))
+	if !hmac.Equal(signature, mac.Sum(nil)) {
+		return "", fmt.Errorf("invalid JWT signature")
+	}
+
+	claimsJSON, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return "", fmt.Errorf("malformed JWT claims: %v", err)
+	}
+	var claims jwtClaims
+	if err := json.Unmarshal(claimsJSON, &claims); err != nil {
+		return "", fmt.Errorf("malformed JWT claims: %v", err)
+	}
+	if claims.ExpiresAt != 0 && !now.Before(time.Unix(claims.ExpiresAt, 0)) {
+		return "", fmt.Errorf("JWT expired")
+	}
+	if claims.NotBefore != 0 && now.Before(time.Unix(claims.NotBefore, 0)) {
+		return "", fmt.Errorf("JWT not valid yet")
+	}
+	return claims.Role, nil
+}
+
+// validateTokenAtEndpoint asks the auth service whether token may view this
+// robot. The token is sent as a bearer token with the peer and thing names
+// as query parameters; any 2xx response accepts it. A JSON body like
+// {"role": "viewer"} sets the role granted.
+func validateTokenAtEndpoint(endpoint string, peerID string, token string) (string, error) {
+	request, err := http.NewRequest(http.MethodGet, endpoint, nil)
+	if err != nil {
+		return "", fmt.Errorf("invalid auth endpoint: %v", err)
+	}
+	query := request.URL.Query()
+	query.Set("peerId", peerID)
+	query.Set("thing", identity.ThingName)
+	request.URL.RawQuery = query.Encode()
+	request.Header.Set("Authorization", "Bearer "+token)
+
+	client := http.Client{Timeout: offerAuthTimeout}
+	response, err := client.Do(request)
+	if err != nil {
+		return "", fmt.Errorf("auth endpoint unreachable: %v", err)
+	}
+	defer response.Body.Close()
+
+	if response.StatusCode < 200 || response.StatusCode > 299 {
+		return "", fmt.Errorf("token rejected by auth endpoint (%s)", response.Status)
+	}
+
+	var grant struct {
+		Role string `json:"role"`
+	}
+	// Bodies that are not JSON grant the default role
+	json.NewDecoder(io.LimitReader(response.Body, maxAuthResponseSize)).Decode(&grant)
+	return grant.Role, nil
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"strings"
+	"time"
+
+	"github.com/pion/sdp/v3"
+)
+
+// Per-peer bandwidth caps: a peer may be sent at most its cap, the lowest
+// of its role's (viewerMaxBitrate or operatorMaxBitrate), the maxBitrate of
+// its capabilities and the b=TIAS or b=AS of its offer's video, where a
+// browser on a metered link says what it wants to receive. Adaptive bitrate
+// counts a capped peer's estimate as no higher than its cap, so the quality
+// rung drops for it as it would for a slow link, and REMB or TWCC lower it
+// further when the link carries less.
+
+// roleMaxBitrate returns the cap of role, 0 for none
+func roleMaxBitrate(role string) int {
+	if role == RoleViewer {
+		return viewerMaxBitrate
+	}
+	return operatorMaxBitrate
+}
+
+// peerMaxBitrate returns the cap of a peer answered with caps for offerSDP,
+// 0 for none
+func peerMaxBitrate(caps PeerCapabilities, offerSDP string) int {
+	limit := 0
+	for _, candidate := range []int{roleMaxBitrate(caps.Role), caps.MaxBitrate, offerVideoBitrate(offerSDP)} {
+		if candidate > 0 && (limit == 0 || candidate < limit) {
+			limit = candidate
+		}
+	}
+	return limit
+}
+
+// offerVideoBitrate returns the lowest bandwidth the video sections of
+// offerSDP, or the session, allow in bits per second, 0 if they set none
+func offerVideoBitrate(offerSDP string) int {
+	var offer sdp.SessionDescription
+	if err := offer.UnmarshalString(offerSDP); err != nil {
+		return 0
+	}
+
+	limit := 0
+	lower := func(bandwidths []sdp.Bandwidth) {
+		for _, bandwidth := range bandwidths {
+			var bps int
+			switch strings.ToUpper(bandwidth.Type) {
+			case "TIAS":
+				bps = int(bandwidth.Bandwidth)
+			case "AS":
+				bps = int(bandwidth.Bandwidth) * 1000
+			default:
+				continue
+			}
+			if bps > 0 && (limit == 0 || bps < limit) {
+				limit = bps
+			}
+		}
+	}
+	lower(offer.Bandwidth)
+	for _, media := range offer.MediaDescriptions {
+		if media.MediaName.Media == "video" {
+			lower(media.Bandwidth)
+		}
+	}
+	return limit
+}
+
+// budget returns what the peer can be sent: its estimate, lowered to its
+// cap, or the cap alone if there is no estimate yet
+func (b *peerBandwidth) budget(now time.Time) int {
+	estimate := b.estimate(now)
+	if b.limit > 0 && (estimate == 0 || estimate > b.limit) {
+		return b.limit
+	}
+	return estimate
+}
+
+// PeerMaxBitrate returns the bits per second peerID is capped at, 0 if it
+// is not capped or unknown
+func (w *WebRTCManager) PeerMaxBitrate(peerID string) int {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if bandwidth, ok := w.bandwidth[peerID]; ok {
+		return bandwidth.limit
+	}
+	return 0
+}
@@ -0,0 +1,123 @@
+package main
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Frame broadcaster: besides its track, each stream hands every access
+// unit it streams to a FrameBroadcaster, which fans it out to the other
+// consumers of the stream: the snapshotter (see snapshot.go), the codec
+// fallback transcoder (see transcoder.go), or a recorder of the host
+// application's. Each consumer has its own queue and goroutine, so a
+// consumer falling behind drops its own access units without holding up
+// the track or the other consumers, and the track falling behind (see
+// frame_queue.go) does not starve them. After a drop a consumer skips to
+// the next keyframe, so what it gets stays decodable. Units are published
+// before the track's queue and before end-to-end encryption.
+
+// AccessUnit is one encoded frame of a stream, as the Annex B sample
+// written to its track, SEI and any parameter sets included. Data is shared
+// by every consumer and must not be modified.
+type AccessUnit struct {
+	Data     []byte
+	Captured time.Time
+	Keyframe bool // Data has an IDR
+}
+
+// FrameBroadcaster fans a stream's access units out to its consumers
+type FrameBroadcaster struct {
+	consumers []*FrameConsumer
+	mu        sync.Mutex
+}
+
+// FrameConsumer receives a stream's access units, see
+// FrameBroadcaster.Subscribe
+type FrameConsumer struct {
+	name          string
+	units         chan AccessUnit
+	keyframesOnly bool
+	// waitKeyframe skips units until the next keyframe, guarded by the
+	// broadcaster's mu
+	waitKeyframe bool
+	dropped      atomic.Uint64
+}
+
+// Subscribe has fn called with every access unit from the next keyframe
+// on, on a goroutine of its own, until Unsubscribe. Up to size units wait
+// for fn before they are dropped; name labels the consumer's metrics.
+func (b *FrameBroadcaster) Subscribe(name string, size int, fn func(unit AccessUnit)) *FrameConsumer {
+	return b.subscribe(&FrameConsumer{name: name, units: make(chan AccessUnit, size), waitKeyframe: true}, fn)
+}
+
+// SubscribeKeyframes is Subscribe for keyframes only
+func (b *FrameBroadcaster) SubscribeKeyframes(name string, size int, fn func(unit AccessUnit)) *FrameConsumer {
+	return b.subscribe(&FrameConsumer{name: name, units: make(chan AccessUnit, size), keyframesOnly: true}, fn)
+}
+
+func (b *FrameBroadcaster) subscribe(consumer *FrameConsumer, fn func(unit AccessUnit)) *FrameConsumer {
+	b.mu.Lock()
+	b.consumers = append(b.consumers, consumer)
+	b.mu.Unlock()
+
+	go func() {
+		for unit := range consumer.units {
+			fn(unit)
+		}
+	}()
+	return consumer
+}
+
+// Unsubscribe stops consumer. Units it already queued are still handed to
+// its fn, which may be running as Unsubscribe returns.
+func (b *FrameBroadcaster) Unsubscribe(consumer *FrameConsumer) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	for i, candidate := range b.consumers {
+		if candidate == consumer {
+			b.consumers = append(b.consumers[:i], b.consumers[i+1:]...)
+			close(consumer.units)
+			return
+		}
+	}
+}
+
+// Publish hands unit to every consumer that has room for it. Its data is
+// copied, once, only if a consumer takes it, so the caller's buffer can be
+// reused as soon as Publish returns.
+func (b *FrameBroadcaster) Publish(unit AccessUnit) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	var shared []byte
+	for _, consumer := range b.consumers {
+		if !unit.Keyframe && (consumer.keyframesOnly || consumer.waitKeyframe) {
+			continue
+		}
+		if shared == nil {
+			shared = append([]byte(nil), unit.Data...)
+		}
+		queued := unit
+		queued.Data = shared
+		select {
+		case consumer.units <- queued:
+			consumer.waitKeyframe = false
+		default:
+			consumer.dropped.Add(1)
+			consumer.waitKeyframe = true
+			metrics.Inc("broadcast.dropped." + consumer.name)
+		}
+	}
+}
+
+// Pending returns how many units wait for the consumer
+func (c *FrameConsumer) Pending() int {
+	return len(c.units)
+}
+
+// Dropped returns how many units the consumer had no room for
+func (c *FrameConsumer) Dropped() uint64 {
+	return c.dropped.Load()
+}
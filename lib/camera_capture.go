@@ -0,0 +1,207 @@
+package main
+
+import (
+	"fmt"
+	"net/url"
+	"os/exec"
+	"runtime"
+	"strconv"
+	"strings"
+)
+
+// Camera capture: a camera whose entry in cameraDirectories is
+// "capture:<device>" is captured from a camera attached to the host by
+// captureCommand (ffmpeg), encoded at captureBitrate with the encoder
+// captureEncoder selects (see encoder.go), and streamed as a process source
+// (see process_source.go). Devices are V4L2's on Linux, /dev/videoN or just
+// N, and avfoundation's on macOS, by index or name. The entry can set the
+// device's pixel format, resolution and frame rate, otherwise
+// capturePixelFormat, captureWidth x captureHeight and captureFPS:
+//
+//	"capture:/dev/video2?format=mjpeg&size=1920x1080&fps=15"
+//
+// "capture:testpattern" streams the test pattern, see test_pattern.go. The
+// entry's crop, flip and rotate options turn the picture upright, see
+// orientation.go. The
+// entry's profile option picks the encoder profile, e.g. profile=quality
+// (see encoder.go). A keyframe goes out every second, or two with the
+// quality profile, or sooner by restarting ffmpeg, see process_source.go.
+// Bitrate, resolution and profile can be changed while the camera streams,
+// see capture_settings.go. Legacy cameras streaming MJPEG over HTTP are
+// captured the same way, see mjpeg_source.go, and so are ROS image topics,
+// see ros_source.go.
+
+// captureConfig is what a camera entry captures
+type captureConfig struct {
+	device      string
+	pixelFormat string // the device's, e.g. yuyv422 or mjpeg; "" for its default
+	width       int
+	height      int
+	fps         int
+	bitrate     int    // encoded at
+	profile     string // encoder profile, see encoder.go
+	orientation cameraOrientation
+	mjpeg       bool // device is an MJPEG stream's URL, see mjpeg_source.go
+	ros         bool // device is a ROS image topic, see ros_source.go
+	every       int  // a ROS topic's images taken, 1 in every; 0 for all
+	// thermal colors a ROS topic's 16-bit images, see thermal.go
+	thermal thermalOptions
+}
+
+// captureDevice returns the capture a "capture:<device>", "mjpeg:<url>" or
+// "ros:<topic>" camera entry configures. ok is false for other entries.
+func captureDevice(address string) (config captureConfig, ok bool) {
+	if config, ok := mjpegStream(address); ok {
+		return config, true
+	}
+	if config, ok := rosImageTopic(address); ok {
+		return config, true
+	}
+	device, ok := strings.CutPrefix(address, "capture:")
+	if !ok {
+		return captureConfig{}, false
+	}
+	config = captureConfig{
+		pixelFormat: capturePixelFormat,
+		width:       captureWidth,
+		height:      captureHeight,
+		fps:         captureFPS,
+		bitrate:     captureBitrate,
+		profile:     captureProfile,
+	}
+	device, options, _ := strings.Cut(device, "?")
+	config.device = device
+	if runtime.GOOS == "linux" {
+		if _, err := strconv.Atoi(device); err == nil {
+			config.device = "/dev/video" + device
+		}
+	}
+
+	values, _ := url.ParseQuery(options)
+	if format := values.Get("format"); format != "" {
+		config.pixelFormat = format
+	}
+	config.orientation = orientationOptions(values)
+	return captureOptions(config, values), true
+}
+
+// captureOptions applies the size, fps and profile options of a camera
+// entry to config
+func captureOptions(config captureConfig, values url.Values) captureConfig {
+	if size := values.Get("size"); size != "" {
+		width, height, _ := strings.Cut(size, "x")
+		w, errW := strconv.Atoi(width)
+		h, errH := strconv.Atoi(height)
+		if errW == nil && errH == nil && w > 0 && h > 0 {
+			config.width, config.height = w, h
+		}
+	}
+	if fps, err := strconv.Atoi(values.Get("fps")); err == nil && fps > 0 {
+		config.fps = fps
+	}
+	if profile := values.Get("profile"); profile != "" {
+		config.profile = profile
+	}
+	return config
+}
+
+// newCameraCapture returns a source capturing config's device
+func newCameraCapture(config captureConfig) (*processSource, error) {
+	if config.ros {
+		return newROSCapture(config)
+	}
+	if runtime.GOOS != "linux" && runtime.GOOS != "darwin" && config.device != testPatternDevice && !config.mjpeg {
+		return nil, fmt.Errorf("cannot capture %s: camera capture needs V4L2 on Linux or avfoundation on macOS", config.device)
+	}
+	if _, err := config.orientation.filters(); err != nil {
+		return nil, fmt.Errorf("cannot capture %s: %v", config.device, err)
+	}
+
+	var encoder h264Encoder // of the current run
+	source := &processSource{
+		name:         "camera capture " + config.device,
+		timeout:      captureTimeout,
+		restartDelay: captureRestartDelay,
+		metric:       "capture.restarts",
+		progress:     true,
+	}
+	source.command = func(port int) (*exec.Cmd, error) {
+		encoder = captureEncoders.selectEncoder()
+		return exec.Command(captureCommand, captureArgs(config, encoder, port)...), nil
+	}
+	source.cost = func() float64 {
+		return captureCost(config, captureEncoders.selectEncoder())
+	}
+	source.ended = func(frames int, err error) {
+		// Capturing nothing at all is likely the encoder's fault, a
+		// hardware encoder without its hardware
+		if frames == 0 {
+			captureEncoders.markFailed(encoder.name)
+		}
+	}
+	return source, nil
+}
+
+// captureCost estimates the CPU cores capturing config with encoder takes,
+// scaling the encoder's cost at 1080p30 by the pixels encoded and the
+// profile's cost
+func captureCost(config captureConfig, encoder h264Encoder) float64 {
+	profile := lookupEncoderProfile(config.profile)
+	return captureInputCost + encoder.cost*profile.cost*float64(config.width*config.height*config.fps)/(1920*1080*30)
+}
+
+// captureArgs returns the ffmpeg arguments capturing config with encoder,
+// sending RTP to port
+func captureArgs(config captureConfig, encoder h264Encoder, port int) []string {
+	args := []string{"-hide_banner", "-loglevel", "error", "-progress", "pipe:1"}
+	args = append(args, encoder.inputArgs...)
+	args = append(args, captureInputArgs(config)...)
+	// Checked as the source was created
+	filters, _ := config.orientation.filters()
+	if config.mjpeg {
+		filters = append(filters, mjpegFilters(config)...)
+	}
+	if encoder.filter != "" {
+		filters = append(filters, encoder.filter)
+	}
+	if len(filters) > 0 {
+		args = append(args, "-vf", strings.Join(filters, ","))
+	}
+	return append(args, encodeArgs(config, encoder, port)...)
+}
+
+// encodeArgs returns the ffmpeg arguments encoding with encoder at config's
+// bitrate and profile, and sending RTP to port
+func encodeArgs(config captureConfig, encoder h264Encoder, port int) []string {
+	profile := lookupEncoderProfile(config.profile)
+	args := encoder.outputArgs(config.bitrate, profile.gopFrames(config.fps), profile)
+	// Parameter sets with every keyframe, for peers joining mid-GOP
+	return append(args, "-bsf:v", "dump_extra=freq=keyframe", "-an",
+		"-f", "rtp", "-payload_type", strconv.Itoa(processPayloadType),
+		fmt.Sprintf("rtp://127.0.0.1:%d?pkt_size=%d", port, rtpMTU))
+}
+
+// captureInputArgs returns the ffmpeg arguments opening config's device
+// with the platform's capture API
+func captureInputArgs(config captureConfig) []string {
+	if config.device == testPatternDevice {
+		return testPatternInputArgs(config)
+	}
+	if config.mjpeg {
+		return mjpegInputArgs(config)
+	}
+	args := []string{
+		"-framerate", strconv.Itoa(config.fps),
+		"-video_size", fmt.Sprintf("%dx%d", config.width, config.height),
+	}
+	if runtime.GOOS == "darwin" {
+		if config.pixelFormat != "" {
+			args = append(args, "-pixel_format", config.pixelFormat)
+		}
+		return append([]string{"-f", "avfoundation"}, append(args, "-i", config.device+":none")...)
+	}
+	if config.pixelFormat != "" {
+		args = append(args, "-input_format", config.pixelFormat)
+	}
+	return append([]string{"-f", "v4l2"}, append(args, "-i", config.device)...)
+}
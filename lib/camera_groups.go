@@ -0,0 +1,129 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"strings"
+)
+
+// ControlCameraGroup switches camera groups from the control channel; the
+// payload is the group name
+const ControlCameraGroup = "camera-group"
+
+// cameraGroups are the named sets of cameras switched together, in output
+// order: the first camera goes to the first video track, the second to the
+// second, and so on. Groups can have at most videoOutputCount cameras.
+var cameraGroups = map[string][]int{
+	"front-pair": {1, 2},
+	"rear-pair":  {3, 4},
+	"side-pair":  {5, 6},
+}
+
+// SwitchCameraGroup switches every camera of the named group onto its video
+// track at once. All cameras' files are found before any output changes, so
+// a missing camera leaves the previous group playing on every screen, and
+// the outputs switch together between two frames so matched pairs never
+// show mismatched cameras.
+func (w *WebRTCManager) SwitchCameraGroup(name string) error {
+	cameras, ok := cameraGroups[name]
+	if !ok {
+		return fmt.Errorf("unknown camera group %q", name)
+	}
+	if len(cameras) > len(w.outputs) {
+		return fmt.Errorf("camera group %q has %d cameras but only %d video tracks (videoOutputCount)", name, len(cameras), len(w.outputs))
+	}
+
+	w.switchMu.Lock()
+	defer w.switchMu.Unlock()
+
+	// Cameras with registered sources are switched after the rest, their
+	// sources opening as they are, see loadCamera
+	files := make([][]string, len(cameras))
+	for i, cameraNumber := range cameras {
+		if !w.validCamera(cameraNumber) {
+			return fmt.Errorf("camera group %q: invalid camera number %d", name, cameraNumber)
+		}
+		if _, fromSource := w.cameraFactory(cameraNumber); fromSource {
+			continue
+		}
+		var err error
+		if files[i], err = findH264Files(w.rendition(cameraDirectories[cameraNumber])); err != nil {
+			w.events.emitSourceError(SourceErrorEvent{TrackID: w.outputs[i].track.ID(), Camera: cameraNumber, Err: err})
+			return fmt.Errorf("camera group %q: failed to load camera %d files: %v", name, cameraNumber, err)
+		}
+	}
+
+	// Holding every file source at once keeps any of them from sending a
+	// frame until all have switched
+	outputs := w.outputs[:len(cameras)]
+	sources := make([]*fileSource, len(cameras))
+	for i, output := range outputs {
+		if files[i] != nil {
+			sources[i] = output.streamer.files()
+		}
+	}
+	for _, source := range sources {
+		if source != nil {
+			source.mu.Lock()
+		}
+	}
+	for i, output := range outputs {
+		if sources[i] != nil {
+			sources[i].useFilesLocked(files[i])
+			output.camera.Store(int32(cameras[i]))
+		}
+	}
+	for _, source := range sources {
+		if source != nil {
+			source.mu.Unlock()
+		}
+	}
+	for i, output := range outputs {
+		if sources[i] != nil {
+			output.loadLayers(cameraDirectories[cameras[i]])
+			continue
+		}
+		if err := w.loadCamera(output, cameras[i]); err != nil {
+			w.events.emitSourceError(SourceErrorEvent{TrackID: output.track.ID(), Camera: cameras[i], Err: err})
+			return fmt.Errorf("camera group %q: %v", name, err)
+		}
+		output.camera.Store(int32(cameras[i]))
+	}
+
+	log.Printf("Switched to camera group %s: cameras %v", name, cameras)
+	metrics.Inc("camera.group_switches")
+	for i, output := range outputs {
+		w.events.emitCameraSwitched(CameraEvent{TrackID: output.track.ID(), Camera: cameras[i], Group: name})
+	}
+
+	w.mu.Lock()
+	sessions := w.sessions
+	w.mu.Unlock()
+	if sessions != nil {
+		sessions.SetCamera(cameras[0])
+	}
+	return nil
+}
+
+// handleCameraGroup switches to the camera group named in the payload
+func (m *MQTTClient) handleCameraGroup(topic string, payload []byte) {
+	name := strings.TrimSpace(string(payload))
+	log.Printf("Camera group switch request received on topic %s: %s", topic, name)
+
+	if err := m.webrtcManager.SwitchCameraGroup(name); err != nil {
+		log.Printf("Failed to switch camera group: %v", err)
+	}
+}
+
+// cameraGroupControl switches camera groups from the control channel; the
+// payload is the group name as a JSON string
+func cameraGroupControl(manager *WebRTCManager) ControlHandler {
+	return ControlHandlerFunc(func(peerID string, payload json.RawMessage) error {
+		var name string
+		if err := json.Unmarshal(payload, &name); err != nil {
+			return fmt.Errorf("invalid camera group: %s", payload)
+		}
+		return manager.SwitchCameraGroup(name)
+	})
+}
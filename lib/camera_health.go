@@ -0,0 +1,224 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Camera health statuses and degradation reasons, see CameraStatus
+const (
+	CameraUnknown  = "unknown"
+	CameraOK       = "ok"
+	CameraDegraded = "degraded"
+
+	DegradedBlack   = "black"
+	DegradedFrozen  = "frozen"
+	DegradedStalled = "stalled" // no frames at all, see stall_watchdog.go
+)
+
+// cameraDirectories maps camera numbers to their H.264 frame directories
+var cameraDirectories = map[int]string{
+	1: "h264/flir_id8_image_resized_30fps",
+	2: "h264/leopard_id1_image_resized_30fps",
+	3: "h264/leopard_id3_image_resized_30fps",
+	4: "h264/leopard_id4_image_resized_30fps",
+	5: "h264/leopard_id5_image_resized_30fps",
+	6: "h264/leopard_id6_image_resized_30fps",
+	7: "h264/leopard_id7_image_resized_30fps",
+}
+
+// frameAnalyzer looks at one camera's encoded frames without decoding them.
+// A frame byte-identical to the previous one (a stuck driver resending its
+// buffer) or a P-frame so small that every macroblock is skipped (an
+// unchanged picture, which real sensor noise never produces) counts towards
+// frozen. An IDR frame small enough to be a flat picture counts towards
+// black. Either has to last cameraHealthWindow to degrade the camera.
+type frameAnalyzer struct {
+	lastChecksum uint32
+	frozenSince  time.Time
+	blackSince   time.Time
+}
+
+// observe classifies a length-prefixed frame and returns the degradation
+// reason, if any, that has lasted the whole window at now
+func (a *frameAnalyzer) observe(data []byte, now time.Time) string {
+	checksum := frameChecksum(data)
+	identical := checksum == a.lastChecksum
+	a.lastChecksum = checksum
+
+	idr := false
+	sliceBytes := 0
+	forEachNAL(data, func(nal []byte) {
+		switch nal[0] & 0x1F {
+		case NAL_TYPE_IDR:
+			idr = true
+			sliceBytes += len(nal)
+		case NAL_TYPE_NON_IDR:
+			sliceBytes += len(nal)
+		}
+	})
+
+	// IDRs of a frozen picture are full size, so they neither start nor end it
+	frozen := identical || (!idr && sliceBytes > 0 && sliceBytes <= frozenFrameMaxBytes)
+	if frozen {
+		if a.frozenSince.IsZero() {
+			a.frozenSince = now
+		}
+	} else if !idr {
+		a.frozenSince = time.Time{}
+	}
+
+	// Black is judged on IDRs, the only frames whose size reflects content
+	if idr {
+		if sliceBytes <= blackFrameMaxBytes {
+			if a.blackSince.IsZero() {
+				a.blackSince = now
+			}
+		} else {
+			a.blackSince = time.Time{}
+		}
+	}
+
+	switch {
+	case !a.blackSince.IsZero() && now.Sub(a.blackSince) >= cameraHealthWindow:
+		return DegradedBlack
+	case !a.frozenSince.IsZero() && now.Sub(a.frozenSince) >= cameraHealthWindow:
+		return DegradedFrozen
+	}
+	return ""
+}
+
+// forEachNAL calls fn with every NAL unit of a length-prefixed frame
+func forEachNAL(data []byte, fn func(nal []byte)) {
+	i := 0
+	for i+4 <= len(data) {
+		length := int(uint32(data[i])<<24 | uint32(data[i+1])<<16 | uint32(data[i+2])<<8 | uint32(data[i+3]))
+		start := i + 4
+		end := start + length
+		if length == 0 || end > len(data) {
+			return
+		}
+		fn(data[start:end])
+		i = end
+	}
+}
+
+// CameraHealth keeps the availability list: the status of every camera,
+// updated from the frames of whichever camera is streaming
+type CameraHealth struct {
+	analyzers map[int]*frameAnalyzer
+	statuses  map[int]CameraStatus
+	onChange  func(CameraList)
+	mu        sync.Mutex
+}
+
+func NewCameraHealth() *CameraHealth {
+	h := &CameraHealth{
+		analyzers: make(map[int]*frameAnalyzer),
+		statuses:  make(map[int]CameraStatus),
+	}
+	now := time.Now()
+	for camera := range cameraDirectories {
+		h.statuses[camera] = CameraStatus{Camera: camera, Status: CameraUnknown, Since: now}
+	}
+	return h
+}
+
+// SetOnChange registers fn to receive the list whenever a status changes
+func (h *CameraHealth) SetOnChange(fn func(CameraList)) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.onChange = fn
+}
+
+// Observe analyses a frame streamed from camera
+func (h *CameraHealth) Observe(camera int, data []byte) {
+	now := time.Now()
+
+	h.mu.Lock()
+	analyzer, ok := h.analyzers[camera]
+	if !ok {
+		analyzer = &frameAnalyzer{}
+		h.analyzers[camera] = analyzer
+	}
+	reason := analyzer.observe(data, now)
+
+	status := CameraStatus{Camera: camera, Status: CameraOK}
+	if reason != "" {
+		status.Status = CameraDegraded
+		status.Reason = reason
+	}
+	previous := h.statuses[camera]
+	if previous.Status == status.Status && previous.Reason == status.Reason {
+		h.mu.Unlock()
+		return
+	}
+	status.Since = now
+	h.statuses[camera] = status
+	onChange := h.onChange
+	h.mu.Unlock()
+
+	h.report(status, previous)
+	if onChange != nil {
+		onChange(h.List())
+	}
+}
+
+// SetStalled marks camera degraded for sending no frames, until it sends
+// one again
+func (h *CameraHealth) SetStalled(camera int) {
+	h.mu.Lock()
+	previous := h.statuses[camera]
+	if previous.Reason == DegradedStalled {
+		h.mu.Unlock()
+		return
+	}
+	status := CameraStatus{Camera: camera, Status: CameraDegraded, Reason: DegradedStalled, Since: time.Now()}
+	h.statuses[camera] = status
+	// Frames seen before the stall say nothing of those after it
+	delete(h.analyzers, camera)
+	onChange := h.onChange
+	h.mu.Unlock()
+
+	h.report(status, previous)
+	if onChange != nil {
+		onChange(h.List())
+	}
+}
+
+func (h *CameraHealth) report(status CameraStatus, previous CameraStatus) {
+	degraded := int64(0)
+	if status.Status == CameraDegraded {
+		degraded = 1
+		metrics.Inc(fmt.Sprintf("camera.%s_detected", status.Reason))
+		if status.Reason == DegradedStalled {
+			log.Printf("Camera %d degraded: no frames for %s", status.Camera, stallTimeout)
+		} else {
+			log.Printf("Camera %d degraded: %s frames for %s", status.Camera, status.Reason, cameraHealthWindow)
+		}
+	} else if previous.Status == CameraDegraded {
+		log.Printf("Camera %d recovered from %s frames", status.Camera, previous.Reason)
+	}
+	metrics.SetGauge(fmt.Sprintf("camera.%d.degraded", status.Camera), degraded)
+}
+
+// List returns the availability list, ordered by camera number
+func (h *CameraHealth) List() CameraList {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	list := CameraList{Schema: CameraListSchema, Cameras: make([]CameraStatus, 0, len(h.statuses))}
+	for _, status := range h.statuses {
+		list.Cameras = append(list.Cameras, status)
+	}
+	sort.Slice(list.Cameras, func(i, j int) bool { return list.Cameras[i].Camera < list.Cameras[j].Camera })
+	return list
+}
+
+func (h *CameraHealth) JSON() ([]byte, error) {
+	return json.Marshal(h.List())
+}
@@ -0,0 +1,136 @@
+package main
+
+import (
+	"fmt"
+	"log"
+)
+
+// Camera tracks: a peer that lists cameras in its capabilities gets a video
+// track per camera instead of the shared outputs, e.g. a main view and
+// thumbnails, and picks other cameras by offering again. Each camera's track
+// is shared by every peer requesting it and never switches camera, and is
+// stopped and dropped once no peer requests it. Once the answer is out, the
+// peer is told which mid carries which camera.
+
+// peerOutputs returns the outputs sent to a peer requesting cameras: a
+// track per camera in the order requested, or the shared outputs if none
+func (w *WebRTCManager) peerOutputs(cameras []int) ([]*videoOutput, error) {
+	if len(cameras) == 0 {
+		return w.outputs, nil
+	}
+
+	requested := make(map[int]bool)
+	var outputs []*videoOutput
+	for _, cameraNumber := range cameras {
+		if requested[cameraNumber] {
+			return nil, fmt.Errorf("camera %d requested twice", cameraNumber)
+		}
+		requested[cameraNumber] = true
+		output, err := w.cameraOutput(cameraNumber)
+		if err != nil {
+			return nil, err
+		}
+		outputs = append(outputs, output)
+	}
+	return outputs, nil
+}
+
+// cameraOutput returns camera's own track, creating it on first request
+func (w *WebRTCManager) cameraOutput(cameraNumber int) (*videoOutput, error) {
+	if !w.validCamera(cameraNumber) {
+		return nil, errInvalidCamera(cameraNumber)
+	}
+
+	w.outputsMu.Lock()
+	defer w.outputsMu.Unlock()
+
+	if output, ok := w.cameraOutputs[cameraNumber]; ok {
+		return output, nil
+	}
+	trackID := fmt.Sprintf("camera-%d", cameraNumber)
+	output, err := newVideoOutputWithIDs(trackID, trackID)
+	if err != nil {
+		return nil, err
+	}
+	// No frame observer: camera health watches the shared outputs, and a
+	// second stream of the same camera would interleave with theirs
+	if err := w.loadCamera(output, cameraNumber); err != nil {
+		w.events.emitSourceError(SourceErrorEvent{Camera: cameraNumber, Err: err})
+		return nil, err
+	}
+	output.camera.Store(int32(cameraNumber))
+	w.reportSourceErrors(output)
+	output.setEncryptor(w.e2ee)
+	w.cameraOutputs[cameraNumber] = output
+	log.Printf("Created track %s for camera %d", trackID, cameraNumber)
+	return output, nil
+}
+
+// dropUnusedCameraOutputs stops the camera tracks no peer in peerCameras
+// requests and forgets them, so their sources stop; w.mu must be held
+func (w *WebRTCManager) dropUnusedCameraOutputs() {
+	requested := make(map[int]bool)
+	for _, cameras := range w.peerCameras {
+		for _, cameraNumber := range cameras {
+			requested[cameraNumber] = true
+		}
+	}
+
+	var unused []*videoOutput
+	w.outputsMu.Lock()
+	for cameraNumber, output := range w.cameraOutputs {
+		if !requested[cameraNumber] {
+			unused = append(unused, output)
+			delete(w.cameraOutputs, cameraNumber)
+			log.Printf("Dropped track camera-%d, no peer requests it", cameraNumber)
+		}
+	}
+	w.outputsMu.Unlock()
+
+	for _, output := range unused {
+		output.streamer.StopStreaming()
+		for _, layer := range output.layers {
+			layer.streamer.StopStreaming()
+		}
+		if output.transcoder != nil {
+			output.transcoder.stopEncoder()
+		}
+	}
+}
+
+// allOutputs returns the shared outputs followed by the camera tracks
+func (w *WebRTCManager) allOutputs() []*videoOutput {
+	w.outputsMu.Lock()
+	defer w.outputsMu.Unlock()
+
+	outputs := append([]*videoOutput(nil), w.outputs...)
+	for _, output := range w.cameraOutputs {
+		outputs = append(outputs, output)
+	}
+	return outputs
+}
+
+// PeerTracks labels the camera tracks of peerID's connection with their
+// mids. ok is false for unknown peers and peers that requested no cameras.
+func (w *WebRTCManager) PeerTracks(peerID string) (PeerTracks, bool) {
+	w.mu.Lock()
+	peerConnection, exists := w.peerConnections[peerID]
+	cameras := w.peerCameras[peerID]
+	w.mu.Unlock()
+
+	if !exists || len(cameras) == 0 {
+		return PeerTracks{}, false
+	}
+
+	tracks := PeerTracks{Schema: PeerTracksSchema, PeerID: peerID, Tracks: []TrackLabel{}}
+	for _, cameraNumber := range cameras {
+		trackID := fmt.Sprintf("camera-%d", cameraNumber)
+		for _, transceiver := range peerConnection.GetTransceivers() {
+			sender := transceiver.Sender()
+			if sender != nil && sender.Track() != nil && sender.Track().ID() == trackID {
+				tracks.Tracks = append(tracks.Tracks, TrackLabel{Mid: transceiver.Mid(), TrackID: trackID, Camera: cameraNumber})
+			}
+		}
+	}
+	return tracks, true
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"sync"
+	"time"
+
+	"github.com/pion/webrtc/v4"
+)
+
+// candidateBatch collects the ICE candidates of one offer gathered within
+// candidateBatchWindow of the first, and sends them in one message. Pion
+// gathers host, server reflexive and relay candidates in quick succession,
+// so a connection's setup takes a few messages instead of one per
+// candidate.
+type candidateBatch struct {
+	send    func(candidates []webrtc.ICECandidateInit)
+	pending []webrtc.ICECandidateInit
+	timer   *time.Timer // pending flush, nil if nothing is waiting
+	mu      sync.Mutex
+}
+
+func newCandidateBatch(send func(candidates []webrtc.ICECandidateInit)) *candidateBatch {
+	return &candidateBatch{send: send}
+}
+
+// add queues candidate, to be sent with the others gathered within the
+// window
+func (b *candidateBatch) add(candidate webrtc.ICECandidateInit) {
+	b.addAll([]webrtc.ICECandidateInit{candidate})
+}
+
+// addAll queues candidates, to be sent with the others gathered within the
+// window
+func (b *candidateBatch) addAll(candidates []webrtc.ICECandidateInit) {
+	if len(candidates) == 0 {
+		return
+	}
+	if candidateBatchWindow <= 0 {
+		b.sendBatch(candidates)
+		return
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.pending = append(b.pending, candidates...)
+	if b.timer == nil {
+		b.timer = time.AfterFunc(candidateBatchWindow, b.flush)
+	}
+}
+
+// flush sends the queued candidates
+func (b *candidateBatch) flush() {
+	b.mu.Lock()
+	candidates := b.pending
+	b.pending = nil
+	b.timer = nil
+	b.mu.Unlock()
+
+	if len(candidates) > 0 {
+		b.sendBatch(candidates)
+	}
+}
+
+func (b *candidateBatch) sendBatch(candidates []webrtc.ICECandidateInit) {
+	metrics.Inc("signaling.candidate_messages")
+	metrics.Add("signaling.candidates_sent", uint64(len(candidates)))
+	b.send(candidates)
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+)
+
+// PeerCapabilities is what a frontend announces on
+// <baseTopic>/<peerId>/capabilities before sending its offer
+type PeerCapabilities struct {
+	// TrickleICE selects whether candidates are sent as separate messages.
+	// When false the answer is only sent once ICE gathering completes, with
+	// every local candidate embedded in its SDP.
+	TrickleICE bool `json:"trickleIce"`
+	// Encoding selects how candidates and telemetry are serialised, "json"
+	// or "cbor". Capabilities themselves are always JSON.
+	Encoding string `json:"encoding,omitempty"`
+	// Cameras, if set, asks for a video track per camera, main view first
+	// (see camera_tracks.go), instead of the shared switchable tracks
+	Cameras []int `json:"cameras,omitempty"`
+	// Role "viewer" asks for video only, without the control channel, even
+	// if the peer's token grants more. Signaler.HandleOffer replaces it with
+	// the role the offer is answered with.
+	Role string `json:"role,omitempty"`
+	// Metadata describes the peer's device, see peer_metadata.go. An offer
+	// that carries metadata replaces it.
+	Metadata PeerMetadata `json:"metadata"`
+	// MaxBitrate caps the bits per second the peer is sent, e.g. on a
+	// metered link, see bandwidth_cap.go. It can only lower its role's cap.
+	MaxBitrate int `json:"maxBitrate,omitempty"`
+	// SEIVersions lists the versions of the SEI frames are stamped with
+	// that the peer parses, see frame_info.go; [1] if unset
+	SEIVersions []int `json:"seiVersions,omitempty"`
+	// Resume is the resume token of the offer, see resume.go. A valid one
+	// replaces everything else announced with the session's capabilities.
+	Resume string `json:"resume,omitempty"`
+}
+
+// BackendCapabilities is published on <baseTopic>/<peerId>/capabilities/rmcs
+// in reply, so the frontend knows which options the backend understands
+type BackendCapabilities struct {
+	TrickleICE    bool     `json:"trickleIce"`
+	NonTrickleICE bool     `json:"nonTrickleIce"`
+	Encodings     []string `json:"encodings"`
+	SEIVersions   []int    `json:"seiVersions"`
+	// JPEGView is set when jpeg-view is understood, see mjpeg_view.go
+	JPEGView bool `json:"jpegView"`
+}
+
+// defaultPeerCapabilities applies to peers that never announce capabilities
+func defaultPeerCapabilities() PeerCapabilities {
+	return PeerCapabilities{
+		TrickleICE: true,
+		Encoding:   EncodingJSON,
+	}
+}
+
+func (m *MQTTClient) handleCapabilities(topic string, payload []byte) {
+	peerID, ok := peerIDFromTopic(topic)
+	if !ok {
+		return
+	}
+
+	// Fields the peer leaves out keep their defaults
+	caps := defaultPeerCapabilities()
+	if err := json.Unmarshal(payload, &caps); err != nil {
+		log.Printf("Failed to parse capabilities from %s: %v", peerID, err)
+		return
+	}
+	if caps.Encoding != EncodingJSON && caps.Encoding != EncodingCBOR {
+		log.Printf("[%s] Unsupported encoding %q, falling back to JSON", peerID, caps.Encoding)
+		caps.Encoding = EncodingJSON
+	}
+
+	m.mu.Lock()
+	m.peerCapabilities[peerID] = caps
+	m.mu.Unlock()
+	log.Printf("[%s] Capabilities: trickle ICE %v, encoding %s, cameras %v, role %q", peerID, caps.TrickleICE, caps.Encoding, caps.Cameras, caps.Role)
+
+	reply, err := json.Marshal(BackendCapabilities{
+		TrickleICE:    true,
+		NonTrickleICE: true,
+		Encodings:     supportedEncodings,
+		SEIVersions:   supportedSEIVersions(),
+		JPEGView:      true,
+	})
+	if err != nil {
+		log.Printf("Failed to marshal backend capabilities: %v", err)
+		return
+	}
+
+	replyTopic := peerTopic(peerID, "capabilities/rmcs")
+	if err := m.publish(replyTopic, reply); err != nil {
+		log.Printf("Failed to send capabilities: %v", err)
+	}
+}
+
+// capabilitiesFor returns what peerID announced, or the defaults
+func (m *MQTTClient) capabilitiesFor(peerID string) PeerCapabilities {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if caps, ok := m.peerCapabilities[peerID]; ok {
+		return caps
+	}
+	return defaultPeerCapabilities()
+}
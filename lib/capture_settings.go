@@ -0,0 +1,265 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+)
+
+// Runtime capture settings: the set-bitrate, set-resolution and
+// set-profile commands, on MQTT or the control channel, change the bitrate,
+// resolution or encoder profile (see encoder.go) a captured camera (see
+// camera_capture.go) is encoded with without restarting the stream. A second ffmpeg is launched with the new settings while the
+// first keeps streaming, and takes over the track at its first frame, an
+// IDR with its own parameter sets, so peers carry on without a gap or a
+// broken GOP. The settings last until the backend restarts, over camera
+// switches.
+
+// Control message types changing capture settings
+const (
+	ControlSetBitrate    = "set-bitrate"
+	ControlSetResolution = "set-resolution"
+	ControlSetProfile    = "set-profile"
+)
+
+// CaptureSettings is the payload of set-bitrate, e.g. {"camera": 8,
+// "bitrate": 1000000}, set-resolution, e.g. {"camera": 8, "width": 640,
+// "height": 360}, and set-profile, e.g. {"camera": 8, "profile":
+// "quality"}. Camera defaults to the first track's.
+type CaptureSettings struct {
+	Camera  int    `json:"camera,omitempty"`
+	Bitrate int    `json:"bitrate,omitempty"`
+	Width   int    `json:"width,omitempty"`
+	Height  int    `json:"height,omitempty"`
+	Profile string `json:"profile,omitempty"`
+}
+
+// captureOverrides applies the settings changed at runtime for cameraNumber
+// to config
+func (c *cameraSources) captureOverrides(cameraNumber int, config captureConfig) captureConfig {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	settings := c.settings[cameraNumber]
+	if settings.Bitrate > 0 {
+		config.bitrate = settings.Bitrate
+	}
+	if settings.Width > 0 && settings.Height > 0 {
+		config.width, config.height = settings.Width, settings.Height
+	}
+	if settings.Profile != "" {
+		config.profile = settings.Profile
+	}
+	return config
+}
+
+// SetCaptureBitrate encodes a captured camera at bitrate bits per second
+// from now on; camera 0 is the first track's
+func (w *WebRTCManager) SetCaptureBitrate(cameraNumber int, bitrate int) error {
+	if bitrate < 100000 || bitrate > 50000000 {
+		return fmt.Errorf("invalid bitrate %d (100000-50000000)", bitrate)
+	}
+	return w.setCaptureSettings(CaptureSettings{Camera: cameraNumber, Bitrate: bitrate})
+}
+
+// SetCaptureResolution captures a camera at width x height from now on;
+// camera 0 is the first track's
+func (w *WebRTCManager) SetCaptureResolution(cameraNumber int, width int, height int) error {
+	if width < 16 || height < 16 || width > 7680 || height > 4320 || width%2 != 0 || height%2 != 0 {
+		return fmt.Errorf("invalid resolution %dx%d", width, height)
+	}
+	return w.setCaptureSettings(CaptureSettings{Camera: cameraNumber, Width: width, Height: height})
+}
+
+// SetCaptureProfile encodes a captured camera with the encoder profile
+// named profile from now on; camera 0 is the first track's
+func (w *WebRTCManager) SetCaptureProfile(cameraNumber int, profile string) error {
+	if _, ok := encoderProfiles[profile]; !ok {
+		return fmt.Errorf("unknown encoder profile %q", profile)
+	}
+	return w.setCaptureSettings(CaptureSettings{Camera: cameraNumber, Profile: profile})
+}
+
+// setCaptureSettings merges change into the camera's settings and hands
+// every track showing it over to a capture with them, or with the source
+// manager the camera's running source
+func (w *WebRTCManager) setCaptureSettings(change CaptureSettings) error {
+	if change.Camera == 0 {
+		change.Camera = int(w.outputs[0].camera.Load())
+	}
+	if _, registered := w.sources.factory(change.Camera); registered {
+		return fmt.Errorf("camera %d is not captured", change.Camera)
+	}
+	address, _ := cameraAddress(change.Camera)
+	if _, ok := captureDevice(address); !ok {
+		return fmt.Errorf("camera %d is not captured", change.Camera)
+	}
+
+	w.switchMu.Lock()
+	defer w.switchMu.Unlock()
+
+	w.sources.mu.Lock()
+	if w.sources.settings == nil {
+		w.sources.settings = make(map[int]CaptureSettings)
+	}
+	settings := w.sources.settings[change.Camera]
+	if change.Bitrate > 0 {
+		settings.Bitrate = change.Bitrate
+	}
+	if change.Width > 0 {
+		settings.Width, settings.Height = change.Width, change.Height
+	}
+	if change.Profile != "" {
+		settings.Profile = change.Profile
+	}
+	w.sources.settings[change.Camera] = settings
+	w.sources.mu.Unlock()
+	log.Printf("Camera %d capture settings: bitrate %d, resolution %dx%d, profile %q (0 or empty for the default)",
+		change.Camera, settings.Bitrate, settings.Width, settings.Height, settings.Profile)
+	metrics.Inc("capture.settings_changes")
+	return w.recapture(change.Camera)
+}
+
+// recapture hands every track showing cameraNumber over to a new source,
+// started with the capture settings as they are now, or with the source
+// manager the camera's running source, with w.switchMu held
+func (w *WebRTCManager) recapture(cameraNumber int) error {
+	factory, ok := w.cameraFactory(cameraNumber)
+	if !ok {
+		return nil
+	}
+	if sourceManagerEnabled {
+		// The tracks showing the camera share its source
+		return w.sourceManager.replace(cameraNumber, factory)
+	}
+	for _, output := range w.allOutputs() {
+		if int(output.camera.Load()) != cameraNumber {
+			continue
+		}
+		streamers := []*VideoStreamer{output.streamer}
+		for _, layer := range output.layers {
+			streamers = append(streamers, layer.streamer)
+		}
+		for _, streamer := range streamers {
+			source, err := factory(cameraNumber)
+			if err != nil {
+				return err
+			}
+			handOverSource(streamer, source)
+		}
+	}
+	return nil
+}
+
+// handOverSource starts source beside the streamer's current one and makes
+// it the streamer's at its first keyframe, see handoffSink. A source
+// without a keyframe within captureTimeout is given up on. A stopped
+// streamer just takes source.
+func handOverSource(streamer *VideoStreamer, source VideoSource) {
+	if !streamer.streaming() {
+		streamer.SetSource(source)
+		return
+	}
+	handoff := &handoffSink{streamer: streamer, source: source}
+	streamer.setHandoff(handoff)
+	if err := source.Start(handoff); err != nil {
+		log.Printf("Failed to start new source: %v", err)
+		streamer.ReportError(err)
+		return
+	}
+	time.AfterFunc(captureTimeout, func() {
+		handoff.mu.Lock()
+		abandon := !handoff.handed && !handoff.abandoned
+		handoff.abandoned = true
+		handoff.mu.Unlock()
+		if abandon {
+			log.Printf("New source sent no keyframe within %s, keeping the current one", captureTimeout)
+			source.Stop()
+		}
+	})
+}
+
+// handoffSink holds a new source's frames back until its first keyframe,
+// then stops the streamer's current source and passes the keyframe and
+// everything after it to the streamer
+type handoffSink struct {
+	streamer  *VideoStreamer
+	source    VideoSource
+	handed    bool // the streamer took source
+	abandoned bool // source is being stopped
+	mu        sync.Mutex
+}
+
+// WriteFrame implements SampleSink
+func (h *handoffSink) WriteFrame(frame VideoFrame) bool {
+	h.mu.Lock()
+	if !h.handed {
+		if h.abandoned {
+			h.mu.Unlock()
+			return false
+		}
+		if !hasIDR(frame.Data) {
+			h.mu.Unlock()
+			return true
+		}
+		if !h.streamer.handOver(h) {
+			h.abandoned = true
+			h.mu.Unlock()
+			// Stopping waits for this frame to be written
+			go h.source.Stop()
+			return false
+		}
+		h.handed = true
+		log.Printf("New source took over the stream")
+	}
+	h.mu.Unlock()
+	return h.streamer.WriteFrame(frame)
+}
+
+// ReportError implements SampleSink
+func (h *handoffSink) ReportError(err error) {
+	h.mu.Lock()
+	handed := h.handed
+	h.mu.Unlock()
+	if handed {
+		h.streamer.ReportError(err)
+	}
+}
+
+// captureSettingsControl changes capture settings from the control
+// channel, the payload being CaptureSettings
+func captureSettingsControl(manager *WebRTCManager, kind string) ControlHandler {
+	return ControlHandlerFunc(func(peerID string, payload json.RawMessage) error {
+		return manager.applyCaptureSettings(kind, payload)
+	})
+}
+
+// handleCaptureSettings changes capture settings from
+// <thingName>/set-bitrate, <thingName>/set-resolution and
+// <thingName>/set-profile
+func (m *MQTTClient) handleCaptureSettings(kind string) func(topic string, payload []byte) {
+	return func(topic string, payload []byte) {
+		log.Printf("%s request received on topic %s: %s", kind, topic, string(payload))
+		if err := m.webrtcManager.applyCaptureSettings(kind, payload); err != nil {
+			log.Printf("Failed to %s: %v", kind, err)
+		}
+	}
+}
+
+// applyCaptureSettings runs a set-bitrate, set-resolution or set-profile
+// command
+func (w *WebRTCManager) applyCaptureSettings(kind string, payload []byte) error {
+	var settings CaptureSettings
+	if err := json.Unmarshal(payload, &settings); err != nil {
+		return fmt.Errorf("invalid %s payload: %v", kind, err)
+	}
+	switch kind {
+	case ControlSetBitrate:
+		return w.SetCaptureBitrate(settings.Camera, settings.Bitrate)
+	case ControlSetProfile:
+		return w.SetCaptureProfile(settings.Camera, settings.Profile)
+	}
+	return w.SetCaptureResolution(settings.Camera, settings.Width, settings.Height)
+}
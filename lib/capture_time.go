@@ -0,0 +1,100 @@
+package main
+
+import (
+	"encoding/binary"
+	"time"
+
+	"github.com/pion/rtp"
+	"github.com/pion/webrtc/v4"
+)
+
+// Capture time: each frame carries the time it was read for streaming,
+// which stands in for its capture time, so clients can measure glass-to-
+// glass latency. Peers that negotiate the abs-capture-time RTP header
+// extension get it on the first packet of every frame; with seiCaptureTime
+// the frame also starts with an SEI carrying it, for peers that do not.
+
+// absCaptureTimeURI identifies the abs-capture-time header extension
+const absCaptureTimeURI = "http://www.webrtc.org/experiments/rtp-hdrext/abs-capture-time"
+
+// seiCaptureTimeUUID identifies the rmcs capture time SEI message. Its
+// payload is the big-endian capture time in microseconds since the Unix
+// epoch.
+var seiCaptureTimeUUID = [16]byte{
+	0x72, 0x6d, 0x63, 0x73, 0x2d, 0x74, 0x69, 0x6d, // "rmcs-tim"
+	0x3c, 0x85, 0x0e, 0x61, 0xd2, 0x4b, 0x4f, 0x97,
+}
+
+// appendCaptureTimeSEI appends the capture time SEI NAL unit for captured
+// to dst
+func appendCaptureTimeSEI(dst []byte, captured time.Time) []byte {
+	var payload [8]byte
+	binary.BigEndian.PutUint64(payload[:], uint64(captured.UnixMicro()))
+	return appendUserDataSEI(dst, seiCaptureTimeUUID, payload[:])
+}
+
+// peerTrack returns what peerID is sent of a track streamed by streamer:
+// the track itself, tagged with capture times with captureTimeExtension on,
+// and primed with its GOP with gopCacheEnabled (see gop_cache.go)
+func peerTrack(peerID string, track webrtc.TrackLocal, streamer *VideoStreamer) webrtc.TrackLocal {
+	if captureTimeExtension {
+		track = &captureTimeTrack{TrackLocal: track, streamer: streamer}
+	}
+	if gopCacheEnabled {
+		track = &gopPrimingTrack{TrackLocal: track, peerID: peerID, streamer: streamer}
+	}
+	return track
+}
+
+// captureTimeTrack is one peer's view of a shared track, tagging the first
+// packet of each frame with the abs-capture-time of the frame being written
+type captureTimeTrack struct {
+	webrtc.TrackLocal
+	streamer *VideoStreamer
+}
+
+func (t *captureTimeTrack) Bind(ctx webrtc.TrackLocalContext) (webrtc.RTPCodecParameters, error) {
+	for _, extension := range ctx.HeaderExtensions() {
+		if extension.URI == absCaptureTimeURI {
+			writer := &captureTimeWriter{TrackLocalWriter: ctx.WriteStream(), id: uint8(extension.ID), streamer: t.streamer}
+			return t.TrackLocal.Bind(writerContext{TrackLocalContext: ctx, writer: writer})
+		}
+	}
+	// The peer did not negotiate it, the SEI is all it gets
+	return t.TrackLocal.Bind(ctx)
+}
+
+// captureTimeWriter adds abs-capture-time to the first packet of each frame
+// written to one peer. Like ridWriter, it tags a copy of the shared header.
+type captureTimeWriter struct {
+	webrtc.TrackLocalWriter
+	id            uint8
+	streamer      *VideoStreamer
+	lastTimestamp uint32
+	tagged        bool
+}
+
+func (w *captureTimeWriter) WriteRTP(header *rtp.Header, payload []byte) (int, error) {
+	if w.tagged && header.Timestamp == w.lastTimestamp {
+		return w.TrackLocalWriter.WriteRTP(header, payload)
+	}
+	w.lastTimestamp, w.tagged = header.Timestamp, true
+
+	extension, err := rtp.NewAbsCaptureTimeExtension(w.streamer.CaptureTime()).Marshal()
+	if err != nil {
+		return 0, err
+	}
+	tagged := header.Clone()
+	if err := tagged.SetExtension(w.id, extension); err != nil {
+		return 0, err
+	}
+	return w.TrackLocalWriter.WriteRTP(&tagged, payload)
+}
+
+func (w *captureTimeWriter) Write(b []byte) (int, error) {
+	var packet rtp.Packet
+	if err := packet.Unmarshal(b); err != nil {
+		return 0, err
+	}
+	return w.WriteRTP(&packet.Header, packet.Payload)
+}
@@ -0,0 +1,141 @@
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+// Clock is the time source of the video pipeline. The real clock is used in
+// production; the latency rig drives the pipeline with a VirtualClock.
+type Clock interface {
+	Now() time.Time
+	NewTimer(d time.Duration) Timer
+}
+
+// Timer is the subset of time.Timer the pipeline uses. It fires once, with
+// a timer of d <= 0 firing at once.
+type Timer interface {
+	C() <-chan time.Time
+	Stop()
+}
+
+// mediaClock stamps the capture time of every source's frames. It reads
+// the monotonic clock against one epoch, taken at startup, so streams
+// captured side by side stay on one timeline even when the system time is
+// stepped, e.g. by NTP, between two sources reading it.
+var mediaClock Clock = newEpochClock(time.Now())
+
+type realClock struct{}
+
+func (realClock) Now() time.Time {
+	return time.Now()
+}
+
+func (realClock) NewTimer(d time.Duration) Timer {
+	return realTimer{time.NewTimer(d)}
+}
+
+type realTimer struct {
+	timer *time.Timer
+}
+
+func (t realTimer) C() <-chan time.Time {
+	return t.timer.C
+}
+
+func (t realTimer) Stop() {
+	t.timer.Stop()
+}
+
+// epochClock is the real clock, read as the monotonic time since epoch
+// added to the epoch's wall time
+type epochClock struct {
+	epoch time.Time
+}
+
+func newEpochClock(epoch time.Time) epochClock {
+	return epochClock{epoch: epoch}
+}
+
+func (c epochClock) Now() time.Time {
+	return c.epoch.Add(time.Since(c.epoch))
+}
+
+func (c epochClock) NewTimer(d time.Duration) Timer {
+	return realTimer{time.NewTimer(d)}
+}
+
+// VirtualClock only moves when Advance is called, firing the timers that
+// fall due
+type VirtualClock struct {
+	now    time.Time
+	timers map[*virtualTimer]struct{}
+	mu     sync.Mutex
+}
+
+func NewVirtualClock(start time.Time) *VirtualClock {
+	return &VirtualClock{
+		now:    start,
+		timers: make(map[*virtualTimer]struct{}),
+	}
+}
+
+func (c *VirtualClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now
+}
+
+func (c *VirtualClock) NewTimer(d time.Duration) Timer {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	t := &virtualTimer{
+		clock:    c,
+		deadline: c.now.Add(d),
+		channel:  make(chan time.Time, 1),
+	}
+	if d <= 0 {
+		t.channel <- c.now
+	} else {
+		c.timers[t] = struct{}{}
+	}
+	return t
+}
+
+// Timers returns how many timers are waiting to fire
+func (c *VirtualClock) Timers() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return len(c.timers)
+}
+
+// Advance moves the clock forward by d, firing every timer that falls due
+func (c *VirtualClock) Advance(d time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.now = c.now.Add(d)
+	for t := range c.timers {
+		if !t.deadline.After(c.now) {
+			t.channel <- c.now
+			delete(c.timers, t)
+		}
+	}
+}
+
+type virtualTimer struct {
+	clock    *VirtualClock
+	deadline time.Time
+	channel  chan time.Time
+}
+
+func (t *virtualTimer) C() <-chan time.Time {
+	return t.channel
+}
+
+func (t *virtualTimer) Stop() {
+	t.clock.mu.Lock()
+	defer t.clock.mu.Unlock()
+	delete(t.clock.timers, t)
+}
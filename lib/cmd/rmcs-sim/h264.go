@@ -0,0 +1,220 @@
+package main
+
+import (
+	"encoding/binary"
+	"math/bits"
+)
+
+// The frames are encoded with every changed macroblock as I_PCM: raw
+// samples, no prediction or transform. That is valid Constrained Baseline
+// any browser decodes, and simple enough to write without an encoder. IDR
+// frames carry the whole picture, P-frames only the macroblocks that
+// changed and skip the rest.
+
+// NAL unit types
+const (
+	nalSlice = 1
+	nalIDR   = 5
+	nalSPS   = 7
+	nalPPS   = 8
+)
+
+// Macroblock types coded as I_PCM, in I and P slices
+const (
+	mbTypeIPCM       = 25
+	mbTypeIPCMInP    = 5 + mbTypeIPCM
+	sliceTypeP       = 5 // all slices of the picture are P
+	sliceTypeI       = 7 // all slices of the picture are I
+	log2MaxFrameNum  = 4
+	maxFrameNumValue = 1 << log2MaxFrameNum
+)
+
+// bitWriter writes an RBSP, most significant bit first
+type bitWriter struct {
+	buf   []byte
+	cur   byte
+	nbits uint
+}
+
+func (w *bitWriter) bit(b uint) {
+	w.cur = w.cur<<1 | byte(b&1)
+	w.nbits++
+	if w.nbits == 8 {
+		w.buf = append(w.buf, w.cur)
+		w.cur, w.nbits = 0, 0
+	}
+}
+
+func (w *bitWriter) bits(v uint64, n int) {
+	for i := n - 1; i >= 0; i-- {
+		w.bit(uint(v >> uint(i)))
+	}
+}
+
+// ue writes an unsigned Exp-Golomb code
+func (w *bitWriter) ue(v uint) {
+	n := bits.Len(v + 1)
+	w.bits(0, n-1)
+	w.bits(uint64(v+1), n)
+}
+
+// se writes a signed Exp-Golomb code
+func (w *bitWriter) se(v int) {
+	if v > 0 {
+		w.ue(uint(2*v - 1))
+	} else {
+		w.ue(uint(-2 * v))
+	}
+}
+
+func (w *bitWriter) alignZero() {
+	for w.nbits != 0 {
+		w.bit(0)
+	}
+}
+
+func (w *bitWriter) bytes(data []byte) {
+	w.buf = append(w.buf, data...)
+}
+
+// trailing writes the rbsp_trailing_bits and returns the RBSP
+func (w *bitWriter) trailing() []byte {
+	w.bit(1)
+	w.alignZero()
+	return w.buf
+}
+
+// nalUnit wraps an RBSP in a NAL unit, inserting emulation prevention bytes
+func nalUnit(refIdc byte, nalType byte, rbsp []byte) []byte {
+	nal := []byte{refIdc<<5 | nalType}
+	zeros := 0
+	for _, b := range rbsp {
+		if zeros >= 2 && b <= 3 {
+			nal = append(nal, 3)
+			zeros = 0
+		}
+		nal = append(nal, b)
+		if b == 0 {
+			zeros++
+		} else {
+			zeros = 0
+		}
+	}
+	return nal
+}
+
+// lengthPrefixed joins NAL units in the backend's frame file format, each
+// preceded by its big-endian 32-bit length
+func lengthPrefixed(nals ...[]byte) []byte {
+	var frame []byte
+	for _, nal := range nals {
+		frame = binary.BigEndian.AppendUint32(frame, uint32(len(nal)))
+		frame = append(frame, nal...)
+	}
+	return frame
+}
+
+// encoder writes one camera's frames for a scene
+type encoder struct {
+	scene    *scene
+	frameNum int // frame_num of the next frame
+	idrCount int
+}
+
+func (e *encoder) sps() []byte {
+	w := &bitWriter{}
+	w.bits(66, 8)   // profile_idc: Baseline
+	w.bits(0xC0, 8) // constraint_set0 and set1: Constrained Baseline
+	w.bits(uint64(e.scene.level()), 8)
+	w.ue(0) // seq_parameter_set_id
+	w.ue(log2MaxFrameNum - 4)
+	w.ue(2) // pic_order_cnt_type: output order is decoding order
+	w.ue(1) // max_num_ref_frames
+	w.bit(0)
+	w.ue(uint(e.scene.mbWidth - 1))
+	w.ue(uint(e.scene.mbHeight - 1))
+	w.bit(1) // frame_mbs_only_flag
+	w.bit(1) // direct_8x8_inference_flag
+	w.bit(0) // frame_cropping_flag
+	w.bit(0) // vui_parameters_present_flag
+	return nalUnit(3, nalSPS, w.trailing())
+}
+
+func (e *encoder) pps() []byte {
+	w := &bitWriter{}
+	w.ue(0)  // pic_parameter_set_id
+	w.ue(0)  // seq_parameter_set_id
+	w.bit(0) // entropy_coding_mode_flag: CAVLC
+	w.bit(0) // bottom_field_pic_order_in_frame_present_flag
+	w.ue(0)  // num_slice_groups_minus1
+	w.ue(0)  // num_ref_idx_l0_default_active_minus1
+	w.ue(0)  // num_ref_idx_l1_default_active_minus1
+	w.bit(0) // weighted_pred_flag
+	w.bits(0, 2)
+	w.se(0)  // pic_init_qp_minus26
+	w.se(0)  // pic_init_qs_minus26
+	w.se(0)  // chroma_qp_index_offset
+	w.bit(1) // deblocking_filter_control_present_flag
+	w.bit(0) // constrained_intra_pred_flag
+	w.bit(0) // redundant_pic_cnt_present_flag
+	return nalUnit(3, nalPPS, w.trailing())
+}
+
+// pcm writes macroblock mb's samples
+func (e *encoder) pcm(w *bitWriter, frame int, mb int) {
+	w.alignZero()
+	luma, cb, cr := e.scene.macroblock(frame, mb)
+	w.bytes(luma)
+	w.bytes(cb)
+	w.bytes(cr)
+}
+
+// idr encodes frame as an IDR picture, preceded by the parameter sets
+func (e *encoder) idr(frame int) []byte {
+	e.frameNum = 0
+	w := &bitWriter{}
+	w.ue(0) // first_mb_in_slice
+	w.ue(sliceTypeI)
+	w.ue(0) // pic_parameter_set_id
+	w.bits(uint64(e.frameNum), log2MaxFrameNum)
+	w.ue(uint(e.idrCount % 65536)) // idr_pic_id, different for consecutive IDRs
+	w.bit(0)                       // no_output_of_prior_pics_flag
+	w.bit(0)                       // long_term_reference_flag
+	w.se(0)                        // slice_qp_delta
+	w.ue(1)                        // disable_deblocking_filter_idc
+	for mb := 0; mb < e.scene.mbCount(); mb++ {
+		w.ue(mbTypeIPCM)
+		e.pcm(w, frame, mb)
+	}
+	e.idrCount++
+	e.frameNum++
+	return lengthPrefixed(e.sps(), e.pps(), nalUnit(3, nalIDR, w.trailing()))
+}
+
+// p encodes frame as a P-picture referencing the previous frame, coding only
+// the macroblocks that changed
+func (e *encoder) p(frame int) []byte {
+	w := &bitWriter{}
+	w.ue(0) // first_mb_in_slice
+	w.ue(sliceTypeP)
+	w.ue(0) // pic_parameter_set_id
+	w.bits(uint64(e.frameNum%maxFrameNumValue), log2MaxFrameNum)
+	w.bit(0) // num_ref_idx_active_override_flag
+	w.bit(0) // ref_pic_list_modification_flag_l0
+	w.bit(0) // adaptive_ref_pic_marking_mode_flag
+	w.se(0)  // slice_qp_delta
+	w.ue(1)  // disable_deblocking_filter_idc
+
+	next := 0
+	for _, mb := range e.scene.changed(frame) {
+		w.ue(uint(mb - next)) // mb_skip_run
+		w.ue(mbTypeIPCMInP)
+		e.pcm(w, frame, mb)
+		next = mb + 1
+	}
+	if remaining := e.scene.mbCount() - next; remaining > 0 {
+		w.ue(uint(remaining))
+	}
+	e.frameNum++
+	return lengthPrefixed(nalUnit(2, nalSlice, w.trailing()))
+}
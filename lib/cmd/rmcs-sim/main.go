@@ -0,0 +1,258 @@
+// Command rmcs-sim emulates a whole robot for frontend and integration work
+// without hardware or a ROS installation.
+//
+// It writes synthetic camera frames where the backend streams them from
+// (h264/<camera>/, as bag_processor lays them out), serves a fake ROS master
+// publishing the matching sensor_msgs/Image topics (and JPEG
+// sensor_msgs/CompressedImage ones on <topic>/compressed), and runs the
+// normal backend in the simulated robot's directory until interrupted. Each camera
+// shows its own shade of grey with a square moving across it.
+//
+// Usage, from lib/ after build-lib.sh and make:
+//
+//	go run ./cmd/rmcs-sim -backend ../streaming
+//	go run ./cmd/rmcs-sim -fps 15 -camera 1=1280x720@30 -renditions
+//
+// The backend paces every camera at its own 30 fps whatever rate the frames
+// were generated for; the rates apply to the ROS topics.
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"os/exec"
+	"os/signal"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+// simCamera is one camera of the simulated robot
+type simCamera struct {
+	number    int
+	directory string // under h264/, as in cameraDirectories in lib/camera_health.go
+	topic     string
+	width     int
+	height    int
+	fps       int
+}
+
+var cameras = []simCamera{
+	{number: 1, directory: "flir_id8_image_resized_30fps", topic: "/flir_id8/image_resized"},
+	{number: 2, directory: "leopard_id1_image_resized_30fps", topic: "/leopard_id1/image_resized"},
+	{number: 3, directory: "leopard_id3_image_resized_30fps", topic: "/leopard_id3/image_resized"},
+	{number: 4, directory: "leopard_id4_image_resized_30fps", topic: "/leopard_id4/image_resized"},
+	{number: 5, directory: "leopard_id5_image_resized_30fps", topic: "/leopard_id5/image_resized"},
+	{number: 6, directory: "leopard_id6_image_resized_30fps", topic: "/leopard_id6/image_resized"},
+	{number: 7, directory: "leopard_id7_image_resized_30fps", topic: "/leopard_id7/image_resized"},
+}
+
+// renditions are the lower qualityLadder rungs written with -renditions,
+// each a fraction of the camera's resolution
+var renditions = []struct {
+	suffix string
+	scale  int
+}{
+	{suffix: "_medium", scale: 2},
+	{suffix: "_low", scale: 4},
+}
+
+// simMarker marks a directory as the simulator's, so frames are never
+// written over a real robot's recordings
+const simMarker = ".rmcs-sim"
+
+// cameraOverrides collects -camera N=WxH@FPS flags
+type cameraOverrides map[int]simCamera
+
+func (o cameraOverrides) String() string { return "" }
+
+func (o cameraOverrides) Set(value string) error {
+	number, spec, ok := strings.Cut(value, "=")
+	if !ok {
+		return fmt.Errorf("want N=WxH@FPS, got %q", value)
+	}
+	n, err := strconv.Atoi(number)
+	if err != nil {
+		return fmt.Errorf("invalid camera number %q", number)
+	}
+	var camera simCamera
+	if _, err := fmt.Sscanf(spec, "%dx%d@%d", &camera.width, &camera.height, &camera.fps); err != nil {
+		return fmt.Errorf("want N=WxH@FPS, got %q", value)
+	}
+	if camera.width < 16 || camera.height < 16 || camera.fps < 1 {
+		return fmt.Errorf("camera %d: at least 16x16 at 1 fps", n)
+	}
+	o[n] = camera
+	return nil
+}
+
+func main() {
+	root := flag.String("root", "rmcs-sim", "directory of the simulated robot, the backend runs in it")
+	width := flag.Int("width", 320, "default camera width, rounded down to a multiple of 16")
+	height := flag.Int("height", 240, "default camera height, rounded down to a multiple of 16")
+	fps := flag.Int("fps", 30, "default camera frame rate")
+	seconds := flag.Int("seconds", 10, "length of the frame loop the backend streams")
+	withRenditions := flag.Bool("renditions", false, "also write the _medium and _low renditions for adaptive bitrate")
+	master := flag.String("ros-master", ":11311", `address of the fake ROS master, "" for none`)
+	hostname := flag.String("ros-hostname", rosHostname(), "host name advertised in ROS URIs")
+	backend := flag.String("backend", "", `backend executable, e.g. ../streaming; "" only simulates the robot`)
+	overrides := cameraOverrides{}
+	flag.Var(overrides, "camera", "per-camera N=WxH@FPS, e.g. 1=1280x720@15 (repeatable)")
+	flag.Parse()
+
+	if *width < 16 || *height < 16 || *fps < 1 || *seconds < 1 {
+		log.Fatal("need at least 16x16 at 1 fps for 1 second")
+	}
+	for i := range cameras {
+		camera := &cameras[i]
+		camera.width, camera.height, camera.fps = *width, *height, *fps
+		if override, ok := overrides[camera.number]; ok {
+			camera.width, camera.height, camera.fps = override.width, override.height, override.fps
+		}
+	}
+
+	if err := prepareRoot(*root); err != nil {
+		log.Fatal(err)
+	}
+	var topics []*imageTopic
+	for _, camera := range cameras {
+		scene := newScene(camera.number, camera.width, camera.height)
+		if err := writeFrames(filepath.Join(*root, "h264", camera.directory), scene, camera.fps, *seconds); err != nil {
+			log.Fatal(err)
+		}
+		if *withRenditions {
+			for _, rendition := range renditions {
+				scaled := newScene(camera.number, camera.width/rendition.scale, camera.height/rendition.scale)
+				if err := writeFrames(filepath.Join(*root, "h264", camera.directory+rendition.suffix), scaled, camera.fps, *seconds); err != nil {
+					log.Fatal(err)
+				}
+			}
+		}
+		log.Printf("Camera %d: %dx%d at %d fps on %s", camera.number, scene.width(), scene.height(), camera.fps, camera.topic)
+		frameID := strings.TrimPrefix(camera.topic, "/")
+		topics = append(topics,
+			newImageTopic(camera.topic, frameID, scene, camera.fps, false),
+			newImageTopic(camera.topic+"/compressed", frameID, scene, camera.fps, true))
+	}
+
+	stop := make(chan struct{})
+	if *master != "" {
+		rosMaster, err := startROSMaster(*master, *hostname, topics)
+		if err != nil {
+			log.Fatal(err)
+		}
+		for _, topic := range topics {
+			go topic.run(stop)
+		}
+		log.Printf("ROS master at %s (export ROS_MASTER_URI=%s)", rosMaster.masterURI, rosMaster.masterURI)
+	}
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	if *backend == "" {
+		log.Printf("Robot simulated in %s, interrupt to stop", *root)
+		<-signals
+		close(stop)
+		return
+	}
+
+	code := runBackend(*backend, *root, signals)
+	close(stop)
+	os.Exit(code)
+}
+
+// rosHostname picks the advertised host like ROS nodes do
+func rosHostname() string {
+	for _, name := range []string{"ROS_HOSTNAME", "ROS_IP"} {
+		if value := os.Getenv(name); value != "" {
+			return value
+		}
+	}
+	return "localhost"
+}
+
+// prepareRoot creates root, refusing a directory with frames that are not
+// the simulator's
+func prepareRoot(root string) error {
+	if _, err := os.Stat(filepath.Join(root, "h264")); err == nil {
+		if _, err := os.Stat(filepath.Join(root, simMarker)); err != nil {
+			return fmt.Errorf("%s already has h264/ frames not written by rmcs-sim, pick another -root", root)
+		}
+	}
+	if err := os.MkdirAll(root, 0755); err != nil {
+		return err
+	}
+	return os.WriteFile(filepath.Join(root, simMarker), nil, 0644)
+}
+
+// writeFrames replaces directory's frames with seconds of scene at fps, one
+// IDR per second
+func writeFrames(directory string, scene *scene, fps int, seconds int) error {
+	if err := os.MkdirAll(directory, 0755); err != nil {
+		return err
+	}
+	stale, err := filepath.Glob(filepath.Join(directory, "*.h264"))
+	if err != nil {
+		return err
+	}
+	for _, file := range stale {
+		os.Remove(file)
+	}
+
+	e := &encoder{scene: scene}
+	for frame := 0; frame < fps*seconds; frame++ {
+		var data []byte
+		if frame%fps == 0 {
+			data = e.idr(frame)
+		} else {
+			data = e.p(frame)
+		}
+		if err := os.WriteFile(filepath.Join(directory, fmt.Sprintf("%d.h264", frame)), data, 0644); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// runBackend runs the backend in root until it exits or a signal arrives,
+// which it stops the way its console does, with Enter. Returns its exit code.
+func runBackend(backend string, root string, signals <-chan os.Signal) int {
+	path, err := filepath.Abs(backend)
+	if err != nil {
+		log.Fatal(err)
+	}
+	cmd := exec.Command(path)
+	cmd.Dir = root
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	// librmcs.so sits next to the example binary, see run.sh
+	cmd.Env = append(os.Environ(), "LD_LIBRARY_PATH="+filepath.Dir(path)+":"+os.Getenv("LD_LIBRARY_PATH"))
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		log.Fatal(err)
+	}
+	if err := cmd.Start(); err != nil {
+		log.Fatalf("Failed to start backend %s: %v", path, err)
+	}
+
+	exited := make(chan error, 1)
+	go func() { exited <- cmd.Wait() }()
+	select {
+	case err = <-exited:
+	case <-signals:
+		log.Println("Stopping backend")
+		stdin.Write([]byte("\n"))
+		err = <-exited
+	}
+	if exitErr, ok := err.(*exec.ExitError); ok {
+		return exitErr.ExitCode()
+	}
+	if err != nil {
+		log.Printf("Backend: %v", err)
+		return 1
+	}
+	return 0
+}
@@ -0,0 +1,241 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"sort"
+	"sync"
+)
+
+// simNodeName is the node the image topics are published by
+const simNodeName = "/rmcs_sim"
+
+// rosMaster fakes a ROS master with one node, simNodeName, publishing the
+// camera image topics. Other nodes can register publishers and subscribers
+// as usual and see each other in getSystemState; parameters and services
+// are not supported.
+type rosMaster struct {
+	masterURI  string
+	nodeURI    string
+	host       string
+	tcprosPort int
+	topics     map[string]*imageTopic
+	// Registrations of other nodes: topic -> caller ID -> API URI
+	publishers  map[string]map[string]string
+	subscribers map[string]map[string]string
+	topicTypes  map[string]string
+	mu          sync.Mutex
+}
+
+// startROSMaster serves the master API on addr, and the node API and TCPROS
+// of simNodeName on ephemeral ports of host
+func startROSMaster(addr string, host string, topics []*imageTopic) (*rosMaster, error) {
+	m := &rosMaster{
+		host:        host,
+		topics:      make(map[string]*imageTopic),
+		publishers:  make(map[string]map[string]string),
+		subscribers: make(map[string]map[string]string),
+		topicTypes:  make(map[string]string),
+	}
+	for _, topic := range topics {
+		m.topics[topic.name] = topic
+		m.topicTypes[topic.name] = topic.messageType().name
+	}
+
+	masterListener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, fmt.Errorf("failed to listen for the ROS master on %s: %v", addr, err)
+	}
+	nodeListener, err := net.Listen("tcp", net.JoinHostPort("", "0"))
+	if err != nil {
+		masterListener.Close()
+		return nil, err
+	}
+	tcprosListener, err := net.Listen("tcp", net.JoinHostPort("", "0"))
+	if err != nil {
+		masterListener.Close()
+		nodeListener.Close()
+		return nil, err
+	}
+
+	m.masterURI = fmt.Sprintf("http://%s/", net.JoinHostPort(host, fmt.Sprint(masterListener.Addr().(*net.TCPAddr).Port)))
+	m.nodeURI = fmt.Sprintf("http://%s/", net.JoinHostPort(host, fmt.Sprint(nodeListener.Addr().(*net.TCPAddr).Port)))
+	m.tcprosPort = tcprosListener.Addr().(*net.TCPAddr).Port
+
+	go http.Serve(masterListener, xmlrpcHandler("ROS master", m.handleMaster))
+	go http.Serve(nodeListener, xmlrpcHandler(simNodeName, m.handleNode))
+	go serveTCPROS(tcprosListener, m.topics)
+	return m, nil
+}
+
+// handleMaster answers the ROS master API
+func (m *rosMaster) handleMaster(call *xmlrpcCall) interface{} {
+	callerID := call.stringParam(0)
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	switch call.MethodName {
+	case "getUri":
+		return rosResult(1, "", m.masterURI)
+	case "getPid":
+		return rosResult(1, "", os.Getpid())
+	case "lookupNode":
+		if call.stringParam(1) == simNodeName {
+			return rosResult(1, "", m.nodeURI)
+		}
+		for _, registrations := range []map[string]map[string]string{m.publishers, m.subscribers} {
+			for _, nodes := range registrations {
+				if api, ok := nodes[call.stringParam(1)]; ok {
+					return rosResult(1, "", api)
+				}
+			}
+		}
+		return rosResult(-1, "unknown node "+call.stringParam(1), "")
+	case "getPublishedTopics", "getTopicTypes":
+		return rosResult(1, "", m.topicList())
+	case "getSystemState":
+		return rosResult(1, "", []interface{}{
+			m.registrationList(m.publishers, true),
+			m.registrationList(m.subscribers, false),
+			[]interface{}{},
+		})
+	case "registerSubscriber":
+		topic := call.stringParam(1)
+		register(m.subscribers, topic, callerID, call.stringParam(3))
+		m.setType(topic, call.stringParam(2))
+		log.Printf("ROS master: %s subscribes to %s", callerID, topic)
+		return rosResult(1, "", m.publisherAPIs(topic))
+	case "unregisterSubscriber":
+		return rosResult(1, "", unregister(m.subscribers, call.stringParam(1), callerID))
+	case "registerPublisher":
+		topic := call.stringParam(1)
+		register(m.publishers, topic, callerID, call.stringParam(3))
+		m.setType(topic, call.stringParam(2))
+		log.Printf("ROS master: %s publishes %s", callerID, topic)
+		return rosResult(1, "", m.subscriberAPIs(topic))
+	case "unregisterPublisher":
+		return rosResult(1, "", unregister(m.publishers, call.stringParam(1), callerID))
+	case "hasParam":
+		return rosResult(1, "", false)
+	case "getParam":
+		return rosResult(-1, "parameter not set: "+call.stringParam(1), 0)
+	case "getParamNames":
+		return rosResult(1, "", []interface{}{})
+	case "lookupService":
+		return rosResult(-1, "no service "+call.stringParam(1), "")
+	}
+	return rosResult(-1, "unsupported method "+call.MethodName, 0)
+}
+
+// handleNode answers the node API of simNodeName
+func (m *rosMaster) handleNode(call *xmlrpcCall) interface{} {
+	switch call.MethodName {
+	case "requestTopic":
+		if _, ok := m.topics[call.stringParam(1)]; !ok {
+			return rosResult(-1, "not a publisher of "+call.stringParam(1), 0)
+		}
+		return rosResult(1, "", []interface{}{"TCPROS", m.host, m.tcprosPort})
+	case "getPublications":
+		var publications []interface{}
+		for _, name := range sortedKeys(m.topics) {
+			publications = append(publications, []interface{}{name, m.topics[name].messageType().name})
+		}
+		return rosResult(1, "", publications)
+	case "getSubscriptions", "getBusInfo", "getBusStats":
+		return rosResult(1, "", []interface{}{})
+	case "getMasterUri":
+		return rosResult(1, "", m.masterURI)
+	case "getPid":
+		return rosResult(1, "", os.Getpid())
+	case "publisherUpdate", "paramUpdate", "shutdown":
+		return rosResult(1, "", 0)
+	}
+	return rosResult(-1, "unsupported method "+call.MethodName, 0)
+}
+
+func register(registrations map[string]map[string]string, topic string, callerID string, api string) {
+	if registrations[topic] == nil {
+		registrations[topic] = make(map[string]string)
+	}
+	registrations[topic][callerID] = api
+}
+
+func unregister(registrations map[string]map[string]string, topic string, callerID string) int {
+	if _, ok := registrations[topic][callerID]; !ok {
+		return 0
+	}
+	delete(registrations[topic], callerID)
+	return 1
+}
+
+func (m *rosMaster) setType(topic string, topicType string) {
+	if _, ok := m.topicTypes[topic]; !ok && topicType != "" && topicType != "*" {
+		m.topicTypes[topic] = topicType
+	}
+}
+
+func sortedKeys[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// topicList returns [topic, type] of every published topic, with m.mu held
+func (m *rosMaster) topicList() []interface{} {
+	var list []interface{}
+	for _, topic := range sortedKeys(m.topicTypes) {
+		if m.topics[topic] != nil || len(m.publishers[topic]) > 0 {
+			list = append(list, []interface{}{topic, m.topicTypes[topic]})
+		}
+	}
+	return list
+}
+
+// registrationList returns [topic, [nodes]] of every topic in
+// registrations, plus the image topics for publishers, with m.mu held
+func (m *rosMaster) registrationList(registrations map[string]map[string]string, withImages bool) []interface{} {
+	nodes := make(map[string][]interface{})
+	if withImages {
+		for name := range m.topics {
+			nodes[name] = append(nodes[name], simNodeName)
+		}
+	}
+	for topic, callers := range registrations {
+		for callerID := range callers {
+			nodes[topic] = append(nodes[topic], callerID)
+		}
+	}
+
+	var list []interface{}
+	for _, topic := range sortedKeys(nodes) {
+		list = append(list, []interface{}{topic, nodes[topic]})
+	}
+	return list
+}
+
+// publisherAPIs returns the node URIs publishing topic, with m.mu held
+func (m *rosMaster) publisherAPIs(topic string) []interface{} {
+	apis := []interface{}{}
+	if m.topics[topic] != nil {
+		apis = append(apis, m.nodeURI)
+	}
+	for _, api := range m.publishers[topic] {
+		apis = append(apis, api)
+	}
+	return apis
+}
+
+// subscriberAPIs returns the node URIs subscribed to topic, with m.mu held
+func (m *rosMaster) subscriberAPIs(topic string) []interface{} {
+	apis := []interface{}{}
+	for _, api := range m.subscribers[topic] {
+		apis = append(apis, api)
+	}
+	return apis
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"bytes"
+	"image"
+	"image/jpeg"
+)
+
+// scene is the synthetic picture of one camera: a flat background, a
+// different shade for each camera so they are told apart at a glance, and a
+// square moving one macroblock per frame so the picture is never frozen
+type scene struct {
+	mbWidth    int
+	mbHeight   int
+	background byte // luma
+	square     byte
+}
+
+// newScene creates camera's scene at width x height, rounded down to whole
+// macroblocks
+func newScene(camera int, width int, height int) *scene {
+	s := &scene{
+		mbWidth:    max(width/16, 1),
+		mbHeight:   max(height/16, 1),
+		background: byte(16 + camera*28),
+		square:     235,
+	}
+	if s.background >= 128 {
+		s.square = 16
+	}
+	return s
+}
+
+func (s *scene) width() int   { return s.mbWidth * 16 }
+func (s *scene) height() int  { return s.mbHeight * 16 }
+func (s *scene) mbCount() int { return s.mbWidth * s.mbHeight }
+
+// level returns the lowest H.264 level whose frame size fits the scene
+func (s *scene) level() int {
+	levels := []struct{ maxMBs, level int }{
+		{99, 10}, {396, 20}, {792, 21}, {1620, 30}, {3600, 31}, {5120, 32}, {8192, 40},
+	}
+	for _, l := range levels {
+		if s.mbCount() <= l.maxMBs {
+			return l.level
+		}
+	}
+	return 51
+}
+
+// squareAt returns the macroblock the square covers in frame
+func (s *scene) squareAt(frame int) int {
+	return frame % s.mbCount()
+}
+
+// changed returns the macroblocks that differ from the previous frame, in
+// address order
+func (s *scene) changed(frame int) []int {
+	previous, current := s.squareAt(frame-1), s.squareAt(frame)
+	switch {
+	case previous == current:
+		return nil
+	case previous < current:
+		return []int{previous, current}
+	default:
+		return []int{current, previous}
+	}
+}
+
+// macroblock returns the 4:2:0 samples of macroblock mb in frame
+func (s *scene) macroblock(frame int, mb int) (luma []byte, cb []byte, cr []byte) {
+	y := s.background
+	if mb == s.squareAt(frame) {
+		y = s.square
+	}
+	luma = make([]byte, 256)
+	for i := range luma {
+		luma[i] = y
+	}
+	cb = make([]byte, 64)
+	cr = make([]byte, 64)
+	for i := range cb {
+		cb[i], cr[i] = 128, 128
+	}
+	return luma, cb, cr
+}
+
+// jpeg renders frame as a JPEG, for the compressed ROS image topics
+func (s *scene) jpeg(frame int) []byte {
+	rgb := s.rgb(frame)
+	picture := image.NewGray(image.Rect(0, 0, s.width(), s.height()))
+	for i := range picture.Pix {
+		// The scene is grey: R, G and B are the same
+		picture.Pix[i] = rgb[i*3]
+	}
+	var buf bytes.Buffer
+	jpeg.Encode(&buf, picture, &jpeg.Options{Quality: 80})
+	return buf.Bytes()
+}
+
+// rgb renders frame as packed 8-bit RGB, for the ROS image topics
+func (s *scene) rgb(frame int) []byte {
+	width := s.width()
+	data := make([]byte, width*s.height()*3)
+	square := s.squareAt(frame)
+	squareX, squareY := square%s.mbWidth*16, square/s.mbWidth*16
+	for y := 0; y < s.height(); y++ {
+		for x := 0; x < width; x++ {
+			value := s.background
+			if x >= squareX && x < squareX+16 && y >= squareY && y < squareY+16 {
+				value = s.square
+			}
+			i := (y*width + x) * 3
+			data[i], data[i+1], data[i+2] = value, value, value
+		}
+	}
+	return data
+}
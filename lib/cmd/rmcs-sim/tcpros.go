@@ -0,0 +1,265 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"strings"
+	"sync"
+	"time"
+)
+
+// messageType is what a topic's connection header says of its messages
+type messageType struct {
+	name       string
+	md5        string
+	definition string
+}
+
+// sensor_msgs/Image, as published on the image topics, and
+// sensor_msgs/CompressedImage, on their /compressed counterparts
+var (
+	imageType = messageType{
+		name: "sensor_msgs/Image",
+		md5:  "060021388200f6f0f447d0fcd9c64743",
+		definition: `std_msgs/Header header
+uint32 height
+uint32 width
+string encoding
+uint8 is_bigendian
+uint32 step
+uint8[] data
+================================================================================
+MSG: std_msgs/Header
+uint32 seq
+time stamp
+string frame_id
+`,
+	}
+	compressedImageType = messageType{
+		name: "sensor_msgs/CompressedImage",
+		md5:  "8f7a12909da2c9d3332d540a0977563f",
+		definition: `std_msgs/Header header
+string format
+uint8[] data
+================================================================================
+MSG: std_msgs/Header
+uint32 seq
+time stamp
+string frame_id
+`,
+	}
+)
+
+// maxHeaderSize bounds the connection header a subscriber can send
+const maxHeaderSize = 64 * 1024
+
+// imageTopic publishes one camera's scene at its frame rate, as rgb8
+// images or, compressed, as JPEGs
+type imageTopic struct {
+	name        string
+	frameID     string
+	scene       *scene
+	fps         int
+	compressed  bool
+	subscribers map[chan []byte]bool
+	mu          sync.Mutex
+}
+
+func newImageTopic(name string, frameID string, scene *scene, fps int, compressed bool) *imageTopic {
+	return &imageTopic{
+		name:        name,
+		frameID:     frameID,
+		scene:       scene,
+		fps:         fps,
+		compressed:  compressed,
+		subscribers: make(map[chan []byte]bool),
+	}
+}
+
+// messageType returns the type of the topic's messages
+func (t *imageTopic) messageType() messageType {
+	if t.compressed {
+		return compressedImageType
+	}
+	return imageType
+}
+
+func (t *imageTopic) subscribe() chan []byte {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	// One message of slack; a subscriber slower than the topic loses frames
+	// rather than holding up the others
+	ch := make(chan []byte, 1)
+	t.subscribers[ch] = true
+	return ch
+}
+
+func (t *imageTopic) unsubscribe(ch chan []byte) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	delete(t.subscribers, ch)
+}
+
+// run publishes a frame every 1/fps until stop closes. Frames are only
+// rendered while someone subscribes.
+func (t *imageTopic) run(stop <-chan struct{}) {
+	ticker := time.NewTicker(time.Second / time.Duration(t.fps))
+	defer ticker.Stop()
+
+	var seq uint32
+	for {
+		select {
+		case <-stop:
+			return
+		case now := <-ticker.C:
+			seq++
+			t.mu.Lock()
+			if len(t.subscribers) > 0 {
+				var message []byte
+				if t.compressed {
+					message = compressedImageMessage(seq, now, t.frameID, t.scene.jpeg(int(seq)))
+				} else {
+					message = imageMessage(seq, now, t.frameID, t.scene, t.scene.rgb(int(seq)))
+				}
+				for ch := range t.subscribers {
+					select {
+					case ch <- message:
+					default:
+					}
+				}
+			}
+			t.mu.Unlock()
+		}
+	}
+}
+
+// imageMessage serializes a sensor_msgs/Image, prefixed with its length
+func imageMessage(seq uint32, stamp time.Time, frameID string, s *scene, data []byte) []byte {
+	var msg []byte
+	le := binary.LittleEndian
+	msg = le.AppendUint32(msg, seq)
+	msg = le.AppendUint32(msg, uint32(stamp.Unix()))
+	msg = le.AppendUint32(msg, uint32(stamp.Nanosecond()))
+	msg = appendString(msg, frameID)
+	msg = le.AppendUint32(msg, uint32(s.height()))
+	msg = le.AppendUint32(msg, uint32(s.width()))
+	msg = appendString(msg, "rgb8")
+	msg = append(msg, 0) // is_bigendian
+	msg = le.AppendUint32(msg, uint32(s.width()*3))
+	msg = le.AppendUint32(msg, uint32(len(data)))
+	msg = append(msg, data...)
+	return append(le.AppendUint32(nil, uint32(len(msg))), msg...)
+}
+
+// compressedImageMessage serializes a sensor_msgs/CompressedImage of a
+// JPEG, prefixed with its length
+func compressedImageMessage(seq uint32, stamp time.Time, frameID string, jpeg []byte) []byte {
+	var msg []byte
+	le := binary.LittleEndian
+	msg = le.AppendUint32(msg, seq)
+	msg = le.AppendUint32(msg, uint32(stamp.Unix()))
+	msg = le.AppendUint32(msg, uint32(stamp.Nanosecond()))
+	msg = appendString(msg, frameID)
+	msg = appendString(msg, "jpeg")
+	msg = le.AppendUint32(msg, uint32(len(jpeg)))
+	msg = append(msg, jpeg...)
+	return append(le.AppendUint32(nil, uint32(len(msg))), msg...)
+}
+
+func appendString(b []byte, s string) []byte {
+	b = binary.LittleEndian.AppendUint32(b, uint32(len(s)))
+	return append(b, s...)
+}
+
+// readHeader reads a TCPROS connection header into its fields
+func readHeader(r io.Reader) (map[string]string, error) {
+	var size uint32
+	if err := binary.Read(r, binary.LittleEndian, &size); err != nil {
+		return nil, err
+	}
+	if size > maxHeaderSize {
+		return nil, fmt.Errorf("connection header of %d bytes", size)
+	}
+	data := make([]byte, size)
+	if _, err := io.ReadFull(r, data); err != nil {
+		return nil, err
+	}
+
+	fields := make(map[string]string)
+	for len(data) >= 4 {
+		n := binary.LittleEndian.Uint32(data)
+		if int(n) > len(data)-4 {
+			return nil, errors.New("truncated connection header")
+		}
+		key, value, _ := strings.Cut(string(data[4:4+n]), "=")
+		fields[key] = value
+		data = data[4+n:]
+	}
+	return fields, nil
+}
+
+func writeHeader(w io.Writer, fields map[string]string) error {
+	var data []byte
+	for key, value := range fields {
+		data = appendString(data, key+"="+value)
+	}
+	_, err := w.Write(append(binary.LittleEndian.AppendUint32(nil, uint32(len(data))), data...))
+	return err
+}
+
+// serveTCPROS accepts subscriber connections to the image topics on
+// listener until it closes
+func serveTCPROS(listener net.Listener, topics map[string]*imageTopic) {
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		go serveSubscriber(conn, topics)
+	}
+}
+
+func serveSubscriber(conn net.Conn, topics map[string]*imageTopic) {
+	defer conn.Close()
+
+	header, err := readHeader(bufio.NewReader(conn))
+	if err != nil {
+		log.Printf("TCPROS: bad connection header from %s: %v", conn.RemoteAddr(), err)
+		return
+	}
+	topic, ok := topics[header["topic"]]
+	if !ok {
+		writeHeader(conn, map[string]string{"error": "no such topic " + header["topic"]})
+		return
+	}
+	msgType := topic.messageType()
+	if md5 := header["md5sum"]; md5 != "*" && md5 != msgType.md5 {
+		writeHeader(conn, map[string]string{"error": fmt.Sprintf("%s is %s, not md5sum %s", topic.name, msgType.name, md5)})
+		return
+	}
+	if err := writeHeader(conn, map[string]string{
+		"callerid":           simNodeName,
+		"topic":              topic.name,
+		"type":               msgType.name,
+		"md5sum":             msgType.md5,
+		"message_definition": msgType.definition,
+		"latching":           "0",
+	}); err != nil {
+		return
+	}
+
+	log.Printf("%s subscribed to %s", header["callerid"], topic.name)
+	messages := topic.subscribe()
+	defer topic.unsubscribe(messages)
+	for message := range messages {
+		if _, err := conn.Write(message); err != nil {
+			log.Printf("%s unsubscribed from %s: %v", header["callerid"], topic.name, err)
+			return
+		}
+	}
+}
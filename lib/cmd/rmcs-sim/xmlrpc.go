@@ -0,0 +1,96 @@
+package main
+
+import (
+	"bytes"
+	"encoding/xml"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+)
+
+// Just enough XML-RPC for the ROS master and node APIs: string, int and
+// boolean values and arrays of them
+
+type xmlrpcCall struct {
+	MethodName string        `xml:"methodName"`
+	Params     []xmlrpcValue `xml:"params>param>value"`
+}
+
+type xmlrpcValue struct {
+	String *string       `xml:"string"`
+	Int    *int          `xml:"int"`
+	I4     *int          `xml:"i4"`
+	Array  []xmlrpcValue `xml:"array>data>value"`
+	Text   string        `xml:",chardata"`
+}
+
+func (v xmlrpcValue) str() string {
+	if v.String != nil {
+		return *v.String
+	}
+	return strings.TrimSpace(v.Text)
+}
+
+// stringParam returns the i-th parameter as a string, "" if missing
+func (c *xmlrpcCall) stringParam(i int) string {
+	if i >= len(c.Params) {
+		return ""
+	}
+	return c.Params[i].str()
+}
+
+// rosResult is the [code, statusMessage, value] triple every ROS API call
+// returns
+func rosResult(code int, status string, value interface{}) []interface{} {
+	return []interface{}{code, status, value}
+}
+
+func writeValue(buf *bytes.Buffer, value interface{}) {
+	buf.WriteString("<value>")
+	switch v := value.(type) {
+	case string:
+		buf.WriteString("<string>")
+		xml.EscapeText(buf, []byte(v))
+		buf.WriteString("</string>")
+	case int:
+		fmt.Fprintf(buf, "<i4>%d</i4>", v)
+	case bool:
+		if v {
+			buf.WriteString("<boolean>1</boolean>")
+		} else {
+			buf.WriteString("<boolean>0</boolean>")
+		}
+	case []interface{}:
+		buf.WriteString("<array><data>")
+		for _, item := range v {
+			writeValue(buf, item)
+		}
+		buf.WriteString("</data></array>")
+	default:
+		panic(fmt.Sprintf("xmlrpc: unsupported value %T", value))
+	}
+	buf.WriteString("</value>")
+}
+
+// xmlrpcHandler serves XML-RPC calls with handle, which returns the value of
+// the response
+func xmlrpcHandler(name string, handle func(call *xmlrpcCall) interface{}) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var call xmlrpcCall
+		if err := xml.NewDecoder(r.Body).Decode(&call); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		var buf bytes.Buffer
+		buf.WriteString(`<?xml version="1.0"?><methodResponse><params><param>`)
+		writeValue(&buf, handle(&call))
+		buf.WriteString("</param></params></methodResponse>")
+
+		w.Header().Set("Content-Type", "text/xml")
+		if _, err := w.Write(buf.Bytes()); err != nil {
+			log.Printf("%s: failed to answer %s: %v", name, call.MethodName, err)
+		}
+	})
+}
@@ -0,0 +1,237 @@
+// Command schemagen generates Go types from the JSON Schemas in lib/schema.
+//
+// It understands the subset of JSON Schema those files use: objects with
+// properties, maps via additionalProperties, arrays, $ref to $defs, and the
+// string, integer, number and boolean types. "format" picks the Go type
+// (date-time, int, int64, uint64), a "contentEncoding" of base64 makes a
+// string []byte and "x-go-name" overrides a field name. An optional $ref
+// property is a pointer, absent when nil, and a schema without a type, {},
+// takes any value as an interface{}.
+// Each schema's $id becomes a <Title>Schema constant for its "schema" field.
+//
+// Usage: go run ./cmd/schemagen -in schema -out schema_types.go
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"go/format"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+type node struct {
+	ID                   string                     `json:"$id"`
+	Title                string                     `json:"title"`
+	Description          string                     `json:"description"`
+	Type                 string                     `json:"type"`
+	Format               string                     `json:"format"`
+	ContentEncoding      string                     `json:"contentEncoding"`
+	Ref                  string                     `json:"$ref"`
+	Properties           json.RawMessage            `json:"properties"`
+	Required             []string                   `json:"required"`
+	AdditionalProperties *node                      `json:"additionalProperties"`
+	Items                *node                      `json:"items"`
+	GoName               string                     `json:"x-go-name"`
+	Defs                 map[string]json.RawMessage `json:"$defs"`
+}
+
+type property struct {
+	name   string
+	schema *node
+}
+
+// orderedProperties decodes an object's properties in file order, so the
+// generated fields follow the schema
+func orderedProperties(raw json.RawMessage) ([]property, error) {
+	if len(raw) == 0 {
+		return nil, nil
+	}
+	decoder := json.NewDecoder(bytes.NewReader(raw))
+	if _, err := decoder.Token(); err != nil {
+		return nil, err
+	}
+
+	var properties []property
+	for decoder.More() {
+		key, err := decoder.Token()
+		if err != nil {
+			return nil, err
+		}
+		var schema node
+		if err := decoder.Decode(&schema); err != nil {
+			return nil, fmt.Errorf("property %v: %v", key, err)
+		}
+		properties = append(properties, property{name: key.(string), schema: &schema})
+	}
+	return properties, nil
+}
+
+func goFieldName(p property) string {
+	if p.schema.GoName != "" {
+		return p.schema.GoName
+	}
+	return strings.ToUpper(p.name[:1]) + p.name[1:]
+}
+
+func goType(n *node) (string, error) {
+	if n.Ref != "" {
+		return strings.TrimPrefix(n.Ref, "#/$defs/"), nil
+	}
+
+	switch n.Type {
+	case "string":
+		if n.Format == "date-time" {
+			return "time.Time", nil
+		}
+		if n.ContentEncoding == "base64" {
+			// encoding/json encodes []byte as base64
+			return "[]byte", nil
+		}
+		return "string", nil
+	case "integer":
+		switch n.Format {
+		case "", "int64":
+			return "int64", nil
+		case "int", "uint64":
+			return n.Format, nil
+		}
+		return "", fmt.Errorf("unsupported integer format %q", n.Format)
+	case "number":
+		return "float64", nil
+	case "boolean":
+		return "bool", nil
+	case "":
+		return "interface{}", nil
+	case "array":
+		if n.Items == nil {
+			return "", fmt.Errorf("array without items")
+		}
+		item, err := goType(n.Items)
+		return "[]" + item, err
+	case "object":
+		if n.AdditionalProperties == nil {
+			return "", fmt.Errorf("inline objects are not supported, use $defs")
+		}
+		value, err := goType(n.AdditionalProperties)
+		return "map[string]" + value, err
+	}
+	return "", fmt.Errorf("unsupported type %q", n.Type)
+}
+
+func lowerFirst(s string) string {
+	if s == "" {
+		return s
+	}
+	return strings.ToLower(s[:1]) + s[1:]
+}
+
+// writeStruct emits the Go struct for an object schema
+func writeStruct(out *bytes.Buffer, name string, n *node) error {
+	if n.Description != "" {
+		fmt.Fprintf(out, "// %s is %s\n", name, lowerFirst(n.Description))
+	}
+	fmt.Fprintf(out, "type %s struct {\n", name)
+
+	properties, err := orderedProperties(n.Properties)
+	if err != nil {
+		return fmt.Errorf("%s: %v", name, err)
+	}
+	required := make(map[string]bool, len(n.Required))
+	for _, r := range n.Required {
+		required[r] = true
+	}
+
+	for _, p := range properties {
+		typ, err := goType(p.schema)
+		if err != nil {
+			return fmt.Errorf("%s.%s: %v", name, p.name, err)
+		}
+		tag := p.name
+		if !required[p.name] {
+			tag += ",omitempty"
+			if p.schema.Ref != "" {
+				typ = "*" + typ
+			}
+		}
+		if p.schema.Description != "" {
+			fmt.Fprintf(out, "\t// %s\n", p.schema.Description)
+		}
+		fmt.Fprintf(out, "\t%s %s `json:%q`\n", goFieldName(p), typ, tag)
+	}
+	out.WriteString("}\n\n")
+	return nil
+}
+
+func generate(files []string) ([]byte, error) {
+	var out bytes.Buffer
+
+	for _, file := range files {
+		data, err := os.ReadFile(file)
+		if err != nil {
+			return nil, err
+		}
+		var root node
+		if err := json.Unmarshal(data, &root); err != nil {
+			return nil, fmt.Errorf("%s: %v", file, err)
+		}
+		if root.Title == "" || root.ID == "" {
+			return nil, fmt.Errorf("%s: $id and title are required", file)
+		}
+
+		fmt.Fprintf(&out, "// %sSchema is the $id of %s, and the value of its \"schema\" field\n", root.Title, filepath.Base(file))
+		fmt.Fprintf(&out, "const %sSchema = %q\n\n", root.Title, root.ID)
+		if err := writeStruct(&out, root.Title, &root); err != nil {
+			return nil, fmt.Errorf("%s: %v", file, err)
+		}
+
+		defNames := make([]string, 0, len(root.Defs))
+		for name := range root.Defs {
+			defNames = append(defNames, name)
+		}
+		sort.Strings(defNames)
+		for _, name := range defNames {
+			var def node
+			if err := json.Unmarshal(root.Defs[name], &def); err != nil {
+				return nil, fmt.Errorf("%s: $defs/%s: %v", file, name, err)
+			}
+			if err := writeStruct(&out, name, &def); err != nil {
+				return nil, fmt.Errorf("%s: %v", file, err)
+			}
+		}
+	}
+
+	var source bytes.Buffer
+	source.WriteString("// Code generated by schemagen from schema/*.schema.json; DO NOT EDIT.\n\n")
+	source.WriteString("package main\n\n")
+	if bytes.Contains(out.Bytes(), []byte("time.Time")) {
+		source.WriteString("import \"time\"\n\n")
+	}
+	source.Write(out.Bytes())
+	return format.Source(source.Bytes())
+}
+
+func main() {
+	in := flag.String("in", "schema", "directory holding *.schema.json")
+	outPath := flag.String("out", "schema_types.go", "Go file to write")
+	flag.Parse()
+
+	files, err := filepath.Glob(filepath.Join(*in, "*.schema.json"))
+	if err != nil {
+		log.Fatal(err)
+	}
+	sort.Strings(files)
+
+	source, err := generate(files)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if err := os.WriteFile(*outPath, source, 0644); err != nil {
+		log.Fatal(err)
+	}
+}
@@ -0,0 +1,251 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net/url"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Composition: a "compose:<main>,<inset>" camera in cameraDirectories
+// streams two other cameras in one picture, composed by ffmpeg
+// (captureCommand): the inset camera over the top right corner of the main
+// one with layout=pip, the default, or the two side by side with
+// layout=side. Each run of the process is fed both cameras' frames through
+// pipes, from sources of their own (with the source manager, taps of their
+// running sources, see source_manager.go), decodes them, composes them with
+// a filtergraph and encodes the result like a captured camera (see
+// camera_capture.go), at the entry's size and fps or the capture defaults.
+// The composition is switched to with the camera command like any camera.
+
+// Composition layouts
+const (
+	composeLayoutPIP  = "pip"
+	composeLayoutSide = "side"
+)
+
+// composeConfig is what a "compose:" camera composes, and how
+type composeConfig struct {
+	main   int // -1 if the entry does not name it
+	inset  int // the camera on the right with layout=side
+	layout string
+	output captureConfig // size, frame rate, bitrate and profile of the composition
+}
+
+// composeCameras returns the composition a "compose:<main>,<inset>" camera
+// entry configures. ok is false for other entries.
+func composeCameras(address string) (config composeConfig, ok bool) {
+	spec, ok := strings.CutPrefix(address, "compose:")
+	if !ok {
+		return composeConfig{}, false
+	}
+	cameras, options, _ := strings.Cut(spec, "?")
+	config = composeConfig{
+		main:   -1,
+		inset:  -1,
+		layout: composeLayoutPIP,
+		output: captureConfig{width: captureWidth, height: captureHeight, fps: captureFPS, bitrate: captureBitrate, profile: captureProfile},
+	}
+	if main, inset, found := strings.Cut(cameras, ","); found {
+		if n, err := strconv.Atoi(strings.TrimSpace(main)); err == nil {
+			config.main = n
+		}
+		if n, err := strconv.Atoi(strings.TrimSpace(inset)); err == nil {
+			config.inset = n
+		}
+	}
+
+	values, _ := url.ParseQuery(options)
+	if layout := values.Get("layout"); layout != "" {
+		config.layout = layout
+	}
+	config.output = captureOptions(config.output, values)
+	return config, true
+}
+
+// newComposition returns a source composing config's cameras
+func (w *WebRTCManager) newComposition(config composeConfig) (*processSource, error) {
+	if config.layout != composeLayoutPIP && config.layout != composeLayoutSide {
+		return nil, fmt.Errorf("unknown composition layout %q (%s or %s)", config.layout, composeLayoutPIP, composeLayoutSide)
+	}
+	for _, camera := range []int{config.main, config.inset} {
+		if !w.validCamera(camera) {
+			return nil, fmt.Errorf("cannot compose camera %d: no such camera", camera)
+		}
+		if address, _ := cameraAddress(camera); strings.HasPrefix(address, "compose:") {
+			return nil, fmt.Errorf("cannot compose camera %d: it is a composition", camera)
+		}
+	}
+
+	var inputs []*composeInput // of the current run
+	source := &processSource{
+		name:         fmt.Sprintf("composition of cameras %d and %d", config.main, config.inset),
+		timeout:      captureTimeout,
+		restartDelay: captureRestartDelay,
+		metric:       "compose.restarts",
+		progress:     true,
+	}
+	source.command = func(port int) (*exec.Cmd, error) {
+		cmd := exec.Command(captureCommand, composeArgs(config, captureEncoders.selectEncoder(), port)...)
+		for _, camera := range []int{config.main, config.inset} {
+			input, err := w.startComposeInput(camera)
+			if err != nil {
+				for _, input := range inputs {
+					input.stop()
+				}
+				inputs = nil
+				return nil, err
+			}
+			inputs = append(inputs, input)
+			// pipe:3 and pipe:4 in the process
+			cmd.ExtraFiles = append(cmd.ExtraFiles, input.reader)
+		}
+		return cmd, nil
+	}
+	source.afterRun = func() {
+		for _, input := range inputs {
+			input.stop()
+		}
+		inputs = nil
+	}
+	source.cost = func() float64 {
+		// Decoding the second camera on top of capturing and encoding one
+		return captureCost(config.output, captureEncoders.selectEncoder()) + captureInputCost
+	}
+	return source, nil
+}
+
+// composeArgs returns the ffmpeg arguments composing config's cameras, read
+// from pipes 3 and 4, with encoder, sending RTP to port
+func composeArgs(config composeConfig, encoder h264Encoder, port int) []string {
+	args := []string{"-hide_banner", "-loglevel", "error", "-progress", "pipe:1"}
+	args = append(args, encoder.inputArgs...)
+	for _, pipe := range []string{"pipe:3", "pipe:4"} {
+		// The frames come live, without timestamps of their own
+		args = append(args, "-use_wallclock_as_timestamps", "1", "-f", "h264", "-i", pipe)
+	}
+	args = append(args, "-filter_complex", composeGraph(config, encoder), "-map", "[out]",
+		"-r", strconv.Itoa(config.output.fps))
+	return append(args, encodeArgs(config.output, encoder, port)...)
+}
+
+// composeGraph returns the filtergraph composing config's cameras, inputs
+// 0 and 1, into [out], through the filter encoder needs
+func composeGraph(config composeConfig, encoder h264Encoder) string {
+	width, height := config.output.width, config.output.height
+	var graph string
+	switch config.layout {
+	case composeLayoutSide:
+		half := width / 2 &^ 1
+		graph = fmt.Sprintf("[0:v]%s[left];[1:v]%s[right];[left][right]hstack",
+			fitFilter(half, height), fitFilter(half, height))
+	default:
+		insetWidth := width * composeInsetPercent / 100 &^ 1
+		margin := width / 40 &^ 1
+		graph = fmt.Sprintf("[0:v]%s[main];[1:v]scale=%d:-2,setsar=1[inset];[main][inset]overlay=W-w-%d:%d",
+			fitFilter(width, height), insetWidth, margin, margin)
+	}
+	if encoder.filter != "" {
+		graph += "," + encoder.filter
+	}
+	return graph + "[out]"
+}
+
+// fitFilter returns the filters scaling a picture to fit width x height,
+// letterboxed
+func fitFilter(width int, height int) string {
+	return fmt.Sprintf("scale=%d:%d:force_original_aspect_ratio=decrease,pad=%d:%d:(ow-iw)/2:(oh-ih)/2,setsar=1",
+		width, height, width, height)
+}
+
+// composeInput feeds one camera of a composition to the process, as Annex
+// B on a pipe
+type composeInput struct {
+	camera         int
+	source         VideoSource
+	reader, writer *os.File
+	// Parameter sets of the camera, for keyframes sent without them
+	sps, pps []byte
+	keyframe bool // one was written; frames before it are dropped
+	buffer   []byte
+}
+
+// startComposeInput starts a source of camera feeding a new pipe: one from
+// the camera's factory, or a source of its frame files
+func (w *WebRTCManager) startComposeInput(camera int) (*composeInput, error) {
+	var source VideoSource
+	if factory, ok := w.cameraFactory(camera); ok {
+		var err error
+		if source, err = w.cameraSource(camera, factory); err != nil {
+			return nil, fmt.Errorf("failed to open camera %d: %v", camera, err)
+		}
+	} else {
+		files, err := findH264Files(cameraDirectories[camera])
+		if err != nil {
+			return nil, fmt.Errorf("failed to load camera %d files: %v", camera, err)
+		}
+		// The frame files are recorded at 30 FPS
+		recorded := newFileSource(mediaClock, time.Second/30)
+		recorded.useFiles(files)
+		source = recorded
+	}
+
+	reader, writer, err := os.Pipe()
+	if err != nil {
+		return nil, err
+	}
+	input := &composeInput{camera: camera, source: source, reader: reader, writer: writer}
+	if err := source.Start(input); err != nil {
+		reader.Close()
+		writer.Close()
+		return nil, fmt.Errorf("failed to start camera %d: %v", camera, err)
+	}
+	return input, nil
+}
+
+// stop stops the input once its run of the process ended
+func (c *composeInput) stop() {
+	// Closing the reader fails a write blocked on a process no longer
+	// reading, which stopping the source waits for
+	c.reader.Close()
+	c.source.Stop()
+	c.writer.Close()
+}
+
+// WriteFrame implements SampleSink
+func (c *composeInput) WriteFrame(frame VideoFrame) bool {
+	idr, hasSPS := false, false
+	forEachNAL(frame.Data, func(nal []byte) {
+		switch nal[0] & 0x1F {
+		case NAL_SPS:
+			c.sps, hasSPS = append(c.sps[:0], nal...), true
+		case NAL_PPS:
+			c.pps = append(c.pps[:0], nal...)
+		case NAL_IDR:
+			idr = true
+		}
+	})
+	// The decoder starts at a keyframe
+	if !c.keyframe && !idr {
+		return true
+	}
+	c.keyframe = true
+
+	c.buffer = c.buffer[:0]
+	if idr && !hasSPS && c.sps != nil && c.pps != nil {
+		c.buffer = appendAnnexBNAL(c.buffer, c.sps)
+		c.buffer = appendAnnexBNAL(c.buffer, c.pps)
+	}
+	c.buffer = appendAnnexB(c.buffer, frame.Data)
+	_, err := c.writer.Write(c.buffer)
+	return err == nil
+}
+
+// ReportError implements SampleSink
+func (c *composeInput) ReportError(err error) {
+	log.Printf("Camera %d of a composition: %v", c.camera, err)
+}
@@ -0,0 +1,331 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Config audit triggers, see ConfigAudit
+const (
+	TriggerStartup = "startup"
+	TriggerAdmin   = "admin"
+	TriggerAPI     = "api"
+)
+
+// redacted replaces secret values in published audit events
+const redacted = "[redacted]"
+
+// secretSettings are never published or stored in clear. The stored
+// snapshot keeps a fingerprint of them so a rotated secret still shows up
+// as a change.
+var secretSettings = map[string]bool{
+	"identity.password":  true,
+	"offerAuthJWTSecret": true,
+	"iceTURNCredential":  true,
+}
+
+// staticConfig returns the settings fixed for the life of the process: the
+// build's constants and the device identity. Secrets are fingerprinted.
+func staticConfig() map[string]string {
+	config := map[string]string{
+		"identity.broker":          identity.Broker,
+		"identity.port":            fmt.Sprint(identity.Port),
+		"identity.username":        identity.Username,
+		"identity.password":        identity.Password,
+		"identity.thingName":       identity.ThingName,
+		"identity.clientId":        identity.ClientID,
+		"identity.topicPrefix":     identity.TopicPrefix,
+		"peerTopicTemplate":        peerTopicTemplate,
+		"deviceTopicTemplate":      deviceTopicTemplate,
+		"broadcastTopicTemplate":   broadcastTopicTemplate,
+		"sharedSubscriptionGroup":  sharedSubscriptionGroup,
+		"mqttSignalingEnabled":     fmt.Sprint(mqttSignalingEnabled),
+		"webSocketSignalingAddr":   webSocketSignalingAddr,
+		"whipAddr":                 whipAddr,
+		"candidateBatchWindow":     candidateBatchWindow.String(),
+		"mediaInterface":           mediaInterface,
+		"signalingInterface":       signalingInterface,
+		"mediaDSCP":                fmt.Sprint(mediaDSCP),
+		"signalingDSCP":            fmt.Sprint(signalingDSCP),
+		"controlChannelEnabled":    fmt.Sprint(controlChannelEnabled),
+		"iceSTUNURL":               iceSTUNURL,
+		"iceTURNURLs":              iceTURNURLs,
+		"iceTURNUsername":          iceTURNUsername,
+		"iceTURNCredential":        iceTURNCredential,
+		"iceTCPEnabled":            fmt.Sprint(iceTCPEnabled),
+		"mediaUDPPortMin":          fmt.Sprint(mediaUDPPortMin),
+		"mediaUDPPortMax":          fmt.Sprint(mediaUDPPortMax),
+		"natPublicIPs":             natPublicIPs,
+		"natCandidateType":         natCandidateType,
+		"mdnsCandidatesDisabled":   fmt.Sprint(mdnsCandidatesDisabled),
+		"iceTCPPort":               fmt.Sprint(iceTCPPort),
+		"offerAuthMode":            offerAuthMode,
+		"offerAuthJWTSecret":       offerAuthJWTSecret,
+		"offerAuthEndpoint":        offerAuthEndpoint,
+		"mqttNetworkProfile":       mqttNetworkProfile,
+		"mqttKeepAlive":            activeMQTTProfile().KeepAlive.String(),
+		"mqttPingTimeout":          activeMQTTProfile().PingTimeout.String(),
+		"frameQueueSize":           fmt.Sprint(frameQueueSize),
+		"frameQueueOverflowPolicy": fmt.Sprint(frameQueueOverflowPolicy),
+		"pacingResyncLag":          pacingResyncLag.String(),
+		"frameBufferSize":          fmt.Sprint(frameBufferSize),
+		"frameBufferMaxSize":       fmt.Sprint(frameBufferMaxSize),
+		"gopCacheEnabled":          fmt.Sprint(gopCacheEnabled),
+		"gopCacheMaxPackets":       fmt.Sprint(gopCacheMaxPackets),
+		"sourceManagerEnabled":     fmt.Sprint(sourceManagerEnabled),
+		"sourceManagerCPUBudget":   fmt.Sprint(sourceManagerCPUBudget),
+		"rtspTimeout":              rtspTimeout.String(),
+		"rtspReconnectDelay":       rtspReconnectDelay.String(),
+		"rtspKeepaliveInterval":    rtspKeepaliveInterval.String(),
+		"gstreamerCommand":         gstreamerCommand,
+		"gstreamerTimeout":         gstreamerTimeout.String(),
+		"gstreamerRestartDelay":    gstreamerRestartDelay.String(),
+		"captureCommand":           captureCommand,
+		"captureEncoder":           captureEncoder,
+		"captureProfile":           captureProfile,
+		"captureWidth":             fmt.Sprint(captureWidth),
+		"captureHeight":            fmt.Sprint(captureHeight),
+		"capturePixelFormat":       capturePixelFormat,
+		"captureFPS":               fmt.Sprint(captureFPS),
+		"captureBitrate":           fmt.Sprint(captureBitrate),
+		"captureTimeout":           captureTimeout.String(),
+		"captureRestartDelay":      captureRestartDelay.String(),
+		"encoderUser":              encoderUser,
+		"encoderCgroup":            encoderCgroup,
+		"encoderMemoryMax":         fmt.Sprint(encoderMemoryMax),
+		"encoderCPUMax":            fmt.Sprint(encoderCPUMax),
+		"composeInsetPercent":      fmt.Sprint(composeInsetPercent),
+		"mjpegWidth":               fmt.Sprint(mjpegWidth),
+		"mjpegHeight":              fmt.Sprint(mjpegHeight),
+		"mjpegFPS":                 fmt.Sprint(mjpegFPS),
+		"mjpegBitrate":             fmt.Sprint(mjpegBitrate),
+		"mjpegViewMaxFPS":          fmt.Sprint(mjpegViewMaxFPS),
+		"mjpegViewMaxFrame":        fmt.Sprint(mjpegViewMaxFrame),
+		"mjpegViewMaxBuffered":     fmt.Sprint(mjpegViewMaxBuffered),
+		"rosNodeName":              rosNodeName,
+		"rosMasterURI":             rosMasterURI,
+		"rosHostname":              rosHostname,
+		"rosTimeout":               rosTimeout.String(),
+		"rosReconnectDelay":        rosReconnectDelay.String(),
+		"rosMaxMessageSize":        fmt.Sprint(rosMaxMessageSize),
+		"rosTopicMapPath":          rosTopicMapPath,
+		"rosDiscoveryInterval":     rosDiscoveryInterval.String(),
+		"rosServicesPath":          rosServicesPath,
+		"rosServiceTimeout":        rosServiceTimeout.String(),
+		"teleopTopic":              teleopTopic,
+		"teleopMaxLinear":          fmt.Sprint(teleopMaxLinear),
+		"teleopMaxAngular":         fmt.Sprint(teleopMaxAngular),
+		"teleopMaxRate":            fmt.Sprint(teleopMaxRate),
+		"teleopTimeout":            teleopTimeout.String(),
+		"estopTopic":               estopTopic,
+		"mqttControlEnabled":       fmt.Sprint(mqttControlEnabled),
+		"telemetryInterval":        telemetryInterval.String(),
+		"telemetryChannelID":       fmt.Sprint(telemetryChannelID),
+		"telemetryOdometryTopic":   telemetryOdometryTopic,
+		"telemetryJointsTopic":     telemetryJointsTopic,
+		"telemetryBatteryTopic":    telemetryBatteryTopic,
+		"telemetryGPSTopic":        telemetryGPSTopic,
+		"telemetryMaxAge":          telemetryMaxAge.String(),
+		"snapshotQuality":          fmt.Sprint(snapshotQuality),
+		"snapshotTimeout":          snapshotTimeout.String(),
+		"snapshotHTTPEnabled":      fmt.Sprint(snapshotHTTPEnabled),
+		"frameCacheMode":           frameCacheMode,
+		"frameCacheMaxBytes":       fmt.Sprint(frameCacheMaxBytes),
+		"keyframeMinInterval":      keyframeMinInterval.String(),
+		"streamLinger":             streamLinger.String(),
+		"resumeTokenTTL":           resumeTokenTTL.String(),
+		"keyChannelID":             fmt.Sprint(keyChannelID),
+		"rtpForwarding":            fmt.Sprint(rtpForwarding),
+		"rtpMTU":                   fmt.Sprint(rtpMTU),
+		"nackEnabled":              fmt.Sprint(nackEnabled),
+		"rtxEnabled":               fmt.Sprint(rtxEnabled),
+		"sdpProfileLevelID":        sdpProfileLevelID,
+		"sdpVideoBandwidthKbps":    fmt.Sprint(sdpVideoBandwidthKbps),
+		"e2eeEnabled":              fmt.Sprint(e2eeEnabled),
+		"twccEnabled":              fmt.Sprint(twccEnabled),
+		"adaptiveBitrateEnabled":   fmt.Sprint(adaptiveBitrateEnabled),
+		"abrUpgradeHold":           abrUpgradeHold.String(),
+		"viewerMaxBitrate":         fmt.Sprint(viewerMaxBitrate),
+		"operatorMaxBitrate":       fmt.Sprint(operatorMaxBitrate),
+		"simulcastEnabled":         fmt.Sprint(simulcastEnabled),
+		"codecFallback":            codecFallback,
+		"adaptiveFPSEnabled":       fmt.Sprint(adaptiveFPSEnabled),
+		"adaptiveFPSMaxLag":        adaptiveFPSMaxLag.String(),
+		"captureTimeExtension":     fmt.Sprint(captureTimeExtension),
+		"seiCaptureTime":           fmt.Sprint(seiCaptureTime),
+		"seiFrameInfo":             fmt.Sprint(seiFrameInfo),
+		"seiFrameChecksum":         fmt.Sprint(seiFrameChecksum),
+		"cameraHealthEnabled":      fmt.Sprint(cameraHealthEnabled),
+		"stallWatchdogEnabled":     fmt.Sprint(stallWatchdogEnabled),
+		"stallTimeout":             stallTimeout.String(),
+		"stallFallbackCamera":      fmt.Sprint(stallFallbackCamera),
+		"cpuGovernorEnabled":       fmt.Sprint(cpuGovernorEnabled),
+		"governorHighCPU":          fmt.Sprint(governorHighCPU),
+		"governorLowCPU":           fmt.Sprint(governorLowCPU),
+		"peerReapingEnabled":       fmt.Sprint(peerReapingEnabled),
+		"peerKeepaliveTimeout":     peerKeepaliveTimeout.String(),
+		"peerStaleTimeout":         peerStaleTimeout.String(),
+		"defaultPeerRole":          defaultPeerRole,
+		"incomingMediaEnabled":     fmt.Sprint(incomingMediaEnabled),
+		"incomingMediaDir":         incomingMediaDir,
+		"maxPeers":                 fmt.Sprint(maxPeers),
+		"peerAdmissionPolicy":      peerAdmissionPolicy,
+		"peerStatsInterval":        peerStatsInterval.String(),
+		"pipelineStatsInterval":    pipelineStatsInterval.String(),
+		"peerQualityEnabled":       fmt.Sprint(peerQualityEnabled),
+		"qualityGoodRTTMs":         fmt.Sprint(qualityGoodRTTMs),
+		"qualityBadRTTMs":          fmt.Sprint(qualityBadRTTMs),
+		"qualityBadLoss":           fmt.Sprint(qualityBadLoss),
+		"sessionStorePath":         sessionStorePath,
+		"logStreamingEnabled":      fmt.Sprint(logStreamingEnabled),
+		"eventMirrorBackend":       eventMirrorBackend,
+		"eventMirrorURL":           eventMirrorURL,
+		"eventMirrorSubject":       eventMirrorSubject,
+		"metricsAddr":              metricsAddr,
+	}
+	for key := range secretSettings {
+		if value := config[key]; value != "" {
+			config[key] = fingerprint(value)
+		}
+	}
+	return config
+}
+
+func fingerprint(secret string) string {
+	sum := sha256.Sum256([]byte(secret))
+	return "sha256:" + hex.EncodeToString(sum[:8])
+}
+
+// diffConfig lists the settings that differ between old and current, in key
+// order, with secret values redacted
+func diffConfig(old map[string]string, current map[string]string) []ConfigChange {
+	keys := make(map[string]bool, len(current))
+	for key := range old {
+		keys[key] = true
+	}
+	for key := range current {
+		keys[key] = true
+	}
+
+	var changes []ConfigChange
+	for key := range keys {
+		oldValue, hadOld := old[key]
+		newValue, hasNew := current[key]
+		if hadOld == hasNew && oldValue == newValue {
+			continue
+		}
+		if secretSettings[key] {
+			if oldValue != "" {
+				oldValue = redacted
+			}
+			if newValue != "" {
+				newValue = redacted
+			}
+		}
+		changes = append(changes, ConfigChange{Key: key, Old: oldValue, New: newValue})
+	}
+	sort.Slice(changes, func(i, j int) bool { return changes[i].Key < changes[j].Key })
+	return changes
+}
+
+// ConfigAuditor publishes what changed whenever the configuration does: at
+// startup against the snapshot saved by the previous run, which catches new
+// builds and identities pushed to the robot, and at runtime for settings
+// changed by admin commands or the C API.
+type ConfigAuditor struct {
+	path    string
+	current map[string]string
+	publish func(ConfigAudit)
+	mu      sync.Mutex
+}
+
+// configAudit is set by RMCSInit when configAuditPath is configured
+var configAudit *ConfigAuditor
+
+func NewConfigAuditor(path string, publish func(ConfigAudit)) *ConfigAuditor {
+	return &ConfigAuditor{path: path, current: make(map[string]string), publish: publish}
+}
+
+// Startup compares the running configuration with the previous run's and
+// saves it for the next one. The first run reports every setting as new.
+func (a *ConfigAuditor) Startup() {
+	config := staticConfig()
+
+	previous := make(map[string]string)
+	if data, err := os.ReadFile(a.path); err == nil {
+		if err := json.Unmarshal(data, &previous); err != nil {
+			log.Printf("Ignoring unreadable config snapshot %s: %v", a.path, err)
+		}
+	} else if !os.IsNotExist(err) {
+		log.Printf("Failed to read config snapshot %s: %v", a.path, err)
+	}
+
+	a.mu.Lock()
+	for key, value := range config {
+		a.current[key] = value
+	}
+	// Runtime settings start from their defaults every run
+	a.current["maintenance"] = "false"
+	a.mu.Unlock()
+
+	if data, err := json.MarshalIndent(config, "", "  "); err == nil {
+		if err := os.WriteFile(a.path, data, 0600); err != nil {
+			log.Printf("Failed to save config snapshot %s: %v", a.path, err)
+		}
+	}
+
+	a.emit(TriggerStartup, "", diffConfig(previous, config))
+}
+
+// Set records a runtime setting changed by trigger on behalf of source,
+// publishing an audit event if its value differs
+func (a *ConfigAuditor) Set(key string, value string, trigger string, source string) {
+	a.mu.Lock()
+	old, existed := a.current[key]
+	if existed && old == value {
+		a.mu.Unlock()
+		return
+	}
+	before := map[string]string{}
+	if existed {
+		before[key] = old
+	}
+	a.current[key] = value
+	a.mu.Unlock()
+
+	a.emit(trigger, source, diffConfig(before, map[string]string{key: value}))
+}
+
+func (a *ConfigAuditor) emit(trigger string, source string, changes []ConfigChange) {
+	if len(changes) == 0 {
+		return
+	}
+
+	event := ConfigAudit{
+		Schema:  ConfigAuditSchema,
+		Thing:   identity.ThingName,
+		Trigger: trigger,
+		Source:  source,
+		Changes: changes,
+		Time:    time.Now().UTC(),
+	}
+	log.Printf("Configuration changed (%s %s): %d settings", trigger, source, len(changes))
+	metrics.Inc("config.audit_events")
+	if a.publish != nil {
+		a.publish(event)
+	}
+}
+
+// auditSetting records a runtime setting change if auditing is on
+func auditSetting(key string, value string, trigger string, source string) {
+	if configAudit != nil {
+		configAudit.Set(key, value, trigger, source)
+	}
+}
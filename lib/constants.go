@@ -1,5 +1,7 @@
 package main
 
+import "time"
+
 const (
 	broker    = "rmcs.d6-vnext.com"
 	port      = 1883
@@ -7,5 +9,548 @@ const (
 	password  = "RMy4aJ%9"
 	thingName = "d76053c0-6cae-47ee-b4c6-a7f96573f7e6"
 	clientID  = "go-backend-rmcs-client"
-	baseTopic = "d76053c0-6cae-47ee-b4c6-a7f96573f7e6/robot-control"
+
+	// provisioningEnabled registers the robot on first boot: the credentials
+	// above are used only as bootstrap credentials to publish a registration
+	// request on <provisioningTopicPrefix>/<hardwareId>/request, and the
+	// identity received on .../response is stored in identityFilePath
+	provisioningEnabled     = false
+	provisioningTopicPrefix = "rmcs/provisioning"
+	identityFilePath        = "rmcs-identity.json"
+	provisioningTimeout     = 60 * time.Second
+
+	// Topic templates, see topics.go. {thing} is thingName, {peer} a peer
+	// ID and {channel} the message type (offer, answer, camera, ...).
+	// {peer} must be a whole topic level so it can be subscribed with "+".
+	peerTopicTemplate      = "{thing}/robot-control/{peer}/{channel}"
+	deviceTopicTemplate    = "{thing}/{channel}"
+	broadcastTopicTemplate = "{thing}/robot-control/{channel}"
+
+	// sharedSubscriptionGroup, when set, subscribes to offers through the
+	// broker's $share/<group>/ mechanism so that only one of several
+	// redundant instances answers a given offer. Each instance then also
+	// gets a unique MQTT client ID.
+	sharedSubscriptionGroup = ""
+
+	// mqttSignalingEnabled connects to the broker above for signaling.
+	// Disable it together with webSocketSignalingAddr for broker-less setups.
+	mqttSignalingEnabled = true
+
+	// webSocketSignalingAddr, when set (e.g. ":8080"), serves a WebSocket
+	// signaling endpoint at ws://<addr>/signaling?peerId=<id>
+	webSocketSignalingAddr = ""
+
+	// whipAddr, when set (e.g. ":8081"), serves WHIP ingest at
+	// http://<addr>/whip and WHEP playback at http://<addr>/whep for standard
+	// players and encoders (see whip.go)
+	whipAddr = ""
+
+	// candidateBatchWindow batches the ICE candidates gathered within this
+	// long of the first into one message, instead of a message each, to cut
+	// broker chatter during connection setup; 0 sends each on its own
+	candidateBatchWindow = 50 * time.Millisecond
+
+	// mediaInterface and signalingInterface bind WebRTC media and the MQTT
+	// connection to network interfaces by name (e.g. media over "wwan0",
+	// signaling over "wlan0"); empty uses any interface. mediaDSCP and
+	// signalingDSCP mark their packets with a DSCP code point (e.g. 46 for
+	// EF, 34 for AF41); 0 leaves them unmarked. A media DSCP makes all
+	// peers share one UDP port.
+	mediaInterface     = ""
+	signalingInterface = ""
+	mediaDSCP          = 0
+	signalingDSCP      = 0
+
+	// mediaUDPPortMin and mediaUDPPortMax limit the UDP ports media uses,
+	// for firewall rules; 0 and 0 allow any. A media DSCP already confines
+	// media to one port, so the range is unused then.
+	mediaUDPPortMin = 0
+	mediaUDPPortMax = 0
+
+	// natPublicIPs (comma-separated) advertises the robot behind a static
+	// 1:1 NAT, e.g. a cloud instance, at its public addresses: one for
+	// every local address, or "public/local" pairs. natCandidateType "host"
+	// advertises them instead of the local addresses; "srflx" adds them as
+	// server reflexive candidates, which replaces STUN. Empty disables.
+	natPublicIPs     = ""
+	natCandidateType = "host"
+
+	// mdnsCandidatesDisabled neither gathers nor resolves .local mDNS
+	// candidates, on networks where multicast is blocked or unwanted
+	mdnsCandidatesDisabled = false
+
+	// controlChannelEnabled adds a negotiated "control" data channel with id
+	// controlChannelID to every peer connection, carrying drive, e-stop and
+	// PTZ commands peer-to-peer (see control_channel.go)
+	controlChannelEnabled = true
+	controlChannelID      = 0
+
+	// iceSTUNURL and iceTURNURLs (comma-separated) are offered to every
+	// peer connection. For networks that block UDP, list TURN over TCP and
+	// TLS, e.g. "turn:turn.example.com:3478?transport=tcp,
+	// turns:turn.example.com:443?transport=tcp", authenticated with
+	// iceTURNUsername and iceTURNCredential. iceTCPEnabled also gathers
+	// ICE-TCP candidates on iceTCPPort, reachable without a relay when only
+	// that port is allowed through.
+	iceSTUNURL        = "stun:stun.l.google.com:19302"
+	iceTURNURLs       = ""
+	iceTURNUsername   = ""
+	iceTURNCredential = ""
+	iceTCPEnabled     = false
+	iceTCPPort        = 8443
+
+	// offerAuthMode requires a token with every offer (see auth.go): "jwt"
+	// checks an HS256 JWT signed with offerAuthJWTSecret, "endpoint" has
+	// offerAuthEndpoint vouch for an opaque token within offerAuthTimeout,
+	// and "" answers every offer
+	offerAuthMode      = AuthNone
+	offerAuthJWTSecret = ""
+	offerAuthEndpoint  = "https://auth.example.com/rmcs/validate"
+	offerAuthTimeout   = 5 * time.Second
+
+	// defaultPeerRole is the role of peers whose token names none, and of
+	// every peer with offerAuthMode off (see roles.go). RoleOperator gets
+	// video and the control channel, RoleViewer sendonly video only.
+	defaultPeerRole = RoleOperator
+
+	// mqttNetworkProfile selects the broker connection timing preset for the
+	// signaling link, "lan" or "lte" (see mqttNetworkProfiles in
+	// network.go). mqttKeepAlive, mqttPingTimeout and mqttTCPKeepAlive
+	// override the preset when non-zero.
+	mqttNetworkProfile = "lan"
+	mqttKeepAlive      = 0 * time.Second
+	mqttPingTimeout    = 0 * time.Second
+	mqttTCPKeepAlive   = 0 * time.Second
+
+	// mqttTokenTimeout bounds how long a publish or subscribe waits for the
+	// broker; publishes that exceed it are counted as unacked
+	mqttTokenTimeout = 5 * time.Second
+
+	// mqttResubscribeInterval is how often subscriptions that failed after a
+	// (re)connect are retried while the connection stays up
+	mqttResubscribeInterval = 5 * time.Second
+
+	// mqttDrainTimeout bounds each stage of the shutdown drain: flushing
+	// pending publishes and the final disconnect
+	mqttDrainTimeout = 2 * time.Second
+
+	// drainOnSIGTERM drains MQTT (see MQTTClient.Disconnect) when the host
+	// process receives SIGTERM, before letting the signal terminate it
+	drainOnSIGTERM = true
+
+	// videoOutputCount video tracks are sent to every peer, each fed from
+	// its own camera: 1, 2, ... by default, then switched individually
+	// (the first with the camera command) or together as a camera group
+	// (see camera_groups.go). Dual-screen stations use 2.
+	videoOutputCount = 1
+
+	// frameQueueSize frames (one second at 30 FPS) can wait between the NAL
+	// reader and the track writer. frameQueueOverflowPolicy decides what
+	// happens when it is full: OverflowBlock, OverflowDropNewest,
+	// OverflowDropOldest or OverflowDropOldestKeepKeyframes (see
+	// frame_queue.go). Blocking holds up the source, a capture process or
+	// the host's frame callbacks, for as long as the track is behind, so the
+	// default drops the oldest delta frames instead: the picture smears until
+	// the next IDR, but every keyframe gets through.
+	frameQueueSize           = 30
+	frameQueueOverflowPolicy = OverflowDropOldestKeepKeyframes
+
+	// Frame files are paced to deadlines (see frame_pacer.go); a stream
+	// more than pacingResyncLag behind them restarts its schedule instead
+	// of catching up
+	pacingResyncLag = 500 * time.Millisecond
+
+	// Samples are built in pooled buffers of at least frameBufferSize bytes
+	// (see frame_buffers.go). A buffer an unusually large keyframe grew past
+	// frameBufferMaxSize is left to the garbage collector instead.
+	frameBufferSize    = 64 * 1024
+	frameBufferMaxSize = 1024 * 1024
+
+	// gopCacheEnabled replays each track's packets since its last keyframe
+	// to a peer joining it, so its video starts at once (see gop_cache.go).
+	// A GOP of more than gopCacheMaxPackets packets (about 3.5 MB) is not
+	// kept.
+	gopCacheEnabled    = true
+	gopCacheMaxPackets = 3000
+
+	// sourceManagerEnabled keeps cameras streamed from sources running in a
+	// SourceManager, shared by the tracks showing them and started ahead of
+	// being shown, so switching to one swaps to an encoder already running
+	// (see source_manager.go). sourceManagerCPUBudget bounds the cores the
+	// sources running take, as estimated.
+	sourceManagerEnabled   = true
+	sourceManagerCPUBudget = 2.0
+
+	// RTSP cameras (rtsp:// URLs in cameraDirectories, see rtsp_source.go)
+	// reconnect rtspReconnectDelay after their connection fails or they send
+	// nothing for rtspTimeout, and are sent a keepalive every
+	// rtspKeepaliveInterval, or half the session timeout they ask for
+	rtspTimeout           = 10 * time.Second
+	rtspReconnectDelay    = 2 * time.Second
+	rtspKeepaliveInterval = 30 * time.Second
+
+	// GStreamer cameras ("gst:<name>" in cameraDirectories, see
+	// gstreamer_source.go) run their pipeline with gstreamerCommand,
+	// restarted gstreamerRestartDelay after it exits or sends nothing for
+	// gstreamerTimeout
+	gstreamerCommand      = "gst-launch-1.0"
+	gstreamerTimeout      = 10 * time.Second
+	gstreamerRestartDelay = 2 * time.Second
+
+	// Captured cameras ("capture:<device>" in cameraDirectories, see
+	// camera_capture.go) are captured and encoded by captureCommand at
+	// captureWidth x captureHeight, captureFPS and captureBitrate bits per
+	// second, in the device's capturePixelFormat ("" for its default, or
+	// e.g. "yuyv422", "mjpeg"), unless the entry sets its own. It is
+	// restarted captureRestartDelay after it exits or sends nothing for
+	// captureTimeout. captureEncoder is "auto", picking the best
+	// encoder of the platform (see encoder.go), or an ffmpeg encoder name:
+	// h264_nvenc, h264_vaapi, h264_v4l2m2m, h264_videotoolbox or libx264.
+	// captureProfile is the encoder profile, "ultra-low-latency" or
+	// "quality" (see encoderProfiles in encoder.go).
+	captureCommand      = "ffmpeg"
+	captureEncoder      = "auto"
+	captureProfile      = "ultra-low-latency"
+	captureWidth        = 1280
+	captureHeight       = 720
+	capturePixelFormat  = ""
+	captureFPS          = 30
+	captureBitrate      = 2000000
+	captureTimeout      = 10 * time.Second
+	captureRestartDelay = 2 * time.Second
+
+	// Encoder processes, GStreamer pipelines and ffmpeg, are killed with
+	// the backend (see sandbox_linux.go). They run as encoderUser, a user
+	// name or ID ("" for the backend's own; changing it takes root), and
+	// with encoderCgroup, the path of a cgroup v2 directory the backend can
+	// write ("" for none), in that cgroup, limited to encoderMemoryMax
+	// bytes and encoderCPUMax cores (0 for no limit) between them.
+	encoderUser      = ""
+	encoderCgroup    = ""
+	encoderMemoryMax = 0
+	encoderCPUMax    = 0.0
+
+	// Compositions ("compose:<main>,<inset>" in cameraDirectories, see
+	// compose_source.go) are encoded like captured cameras; with layout=pip
+	// the inset camera is composeInsetPercent of the picture's width
+	composeInsetPercent = 30
+
+	// MJPEG cameras ("mjpeg:<url>" in cameraDirectories, see
+	// mjpeg_source.go) are transcoded like captured cameras, scaled to
+	// mjpegWidth x mjpegHeight at mjpegFPS and encoded at mjpegBitrate,
+	// unless the entry sets its own. A peer's jpeg-view gets a camera's
+	// JPEGs on a data channel instead, at most mjpegViewMaxFPS a second;
+	// frames over mjpegViewMaxFrame bytes, or sent while more than
+	// mjpegViewMaxBuffered bytes are still queued, are skipped.
+	mjpegWidth           = 640
+	mjpegHeight          = 480
+	mjpegFPS             = 15
+	mjpegBitrate         = 1000000
+	mjpegViewMaxFPS      = 5
+	mjpegViewMaxFrame    = 256 * 1024
+	mjpegViewMaxBuffered = 1024 * 1024
+
+	// ROS cameras ("ros:<topic>" in cameraDirectories, see ros_source.go)
+	// are encoded like captured cameras. The backend's ROS node (see
+	// ros_node.go), rosNodeName, registers with the master at rosMasterURI
+	// ("" for $ROS_MASTER_URI, or http://localhost:11311/) and is reached
+	// by other nodes at rosHostname ("" for $ROS_HOSTNAME, $ROS_IP or the
+	// host's name). Master and node API calls, and connecting to
+	// publishers, give up after rosTimeout; a publisher's connection is
+	// retried rosReconnectDelay after it fails. Messages over
+	// rosMaxMessageSize bytes end the connection.
+	rosNodeName       = "/rmcs"
+	rosMasterURI      = ""
+	rosHostname       = ""
+	rosTimeout        = 5 * time.Second
+	rosReconnectDelay = 2 * time.Second
+	rosMaxMessageSize = 64 * 1024 * 1024
+
+	// rosTopicMapPath maps cameras to ROS topics, loaded at startup (see
+	// ros_discovery.go); empty, or no file there, keeps cameraDirectories as
+	// built in. rosDiscoveryInterval is how often the master's image topics
+	// are listed and, when they changed, published retained to
+	// <thingName>/ros-topics; zero disables discovery.
+	rosTopicMapPath      = "rmcs-topics.json"
+	rosDiscoveryInterval = 0 * time.Second
+
+	// rosServicesPath allowlists the ROS services the operator may call,
+	// with their types, loaded at startup (see ros_service.go); empty, or
+	// no file there, allows none. A call gives up after rosServiceTimeout.
+	rosServicesPath   = "rmcs-services.json"
+	rosServiceTimeout = 10 * time.Second
+
+	// Teleoperation (see teleop.go) publishes drive commands as
+	// geometry_msgs/Twist on teleopTopic, the robot's cmd_vel; empty
+	// disables it. Commands beyond teleopMaxLinear m/s or teleopMaxAngular
+	// rad/s are refused, at most teleopMaxRate a second are published, and
+	// the robot is stopped teleopTimeout after the last one (zero never).
+	teleopTopic      = "/cmd_vel"
+	teleopMaxLinear  = 1.0
+	teleopMaxAngular = 2.0
+	teleopMaxRate    = 20
+	teleopTimeout    = 500 * time.Millisecond
+
+	// mqttControlEnabled takes drive commands, e-stop releases and ROS
+	// service calls on their MQTT topics too. MQTT messages carry no token
+	// or role, so anyone who can publish to the broker could sidestep the
+	// viewer role; off, only operators control the robot, over the control
+	// channel. Engaging the e-stop is always taken.
+	mqttControlEnabled = false
+
+	// The e-stop (see estop.go) stops the robot on teleopTopic and latches
+	// its state on estopTopic, a std_msgs/Bool; empty publishes none.
+	estopTopic = "/e_stop"
+
+	// Telemetry (see telemetry.go): the latest of telemetryOdometryTopic,
+	// telemetryJointsTopic, telemetryBatteryTopic and telemetryGPSTopic
+	// (empty skips one) is sent every telemetryInterval on a negotiated "telemetry" data
+	// channel with id telemetryChannelID, or on <thingName>/telemetry while
+	// no peer has it open; zero disables telemetry. What was not received
+	// for telemetryMaxAge is left out. Each new GPS fix is also retained
+	// on <thingName>/gps.
+	telemetryInterval      = 200 * time.Millisecond
+	telemetryChannelID     = 1
+	telemetryOdometryTopic = "/odom"
+	telemetryJointsTopic   = "/joint_states"
+	telemetryBatteryTopic  = "/battery_state"
+	telemetryGPSTopic      = "/gps/fix"
+	telemetryMaxAge        = 5 * time.Second
+
+	// Snapshots (see snapshot.go) decode a track's last keyframe into a
+	// JPEG of snapshotQuality (ffmpeg -q:v, 2 best to 31), giving up after
+	// snapshotTimeout. snapshotHTTPEnabled also serves them at /snapshot
+	// on the metrics server, which has no authentication: it is off unless
+	// that port is private to the robot.
+	snapshotQuality     = 3
+	snapshotTimeout     = 5 * time.Second
+	snapshotHTTPEnabled = false
+
+	// frameCacheMode keeps the frame files of the cameras loaded in memory,
+	// so streaming them does no disk I/O (see frame_cache.go): "preload"
+	// reads them, "mmap" maps them, "" reads a file every frame.
+	// frameCacheMaxBytes caps the cache, shared by every camera; the least
+	// recently streamed files are evicted first.
+	frameCacheMode     = "preload"
+	frameCacheMaxBytes = 128 << 20
+
+	// keyframeMinInterval coalesces PLI/FIR keyframe requests: one keyframe
+	// per interval serves every peer, as they all share the track
+	keyframeMinInterval = 500 * time.Millisecond
+
+	// streamLinger keeps the video pipeline running this long after the
+	// last peer drops, so a peer reconnecting after a network blip does not
+	// restart it (see linger.go); zero stops it at once
+	streamLinger = 10 * time.Second
+
+	// resumeTokenTTL is how long after its connection ends a peer can
+	// resume its session with the token sent after its answer, keeping its
+	// cameras and stream settings; the offer is still authenticated (see
+	// resume.go). Zero issues no tokens. MQTT peers get the token, and the
+	// frame key with e2eeEnabled, on a negotiated "keys" data channel with
+	// id keyChannelID (see key_channel.go).
+	resumeTokenTTL = 2 * time.Minute
+	keyChannelID   = 2
+
+	// rtpForwarding packetizes each H.264 frame once, into packets of at
+	// most rtpMTU bytes, and forwards them to every peer (see
+	// rtp_forwarding.go) instead of writing it to pion's sample tracks
+	rtpForwarding = false
+	rtpMTU        = 1200
+
+	// nackEnabled resends the packets peers report lost, over RTX where the
+	// peer offers it and rtxEnabled allows; twccEnabled adds transport-wide
+	// congestion control sequence numbers for adaptive bitrate to estimate
+	// from (see interceptors.go). RTCP reports are always on.
+	nackEnabled = true
+	rtxEnabled  = true
+	twccEnabled = true
+
+	// sdpProfileLevelID, when set (e.g. "42e01f"), forces the H.264
+	// profile-level-id of every answer, and sdpVideoBandwidthKbps, when
+	// positive, caps its video sections with a b=AS line (see sdp_hooks.go)
+	sdpProfileLevelID     = ""
+	sdpVideoBandwidthKbps = 0
+
+	// e2eeEnabled encrypts the slices of every H.264 frame end to end with
+	// SFrame, for peers behind TURN servers and SFUs that must not see the
+	// video; each peer gets the key over signaling (see e2ee.go). Peers
+	// needing codecFallback are refused, their video would go out in the
+	// clear.
+	e2eeEnabled = false
+
+	// adaptiveBitrateEnabled estimates every peer's bandwidth and streams
+	// each camera at the best rung of qualityLadder the slowest peer can
+	// take (see adaptive_bitrate.go), checked every abrInterval. Stepping
+	// down is immediate; stepping up needs abrUpgradeHeadroom times the
+	// rung's bitrate for abrUpgradeHold, so a recovering link is not flooded
+	// again at once. REMB estimates older than abrREMBMaxAge are ignored.
+	adaptiveBitrateEnabled = true
+	abrInterval            = 1 * time.Second
+	abrUpgradeHold         = 10 * time.Second
+	abrUpgradeHeadroom     = 1.25
+	abrREMBMaxAge          = 5 * time.Second
+	abrMinBitrate          = 150000
+	abrMaxBitrate          = 4000000
+
+	// viewerMaxBitrate and operatorMaxBitrate cap the bits per second each
+	// viewer or operator is sent, zero for no cap. A peer can ask for less
+	// with maxBitrate in its capabilities or b=TIAS in its offer (see
+	// bandwidth_cap.go). A capped peer lowers the quality rung as a slow
+	// link would, so caps need adaptiveBitrateEnabled.
+	viewerMaxBitrate   = 0
+	operatorMaxBitrate = 0
+
+	// simulcastEnabled sends peers whose offer asks for simulcast (an SFU,
+	// typically) every video output as one encoding per qualityLadder rung,
+	// for them to pick from (see simulcast.go). Other peers are unaffected.
+	simulcastEnabled = true
+
+	// codecFallback answers peers whose offer has no H.264 but this codec,
+	// "video/VP8" or "video/VP9", by re-encoding every track at
+	// transcodeBitrate with transcoderCommand, ffmpeg built with libvpx,
+	// while such a peer is connected (see transcoder.go); "" disables
+	codecFallback     = "video/VP8"
+	transcoderCommand = "ffmpeg"
+	transcodeBitrate  = 1500000
+
+	// adaptiveFPSEnabled lowers the frame rate, and with it the bitrate,
+	// the transcoders encode a step of frameRateSteps when an encoder falls
+	// adaptiveFPSMaxLag behind or the transcoded peers' links cannot carry
+	// it, checked every adaptiveFPSInterval, and restores it a step at a
+	// time after adaptiveFPSHold without pressure (see adaptive_fps.go)
+	adaptiveFPSEnabled  = true
+	adaptiveFPSInterval = 1 * time.Second
+	adaptiveFPSMaxLag   = 200 * time.Millisecond
+	adaptiveFPSHold     = 10 * time.Second
+
+	// captureTimeExtension sends each frame's capture time in the
+	// abs-capture-time RTP header extension to peers that negotiate it;
+	// seiCaptureTime also stamps it into an SEI at the start of the frame,
+	// for peers that do not (see capture_time.go)
+	captureTimeExtension = true
+	seiCaptureTime       = true
+
+	// seiFrameInfo stamps frames for peers that parse it with the frame info
+	// SEI, version 2 of the stamp, adding the camera, the frame's sequence
+	// number and a monotonic capture time (see frame_info.go)
+	seiFrameInfo = true
+
+	// seiFrameChecksum prefixes every frame with an SEI message carrying a
+	// CRC-32 of its NAL units (see sei.go) for client-side integrity checks
+	seiFrameChecksum = false
+
+	// cameraHealthEnabled watches the streamed camera for black or frozen
+	// frames (see camera_health.go). A camera is degraded once every IDR for
+	// cameraHealthWindow has at most blackFrameMaxBytes of slice data (a
+	// flat picture), or every frame is a repeat or a P-frame of at most
+	// frozenFrameMaxBytes (nothing changed).
+	cameraHealthEnabled = true
+	cameraHealthWindow  = 3 * time.Second
+	blackFrameMaxBytes  = 2048
+	frozenFrameMaxBytes = 64
+
+	// stallWatchdogEnabled checks every stallCheckInterval for tracks whose
+	// source sent no frame for stallTimeout, reports the camera stalled and
+	// restarts its source; a camera still silent after that falls back to
+	// frame files, its own or stallFallbackCamera's, and is retried every
+	// stallRetryInterval (see stall_watchdog.go)
+	stallWatchdogEnabled = true
+	stallCheckInterval   = 1 * time.Second
+	stallTimeout         = 5 * time.Second
+	stallRetryInterval   = 30 * time.Second
+	stallFallbackCamera  = 1
+
+	// cpuGovernorEnabled reads the host's CPU usage every governorInterval
+	// and, at governorHighCPU percent or more for governorHold, lowers the
+	// encoding of captured and composed cameras a step: preset, frame rate,
+	// resolution. Below governorLowCPU percent for governorRecoverHold it
+	// takes a step back (see cpu_governor.go).
+	cpuGovernorEnabled  = true
+	governorInterval    = 2 * time.Second
+	governorHighCPU     = 90.0
+	governorLowCPU      = 60.0
+	governorHold        = 10 * time.Second
+	governorRecoverHold = 60 * time.Second
+
+	// peerReapingEnabled disconnects peers whose keepalives and ICE traffic
+	// have both been silent for peerKeepaliveTimeout, checked every
+	// peerReapInterval
+	peerReapingEnabled   = true
+	peerKeepaliveTimeout = 30 * time.Second
+	peerReapInterval     = 10 * time.Second
+
+	// peerStaleTimeout also reaps peers that sit in new, connecting,
+	// disconnected or failed for this long, e.g. offers whose ICE never
+	// completed; zero disables it
+	peerStaleTimeout = 60 * time.Second
+
+	// incomingMediaEnabled receives the camera and microphone tracks that
+	// operators send (see incoming_media.go) and hands their frames to the
+	// host application; incomingMediaDir, if set, also saves each track there
+	incomingMediaEnabled = false
+	incomingMediaDir     = ""
+
+	// maxPeers caps concurrent peer connections to protect the robot's CPU,
+	// zero for no cap. Past it, peerAdmissionPolicy AdmitReject answers new
+	// peers with a peer_limit OfferError, AdmitEvictOldest disconnects the
+	// viewer connected longest to make room, answering as AdmitReject does
+	// while no viewer is connected (see admission.go).
+	maxPeers            = 0
+	peerAdmissionPolicy = AdmitReject
+
+	// peerStatsInterval is how often each peer's outbound media stats are
+	// published to <baseTopic>/<peerId>/stats (see peer_stats.go); zero
+	// disables publishing, GetPeerStats still works
+	peerStatsInterval = 5 * time.Second
+
+	// pipelineStatsInterval is how often the stats of every streaming
+	// source and transcoder are published to <thingName>/pipeline-stats
+	// (see pipeline_stats.go); zero disables publishing,
+	// GetPipelineStats still works
+	pipelineStatsInterval = 5 * time.Second
+
+	// Each peer's quality score (see quality.go) is published with its stats
+	// to <baseTopic>/<peerId>/quality. Round trip time scores full marks up to
+	// qualityGoodRTTMs and none from qualityBadRTTMs, loss none from
+	// qualityBadLoss.
+	peerQualityEnabled = true
+	qualityGoodRTTMs   = 100.0
+	qualityBadRTTMs    = 800.0
+	qualityBadLoss     = 0.1
+
+	// sessionStorePath persists known peers and the camera selection across
+	// restarts, e.g. "rmcs-sessions.json"; empty, the default, disables
+	// persistence
+	sessionStorePath = ""
+
+	// configAuditPath stores the configuration snapshot that startup diffs
+	// are computed against (see config_audit.go), e.g. "rmcs-config.json";
+	// empty, the default, disables config audit events
+	configAuditPath = ""
+
+	// logStreamingEnabled keeps the last logStreamBacklog log lines and lets
+	// an operator stream them, and new lines, to <thingName>/logs with the
+	// start-log-stream admin command. Lines the topic cannot keep up with
+	// are dropped after logStreamQueueSize.
+	logStreamingEnabled = false
+	logStreamBacklog    = 200
+	logStreamQueueSize  = 100
+
+	// eventMirrorBackend, when set to "nats" or "kafka", republishes
+	// signaling lifecycle events (see event_mirror.go) as JSON to
+	// eventMirrorSubject, a NATS subject or Kafka topic, on eventMirrorURL:
+	// a NATS URL or comma-separated Kafka brokers. Up to
+	// eventMirrorQueueSize events wait for a slow bus before being dropped.
+	eventMirrorBackend   = ""
+	eventMirrorURL       = "nats://localhost:4222"
+	eventMirrorSubject   = "rmcs.signaling"
+	eventMirrorQueueSize = 256
+
+	// metricsAddr, when set (e.g. ":9090"), serves metrics JSON at /metrics
+	metricsAddr = ""
+
+	// iceGatheringTimeout bounds how long a non-trickle answer waits for
+	// candidate gathering before being sent with what was found so far
+	iceGatheringTimeout = 10 * time.Second
 )
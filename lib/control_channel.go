@@ -0,0 +1,211 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pion/webrtc/v4"
+)
+
+// controlChannelLabel names the negotiated data channel robot control
+// commands arrive on. Both sides create it with id controlChannelID, so it
+// is open as soon as the connection is, without an in-band handshake.
+const controlChannelLabel = "control"
+
+// Control message types handled by the backend itself; anything else goes
+// to registered handlers
+const (
+	ControlCamera = "camera"
+	ControlAck    = "ack"
+)
+
+// ControlMessage is a command sent by a peer on the control channel, e.g.
+// {"type": "drive", "seq": 12, "payload": {"linear": 0.5, "angular": 0}}.
+// Each is acknowledged with a ControlReply carrying the same seq.
+type ControlMessage struct {
+	Type    string          `json:"type"`
+	Seq     uint64          `json:"seq,omitempty"`
+	Payload json.RawMessage `json:"payload,omitempty"`
+}
+
+// ControlReply acknowledges a ControlMessage
+type ControlReply struct {
+	Type  string `json:"type"` // always "ack"
+	Seq   uint64 `json:"seq,omitempty"`
+	OK    bool   `json:"ok"`
+	Error string `json:"error,omitempty"`
+	// Result is what the handler returned, for a ControlResultFunc
+	Result interface{} `json:"result,omitempty"`
+}
+
+// ControlHandler handles one type of control message. It runs on the data
+// channel's receive goroutine, so it must return quickly; the error, if
+// any, is sent back to the peer.
+type ControlHandler interface {
+	HandleControl(peerID string, payload json.RawMessage) error
+}
+
+// ControlHandlerFunc adapts a function to ControlHandler
+type ControlHandlerFunc func(peerID string, payload json.RawMessage) error
+
+func (f ControlHandlerFunc) HandleControl(peerID string, payload json.RawMessage) error {
+	return f(peerID, payload)
+}
+
+// ControlResultFunc is a ControlHandler whose acknowledgment carries a
+// result, such as the e-stop's
+type ControlResultFunc func(peerID string, payload json.RawMessage) (interface{}, error)
+
+func (f ControlResultFunc) HandleControl(peerID string, payload json.RawMessage) error {
+	_, err := f(peerID, payload)
+	return err
+}
+
+// ControlSlowFunc is a ControlResultFunc that may block, such as a ROS
+// service call: it runs on a goroutine of its own, acknowledged as it
+// returns, so the channel's other messages are not held up
+type ControlSlowFunc func(peerID string, payload json.RawMessage) (interface{}, error)
+
+func (f ControlSlowFunc) HandleControl(peerID string, payload json.RawMessage) error {
+	_, err := f(peerID, payload)
+	return err
+}
+
+// ControlFallback receives control messages of types without a handler,
+// along with their type
+type ControlFallback func(peerID string, kind string, payload json.RawMessage) error
+
+// ControlRouter dispatches control messages to the handler registered for
+// their type, or to the fallback (the host application's callback) when
+// there is none
+type ControlRouter struct {
+	handlers map[string]ControlHandler
+	fallback ControlFallback
+	mu       sync.RWMutex
+}
+
+func NewControlRouter() *ControlRouter {
+	return &ControlRouter{handlers: make(map[string]ControlHandler)}
+}
+
+// Register makes handler receive every control message of type kind,
+// replacing any previous handler
+func (r *ControlRouter) Register(kind string, handler ControlHandler) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.handlers[kind] = handler
+}
+
+// SetFallback makes fallback receive message types without a handler; nil
+// rejects them
+func (r *ControlRouter) SetFallback(fallback ControlFallback) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.fallback = fallback
+}
+
+func (r *ControlRouter) handler(kind string) ControlHandler {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	if handler, ok := r.handlers[kind]; ok {
+		return handler
+	}
+	if fallback := r.fallback; fallback != nil {
+		return ControlHandlerFunc(func(peerID string, payload json.RawMessage) error {
+			return fallback(peerID, kind, payload)
+		})
+	}
+	return nil
+}
+
+// Dispatch runs the handler for msg and returns the reply to send
+func (r *ControlRouter) Dispatch(peerID string, msg ControlMessage) ControlReply {
+	reply := ControlReply{Type: ControlAck, Seq: msg.Seq, OK: true}
+
+	handler := r.handler(msg.Type)
+	if handler == nil {
+		metrics.Inc("control.unhandled")
+		reply.OK = false
+		reply.Error = fmt.Sprintf("no handler for %q", msg.Type)
+		return reply
+	}
+
+	metrics.Inc("control.received." + msg.Type)
+	start := time.Now()
+	var err error
+	switch f := handler.(type) {
+	case ControlResultFunc:
+		reply.Result, err = f(peerID, msg.Payload)
+	case ControlSlowFunc:
+		reply.Result, err = f(peerID, msg.Payload)
+	default:
+		err = handler.HandleControl(peerID, msg.Payload)
+	}
+	metrics.Observe("control.handler."+msg.Type, time.Since(start))
+	if err != nil {
+		metrics.Inc("control.errors")
+		log.Printf("[%s] Control %s failed: %v", peerID, msg.Type, err)
+		reply.OK = false
+		reply.Error = err.Error()
+	}
+	return reply
+}
+
+// attach creates the negotiated control channel on peerConnection. It only
+// opens if the peer's offer has a data section and the peer creates the
+// same channel.
+func (r *ControlRouter) attach(peerID string, peerConnection *webrtc.PeerConnection) error {
+	negotiated := true
+	id := uint16(controlChannelID)
+	channel, err := peerConnection.CreateDataChannel(controlChannelLabel, &webrtc.DataChannelInit{
+		Negotiated: &negotiated,
+		ID:         &id,
+	})
+	if err != nil {
+		return err
+	}
+
+	channel.OnOpen(func() {
+		log.Printf("[%s] Control channel open", peerID)
+	})
+	acknowledge := func(reply ControlReply) {
+		payload, err := json.Marshal(reply)
+		if err != nil {
+			return
+		}
+		if err := channel.SendText(string(payload)); err != nil {
+			log.Printf("[%s] Failed to acknowledge control message: %v", peerID, err)
+		}
+	}
+	channel.OnMessage(func(message webrtc.DataChannelMessage) {
+		var msg ControlMessage
+		if err := json.Unmarshal(message.Data, &msg); err != nil || msg.Type == "" {
+			metrics.Inc("control.invalid")
+			acknowledge(ControlReply{Type: ControlAck, OK: false, Error: "invalid control message"})
+			return
+		}
+		if _, slow := r.handler(msg.Type).(ControlSlowFunc); slow {
+			go func() { acknowledge(r.Dispatch(peerID, msg)) }()
+			return
+		}
+		acknowledge(r.Dispatch(peerID, msg))
+	})
+	return nil
+}
+
+// cameraControl switches cameras from the control channel, like the
+// <thingName>/camera topic; the payload is the camera number
+func cameraControl(manager *WebRTCManager) ControlHandler {
+	return ControlHandlerFunc(func(peerID string, payload json.RawMessage) error {
+		cameraNumber, err := strconv.Atoi(strings.Trim(string(payload), "\" "))
+		if err != nil {
+			return fmt.Errorf("invalid camera number: %s", payload)
+		}
+		return manager.SwitchCamera(cameraNumber)
+	})
+}
@@ -0,0 +1,189 @@
+package main
+
+import (
+	"log"
+	"slices"
+	"time"
+)
+
+// CPU governor: the encoders of captured and composed cameras (see
+// camera_capture.go and compose_source.go) share the robot's CPU with
+// everything else it runs. Every governorInterval the governor reads the
+// host's CPU usage; saturated, at governorHighCPU percent or more for
+// governorHold, it lowers the encoding a step: first the preset (the
+// cheapest encoder profile, see encoder.go), then the frame rate, halved,
+// then the resolution, halved, each on top of those before. Every encoded
+// camera running is re-captured with the step, handed over at its first
+// keyframe (see handOverSource). While saturated the source manager starts
+// no camera ahead of it being shown. Below governorLowCPU percent for
+// governorRecoverHold it takes a step back. Each step is logged and
+// published on <thingName>/governor. The host's CPU usage is read from
+// /proc/stat, so the governor runs on Linux only.
+
+// governorSteps names the steps, by level
+var governorSteps = []string{"none", "preset", "fps", "resolution"}
+
+// Lowest frame rate and width the governor lowers captures to
+const (
+	governorMinFPS   = 10
+	governorMinWidth = 320
+)
+
+// cpuTimes are the host's CPU times since boot, in clock ticks
+type cpuTimes struct {
+	busy  uint64
+	total uint64
+}
+
+// usage returns the fraction of CPU time busy since previous, 0 to 1
+func (t cpuTimes) usage(previous cpuTimes) float64 {
+	if t.total <= previous.total || t.busy < previous.busy {
+		return 0
+	}
+	return min(1, float64(t.busy-previous.busy)/float64(t.total-previous.total))
+}
+
+// governed returns config lowered to the governor's level
+func governed(config captureConfig, level int) captureConfig {
+	if level >= 1 {
+		config.profile = cheapestEncoderProfile()
+	}
+	if level >= 2 {
+		config.fps = max(governorMinFPS, config.fps/2)
+	}
+	if level >= 3 && config.width/2 >= governorMinWidth {
+		config.width, config.height = config.width/2&^1, config.height/2&^1
+	}
+	return config
+}
+
+// cheapestEncoderProfile returns the name of the encoder profile taking
+// the least CPU
+func cheapestEncoderProfile() string {
+	cheapest := captureProfile
+	for name, profile := range encoderProfiles {
+		if profile.cost < encoderProfiles[cheapest].cost {
+			cheapest = name
+		}
+	}
+	return cheapest
+}
+
+// StartCPUGovernor lowers the encoding of captured and composed cameras
+// while the host's CPU is saturated
+func (w *WebRTCManager) StartCPUGovernor() {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if w.stopGovernor != nil {
+		return
+	}
+	w.stopGovernor = make(chan struct{})
+	go w.governorLoop(w.stopGovernor)
+}
+
+func (w *WebRTCManager) governorLoop(stop chan struct{}) {
+	previous, err := readCPUTimes()
+	if err != nil {
+		log.Printf("CPU governor not running: %v", err)
+		return
+	}
+	ticker := time.NewTicker(governorInterval)
+	defer ticker.Stop()
+
+	var highSince, lowSince time.Time
+	for {
+		select {
+		case <-stop:
+			w.sourceManager.setSaturated(false)
+			return
+		case now := <-ticker.C:
+			times, err := readCPUTimes()
+			if err != nil {
+				log.Printf("Failed to read CPU usage: %v", err)
+				continue
+			}
+			percent := times.usage(previous) * 100
+			previous = times
+			metrics.SetGauge("governor.cpu_percent", int64(percent))
+
+			saturated := percent >= governorHighCPU
+			w.sourceManager.setSaturated(saturated)
+			level := int(w.governorLevel.Load())
+			switch {
+			case saturated:
+				lowSince = time.Time{}
+				if highSince.IsZero() {
+					highSince = now
+				}
+				if now.Sub(highSince) >= governorHold && level < len(governorSteps)-1 {
+					highSince = now
+					w.setGovernorLevel(level+1, percent)
+				}
+			case percent <= governorLowCPU:
+				highSince = time.Time{}
+				if lowSince.IsZero() {
+					lowSince = now
+				}
+				if now.Sub(lowSince) >= governorRecoverHold && level > 0 {
+					lowSince = now
+					w.setGovernorLevel(level-1, percent)
+				}
+			default:
+				highSince, lowSince = time.Time{}, time.Time{}
+			}
+		}
+	}
+}
+
+// setGovernorLevel lowers or raises the encoding to level, re-capturing
+// every encoded camera running. Lowering with none running does nothing:
+// the CPU goes to something else.
+func (w *WebRTCManager) setGovernorLevel(level int, percent float64) {
+	w.switchMu.Lock()
+	defer w.switchMu.Unlock()
+
+	cameras := w.encodedCameras()
+	previous := int(w.governorLevel.Load())
+	if level > previous && len(cameras) == 0 {
+		return
+	}
+	w.governorLevel.Store(int32(level))
+	metrics.SetGauge("governor.level", int64(level))
+	if level > previous {
+		log.Printf("CPU at %.0f%%, lowering the encoding of cameras %v: %s", percent, cameras, governorSteps[level])
+		metrics.Inc("governor.steps_down")
+	} else {
+		log.Printf("CPU at %.0f%%, raising the encoding of cameras %v back from %s", percent, cameras, governorSteps[previous])
+		metrics.Inc("governor.steps_up")
+	}
+	for _, camera := range cameras {
+		if err := w.recapture(camera); err != nil {
+			log.Printf("Failed to re-capture camera %d: %v", camera, err)
+		}
+	}
+	w.events.emitGovernorChanged(GovernorEvent{Level: level, Step: governorSteps[level], CPUPercent: percent, Cameras: cameras})
+}
+
+// encodedCameras returns the captured and composed cameras shown on a
+// track or running in the source manager
+func (w *WebRTCManager) encodedCameras() []int {
+	var cameras []int
+	for _, output := range w.allOutputs() {
+		cameras = append(cameras, int(output.camera.Load()))
+	}
+	if sourceManagerEnabled {
+		cameras = append(cameras, w.sourceManager.cameras()...)
+	}
+	slices.Sort(cameras)
+	cameras = slices.Compact(cameras)
+	return slices.DeleteFunc(cameras, func(camera int) bool {
+		if _, registered := w.sources.factory(camera); registered {
+			return true
+		}
+		address, _ := cameraAddress(camera)
+		_, captured := captureDevice(address)
+		_, composed := composeCameras(address)
+		return !captured && !composed
+	})
+}
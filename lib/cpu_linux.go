@@ -0,0 +1,38 @@
+//go:build linux
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// readCPUTimes returns the host's CPU times, in clock ticks, from the
+// first line of /proc/stat: "cpu user nice system idle iowait irq softirq
+// steal guest guest_nice"
+func readCPUTimes() (cpuTimes, error) {
+	data, err := os.ReadFile("/proc/stat")
+	if err != nil {
+		return cpuTimes{}, err
+	}
+	line, _, _ := strings.Cut(string(data), "\n")
+	fields := strings.Fields(line)
+	if len(fields) < 5 || fields[0] != "cpu" {
+		return cpuTimes{}, fmt.Errorf("unexpected /proc/stat line %q", line)
+	}
+	var times cpuTimes
+	// Guest time is counted in user time already
+	for i, field := range fields[1:min(len(fields), 9)] {
+		ticks, err := strconv.ParseUint(field, 10, 64)
+		if err != nil {
+			return cpuTimes{}, fmt.Errorf("unexpected /proc/stat line %q", line)
+		}
+		times.total += ticks
+		if i != 3 && i != 4 { // idle, iowait
+			times.busy += ticks
+		}
+	}
+	return times, nil
+}
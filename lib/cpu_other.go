@@ -0,0 +1,11 @@
+//go:build !linux
+
+package main
+
+import "errors"
+
+// readCPUTimes is only implemented on Linux: elsewhere the CPU governor
+// does not run
+func readCPUTimes() (cpuTimes, error) {
+	return cpuTimes{}, errors.New("host CPU usage is only read on Linux")
+}
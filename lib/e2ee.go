@@ -0,0 +1,208 @@
+package main
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"sync/atomic"
+	"time"
+
+	"golang.org/x/crypto/hkdf"
+)
+
+// End-to-end encryption: with e2eeEnabled the slices of every H.264 frame
+// are encrypted with SFrame (RFC 9605), so TURN servers and SFUs relaying
+// the media see only ciphertext, on top of DTLS-SRTP which ends at them.
+// Each peer receives the key once its offer is authorized and answered, on
+// a channel private to it, never the broker: over its WebSocket, or for
+// MQTT peers on the key channel (see key_channel.go), and decrypts in an
+// insertable streams (encoded transform) worker.
+//
+// The packetizers on both sides still parse the Annex-B stream, so only the
+// slice payloads are encrypted: start codes, NAL headers, parameter sets
+// and SEI stay in the clear. A slice NAL unit becomes
+//
+//	nal header | EP(sframe header | ciphertext | tag | 0x80)
+//
+// where EP is H.264 emulation prevention, so the ciphertext cannot mimic a
+// start code, and the 0x80 stop byte keeps the NAL unit from ending in zero.
+// The AEAD's associated data is the SFrame header followed by the NAL
+// header byte.
+
+// The SFrame cipher suite, AES_128_GCM_SHA256_128, and its sizes
+const (
+	e2eeCipherSuite     = 0x0004
+	e2eeCipherSuiteName = "AES_128_GCM_SHA256_128"
+	e2eeKeySize         = 16
+	e2eeNonceSize       = 12
+)
+
+// FrameEncryptor encrypts frames with one SFrame key. It is shared by every
+// video track; the counter makes each nonce unique across them.
+type FrameEncryptor struct {
+	keyID   uint64
+	baseKey []byte
+	aead    cipher.AEAD
+	salt    []byte
+	counter atomic.Uint64
+}
+
+// NewFrameEncryptor creates an encryptor with a random base key
+func NewFrameEncryptor(keyID uint64) (*FrameEncryptor, error) {
+	baseKey := make([]byte, e2eeKeySize)
+	if _, err := rand.Read(baseKey); err != nil {
+		return nil, fmt.Errorf("failed to generate frame key: %v", err)
+	}
+
+	key, salt, err := deriveSFrameKey(baseKey, keyID)
+	if err != nil {
+		return nil, err
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	return &FrameEncryptor{keyID: keyID, baseKey: baseKey, aead: aead, salt: salt}, nil
+}
+
+// deriveSFrameKey derives the key and salt of keyID from baseKey, as RFC
+// 9605 section 4.4.2 does
+func deriveSFrameKey(baseKey []byte, keyID uint64) (key []byte, salt []byte, err error) {
+	secret := hkdf.Extract(sha256.New, baseKey, nil)
+	suffix := binary.BigEndian.AppendUint16(binary.BigEndian.AppendUint64(nil, keyID), e2eeCipherSuite)
+
+	key = make([]byte, e2eeKeySize)
+	if _, err := io.ReadFull(hkdf.Expand(sha256.New, secret, append([]byte("SFrame 1.0 Secret key "), suffix...)), key); err != nil {
+		return nil, nil, err
+	}
+	salt = make([]byte, e2eeNonceSize)
+	if _, err := io.ReadFull(hkdf.Expand(sha256.New, secret, append([]byte("SFrame 1.0 Secret salt "), suffix...)), salt); err != nil {
+		return nil, nil, err
+	}
+	return key, salt, nil
+}
+
+// Key returns the key message peers decrypt with
+func (e *FrameEncryptor) Key() E2EEKey {
+	return E2EEKey{
+		Schema:      E2EEKeySchema,
+		KeyID:       e.keyID,
+		Key:         base64.StdEncoding.EncodeToString(e.baseKey),
+		CipherSuite: e2eeCipherSuiteName,
+		Time:        time.Now().UTC(),
+	}
+}
+
+// Encrypt returns an Annex-B frame with its slices encrypted
+func (e *FrameEncryptor) Encrypt(frame []byte) []byte {
+	start := time.Now()
+	encrypted := make([]byte, 0, len(frame)+64)
+	forEachAnnexBNAL(frame, func(nal []byte) {
+		encrypted = append(encrypted, 0x00, 0x00, 0x00, 0x01)
+		switch nal[0] & 0x1F {
+		case NAL_TYPE_NON_IDR, NAL_TYPE_IDR:
+			encrypted = append(encrypted, nal[0])
+			encrypted = append(encrypted, addEmulationPrevention(append(e.seal(nal[0], nal[1:]), 0x80))...)
+		default:
+			encrypted = append(encrypted, nal...)
+		}
+	})
+	metrics.Observe("e2ee.encrypt", time.Since(start))
+	return encrypted
+}
+
+// seal encrypts a slice's payload into an SFrame ciphertext
+func (e *FrameEncryptor) seal(nalHeader byte, payload []byte) []byte {
+	counter := e.counter.Add(1) - 1
+	header := sframeHeader(e.keyID, counter)
+
+	nonce := make([]byte, e2eeNonceSize)
+	binary.BigEndian.PutUint64(nonce[e2eeNonceSize-8:], counter)
+	for i := range nonce {
+		nonce[i] ^= e.salt[i]
+	}
+
+	aad := append(append([]byte(nil), header...), nalHeader)
+	return e.aead.Seal(header, nonce, payload, aad)
+}
+
+// sframeHeader encodes an SFrame header: a config byte, then the key ID and
+// counter in as few bytes as they need if they do not fit in it
+func sframeHeader(keyID uint64, counter uint64) []byte {
+	header := []byte{0}
+	var extended []byte
+	if keyID < 8 {
+		header[0] |= byte(keyID) << 4
+	} else {
+		kid := minimalBigEndian(keyID)
+		header[0] |= 0x80 | byte(len(kid)-1)<<4
+		extended = append(extended, kid...)
+	}
+	if counter < 8 {
+		header[0] |= byte(counter)
+	} else {
+		ctr := minimalBigEndian(counter)
+		header[0] |= 0x08 | byte(len(ctr)-1)
+		extended = append(extended, ctr...)
+	}
+	return append(header, extended...)
+}
+
+func minimalBigEndian(value uint64) []byte {
+	encoded := binary.BigEndian.AppendUint64(nil, value)
+	for len(encoded) > 1 && encoded[0] == 0 {
+		encoded = encoded[1:]
+	}
+	return encoded
+}
+
+// forEachAnnexBNAL calls fn with each NAL unit of an Annex-B stream,
+// without its start code
+func forEachAnnexBNAL(data []byte, fn func(nal []byte)) {
+	start := -1
+	for i := 0; i+2 < len(data); i++ {
+		if data[i] != 0x00 || data[i+1] != 0x00 || data[i+2] != 0x01 {
+			continue
+		}
+		if start >= 0 {
+			emitAnnexBNAL(data[start:i], fn)
+		}
+		start = i + 3
+		i += 2
+	}
+	if start >= 0 {
+		emitAnnexBNAL(data[start:], fn)
+	}
+}
+
+// emitAnnexBNAL drops the zero byte of a following four-byte start code
+func emitAnnexBNAL(nal []byte, fn func(nal []byte)) {
+	for len(nal) > 0 && nal[len(nal)-1] == 0x00 {
+		nal = nal[:len(nal)-1]
+	}
+	if len(nal) > 0 {
+		fn(nal)
+	}
+}
+
+// setEncryptor encrypts the frames of the output's track and layers
+func (o *videoOutput) setEncryptor(encryptor *FrameEncryptor) {
+	o.streamer.SetEncryptor(encryptor)
+	for _, layer := range o.layers {
+		layer.streamer.SetEncryptor(encryptor)
+	}
+}
+
+// E2EE returns the frame encryptor, nil unless e2eeEnabled
+func (w *WebRTCManager) E2EE() *FrameEncryptor {
+	return w.e2ee
+}
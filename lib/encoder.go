@@ -0,0 +1,251 @@
+package main
+
+import (
+	"log"
+	"os"
+	"os/exec"
+	"runtime"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// H.264 encoders for camera capture (see camera_capture.go): ffmpeg's
+// hardware encoders where the platform has them, NVENC on NVIDIA GPUs,
+// VAAPI on Intel and AMD graphics, V4L2 M2M on Jetson and Raspberry Pi
+// class boards and VideoToolbox on macOS, and libx264 everywhere else.
+// captureEncoder names one, or "auto" picks the first in that order that
+// runs on the platform, has its device and is built into captureCommand.
+// An encoder that fails to produce a frame is skipped from then on, falling
+// back to the next "auto" would pick, or to libx264 for a named one.
+//
+// How it encodes is the capture's profile, captureProfile unless the
+// camera entry or a set-profile command picks another:
+// "ultra-low-latency" tunes for zero latency with a keyframe every second,
+// "quality" trades about a second of latency and twice the CPU for lookahead,
+// constant quality within the bitrate and a keyframe every two seconds.
+// Hardware encoders without lookahead only change the keyframe interval.
+
+// h264Encoder is an ffmpeg H.264 encoder and how to run it for WebRTC:
+// baseline profile, no B-frames, a keyframe every gop frames, tuned as
+// profile says
+type h264Encoder struct {
+	name      string   // ffmpeg's, also the captureEncoder value
+	cost      float64  // CPU cores it takes encoding 1080p30, roughly
+	platforms []string // GOOS it runs on, nil for any
+	device    string   // it needs, "" for none
+	// inputArgs go before the input, outputArgs after it and filter, the
+	// video filter it needs its frames through, if any
+	inputArgs  []string
+	filter     string
+	outputArgs func(bitrate int, gop int, profile encoderProfile) []string
+}
+
+// encoderProfile is how captures are encoded, whatever the encoder
+type encoderProfile struct {
+	gop        time.Duration // between keyframes
+	lowLatency bool          // zero-latency tuning: no lookahead, no frame threads
+	lookahead  int           // frames rate control looks ahead, without lowLatency
+	crf        int           // constant quality capped at the bitrate, 0 for the bitrate
+	cost       float64       // CPU taken, relative to ultra-low-latency
+}
+
+// encoderProfiles are the profiles selectable with captureProfile, the
+// camera entry's profile option and set-profile
+var encoderProfiles = map[string]encoderProfile{
+	// Every frame out as soon as it is encoded
+	"ultra-low-latency": {
+		gop:        time.Second,
+		lowLatency: true,
+		cost:       1,
+	},
+	// Better pictures for inspection, where latency matters less
+	"quality": {
+		gop:       2 * time.Second,
+		lookahead: 20,
+		crf:       23,
+		cost:      2,
+	},
+}
+
+// lookupEncoderProfile returns the profile named name, or captureProfile's
+// for a name unknown
+func lookupEncoderProfile(name string) encoderProfile {
+	profile, ok := encoderProfiles[name]
+	if !ok {
+		log.Printf("Unknown encoder profile %q, using %s", name, captureProfile)
+		profile = encoderProfiles[captureProfile]
+	}
+	return profile
+}
+
+// gopFrames returns the profile's keyframe interval in frames at fps
+func (p encoderProfile) gopFrames(fps int) int {
+	return max(1, int(p.gop.Seconds()*float64(fps)))
+}
+
+// softwareEncoder is the encoder every platform falls back to
+const softwareEncoder = "libx264"
+
+// h264Encoders in the order "auto" tries them
+var h264Encoders = []h264Encoder{
+	{
+		name:      "h264_nvenc",
+		cost:      0.1,
+		platforms: []string{"linux"},
+		device:    "/dev/nvidiactl",
+		outputArgs: func(bitrate int, gop int, profile encoderProfile) []string {
+			args := []string{"-c:v", "h264_nvenc", "-preset", "p1", "-tune", "ll", "-zerolatency", "1",
+				"-b:v", strconv.Itoa(bitrate)}
+			if !profile.lowLatency {
+				args = []string{"-c:v", "h264_nvenc", "-preset", "p5", "-tune", "hq",
+					"-rc-lookahead", strconv.Itoa(profile.lookahead), "-b:v", strconv.Itoa(bitrate), "-maxrate", strconv.Itoa(bitrate)}
+				if profile.crf > 0 {
+					args = append(args, "-rc", "vbr", "-cq", strconv.Itoa(profile.crf))
+				}
+			}
+			return append(args, "-g", strconv.Itoa(gop), "-bf", "0", "-profile:v", "baseline")
+		},
+	},
+	{
+		name:      "h264_vaapi",
+		cost:      0.15,
+		platforms: []string{"linux"},
+		device:    "/dev/dri/renderD128",
+		inputArgs: []string{"-vaapi_device", "/dev/dri/renderD128"},
+		filter:    "format=nv12,hwupload",
+		outputArgs: func(bitrate int, gop int, profile encoderProfile) []string {
+			return []string{"-c:v", "h264_vaapi",
+				"-b:v", strconv.Itoa(bitrate), "-g", strconv.Itoa(gop), "-bf", "0", "-profile:v", "constrained_baseline"}
+		},
+	},
+	{
+		name:      "h264_v4l2m2m",
+		cost:      0.25,
+		platforms: []string{"linux"},
+		outputArgs: func(bitrate int, gop int, profile encoderProfile) []string {
+			return []string{"-pix_fmt", "yuv420p", "-c:v", "h264_v4l2m2m",
+				"-b:v", strconv.Itoa(bitrate), "-g", strconv.Itoa(gop)}
+		},
+	},
+	{
+		name:      "h264_videotoolbox",
+		cost:      0.1,
+		platforms: []string{"darwin"},
+		outputArgs: func(bitrate int, gop int, profile encoderProfile) []string {
+			realtime := "1"
+			if !profile.lowLatency {
+				realtime = "0"
+			}
+			return []string{"-c:v", "h264_videotoolbox", "-realtime", realtime,
+				"-b:v", strconv.Itoa(bitrate), "-g", strconv.Itoa(gop), "-profile:v", "baseline"}
+		},
+	},
+	{
+		name: softwareEncoder,
+		cost: 1,
+		outputArgs: func(bitrate int, gop int, profile encoderProfile) []string {
+			args := []string{"-pix_fmt", "yuv420p", "-c:v", "libx264", "-preset", "ultrafast", "-tune", "zerolatency",
+				"-b:v", strconv.Itoa(bitrate)}
+			if !profile.lowLatency {
+				args = []string{"-pix_fmt", "yuv420p", "-c:v", "libx264", "-preset", "veryfast",
+					"-rc-lookahead", strconv.Itoa(profile.lookahead)}
+				if profile.crf > 0 {
+					args = append(args, "-crf", strconv.Itoa(profile.crf))
+				} else {
+					args = append(args, "-b:v", strconv.Itoa(bitrate))
+				}
+				args = append(args, "-maxrate", strconv.Itoa(bitrate), "-bufsize", strconv.Itoa(2*bitrate))
+			}
+			return append(args, "-g", strconv.Itoa(gop), "-bf", "0", "-profile:v", "baseline")
+		},
+	},
+}
+
+// encoderSelector picks the capture encoder, remembering those that failed
+type encoderSelector struct {
+	built  map[string]bool // encoders captureCommand was built with
+	probe  sync.Once
+	failed map[string]bool
+	mu     sync.Mutex
+}
+
+// captureEncoders selects the encoder of every camera capture
+var captureEncoders = &encoderSelector{failed: make(map[string]bool)}
+
+// selectEncoder returns the encoder to capture with next
+func (e *encoderSelector) selectEncoder() h264Encoder {
+	e.probe.Do(func() {
+		e.built = probeFFmpegEncoders(captureCommand)
+	})
+
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	var fallback h264Encoder
+	for _, encoder := range h264Encoders {
+		if encoder.name == softwareEncoder {
+			fallback = encoder
+			continue
+		}
+		if e.failed[encoder.name] {
+			continue
+		}
+		if captureEncoder == encoder.name {
+			return encoder
+		}
+		if captureEncoder == "auto" && e.usable(encoder) {
+			return encoder
+		}
+	}
+	return fallback
+}
+
+// usable reports whether encoder runs on this platform, with e.mu held
+func (e *encoderSelector) usable(encoder h264Encoder) bool {
+	if encoder.platforms != nil && !slices.Contains(encoder.platforms, runtime.GOOS) {
+		return false
+	}
+	if encoder.device != "" {
+		if _, err := os.Stat(encoder.device); err != nil {
+			return false
+		}
+	}
+	// Without the list, the encoder is tried and falls back if it fails
+	return e.built == nil || e.built[encoder.name]
+}
+
+// markFailed skips encoder from now on, unless it is the fallback
+func (e *encoderSelector) markFailed(name string) {
+	if name == softwareEncoder {
+		return
+	}
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if !e.failed[name] {
+		e.failed[name] = true
+		log.Printf("Encoder %s failed, falling back", name)
+		metrics.Inc("capture.encoder_fallbacks")
+	}
+}
+
+// probeFFmpegEncoders returns the video encoders command lists, nil if it
+// cannot be run
+func probeFFmpegEncoders(command string) map[string]bool {
+	output, err := exec.Command(command, "-hide_banner", "-encoders").Output()
+	if err != nil {
+		log.Printf("Failed to list %s encoders: %v", command, err)
+		return nil
+	}
+	encoders := make(map[string]bool)
+	for _, line := range strings.Split(string(output), "\n") {
+		// " V....D h264_nvenc   NVIDIA NVENC H.264 encoder"
+		fields := strings.Fields(line)
+		if len(fields) >= 2 && strings.HasPrefix(fields[0], "V") {
+			encoders[fields[1]] = true
+		}
+	}
+	return encoders
+}
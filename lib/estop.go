@@ -0,0 +1,196 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// E-stop: an operator stops the robot with estop on the control channel,
+// or on <thingName>/estop over MQTT, subscribed with QoS 1 so the broker
+// does not drop it. The payload is {}, or {"id": "..."} to tell its
+// acknowledgment apart; {"release": true} releases the e-stop.
+//
+// Engaging sends the robot a stop on teleopTopic at once, bypassing
+// teleopMaxRate and dropping any drive command waiting its turn, then
+// publishes true, latched, on estopTopic, a std_msgs/Bool, for the robot's
+// own e-stop; drive commands are refused until it is released, which
+// publishes false. Every command is acknowledged with an EStopAck carrying
+// the robot's clock as it was sent: the control channel's reply has it as
+// its result, and MQTT's is published on <thingName>/estop/ack.
+
+// ControlEStop engages or releases the e-stop
+const ControlEStop = "estop"
+
+// EStopCommand is the payload of estop
+type EStopCommand struct {
+	ID      string `json:"id,omitempty"`
+	Release bool   `json:"release,omitempty"`
+}
+
+var errEStopDisabled = errors.New("the e-stop is disabled")
+
+// estopBridge publishes the e-stop's state to estopTopic. It takes no lock
+// of its own, nor teleop's, so an e-stop never waits behind a drive command
+// or a master being slow to register one.
+type estopBridge struct {
+	publication atomic.Pointer[rosPublication] // nil until advertised
+}
+
+// estopControl engages or releases the e-stop from the control channel,
+// replying with its EStopAck
+func estopControl(manager *WebRTCManager) ControlResultFunc {
+	return ControlResultFunc(func(peerID string, payload json.RawMessage) (interface{}, error) {
+		command, err := parseEStopCommand(payload)
+		if err != nil {
+			return nil, err
+		}
+		log.Printf("[%s] E-stop %s", peerID, command.action())
+		ack := manager.EStop(command)
+		if !ack.OK {
+			return ack, errors.New(ack.Error)
+		}
+		return ack, nil
+	})
+}
+
+// handleEStop engages or releases the e-stop from <thingName>/estop,
+// acknowledging on <thingName>/estop/ack
+func (m *MQTTClient) handleEStop(topic string, payload []byte) {
+	command, err := parseEStopCommand(payload)
+	if err != nil {
+		// Whatever was meant, stopping is the safe side
+		log.Printf("Invalid e-stop on %s, engaging: %v", topic, err)
+		command = EStopCommand{}
+	}
+	if command.Release && !mqttControlEnabled {
+		// Releasing lets the robot drive again, which is an operator's call
+		log.Printf("E-stop release from %s refused: %v", topic, errMQTTControlDisabled)
+		metrics.Inc("estop.mqtt_refused")
+		m.sendEStopAck(EStopAck{Schema: EStopAckSchema, ID: command.ID, Engaged: false, Error: errMQTTControlDisabled.Error(), Time: time.Now().UTC()})
+		return
+	}
+	log.Printf("E-stop %s from %s", command.action(), topic)
+	m.sendEStopAck(m.webrtcManager.EStop(command))
+}
+
+// parseEStopCommand parses an estop payload, which may be empty
+func parseEStopCommand(payload []byte) (EStopCommand, error) {
+	var command EStopCommand
+	if len(strings.TrimSpace(string(payload))) == 0 {
+		return command, nil
+	}
+	if err := json.Unmarshal(payload, &command); err != nil {
+		return command, errors.New("invalid e-stop: " + err.Error())
+	}
+	return command, nil
+}
+
+func (c EStopCommand) action() string {
+	if c.Release {
+		return "released"
+	}
+	return "engaged"
+}
+
+// EStop engages the e-stop, or releases it, reporting what the robot was
+// sent in its EStopAck
+func (w *WebRTCManager) EStop(command EStopCommand) EStopAck {
+	start := time.Now()
+	var errs []string
+	fail := func(err error) {
+		errs = append(errs, err.Error())
+	}
+
+	switch {
+	case teleopTopic == "" && estopTopic == "":
+		fail(errEStopDisabled)
+	case command.Release:
+		if err := w.estop.publish(false); err != nil {
+			fail(err)
+		}
+		if len(errs) == 0 {
+			w.teleop.resume()
+		}
+	default:
+		if teleopTopic != "" {
+			if err := w.teleop.halt(); err != nil {
+				fail(err)
+			}
+		}
+		if err := w.estop.publish(true); err != nil {
+			fail(err)
+		}
+	}
+
+	ack := EStopAck{
+		Schema:  EStopAckSchema,
+		ID:      command.ID,
+		Engaged: !command.Release,
+		OK:      len(errs) == 0,
+		Error:   strings.Join(errs, "; "),
+		Time:    time.Now().UTC(),
+	}
+	metrics.Observe("estop.handler", time.Since(start))
+	if ack.OK {
+		metrics.Inc("estop." + command.action())
+	} else {
+		metrics.Inc("estop.failures")
+		log.Printf("E-stop not %s: %s", command.action(), ack.Error)
+	}
+	return ack
+}
+
+// advertiseEStop advertises estopTopic as the backend starts, ahead of the
+// first e-stop, so the robot's subscribers are connected by then and the
+// e-stop need not call the master
+func (w *WebRTCManager) advertiseEStop() error {
+	_, err := w.estop.advertise()
+	return err
+}
+
+// advertise advertises estopTopic if it is not yet, returning its
+// publication
+func (b *estopBridge) advertise() (*rosPublication, error) {
+	if publication := b.publication.Load(); publication != nil || estopTopic == "" {
+		return publication, nil
+	}
+	node, err := startROSNode()
+	if err != nil {
+		return nil, err
+	}
+	publication, err := node.advertise(estopTopic, rosBoolType, true)
+	if err != nil {
+		return nil, err
+	}
+	b.publication.Store(publication)
+	return publication, nil
+}
+
+// publish latches engaged on estopTopic, if there is one, advertising it
+// first if that failed as the backend started
+func (b *estopBridge) publish(engaged bool) error {
+	if estopTopic == "" {
+		return nil
+	}
+	publication, err := b.advertise()
+	if err != nil {
+		return err
+	}
+	publication.publish(encodeROSBool(engaged))
+	return nil
+}
+
+func (m *MQTTClient) sendEStopAck(ack EStopAck) {
+	payload, err := json.Marshal(ack)
+	if err != nil {
+		log.Printf("Failed to marshal e-stop ack: %v", err)
+		return
+	}
+	if err := m.publish(deviceTopic("estop/ack"), payload); err != nil {
+		log.Printf("Failed to send e-stop ack: %v", err)
+	}
+}
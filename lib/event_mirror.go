@@ -0,0 +1,180 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/nats-io/nats.go"
+	"github.com/segmentio/kafka-go"
+)
+
+// Signaling lifecycle events mirrored to analytics
+const (
+	EventOfferReceived    = "offer_received"
+	EventAnswerSent       = "answer_sent"
+	EventPeerConnected    = "peer_connected"
+	EventPeerDisconnected = "peer_disconnected"
+	EventPeerReaped       = "peer_reaped"
+)
+
+// Event mirror backends
+const (
+	MirrorNATS  = "nats"
+	MirrorKafka = "kafka"
+)
+
+// EventSink delivers mirrored events to an external bus
+type EventSink interface {
+	Publish(key string, payload []byte) error
+	Close() error
+}
+
+// natsSink publishes each event on the mirror subject
+type natsSink struct {
+	conn    *nats.Conn
+	subject string
+}
+
+func (s *natsSink) Publish(key string, payload []byte) error {
+	return s.conn.Publish(s.subject, payload)
+}
+
+func (s *natsSink) Close() error {
+	return s.conn.Drain()
+}
+
+// kafkaSink writes each event to the mirror topic, keyed by thing name so a
+// robot's events stay ordered within one partition
+type kafkaSink struct {
+	writer *kafka.Writer
+}
+
+func (s *kafkaSink) Publish(key string, payload []byte) error {
+	ctx, cancel := context.WithTimeout(context.Background(), mqttTokenTimeout)
+	defer cancel()
+	return s.writer.WriteMessages(ctx, kafka.Message{Key: []byte(key), Value: payload})
+}
+
+func (s *kafkaSink) Close() error {
+	return s.writer.Close()
+}
+
+// newEventSink connects to the configured mirror backend
+func newEventSink(backend, url, subject string) (EventSink, error) {
+	switch backend {
+	case MirrorNATS:
+		conn, err := nats.Connect(url, nats.Name(identity.ClientID))
+		if err != nil {
+			return nil, fmt.Errorf("failed to connect to NATS at %s: %v", url, err)
+		}
+		return &natsSink{conn: conn, subject: subject}, nil
+	case MirrorKafka:
+		return &kafkaSink{writer: &kafka.Writer{
+			Addr:     kafka.TCP(strings.Split(url, ",")...),
+			Topic:    subject,
+			Balancer: &kafka.Hash{},
+		}}, nil
+	default:
+		return nil, fmt.Errorf("unknown event mirror backend %q", backend)
+	}
+}
+
+// EventMirror republishes signaling events to an EventSink in the
+// background, so a slow bus never holds up signaling. Events that do not fit
+// in the queue are dropped and counted.
+type EventMirror struct {
+	sink   EventSink
+	events chan SignalingEvent
+	done   chan struct{}
+	closed bool
+	mu     sync.Mutex
+}
+
+// eventMirror is set by RMCSInit when eventMirrorBackend is configured
+var eventMirror *EventMirror
+
+func NewEventMirror(sink EventSink) *EventMirror {
+	m := &EventMirror{
+		sink:   sink,
+		events: make(chan SignalingEvent, eventMirrorQueueSize),
+		done:   make(chan struct{}),
+	}
+	go m.run()
+	return m
+}
+
+func (m *EventMirror) run() {
+	defer close(m.done)
+	for event := range m.events {
+		payload, err := json.Marshal(event)
+		if err != nil {
+			log.Printf("Failed to marshal %s event: %v", event.Type, err)
+			continue
+		}
+		if err := m.sink.Publish(event.Thing, payload); err != nil {
+			log.Printf("Failed to mirror %s event for %s: %v", event.Type, event.PeerID, err)
+			metrics.Inc("mirror.failures")
+			continue
+		}
+		metrics.Inc("mirror.events")
+	}
+}
+
+func (m *EventMirror) emit(event SignalingEvent) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	// Connection state callbacks can still fire while shutting down
+	if m.closed {
+		return
+	}
+	select {
+	case m.events <- event:
+	default:
+		metrics.Inc("mirror.dropped")
+	}
+}
+
+// Close delivers queued events, then closes the sink
+func (m *EventMirror) Close() {
+	m.mu.Lock()
+	if m.closed {
+		m.mu.Unlock()
+		return
+	}
+	m.closed = true
+	close(m.events)
+	m.mu.Unlock()
+
+	<-m.done
+	if err := m.sink.Close(); err != nil {
+		log.Printf("Failed to close event mirror: %v", err)
+	}
+}
+
+// mirrorPeerEvents mirrors peers connecting and disconnecting
+func mirrorPeerEvents(bus *EventBus) {
+	bus.OnPeerConnected(func(event PeerEvent) {
+		mirrorEvent(SignalingEvent{Type: EventPeerConnected, PeerID: event.PeerID, State: event.State, MediaTransport: event.MediaTransport, OverTCP: overTCP(event.MediaTransport)})
+	})
+	bus.OnPeerDisconnected(func(event PeerEvent) {
+		mirrorEvent(SignalingEvent{Type: EventPeerDisconnected, PeerID: event.PeerID, State: event.State})
+	})
+}
+
+// mirrorEvent records a signaling event, stamped with its schema, the thing
+// name and time, if mirroring is enabled
+func mirrorEvent(event SignalingEvent) {
+	if eventMirror == nil {
+		return
+	}
+	event.Schema = SignalingEventSchema
+	event.Thing = identity.ThingName
+	event.Time = time.Now()
+	eventMirror.emit(event)
+}
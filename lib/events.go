@@ -0,0 +1,150 @@
+package main
+
+import (
+	"log"
+	"sync"
+)
+
+// Lifecycle events: the WebRTC manager raises peers connecting and
+// disconnecting, camera switches and video source errors on its EventBus
+// (see WebRTCManager.Events), and subsystems subscribe to the ones they act
+// on: the event mirror, metrics and the MQTT status topics. Handlers run on
+// the goroutine raising the event, in the order they subscribed, and must
+// not block.
+
+// PeerEvent is a peer's connection becoming connected, or disconnected,
+// failed or closed
+type PeerEvent struct {
+	PeerID string
+	State  string // pion's connection state, e.g. "connected" or "failed"
+	// MediaTransport is how a connected peer's media travels, see
+	// PeerTransport
+	MediaTransport string
+}
+
+// CameraEvent is a shared video track switching camera
+type CameraEvent struct {
+	TrackID string
+	Camera  int
+	Group   string // the camera group switched to, if the switch was a group's
+}
+
+// SourceErrorEvent is a camera's frames failing to load or read
+type SourceErrorEvent struct {
+	TrackID string // empty if the camera feeds no track yet
+	Camera  int
+	Err     error
+}
+
+// GovernorEvent is the CPU governor lowering or raising the encoding, see
+// cpu_governor.go
+type GovernorEvent struct {
+	Level      int
+	Step       string
+	CPUPercent float64
+	Cameras    []int // re-captured
+}
+
+// EventBus delivers lifecycle events to the handlers subscribed to them
+type EventBus struct {
+	peerConnected    []func(PeerEvent)
+	peerDisconnected []func(PeerEvent)
+	cameraSwitched   []func(CameraEvent)
+	sourceError      []func(SourceErrorEvent)
+	governorChanged  []func(GovernorEvent)
+	mu               sync.Mutex
+}
+
+func NewEventBus() *EventBus {
+	return &EventBus{}
+}
+
+// OnPeerConnected subscribes fn to peers connecting
+func (b *EventBus) OnPeerConnected(fn func(PeerEvent)) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.peerConnected = append(b.peerConnected, fn)
+}
+
+// OnPeerDisconnected subscribes fn to peers' connections going
+// disconnected, failed or closed
+func (b *EventBus) OnPeerDisconnected(fn func(PeerEvent)) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.peerDisconnected = append(b.peerDisconnected, fn)
+}
+
+// OnCameraSwitched subscribes fn to shared tracks switching camera
+func (b *EventBus) OnCameraSwitched(fn func(CameraEvent)) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.cameraSwitched = append(b.cameraSwitched, fn)
+}
+
+// OnSourceError subscribes fn to cameras failing to load or read
+func (b *EventBus) OnSourceError(fn func(SourceErrorEvent)) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.sourceError = append(b.sourceError, fn)
+}
+
+// OnGovernorChanged subscribes fn to the CPU governor's steps
+func (b *EventBus) OnGovernorChanged(fn func(GovernorEvent)) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.governorChanged = append(b.governorChanged, fn)
+}
+
+func (b *EventBus) emitPeerConnected(event PeerEvent) {
+	b.mu.Lock()
+	handlers := b.peerConnected
+	b.mu.Unlock()
+	for _, fn := range handlers {
+		fn(event)
+	}
+}
+
+func (b *EventBus) emitPeerDisconnected(event PeerEvent) {
+	b.mu.Lock()
+	handlers := b.peerDisconnected
+	b.mu.Unlock()
+	for _, fn := range handlers {
+		fn(event)
+	}
+}
+
+func (b *EventBus) emitCameraSwitched(event CameraEvent) {
+	b.mu.Lock()
+	handlers := b.cameraSwitched
+	b.mu.Unlock()
+	for _, fn := range handlers {
+		fn(event)
+	}
+}
+
+func (b *EventBus) emitSourceError(event SourceErrorEvent) {
+	log.Printf("Camera %d source error: %v", event.Camera, event.Err)
+	b.mu.Lock()
+	handlers := b.sourceError
+	b.mu.Unlock()
+	for _, fn := range handlers {
+		fn(event)
+	}
+}
+
+func (b *EventBus) emitGovernorChanged(event GovernorEvent) {
+	b.mu.Lock()
+	handlers := b.governorChanged
+	b.mu.Unlock()
+	for _, fn := range handlers {
+		fn(event)
+	}
+}
+
+// countEvents keeps the lifecycle metrics
+func countEvents(bus *EventBus) {
+	bus.OnPeerConnected(func(PeerEvent) { metrics.Inc("events.peer_connected") })
+	bus.OnPeerDisconnected(func(PeerEvent) { metrics.Inc("events.peer_disconnected") })
+	bus.OnCameraSwitched(func(CameraEvent) { metrics.Inc("events.camera_switched") })
+	bus.OnSourceError(func(SourceErrorEvent) { metrics.Inc("events.source_errors") })
+}
@@ -0,0 +1,336 @@
+package main
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// fileSource streams a camera's frames from a directory of frame files,
+// one length-prefixed frame per file, looping at the end, paced by a clock
+type fileSource struct {
+	frameFiles   []string
+	frameCounter int // index of the last frame read
+	lastIDRFrame int // index of the last frame read holding an IDR
+	// rewind continues from lastIDRFrame on the next frame, see ForceKeyframe
+	rewind bool
+	// sendParameterSets prefixes the next frame with the files' SPS and PPS,
+	// after switching to other files mid-stream
+	sendParameterSets bool
+
+	// Parameter sets and first IDR of the files, sent as the first frame
+	sps     []byte // Type 7
+	pps     []byte // Type 8
+	lastIDR []byte // Type 5
+
+	clock         Clock
+	frameDuration time.Duration
+	stats         VideoSourceStats
+	cancel        context.CancelFunc // stops the stream
+	done          chan struct{}
+	mu            sync.Mutex
+}
+
+func newFileSource(clock Clock, frameDuration time.Duration) *fileSource {
+	return &fileSource{
+		frameCounter:  -1,
+		lastIDRFrame:  -1,
+		clock:         clock,
+		frameDuration: frameDuration,
+	}
+}
+
+// findH264Files lists the frame files of directory in playback order
+func findH264Files(directory string) ([]string, error) {
+	files, err := filepath.Glob(filepath.Join(directory, "*.h264"))
+	if err != nil {
+		return nil, err
+	}
+
+	if len(files) == 0 {
+		return nil, fmt.Errorf("no H.264 files found in %s", directory)
+	}
+
+	// Sort files numerically like C++ implementation
+	sort.Slice(files, func(i, j int) bool {
+		numI := extractFileNumber(filepath.Base(files[i]))
+		numJ := extractFileNumber(filepath.Base(files[j]))
+		return numI < numJ
+	})
+	return files, nil
+}
+
+func extractFileNumber(filename string) int {
+	// Extract number from "sample-123.h264"
+	parts := strings.Split(filename, "-")
+	if len(parts) < 2 {
+		return 0
+	}
+	numStr := strings.TrimSuffix(parts[1], ".h264")
+	num, _ := strconv.Atoi(numStr)
+	return num
+}
+
+// useFiles streams files from the next frame on
+func (s *fileSource) useFiles(files []string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.useFilesLocked(files)
+}
+
+// useFilesLocked streams files from the next frame on, with s.mu held
+func (s *fileSource) useFilesLocked(files []string) {
+	s.frameFiles = files
+	frameCache.preload(files)
+
+	// Parse first file to get initial NAL units
+	if len(files) > 0 {
+		s.parseInitialNALUnits(files[0])
+	}
+
+	// Reset frame counter to start from beginning with new files
+	s.frameCounter = -1
+	s.lastIDRFrame = -1
+}
+
+// switchRendition continues the stream from files, another rendition of the
+// camera streamed, at the last IDR frame read: with aligned GOPs the picture
+// carries on where it was. Returns false if files are already streamed.
+func (s *fileSource) switchRendition(files []string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if len(files) == 0 || (len(s.frameFiles) > 0 && s.frameFiles[0] == files[0]) {
+		return false
+	}
+	s.frameFiles = files
+	frameCache.preload(files)
+	s.parseInitialNALUnits(files[0])
+	// The new rendition's parameter sets go out with its first frame
+	s.rewind = true
+	s.sendParameterSets = true
+	return true
+}
+
+func (s *fileSource) parseInitialNALUnits(filepath string) error {
+	data, err := os.ReadFile(filepath)
+	if err != nil {
+		return err
+	}
+
+	forEachNAL(data, func(nal []byte) {
+		// Store ONLY the NAL unit data (without length prefix)
+		switch nal[0] & 0x1F {
+		case NAL_SPS:
+			s.sps = append([]byte(nil), nal...)
+			log.Printf("Cached SPS NAL unit (%d bytes)", len(s.sps))
+		case NAL_PPS:
+			s.pps = append([]byte(nil), nal...)
+			log.Printf("Cached PPS NAL unit (%d bytes)", len(s.pps))
+		case NAL_IDR:
+			s.lastIDR = append([]byte(nil), nal...)
+			log.Printf("Cached IDR NAL unit (%d bytes)", len(s.lastIDR))
+		}
+	})
+	return nil
+}
+
+// initialFrame returns the files' SPS, PPS and first IDR, with s.mu held
+func (s *fileSource) initialFrame() []byte {
+	return lengthPrefixed(s.sps, s.pps, s.lastIDR)
+}
+
+// lengthPrefixed joins NAL units into a frame, skipping nil ones
+func lengthPrefixed(nals ...[]byte) []byte {
+	var frame []byte
+	for _, nal := range nals {
+		if nal != nil {
+			frame = binary.BigEndian.AppendUint32(frame, uint32(len(nal)))
+			frame = append(frame, nal...)
+		}
+	}
+	return frame
+}
+
+// setClock replaces the clock that paces the frames, before they start
+func (s *fileSource) setClock(clock Clock) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.clock = clock
+}
+
+// Start implements VideoSource
+func (s *fileSource) Start(sink SampleSink) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.cancel != nil {
+		return errors.New("file source already started")
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	s.cancel = cancel
+	s.done = make(chan struct{})
+	s.frameCounter = -1
+	go s.streamLoop(ctx, sink, s.clock, s.done)
+	return nil
+}
+
+// Stop implements VideoSource
+func (s *fileSource) Stop() {
+	s.mu.Lock()
+	cancel, done := s.cancel, s.done
+	s.cancel, s.done = nil, nil
+	s.mu.Unlock()
+
+	if cancel != nil {
+		cancel()
+		<-done
+	}
+}
+
+// ForceKeyframe implements VideoSource. Files have no encoder to ask, so
+// the source rewinds to the last IDR frame it read: resending only a cached
+// IDR would leave the following P-frames referencing pictures the decoder
+// never got.
+func (s *fileSource) ForceKeyframe() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.rewind = true
+	s.stats.Keyframes++
+}
+
+// Stats implements VideoSource
+func (s *fileSource) Stats() VideoSourceStats {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.stats
+}
+
+// streamLoop reads a frame each time one is due and writes it to sink until
+// ctx is cancelled or the sink stops
+func (s *fileSource) streamLoop(ctx context.Context, sink SampleSink, clock Clock, done chan struct{}) {
+	defer close(done)
+	log.Println("Starting proper video stream with microsecond timing")
+
+	// Send initial NAL units immediately
+	s.mu.Lock()
+	initialData := s.initialFrame()
+	s.mu.Unlock()
+	if len(initialData) > 0 && !sink.WriteFrame(VideoFrame{Data: initialData, Duration: s.frameDuration, Captured: clock.Now()}) {
+		return
+	}
+
+	pacer := newFramePacer(clock, s.frameDuration)
+	framesRead := 0
+	failing := false // frames are failing to read, already reported
+	var frame []byte // read into, reused once the sink has the frame
+
+	for {
+		late, ok := pacer.wait(ctx)
+		if !ok {
+			log.Printf("Stopping stream. Read %d frames", framesRead)
+			return
+		}
+
+		s.mu.Lock()
+		s.stats.PacedFrames++
+		s.stats.Jitter += late
+		s.stats.MaxJitter = max(s.stats.MaxJitter, late)
+		if len(s.frameFiles) == 0 {
+			s.stats.Errors++
+			s.mu.Unlock()
+			if !failing {
+				log.Println("ERROR: No H264 files loaded, cannot stream")
+				sink.ReportError(errors.New("no H264 files loaded"))
+			}
+			failing = true
+			continue
+		}
+		if s.rewind {
+			s.rewind = false
+			rewindTo := s.lastIDRFrame
+			if rewindTo < 0 || rewindTo >= len(s.frameFiles) {
+				rewindTo = 0
+			}
+			// Advanced below before reading
+			s.frameCounter = rewindTo - 1
+		}
+		s.frameCounter++
+		if s.frameCounter >= len(s.frameFiles) {
+			if s.frameCounter > 0 {
+				// Loop back to start
+				s.frameCounter = 0
+				log.Println("Looping video")
+			}
+		}
+
+		// Read frame file
+		frameIndex := s.frameCounter
+		filepath := s.frameFiles[frameIndex]
+		var parameterSets []byte
+		if s.sendParameterSets {
+			s.sendParameterSets = false
+			parameterSets = lengthPrefixed(s.sps, s.pps)
+		}
+		s.mu.Unlock()
+		var err error
+		frame, err = frameCache.readFrame(append(frame[:0], parameterSets...), filepath)
+		if err != nil {
+			log.Printf("Failed to read frame %d: %v", frameIndex, err)
+			s.mu.Lock()
+			s.stats.Errors++
+			s.mu.Unlock()
+			if !failing {
+				sink.ReportError(fmt.Errorf("failed to read frame %d: %v", frameIndex, err))
+			}
+			failing = true
+			continue
+		}
+		failing = false
+		if hasIDR(frame) {
+			s.mu.Lock()
+			s.lastIDRFrame = frameIndex
+			s.mu.Unlock()
+		}
+
+		if !sink.WriteFrame(VideoFrame{Data: frame, Duration: s.frameDuration, Captured: clock.Now()}) {
+			return
+		}
+		framesRead++
+		s.mu.Lock()
+		s.stats.Frames++
+		s.stats.Bytes += uint64(len(frame))
+		s.mu.Unlock()
+	}
+}
+
+// readFrameFile appends the frame file at path to dst
+func readFrameFile(dst []byte, path string) ([]byte, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return dst, err
+	}
+	defer file.Close()
+
+	info, err := file.Stat()
+	if err != nil {
+		return dst, err
+	}
+	start := len(dst)
+	dst = slices.Grow(dst, int(info.Size()))[:start+int(info.Size())]
+	if _, err := io.ReadFull(file, dst[start:]); err != nil {
+		return dst[:start], err
+	}
+	return dst, nil
+}
@@ -0,0 +1,65 @@
+package main
+
+import (
+	"encoding/binary"
+	"sync"
+)
+
+// Frame buffers: every frame of every output goes through the pipeline 30
+// times a second, so the path avoids allocating per frame. Sources reuse
+// their read and assembly buffers, as a frame's data is only valid during
+// WriteFrame. The streamer builds each sample, SEI, parameter sets and
+// Annex B conversion together, in one buffer from frameBuffers, which goes
+// back to the pool once the track has packetized the sample.
+
+// frameBuffers holds *[]byte sample buffers, see getFrameBuffer
+var frameBuffers = sync.Pool{
+	New: func() any {
+		buffer := make([]byte, 0, frameBufferSize)
+		return &buffer
+	},
+}
+
+// getFrameBuffer returns an empty pooled buffer with room for size bytes
+func getFrameBuffer(size int) *[]byte {
+	buffer := frameBuffers.Get().(*[]byte)
+	if cap(*buffer) < size {
+		*buffer = make([]byte, 0, size)
+	}
+	*buffer = (*buffer)[:0]
+	return buffer
+}
+
+// putFrameBuffer returns a buffer to the pool, once nothing uses its data
+func putFrameBuffer(buffer *[]byte) {
+	if buffer == nil || cap(*buffer) > frameBufferMaxSize {
+		return
+	}
+	frameBuffers.Put(buffer)
+}
+
+// annexBStartCode precedes each NAL unit of an Annex B sample
+var annexBStartCode = []byte{0x00, 0x00, 0x00, 0x01}
+
+// appendAnnexB appends a length-prefixed frame's NAL units to dst in Annex B
+// format, each after a start code. The lengths are the start codes' size,
+// so dst grows by len(data) at most.
+func appendAnnexB(dst []byte, data []byte) []byte {
+	i := 0
+	for i+4 <= len(data) {
+		naluStartIndex := i + 4
+		naluEndIndex := naluStartIndex + int(binary.BigEndian.Uint32(data[i:i+4]))
+		if naluEndIndex > len(data) {
+			break
+		}
+		dst = append(dst, annexBStartCode...)
+		dst = append(dst, data[naluStartIndex:naluEndIndex]...)
+		i = naluEndIndex
+	}
+	return dst
+}
+
+// appendAnnexBNAL appends one NAL unit to dst after a start code
+func appendAnnexBNAL(dst []byte, nal []byte) []byte {
+	return append(append(dst, annexBStartCode...), nal...)
+}
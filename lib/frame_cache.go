@@ -0,0 +1,205 @@
+package main
+
+import (
+	"container/list"
+	"log"
+	"os"
+	"sync"
+	"time"
+)
+
+// Frame cache: streaming a camera's frame files reads one every tick, and
+// disk I/O shows up as jitter in the stream. With frameCacheMode "preload"
+// every file of a camera is read into memory when the camera is loaded,
+// or a rendition switched to; with "mmap" the files are mapped instead,
+// leaving the pages to the kernel's page cache. Loading happens in the
+// background, frames not cached yet being read from disk as before. The
+// cache is shared by every file source and holds frameCacheMaxBytes at
+// most: loading more evicts the least recently streamed files, and what
+// does not fit is read from disk. A file is loaded again if its size or
+// modification time changed since. Mapped files must be replaced rather
+// than rewritten in place: reading a mapped file truncated meanwhile
+// crashes the process.
+
+// frameCache holds the frame files of the cameras loaded
+var frameCache = newFrameFileCache(frameCacheMode, frameCacheMaxBytes)
+
+// frameFileCache keeps frame files in memory, least recently used first
+// to go
+type frameFileCache struct {
+	mode     string // frameCacheMode
+	maxBytes int64
+	bytes    int64
+	entries  map[string]*list.Element // of *cachedFrameFile
+	lru      *list.List               // most recently used at the front
+	loading  map[string]bool          // first files of the sets being loaded
+	loads    int                      // sets loaded so far
+	mu       sync.Mutex
+}
+
+// cachedFrameFile is a frame file in memory
+type cachedFrameFile struct {
+	path    string
+	data    []byte
+	mapped  bool // data is mapped, and unmapped when evicted
+	load    int  // set it was loaded with
+	size    int64
+	modTime time.Time
+}
+
+func newFrameFileCache(mode string, maxBytes int64) *frameFileCache {
+	return &frameFileCache{
+		mode:     mode,
+		maxBytes: maxBytes,
+		entries:  make(map[string]*list.Element),
+		lru:      list.New(),
+		loading:  make(map[string]bool),
+	}
+}
+
+// enabled reports whether frame files are cached
+func (c *frameFileCache) enabled() bool {
+	return c.mode == "preload" || c.mode == "mmap"
+}
+
+// preload loads files into the cache in the background, unless they are
+// being loaded already
+func (c *frameFileCache) preload(files []string) {
+	if !c.enabled() || len(files) == 0 {
+		return
+	}
+	c.mu.Lock()
+	if c.loading[files[0]] {
+		c.mu.Unlock()
+		return
+	}
+	c.loading[files[0]] = true
+	c.mu.Unlock()
+
+	go func() {
+		start := time.Now()
+		loaded, err := c.load(files)
+		if err != nil {
+			log.Printf("Failed to %s frame files: %v", c.mode, err)
+		}
+		c.mu.Lock()
+		delete(c.loading, files[0])
+		cached := c.bytes
+		c.mu.Unlock()
+		log.Printf("Cached %d of %d frame files (%s) in %v, cache %d MB",
+			loaded, len(files), c.mode, time.Since(start).Round(time.Millisecond), cached>>20)
+	}()
+}
+
+// load loads files into the cache, stopping at the first that cannot be
+// loaded or does not fit, and returns how many are cached
+func (c *frameFileCache) load(files []string) (int, error) {
+	c.mu.Lock()
+	c.loads++
+	load := c.loads
+	c.mu.Unlock()
+
+	for i, path := range files {
+		info, err := os.Stat(path)
+		if err != nil {
+			return i, err
+		}
+		if info.Size() > c.maxBytes {
+			return i, nil
+		}
+		c.mu.Lock()
+		if element, ok := c.entries[path]; ok {
+			entry := element.Value.(*cachedFrameFile)
+			if entry.size == info.Size() && entry.modTime.Equal(info.ModTime()) {
+				c.mu.Unlock()
+				continue
+			}
+			c.remove(element)
+		}
+		c.mu.Unlock()
+
+		entry := &cachedFrameFile{path: path, load: load, size: info.Size(), modTime: info.ModTime()}
+		if c.mode == "mmap" {
+			entry.data, err = mapFile(path, info.Size())
+			entry.mapped = err == nil
+		} else {
+			entry.data, err = os.ReadFile(path)
+		}
+		if err != nil {
+			return i, err
+		}
+
+		c.mu.Lock()
+		fits := c.insert(entry)
+		c.mu.Unlock()
+		if !fits {
+			return i, nil
+		}
+	}
+	return len(files), nil
+}
+
+// insert adds entry to the cache as the most recently used file, evicting
+// the least recently used ones to make room for it; with c.mu held.
+// Returns false, releasing entry, if it would only fit by evicting files
+// of its own set: the start of a set is kept rather than its end, as
+// streaming starts there.
+func (c *frameFileCache) insert(entry *cachedFrameFile) bool {
+	if _, ok := c.entries[entry.path]; ok {
+		// Loaded meanwhile by another set sharing the file
+		c.release(entry)
+		return true
+	}
+	for c.bytes+entry.size > c.maxBytes {
+		oldest := c.lru.Back()
+		if oldest == nil || oldest.Value.(*cachedFrameFile).load == entry.load {
+			c.release(entry)
+			return false
+		}
+		c.remove(oldest)
+		metrics.Inc("frames.cache_evictions")
+	}
+	c.entries[entry.path] = c.lru.PushFront(entry)
+	c.bytes += entry.size
+	metrics.SetGauge("frames.cache_bytes", c.bytes)
+	return true
+}
+
+// remove evicts a file from the cache, with c.mu held
+func (c *frameFileCache) remove(element *list.Element) {
+	entry := c.lru.Remove(element).(*cachedFrameFile)
+	delete(c.entries, entry.path)
+	c.bytes -= entry.size
+	c.release(entry)
+	metrics.SetGauge("frames.cache_bytes", c.bytes)
+}
+
+// release frees an entry's memory, with c.mu held so no read copies from
+// it meanwhile
+func (c *frameFileCache) release(entry *cachedFrameFile) {
+	if entry.mapped {
+		if err := unmapFile(entry.data); err != nil {
+			log.Printf("Failed to unmap %s: %v", entry.path, err)
+		}
+	}
+	entry.data = nil
+}
+
+// readFrame appends the frame file at path to dst, from the cache if it
+// holds the file, and from disk otherwise
+func (c *frameFileCache) readFrame(dst []byte, path string) ([]byte, error) {
+	if !c.enabled() {
+		return readFrameFile(dst, path)
+	}
+	c.mu.Lock()
+	if element, ok := c.entries[path]; ok {
+		c.lru.MoveToFront(element)
+		dst = append(dst, element.Value.(*cachedFrameFile).data...)
+		c.mu.Unlock()
+		metrics.Inc("frames.cache_hits")
+		return dst, nil
+	}
+	c.mu.Unlock()
+	metrics.Inc("frames.cache_misses")
+	return readFrameFile(dst, path)
+}
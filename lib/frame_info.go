@@ -0,0 +1,117 @@
+package main
+
+import (
+	"encoding/binary"
+	"slices"
+	"time"
+)
+
+// Frame info: the capture time SEI (see capture_time.go) is version 1 of
+// the SEI frames are stamped with. Version 2, the frame info SEI, adds the
+// camera streamed, the frame's sequence number on its track and its
+// capture time on the backend's monotonic clock, so clients can count the
+// frames dropped on the way (gaps in the sequence) and measure latency per
+// camera without wall clock steps getting in the way. A peer lists the
+// versions it parses in seiVersions of its capabilities, [1] if it does
+// not; the backend's reply lists those it stamps, and each peer is served
+// the highest both know. Peers share the tracks, so frames carry the SEI
+// of every version negotiated with a connected peer.
+
+// SEI versions
+const (
+	seiVersionCaptureTime = 1
+	seiVersionFrameInfo   = 2
+)
+
+// seiFrameInfoUUID identifies the rmcs frame info SEI message. Its payload,
+// big-endian:
+//
+//	0      version, 2; later versions append fields, which older clients skip
+//	1-2    camera streamed
+//	3-6    frame sequence number on the track, wrapping
+//	7-14   capture time in microseconds since the Unix epoch
+//	15-22  capture time in microseconds on the backend's monotonic clock
+var seiFrameInfoUUID = [16]byte{
+	0x72, 0x6d, 0x63, 0x73, 0x2d, 0x66, 0x72, 0x6d, // "rmcs-frm"
+	0x51, 0xe4, 0x2b, 0x97, 0x0c, 0x6a, 0x4d, 0x38,
+}
+
+// monotonicEpoch is zero on the monotonic clock of the frame info SEI
+var monotonicEpoch = time.Now()
+
+// appendFrameInfoSEI appends the frame info SEI NAL unit of a frame of
+// camera, sequence on its track, captured at captured, to dst
+func appendFrameInfoSEI(dst []byte, camera int, sequence uint32, captured time.Time) []byte {
+	var payload [23]byte
+	payload[0] = seiVersionFrameInfo
+	binary.BigEndian.PutUint16(payload[1:], uint16(camera))
+	binary.BigEndian.PutUint32(payload[3:], sequence)
+	binary.BigEndian.PutUint64(payload[7:], uint64(captured.UnixMicro()))
+	binary.BigEndian.PutUint64(payload[15:], uint64(max(captured.Sub(monotonicEpoch), 0).Microseconds()))
+	return appendUserDataSEI(dst, seiFrameInfoUUID, payload[:])
+}
+
+// supportedSEIVersions returns the SEI versions frames can be stamped with
+func supportedSEIVersions() []int {
+	var versions []int
+	if seiCaptureTime {
+		versions = append(versions, seiVersionCaptureTime)
+	}
+	if seiFrameInfo {
+		versions = append(versions, seiVersionFrameInfo)
+	}
+	return versions
+}
+
+// negotiateSEIVersion returns the highest SEI version both the backend and
+// a peer with caps know, 0 for none
+func negotiateSEIVersion(caps PeerCapabilities) int {
+	parsed := caps.SEIVersions
+	if len(parsed) == 0 {
+		parsed = []int{seiVersionCaptureTime}
+	}
+	version := 0
+	for _, supported := range supportedSEIVersions() {
+		if slices.Contains(parsed, supported) {
+			version = supported
+		}
+	}
+	return version
+}
+
+// seiVersionMask returns the bit of each version in versions
+func seiVersionMask(versions ...int) uint32 {
+	var mask uint32
+	for _, version := range versions {
+		mask |= 1 << version
+	}
+	return mask
+}
+
+// updateSEIVersions stamps the frames of every track with the SEI versions
+// negotiated with the peers, or with every supported one without peers, so
+// the GOP cache serves whoever connects next. Called with w.mu held.
+func (w *WebRTCManager) updateSEIVersions() {
+	mask := seiVersionMask(supportedSEIVersions()...)
+	if len(w.seiVersions) > 0 {
+		mask = 0
+		for _, version := range w.seiVersions {
+			mask |= seiVersionMask(version)
+		}
+	}
+	for _, output := range w.allOutputs() {
+		output.streamer.seiVersions.Store(mask)
+		for _, layer := range output.layers {
+			layer.streamer.seiVersions.Store(mask)
+		}
+	}
+}
+
+// setStreamedCamera tells the output's streamers which camera they stream,
+// for the frame info SEI
+func (o *videoOutput) setStreamedCamera(cameraNumber int) {
+	o.streamer.camera.Store(int32(cameraNumber))
+	for _, layer := range o.layers {
+		layer.streamer.camera.Store(int32(cameraNumber))
+	}
+}
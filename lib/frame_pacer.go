@@ -0,0 +1,44 @@
+package main
+
+import (
+	"context"
+	"time"
+)
+
+// framePacer times frames to deadlines on a clock rather than to a ticker:
+// frame n is due n intervals after the start, so a late wake-up is made up
+// by the next frame instead of pushing every later one back, and the rate
+// does not drift. Falling more than pacingResyncLag behind, on a stalled
+// disk or a suspended host, restarts the schedule from then rather than
+// bursting out the frames missed.
+type framePacer struct {
+	clock    Clock
+	interval time.Duration
+	next     time.Time // when the next frame is due
+}
+
+func newFramePacer(clock Clock, interval time.Duration) *framePacer {
+	return &framePacer{clock: clock, interval: interval, next: clock.Now().Add(interval)}
+}
+
+// wait blocks until the next frame is due, returning how late it woke for
+// it, or false if ctx is done first
+func (p *framePacer) wait(ctx context.Context) (late time.Duration, ok bool) {
+	timer := p.clock.NewTimer(p.next.Sub(p.clock.Now()))
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return 0, false
+	case <-timer.C():
+	}
+
+	now := p.clock.Now()
+	late = max(now.Sub(p.next), 0)
+	metrics.Observe("pipeline.pacing_jitter", late)
+	if late > pacingResyncLag {
+		metrics.Inc("pipeline.pacing_resyncs")
+		p.next = now
+	}
+	p.next = p.next.Add(p.interval)
+	return late, true
+}
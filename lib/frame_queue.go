@@ -0,0 +1,167 @@
+package main
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+// Frame queue overflow policies
+const (
+	// OverflowBlock makes the reader wait for the writer, like a direct call
+	OverflowBlock = "block"
+	// OverflowDropNewest discards the frame that did not fit
+	OverflowDropNewest = "drop-newest"
+	// OverflowDropOldest discards the longest-queued frame to make room
+	OverflowDropOldest = "drop-oldest"
+	// OverflowDropOldestKeepKeyframes discards the longest-queued frame that
+	// is not a keyframe, so the stream never loses a point decoders can
+	// recover from. With only keyframes queued, a new delta frame is
+	// discarded, and a new keyframe replaces the oldest.
+	OverflowDropOldestKeepKeyframes = "drop-oldest-keep-keyframes"
+)
+
+// queuedFrame is an Annex B access unit waiting to be written to the track
+type queuedFrame struct {
+	data     []byte
+	buffer   *[]byte // data is in, see frame_buffers.go
+	duration time.Duration
+	captured time.Time // see capture_time.go
+	enqueued time.Time
+	keyframe bool // it holds an IDR
+}
+
+// release returns the frame's buffer to the pool once it is written or
+// dropped
+func (f queuedFrame) release() {
+	putFrameBuffer(f.buffer)
+}
+
+// FrameQueue is the bounded hand-off between the NAL reader and the track
+// writer. Its depth and wait times are reported under "pipeline.*" metrics.
+type FrameQueue struct {
+	frames  chan queuedFrame
+	policy  string
+	clock   Clock
+	dropped *atomic.Uint64 // counts the frames the policy discards
+}
+
+// NewFrameQueue returns a queue of size frames, counting those it drops in
+// dropped
+func NewFrameQueue(size int, policy string, clock Clock, dropped *atomic.Uint64) *FrameQueue {
+	return &FrameQueue{
+		frames:  make(chan queuedFrame, size),
+		policy:  policy,
+		clock:   clock,
+		dropped: dropped,
+	}
+}
+
+// Push queues a frame according to the overflow policy. It returns false
+// only if stop closed while blocked.
+func (q *FrameQueue) Push(frame queuedFrame, stop <-chan struct{}) bool {
+	frame.enqueued = q.clock.Now()
+
+	select {
+	case q.frames <- frame:
+		q.reportDepth()
+		return true
+	default:
+	}
+
+	metrics.Inc("pipeline.queue_full")
+
+	switch q.policy {
+	case OverflowDropNewest:
+		q.drop(frame)
+		return true
+	case OverflowDropOldest:
+		select {
+		case dropped := <-q.frames:
+			q.drop(dropped)
+		default:
+		}
+		// Only the reader fills the queue, so the freed slot is still free
+		q.frames <- frame
+		q.reportDepth()
+		return true
+	case OverflowDropOldestKeepKeyframes:
+		q.dropOldestDelta(frame)
+		return true
+	default:
+		select {
+		case q.frames <- frame:
+			q.reportDepth()
+			return true
+		case <-stop:
+			frame.release()
+			return false
+		}
+	}
+}
+
+// dropOldestDelta queues frame in place of the oldest queued delta frame,
+// see OverflowDropOldestKeepKeyframes
+func (q *FrameQueue) dropOldestDelta(frame queuedFrame) {
+	// Take the frames the writer has not, and put them back without the
+	// oldest delta frame. The writer only takes from the front and only the
+	// reader fills the queue, so the order holds and there is room for all.
+	queued := make([]queuedFrame, 0, cap(q.frames))
+drain:
+	for {
+		select {
+		case waiting := <-q.frames:
+			queued = append(queued, waiting)
+		default:
+			break drain
+		}
+	}
+	dropped := -1
+	for i, waiting := range queued {
+		if !waiting.keyframe {
+			dropped = i
+			break
+		}
+	}
+	switch {
+	case dropped >= 0:
+		q.drop(queued[dropped])
+		queued = append(queued[:dropped], queued[dropped+1:]...)
+	case !frame.keyframe || len(queued) == 0:
+		q.drop(frame)
+		frame = queuedFrame{}
+	default:
+		q.drop(queued[0])
+		queued = queued[1:]
+	}
+	for _, waiting := range queued {
+		q.frames <- waiting
+	}
+	if frame.data != nil {
+		q.frames <- frame
+	}
+	q.reportDepth()
+}
+
+// drop discards frame
+func (q *FrameQueue) drop(frame queuedFrame) {
+	metrics.Inc("pipeline.frames_dropped")
+	if q.dropped != nil {
+		q.dropped.Add(1)
+	}
+	frame.release()
+}
+
+// Frames is drained by the writer
+func (q *FrameQueue) Frames() <-chan queuedFrame {
+	return q.frames
+}
+
+// Received records how long frame waited in the queue
+func (q *FrameQueue) Received(frame queuedFrame) {
+	metrics.Observe("pipeline.queue_latency", q.clock.Now().Sub(frame.enqueued))
+	q.reportDepth()
+}
+
+func (q *FrameQueue) reportDepth() {
+	metrics.SetGauge("pipeline.queue_depth", int64(len(q.frames)))
+}
@@ -0,0 +1,201 @@
+package main
+
+import (
+	"sync"
+
+	"github.com/pion/rtp"
+	"github.com/pion/webrtc/v4"
+)
+
+// GOP cache: with gopCacheEnabled each track keeps the RTP packets it sent
+// since its last keyframe, and a peer joining the track is sent them in a
+// burst before the live packets, as soon as its connection can carry them.
+// Its decoder gets the keyframe and everything since at once, so video
+// shows within a round trip of connecting instead of at the source's next
+// keyframe. The packets are replayed as they were sent, sequence numbers
+// and timestamps included, so the live stream carries on from them for the
+// new peer as for every other. A GOP longer than gopCacheMaxPackets is not
+// kept; peers joining then get a keyframe request, as without the cache.
+
+// gopPacket is a packet of the cached GOP, without header extensions, which
+// are each peer's own
+type gopPacket struct {
+	header  rtp.Header
+	payload []byte
+}
+
+// gopCache holds the packets of a track's current GOP
+type gopCache struct {
+	packets   []gopPacket
+	timestamp uint32 // of the GOP's keyframe
+	keyframe  bool   // packets start with a keyframe and can be replayed
+	lastSeq   uint16 // of the last packet recorded
+	recorded  bool
+	mu        sync.Mutex
+}
+
+// record adds a packet sent to one of the track's peers. Every peer's
+// writer records every packet; those already recorded are skipped.
+func (c *gopCache) record(header *rtp.Header, payload []byte) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.recorded {
+		delta := header.SequenceNumber - c.lastSeq
+		if delta == 0 || delta >= 0x8000 {
+			return
+		}
+		if delta != 1 {
+			// Packets went unrecorded, with no peer to send them to
+			c.clear()
+		}
+	}
+	c.lastSeq, c.recorded = header.SequenceNumber, true
+
+	if rtpStartsKeyframe(payload) && (!c.keyframe || header.Timestamp != c.timestamp) {
+		// The GOP starts with the keyframe's frame, SEI sent ahead of it
+		// included
+		start := len(c.packets)
+		for start > 0 && c.packets[start-1].header.Timestamp == header.Timestamp {
+			start--
+		}
+		c.packets = append([]gopPacket(nil), c.packets[start:]...)
+		c.timestamp, c.keyframe = header.Timestamp, true
+	} else if !c.keyframe && len(c.packets) > 0 && c.packets[len(c.packets)-1].header.Timestamp != header.Timestamp {
+		// Until a keyframe, only the frame being sent can become the GOP's
+		c.packets = c.packets[:0]
+	}
+	if len(c.packets) >= gopCacheMaxPackets {
+		c.clear()
+		return
+	}
+
+	packet := gopPacket{header: header.Clone(), payload: append([]byte(nil), payload...)}
+	packet.header.Extension, packet.header.Extensions = false, nil
+	c.packets = append(c.packets, packet)
+}
+
+// clear forgets the GOP until the next keyframe, with c.mu held
+func (c *gopCache) clear() {
+	c.packets, c.keyframe = nil, false
+}
+
+// reset forgets the GOP, for a new source or a stopped stream
+func (c *gopCache) reset() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.clear()
+	c.recorded = false
+}
+
+// before returns the GOP's packets sent ahead of the recorded packet seq,
+// nil if there is no GOP to replay up to it
+func (c *gopCache) before(seq uint16) []gopPacket {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if !c.keyframe {
+		return nil
+	}
+	for i := len(c.packets) - 1; i >= 0; i-- {
+		if c.packets[i].header.SequenceNumber == seq {
+			// Recorded packets are never changed, so the slice can be read
+			// without the lock
+			return c.packets[:i:i]
+		}
+	}
+	return nil
+}
+
+// rtpStartsKeyframe reports whether an H.264 RTP payload holds an SPS or
+// the start of an IDR slice
+func rtpStartsKeyframe(payload []byte) bool {
+	if len(payload) < 2 {
+		return false
+	}
+	switch payload[0] & 0x1F {
+	case NAL_IDR, NAL_SPS:
+		return true
+	case 24: // STAP-A
+		for i := 1; i+2 < len(payload); {
+			size := int(payload[i])<<8 | int(payload[i+1])
+			if size == 0 {
+				break
+			}
+			if nalType := payload[i+2] & 0x1F; nalType == NAL_IDR || nalType == NAL_SPS {
+				return true
+			}
+			i += 2 + size
+		}
+	case 28: // FU-A
+		return payload[1]&0x80 != 0 && payload[1]&0x1F == NAL_IDR
+	}
+	return false
+}
+
+// gopPrimingTrack is one peer's view of a shared track, replaying the
+// track's GOP to it before its first live packet
+type gopPrimingTrack struct {
+	webrtc.TrackLocal
+	peerID   string
+	streamer *VideoStreamer
+}
+
+func (t *gopPrimingTrack) Bind(ctx webrtc.TrackLocalContext) (webrtc.RTPCodecParameters, error) {
+	writer := &gopPrimingWriter{TrackLocalWriter: ctx.WriteStream(), peerID: t.peerID, streamer: t.streamer}
+	return t.TrackLocal.Bind(writerContext{TrackLocalContext: ctx, writer: writer})
+}
+
+// gopPrimingWriter records the packets written to one peer in the track's
+// GOP cache, and replays the GOP ahead of the first of them the peer's
+// connection can carry
+type gopPrimingWriter struct {
+	webrtc.TrackLocalWriter
+	peerID   string
+	streamer *VideoStreamer
+	primed   bool
+}
+
+func (w *gopPrimingWriter) WriteRTP(header *rtp.Header, payload []byte) (int, error) {
+	w.streamer.gop.record(header, payload)
+	if w.primed {
+		return w.TrackLocalWriter.WriteRTP(header, payload)
+	}
+
+	replay := w.streamer.gop.before(header.SequenceNumber)
+	for i, packet := range replay {
+		replayed := packet.header
+		replayed.SSRC, replayed.PayloadType = header.SSRC, header.PayloadType
+		n, err := w.TrackLocalWriter.WriteRTP(&replayed, packet.payload)
+		if err != nil {
+			return n, err
+		}
+		// Until the connection is up its packets are dropped unwritten;
+		// this one is cached to be replayed once it is
+		if i == 0 && n == 0 {
+			return 0, nil
+		}
+	}
+
+	n, err := w.TrackLocalWriter.WriteRTP(header, payload)
+	if err != nil || (n == 0 && len(replay) == 0) {
+		return n, err
+	}
+	w.primed = true
+	if len(replay) > 0 {
+		metrics.Inc("video.gop_replays")
+		metrics.Add("video.gop_replayed_packets", uint64(len(replay)))
+	} else if !rtpStartsKeyframe(payload) {
+		// Nothing cached: the peer joined mid-GOP
+		w.streamer.RequestKeyframe(w.peerID, "New peer")
+	}
+	return n, err
+}
+
+func (w *gopPrimingWriter) Write(b []byte) (int, error) {
+	var packet rtp.Packet
+	if err := packet.Unmarshal(b); err != nil {
+		return 0, err
+	}
+	return w.WriteRTP(&packet.Header, packet.Payload)
+}
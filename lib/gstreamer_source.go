@@ -0,0 +1,62 @@
+package main
+
+import (
+	"fmt"
+	"os/exec"
+	"strconv"
+	"strings"
+)
+
+// GStreamer sources: a camera whose entry in cameraDirectories is
+// "gst:<name>" is captured and encoded by the pipeline template of that name
+// in gstreamerPipelines, for deployments without FFmpeg or needing
+// hardware plugins such as nvv4l2h264enc. The template ends with H.264;
+// the source runs it with gstreamerCommand as a process source (see
+// process_source.go), with RTP payloading appended. gst-launch cannot be
+// sent a force-key-unit event, so keyframes are forced by restarting it and
+// templates set a short keyframe interval of their own (idrinterval,
+// key-int-max).
+
+// gstreamerPipelines are the pipeline templates cameras select. {camera}
+// is replaced with the camera number.
+var gstreamerPipelines = map[string]string{
+	// Jetson CSI camera, hardware encoded
+	"jetson-csi": "nvarguscamerasrc sensor-id={camera} ! video/x-raw(memory:NVMM),width=1280,height=720,framerate=30/1 ! " +
+		"nvv4l2h264enc bitrate=2000000 idrinterval=30 insert-sps-pps=true maxperf-enable=true",
+	// USB camera, software encoded
+	"v4l2-x264": "v4l2src device=/dev/video{camera} ! videoconvert ! video/x-raw,format=I420,framerate=30/1 ! " +
+		"x264enc tune=zerolatency speed-preset=ultrafast bitrate=2000 key-int-max=30",
+	// Test pattern, for deployments without cameras
+	"test": "videotestsrc is-live=true pattern=ball ! video/x-raw,width=1280,height=720,framerate=30/1 ! " +
+		"x264enc tune=zerolatency speed-preset=ultrafast bitrate=2000 key-int-max=30",
+}
+
+// gstreamerPipeline returns the template a "gst:<name>" camera entry
+// selects. ok is false for other entries.
+func gstreamerPipeline(address string) (name string, ok bool) {
+	return strings.CutPrefix(address, "gst:")
+}
+
+// newGStreamerSource returns a source running the pipeline template name
+// for cameraNumber
+func newGStreamerSource(name string, cameraNumber int) (*processSource, error) {
+	template, ok := gstreamerPipelines[name]
+	if !ok {
+		return nil, fmt.Errorf("unknown GStreamer pipeline %q", name)
+	}
+	pipeline := strings.ReplaceAll(template, "{camera}", strconv.Itoa(cameraNumber))
+
+	return &processSource{
+		name: "GStreamer pipeline " + name,
+		command: func(port int) (*exec.Cmd, error) {
+			args := append([]string{"-q"}, strings.Fields(pipeline)...)
+			args = append(args, strings.Fields(fmt.Sprintf(
+				"! h264parse config-interval=-1 ! rtph264pay pt=%d mtu=%d config-interval=-1 ! udpsink host=127.0.0.1 port=%d sync=false",
+				processPayloadType, rtpMTU, port))...)
+			return exec.Command(gstreamerCommand, args...), nil
+		},
+		timeout:      gstreamerTimeout,
+		restartDelay: gstreamerRestartDelay,
+		metric:       "gstreamer.restarts",
+	}, nil
+}
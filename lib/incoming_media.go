@@ -0,0 +1,190 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/pion/rtcp"
+	"github.com/pion/rtp"
+	"github.com/pion/rtp/codecs"
+	"github.com/pion/sdp/v3"
+	"github.com/pion/webrtc/v4"
+	"github.com/pion/webrtc/v4/pkg/media/h264writer"
+	"github.com/pion/webrtc/v4/pkg/media/ivfwriter"
+	"github.com/pion/webrtc/v4/pkg/media/oggwriter"
+	"github.com/pion/webrtc/v4/pkg/media/samplebuilder"
+)
+
+// Incoming media: with incomingMediaEnabled, the camera and microphone
+// tracks an operator offers to send (a sendrecv or sendonly section) are
+// received, e.g. for remote assistance. Each track's frames go to the
+// IncomingMediaSink, which the host application sets to publish them on a
+// ROS topic, and with incomingMediaDir set each track is also saved to a
+// file there. Viewers are never asked to send, see answerSendOnly.
+
+// incomingMaxLate is how many packets a frame may wait for a reordered or
+// retransmitted packet before it is given up
+const incomingMaxLate = 128
+
+// IncomingFrame is one frame of a track an operator sends
+type IncomingFrame struct {
+	PeerID    string
+	Kind      string // "video" or "audio"
+	Codec     string // MIME type, e.g. "video/VP8"
+	Data      []byte // Annex B for H.264, the codec's frame otherwise
+	Timestamp uint32 // RTP timestamp, in the codec's clock rate
+}
+
+// IncomingMediaSink receives the frames of operators' tracks. It is called
+// on the track's goroutine and must not keep Data.
+type IncomingMediaSink func(frame IncomingFrame)
+
+// rtpFileWriter is one of pion's media file writers
+type rtpFileWriter interface {
+	WriteRTP(packet *rtp.Packet) error
+	Close() error
+}
+
+// SetIncomingMediaSink makes sink receive the frames of operators' tracks;
+// nil stops delivering them
+func (w *WebRTCManager) SetIncomingMediaSink(sink IncomingMediaSink) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.incomingSink = sink
+}
+
+func (w *WebRTCManager) incomingMediaSink() IncomingMediaSink {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.incomingSink
+}
+
+// receiveTrack reads track until peerID's connection closes, handing its
+// frames to the sink and saving it under incomingMediaDir
+func (w *WebRTCManager) receiveTrack(peerID string, peerConnection *webrtc.PeerConnection, track *webrtc.TrackRemote) {
+	codec := track.Codec()
+	kind := track.Kind().String()
+	log.Printf("[%s] Receiving %s track %s (%s)", peerID, kind, track.ID(), codec.MimeType)
+	metrics.Inc("incoming.tracks." + kind)
+
+	var file rtpFileWriter
+	if incomingMediaDir != "" {
+		var err error
+		if file, err = newTrackFile(peerID, kind, codec); err != nil {
+			log.Printf("[%s] Not saving %s track: %v", peerID, kind, err)
+			file = nil // not the writer's typed nil
+		}
+	}
+	defer func() {
+		if file != nil {
+			file.Close()
+		}
+	}()
+
+	var builder *samplebuilder.SampleBuilder
+	if depacketizer := newDepacketizer(codec.MimeType); depacketizer != nil {
+		builder = samplebuilder.New(incomingMaxLate, depacketizer, codec.ClockRate)
+	} else {
+		log.Printf("[%s] No depacketizer for %s, frames are not delivered", peerID, codec.MimeType)
+	}
+
+	// Files and decoders downstream need a keyframe to start from
+	if track.Kind() == webrtc.RTPCodecTypeVideo {
+		if err := peerConnection.WriteRTCP([]rtcp.Packet{&rtcp.PictureLossIndication{MediaSSRC: uint32(track.SSRC())}}); err != nil {
+			log.Printf("[%s] Failed to request a keyframe: %v", peerID, err)
+		}
+	}
+
+	for {
+		packet, _, err := track.ReadRTP()
+		if err != nil {
+			log.Printf("[%s] %s track %s ended: %v", peerID, kind, track.ID(), err)
+			return
+		}
+		metrics.Add("incoming.bytes."+kind, uint64(len(packet.Payload)))
+
+		if file != nil {
+			if err := file.WriteRTP(packet); err != nil {
+				log.Printf("[%s] Failed to save %s track, no longer saving it: %v", peerID, kind, err)
+				file.Close()
+				file = nil
+			}
+		}
+
+		if builder == nil {
+			continue
+		}
+		builder.Push(packet)
+		sink := w.incomingMediaSink()
+		for sample := builder.Pop(); sample != nil; sample = builder.Pop() {
+			metrics.Inc("incoming.frames." + kind)
+			if sink != nil {
+				sink(IncomingFrame{
+					PeerID:    peerID,
+					Kind:      kind,
+					Codec:     codec.MimeType,
+					Data:      sample.Data,
+					Timestamp: sample.PacketTimestamp,
+				})
+			}
+		}
+	}
+}
+
+// offerReceivesVideo reports whether an offer has a video section the peer
+// receives in. Peers that only send, such as WHIP encoders, are given no
+// video track: pion answers their sendonly section sendrecv when it has one.
+func offerReceivesVideo(offerSDP string) bool {
+	var offer sdp.SessionDescription
+	if err := offer.UnmarshalString(offerSDP); err != nil {
+		return true // pion reports the offer's error
+	}
+	for _, media := range offer.MediaDescriptions {
+		if media.MediaName.Media != "video" {
+			continue
+		}
+		_, sendOnly := media.Attribute("sendonly")
+		_, inactive := media.Attribute("inactive")
+		if !sendOnly && !inactive {
+			return true
+		}
+	}
+	return false
+}
+
+// newDepacketizer returns the depacketizer for a codec, nil if unsupported
+func newDepacketizer(mimeType string) rtp.Depacketizer {
+	switch {
+	case strings.EqualFold(mimeType, webrtc.MimeTypeH264):
+		return &codecs.H264Packet{}
+	case strings.EqualFold(mimeType, webrtc.MimeTypeVP8):
+		return &codecs.VP8Packet{}
+	case strings.EqualFold(mimeType, webrtc.MimeTypeVP9):
+		return &codecs.VP9Packet{}
+	case strings.EqualFold(mimeType, webrtc.MimeTypeOpus):
+		return &codecs.OpusPacket{}
+	}
+	return nil
+}
+
+// newTrackFile creates the file a track is saved to: Annex B for H.264,
+// IVF for VP8 and VP9, Ogg for Opus
+func newTrackFile(peerID string, kind string, codec webrtc.RTPCodecParameters) (rtpFileWriter, error) {
+	if err := os.MkdirAll(incomingMediaDir, 0755); err != nil {
+		return nil, err
+	}
+	name := filepath.Join(incomingMediaDir, fmt.Sprintf("%s-%s-%s", peerID, kind, time.Now().Format("20060102-150405")))
+	switch mimeType := codec.MimeType; {
+	case strings.EqualFold(mimeType, webrtc.MimeTypeH264):
+		return h264writer.New(name + ".h264")
+	case strings.EqualFold(mimeType, webrtc.MimeTypeVP8), strings.EqualFold(mimeType, webrtc.MimeTypeVP9):
+		return ivfwriter.New(name+".ivf", ivfwriter.WithCodec(mimeType))
+	case strings.EqualFold(mimeType, webrtc.MimeTypeOpus):
+		return oggwriter.New(name+".ogg", codec.ClockRate, codec.Channels)
+	}
+	return nil, fmt.Errorf("cannot save %s", codec.MimeType)
+}
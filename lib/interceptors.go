@@ -0,0 +1,152 @@
+package main
+
+import (
+	"strings"
+
+	"github.com/pion/interceptor"
+	"github.com/pion/interceptor/pkg/cc"
+	"github.com/pion/interceptor/pkg/gcc"
+	"github.com/pion/sdp/v3"
+	"github.com/pion/webrtc/v4"
+)
+
+// Interceptors: RTCP sender and receiver reports are always generated, the
+// peer stats need them. Lossy links want NACK, and RTX keeps the resent
+// packets out of the media stream's own loss and jitter figures; links where
+// a late frame is as bad as a lost one can do without both. TWCC feeds the
+// congestion control of adaptive bitrate, which falls back to the peers'
+// REMB estimates without it.
+
+// addInterceptors sets up the RTP interceptors in place of pion's defaults,
+// per nackEnabled, twccEnabled and adaptiveBitrateEnabled
+func addInterceptors(mediaEngine *webrtc.MediaEngine, registry *interceptor.Registry, onEstimator cc.NewPeerConnectionCallback) error {
+	if adaptiveBitrateEnabled {
+		if err := addCongestionControl(mediaEngine, registry, onEstimator); err != nil {
+			return err
+		}
+	}
+	if nackEnabled {
+		if err := webrtc.ConfigureNack(mediaEngine, registry); err != nil {
+			return err
+		}
+	}
+	if err := webrtc.ConfigureRTCPReports(registry); err != nil {
+		return err
+	}
+	if err := webrtc.ConfigureSimulcastExtensionHeaders(mediaEngine); err != nil {
+		return err
+	}
+	// TWCC feedback for the media operators send, see incoming_media.go
+	if twccEnabled {
+		return webrtc.ConfigureTWCCSender(mediaEngine, registry)
+	}
+	return nil
+}
+
+// addCongestionControl estimates each peer's bandwidth with Google Congestion
+// Control, from the transport-wide congestion control (TWCC) feedback of
+// peers that negotiate it, with twccEnabled. Peers that only send REMB are
+// handled in readRTCP. The stream is already paced by its frame clock, so
+// packets are not paced again.
+func addCongestionControl(mediaEngine *webrtc.MediaEngine, registry *interceptor.Registry, onEstimator cc.NewPeerConnectionCallback) error {
+	mediaEngine.RegisterFeedback(webrtc.RTCPFeedback{Type: webrtc.TypeRTCPFBGoogREMB}, webrtc.RTPCodecTypeVideo)
+	if !twccEnabled {
+		return nil
+	}
+
+	congestionController, err := cc.NewInterceptor(func() (cc.BandwidthEstimator, error) {
+		return gcc.NewSendSideBWE(
+			gcc.SendSideBWEInitialBitrate(qualityLadder[0].Bitrate),
+			gcc.SendSideBWEMinBitrate(abrMinBitrate),
+			gcc.SendSideBWEMaxBitrate(abrMaxBitrate),
+			gcc.SendSideBWEPacer(gcc.NewNoOpPacer()),
+		)
+	})
+	if err != nil {
+		return err
+	}
+	congestionController.OnNewPeerConnection(onEstimator)
+	registry.Add(congestionController)
+
+	return webrtc.ConfigureTWCCHeaderExtensionSender(mediaEngine, registry)
+}
+
+// answerWithoutNACK removes the generic NACK feedback pion's default codecs
+// carry from an answer, so peers do not ask for retransmissions that never
+// come. PLI, "nack pli", stays for keyframe requests.
+func answerWithoutNACK(answerSDP string) string {
+	lines := strings.SplitAfter(answerSDP, "\n")
+	kept := lines[:0]
+	for _, line := range lines {
+		// e.g. "a=rtcp-fb:96 nack"
+		if rest, ok := strings.CutPrefix(strings.TrimRight(line, "\r\n"), "a=rtcp-fb:"); ok {
+			if _, feedback, _ := strings.Cut(rest, " "); feedback == "nack" {
+				continue
+			}
+		}
+		kept = append(kept, line)
+	}
+	return strings.Join(kept, "")
+}
+
+// offerWithoutRTX removes the RTX payload types, and the RTX streams of
+// the peer's own media, from an offer, so that it is answered without RTX
+// and lost packets are resent in the media stream itself. pion's default
+// codecs always include RTX.
+func offerWithoutRTX(offerSDP string) string {
+	var offer sdp.SessionDescription
+	if err := offer.UnmarshalString(offerSDP); err != nil {
+		return offerSDP // pion reports the offer's error
+	}
+
+	for _, media := range offer.MediaDescriptions {
+		rtx := make(map[string]bool)
+		for _, attribute := range media.Attributes {
+			// e.g. "97 rtx/90000"
+			if attribute.Key == "rtpmap" {
+				payloadType, encoding, _ := strings.Cut(attribute.Value, " ")
+				if strings.HasPrefix(strings.ToLower(encoding), "rtx/") {
+					rtx[payloadType] = true
+				}
+			}
+		}
+		if len(rtx) == 0 {
+			continue
+		}
+
+		// e.g. "FID 1234 5678", the second SSRC being the RTX stream's
+		rtxSSRCs := make(map[string]bool)
+		for _, attribute := range media.Attributes {
+			if fields := strings.Fields(attribute.Value); attribute.Key == "ssrc-group" && len(fields) == 3 && fields[0] == "FID" {
+				rtxSSRCs[fields[2]] = true
+			}
+		}
+
+		var formats []string
+		for _, format := range media.MediaName.Formats {
+			if !rtx[format] {
+				formats = append(formats, format)
+			}
+		}
+		media.MediaName.Formats = formats
+
+		var attributes []sdp.Attribute
+		for _, attribute := range media.Attributes {
+			first, _, _ := strings.Cut(attribute.Value, " ")
+			switch {
+			case (attribute.Key == "rtpmap" || attribute.Key == "fmtp" || attribute.Key == "rtcp-fb") && rtx[first]:
+			case attribute.Key == "ssrc-group" && first == "FID":
+			case attribute.Key == "ssrc" && rtxSSRCs[first]:
+			default:
+				attributes = append(attributes, attribute)
+			}
+		}
+		media.Attributes = attributes
+	}
+
+	stripped, err := offer.Marshal()
+	if err != nil {
+		return offerSDP
+	}
+	return string(stripped)
+}
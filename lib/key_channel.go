@@ -0,0 +1,95 @@
+package main
+
+import (
+	"errors"
+	"log"
+	"sync"
+
+	"github.com/pion/webrtc/v4"
+)
+
+// Key channel: secrets meant for one peer, its resume token and the frame
+// key with e2eeEnabled (see e2ee.go), are not published on the broker,
+// where any client allowed to subscribe could read them. MQTT peers get
+// them on a negotiated data channel labelled "keys" with id keyChannelID,
+// inside the peer's own DTLS session, in the encoding the peer selected.
+// What is sent before the channel opens waits for it. Messages on the
+// channel are told apart by their schema.
+
+const keyChannelLabel = "keys"
+
+var errNoKeyChannel = errors.New("peer has no key channel")
+
+// keyChannel is a peer's key data channel
+type keyChannel struct {
+	channel  *webrtc.DataChannel
+	encoding string
+	open     bool
+	pending  []interface{} // sent once the channel opens
+	mu       sync.Mutex
+}
+
+// attachKeyChannel creates the negotiated key channel on peerConnection,
+// sending in encoding. Like the control channel, it only opens if the peer
+// creates the same channel.
+func (w *WebRTCManager) attachKeyChannel(peerID string, peerConnection *webrtc.PeerConnection, encoding string) (*keyChannel, error) {
+	negotiated := true
+	id := uint16(keyChannelID)
+	channel, err := peerConnection.CreateDataChannel(keyChannelLabel, &webrtc.DataChannelInit{
+		Negotiated: &negotiated,
+		ID:         &id,
+	})
+	if err != nil {
+		return nil, err
+	}
+	keys := &keyChannel{channel: channel, encoding: encoding}
+	channel.OnOpen(func() {
+		log.Printf("[%s] Key channel open", peerID)
+		keys.mu.Lock()
+		keys.open = true
+		pending := keys.pending
+		keys.pending = nil
+		keys.mu.Unlock()
+		for _, message := range pending {
+			if err := keys.write(message); err != nil {
+				log.Printf("[%s] Failed to send on the key channel: %v", peerID, err)
+			}
+		}
+	})
+	return keys, nil
+}
+
+// send sends message on the channel, or once it opens
+func (c *keyChannel) send(message interface{}) error {
+	c.mu.Lock()
+	if !c.open {
+		c.pending = append(c.pending, message)
+		c.mu.Unlock()
+		return nil
+	}
+	c.mu.Unlock()
+	return c.write(message)
+}
+
+// write sends message on the open channel, in its encoding
+func (c *keyChannel) write(message interface{}) error {
+	payload, err := marshalPayload(c.encoding, message)
+	if err != nil {
+		return err
+	}
+	if c.encoding == EncodingCBOR {
+		return c.channel.Send(payload)
+	}
+	return c.channel.SendText(string(payload))
+}
+
+// SendOnKeyChannel sends message to peerID on its key channel, once open
+func (w *WebRTCManager) SendOnKeyChannel(peerID string, message interface{}) error {
+	w.mu.Lock()
+	keys, ok := w.keyChannels[peerID]
+	w.mu.Unlock()
+	if !ok {
+		return errNoKeyChannel
+	}
+	return keys.send(message)
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"log"
+
+	"github.com/pion/interceptor"
+	"github.com/pion/rtcp"
+)
+
+// readRTCP drains RTCP with read (a sender's ReadRTCP, or ReadSimulcastRTCP
+// for one of its encodings) until the connection closes, turning Picture
+// Loss Indications and Full Intra Requests into keyframe requests for
+// streamer and passing REMB bandwidth estimates to onREMB. Reading also
+// lets the sender's interceptors see receiver reports and TWCC feedback.
+func readRTCP(peerID string, read func() ([]rtcp.Packet, interceptor.Attributes, error), streamer *VideoStreamer, onREMB func(bitrate float32)) {
+	for {
+		packets, _, err := read()
+		if err != nil {
+			return
+		}
+		for _, packet := range packets {
+			switch packet := packet.(type) {
+			case *rtcp.PictureLossIndication:
+				metrics.Inc("rtcp.pli_received")
+				streamer.RequestKeyframe(peerID, "PLI")
+			case *rtcp.FullIntraRequest:
+				metrics.Inc("rtcp.fir_received")
+				streamer.RequestKeyframe(peerID, "FIR")
+			case *rtcp.ReceiverEstimatedMaximumBitrate:
+				onREMB(packet.Bitrate)
+			}
+		}
+	}
+}
+
+// RequestKeyframe makes the stream continue from a keyframe as soon as the
+// source can, so a decoder that lost packets recovers without waiting for
+// the next GOP. Every peer shares the track, so one keyframe serves them
+// all: requests within keyframeMinInterval of the last one are coalesced.
+// The next IDR frame goes out with the parameter sets.
+func (v *VideoStreamer) RequestKeyframe(peerID string, reason string) {
+	v.mu.Lock()
+	now := v.clock.Now()
+	if !v.lastKeyframeRequest.IsZero() && now.Sub(v.lastKeyframeRequest) < keyframeMinInterval {
+		v.mu.Unlock()
+		metrics.Inc("video.keyframe_requests_coalesced")
+		return
+	}
+	v.parameterSetsPending = true
+	v.lastKeyframeRequest = now
+	source := v.source
+	v.mu.Unlock()
+
+	metrics.Inc("video.keyframe_requests")
+	log.Printf("[%s] %s received, sending keyframe", peerID, reason)
+	if source != nil {
+		source.ForceKeyframe()
+	}
+}
+
+// parameterSets returns the cached SPS and PPS length-prefixed, with v.mu
+// held
+func (v *VideoStreamer) parameterSets() []byte {
+	return lengthPrefixed(v.sps, v.pps)
+}
+
+// hasIDR reports whether a length-prefixed frame contains an IDR slice
+func hasIDR(data []byte) bool {
+	found := false
+	forEachNAL(data, func(nal []byte) {
+		if nal[0]&0x1F == NAL_IDR {
+			found = true
+		}
+	})
+	return found
+}
@@ -0,0 +1,19 @@
+//go:build latencycheck
+
+package main
+
+import "testing"
+
+// TestLatencyCheck is `make latency-check`: it fails when the video
+// pipeline's latency exceeds latencyBudget, see latency_rig_test.go
+func TestLatencyCheck(t *testing.T) {
+	result, err := RunLatencyRig(latencyRigFrames)
+	if err != nil {
+		t.Fatalf("Latency rig failed: %v", err)
+	}
+
+	t.Logf("Latency rig: %s (budget %s)", result, latencyBudget)
+	if !result.Passed(latencyBudget) {
+		t.Fatal("pipeline latency over budget")
+	}
+}
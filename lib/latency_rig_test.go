@@ -0,0 +1,247 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strconv"
+	"time"
+
+	"github.com/pion/rtp/codecs"
+	"github.com/pion/webrtc/v4"
+)
+
+// The latency rig streams synthetic frames through the real pipeline to an
+// in-process pion client on loopback, with the pipeline paced by a
+// VirtualClock. The clock only advances once per frame interval, after the
+// rig has waited for the frame due at that tick, so a frame that goes
+// straight through arrives with zero virtual latency and every frame of
+// buffering added to the hot path shows up as a whole frame interval. That
+// keeps the result independent of how fast the machine running it is.
+const (
+	// latencyRigFrames is how many frames the rig streams
+	latencyRigFrames = 90
+	// latencyBudget is the largest virtual latency allowed; less than one
+	// frame interval, so a single frame of added buffering fails
+	latencyBudget = 20 * time.Millisecond
+	// latencyRigTickWait is how long, in real time, the rig waits for each
+	// frame before advancing the clock anyway
+	latencyRigTickWait = 500 * time.Millisecond
+	// latencyRigSetupTimeout bounds connecting the client
+	latencyRigSetupTimeout = 10 * time.Second
+)
+
+// seiLatencyUUID identifies the rig's creation time SEI message. Its
+// payload is the frame's virtual creation time in Unix nanoseconds as
+// decimal ASCII, which never needs emulation prevention.
+var seiLatencyUUID = [16]byte{
+	0x72, 0x6d, 0x63, 0x73, 0x2d, 0x6c, 0x61, 0x74, // "rmcs-lat"
+	0x5e, 0x91, 0xc4, 0x27, 0xb8, 0x6a, 0x13, 0xf5,
+}
+
+// LatencyResult summarises a rig run
+type LatencyResult struct {
+	Frames  int
+	Missing int
+	Mean    time.Duration
+	Max     time.Duration
+}
+
+// Passed reports whether every frame arrived within budget
+func (r LatencyResult) Passed(budget time.Duration) bool {
+	return r.Missing == 0 && r.Max <= budget
+}
+
+func (r LatencyResult) String() string {
+	return fmt.Sprintf("%d frames, %d missing, mean %s, max %s", r.Frames, r.Missing, r.Mean, r.Max)
+}
+
+// writeSyntheticFrames writes length-prefixed frame files the streamer can
+// load. Frame i is read on tick i+1, so it carries that tick's time.
+func writeSyntheticFrames(dir string, frames int, start time.Time, interval time.Duration) error {
+	nal := func(frame *bytes.Buffer, unit []byte) {
+		binary.Write(frame, binary.BigEndian, uint32(len(unit)))
+		frame.Write(unit)
+	}
+
+	for i := 0; i < frames; i++ {
+		var frame bytes.Buffer
+		created := start.Add(time.Duration(i+1) * interval)
+		nal(&frame, buildUserDataSEI(seiLatencyUUID, []byte(strconv.FormatInt(created.UnixNano(), 10))))
+		if i == 0 {
+			nal(&frame, []byte{0x67, 0x42, 0xc0, 0x1f, 0xda, 0x01, 0x40, 0x16, 0xe8}) // SPS
+			nal(&frame, []byte{0x68, 0xce, 0x3c, 0x80})                               // PPS
+			nal(&frame, append([]byte{0x65}, bytes.Repeat([]byte{0x88}, 64)...))      // IDR slice
+		} else {
+			nal(&frame, append([]byte{0x41}, bytes.Repeat([]byte{0x9a}, 64)...)) // non-IDR slice
+		}
+
+		name := filepath.Join(dir, fmt.Sprintf("sample-%d.h264", i+1))
+		if err := os.WriteFile(name, frame.Bytes(), 0644); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// frameCreationTime finds the rig's SEI in an Annex B access unit fragment
+func frameCreationTime(data []byte) (time.Time, bool) {
+	i := bytes.Index(data, seiLatencyUUID[:])
+	if i < 0 {
+		return time.Time{}, false
+	}
+	digits := data[i+len(seiLatencyUUID):]
+	end := 0
+	for end < len(digits) && digits[end] >= '0' && digits[end] <= '9' {
+		end++
+	}
+	nanos, err := strconv.ParseInt(string(digits[:end]), 10, 64)
+	if err != nil {
+		return time.Time{}, false
+	}
+	return time.Unix(0, nanos), true
+}
+
+// loopbackAPI is the rig's client's, which connects to the backend over the
+// loopback interface
+func loopbackAPI() *webrtc.API {
+	settingEngine := webrtc.SettingEngine{}
+	settingEngine.SetIncludeLoopbackCandidate(true)
+	settingEngine.SetNetworkTypes([]webrtc.NetworkType{webrtc.NetworkTypeUDP4})
+	return webrtc.NewAPI(webrtc.WithSettingEngine(settingEngine))
+}
+
+// RunLatencyRig streams frames synthetic frames to a loopback client and
+// measures how long, in virtual time, each took to arrive
+func RunLatencyRig(frames int) (LatencyResult, error) {
+	result := LatencyResult{Frames: frames}
+
+	dir, err := os.MkdirTemp("", "rmcs-latency-")
+	if err != nil {
+		return result, err
+	}
+	defer os.RemoveAll(dir)
+
+	clock := NewVirtualClock(time.Unix(0, 0))
+	interval := time.Second / 30
+	if err := writeSyntheticFrames(dir, frames, clock.Now(), interval); err != nil {
+		return result, fmt.Errorf("failed to write frames: %v", err)
+	}
+
+	// The backend's connection is built as any peer's, interceptors and
+	// all, only offering loopback candidates as well
+	manager, err := newWebRTCManager(true)
+	if err != nil {
+		return result, err
+	}
+	defer manager.Close()
+	if err := manager.outputs[0].streamer.LoadH264Files(dir); err != nil {
+		return result, err
+	}
+	manager.outputs[0].streamer.SetClock(clock)
+
+	client, err := loopbackAPI().NewPeerConnection(webrtc.Configuration{})
+	if err != nil {
+		return result, err
+	}
+	defer client.Close()
+
+	if _, err := client.AddTransceiverFromKind(webrtc.RTPCodecTypeVideo, webrtc.RTPTransceiverInit{
+		Direction: webrtc.RTPTransceiverDirectionRecvonly,
+	}); err != nil {
+		return result, err
+	}
+
+	arrivals := make(chan time.Time, frames)
+	client.OnTrack(func(track *webrtc.TrackRemote, receiver *webrtc.RTPReceiver) {
+		var depacketizer codecs.H264Packet
+		for {
+			packet, _, err := track.ReadRTP()
+			if err != nil {
+				return
+			}
+			data, err := depacketizer.Unmarshal(packet.Payload)
+			if err != nil {
+				continue
+			}
+			if created, ok := frameCreationTime(data); ok {
+				arrivals <- created
+			}
+		}
+	})
+
+	// Non-trickle on both sides, the offer carries every candidate
+	offer, err := client.CreateOffer(nil)
+	if err != nil {
+		return result, err
+	}
+	gathered := webrtc.GatheringCompletePromise(client)
+	if err := client.SetLocalDescription(offer); err != nil {
+		return result, err
+	}
+	<-gathered
+
+	answerSDP, _, err := manager.ProcessOffer("latency-rig", client.LocalDescription().SDP, PeerCapabilities{Encoding: EncodingJSON}, nil)
+	if err != nil {
+		return result, fmt.Errorf("failed to answer: %v", err)
+	}
+	if err := client.SetRemoteDescription(webrtc.SessionDescription{Type: webrtc.SDPTypeAnswer, SDP: answerSDP}); err != nil {
+		return result, err
+	}
+
+	// Streaming starts once connected, waiting for its first frame's timer
+	// on the virtual clock
+	deadline := time.Now().Add(latencyRigSetupTimeout)
+	for clock.Timers() == 0 {
+		if time.Now().After(deadline) {
+			return result, fmt.Errorf("stream did not start within %s", latencyRigSetupTimeout)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	var total time.Duration
+	received := 0
+	record := func(created time.Time) {
+		latency := clock.Now().Sub(created)
+		total += latency
+		if latency > result.Max {
+			result.Max = latency
+		}
+		received++
+	}
+
+	// Twice as many ticks as frames, so buffered frames still come out and
+	// are counted late rather than missing
+	for tick := 1; tick <= 2*frames && received < frames; tick++ {
+		clock.Advance(interval)
+		due := clock.Now()
+
+		wait := time.NewTimer(latencyRigTickWait)
+	waitForFrame:
+		for {
+			select {
+			case created := <-arrivals:
+				record(created)
+				if !created.Before(due) {
+					break waitForFrame
+				}
+			case <-wait.C:
+				break waitForFrame
+			}
+		}
+		wait.Stop()
+
+		if tick > frames {
+			log.Printf("Latency rig: tick %d past the last frame, %d of %d received", tick, received, frames)
+		}
+	}
+
+	result.Missing = frames - received
+	if received > 0 {
+		result.Mean = total / time.Duration(received)
+	}
+	return result, nil
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"log"
+	"time"
+
+	"github.com/pion/webrtc/v4"
+)
+
+// Stream linger: when the last peer drops, the cameras, simulcast layers and
+// transcoders keep running for streamLinger before they are stopped, so a
+// peer that reconnects after a network blip finds them warm instead of
+// restarting the whole pipeline.
+//
+// lingerMu is taken after w.mu, never before it.
+
+// idleStreaming stops streaming now that no peer is connected, after
+// streamLinger unless a peer connects meanwhile
+func (w *WebRTCManager) idleStreaming() {
+	if streamLinger <= 0 {
+		log.Println("No peers connected, stopping video stream")
+		w.stopStreaming()
+		return
+	}
+
+	w.lingerMu.Lock()
+	defer w.lingerMu.Unlock()
+
+	if w.linger != nil {
+		return
+	}
+	log.Printf("No peers connected, stopping video stream in %v unless one connects", streamLinger)
+	var timer *time.Timer
+	timer = time.AfterFunc(streamLinger, func() {
+		connected := w.anyPeerConnected()
+
+		w.lingerMu.Lock()
+		defer w.lingerMu.Unlock()
+		if w.linger != timer {
+			return // a peer connected, see resumeStreaming
+		}
+		w.linger = nil
+		if connected {
+			return
+		}
+		log.Printf("No peer connected for %v, stopping video stream", streamLinger)
+		metrics.Inc("pipeline.linger_expired")
+		w.stopStreaming()
+	})
+	w.linger = timer
+}
+
+// cancelLinger stops a pending idleStreaming stop, with lingerMu held, and
+// reports whether there was one
+func (w *WebRTCManager) cancelLinger() bool {
+	if w.linger == nil {
+		return false
+	}
+	w.linger.Stop()
+	w.linger = nil
+	return true
+}
+
+// anyPeerConnected reports whether any peer's connection is connected
+func (w *WebRTCManager) anyPeerConnected() bool {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	for _, peerConnection := range w.peerConnections {
+		if peerConnection.ConnectionState() == webrtc.PeerConnectionStateConnected {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,172 @@
+package main
+
+import (
+	"io"
+	"log"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Log levels for streaming. The backend logs through the standard logger
+// without levels, so each line's level is inferred from its text.
+const (
+	LogLevelInfo  = "info"
+	LogLevelWarn  = "warn"
+	LogLevelError = "error"
+)
+
+var logLevelRank = map[string]int{
+	LogLevelInfo:  0,
+	LogLevelWarn:  1,
+	LogLevelError: 2,
+}
+
+// logLevel classifies a log line
+func logLevel(line string) string {
+	lower := strings.ToLower(line)
+	switch {
+	case strings.Contains(line, "[ERROR]"), strings.Contains(lower, "failed"), strings.Contains(lower, "error"):
+		return LogLevelError
+	case strings.Contains(lower, "timed out"), strings.Contains(lower, "rejected"),
+		strings.Contains(lower, "unknown"), strings.Contains(lower, "ignoring"),
+		strings.Contains(lower, "invalid"), strings.Contains(lower, "unavailable"):
+		return LogLevelWarn
+	default:
+		return LogLevelInfo
+	}
+}
+
+// LogStreamer sits between the standard logger and its output, keeping the
+// last logStreamBacklog lines and, while a stream is active, handing lines
+// at or above the requested level to a sink such as an MQTT topic
+type LogStreamer struct {
+	out     io.Writer
+	backlog []LogLine
+	next    int // backlog slot to overwrite once full
+	minRank int
+	lines   chan LogLine
+	stop    chan struct{}
+	done    chan struct{}
+	mu      sync.Mutex
+}
+
+// logStream is installed by RMCSInit when logStreamingEnabled is set
+var logStream *LogStreamer
+
+func NewLogStreamer(out io.Writer) *LogStreamer {
+	return &LogStreamer{
+		out:     out,
+		backlog: make([]LogLine, 0, logStreamBacklog),
+	}
+}
+
+// installLogStreamer routes the standard logger through a LogStreamer
+func installLogStreamer() {
+	if logStream == nil {
+		logStream = NewLogStreamer(log.Writer())
+		log.SetOutput(logStream)
+	}
+}
+
+// SetOutput replaces the writer the log is passed through to
+func (s *LogStreamer) SetOutput(out io.Writer) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.out = out
+}
+
+// Write implements io.Writer for the standard logger, which calls it once
+// per line
+func (s *LogStreamer) Write(p []byte) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	n, err := s.out.Write(p)
+
+	text := strings.TrimRight(string(p), "\n")
+	line := LogLine{Schema: LogLineSchema, Time: time.Now(), Level: logLevel(text), Message: text}
+	if len(s.backlog) < cap(s.backlog) {
+		s.backlog = append(s.backlog, line)
+	} else if len(s.backlog) > 0 {
+		s.backlog[s.next] = line
+		s.next = (s.next + 1) % len(s.backlog)
+	}
+
+	if s.lines != nil && logLevelRank[line.Level] >= s.minRank {
+		select {
+		case s.lines <- line:
+		default:
+			// Never block logging on a slow sink
+			metrics.Inc("logs.dropped")
+		}
+	}
+	return n, err
+}
+
+// recent returns the backlog, oldest first. Callers hold s.mu.
+func (s *LogStreamer) recent() []LogLine {
+	lines := make([]LogLine, 0, len(s.backlog))
+	lines = append(lines, s.backlog[s.next:]...)
+	return append(lines, s.backlog[:s.next]...)
+}
+
+// Start streams the backlog and then every new line at or above level to
+// sink, replacing any stream already running. sink runs on its own
+// goroutine and must not log, or every line would produce another.
+func (s *LogStreamer) Start(level string, sink func(LogLine) error) bool {
+	rank, ok := logLevelRank[level]
+	if !ok {
+		return false
+	}
+	s.Stop()
+
+	s.mu.Lock()
+	var backlog []LogLine
+	for _, line := range s.recent() {
+		if logLevelRank[line.Level] >= rank {
+			backlog = append(backlog, line)
+		}
+	}
+	lines := make(chan LogLine, logStreamQueueSize)
+	stop := make(chan struct{})
+	done := make(chan struct{})
+	s.minRank, s.lines, s.stop, s.done = rank, lines, stop, done
+	s.mu.Unlock()
+
+	go func() {
+		defer close(done)
+		send := func(line LogLine) {
+			if err := sink(line); err != nil {
+				metrics.Inc("logs.dropped")
+			} else {
+				metrics.Inc("logs.streamed")
+			}
+		}
+		for _, line := range backlog {
+			send(line)
+		}
+		for {
+			select {
+			case line := <-lines:
+				send(line)
+			case <-stop:
+				return
+			}
+		}
+	}()
+	return true
+}
+
+// Stop ends the active stream, if any
+func (s *LogStreamer) Stop() {
+	s.mu.Lock()
+	stop, done := s.stop, s.done
+	s.lines, s.stop, s.done = nil, nil, nil
+	s.mu.Unlock()
+
+	if stop != nil {
+		close(stop)
+		<-done
+	}
+}
@@ -0,0 +1,198 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+)
+
+// histogramBounds are the upper bounds of the latency buckets, the last
+// bucket catches everything slower
+var histogramBounds = []time.Duration{
+	1 * time.Millisecond,
+	5 * time.Millisecond,
+	10 * time.Millisecond,
+	50 * time.Millisecond,
+	100 * time.Millisecond,
+	500 * time.Millisecond,
+	1 * time.Second,
+	5 * time.Second,
+}
+
+// Histogram tracks a latency distribution in fixed buckets
+type Histogram struct {
+	counts []uint64
+	count  uint64
+	sum    time.Duration
+	max    time.Duration
+}
+
+func newHistogram() *Histogram {
+	return &Histogram{
+		counts: make([]uint64, len(histogramBounds)+1),
+	}
+}
+
+func (h *Histogram) observe(d time.Duration) {
+	i := sort.Search(len(histogramBounds), func(i int) bool { return d <= histogramBounds[i] })
+	h.counts[i]++
+	h.count++
+	h.sum += d
+	if d > h.max {
+		h.max = d
+	}
+}
+
+func (h *Histogram) snapshot() HistogramSnapshot {
+	snap := HistogramSnapshot{
+		Count:   h.count,
+		MaxMs:   durationMs(h.max),
+		Buckets: make(map[string]uint64, len(h.counts)),
+	}
+	if h.count > 0 {
+		snap.MeanMs = durationMs(h.sum) / float64(h.count)
+	}
+	for i, c := range h.counts {
+		key := "+Inf"
+		if i < len(histogramBounds) {
+			key = histogramBounds[i].String()
+		}
+		snap.Buckets[key] = c
+	}
+	return snap
+}
+
+func durationMs(d time.Duration) float64 {
+	return float64(d) / float64(time.Millisecond)
+}
+
+// Metrics is a registry of named counters, gauges and latency histograms
+type Metrics struct {
+	counters   map[string]uint64
+	gauges     map[string]int64
+	histograms map[string]*Histogram
+	mu         sync.Mutex
+}
+
+// metrics is the process-wide registry every subsystem reports into
+var metrics = NewMetrics()
+
+func NewMetrics() *Metrics {
+	return &Metrics{
+		counters:   make(map[string]uint64),
+		gauges:     make(map[string]int64),
+		histograms: make(map[string]*Histogram),
+	}
+}
+
+func (m *Metrics) Inc(name string) {
+	m.Add(name, 1)
+}
+
+func (m *Metrics) Add(name string, n uint64) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.counters[name] += n
+}
+
+// SetGauge records the current value of a level such as a queue depth
+func (m *Metrics) SetGauge(name string, value int64) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.gauges[name] = value
+}
+
+func (m *Metrics) Observe(name string, d time.Duration) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	h, ok := m.histograms[name]
+	if !ok {
+		h = newHistogram()
+		m.histograms[name] = h
+	}
+	h.observe(d)
+}
+
+func (m *Metrics) Snapshot() MetricsSnapshot {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	snap := MetricsSnapshot{
+		Schema:     MetricsSnapshotSchema,
+		Counters:   make(map[string]uint64, len(m.counters)),
+		Gauges:     make(map[string]int64, len(m.gauges)),
+		Histograms: make(map[string]HistogramSnapshot, len(m.histograms)),
+	}
+	for name, value := range m.counters {
+		snap.Counters[name] = value
+	}
+	for name, value := range m.gauges {
+		snap.Gauges[name] = value
+	}
+	for name, h := range m.histograms {
+		snap.Histograms[name] = h.snapshot()
+	}
+	return snap
+}
+
+func (m *Metrics) JSON() ([]byte, error) {
+	return json.Marshal(m.Snapshot())
+}
+
+// MetricsServer serves the metrics snapshot as JSON at /metrics, the
+// schemas of published messages at /schema and, with snapshotHTTPEnabled,
+// camera snapshots at /snapshot
+type MetricsServer struct {
+	addr    string
+	manager *WebRTCManager
+	server  *http.Server
+}
+
+func NewMetricsServer(addr string, manager *WebRTCManager) *MetricsServer {
+	return &MetricsServer{addr: addr, manager: manager}
+}
+
+func (s *MetricsServer) Start() error {
+	listener, err := net.Listen("tcp", s.addr)
+	if err != nil {
+		return fmt.Errorf("failed to listen on %s: %v", s.addr, err)
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/schema", handleSchema)
+	mux.HandleFunc("/schema/", handleSchema)
+	mux.HandleFunc("/metrics", func(w http.ResponseWriter, r *http.Request) {
+		payload, err := metrics.JSON()
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(payload)
+	})
+	if snapshotHTTPEnabled {
+		mux.HandleFunc("/snapshot", snapshotHandler(s.manager))
+	}
+	s.server = &http.Server{Handler: mux}
+
+	go func() {
+		if err := s.server.Serve(listener); err != nil && err != http.ErrServerClosed {
+			log.Printf("Metrics server stopped: %v", err)
+		}
+	}()
+
+	log.Printf("Metrics available at http://%s/metrics", listener.Addr())
+	return nil
+}
+
+func (s *MetricsServer) Close() {
+	if s.server != nil {
+		s.server.Close()
+	}
+}
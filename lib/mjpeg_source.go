@@ -0,0 +1,131 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// MJPEG cameras: a camera whose entry in cameraDirectories is
+// "mjpeg:<url>" is a legacy camera streaming MJPEG over HTTP
+// (multipart/x-mixed-replace). It is captured like a camera attached to the
+// host (see camera_capture.go): ffmpeg pulls the stream, scales it to the
+// entry's size and frame rate and transcodes it to H.264. Options go after
+// a '#', so the URL keeps its own query:
+//
+//	"mjpeg:http://10.0.0.7/video.cgi?resolution=640x480#fps=10&rotate=180"
+//
+// Peers that only need a low-rate inspection view can have the camera's
+// JPEGs sent to them as they are instead, on a data channel, see
+// mjpeg_view.go.
+
+// mjpegStream returns the capture an "mjpeg:<url>" camera entry configures.
+// ok is false for other entries.
+func mjpegStream(address string) (config captureConfig, ok bool) {
+	stream, ok := strings.CutPrefix(address, "mjpeg:")
+	if !ok {
+		return captureConfig{}, false
+	}
+	stream, options, _ := strings.Cut(stream, "#")
+	config = captureConfig{
+		device:  stream,
+		width:   mjpegWidth,
+		height:  mjpegHeight,
+		fps:     mjpegFPS,
+		bitrate: mjpegBitrate,
+		profile: captureProfile,
+		mjpeg:   true,
+	}
+	values, _ := url.ParseQuery(options)
+	config.orientation = orientationOptions(values)
+	return captureOptions(config, values), true
+}
+
+// mjpegInputArgs returns the ffmpeg arguments pulling config's stream. The
+// parts carry no timestamps, so frames are timed as they arrive.
+func mjpegInputArgs(config captureConfig) []string {
+	return []string{
+		"-use_wallclock_as_timestamps", "1",
+		"-reconnect", "1", "-reconnect_streamed", "1", "-reconnect_delay_max", "2",
+		"-f", "mpjpeg", "-i", config.device,
+	}
+}
+
+// mjpegFilters return the ffmpeg filters bringing config's stream to its
+// size and frame rate; the camera sends whatever it is set to
+func mjpegFilters(config captureConfig) []string {
+	return []string{
+		fmt.Sprintf("scale=%d:%d", config.width, config.height),
+		fmt.Sprintf("fps=%d", config.fps),
+	}
+}
+
+// pullMJPEG reads the MJPEG stream at address, calling fn with each JPEG
+// until fn returns false, ctx is cancelled or the stream fails. The JPEG is
+// only valid during the call. Parts larger than maxFrame are skipped.
+func pullMJPEG(ctx context.Context, address string, maxFrame int, fn func(jpeg []byte) bool) error {
+	request, err := http.NewRequestWithContext(ctx, http.MethodGet, address, nil)
+	if err != nil {
+		return err
+	}
+	response, err := http.DefaultClient.Do(request)
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+	if response.StatusCode != http.StatusOK {
+		return fmt.Errorf("MJPEG stream %s: %s", address, response.Status)
+	}
+	mediaType, params, err := mime.ParseMediaType(response.Header.Get("Content-Type"))
+	if err != nil || !strings.HasPrefix(mediaType, "multipart/") || params["boundary"] == "" {
+		return fmt.Errorf("MJPEG stream %s is not multipart: %q", address, response.Header.Get("Content-Type"))
+	}
+
+	parts := multipart.NewReader(response.Body, params["boundary"])
+	var frame []byte
+	for {
+		part, err := parts.NextPart()
+		if err != nil {
+			return err
+		}
+		frame, err = readPart(frame[:0], part, maxFrame)
+		if err == errPartTooLarge {
+			metrics.Inc("mjpeg.frames_oversized")
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		if !fn(frame) {
+			return nil
+		}
+	}
+}
+
+var errPartTooLarge = errors.New("MJPEG part too large")
+
+// readPart appends part to buffer, up to max bytes
+func readPart(buffer []byte, part io.Reader, max int) ([]byte, error) {
+	for {
+		if len(buffer) == cap(buffer) {
+			buffer = append(buffer, 0)[:len(buffer)]
+		}
+		n, err := part.Read(buffer[len(buffer):cap(buffer)])
+		buffer = buffer[:len(buffer)+n]
+		if len(buffer) > max {
+			return buffer, errPartTooLarge
+		}
+		if err == io.EOF {
+			return buffer, nil
+		}
+		if err != nil {
+			return buffer, err
+		}
+	}
+}
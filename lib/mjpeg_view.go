@@ -0,0 +1,171 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"sync/atomic"
+	"time"
+
+	"github.com/pion/webrtc/v4"
+)
+
+// JPEG views: a peer sends jpeg-view on the control channel to have an
+// MJPEG camera's JPEGs sent as they are, one binary message each, on a data
+// channel the backend opens labelled "jpeg:<camera>". Nothing is decoded or
+// encoded, which suits low-rate inspection views of cameras that only speak
+// MJPEG. The channel is unordered without retransmissions: a lost frame is
+// not worth waiting for, the next one replaces it. A peer asking for a view
+// is how it tells the backend it can show one.
+
+// ControlJPEGView starts, changes or stops a peer's JPEG view
+const ControlJPEGView = "jpeg-view"
+
+// JPEGView is the payload of jpeg-view, e.g. {"camera": 3, "fps": 2}. FPS
+// is capped at mjpegViewMaxFPS; 0 stops the view.
+type JPEGView struct {
+	Camera int     `json:"camera"`
+	FPS    float64 `json:"fps"`
+}
+
+// jpegViewKey names a peer's view of a camera
+type jpegViewKey struct {
+	peerID string
+	camera int
+}
+
+// jpegView is a running JPEG view
+type jpegView struct {
+	channel  *webrtc.DataChannel
+	interval atomic.Int64 // between frames sent, in nanoseconds
+	cancel   context.CancelFunc
+}
+
+// jpegViewControl handles jpeg-view from the control channel
+func jpegViewControl(manager *WebRTCManager) ControlHandler {
+	return ControlHandlerFunc(func(peerID string, payload json.RawMessage) error {
+		var view JPEGView
+		if err := json.Unmarshal(payload, &view); err != nil {
+			return fmt.Errorf("invalid jpeg-view: %v", err)
+		}
+		return manager.SetJPEGView(peerID, view)
+	})
+}
+
+// SetJPEGView starts sending peerID the JPEGs of view's camera, changes the
+// frame rate of its view, or stops it
+func (w *WebRTCManager) SetJPEGView(peerID string, view JPEGView) error {
+	if view.FPS < 0 {
+		return fmt.Errorf("invalid frame rate %g", view.FPS)
+	}
+	var config captureConfig
+	address, ok := cameraAddress(view.Camera)
+	if ok {
+		config, ok = mjpegStream(address)
+	}
+	if _, registered := w.sources.factory(view.Camera); registered || !ok {
+		return fmt.Errorf("camera %d is not an MJPEG camera", view.Camera)
+	}
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	key := jpegViewKey{peerID, view.Camera}
+	existing := w.jpegViews[key]
+	if view.FPS == 0 {
+		if existing != nil {
+			delete(w.jpegViews, key)
+			existing.stop()
+		}
+		return nil
+	}
+	interval := time.Duration(float64(time.Second) / min(view.FPS, mjpegViewMaxFPS))
+	if existing != nil {
+		existing.interval.Store(int64(interval))
+		return nil
+	}
+
+	peerConnection, ok := w.peerConnections[peerID]
+	if !ok {
+		return fmt.Errorf("unknown peer %s", peerID)
+	}
+	ordered := false
+	retransmits := uint16(0)
+	channel, err := peerConnection.CreateDataChannel(fmt.Sprintf("jpeg:%d", view.Camera), &webrtc.DataChannelInit{
+		Ordered:        &ordered,
+		MaxRetransmits: &retransmits,
+	})
+	if err != nil {
+		return fmt.Errorf("failed to open JPEG view channel: %v", err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	running := &jpegView{channel: channel, cancel: cancel}
+	running.interval.Store(int64(interval))
+	w.jpegViews[key] = running
+
+	channel.OnOpen(func() {
+		log.Printf("[%s] JPEG view of camera %d open", peerID, view.Camera)
+		go running.run(ctx, config.device)
+	})
+	channel.OnClose(func() {
+		w.mu.Lock()
+		if w.jpegViews[key] == running {
+			delete(w.jpegViews, key)
+		}
+		w.mu.Unlock()
+		running.cancel()
+	})
+	metrics.Inc("mjpeg.views_started")
+	return nil
+}
+
+// stopJPEGViews stops the JPEG views of peerID, with w.mu held
+func (w *WebRTCManager) stopJPEGViews(peerID string) {
+	for key, view := range w.jpegViews {
+		if key.peerID == peerID {
+			delete(w.jpegViews, key)
+			view.stop()
+		}
+	}
+}
+
+func (v *jpegView) stop() {
+	v.cancel()
+	v.channel.Close()
+}
+
+// run sends the JPEGs of the stream at address until the view stops,
+// pulling the stream again captureRestartDelay after it fails
+func (v *jpegView) run(ctx context.Context, address string) {
+	var last time.Time
+	for {
+		err := pullMJPEG(ctx, address, mjpegViewMaxFrame, func(jpeg []byte) bool {
+			now := time.Now()
+			if now.Sub(last) < time.Duration(v.interval.Load()) {
+				return true
+			}
+			if v.channel.BufferedAmount() > mjpegViewMaxBuffered {
+				metrics.Inc("mjpeg.view_frames_skipped")
+				return true
+			}
+			if err := v.channel.Send(jpeg); err != nil {
+				return false
+			}
+			last = now
+			metrics.Inc("mjpeg.view_frames")
+			return true
+		})
+		if ctx.Err() != nil {
+			return
+		}
+		if err != nil {
+			log.Printf("JPEG view of %s: %v", address, err)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(captureRestartDelay):
+		}
+	}
+}
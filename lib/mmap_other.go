@@ -0,0 +1,17 @@
+//go:build !unix
+
+package main
+
+import "os"
+
+// mapFile reads the file at path: without mmap, "mmap" preloads the
+// frame files like "preload"
+func mapFile(path string, size int64) ([]byte, error) {
+	return os.ReadFile(path)
+}
+
+// unmapFile releases data read by mapFile, which the garbage collector
+// does
+func unmapFile(data []byte) error {
+	return nil
+}
@@ -2,9 +2,13 @@ package main
 
 import (
 	"encoding/json"
+	"errors"
 	"fmt"
 	"log"
+	"os"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	mqtt "github.com/eclipse/paho.mqtt.golang"
@@ -12,256 +16,687 @@ import (
 )
 
 type MQTTClient struct {
-	client        mqtt.Client
-	webrtcManager *WebRTCManager
+	client         mqtt.Client
+	webrtcManager  *WebRTCManager
+	signaler       *Signaler
 	currentPeerIDs map[string]bool
-	mu            sync.Mutex
+	// peerCapabilities holds what each peer announced before its offer
+	peerCapabilities map[string]PeerCapabilities
+	// integrityReports holds the last frame checksum report from each peer
+	integrityReports map[string]IntegrityReport
+	recorder         *Recorder
+	scenarios        *ScenarioRunner
+	subscriptions    *SubscriptionRegistry
+	stopPeerStats    chan struct{} // see StartPeerStats
+	stopPipeline     chan struct{} // see StartPipelineStats
+	stopDiscovery    chan struct{} // see StartROSDiscovery
+	peerQueues       peerQueues
+	retained         retainedQueue
+	// inflight counts publishes not yet completed, so shutdown can flush them
+	inflight atomic.Int64
+	mu       sync.Mutex
 }
 
-func NewMQTTClient(webrtcManager *WebRTCManager) *MQTTClient {
-	return &MQTTClient{
-		webrtcManager:  webrtcManager,
-		currentPeerIDs: make(map[string]bool),
+// errTokenTimeout means the broker did not complete a request in time
+var errTokenTimeout = errors.New("timed out waiting for MQTT broker")
+
+// errNotConnected means there is no MQTT connection to publish on
+var errNotConnected = errors.New("not connected to MQTT broker")
+
+// mqttRoute binds a subscription filter to the handler for messages on it
+type mqttRoute struct {
+	filter  string
+	name    string
+	shared  bool // load-balanced across instances when sharedSubscriptionGroup is set
+	qos     byte // 1 for what must not be lost, such as the e-stop
+	handler func(topic string, payload []byte)
+}
+
+// subscriptionFilter returns the filter to subscribe with, adding the shared
+// subscription prefix for routes that only one instance should handle
+func (r mqttRoute) subscriptionFilter() string {
+	if r.shared && sharedSubscriptionGroup != "" {
+		return fmt.Sprintf("$share/%s/%s", sharedSubscriptionGroup, r.filter)
+	}
+	return r.filter
+}
+
+// mqttClientID returns the client ID to connect with. Redundant instances
+// sharing a subscription group must not share a client ID, or the broker
+// would keep disconnecting one in favour of the other.
+func mqttClientID() string {
+	if sharedSubscriptionGroup == "" {
+		return identity.ClientID
+	}
+	hostname, err := os.Hostname()
+	if err != nil {
+		hostname = "unknown"
+	}
+	return fmt.Sprintf("%s-%s-%d", identity.ClientID, hostname, os.Getpid())
+}
+
+func NewMQTTClient(webrtcManager *WebRTCManager, signaler *Signaler) *MQTTClient {
+	m := &MQTTClient{
+		webrtcManager:    webrtcManager,
+		signaler:         signaler,
+		currentPeerIDs:   make(map[string]bool),
+		peerCapabilities: make(map[string]PeerCapabilities),
+		integrityReports: make(map[string]IntegrityReport),
+	}
+	m.scenarios = NewScenarioRunner(m)
+	m.subscriptions = NewSubscriptionRegistry()
+	for _, route := range m.routes() {
+		route := route
+		m.subscriptions.Add(route.name, route.subscriptionFilter(), route.qos, func(client mqtt.Client, msg mqtt.Message) {
+			m.recordMessage(msg.Topic(), msg.Payload())
+			m.handleMessage(route, msg.Topic(), msg.Payload())
+		})
+	}
+	// Publishing blocks on the broker, keep it off the stream loop
+	webrtcManager.CameraHealth().SetOnChange(func(list CameraList) {
+		m.retain(deviceTopic("cameras"), func() { m.publishCameras(list) })
+	})
+	webrtcManager.Events().OnCameraSwitched(func(event CameraEvent) {
+		m.retain(deviceTopic("camera/active/"+event.TrackID), func() { m.publishActiveCamera(event) })
+	})
+	webrtcManager.Events().OnSourceError(func(event SourceErrorEvent) {
+		go m.publishSourceError(event)
+	})
+	webrtcManager.Events().OnGovernorChanged(func(event GovernorEvent) {
+		m.retain(deviceTopic("governor"), func() { m.publishGovernor(event) })
+	})
+	webrtcManager.SetTelemetryFallback(m.publishTelemetry)
+	webrtcManager.SetGPSSink(m.publishGPS)
+	webrtcManager.SetCameraInfoSink(m.publishCameraInfo)
+	// The list is taken when it is published, the latest by then
+	webrtcManager.Events().OnPeerConnected(func(PeerEvent) {
+		m.retain(deviceTopic("peers"), func() { m.publishPeers(webrtcManager.Peers()) })
+	})
+	webrtcManager.Events().OnPeerDisconnected(func(PeerEvent) {
+		m.retain(deviceTopic("peers"), func() { m.publishPeers(webrtcManager.Peers()) })
+	})
+	return m
+}
+
+// routes returns every topic the backend listens on, in subscription order
+func (m *MQTTClient) routes() []mqttRoute {
+	return []mqttRoute{
+		{filter: deviceTopic("camera"), name: "camera", handler: m.handleCamera},
+		{filter: deviceTopic("camera-group"), name: "camera-group", handler: m.handleCameraGroup},
+		{filter: deviceTopic(ControlSetBitrate), name: ControlSetBitrate, handler: m.handleCaptureSettings(ControlSetBitrate)},
+		{filter: deviceTopic(ControlSetResolution), name: ControlSetResolution, handler: m.handleCaptureSettings(ControlSetResolution)},
+		{filter: deviceTopic(ControlSetProfile), name: ControlSetProfile, handler: m.handleCaptureSettings(ControlSetProfile)},
+		{filter: deviceTopic(ControlSetThermalRange), name: ControlSetThermalRange, handler: m.handleThermalRange},
+		{filter: deviceTopic("snapshot"), name: "snapshot", handler: m.handleSnapshot},
+		{filter: deviceTopic("scenario"), name: "scenario", handler: m.handleScenario},
+		{filter: deviceTopic("admin"), name: "admin", handler: m.handleAdmin},
+		{filter: deviceTopic(ControlDrive), name: ControlDrive, handler: m.handleDrive},
+		{filter: deviceTopic(ControlEStop), name: ControlEStop, qos: 1, handler: m.handleEStop},
+		{filter: deviceTopic(ControlROSService), name: ControlROSService, handler: m.handleROSService},
+		{filter: peerTopicFilter("disconnect-client"), name: "disconnect-client", handler: m.handleDisconnectClient},
+		{filter: peerTopicFilter("capabilities"), name: "capabilities", handler: m.handleCapabilities},
+		{filter: peerTopicFilter("offer"), name: "offer", shared: true, handler: m.handleOffer},
+		{filter: peerTopicFilter("candidate/robot"), name: "candidate/robot", handler: m.handleRobotCandidate},
+		{filter: peerTopicFilter("keepalive"), name: "keepalive", handler: m.handleKeepalive},
+		{filter: peerTopicFilter("integrity"), name: "integrity", handler: m.handleIntegrityReport},
 	}
 }
 
 func (m *MQTTClient) Connect() error {
 	mqtt.ERROR = log.New(log.Writer(), "[ERROR] ", 0)
 
+	profile := activeMQTTProfile()
+	dialer, err := mqttDialer(profile)
+	if err != nil {
+		return fmt.Errorf("failed to set up MQTT network: %v", err)
+	}
+
 	opts := mqtt.NewClientOptions()
-	opts.AddBroker(fmt.Sprintf("tcp://%s:%d", broker, port))
-	opts.SetClientID(clientID)
-	opts.SetUsername(username)
-	opts.SetPassword(password)
-	opts.SetKeepAlive(60 * time.Second)
-	opts.SetPingTimeout(10 * time.Second)
+	opts.AddBroker(fmt.Sprintf("tcp://%s:%d", identity.Broker, identity.Port))
+	opts.SetDialer(dialer)
+	opts.SetClientID(mqttClientID())
+	opts.SetUsername(identity.Username)
+	opts.SetPassword(identity.Password)
+	opts.SetKeepAlive(profile.KeepAlive)
+	opts.SetPingTimeout(profile.PingTimeout)
 	opts.SetAutoReconnect(true)
-	opts.SetCleanSession(true)
+	opts.SetMaxReconnectInterval(profile.MaxReconnectInterval)
+	opts.SetCleanSession(profile.CleanSession)
 
 	opts.SetOnConnectHandler(func(client mqtt.Client) {
 		log.Println("Connected to MQTT Broker successfully!")
+		metrics.Inc("mqtt.connects")
+		restoreStart := time.Now()
 
-		// Subscribe to camera topic to handle camera switching
-		cameraTopic := fmt.Sprintf("%s/camera", thingName)
-		cameraToken := client.Subscribe(cameraTopic, 0, func(client mqtt.Client, msg mqtt.Message) {
-			log.Printf("Camera switch request received on topic %s: %s", msg.Topic(), string(msg.Payload()))
-
-			// Parse camera number from message
-			var cameraNumber int
-			_, err := fmt.Sscanf(string(msg.Payload()), "%d", &cameraNumber)
-			if err != nil {
-				log.Printf("Failed to parse camera number from message: %v", err)
-				return
-			}
-
-			log.Printf("Parsed camera number: %d", cameraNumber)
-
-			// Switch to requested camera
-			if err := m.webrtcManager.SwitchCamera(cameraNumber); err != nil {
-				log.Printf("Failed to switch camera: %v", err)
-			} else {
-				log.Printf("Successfully switched to camera %d", cameraNumber)
-			}
-		})
+		m.subscriptions.Restore(client)
+		list := m.webrtcManager.CameraHealth().List()
+		m.retain(deviceTopic("cameras"), func() { m.publishCameras(list) })
 
-		if cameraToken.Wait() && cameraToken.Error() != nil {
-			log.Printf("Failed to subscribe to %s: %v", cameraTopic, cameraToken.Error())
-		} else {
-			log.Printf("Subscribed to camera topic: %s", cameraTopic)
-		}
+		// Time from (re)connect until every subscription is back in place;
+		// messages sent in this window are lost with a clean session
+		metrics.Observe("mqtt.subscription_restore", time.Since(restoreStart))
+	})
 
-		// Subscribe to disconnect-client topic
-		disconnectTopic := fmt.Sprintf("%s/+/disconnect-client", baseTopic)
-		disconnectToken := client.Subscribe(disconnectTopic, 0, func(client mqtt.Client, msg mqtt.Message) {
-			log.Printf("Disconnect request received on topic %s", msg.Topic())
-
-			// Extract peer ID from topic
-			topicStr := string(msg.Topic())
-			baseLen := len(baseTopic) + 1
-			if len(topicStr) > baseLen {
-				remainingTopic := topicStr[baseLen:]
-				for i, ch := range remainingTopic {
-					if ch == '/' {
-						peerID := remainingTopic[:i]
-						log.Printf("Disconnecting peer: %s", peerID)
-
-						// Disconnect the peer
-						if err := m.webrtcManager.DisconnectPeer(peerID); err != nil {
-							log.Printf("Failed to disconnect peer %s: %v", peerID, err)
-						}
-
-						// Remove from tracked peers
-						m.mu.Lock()
-						delete(m.currentPeerIDs, peerID)
-						m.mu.Unlock()
-						break
-					}
-				}
-			}
-		})
+	opts.SetConnectionLostHandler(func(client mqtt.Client, err error) {
+		log.Printf("Connection lost: %v", err)
+		metrics.Inc("mqtt.connection_lost")
+		m.subscriptions.ConnectionLost()
+	})
 
-		if disconnectToken.Wait() && disconnectToken.Error() != nil {
-			log.Printf("Failed to subscribe to %s: %v", disconnectTopic, disconnectToken.Error())
-		} else {
-			log.Printf("Subscribed to disconnect topic: %s", disconnectTopic)
-		}
+	opts.SetReconnectingHandler(func(client mqtt.Client, opts *mqtt.ClientOptions) {
+		log.Println("Attempting to reconnect...")
+		metrics.Inc("mqtt.reconnects")
+	})
 
-		// Subscribe to offer topic to receive offers from frontend
-		offerTopic := fmt.Sprintf("%s/+/offer", baseTopic)
-		token := client.Subscribe(offerTopic, 0, func(client mqtt.Client, msg mqtt.Message) {
-			log.Printf("Offer received on topic %s", msg.Topic())
-
-			// Extract peer ID from topic
-			topicStr := string(msg.Topic())
-			// Parse topic to get peer ID: baseTopic/peerId/offer
-			baseLen := len(baseTopic) + 1 // +1 for the /
-			if len(topicStr) > baseLen {
-				remainingTopic := topicStr[baseLen:]
-				// Find the next /
-				for i, ch := range remainingTopic {
-					if ch == '/' {
-						peerID := remainingTopic[:i]
-						log.Printf("Extracted peer ID: %s", peerID)
-
-						// Track this peer
-						m.mu.Lock()
-						m.currentPeerIDs[peerID] = true
-						m.mu.Unlock()
-
-			// The offer is sent as plain SDP string from Flutter
-			offerSDP := string(msg.Payload())
-
-						// Process the offer and create an answer using real WebRTC
-						answerSDP, err := m.webrtcManager.ProcessOffer(peerID, offerSDP)
-						if err != nil {
-							log.Printf("Failed to process offer: %v", err)
-							return
-						}
-
-						// Setup ICE candidate handler for this peer
-						m.webrtcManager.SetupICECandidateHandler(peerID, func(candidate *webrtc.ICECandidate) {
-							if candidate == nil {
-								return
-							}
-
-							// Convert to JSON array format (Flutter expects array)
-							candidateJSON := []map[string]interface{}{
-								{
-									"candidate":     candidate.ToJSON().Candidate,
-									"sdpMid":        candidate.ToJSON().SDPMid,
-									"sdpMLineIndex": candidate.ToJSON().SDPMLineIndex,
-								},
-							}
-
-							payload, err := json.Marshal(candidateJSON)
-							if err != nil {
-								log.Printf("Failed to marshal ICE candidate: %v", err)
-								return
-							}
-
-							// Send to frontend via rmcs candidate topic
-							topic := fmt.Sprintf("%s/%s/candidate/rmcs", baseTopic, peerID)
-							token := client.Publish(topic, 0, false, payload)
-							if token.Wait() && token.Error() != nil {
-								log.Printf("Failed to send ICE candidate: %v", token.Error())
-							} else {
-								log.Printf("Sent ICE candidate to frontend on topic: %s", topic)
-							}
-						})
-
-						// Send the answer as plain SDP string (Flutter expects plain string)
-						answerTopic := fmt.Sprintf("%s/%s/answer", baseTopic, peerID)
-						token := client.Publish(answerTopic, 0, false, []byte(answerSDP))
-						if token.Wait() && token.Error() != nil {
-							log.Printf("Failed to send answer: %v", token.Error())
-						}
-						break
-					}
-				}
-			}
-		})
+	m.client = mqtt.NewClient(opts)
 
-		// Subscribe to robot ICE candidate topic
-		robotCandidateTopic := fmt.Sprintf("%s/+/candidate/robot", baseTopic)
-		iceToken := client.Subscribe(robotCandidateTopic, 0, func(client mqtt.Client, msg mqtt.Message) {
-			// Flutter sends ICE candidates as JSON array
-			var iceCandidates []ICECandidateMessage
-			if err := json.Unmarshal(msg.Payload(), &iceCandidates); err != nil {
-				log.Printf("Failed to parse ICE candidates: %v", err)
-				return
-			}
-
-			// Extract peer ID from topic
-			topicStr := string(msg.Topic())
-			baseLen := len(baseTopic) + 1
-			if len(topicStr) > baseLen {
-				remainingTopic := topicStr[baseLen:]
-				for i, ch := range remainingTopic {
-					if ch == '/' {
-						peerID := remainingTopic[:i]
-						// Add each ICE candidate
-						for _, iceMsg := range iceCandidates {
-							if err := m.webrtcManager.AddICECandidate(peerID, iceMsg); err != nil {
-								log.Printf("Failed to add ICE candidate: %v", err)
-							}
-						}
-						break
-					}
-				}
-			}
-		})
+	log.Printf("Connecting to MQTT broker at %s:%d (%s profile, keepalive %s)...",
+		identity.Broker, identity.Port, mqttNetworkProfile, profile.KeepAlive)
 
-		if token.Wait() && token.Error() != nil {
-			log.Printf("Failed to subscribe to %s: %v", offerTopic, token.Error())
-		} else {
-			log.Printf("Subscribed to topic: %s", offerTopic)
+	if token := m.client.Connect(); token.Wait() && token.Error() != nil {
+		return fmt.Errorf("failed to connect to MQTT broker: %v", token.Error())
+	}
+
+	return nil
+}
+
+// waitToken waits up to mqttTokenTimeout for the broker to complete token,
+// recording how long the caller was blocked
+func waitToken(token mqtt.Token) error {
+	start := time.Now()
+	completed := token.WaitTimeout(mqttTokenTimeout)
+	metrics.Observe("mqtt.token_wait", time.Since(start))
+
+	if !completed {
+		return errTokenTimeout
+	}
+	return token.Error()
+}
+
+// topicMatches reports whether topic matches an MQTT subscription filter
+func topicMatches(filter, topic string) bool {
+	filterLevels := strings.Split(filter, "/")
+	topicLevels := strings.Split(topic, "/")
+
+	for i, level := range filterLevels {
+		if level == "#" {
+			return true
 		}
+		if i >= len(topicLevels) {
+			return false
+		}
+		if level != "+" && level != topicLevels[i] {
+			return false
+		}
+	}
+	return len(filterLevels) == len(topicLevels)
+}
 
-		if iceToken.Wait() && iceToken.Error() != nil {
-			log.Printf("Failed to subscribe to %s: %v", robotCandidateTopic, iceToken.Error())
-		} else {
-			log.Printf("Subscribed to topic: %s", robotCandidateTopic)
+// dispatch routes a message to its handler as if it had arrived from the broker
+func (m *MQTTClient) dispatch(topic string, payload []byte) {
+	for _, route := range m.routes() {
+		if topicMatches(route.filter, topic) {
+			m.handleMessage(route, topic, payload)
+			return
 		}
+	}
+	log.Printf("No handler for topic %s", topic)
+}
+
+// handleMessage runs route's handler, counting the message and timing the handler
+func (m *MQTTClient) handleMessage(route mqttRoute, topic string, payload []byte) {
+	// Zero-length payloads only clear retained messages, see clearRetained
+	if len(payload) == 0 {
+		return
+	}
+
+	metrics.Inc("mqtt.received." + route.name)
+	metrics.Add("mqtt.received_bytes."+route.name, uint64(len(payload)))
+
+	start := time.Now()
+	route.handler(topic, payload)
+	metrics.Observe("mqtt.handler."+route.name, time.Since(start))
+}
+
+// publishCameras retains the camera availability list on <thingName>/cameras,
+// so clients see the current state as soon as they subscribe
+func (m *MQTTClient) publishCameras(list CameraList) {
+	payload, err := json.Marshal(list)
+	if err != nil {
+		log.Printf("Failed to marshal camera list: %v", err)
+		return
+	}
+	if err := m.publishMessage(deviceTopic("cameras"), true, payload); err != nil {
+		log.Printf("Failed to publish camera list: %v", err)
+	}
+}
+
+// publishActiveCamera retains the camera a track switched to on
+// <thingName>/camera/active/<trackId>
+func (m *MQTTClient) publishActiveCamera(event CameraEvent) {
+	payload, err := json.Marshal(ActiveCamera{
+		Schema:  ActiveCameraSchema,
+		TrackID: event.TrackID,
+		Camera:  event.Camera,
+		Group:   event.Group,
+		Time:    time.Now().UTC(),
 	})
+	if err != nil {
+		log.Printf("Failed to marshal active camera: %v", err)
+		return
+	}
+	if err := m.publishMessage(deviceTopic("camera/active/"+event.TrackID), true, payload); err != nil {
+		log.Printf("Failed to publish active camera: %v", err)
+	}
+}
 
-	opts.SetConnectionLostHandler(func(client mqtt.Client, err error) {
-		log.Printf("Connection lost: %v", err)
+// publishSourceError reports a camera failing on <thingName>/source-error
+func (m *MQTTClient) publishSourceError(event SourceErrorEvent) {
+	payload, err := json.Marshal(SourceError{
+		Schema:  SourceErrorSchema,
+		TrackID: event.TrackID,
+		Camera:  event.Camera,
+		Error:   event.Err.Error(),
+		Time:    time.Now().UTC(),
 	})
+	if err != nil {
+		log.Printf("Failed to marshal source error: %v", err)
+		return
+	}
+	if err := m.publish(deviceTopic("source-error"), payload); err != nil {
+		log.Printf("Failed to publish source error: %v", err)
+	}
+}
 
-	opts.SetReconnectingHandler(func(client mqtt.Client, opts *mqtt.ClientOptions) {
-		log.Println("Attempting to reconnect...")
+// publishGovernor reports the CPU governor's step on <thingName>/governor,
+// retained
+func (m *MQTTClient) publishGovernor(event GovernorEvent) {
+	payload, err := json.Marshal(GovernorState{
+		Schema:     GovernorStateSchema,
+		Level:      event.Level,
+		Step:       event.Step,
+		CPUPercent: event.CPUPercent,
+		Cameras:    event.Cameras,
+		Time:       time.Now().UTC(),
 	})
+	if err != nil {
+		log.Printf("Failed to marshal governor state: %v", err)
+		return
+	}
+	if err := m.publishMessage(deviceTopic("governor"), true, payload); err != nil {
+		log.Printf("Failed to publish governor state: %v", err)
+	}
+}
 
-	m.client = mqtt.NewClient(opts)
+// publish sends a message to the broker, skipping it when running without one (replay)
+func (m *MQTTClient) publish(topic string, payload []byte) error {
+	return m.publishMessage(topic, false, payload)
+}
 
-	log.Printf("Connecting to MQTT broker at %s:%d...", broker, port)
+func (m *MQTTClient) publishMessage(topic string, retained bool, payload []byte) error {
+	if m.client == nil {
+		log.Printf("No MQTT connection, dropping publish to %s", topic)
+		metrics.Inc("mqtt.publish_dropped")
+		return nil
+	}
 
-	if token := m.client.Connect(); token.Wait() && token.Error() != nil {
-		return fmt.Errorf("failed to connect to MQTT broker: %v", token.Error())
+	m.inflight.Add(1)
+	defer m.inflight.Add(-1)
+
+	kind := topicKind(topic)
+	start := time.Now()
+	token := m.client.Publish(topic, 0, retained, payload)
+	if err := waitToken(token); err != nil {
+		if err == errTokenTimeout {
+			metrics.Inc("mqtt.publish_unacked")
+		} else {
+			metrics.Inc("mqtt.publish_dropped")
+		}
+		metrics.Inc("mqtt.publish_failures." + kind)
+		return err
 	}
 
+	metrics.Inc("mqtt.publish_sent")
+	metrics.Inc("mqtt.published." + kind)
+	metrics.Add("mqtt.published_bytes."+kind, uint64(len(payload)))
+	metrics.Observe("mqtt.publish_latency", time.Since(start))
 	return nil
 }
 
+func (m *MQTTClient) handleCamera(topic string, payload []byte) {
+	log.Printf("Camera switch request received on topic %s: %s", topic, string(payload))
+
+	// Parse camera number from message
+	var cameraNumber int
+	_, err := fmt.Sscanf(string(payload), "%d", &cameraNumber)
+	if err != nil {
+		log.Printf("Failed to parse camera number from message: %v", err)
+		return
+	}
+
+	log.Printf("Parsed camera number: %d", cameraNumber)
+
+	// Switch to requested camera
+	if err := m.webrtcManager.SwitchCamera(cameraNumber); err != nil {
+		log.Printf("Failed to switch camera: %v", err)
+	} else {
+		log.Printf("Successfully switched to camera %d", cameraNumber)
+	}
+}
+
+func (m *MQTTClient) handleDisconnectClient(topic string, payload []byte) {
+	log.Printf("Disconnect request received on topic %s", topic)
+
+	peerID, ok := peerIDFromTopic(topic)
+	if !ok {
+		return
+	}
+
+	m.inOrder(peerID, func() { m.dropPeer(peerID) })
+}
+
+// dropPeer closes peerID's connection and forgets everything tracked for it
+func (m *MQTTClient) dropPeer(peerID string) {
+	m.signaler.HandleDisconnect(peerID)
+	m.signaler.RevokeResume(peerID)
+	m.clearRetained(peerID)
+
+	// Remove from tracked peers
+	m.mu.Lock()
+	delete(m.currentPeerIDs, peerID)
+	delete(m.peerCapabilities, peerID)
+	delete(m.integrityReports, peerID)
+	m.mu.Unlock()
+}
+
+func (m *MQTTClient) handleOffer(topic string, payload []byte) {
+	log.Printf("Offer received on topic %s", topic)
+
+	// Parse topic to get peer ID: <baseTopic>/<peerId>/offer
+	peerID, ok := peerIDFromTopic(topic)
+	if !ok {
+		return
+	}
+	log.Printf("Extracted peer ID: %s", peerID)
+
+	// Flutter sends plain SDP, or an OfferEnvelope when it has a token or
+	// metadata
+	envelope, err := parseOffer(payload)
+	if err != nil {
+		log.Printf("Failed to parse offer from %s: %v", peerID, err)
+		return
+	}
+
+	// Track this peer
+	m.mu.Lock()
+	m.currentPeerIDs[peerID] = true
+	m.mu.Unlock()
+
+	caps := m.capabilitiesFor(peerID)
+	if envelope.Metadata != nil {
+		caps.Metadata = *envelope.Metadata
+	}
+	caps.Resume = envelope.Resume
+	m.inOrder(peerID, func() {
+		m.signaler.HandleOffer(m, peerID, envelope.SDP, envelope.Token, caps)
+	})
+}
+
+// retainedQueue publishes retained state from one goroutine, in the order it
+// changed, so a state published late cannot overwrite a newer one on the
+// broker. A topic that changes again before its turn is published once, as
+// it last changed.
+type retainedQueue struct {
+	pending map[string]func() // by topic, the latest publish waiting
+	order   []string          // the topics in pending, first changed first
+	running bool              // whether the goroutine publishing them runs
+	mu      sync.Mutex
+}
+
+// retain queues publish, which publishes topic's retained state, in place
+// of any publish of topic still waiting
+func (m *MQTTClient) retain(topic string, publish func()) {
+	q := &m.retained
+	q.mu.Lock()
+	if q.pending == nil {
+		q.pending = make(map[string]func())
+	}
+	if _, waiting := q.pending[topic]; !waiting {
+		q.order = append(q.order, topic)
+	}
+	q.pending[topic] = publish
+	running := q.running
+	q.running = true
+	q.mu.Unlock()
+	if !running {
+		go q.drain()
+	}
+}
+
+// drain publishes the queued states until there are none left
+func (q *retainedQueue) drain() {
+	for {
+		q.mu.Lock()
+		if len(q.order) == 0 {
+			q.running = false
+			q.mu.Unlock()
+			return
+		}
+		topic := q.order[0]
+		publish := q.pending[topic]
+		q.order = q.order[1:]
+		delete(q.pending, topic)
+		q.mu.Unlock()
+		publish()
+	}
+}
+
+// peerQueues runs each peer's signaling in order on a goroutine of its own
+type peerQueues struct {
+	pending map[string][]func() // by peer, present while its goroutine runs
+	mu      sync.Mutex
+}
+
+// inOrder runs work, a peer's offer, candidates or disconnect. With
+// offerAuthMode "endpoint" an offer can wait offerAuthTimeout on the auth
+// service, so the work is queued for the peer instead of run on the MQTT
+// client's goroutine: the peer's later candidates still follow its offer,
+// while every other topic, the e-stop among them, carries on.
+func (m *MQTTClient) inOrder(peerID string, work func()) {
+	if offerAuthMode != AuthEndpoint {
+		work()
+		return
+	}
+	q := &m.peerQueues
+	q.mu.Lock()
+	if q.pending == nil {
+		q.pending = make(map[string][]func())
+	}
+	queued, running := q.pending[peerID]
+	q.pending[peerID] = append(queued, work)
+	q.mu.Unlock()
+	if !running {
+		go q.drain(peerID)
+	}
+}
+
+// drain runs peerID's queued work until there is none left
+func (q *peerQueues) drain(peerID string) {
+	for {
+		q.mu.Lock()
+		queued := q.pending[peerID]
+		if len(queued) == 0 {
+			delete(q.pending, peerID)
+			q.mu.Unlock()
+			return
+		}
+		q.pending[peerID] = queued[1:]
+		q.mu.Unlock()
+		queued[0]()
+	}
+}
+
+func (m *MQTTClient) handleRobotCandidate(topic string, payload []byte) {
+	peerID, ok := peerIDFromTopic(topic)
+	if !ok {
+		return
+	}
+
+	// Flutter sends ICE candidates as an array, JSON unless it negotiated CBOR
+	var iceCandidates []ICECandidateMessage
+	if err := unmarshalPayload(m.capabilitiesFor(peerID).Encoding, payload, &iceCandidates); err != nil {
+		log.Printf("Failed to parse ICE candidates: %v", err)
+		return
+	}
+
+	m.inOrder(peerID, func() {
+		// With shared subscriptions the offer may have been answered by
+		// another instance; its candidates are not ours to apply
+		if sharedSubscriptionGroup != "" && !m.webrtcManager.HasPeer(peerID) {
+			return
+		}
+		m.signaler.HandleCandidates(peerID, iceCandidates)
+	})
+}
+
+// clearRetained removes any retained signaling messages for peerID, so a
+// reconnecting frontend does not pick up the previous session's SDP
+func (m *MQTTClient) clearRetained(peerID string) {
+	for _, kind := range []string{"answer", "candidate/rmcs", "candidate/robot"} {
+		topic := peerTopic(peerID, kind)
+		if err := m.publishMessage(topic, true, nil); err != nil {
+			log.Printf("Failed to clear retained %s for %s: %v", kind, peerID, err)
+		}
+	}
+}
+
+func (m *MQTTClient) handleKeepalive(topic string, payload []byte) {
+	if peerID, ok := peerIDFromTopic(topic); ok {
+		m.signaler.HandleKeepalive(peerID)
+	}
+}
+
+// Name implements SignalingTransport
+func (m *MQTTClient) Name() string {
+	return "mqtt"
+}
+
+// SendAnswer implements SignalingTransport
+func (m *MQTTClient) SendAnswer(peerID string, answerSDP string) error {
+	// Send the answer as plain SDP string (Flutter expects plain string)
+	answerTopic := peerTopic(peerID, "answer")
+	return m.publish(answerTopic, []byte(answerSDP))
+}
+
+// SendCandidates implements SignalingTransport
+func (m *MQTTClient) SendCandidates(peerID string, candidates []webrtc.ICECandidateInit) error {
+	// Flutter expects an array, in the encoding it negotiated
+	messages := make([]map[string]interface{}, 0, len(candidates))
+	for _, candidate := range candidates {
+		messages = append(messages, map[string]interface{}{
+			"candidate":     candidate.Candidate,
+			"sdpMid":        candidate.SDPMid,
+			"sdpMLineIndex": candidate.SDPMLineIndex,
+		})
+	}
+
+	payload, err := marshalPayload(m.capabilitiesFor(peerID).Encoding, messages)
+	if err != nil {
+		return fmt.Errorf("failed to marshal ICE candidates: %v", err)
+	}
+
+	// Send to frontend via rmcs candidate topic
+	topic := peerTopic(peerID, "candidate/rmcs")
+	return m.publish(topic, payload)
+}
+
+// SendTracks implements SignalingTransport
+func (m *MQTTClient) SendTracks(peerID string, tracks PeerTracks) error {
+	payload, err := marshalPayload(m.capabilitiesFor(peerID).Encoding, tracks)
+	if err != nil {
+		return fmt.Errorf("failed to marshal tracks: %v", err)
+	}
+	return m.publish(peerTopic(peerID, "tracks"), payload)
+}
+
+// SendError implements SignalingTransport
+func (m *MQTTClient) SendError(peerID string, offerErr OfferError) error {
+	payload, err := marshalPayload(m.capabilitiesFor(peerID).Encoding, offerErr)
+	if err != nil {
+		return fmt.Errorf("failed to marshal offer error: %v", err)
+	}
+	return m.publish(peerTopic(peerID, "error"), payload)
+}
+
+// SendKey implements SignalingTransport. The key is sent on the peer's key
+// channel, inside its DTLS session, rather than the broker, where any client
+// allowed to subscribe could read it and decrypt the video end-to-end
+// encryption hides from the broker.
+func (m *MQTTClient) SendKey(peerID string, key E2EEKey) error {
+	return m.webrtcManager.SendOnKeyChannel(peerID, key)
+}
+
+// SendResume implements SignalingTransport. Like the key, the token is sent
+// on the peer's key channel rather than the broker, where any client allowed
+// to subscribe could take over the session with it.
+func (m *MQTTClient) SendResume(peerID string, resume ResumeToken) error {
+	return m.webrtcManager.SendOnKeyChannel(peerID, resume)
+}
+
 func (m *MQTTClient) PublishDisconnectTractor() {
 	if m.client != nil {
-		topic := fmt.Sprintf("%s/disconnect-tractor", baseTopic)
+		topic := broadcastTopic("disconnect-tractor")
 		payload := "robot"
-		token := m.client.Publish(topic, 0, false, []byte(payload))
-		if token.Wait() && token.Error() != nil {
-			log.Printf("Failed to publish disconnect-tractor: %v", token.Error())
+		if err := m.publish(topic, []byte(payload)); err != nil {
+			log.Printf("Failed to publish disconnect-tractor: %v", err)
 		} else {
 			log.Printf("Published disconnect-tractor message to %s", topic)
 		}
 	}
 }
 
+// Disconnect drains the broker connection: every tracked peer is told the
+// backend is going away, subscriptions are removed so no new work arrives,
+// in-flight publishes are flushed and only then is the connection closed
 func (m *MQTTClient) Disconnect() {
-	if m.client != nil {
-		// Publish disconnect-tractor before disconnecting
-		m.PublishDisconnectTractor()
+	if m.client == nil {
+		return
+	}
 
-		m.client.Disconnect(250)
-		log.Println("Disconnected from MQTT broker")
+	m.mu.Lock()
+	peerIDs := make([]string, 0, len(m.currentPeerIDs))
+	for peerID := range m.currentPeerIDs {
+		peerIDs = append(peerIDs, peerID)
 	}
-}
\ No newline at end of file
+	m.mu.Unlock()
+
+	for _, peerID := range peerIDs {
+		topic := peerTopic(peerID, "disconnecting")
+		if err := m.publish(topic, []byte("robot")); err != nil {
+			log.Printf("Failed to notify %s of shutdown: %v", peerID, err)
+		}
+		m.clearRetained(peerID)
+	}
+
+	m.StopPeerStats()
+	m.StopPipelineStats()
+	m.StopROSDiscovery()
+
+	// Publish disconnect-tractor before disconnecting
+	m.PublishDisconnectTractor()
+
+	m.subscriptions.UnsubscribeAll(m.client)
+
+	// Handlers still running may be publishing answers or candidates
+	deadline := time.Now().Add(mqttDrainTimeout)
+	for m.inflight.Load() > 0 {
+		if time.Now().After(deadline) {
+			log.Printf("Timed out flushing %d pending MQTT publishes", m.inflight.Load())
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	m.client.Disconnect(uint(mqttDrainTimeout.Milliseconds()))
+	log.Println("Disconnected from MQTT broker")
+}
@@ -0,0 +1,360 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/pion/ice/v4"
+	"github.com/pion/interceptor"
+	"github.com/pion/interceptor/pkg/cc"
+	"github.com/pion/interceptor/pkg/stats"
+	"github.com/pion/webrtc/v4"
+)
+
+// interfaceIP returns the first IPv4 address of the named interface, or its
+// first address of any family if it has no IPv4 address
+func interfaceIP(name string) (net.IP, error) {
+	iface, err := net.InterfaceByName(name)
+	if err != nil {
+		return nil, fmt.Errorf("interface %s: %v", name, err)
+	}
+	addrs, err := iface.Addrs()
+	if err != nil {
+		return nil, fmt.Errorf("interface %s: %v", name, err)
+	}
+
+	var fallback net.IP
+	for _, addr := range addrs {
+		ipNet, ok := addr.(*net.IPNet)
+		if !ok || ipNet.IP.IsLinkLocalUnicast() {
+			continue
+		}
+		if ip4 := ipNet.IP.To4(); ip4 != nil {
+			return ip4, nil
+		}
+		if fallback == nil {
+			fallback = ipNet.IP
+		}
+	}
+	if fallback == nil {
+		return nil, fmt.Errorf("interface %s has no usable address", name)
+	}
+	return fallback, nil
+}
+
+// MQTTNetworkProfile holds the timing of the broker connection, tuned for
+// the kind of link the robot signals over
+type MQTTNetworkProfile struct {
+	// KeepAlive is the MQTT keepalive; a dead connection is noticed after
+	// at most KeepAlive + PingTimeout
+	KeepAlive   time.Duration
+	PingTimeout time.Duration
+	// TCPKeepAlive is the socket-level keepalive period
+	TCPKeepAlive   time.Duration
+	ConnectTimeout time.Duration
+	// MaxReconnectInterval caps the backoff between reconnect attempts
+	MaxReconnectInterval time.Duration
+	// CleanSession makes the broker drop subscriptions and queued messages
+	// on disconnect. MQTT 3.1.1 has no session expiry interval: how long a
+	// persistent session lives is set on the broker.
+	CleanSession bool
+}
+
+// mqttNetworkProfiles are the presets selectable with mqttNetworkProfile
+var mqttNetworkProfiles = map[string]MQTTNetworkProfile{
+	// Stable links: few pings, tolerant of slow brokers
+	"lan": {
+		KeepAlive:            60 * time.Second,
+		PingTimeout:          10 * time.Second,
+		TCPKeepAlive:         15 * time.Second,
+		ConnectTimeout:       30 * time.Second,
+		MaxReconnectInterval: 10 * time.Minute,
+		CleanSession:         true,
+	},
+	// Cellular: carrier NATs drop idle flows and dead connections must be
+	// noticed in seconds, not minutes
+	"lte": {
+		KeepAlive:            15 * time.Second,
+		PingTimeout:          5 * time.Second,
+		TCPKeepAlive:         10 * time.Second,
+		ConnectTimeout:       10 * time.Second,
+		MaxReconnectInterval: 30 * time.Second,
+		CleanSession:         true,
+	},
+}
+
+// activeMQTTProfile returns the selected preset with any overrides from
+// constants.go applied
+func activeMQTTProfile() MQTTNetworkProfile {
+	profile, ok := mqttNetworkProfiles[mqttNetworkProfile]
+	if !ok {
+		log.Printf("Unknown MQTT network profile %q, using lan", mqttNetworkProfile)
+		profile = mqttNetworkProfiles["lan"]
+	}
+	if mqttKeepAlive != 0 {
+		profile.KeepAlive = mqttKeepAlive
+	}
+	if mqttPingTimeout != 0 {
+		profile.PingTimeout = mqttPingTimeout
+	}
+	if mqttTCPKeepAlive != 0 {
+		profile.TCPKeepAlive = mqttTCPKeepAlive
+	}
+	return profile
+}
+
+// mqttDialer connects to the broker from signalingInterface, marked with
+// signalingDSCP, when configured
+func mqttDialer(profile MQTTNetworkProfile) (*net.Dialer, error) {
+	dialer := &net.Dialer{
+		Timeout:   profile.ConnectTimeout,
+		KeepAlive: profile.TCPKeepAlive,
+	}
+
+	if signalingInterface != "" {
+		ip, err := interfaceIP(signalingInterface)
+		if err != nil {
+			return nil, err
+		}
+		dialer.LocalAddr = &net.TCPAddr{IP: ip}
+		log.Printf("MQTT bound to %s (%s)", signalingInterface, ip)
+	}
+	if signalingDSCP != 0 {
+		dialer.Control = dscpControl(signalingDSCP)
+	}
+	return dialer, nil
+}
+
+// newMediaAPI builds the WebRTC API peer connections are created from. ICE
+// is restricted to mediaInterface when set. With mediaDSCP set, media uses
+// a single UDP socket marked with it; with iceTCPEnabled, peers that cannot
+// use UDP reach a TCP listener on iceTCPPort. The sockets are returned so
+// they can be closed. onStats receives the RTP stats of each new peer
+// connection, and with adaptiveBitrateEnabled onEstimator its bandwidth
+// estimator, both synchronously from NewPeerConnection. loopbackCandidates
+// offers candidates on the loopback interface too, which pion leaves out,
+// for tests whose client is in the same process.
+func newMediaAPI(onStats stats.NewPeerConnectionCallback, onEstimator cc.NewPeerConnectionCallback, loopbackCandidates bool) (*webrtc.API, []io.Closer, error) {
+	settingEngine := webrtc.SettingEngine{}
+	var sockets []io.Closer
+	closeSockets := func() {
+		for _, socket := range sockets {
+			socket.Close()
+		}
+	}
+
+	listenIP := net.IPv4zero
+	if mediaInterface != "" {
+		ip, err := interfaceIP(mediaInterface)
+		if err != nil {
+			return nil, nil, err
+		}
+		listenIP = ip
+		settingEngine.SetInterfaceFilter(func(name string) bool {
+			return name == mediaInterface
+		})
+		log.Printf("WebRTC media bound to %s (%s)", mediaInterface, ip)
+	}
+	if err := configureICE(&settingEngine); err != nil {
+		return nil, nil, err
+	}
+	if loopbackCandidates {
+		settingEngine.SetIncludeLoopbackCandidate(true)
+	}
+
+	listenConfig := net.ListenConfig{}
+	if mediaDSCP != 0 {
+		listenConfig.Control = dscpControl(mediaDSCP)
+
+		// pion opens its own sockets per candidate, so a marked socket has
+		// to be handed to it through a UDP mux
+		conn, err := listenConfig.ListenPacket(context.Background(), "udp", net.JoinHostPort(listenIP.String(), "0"))
+		if err != nil {
+			return nil, nil, fmt.Errorf("failed to open media socket: %v", err)
+		}
+		settingEngine.SetICEUDPMux(webrtc.NewICEUDPMux(nil, conn))
+		sockets = append(sockets, conn)
+		log.Printf("WebRTC media on %s with DSCP %d", conn.LocalAddr(), mediaDSCP)
+	}
+
+	if iceTCPEnabled {
+		listener, err := listenConfig.Listen(context.Background(), "tcp", net.JoinHostPort(listenIP.String(), fmt.Sprint(iceTCPPort)))
+		if err != nil {
+			closeSockets()
+			return nil, nil, fmt.Errorf("failed to open ICE-TCP listener: %v", err)
+		}
+		settingEngine.SetICETCPMux(webrtc.NewICETCPMux(nil, listener, 8))
+		settingEngine.SetNetworkTypes([]webrtc.NetworkType{
+			webrtc.NetworkTypeUDP4, webrtc.NetworkTypeUDP6,
+			webrtc.NetworkTypeTCP4, webrtc.NetworkTypeTCP6,
+		})
+		sockets = append(sockets, listener)
+		log.Printf("ICE-TCP candidates on %s", listener.Addr())
+	}
+
+	// pion only adds its default codecs and interceptors when given none, so
+	// they are set up here alongside the stats interceptor (see
+	// interceptors.go)
+	mediaEngine := &webrtc.MediaEngine{}
+	if err := mediaEngine.RegisterDefaultCodecs(); err != nil {
+		closeSockets()
+		return nil, nil, fmt.Errorf("failed to register codecs: %v", err)
+	}
+	if simulcastEnabled {
+		if err := webrtc.ConfigureSimulcastExtensionHeaders(mediaEngine); err != nil {
+			closeSockets()
+			return nil, nil, fmt.Errorf("failed to register simulcast header extensions: %v", err)
+		}
+	}
+	if captureTimeExtension {
+		if err := mediaEngine.RegisterHeaderExtension(webrtc.RTPHeaderExtensionCapability{URI: absCaptureTimeURI}, webrtc.RTPCodecTypeVideo); err != nil {
+			closeSockets()
+			return nil, nil, fmt.Errorf("failed to register capture time header extension: %v", err)
+		}
+	}
+	registry := &interceptor.Registry{}
+	if err := addInterceptors(mediaEngine, registry, onEstimator); err != nil {
+		closeSockets()
+		return nil, nil, fmt.Errorf("failed to register interceptors: %v", err)
+	}
+	statsInterceptor, err := stats.NewInterceptor()
+	if err != nil {
+		closeSockets()
+		return nil, nil, fmt.Errorf("failed to create stats interceptor: %v", err)
+	}
+	statsInterceptor.OnNewPeerConnection(onStats)
+	registry.Add(statsInterceptor)
+
+	api := webrtc.NewAPI(
+		webrtc.WithSettingEngine(settingEngine),
+		webrtc.WithMediaEngine(mediaEngine),
+		webrtc.WithInterceptorRegistry(registry),
+	)
+	return api, sockets, nil
+}
+
+// configureICE applies the media UDP port range, 1:1 NAT addresses and
+// mDNS setting
+func configureICE(settingEngine *webrtc.SettingEngine) error {
+	if mediaUDPPortMin != 0 || mediaUDPPortMax != 0 {
+		if err := settingEngine.SetEphemeralUDPPortRange(mediaUDPPortMin, mediaUDPPortMax); err != nil {
+			return fmt.Errorf("invalid media UDP port range %d-%d: %v", mediaUDPPortMin, mediaUDPPortMax, err)
+		}
+		log.Printf("WebRTC media on UDP ports %d-%d", mediaUDPPortMin, mediaUDPPortMax)
+	}
+
+	if ips := natIPs(); len(ips) > 0 {
+		var candidateType webrtc.ICECandidateType
+		switch natCandidateType {
+		case "host":
+			candidateType = webrtc.ICECandidateTypeHost
+		case "srflx":
+			candidateType = webrtc.ICECandidateTypeSrflx
+		default:
+			return fmt.Errorf("invalid NAT candidate type %q, want host or srflx", natCandidateType)
+		}
+		settingEngine.SetNAT1To1IPs(ips, candidateType)
+		log.Printf("Advertising 1:1 NAT addresses %v as %s candidates", ips, natCandidateType)
+	}
+
+	if mdnsCandidatesDisabled {
+		settingEngine.SetICEMulticastDNSMode(ice.MulticastDNSModeDisabled)
+	}
+	return nil
+}
+
+// natIPs returns the addresses in natPublicIPs
+func natIPs() []string {
+	var ips []string
+	for _, ip := range strings.Split(natPublicIPs, ",") {
+		if ip = strings.TrimSpace(ip); ip != "" {
+			ips = append(ips, ip)
+		}
+	}
+	return ips
+}
+
+// iceServers returns the STUN and TURN servers offered to every peer
+// connection. TURN URLs with ?transport=tcp or the turns: scheme relay media
+// over TCP or TLS for networks that block UDP entirely.
+func iceServers() []webrtc.ICEServer {
+	servers := []webrtc.ICEServer{}
+	// pion refuses STUN next to srflx candidates from 1:1 NAT addresses,
+	// which already are what STUN would find
+	if iceSTUNURL != "" && !(len(natIPs()) > 0 && natCandidateType == "srflx") {
+		servers = append(servers, webrtc.ICEServer{URLs: []string{iceSTUNURL}})
+	}
+
+	var turnURLs []string
+	for _, url := range strings.Split(iceTURNURLs, ",") {
+		if url = strings.TrimSpace(url); url != "" {
+			turnURLs = append(turnURLs, url)
+		}
+	}
+	if len(turnURLs) > 0 {
+		servers = append(servers, webrtc.ICEServer{
+			URLs:       turnURLs,
+			Username:   iceTURNUsername,
+			Credential: iceTURNCredential,
+		})
+	}
+	return servers
+}
+
+// Media transports of a connected peer, see selectedTransport
+const (
+	TransportUnknown = "unknown"
+	TransportUDP     = "udp"
+	TransportTCP     = "tcp"      // ICE-TCP, straight to our listener
+	TransportTURNUDP = "turn-udp" // relayed, UDP to the TURN server
+	TransportTURNTCP = "turn-tcp"
+	TransportTURNTLS = "turn-tls"
+)
+
+// overTCP reports whether media on transport travels over TCP somewhere on
+// its path, which means head-of-line blocking and less headroom for video
+func overTCP(transport string) bool {
+	switch transport {
+	case TransportTCP, TransportTURNTCP, TransportTURNTLS:
+		return true
+	}
+	return false
+}
+
+// selectedTransport names how peerConnection's nominated candidate pair
+// carries media: directly over UDP or TCP, or relayed through TURN over
+// UDP, TCP or TLS
+func selectedTransport(peerConnection *webrtc.PeerConnection) string {
+	report := peerConnection.GetStats()
+	for _, stats := range report {
+		pair, ok := stats.(webrtc.ICECandidatePairStats)
+		if !ok || !pair.Nominated || pair.State != webrtc.StatsICECandidatePairStateSucceeded {
+			continue
+		}
+		local, ok := report[pair.LocalCandidateID].(webrtc.ICECandidateStats)
+		if !ok {
+			continue
+		}
+
+		if local.CandidateType == webrtc.ICECandidateTypeRelay {
+			switch strings.ToLower(local.RelayProtocol) {
+			case "tcp":
+				return TransportTURNTCP
+			case "tls":
+				return TransportTURNTLS
+			default:
+				return TransportTURNUDP
+			}
+		}
+		if strings.ToLower(local.Protocol) == "tcp" {
+			return TransportTCP
+		}
+		return TransportUDP
+	}
+	return TransportUnknown
+}
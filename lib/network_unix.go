@@ -0,0 +1,33 @@
+//go:build unix
+
+package main
+
+import (
+	"fmt"
+	"syscall"
+)
+
+// dscpControl returns a socket control function that marks outgoing packets
+// with the given DSCP value, for net.Dialer and net.ListenConfig
+func dscpControl(dscp int) func(network, address string, c syscall.RawConn) error {
+	// DSCP is the upper six bits of the TOS / traffic class byte
+	tos := dscp << 2
+	return func(network, address string, c syscall.RawConn) error {
+		var sockErr error
+		err := c.Control(func(fd uintptr) {
+			switch network {
+			case "tcp6", "udp6":
+				sockErr = syscall.SetsockoptInt(int(fd), syscall.IPPROTO_IPV6, syscall.IPV6_TCLASS, tos)
+			default:
+				sockErr = syscall.SetsockoptInt(int(fd), syscall.IPPROTO_IP, syscall.IP_TOS, tos)
+			}
+		})
+		if err != nil {
+			return err
+		}
+		if sockErr != nil {
+			return fmt.Errorf("failed to set DSCP %d: %v", dscp, sockErr)
+		}
+		return nil
+	}
+}
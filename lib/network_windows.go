@@ -0,0 +1,15 @@
+package main
+
+import (
+	"log"
+	"syscall"
+)
+
+// dscpControl returns a socket control function for net.Dialer and
+// net.ListenConfig. Windows ignores IP_TOS from applications and has no
+// IPV6_TCLASS, marking only through QoS policies, so packets go out
+// unmarked.
+func dscpControl(dscp int) func(network, address string, c syscall.RawConn) error {
+	log.Printf("DSCP %d not set: Windows marks packets through QoS policies only", dscp)
+	return nil
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"fmt"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+// Camera orientation: cameras mounted upside down or sideways are turned
+// upright as they are encoded, by ffmpeg filters ahead of the encoder's
+// own. A captured camera's entry (see camera_capture.go) sets them:
+//
+//	"capture:/dev/video2?crop=1280:600:0:60&flip=h&rotate=90"
+//
+// crop=<width>:<height>:<x>:<y> keeps that part of the captured picture,
+// flip=h, v or hv mirrors it, and rotate=90, 180 or 270 turns it clockwise,
+// in that order. Cameras streamed already encoded, from frame files, RTSP
+// or GStreamer pipelines, cannot be filtered without re-encoding them.
+
+// cameraOrientation is how a captured camera's picture is turned upright
+type cameraOrientation struct {
+	crop   string // "<width>:<height>:<x>:<y>", "" for none
+	flip   string // "h", "v" or "hv", "" for none
+	rotate string // degrees clockwise, "" for none
+}
+
+// orientationOptions returns the orientation a camera entry's options set
+func orientationOptions(values url.Values) cameraOrientation {
+	return cameraOrientation{crop: values.Get("crop"), flip: values.Get("flip"), rotate: values.Get("rotate")}
+}
+
+// filters returns the ffmpeg video filters applying the orientation
+func (o cameraOrientation) filters() ([]string, error) {
+	var filters []string
+	if o.crop != "" {
+		parts := strings.Split(o.crop, ":")
+		if len(parts) != 4 {
+			return nil, fmt.Errorf("invalid crop %q (width:height:x:y)", o.crop)
+		}
+		for _, part := range parts {
+			if n, err := strconv.Atoi(part); err != nil || n < 0 {
+				return nil, fmt.Errorf("invalid crop %q (width:height:x:y)", o.crop)
+			}
+		}
+		filters = append(filters, "crop="+o.crop)
+	}
+	switch o.flip {
+	case "":
+	case "h":
+		filters = append(filters, "hflip")
+	case "v":
+		filters = append(filters, "vflip")
+	case "hv", "vh":
+		filters = append(filters, "hflip", "vflip")
+	default:
+		return nil, fmt.Errorf("invalid flip %q (h, v or hv)", o.flip)
+	}
+	switch o.rotate {
+	case "", "0":
+	case "90":
+		filters = append(filters, "transpose=clock")
+	case "180":
+		filters = append(filters, "hflip", "vflip")
+	case "270":
+		filters = append(filters, "transpose=cclock")
+	default:
+		return nil, fmt.Errorf("invalid rotate %q (90, 180 or 270)", o.rotate)
+	}
+	return filters, nil
+}
@@ -0,0 +1,45 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+
+	"github.com/fxamacker/cbor/v2"
+)
+
+// Payload encodings a peer can select in its capabilities. JSON is the
+// default; CBOR carries the same fields under the same keys, in a smaller
+// binary form for constrained links.
+const (
+	EncodingJSON = "json"
+	EncodingCBOR = "cbor"
+)
+
+// supportedEncodings is advertised in BackendCapabilities
+var supportedEncodings = []string{EncodingJSON, EncodingCBOR}
+
+// marshalPayload encodes v for a peer that selected encoding. Unknown
+// encodings fall back to JSON.
+func marshalPayload(encoding string, v interface{}) ([]byte, error) {
+	if encoding == EncodingCBOR {
+		return cbor.Marshal(v)
+	}
+	return json.Marshal(v)
+}
+
+// unmarshalPayload decodes a payload from a peer that selected encoding. A
+// CBOR peer may still send JSON, e.g. a message published before its
+// capabilities arrived, so JSON is tried when CBOR decoding fails.
+func unmarshalPayload(encoding string, data []byte, v interface{}) error {
+	if encoding == EncodingCBOR {
+		cborErr := cbor.Unmarshal(data, v)
+		if cborErr == nil {
+			return nil
+		}
+		if json.Unmarshal(data, v) == nil {
+			return nil
+		}
+		return fmt.Errorf("not valid CBOR or JSON: %v", cborErr)
+	}
+	return json.Unmarshal(data, v)
+}
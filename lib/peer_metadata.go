@@ -0,0 +1,112 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"sort"
+	"strings"
+	"time"
+	"unicode"
+)
+
+// Peer metadata: a frontend may describe itself, its device name, app
+// version and platform, in its offer (the MQTT OfferEnvelope or WebSocket
+// offer) or its capabilities. The manager keeps it with the peer's
+// connection, and it shows in the logs, on <thingName>/peers and in the
+// list-peers admin command, so operators can tell which device each peer ID
+// belongs to. It is descriptive only, never trusted for authorization.
+
+// maxPeerMetadataLength bounds each metadata field, in runes
+const maxPeerMetadataLength = 64
+
+// cleanPeerMetadata trims the fields of metadata sent by a peer and strips
+// control characters, since they end up in logs and published messages
+func cleanPeerMetadata(metadata PeerMetadata) PeerMetadata {
+	clean := func(value string) string {
+		value = strings.Map(func(r rune) rune {
+			if unicode.IsControl(r) {
+				return -1
+			}
+			return r
+		}, strings.TrimSpace(value))
+		if runes := []rune(value); len(runes) > maxPeerMetadataLength {
+			value = string(runes[:maxPeerMetadataLength])
+		}
+		return value
+	}
+	return PeerMetadata{
+		Name:       clean(metadata.Name),
+		AppVersion: clean(metadata.AppVersion),
+		Platform:   clean(metadata.Platform),
+	}
+}
+
+// String describes metadata for log lines, e.g. "Control tablet 3 (app
+// 2.4.1, android)"
+func (metadata PeerMetadata) String() string {
+	name := metadata.Name
+	if name == "" {
+		name = "unnamed"
+	}
+	var details []string
+	if metadata.AppVersion != "" {
+		details = append(details, "app "+metadata.AppVersion)
+	}
+	if metadata.Platform != "" {
+		details = append(details, metadata.Platform)
+	}
+	if len(details) == 0 {
+		return fmt.Sprintf("%q", name)
+	}
+	return fmt.Sprintf("%q (%s)", name, strings.Join(details, ", "))
+}
+
+// PeerMetadata returns what peerID told about itself, ok is false for
+// unknown peers
+func (w *WebRTCManager) PeerMetadata(peerID string) (PeerMetadata, bool) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if _, exists := w.peerConnections[peerID]; !exists {
+		return PeerMetadata{}, false
+	}
+	return w.peerMetadata[peerID], true
+}
+
+// Peers lists every peer the manager holds a connection for
+func (w *WebRTCManager) Peers() PeerList {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	list := PeerList{Schema: PeerListSchema, Peers: []PeerInfo{}, Time: time.Now().UTC()}
+	for peerID, peerConnection := range w.peerConnections {
+		info := PeerInfo{
+			PeerID:         peerID,
+			Role:           w.peerRoles[peerID],
+			State:          peerConnection.ConnectionState().String(),
+			MediaTransport: w.transports[peerID],
+			Metadata:       w.peerMetadata[peerID],
+		}
+		if bandwidth, ok := w.bandwidth[peerID]; ok {
+			info.MaxBitrate = bandwidth.limit
+		}
+		list.Peers = append(list.Peers, info)
+	}
+	sort.Slice(list.Peers, func(i, j int) bool {
+		return list.Peers[i].PeerID < list.Peers[j].PeerID
+	})
+	return list
+}
+
+// publishPeers retains list on <thingName>/peers
+func (m *MQTTClient) publishPeers(list PeerList) {
+	payload, err := json.Marshal(list)
+	if err != nil {
+		log.Printf("Failed to marshal peer list: %v", err)
+		return
+	}
+	if err := m.publishMessage(deviceTopic("peers"), true, payload); err != nil {
+		log.Printf("Failed to publish peer list: %v", err)
+	}
+}
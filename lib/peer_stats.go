@@ -0,0 +1,201 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/pion/interceptor/pkg/stats"
+)
+
+// peerStatsSample is the byte count a peer's bitrate is measured from
+type peerStatsSample struct {
+	bytesSent uint64
+	at        time.Time
+}
+
+// captureStats receives the stats getter of a peer connection being
+// created. NewPeerConnection calls it synchronously, from negotiate with
+// w.mu held, which then files it under the peer's ID.
+func (w *WebRTCManager) captureStats(id string, getter stats.Getter) {
+	w.newStats = getter
+}
+
+// forgetStats drops peerID's stats and bandwidth estimate along with its
+// connection, with w.mu held
+func (w *WebRTCManager) forgetStats(peerID string) {
+	delete(w.statsGetters, peerID)
+	delete(w.statsSamples, peerID)
+	delete(w.bandwidth, peerID)
+}
+
+// GetPeerStats returns the outbound RTP stats of peerID's video tracks,
+// summed over the tracks. Loss and round trip time come from the peer's
+// receiver reports, so they stay zero until the first one arrives. The
+// bitrate is measured since the previous call for the same peer.
+func (w *WebRTCManager) GetPeerStats(peerID string) (PeerStats, error) {
+	w.mu.Lock()
+	peerConnection, exists := w.peerConnections[peerID]
+	getter := w.statsGetters[peerID]
+	transport := w.transports[peerID]
+	bandwidth := w.bandwidth[peerID]
+	estimate := 0
+	if bandwidth != nil {
+		estimate = bandwidth.estimate(time.Now())
+	}
+	w.mu.Unlock()
+
+	if !exists || getter == nil {
+		return PeerStats{}, fmt.Errorf("no peer connection for %s", peerID)
+	}
+
+	now := time.Now()
+	result := PeerStats{
+		Schema:              PeerStatsSchema,
+		PeerID:              peerID,
+		MediaTransport:      transport,
+		EstimatedBitrateBps: int64(estimate),
+		Time:                now.UTC(),
+	}
+	for _, sender := range peerConnection.GetSenders() {
+		track := sender.Track()
+		if track == nil {
+			continue
+		}
+		for _, encoding := range sender.GetParameters().Encodings {
+			s := getter.Get(uint32(encoding.SSRC))
+			if s == nil {
+				continue
+			}
+			outbound, remote := s.OutboundRTPStreamStats, s.RemoteInboundRTPStreamStats
+			trackStats := TrackStats{
+				TrackID:         track.ID(),
+				SSRC:            uint64(encoding.SSRC),
+				BytesSent:       outbound.BytesSent + outbound.HeaderBytesSent,
+				PacketsSent:     outbound.PacketsSent,
+				PacketsLost:     remote.PacketsLost,
+				RoundTripTimeMs: float64(remote.RoundTripTime) / float64(time.Millisecond),
+				NACKCount:       uint64(outbound.NACKCount),
+				PLICount:        uint64(outbound.PLICount),
+				FramesDropped:   w.framesDropped(track.ID()),
+			}
+			result.Tracks = append(result.Tracks, trackStats)
+
+			result.BytesSent += trackStats.BytesSent
+			result.PacketsSent += trackStats.PacketsSent
+			result.PacketsLost += trackStats.PacketsLost
+			result.RoundTripTimeMs = max(result.RoundTripTimeMs, trackStats.RoundTripTimeMs)
+			result.FractionLost = max(result.FractionLost, remote.FractionLost)
+		}
+	}
+
+	w.mu.Lock()
+	previous, measured := w.statsSamples[peerID]
+	if w.peerConnections[peerID] == peerConnection {
+		w.statsSamples[peerID] = peerStatsSample{bytesSent: result.BytesSent, at: now}
+	}
+	w.mu.Unlock()
+
+	if elapsed := now.Sub(previous.at); measured && elapsed > 0 && result.BytesSent >= previous.bytesSent {
+		result.BitrateBps = int64(float64(result.BytesSent-previous.bytesSent) * 8 / elapsed.Seconds())
+	}
+	return result, nil
+}
+
+// StartPeerStats publishes every connected peer's stats to
+// <baseTopic>/<peerId>/stats each peerStatsInterval, and with
+// peerQualityEnabled its quality score to <baseTopic>/<peerId>/quality, for
+// the operator UI
+func (m *MQTTClient) StartPeerStats() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.stopPeerStats != nil || peerStatsInterval <= 0 {
+		return
+	}
+	m.stopPeerStats = make(chan struct{})
+	go m.peerStatsLoop(m.stopPeerStats)
+}
+
+// StopPeerStats stops publishing peer stats
+func (m *MQTTClient) StopPeerStats() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.stopPeerStats != nil {
+		close(m.stopPeerStats)
+		m.stopPeerStats = nil
+	}
+}
+
+func (m *MQTTClient) peerStatsLoop(stop chan struct{}) {
+	ticker := time.NewTicker(peerStatsInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+			m.publishPeerStats()
+		}
+	}
+}
+
+// publishPeerStats publishes the stats and quality of every peer whose
+// media is flowing
+func (m *MQTTClient) publishPeerStats() {
+	for _, peerID := range m.webrtcManager.PeerIDs() {
+		if _, _, connected := m.webrtcManager.PeerTransport(peerID); !connected {
+			continue
+		}
+		peerStats, err := m.webrtcManager.GetPeerStats(peerID)
+		if err != nil {
+			continue
+		}
+		payload, err := json.Marshal(peerStats)
+		if err != nil {
+			log.Printf("[%s] Failed to marshal peer stats: %v", peerID, err)
+			continue
+		}
+		if err := m.publish(peerTopic(peerID, "stats"), payload); err != nil {
+			log.Printf("[%s] Failed to publish peer stats: %v", peerID, err)
+			continue
+		}
+		metrics.Inc("webrtc.peer_stats_published")
+
+		if peerQualityEnabled {
+			m.publishPeerQuality(peerQuality(peerStats))
+		}
+	}
+}
+
+func (m *MQTTClient) publishPeerQuality(quality PeerQuality) {
+	payload, err := json.Marshal(quality)
+	if err != nil {
+		log.Printf("[%s] Failed to marshal peer quality: %v", quality.PeerID, err)
+		return
+	}
+	if err := m.publish(peerTopic(quality.PeerID, "quality"), payload); err != nil {
+		log.Printf("[%s] Failed to publish peer quality: %v", quality.PeerID, err)
+		return
+	}
+	metrics.Inc("webrtc.peer_quality_published")
+}
+
+// framesDropped returns the frames dropped by the streamers of the track
+// trackID, simulcast layers included
+func (w *WebRTCManager) framesDropped(trackID string) uint64 {
+	for _, output := range w.allOutputs() {
+		if output.track.ID() != trackID {
+			continue
+		}
+		dropped := output.streamer.FramesDropped()
+		for _, layer := range output.layers {
+			dropped += layer.streamer.FramesDropped()
+		}
+		return dropped
+	}
+	return 0
+}
@@ -0,0 +1,223 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"time"
+)
+
+// Pipeline stats: what the source of every streaming track and simulcast
+// layer, and every running transcoder (see transcoder.go), put through:
+// frames in and out of the encoder, frames dropped, the average encode
+// time, the bitrate and restarts. Sources that do not encode, frame files,
+// RTSP cameras and GStreamer pipelines, count their frames out as frames
+// in; ffmpeg captures and compositions report theirs with -progress, but
+// cannot time their encoder, which transcoders do. GetPipelineStats
+// returns them and every pipelineStatsInterval they are published to
+// <thingName>/pipeline-stats.
+
+// pipelineSample is the byte count a pipeline's bitrate is measured from
+type pipelineSample struct {
+	bytes uint64
+	at    time.Time
+}
+
+// GetPipelineStats returns the stats of the source of every streaming
+// track and simulcast layer, and of every running transcoder. Bitrates are
+// measured since the previous call.
+func (w *WebRTCManager) GetPipelineStats() PipelineStats {
+	now := time.Now()
+	result := PipelineStats{Schema: PipelineStatsSchema, Sources: []SourceStats{}, Time: now.UTC()}
+	for _, output := range w.allOutputs() {
+		camera := int(output.camera.Load())
+		kind := w.sourceKind(output, camera)
+		if stats, ok := w.sourceStats(output.streamer, output.track.ID(), "", camera, kind, now); ok {
+			result.Sources = append(result.Sources, stats)
+		}
+		for _, layer := range output.layers {
+			if stats, ok := w.sourceStats(layer.streamer, output.track.ID(), qualityLadder[layer.rung].Name, camera, kind, now); ok {
+				result.Sources = append(result.Sources, stats)
+			}
+		}
+		if output.transcoder != nil {
+			if stats, ok := w.transcoderStats(output.transcoder, now); ok {
+				result.Transcoders = append(result.Transcoders, stats)
+			}
+		}
+	}
+	return result
+}
+
+// sourceStats returns the stats of the streamer's source, false if it is
+// not streaming
+func (w *WebRTCManager) sourceStats(streamer *VideoStreamer, trackID string, layer string, camera int, kind string, now time.Time) (SourceStats, bool) {
+	source := streamer.Source()
+	if !streamer.streaming() || source == nil {
+		return SourceStats{}, false
+	}
+	stats := source.Stats()
+	input := stats.InputFrames
+	if input == 0 {
+		input = stats.Frames
+	}
+	result := SourceStats{
+		TrackID:         trackID,
+		Layer:           layer,
+		Camera:          camera,
+		Kind:            kind,
+		InputFrames:     input,
+		EncodedFrames:   stats.Frames,
+		DroppedFrames:   stats.Dropped + streamer.FramesDropped(),
+		EncodeTimeMs:    averageEncodeTimeMs(stats),
+		BitrateBps:      w.pipelineBitrate(trackID+"/"+layer, stats.Bytes, now),
+		JitterMs:        averageJitterMs(stats),
+		MaxJitterMs:     float64(stats.MaxJitter) / float64(time.Millisecond),
+		Restarts:        stats.Restarts,
+		Errors:          stats.Errors,
+		KeyframesForced: stats.Keyframes,
+	}
+	return result, true
+}
+
+// transcoderStats returns the stats of the transcoder, false if its
+// encoder is not running
+func (w *WebRTCManager) transcoderStats(t *transcoder, now time.Time) (TranscoderStats, bool) {
+	t.mu.Lock()
+	running, fps := t.stop != nil, t.fps
+	t.mu.Unlock()
+	if !running {
+		return TranscoderStats{}, false
+	}
+	stats := t.Stats()
+	return TranscoderStats{
+		TrackID:       t.track.ID(),
+		Codec:         codecFallback,
+		FPS:           fps,
+		InputFrames:   stats.InputFrames,
+		EncodedFrames: stats.Frames,
+		DroppedFrames: stats.Dropped,
+		EncodeTimeMs:  averageEncodeTimeMs(stats),
+		BitrateBps:    w.pipelineBitrate("transcoder/"+t.track.ID(), stats.Bytes, now),
+		Restarts:      stats.Restarts,
+	}, true
+}
+
+// averageJitterMs returns how late the frames stats paced went out on
+// average, 0 if it paced none
+func averageJitterMs(stats VideoSourceStats) float64 {
+	if stats.PacedFrames == 0 {
+		return 0
+	}
+	return float64(stats.Jitter) / float64(stats.PacedFrames) / float64(time.Millisecond)
+}
+
+// averageEncodeTimeMs returns the average of the frames stats timed, 0
+// without any
+func averageEncodeTimeMs(stats VideoSourceStats) float64 {
+	if stats.TimedFrames == 0 {
+		return 0
+	}
+	return float64(stats.EncodeTime) / float64(stats.TimedFrames) / float64(time.Millisecond)
+}
+
+// pipelineBitrate returns the bits per second of the pipeline key since the
+// previous sample, 0 for the first or after its counter restarted with a
+// new source
+func (w *WebRTCManager) pipelineBitrate(key string, bytes uint64, now time.Time) int64 {
+	w.mu.Lock()
+	previous, measured := w.pipelineSamples[key]
+	w.pipelineSamples[key] = pipelineSample{bytes: bytes, at: now}
+	w.mu.Unlock()
+
+	if elapsed := now.Sub(previous.at); measured && elapsed > 0 && bytes >= previous.bytes {
+		return int64(float64(bytes-previous.bytes) * 8 / elapsed.Seconds())
+	}
+	return 0
+}
+
+// sourceKind returns what the frames of camera's source shown on output
+// come from, see the kind of SourceStats
+func (w *WebRTCManager) sourceKind(output *videoOutput, camera int) string {
+	if output.fallback.Load() {
+		return "files"
+	}
+	if _, ok := w.sources.factory(camera); ok {
+		return "registered"
+	}
+	address, _ := cameraAddress(camera)
+	if isRTSPURL(address) {
+		return "rtsp"
+	}
+	if _, ok := gstreamerPipeline(address); ok {
+		return "gstreamer"
+	}
+	if _, ok := mjpegStream(address); ok {
+		return "mjpeg"
+	}
+	if _, ok := rosImageTopic(address); ok {
+		return "ros"
+	}
+	if _, ok := captureDevice(address); ok {
+		return "capture"
+	}
+	if _, ok := composeCameras(address); ok {
+		return "compose"
+	}
+	return "files"
+}
+
+// StartPipelineStats publishes the pipeline stats to
+// <thingName>/pipeline-stats each pipelineStatsInterval while anything
+// streams
+func (m *MQTTClient) StartPipelineStats() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.stopPipeline != nil || pipelineStatsInterval <= 0 {
+		return
+	}
+	m.stopPipeline = make(chan struct{})
+	go m.pipelineStatsLoop(m.stopPipeline)
+}
+
+// StopPipelineStats stops publishing pipeline stats
+func (m *MQTTClient) StopPipelineStats() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.stopPipeline != nil {
+		close(m.stopPipeline)
+		m.stopPipeline = nil
+	}
+}
+
+func (m *MQTTClient) pipelineStatsLoop(stop chan struct{}) {
+	ticker := time.NewTicker(pipelineStatsInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+			m.publishPipelineStats()
+		}
+	}
+}
+
+func (m *MQTTClient) publishPipelineStats() {
+	stats := m.webrtcManager.GetPipelineStats()
+	if len(stats.Sources) == 0 {
+		return
+	}
+	payload, err := json.Marshal(stats)
+	if err != nil {
+		log.Printf("Failed to marshal pipeline stats: %v", err)
+		return
+	}
+	if err := m.publish(deviceTopic("pipeline-stats"), payload); err != nil {
+		log.Printf("Failed to publish pipeline stats: %v", err)
+		return
+	}
+	metrics.Inc("pipeline.stats_published")
+}
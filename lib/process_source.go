@@ -0,0 +1,348 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"os/exec"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pion/rtp"
+)
+
+// Process sources run a capture and encoding process, a GStreamer pipeline
+// (see gstreamer_source.go) or ffmpeg (see camera_capture.go), that sends
+// H.264 as RTP to a loopback UDP port, so frames arrive whole, marked by
+// the RTP marker bit. The process is restarted restartDelay after it exits
+// or sends nothing for timeout.
+//
+// An ffmpeg process run with progress reports, on stdout, the frames into
+// its encoder and those it dropped (see pipeline_stats.go).
+//
+// Such processes cannot be asked for a keyframe while they run, but a new
+// one starts with one, so ForceKeyframe restarts the process. Restarting
+// leaves a gap as long as the process takes to start, so the source only
+// restarts it when the process's own next keyframe, judged from the
+// interval between its last two, is further off than that.
+
+// processPayloadType is the RTP payload type processes send
+const processPayloadType = 96
+
+// processSource streams a camera's frames from a process
+type processSource struct {
+	name string // for logs and errors, e.g. "GStreamer pipeline test"
+	// command returns the process to run, sending RTP to port, each time
+	// it is started
+	command func(port int) (*exec.Cmd, error)
+	// ended, if set, hears of each run of the process ending, and how many
+	// frames it streamed
+	ended func(frames int, err error)
+	// retime, if set, corrects the timing of each frame, e.g. by when what
+	// the process was fed was captured, given the frame's RTP timestamp
+	retime func(frame *VideoFrame, timestamp uint32)
+	// prepare, if set, runs before each run's command, e.g. waiting for
+	// what the command depends on, and returns early once stop closes
+	prepare      func(stop <-chan struct{}) error
+	afterRun     func() // if set, runs after each run, however it ended
+	timeout      time.Duration
+	restartDelay time.Duration
+	metric       string         // counter of restarts
+	cost         func() float64 // estimates the process's CPU cores, if set
+	progress     bool           // the process is ffmpeg, with -progress pipe:1
+	onDemand     bool           // see onDemandSource
+	stats        VideoSourceStats
+	stop         chan struct{}
+	done         chan struct{}
+	cmd          *exec.Cmd      // of the running process, killed by Stop
+	conn         net.PacketConn // the process's RTP arrives on, closed by Stop
+	// Keyframes of the running process, see ForceKeyframe
+	lastKeyframe     time.Time
+	keyframeInterval time.Duration // between its last two, 0 until then
+	startup          time.Duration // from the last start to the first frame
+	forcing          bool          // the process was killed for a keyframe
+	mu               sync.Mutex
+}
+
+// Start implements VideoSource
+func (s *processSource) Start(sink SampleSink) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.stop != nil {
+		return fmt.Errorf("%s already started", s.name)
+	}
+	s.stop = make(chan struct{})
+	s.done = make(chan struct{})
+	go s.run(sink, s.stop, s.done)
+	return nil
+}
+
+// Stop implements VideoSource
+func (s *processSource) Stop() {
+	s.mu.Lock()
+	stop, done := s.stop, s.done
+	s.stop, s.done = nil, nil
+	if stop != nil {
+		close(stop)
+	}
+	cmd, conn := s.cmd, s.conn
+	s.mu.Unlock()
+
+	if stop != nil {
+		// Ends a run blocked reading the process
+		if conn != nil {
+			conn.Close()
+		}
+		if cmd != nil && cmd.Process != nil {
+			cmd.Process.Kill()
+		}
+		<-done
+	}
+}
+
+// ForceKeyframe implements VideoSource, see above
+func (s *processSource) ForceKeyframe() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	// A process yet to send its first keyframe is about to
+	if s.cmd == nil || s.cmd.Process == nil || s.lastKeyframe.IsZero() || s.forcing {
+		return
+	}
+	if s.keyframeInterval > 0 && time.Until(s.lastKeyframe.Add(s.keyframeInterval)) <= s.startup {
+		metrics.Inc("video.keyframe_waits")
+		return
+	}
+	s.forcing = true
+	s.stats.Keyframes++
+	metrics.Inc("video.keyframe_restarts")
+	s.cmd.Process.Kill()
+}
+
+// cpuCost implements cpuCoster
+func (s *processSource) cpuCost() float64 {
+	if s.cost == nil {
+		return defaultSourceCost
+	}
+	return s.cost()
+}
+
+// streamsOnDemand implements onDemandSource
+func (s *processSource) streamsOnDemand() bool {
+	return s.onDemand
+}
+
+// Stats implements VideoSource
+func (s *processSource) Stats() VideoSourceStats {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.stats
+}
+
+// run runs the process, restarting it after it ends, until stop closes or
+// the sink stops
+func (s *processSource) run(sink SampleSink, stop chan struct{}, done chan struct{}) {
+	defer close(done)
+
+	failing := false // runs are failing, already reported
+	for {
+		frames, err := s.runProcess(sink, stop)
+		select {
+		case <-stop:
+			log.Printf("Stopped %s", s.name)
+			return
+		default:
+		}
+		if err == errSinkStopped {
+			return
+		}
+		s.mu.Lock()
+		forced := s.forcing
+		s.forcing = false
+		s.mu.Unlock()
+		s.mu.Lock()
+		s.stats.Restarts++
+		s.mu.Unlock()
+		if forced {
+			log.Printf("Restarting %s for a keyframe", s.name)
+			failing = false
+			continue
+		}
+		if s.ended != nil {
+			s.ended(frames, err)
+		}
+		if frames > 0 {
+			failing = false
+		}
+
+		s.mu.Lock()
+		s.stats.Errors++
+		s.mu.Unlock()
+		metrics.Inc(s.metric)
+		log.Printf("%s ended: %v, restarting in %s", s.name, err, s.restartDelay)
+		if !failing {
+			sink.ReportError(fmt.Errorf("%s: %v", s.name, err))
+		}
+		failing = true
+
+		select {
+		case <-stop:
+			return
+		case <-time.After(s.restartDelay):
+		}
+	}
+}
+
+// runProcess runs the process once and streams its frames to sink until it
+// ends, returning how many it streamed
+func (s *processSource) runProcess(sink SampleSink, stop chan struct{}) (int, error) {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		return 0, err
+	}
+	defer conn.Close()
+
+	if s.afterRun != nil {
+		defer s.afterRun()
+	}
+	if s.prepare != nil {
+		if err := s.prepare(stop); err != nil {
+			return 0, err
+		}
+	}
+	cmd, err := s.command(conn.LocalAddr().(*net.UDPAddr).Port)
+	if err != nil {
+		return 0, err
+	}
+	if err := sandboxCommand(cmd); err != nil {
+		return 0, err
+	}
+	cmd.Stderr = log.Writer()
+	if s.progress {
+		s.mu.Lock()
+		cmd.Stdout = &ffmpegProgress{source: s, base: s.stats}
+		s.mu.Unlock()
+	}
+
+	s.mu.Lock()
+	select {
+	case <-stop:
+		s.mu.Unlock()
+		return 0, nil
+	default:
+	}
+	if err := cmd.Start(); err != nil {
+		s.mu.Unlock()
+		return 0, err
+	}
+	s.cmd, s.conn = cmd, conn
+	s.lastKeyframe, s.keyframeInterval = time.Time{}, 0
+	s.mu.Unlock()
+	started := time.Now()
+	log.Printf("Started %s: %v", s.name, cmd.Args)
+
+	// The process exiting ends the read below at once
+	exited := make(chan struct{})
+	var exitErr error
+	go func() {
+		exitErr = cmd.Wait()
+		conn.Close()
+		close(exited)
+	}()
+	defer func() {
+		s.mu.Lock()
+		s.cmd, s.conn = nil, nil
+		s.mu.Unlock()
+		cmd.Process.Kill()
+		<-exited
+	}()
+
+	frames := 0
+	assembler := newRTPFrameAssembler(mediaClock, nil, nil)
+	buffer := make([]byte, 65536)
+	for {
+		conn.SetReadDeadline(time.Now().Add(s.timeout))
+		n, _, err := conn.ReadFrom(buffer)
+		if errors.Is(err, net.ErrClosed) {
+			<-exited
+			return frames, fmt.Errorf("process exited: %v", exitErr)
+		}
+		if err != nil {
+			return frames, err
+		}
+		var packet rtp.Packet
+		if err := packet.Unmarshal(buffer[:n]); err != nil || packet.PayloadType != processPayloadType {
+			continue
+		}
+		frame, ok := assembler.push(&packet)
+		if !ok {
+			continue
+		}
+		if s.retime != nil {
+			s.retime(&frame, assembler.lastTimestamp)
+		}
+		if !sink.WriteFrame(frame) {
+			return frames, errSinkStopped
+		}
+		frames++
+		s.mu.Lock()
+		s.stats.Frames++
+		s.stats.Bytes += uint64(len(frame.Data))
+		if frames == 1 {
+			s.startup = time.Since(started)
+		}
+		if hasIDR(frame.Data) {
+			now := time.Now()
+			if !s.lastKeyframe.IsZero() {
+				s.keyframeInterval = now.Sub(s.lastKeyframe)
+			}
+			s.lastKeyframe = now
+		}
+		s.mu.Unlock()
+	}
+}
+
+// ffmpegProgress takes the -progress reports of one run of an ffmpeg
+// process source, blocks of key=value lines ending with progress=, into the
+// source's stats
+type ffmpegProgress struct {
+	source           *processSource
+	base             VideoSourceStats // the source's, as the run started
+	line             []byte           // unterminated
+	frame, drop, dup uint64           // of the block being read
+}
+
+// Write implements io.Writer
+func (p *ffmpegProgress) Write(data []byte) (int, error) {
+	p.line = append(p.line, data...)
+	for {
+		end := bytes.IndexByte(p.line, '\n')
+		if end < 0 {
+			return len(data), nil
+		}
+		key, value, _ := strings.Cut(strings.TrimSpace(string(p.line[:end])), "=")
+		p.line = p.line[end+1:]
+		n, _ := strconv.ParseUint(value, 10, 64)
+		switch key {
+		case "frame":
+			p.frame = n
+		case "drop_frames":
+			p.drop = n
+		case "dup_frames":
+			p.dup = n
+		case "progress":
+			// Frames out are those in, less those dropped, plus those
+			// duplicated to keep the frame rate
+			input := p.frame + p.drop - min(p.dup, p.frame+p.drop)
+			p.source.mu.Lock()
+			p.source.stats.InputFrames = p.base.InputFrames + input
+			p.source.stats.Dropped = p.base.Dropped + p.drop
+			p.source.mu.Unlock()
+		}
+	}
+}
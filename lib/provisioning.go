@@ -0,0 +1,193 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"strings"
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+)
+
+// DeviceIdentity is how this robot connects to the broker and names its
+// topics. It defaults to the constants and is replaced by the provisioned
+// identity once the robot has registered.
+type DeviceIdentity struct {
+	Broker    string `json:"broker"`
+	Port      int    `json:"port"`
+	Username  string `json:"username"`
+	Password  string `json:"password"`
+	ThingName string `json:"thingName"`
+	ClientID  string `json:"clientId"`
+	// TopicPrefix is what {thing} expands to in topic templates; it
+	// defaults to ThingName
+	TopicPrefix string `json:"topicPrefix,omitempty"`
+}
+
+// identity is the active device identity
+var identity = DeviceIdentity{
+	Broker:    broker,
+	Port:      port,
+	Username:  username,
+	Password:  password,
+	ThingName: thingName,
+	ClientID:  clientID,
+}
+
+// topicThing returns the value of the {thing} placeholder
+func (d DeviceIdentity) topicThing() string {
+	if d.TopicPrefix != "" {
+		return d.TopicPrefix
+	}
+	return d.ThingName
+}
+
+// setIdentity switches to id, filling unset fields from the current identity
+func setIdentity(id DeviceIdentity) {
+	if id.Broker == "" {
+		id.Broker = identity.Broker
+	}
+	if id.Port == 0 {
+		id.Port = identity.Port
+	}
+	if id.ClientID == "" {
+		id.ClientID = identity.ClientID
+	}
+	identity = id
+	peerTopicPattern = compileTopicPattern(peerTopicTemplate)
+}
+
+// ProvisioningRequest is published by an unregistered robot
+type ProvisioningRequest struct {
+	HardwareID string `json:"hardwareId"`
+	Hostname   string `json:"hostname"`
+}
+
+// hardwareID identifies this machine: its systemd machine ID, or the first
+// hardware address if there is none
+func hardwareID() (string, error) {
+	if data, err := os.ReadFile("/etc/machine-id"); err == nil {
+		if id := strings.TrimSpace(string(data)); id != "" {
+			return id, nil
+		}
+	}
+
+	interfaces, err := net.Interfaces()
+	if err != nil {
+		return "", err
+	}
+	for _, iface := range interfaces {
+		if iface.Flags&net.FlagLoopback == 0 && len(iface.HardwareAddr) > 0 {
+			return strings.ReplaceAll(iface.HardwareAddr.String(), ":", ""), nil
+		}
+	}
+	return "", fmt.Errorf("no machine ID or hardware address found")
+}
+
+// LoadOrProvisionIdentity activates the identity stored at path. If there is
+// none yet, it registers with the provisioning service using the bootstrap
+// credentials from constants.go and stores the identity it receives.
+func LoadOrProvisionIdentity(path string) error {
+	data, err := os.ReadFile(path)
+	if err == nil {
+		var stored DeviceIdentity
+		if err := json.Unmarshal(data, &stored); err != nil {
+			return fmt.Errorf("invalid identity file %s: %v", path, err)
+		}
+		setIdentity(stored)
+		log.Printf("Loaded device identity %s from %s", identity.ThingName, path)
+		return nil
+	}
+	if !os.IsNotExist(err) {
+		return fmt.Errorf("failed to read identity file %s: %v", path, err)
+	}
+
+	provisioned, err := provision()
+	if err != nil {
+		return err
+	}
+
+	data, err = json.MarshalIndent(provisioned, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to encode identity: %v", err)
+	}
+	// Holds broker credentials
+	if err := os.WriteFile(path, data, 0600); err != nil {
+		return fmt.Errorf("failed to store identity in %s: %v", path, err)
+	}
+
+	setIdentity(provisioned)
+	log.Printf("Provisioned as %s, identity stored in %s", identity.ThingName, path)
+	return nil
+}
+
+// provision publishes a registration request on
+// <provisioningTopicPrefix>/<hardwareId>/request and waits for the identity
+// on .../response
+func provision() (DeviceIdentity, error) {
+	hwID, err := hardwareID()
+	if err != nil {
+		return DeviceIdentity{}, fmt.Errorf("failed to determine hardware ID: %v", err)
+	}
+	hostname, _ := os.Hostname()
+
+	dialer, err := mqttDialer(activeMQTTProfile())
+	if err != nil {
+		return DeviceIdentity{}, fmt.Errorf("failed to set up MQTT network: %v", err)
+	}
+
+	opts := mqtt.NewClientOptions()
+	opts.AddBroker(fmt.Sprintf("tcp://%s:%d", broker, port))
+	opts.SetDialer(dialer)
+	opts.SetClientID(fmt.Sprintf("%s-provisioning-%s", clientID, hwID))
+	opts.SetUsername(username)
+	opts.SetPassword(password)
+	opts.SetCleanSession(true)
+
+	client := mqtt.NewClient(opts)
+	if err := waitToken(client.Connect()); err != nil {
+		return DeviceIdentity{}, fmt.Errorf("failed to connect for provisioning: %v", err)
+	}
+	defer client.Disconnect(250)
+
+	responses := make(chan DeviceIdentity, 1)
+	responseTopic := fmt.Sprintf("%s/%s/response", provisioningTopicPrefix, hwID)
+	token := client.Subscribe(responseTopic, 1, func(client mqtt.Client, msg mqtt.Message) {
+		var provisioned DeviceIdentity
+		if err := json.Unmarshal(msg.Payload(), &provisioned); err != nil {
+			log.Printf("Invalid provisioning response: %v", err)
+			return
+		}
+		if provisioned.ThingName == "" {
+			log.Println("Provisioning response has no thingName, ignoring")
+			return
+		}
+		select {
+		case responses <- provisioned:
+		default:
+		}
+	})
+	if err := waitToken(token); err != nil {
+		return DeviceIdentity{}, fmt.Errorf("failed to subscribe to %s: %v", responseTopic, err)
+	}
+
+	request, err := json.Marshal(ProvisioningRequest{HardwareID: hwID, Hostname: hostname})
+	if err != nil {
+		return DeviceIdentity{}, err
+	}
+	requestTopic := fmt.Sprintf("%s/%s/request", provisioningTopicPrefix, hwID)
+	if err := waitToken(client.Publish(requestTopic, 1, false, request)); err != nil {
+		return DeviceIdentity{}, fmt.Errorf("failed to publish registration request: %v", err)
+	}
+	log.Printf("Registration request sent for hardware ID %s, waiting for provisioning", hwID)
+
+	select {
+	case provisioned := <-responses:
+		return provisioned, nil
+	case <-time.After(provisioningTimeout):
+		return DeviceIdentity{}, fmt.Errorf("no provisioning response within %s", provisioningTimeout)
+	}
+}
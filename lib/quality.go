@@ -0,0 +1,40 @@
+package main
+
+// Connection quality: each peer's stats are boiled down to a 0-100 score
+// and 0-4 signal bars for the operator UI. Round trip time and loss weigh
+// the most, the bandwidth estimate counts against the top bitrate.
+
+// Quality score weights, summing to 100
+const (
+	qualityWeightRTT       = 40
+	qualityWeightLoss      = 40
+	qualityWeightBandwidth = 20
+)
+
+// peerQuality scores peerStats
+func peerQuality(peerStats PeerStats) PeerQuality {
+	rtt := 1 - (peerStats.RoundTripTimeMs-qualityGoodRTTMs)/(qualityBadRTTMs-qualityGoodRTTMs)
+	loss := 1 - peerStats.FractionLost/qualityBadLoss
+	// No estimate yet is no evidence of a poor link
+	bandwidth := 1.0
+	if peerStats.EstimatedBitrateBps > 0 {
+		bandwidth = float64(peerStats.EstimatedBitrateBps) / abrMaxBitrate
+	}
+	score := int64(qualityWeightRTT*clampUnit(rtt) + qualityWeightLoss*clampUnit(loss) + qualityWeightBandwidth*clampUnit(bandwidth) + 0.5)
+
+	return PeerQuality{
+		Schema:              PeerQualitySchema,
+		PeerID:              peerStats.PeerID,
+		Score:               score,
+		Bars:                (score + 24) / 25,
+		RoundTripTimeMs:     peerStats.RoundTripTimeMs,
+		FractionLost:        peerStats.FractionLost,
+		EstimatedBitrateBps: peerStats.EstimatedBitrateBps,
+		Time:                peerStats.Time,
+	}
+}
+
+// clampUnit clamps v to [0, 1]
+func clampUnit(v float64) float64 {
+	return min(max(v, 0), 1)
+}
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"log"
+	"time"
+)
+
+// Reasons of peer_reaped events
+const (
+	ReapSilent  = "silent"
+	ReapStale   = "stale"
+	ReapEvicted = "evicted" // to admit a new peer, see peerAdmissionPolicy
+)
+
+// peerLiveness tracks the two signs of life a peer can give: explicit
+// keepalives and traffic on its ICE transport
+type peerLiveness struct {
+	lastKeepalive time.Time
+	lastBytes     uint64
+	lastTraffic   time.Time
+}
+
+// HandleKeepalive records a keepalive from peerID
+func (s *Signaler) HandleKeepalive(peerID string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if liveness, ok := s.liveness[peerID]; ok {
+		liveness.lastKeepalive = time.Now()
+	}
+}
+
+// trackLiveness starts liveness tracking for a newly answered peer
+func (s *Signaler) trackLiveness(peerID string) {
+	now := time.Now()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.liveness[peerID] = &peerLiveness{
+		lastKeepalive: now,
+		lastTraffic:   now,
+	}
+}
+
+// StartReaper periodically disconnects peers whose keepalives and ICE
+// traffic have both been silent for peerKeepaliveTimeout, e.g. tablets that
+// lost power without sending disconnect-client, and peers that never
+// connected or stayed disconnected for peerStaleTimeout
+func (s *Signaler) StartReaper() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.stopReaper != nil {
+		return
+	}
+	s.stopReaper = make(chan struct{})
+	go s.reapLoop(s.stopReaper)
+}
+
+func (s *Signaler) reapLoop(stop chan struct{}) {
+	ticker := time.NewTicker(peerReapInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+			reaped := make(map[string]bool)
+			for _, peerID := range s.silentPeers() {
+				log.Printf("[%s] No keepalive or ICE traffic for %s, reaping peer", peerID, peerKeepaliveTimeout)
+				metrics.Inc("signaling.peers_reaped")
+				mirrorEvent(SignalingEvent{Type: EventPeerReaped, PeerID: peerID, Reason: ReapSilent})
+				s.HandleDisconnect(peerID)
+				reaped[peerID] = true
+			}
+			if peerStaleTimeout <= 0 {
+				continue
+			}
+			for peerID, state := range s.webrtcManager.StalePeers(peerStaleTimeout) {
+				if reaped[peerID] {
+					continue
+				}
+				log.Printf("[%s] Stuck in %s for %s, reaping peer", peerID, state, peerStaleTimeout)
+				metrics.Inc("signaling.peers_stale")
+				mirrorEvent(SignalingEvent{Type: EventPeerReaped, PeerID: peerID, State: state.String(), Reason: ReapStale})
+				s.HandleDisconnect(peerID)
+			}
+		}
+	}
+}
+
+// silentPeers refreshes traffic counters and returns the peers to reap
+func (s *Signaler) silentPeers() []string {
+	now := time.Now()
+	var silent []string
+
+	for _, peerID := range s.webrtcManager.PeerIDs() {
+		bytesReceived, ok := s.webrtcManager.BytesReceived(peerID)
+		if !ok {
+			continue
+		}
+
+		s.mu.Lock()
+		liveness, tracked := s.liveness[peerID]
+		if tracked {
+			if bytesReceived != liveness.lastBytes {
+				liveness.lastBytes = bytesReceived
+				liveness.lastTraffic = now
+			}
+			if now.Sub(liveness.lastKeepalive) > peerKeepaliveTimeout && now.Sub(liveness.lastTraffic) > peerKeepaliveTimeout {
+				silent = append(silent, peerID)
+			}
+		}
+		s.mu.Unlock()
+	}
+
+	return silent
+}
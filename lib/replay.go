@@ -0,0 +1,179 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Recorded event kinds
+const (
+	EventMQTTMessage       = "mqtt"
+	EventCameraSwitch      = "camera-switch"
+	EventCameraGroupSwitch = "camera-group-switch"
+)
+
+// RecordedEvent is one external input captured by the Recorder
+type RecordedEvent struct {
+	Offset  time.Duration `json:"offset"` // time since recording started
+	Kind    string        `json:"kind"`
+	Topic   string        `json:"topic,omitempty"`
+	Payload []byte        `json:"payload,omitempty"`
+}
+
+// Recorder appends every external input to a JSON-lines file so a session
+// can be replayed later with the same ordering and timing
+type Recorder struct {
+	file    *os.File
+	encoder *json.Encoder
+	start   time.Time
+	mu      sync.Mutex
+}
+
+func NewRecorder(path string) (*Recorder, error) {
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0644)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create recording %s: %v", path, err)
+	}
+
+	log.Printf("Recording external inputs to %s", path)
+	return &Recorder{
+		file:    file,
+		encoder: json.NewEncoder(file),
+		start:   time.Now(),
+	}, nil
+}
+
+func (r *Recorder) Record(kind, topic string, payload []byte) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.file == nil {
+		return
+	}
+
+	event := RecordedEvent{
+		Offset:  time.Since(r.start),
+		Kind:    kind,
+		Topic:   topic,
+		Payload: append([]byte(nil), payload...),
+	}
+	if err := r.encoder.Encode(event); err != nil {
+		log.Printf("Failed to record %s event: %v", kind, err)
+	}
+}
+
+func (r *Recorder) Close() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.file == nil {
+		return nil
+	}
+	err := r.file.Close()
+	r.file = nil
+	log.Println("Recording stopped")
+	return err
+}
+
+// LoadRecording reads every event from a file written by a Recorder
+func LoadRecording(path string) ([]RecordedEvent, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open recording %s: %v", path, err)
+	}
+	defer file.Close()
+
+	var events []RecordedEvent
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 64*1024), 16*1024*1024) // SDP offers can be large
+	for line := 1; scanner.Scan(); line++ {
+		var event RecordedEvent
+		if err := json.Unmarshal(scanner.Bytes(), &event); err != nil {
+			return nil, fmt.Errorf("invalid event on line %d: %v", line, err)
+		}
+		events = append(events, event)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	return events, nil
+}
+
+// SetRecorder starts capturing every incoming message; nil stops capturing
+func (m *MQTTClient) SetRecorder(recorder *Recorder) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.recorder = recorder
+}
+
+func (m *MQTTClient) recordEvent(kind, topic string, payload []byte) {
+	m.mu.Lock()
+	recorder := m.recorder
+	m.mu.Unlock()
+
+	if recorder != nil {
+		recorder.Record(kind, topic, payload)
+	}
+}
+
+func (m *MQTTClient) recordMessage(topic string, payload []byte) {
+	m.recordEvent(EventMQTTMessage, topic, payload)
+}
+
+// Replay feeds recorded events through the same handlers used for live
+// traffic, one at a time and in their original order. With realtime set the
+// original gaps between events are reproduced; otherwise events run
+// back-to-back, which makes the sequence fully deterministic.
+func (m *MQTTClient) Replay(events []RecordedEvent, realtime bool) {
+	var clock Clock
+	if realtime {
+		clock = realClock{}
+	}
+	m.replay(events, clock)
+}
+
+// replay feeds events as Replay does, each at its offset on clock, or
+// back-to-back without one
+func (m *MQTTClient) replay(events []RecordedEvent, clock Clock) {
+	log.Printf("Replaying %d recorded events (realtime: %v)", len(events), clock != nil)
+
+	var start time.Time
+	if clock != nil {
+		start = clock.Now()
+	}
+	for _, event := range events {
+		if clock != nil {
+			timer := clock.NewTimer(event.Offset - clock.Now().Sub(start))
+			<-timer.C()
+		}
+
+		switch event.Kind {
+		case EventMQTTMessage:
+			m.dispatch(event.Topic, event.Payload)
+		case EventCameraSwitch:
+			cameraNumber, err := strconv.Atoi(string(event.Payload))
+			if err != nil {
+				log.Printf("Invalid recorded camera switch %q: %v", event.Payload, err)
+				continue
+			}
+			if err := m.webrtcManager.SwitchCamera(cameraNumber); err != nil {
+				log.Printf("Failed to switch camera: %v", err)
+			}
+		case EventCameraGroupSwitch:
+			if err := m.webrtcManager.SwitchCameraGroup(string(event.Payload)); err != nil {
+				log.Printf("Failed to switch camera group: %v", err)
+			}
+		default:
+			log.Printf("Skipping unknown recorded event kind: %s", event.Kind)
+		}
+	}
+
+	log.Println("Replay finished")
+}
@@ -0,0 +1,129 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// replayTestTimeout bounds how long, in real time, the replay may take to
+// handle an event and wait for the next
+const replayTestTimeout = 10 * time.Second
+
+// TestReplayFixture replays testdata/replay_two_peers.jsonl, recorded from
+// two browsers, on a VirtualClock, checking the state after each event
+// before letting the clock on to the next
+func TestReplayFixture(t *testing.T) {
+	events, err := LoadRecording("testdata/replay_two_peers.jsonl")
+	if err != nil {
+		t.Fatal(err)
+	}
+	withCameraFiles(t, 1, 2, 3)
+
+	// What holds once each event, in the fixture's order, has been handled
+	steps := []struct {
+		event     string
+		connected []string
+		gone      []string
+		camera    int
+	}{
+		{event: "tablet-1 offers", connected: []string{"tablet-1"}, gone: []string{"tablet-2"}, camera: 1},
+		{event: "tablet-1 sends candidates", connected: []string{"tablet-1"}, gone: []string{"tablet-2"}, camera: 1},
+		{event: "tablet-2 offers", connected: []string{"tablet-1", "tablet-2"}, camera: 1},
+		{event: "tablet-2 sends candidates", connected: []string{"tablet-1", "tablet-2"}, camera: 1},
+		{event: "camera 2 on MQTT", connected: []string{"tablet-1", "tablet-2"}, camera: 2},
+		{event: "tablet-1 disconnects", connected: []string{"tablet-2"}, gone: []string{"tablet-1"}, camera: 2},
+		{event: "camera 3 switched", connected: []string{"tablet-2"}, gone: []string{"tablet-1"}, camera: 3},
+	}
+	if len(events) != len(steps) {
+		t.Fatalf("fixture has %d events, want %d", len(events), len(steps))
+	}
+
+	manager, err := NewWebRTCManager()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer manager.Close()
+	client := NewMQTTClient(manager, NewSignaler(manager))
+
+	clock := NewVirtualClock(time.Unix(0, 0))
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		client.replay(events, clock)
+	}()
+
+	for i, step := range steps {
+		// The replay has handled event i once it waits for the next, or
+		// is done after the last
+		deadline := time.Now().Add(replayTestTimeout)
+		for clock.Timers() == 0 {
+			if i == len(steps)-1 && isClosed(done) {
+				break
+			}
+			if time.Now().After(deadline) {
+				t.Fatalf("%s: not handled within %s", step.event, replayTestTimeout)
+			}
+			time.Sleep(time.Millisecond)
+		}
+
+		for _, peerID := range step.connected {
+			if !manager.HasPeer(peerID) {
+				t.Errorf("%s: %s has no connection", step.event, peerID)
+			}
+		}
+		for _, peerID := range step.gone {
+			if manager.HasPeer(peerID) {
+				t.Errorf("%s: %s has a connection", step.event, peerID)
+			}
+		}
+		if camera := int(manager.outputs[0].camera.Load()); camera != step.camera {
+			t.Errorf("%s: camera %d, want %d", step.event, camera, step.camera)
+		}
+
+		if i+1 < len(events) {
+			clock.Advance(events[i+1].Offset - events[i].Offset)
+		}
+	}
+
+	select {
+	case <-done:
+	case <-time.After(replayTestTimeout):
+		t.Fatal("replay did not finish")
+	}
+}
+
+// withCameraFiles runs the rest of the test in a directory of its own,
+// with a frame of synthetic H.264 for each of cameras
+func withCameraFiles(t *testing.T, cameras ...int) {
+	dir := t.TempDir()
+	for _, camera := range cameras {
+		address, _ := cameraAddress(camera)
+		cameraDir := filepath.Join(dir, address)
+		if err := os.MkdirAll(cameraDir, 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := writeSyntheticFrames(cameraDir, 1, time.Unix(0, 0), time.Second/30); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chdir(dir); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.Chdir(wd) })
+}
+
+func isClosed(done <-chan struct{}) bool {
+	select {
+	case <-done:
+		return true
+	default:
+		return false
+	}
+}
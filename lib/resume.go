@@ -0,0 +1,246 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"log"
+	"sync"
+	"time"
+)
+
+// Session resumption: every answer is followed by a resume token. A peer
+// that reconnects, e.g. an operator's tablet changing networks, sends it
+// back as "resume" in its offer within resumeTokenTTL of its connection
+// ending, and the offer is answered with the capabilities the token was
+// issued with: the same cameras and stream settings, without waiting for
+// its capabilities. The offer is authorized as any other, and its role is
+// the one its auth token grants, kept a viewer if the session was one: a
+// token restores stream state, never a role. The stream is started while
+// the peer connects, and a keyframe sent as soon as it has, so video
+// resumes without waiting for a PLI.
+//
+// Tokens only travel on channels private to the peer: its WebSocket, or
+// for MQTT peers the key channel (see key_channel.go), never the broker.
+// They are single use, each answer brings a new one, and are held in
+// memory only: a restarted backend asks peers to re-offer instead (see
+// session_store.go). A peer disconnected on purpose, by itself or an
+// admin, loses its token.
+
+// resumeTokenSize is the number of random bytes in a token
+const resumeTokenSize = 32
+
+// resumeSession is what a resume token restores
+type resumeSession struct {
+	peerID    string
+	caps      PeerCapabilities
+	connected bool
+	// since is when the token was issued, or the peer's connection last
+	// ended; the token expires resumeTokenTTL after it unless connected
+	since time.Time
+}
+
+// expired reports whether the session can no longer be resumed at now
+func (r *resumeSession) expired(now time.Time) bool {
+	return !r.connected && now.Sub(r.since) >= resumeTokenTTL
+}
+
+// resumeTokens holds each peer's live resume token
+type resumeTokens struct {
+	sessions map[string]*resumeSession // by token
+	tokens   map[string]string         // each peer's token
+	// priming holds resumed peers to send a keyframe once connected
+	priming map[string]bool
+	mu      sync.Mutex
+}
+
+func newResumeTokens() *resumeTokens {
+	return &resumeTokens{
+		sessions: make(map[string]*resumeSession),
+		tokens:   make(map[string]string),
+		priming:  make(map[string]bool),
+	}
+}
+
+// issue replaces peerID's token with a new one restoring caps
+func (t *resumeTokens) issue(peerID string, caps PeerCapabilities) (string, error) {
+	random := make([]byte, resumeTokenSize)
+	if _, err := rand.Read(random); err != nil {
+		return "", err
+	}
+	token := base64.RawURLEncoding.EncodeToString(random)
+	caps.Resume = ""
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	now := time.Now()
+	for oldToken, session := range t.sessions {
+		if session.expired(now) {
+			t.revokeLocked(session.peerID, oldToken)
+		}
+	}
+	t.revokeLocked(peerID, t.tokens[peerID])
+	t.sessions[token] = &resumeSession{peerID: peerID, caps: caps, since: now}
+	t.tokens[peerID] = token
+	return token, nil
+}
+
+// take spends peerID's token and returns the capabilities it restores. ok
+// is false for tokens that are unknown, expired or another peer's.
+func (t *resumeTokens) take(peerID string, token string) (PeerCapabilities, bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	session, ok := t.sessions[token]
+	if !ok || session.peerID != peerID {
+		return PeerCapabilities{}, false
+	}
+	t.revokeLocked(peerID, token)
+	if session.expired(time.Now()) {
+		return PeerCapabilities{}, false
+	}
+	return session.caps, true
+}
+
+// revoke forgets peerID's token
+func (t *resumeTokens) revoke(peerID string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.revokeLocked(peerID, t.tokens[peerID])
+	delete(t.priming, peerID)
+}
+
+// revokeLocked forgets token, peerID's, with t.mu held
+func (t *resumeTokens) revokeLocked(peerID string, token string) {
+	delete(t.sessions, token)
+	if t.tokens[peerID] == token {
+		delete(t.tokens, peerID)
+	}
+}
+
+// setConnected records peerID's connection going up or down, which stops
+// and restarts the token's expiry
+func (t *resumeTokens) setConnected(peerID string, connected bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	session, ok := t.sessions[t.tokens[peerID]]
+	if !ok || session.connected == connected {
+		return
+	}
+	session.connected = connected
+	if !connected {
+		session.since = time.Now()
+	}
+}
+
+// prime marks peerID for a keyframe once connected
+func (t *resumeTokens) prime(peerID string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.priming[peerID] = true
+}
+
+// takePriming reports whether peerID was marked by prime, and unmarks it
+func (t *resumeTokens) takePriming(peerID string) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if !t.priming[peerID] {
+		return false
+	}
+	delete(t.priming, peerID)
+	return true
+}
+
+// watchResumes follows peers' connections for their tokens' expiry, and
+// sends resumed peers a keyframe as they connect
+func (s *Signaler) watchResumes(bus *EventBus) {
+	bus.OnPeerConnected(func(event PeerEvent) {
+		s.resumes.setConnected(event.PeerID, true)
+		if s.resumes.takePriming(event.PeerID) {
+			s.webrtcManager.RequestPeerKeyframe(event.PeerID, "Session resume")
+		}
+	})
+	bus.OnPeerDisconnected(func(event PeerEvent) {
+		s.resumes.setConnected(event.PeerID, false)
+	})
+}
+
+// resumeCapabilities returns the capabilities caps.Resume restores, with
+// any metadata the offer carries. ok is false if the offer has no token or
+// it cannot be resumed, and the offer is negotiated afresh.
+func (s *Signaler) resumeCapabilities(peerID string, caps PeerCapabilities) (PeerCapabilities, bool) {
+	if caps.Resume == "" {
+		return caps, false
+	}
+	restored, ok := s.resumes.take(peerID, caps.Resume)
+	if !ok {
+		log.Printf("[%s] Resume token unknown or expired, negotiating afresh", peerID)
+		metrics.Inc("signaling.resumes_rejected")
+		return caps, false
+	}
+	if metadata := cleanPeerMetadata(caps.Metadata); metadata != (PeerMetadata{}) {
+		restored.Metadata = metadata
+	}
+	log.Printf("[%s] Resuming session: role %s, cameras %v", peerID, restored.Role, restored.Cameras)
+	metrics.Inc("signaling.sessions_resumed")
+	return restored, true
+}
+
+// sendResume issues peerID a new resume token restoring caps and sends it,
+// right after its answer
+func (s *Signaler) sendResume(transport SignalingTransport, peerID string, caps PeerCapabilities) {
+	if resumeTokenTTL <= 0 {
+		return
+	}
+	token, err := s.resumes.issue(peerID, caps)
+	if err != nil {
+		log.Printf("Failed to issue resume token: %v", err)
+		return
+	}
+	resume := ResumeToken{
+		Schema:     ResumeTokenSchema,
+		Token:      token,
+		TTLSeconds: int(resumeTokenTTL / time.Second),
+		Time:       time.Now().UTC(),
+	}
+	if err := transport.SendResume(peerID, resume); err != nil {
+		log.Printf("Failed to send resume token: %v", err)
+	}
+}
+
+// RevokeResume forgets peerID's resume token, for peers disconnected on
+// purpose
+func (s *Signaler) RevokeResume(peerID string) {
+	s.resumes.revoke(peerID)
+}
+
+// primeStream starts the stream for a resumed peer without waiting for it
+// to connect, keeping a lingering one, see linger.go
+func (w *WebRTCManager) primeStream(peerID string) {
+	log.Printf("[%s] Resumed session, starting video stream before it connects", peerID)
+	w.startStreaming()
+}
+
+// RequestPeerKeyframe requests a keyframe on every track peerID receives
+func (w *WebRTCManager) RequestPeerKeyframe(peerID string, reason string) {
+	w.mu.Lock()
+	_, exists := w.peerConnections[peerID]
+	cameras := w.peerCameras[peerID]
+	w.mu.Unlock()
+	if !exists {
+		return
+	}
+
+	outputs, err := w.peerOutputs(cameras)
+	if err != nil {
+		return
+	}
+	for _, output := range outputs {
+		output.streamer.RequestKeyframe(peerID, reason)
+		for _, layer := range output.layers {
+			layer.streamer.RequestKeyframe(peerID, reason)
+		}
+	}
+}
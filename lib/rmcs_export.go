@@ -5,23 +5,54 @@ package main
 
 /*
 #include <stdlib.h>
+
+typedef int (*RMCSControlCallback)(const char* peerId, const char* type, const char* payload);
+
+static int rmcsCallControl(RMCSControlCallback callback, const char* peerId, const char* type, const char* payload) {
+	return callback(peerId, type, payload);
+}
+
+typedef void (*RMCSMediaCallback)(const char* peerId, const char* kind, const char* codec, const void* data, int size, unsigned int timestamp);
+
+static void rmcsCallMedia(RMCSMediaCallback callback, const char* peerId, const char* kind, const char* codec, const void* data, int size, unsigned int timestamp) {
+	callback(peerId, kind, codec, data, size, timestamp);
+}
 */
 import "C"
 import (
+	"encoding/json"
+	"fmt"
 	"log"
 	"os"
+	"os/signal"
+	"strconv"
 	"sync"
-	"time"
+	"syscall"
+	"unsafe"
 )
 
 var (
 	rmcsInstance *RMCSInstance
 	rmcsMutex    sync.Mutex
+	sigtermOnce  sync.Once
+
+	// controlCallback receives control messages without a Go handler
+	controlCallback   C.RMCSControlCallback
+	controlCallbackMu sync.Mutex
+
+	// mediaCallback receives the frames of operators' tracks
+	mediaCallback   C.RMCSMediaCallback
+	mediaCallbackMu sync.Mutex
 )
 
 type RMCSInstance struct {
 	client        *MQTTClient
+	signaler      *Signaler
+	wsServer      *WebSocketSignalingServer
+	whipServer    *WHIPServer
+	metricsServer *MetricsServer
 	webrtcManager *WebRTCManager
+	recorder      *Recorder
 	running       bool
 }
 
@@ -35,8 +66,39 @@ func RMCSInit() C.int {
 		return 1
 	}
 
+	// Installed first so the backlog covers startup
+	if logStreamingEnabled {
+		installLogStreamer()
+	}
+
 	log.Println("Initializing RMCS...")
 
+	// Fail closed rather than answer offers anyone could have signed
+	if err := checkOfferAuth(); err != nil {
+		log.Printf("Refusing to start: %v", err)
+		return -5
+	}
+
+	// Registers on first boot, then reuses the stored identity
+	if provisioningEnabled {
+		if err := LoadOrProvisionIdentity(identityFilePath); err != nil {
+			log.Printf("Device provisioning failed: %v", err)
+			return -4
+		}
+	}
+
+	// Before anything looks cameras up; the built-in ones stay on failure
+	if rosTopicMapPath != "" {
+		if err := loadROSTopicMap(rosTopicMapPath); err != nil {
+			log.Printf("ROS topic map not loaded: %v", err)
+		}
+	}
+	if rosServicesPath != "" {
+		if err := loadROSServices(rosServicesPath); err != nil {
+			log.Printf("ROS services not allowed: %v", err)
+		}
+	}
+
 	// Initialize WebRTC manager
 	webrtcManager, err := NewWebRTCManager()
 	if err != nil {
@@ -44,17 +106,128 @@ func RMCSInit() C.int {
 		return -1
 	}
 
-	// Initialize MQTT client
-	mqttClient := NewMQTTClient(webrtcManager)
-	if err := mqttClient.Connect(); err != nil {
-		log.Printf("Failed to connect MQTT: %v", err)
-		return -2
+	// Whatever is started from here is stopped again if starting fails, so
+	// that a retried RMCSInit finds its ports free
+	instance := &RMCSInstance{webrtcManager: webrtcManager}
+
+	// Restore state from before a restart, if a session store is configured
+	var sessions *SessionStore
+	if sessionStorePath != "" {
+		sessions, err = OpenSessionStore(sessionStorePath)
+		if err != nil {
+			log.Printf("Session store unavailable, starting fresh: %v", err)
+		} else {
+			webrtcManager.SetSessionStore(sessions)
+		}
+	}
+
+	// Mirroring is best effort, analytics being down must not stop the robot
+	if eventMirrorBackend != "" {
+		sink, err := newEventSink(eventMirrorBackend, eventMirrorURL, eventMirrorSubject)
+		if err != nil {
+			log.Printf("Event mirror unavailable: %v", err)
+		} else {
+			eventMirror = NewEventMirror(sink)
+		}
+	}
+
+	webrtcManager.Controls().SetFallback(callControlCallback)
+	webrtcManager.SetIncomingMediaSink(callMediaCallback)
+
+	signaler := NewSignaler(webrtcManager)
+	instance.signaler = signaler
+
+	// Initialize MQTT client. Without MQTT signaling it stays unconnected
+	// but still handles recording and replay.
+	mqttClient := NewMQTTClient(webrtcManager, signaler)
+	if mqttSignalingEnabled {
+		if err := mqttClient.Connect(); err != nil {
+			log.Printf("Failed to connect MQTT: %v", err)
+			instance.stop()
+			return -2
+		}
+	}
+	instance.client = mqttClient
+
+	// After connecting, so the startup diff reaches the broker
+	if configAuditPath != "" {
+		configAudit = NewConfigAuditor(configAuditPath, mqttClient.publishConfigAudit)
+		configAudit.Startup()
+	}
+
+	// Peers connected before a restart have no connection any more
+	if mqttSignalingEnabled && sessions != nil {
+		mqttClient.RequestReoffers(sessions)
 	}
 
-	rmcsInstance = &RMCSInstance{
-		client:        mqttClient,
-		webrtcManager: webrtcManager,
-		running:       true,
+	// Start the built-in WebSocket signaling server if configured
+	if webSocketSignalingAddr != "" {
+		wsServer := NewWebSocketSignalingServer(webSocketSignalingAddr, signaler)
+		if err := wsServer.Start(); err != nil {
+			log.Printf("Failed to start WebSocket signaling: %v", err)
+			instance.stop()
+			return -3
+		}
+		instance.wsServer = wsServer
+	}
+
+	// Start the WHIP/WHEP endpoints if configured
+	if whipAddr != "" {
+		whipServer := NewWHIPServer(whipAddr, signaler)
+		if err := whipServer.Start(); err != nil {
+			log.Printf("Failed to start WHIP/WHEP: %v", err)
+			instance.stop()
+			return -3
+		}
+		instance.whipServer = whipServer
+	}
+
+	// Expose the metrics endpoint if configured; metrics are still
+	// available through RMCSGetMetrics without it
+	if metricsAddr != "" {
+		metricsServer := NewMetricsServer(metricsAddr, webrtcManager)
+		if err := metricsServer.Start(); err != nil {
+			log.Printf("Failed to start metrics server: %v", err)
+		} else {
+			instance.metricsServer = metricsServer
+		}
+	}
+
+	if peerReapingEnabled {
+		signaler.StartReaper()
+	}
+	if mqttSignalingEnabled {
+		mqttClient.StartPeerStats()
+		mqttClient.StartPipelineStats()
+		mqttClient.StartROSDiscovery()
+	}
+	if adaptiveBitrateEnabled {
+		webrtcManager.StartAdaptiveBitrate()
+	}
+	if adaptiveFPSEnabled {
+		webrtcManager.StartAdaptiveFrameRate()
+	}
+	if stallWatchdogEnabled {
+		webrtcManager.StartStallWatchdog()
+	}
+	if cpuGovernorEnabled {
+		webrtcManager.StartCPUGovernor()
+	}
+	webrtcManager.StartTelemetry()
+	// Advertised ahead, so the robot listens by the first command; a
+	// failure is retried with it
+	if err := webrtcManager.advertiseEStop(); err != nil {
+		log.Printf("E-stop not advertised yet: %v", err)
+	}
+	if err := webrtcManager.advertiseTeleop(); err != nil {
+		log.Printf("Teleoperation not advertised yet: %v", err)
+	}
+
+	instance.running = true
+	rmcsInstance = instance
+
+	if drainOnSIGTERM {
+		sigtermOnce.Do(watchSIGTERM)
 	}
 
 	log.Println("RMCS initialized successfully")
@@ -73,6 +246,7 @@ func RMCSSwitchCamera(cameraNumber C.int) C.int {
 
 	camNum := int(cameraNumber)
 	log.Printf("Switching to camera %d from C++", camNum)
+	rmcsInstance.client.recordEvent(EventCameraSwitch, "", []byte(strconv.Itoa(camNum)))
 
 	if err := rmcsInstance.webrtcManager.SwitchCamera(camNum); err != nil {
 		log.Printf("Failed to switch camera: %v", err)
@@ -82,34 +256,125 @@ func RMCSSwitchCamera(cameraNumber C.int) C.int {
 	return 0
 }
 
+// RMCSSwitchCameraGroup switches every track to the cameras of a named
+// group (e.g. "front-pair") at once. Returns 0 on success, -1 if RMCS is not
+// running and -2 if the group is unknown or a camera failed to load, in
+// which case no track switched.
+//
+//export RMCSSwitchCameraGroup
+func RMCSSwitchCameraGroup(name *C.char) C.int {
+	rmcsMutex.Lock()
+	defer rmcsMutex.Unlock()
+
+	if rmcsInstance == nil || !rmcsInstance.running {
+		log.Println("RMCS not initialized")
+		return -1
+	}
+
+	group := C.GoString(name)
+	log.Printf("Switching to camera group %s from C++", group)
+	rmcsInstance.client.recordEvent(EventCameraGroupSwitch, "", []byte(group))
+
+	if err := rmcsInstance.webrtcManager.SwitchCameraGroup(group); err != nil {
+		log.Printf("Failed to switch camera group: %v", err)
+		return -2
+	}
+
+	return 0
+}
+
 //export RMCSStop
 func RMCSStop() C.int {
 	rmcsMutex.Lock()
 	defer rmcsMutex.Unlock()
 
+	stopLocked()
+	return 0
+}
+
+// stopLocked tears down the running instance; rmcsMutex must be held
+func stopLocked() {
 	if rmcsInstance == nil {
-		return 0
+		return
 	}
 
 	log.Println("Stopping RMCS...")
+	rmcsInstance.stop()
+	rmcsInstance = nil
+	log.Println("RMCS stopped")
+}
 
-	if rmcsInstance.client != nil {
-		// Publish disconnect-tractor before stopping
-		rmcsInstance.client.PublishDisconnectTractor()
-		// Give time for message to send
-		time.Sleep(500 * time.Millisecond)
-		rmcsInstance.client.Disconnect()
+// stop tears down whatever of the instance was started, which is also how
+// RMCSInit undoes a failed start
+func (r *RMCSInstance) stop() {
+	if r.recorder != nil {
+		r.client.SetRecorder(nil)
+		r.recorder.Close()
 	}
 
-	if rmcsInstance.webrtcManager != nil {
-		rmcsInstance.webrtcManager.Close()
+	if r.client != nil {
+		r.client.scenarios.Stop()
 	}
 
-	rmcsInstance.running = false
-	rmcsInstance = nil
+	// Stopped before the MQTT client it publishes through
+	if logStream != nil {
+		logStream.Stop()
+	}
 
-	log.Println("RMCS stopped")
-	return 0
+	if r.client != nil {
+		// Tells peers and the frontend we are leaving (disconnect-tractor),
+		// then flushes and disconnects
+		r.client.Disconnect()
+	}
+
+	if r.wsServer != nil {
+		r.wsServer.Close()
+	}
+
+	if r.whipServer != nil {
+		r.whipServer.Close()
+	}
+
+	if r.signaler != nil {
+		r.signaler.Close()
+	}
+
+	if r.metricsServer != nil {
+		r.metricsServer.Close()
+	}
+
+	// Drops the session store with it
+	if r.webrtcManager != nil {
+		r.webrtcManager.Close()
+	}
+
+	configAudit = nil
+
+	if eventMirror != nil {
+		eventMirror.Close()
+		eventMirror = nil
+	}
+
+	r.running = false
+}
+
+// watchSIGTERM drains and stops RMCS when the host process receives
+// SIGTERM, then re-raises the signal so the host's default handling runs
+func watchSIGTERM() {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGTERM)
+
+	go func() {
+		<-signals
+		log.Println("SIGTERM received, draining before exit")
+
+		rmcsMutex.Lock()
+		stopLocked()
+		rmcsMutex.Unlock()
+
+		signal.Reset(syscall.SIGTERM)
+		syscall.Kill(os.Getpid(), syscall.SIGTERM)
+	}()
 }
 
 //export RMCSGetStatus
@@ -132,9 +397,317 @@ func RMCSSetLogFile(filename *C.char) C.int {
 		return -1
 	}
 
-	log.SetOutput(file)
+	// Keep the log streamer, if any, in front of the file
+	if logStream != nil {
+		logStream.SetOutput(file)
+	} else {
+		log.SetOutput(file)
+	}
+	auditSetting("logFile", goFilename, TriggerAPI, "RMCSSetLogFile")
+	return 0
+}
+
+//export RMCSStartRecording
+func RMCSStartRecording(filename *C.char) C.int {
+	rmcsMutex.Lock()
+	defer rmcsMutex.Unlock()
+
+	if rmcsInstance == nil || !rmcsInstance.running {
+		log.Println("RMCS not initialized")
+		return -1
+	}
+
+	recorder, err := NewRecorder(C.GoString(filename))
+	if err != nil {
+		log.Printf("Failed to start recording: %v", err)
+		return -2
+	}
+
+	if rmcsInstance.recorder != nil {
+		rmcsInstance.recorder.Close()
+	}
+	rmcsInstance.recorder = recorder
+	rmcsInstance.client.SetRecorder(recorder)
+	return 0
+}
+
+//export RMCSStopRecording
+func RMCSStopRecording() C.int {
+	rmcsMutex.Lock()
+	defer rmcsMutex.Unlock()
+
+	if rmcsInstance == nil || rmcsInstance.recorder == nil {
+		return 0
+	}
+
+	rmcsInstance.client.SetRecorder(nil)
+	if err := rmcsInstance.recorder.Close(); err != nil {
+		log.Printf("Failed to close recording: %v", err)
+		rmcsInstance.recorder = nil
+		return -1
+	}
+	rmcsInstance.recorder = nil
+	return 0
+}
+
+// RMCSReplay feeds a recording through the signaling handlers. When RMCS is
+// not running, a broker-less WebRTC manager is created for the duration of
+// the replay so recordings can be reproduced offline.
+//
+//export RMCSReplay
+func RMCSReplay(filename *C.char, realtime C.int) C.int {
+	events, err := LoadRecording(C.GoString(filename))
+	if err != nil {
+		log.Printf("Failed to load recording: %v", err)
+		return -1
+	}
+
+	rmcsMutex.Lock()
+	instance := rmcsInstance
+	rmcsMutex.Unlock()
+
+	if instance != nil && instance.running {
+		instance.client.Replay(events, realtime != 0)
+		return 0
+	}
+
+	webrtcManager, err := NewWebRTCManager()
+	if err != nil {
+		log.Printf("Failed to create WebRTC manager: %v", err)
+		return -2
+	}
+	defer webrtcManager.Close()
+
+	NewMQTTClient(webrtcManager, NewSignaler(webrtcManager)).Replay(events, realtime != 0)
+	return 0
+}
+
+//export RMCSRunScenario
+func RMCSRunScenario(filename *C.char) C.int {
+	rmcsMutex.Lock()
+	defer rmcsMutex.Unlock()
+
+	if rmcsInstance == nil || !rmcsInstance.running {
+		log.Println("RMCS not initialized")
+		return -1
+	}
+
+	scenario, err := LoadScenario(C.GoString(filename))
+	if err != nil {
+		log.Printf("Failed to load scenario: %v", err)
+		return -2
+	}
+
+	rmcsInstance.client.scenarios.Start(scenario)
 	return 0
 }
 
+//export RMCSStopScenario
+func RMCSStopScenario() C.int {
+	rmcsMutex.Lock()
+	defer rmcsMutex.Unlock()
+
+	if rmcsInstance != nil {
+		rmcsInstance.client.scenarios.Stop()
+	}
+	return 0
+}
+
+// RMCSGetMetrics returns the metrics snapshot as a JSON string, or NULL on
+// failure. The caller owns the returned string and must free() it.
+//
+//export RMCSGetMetrics
+func RMCSGetMetrics() *C.char {
+	payload, err := metrics.JSON()
+	if err != nil {
+		log.Printf("Failed to encode metrics: %v", err)
+		return nil
+	}
+	return C.CString(string(payload))
+}
+
+// RMCSGetSubscriptions returns the state of every MQTT subscription as a
+// JSON array, or NULL if RMCS is not running or on failure. The caller owns
+// the returned string and must free() it.
+//
+//export RMCSGetSubscriptions
+func RMCSGetSubscriptions() *C.char {
+	rmcsMutex.Lock()
+	defer rmcsMutex.Unlock()
+
+	if rmcsInstance == nil || !rmcsInstance.running {
+		return nil
+	}
+
+	payload, err := rmcsInstance.client.subscriptions.JSON()
+	if err != nil {
+		log.Printf("Failed to encode subscriptions: %v", err)
+		return nil
+	}
+	return C.CString(string(payload))
+}
+
+// RMCSGetCameras returns the camera availability list as JSON (see
+// schema/cameras.schema.json), or NULL if RMCS is not running or on
+// failure. The caller owns the returned string and must free() it.
+//
+//export RMCSGetCameras
+func RMCSGetCameras() *C.char {
+	rmcsMutex.Lock()
+	defer rmcsMutex.Unlock()
+
+	if rmcsInstance == nil || !rmcsInstance.running {
+		return nil
+	}
+
+	payload, err := rmcsInstance.webrtcManager.CameraHealth().JSON()
+	if err != nil {
+		log.Printf("Failed to encode camera list: %v", err)
+		return nil
+	}
+	return C.CString(string(payload))
+}
+
+// RMCSGetPeerStats returns the outbound media stats of a peer as JSON (see
+// schema/peer-stats.schema.json), or NULL if RMCS is not running or the
+// peer is unknown. The caller owns the returned string and must free() it.
+//
+//export RMCSGetPeerStats
+func RMCSGetPeerStats(peerID *C.char) *C.char {
+	rmcsMutex.Lock()
+	defer rmcsMutex.Unlock()
+
+	if rmcsInstance == nil || !rmcsInstance.running {
+		return nil
+	}
+
+	peerStats, err := rmcsInstance.webrtcManager.GetPeerStats(C.GoString(peerID))
+	if err != nil {
+		log.Printf("Failed to get peer stats: %v", err)
+		return nil
+	}
+	payload, err := json.Marshal(peerStats)
+	if err != nil {
+		log.Printf("Failed to encode peer stats: %v", err)
+		return nil
+	}
+	return C.CString(string(payload))
+}
+
+// RMCSGetPeers returns the peers the backend holds a connection for, with
+// their metadata, as JSON (see schema/peers.schema.json), or NULL if RMCS is
+// not running or on failure. The caller owns the returned string and must
+// free() it.
+//
+//export RMCSGetPeers
+func RMCSGetPeers() *C.char {
+	rmcsMutex.Lock()
+	defer rmcsMutex.Unlock()
+
+	if rmcsInstance == nil || !rmcsInstance.running {
+		return nil
+	}
+
+	payload, err := json.Marshal(rmcsInstance.webrtcManager.Peers())
+	if err != nil {
+		log.Printf("Failed to encode peer list: %v", err)
+		return nil
+	}
+	return C.CString(string(payload))
+}
+
+// RMCSGetPipelineStats returns the stats of every streaming source and
+// transcoder as JSON (see schema/pipeline-stats.schema.json), or NULL if
+// RMCS is not running or on failure. The caller owns the returned string and
+// must free() it.
+//
+//export RMCSGetPipelineStats
+func RMCSGetPipelineStats() *C.char {
+	rmcsMutex.Lock()
+	defer rmcsMutex.Unlock()
+
+	if rmcsInstance == nil || !rmcsInstance.running {
+		return nil
+	}
+
+	payload, err := json.Marshal(rmcsInstance.webrtcManager.GetPipelineStats())
+	if err != nil {
+		log.Printf("Failed to encode pipeline stats: %v", err)
+		return nil
+	}
+	return C.CString(string(payload))
+}
+
+// RMCSSetControlCallback registers the function that receives control
+// channel messages (drive, estop, ptz, ...) the backend does not handle
+// itself, or unregisters it with NULL. It is called with the peer ID, the
+// message type and the payload as JSON, on a network goroutine, so it must
+// return quickly; a non-zero return is reported to the peer as a failure.
+// Messages received without a callback are rejected.
+//
+//export RMCSSetControlCallback
+func RMCSSetControlCallback(callback C.RMCSControlCallback) {
+	controlCallbackMu.Lock()
+	defer controlCallbackMu.Unlock()
+	controlCallback = callback
+}
+
+// callControlCallback hands a control message to the host application
+func callControlCallback(peerID string, kind string, payload json.RawMessage) error {
+	controlCallbackMu.Lock()
+	callback := controlCallback
+	controlCallbackMu.Unlock()
+
+	if callback == nil {
+		return fmt.Errorf("no handler for %q", kind)
+	}
+
+	cPeerID := C.CString(peerID)
+	cType := C.CString(kind)
+	cPayload := C.CString(string(payload))
+	defer C.free(unsafe.Pointer(cPeerID))
+	defer C.free(unsafe.Pointer(cType))
+	defer C.free(unsafe.Pointer(cPayload))
+
+	if result := C.rmcsCallControl(callback, cPeerID, cType, cPayload); result != 0 {
+		return fmt.Errorf("%s rejected by host (%d)", kind, int(result))
+	}
+	return nil
+}
+
+// RMCSSetMediaCallback registers the function that receives the frames of
+// the camera and microphone tracks operators send (see incomingMediaEnabled),
+// e.g. to publish them on a ROS topic, or unregisters it with NULL. It is
+// called with the peer ID, "video" or "audio", the codec's MIME type, the
+// frame and its RTP timestamp, on the track's goroutine; data is only valid
+// during the call.
+//
+//export RMCSSetMediaCallback
+func RMCSSetMediaCallback(callback C.RMCSMediaCallback) {
+	mediaCallbackMu.Lock()
+	defer mediaCallbackMu.Unlock()
+	mediaCallback = callback
+}
+
+// callMediaCallback hands an operator's frame to the host application
+func callMediaCallback(frame IncomingFrame) {
+	mediaCallbackMu.Lock()
+	callback := mediaCallback
+	mediaCallbackMu.Unlock()
+
+	if callback == nil || len(frame.Data) == 0 {
+		return
+	}
+
+	cPeerID := C.CString(frame.PeerID)
+	cKind := C.CString(frame.Kind)
+	cCodec := C.CString(frame.Codec)
+	defer C.free(unsafe.Pointer(cPeerID))
+	defer C.free(unsafe.Pointer(cKind))
+	defer C.free(unsafe.Pointer(cCodec))
+
+	C.rmcsCallMedia(callback, cPeerID, cKind, cCodec, unsafe.Pointer(&frame.Data[0]), C.int(len(frame.Data)), C.uint(frame.Timestamp))
+}
+
 // Required empty main for c-shared build
-func main() {}
\ No newline at end of file
+func main() {}
@@ -0,0 +1,60 @@
+package main
+
+import "strings"
+
+// Peer roles: operators get the video and the control channel, viewers get
+// sendonly media and no control channel
+const (
+	RoleOperator = "operator"
+	RoleViewer   = "viewer"
+)
+
+// grantedRole maps the role named by a token to a known role. A token that
+// names none gets defaultPeerRole, one naming an unknown role only views.
+func grantedRole(role string) string {
+	switch role {
+	case "":
+		return defaultPeerRole
+	case RoleOperator:
+		return RoleOperator
+	default:
+		return RoleViewer
+	}
+}
+
+// peerRole returns the role an offer is answered with: the role granted by
+// its token, lowered to viewer if the peer asks for that in its
+// capabilities. A peer cannot raise its own role.
+func peerRole(granted string, requested string) string {
+	if requested == RoleViewer {
+		return RoleViewer
+	}
+	return granted
+}
+
+// answerSendOnly turns the media sections of an answer to a viewer into
+// sendonly, or inactive where the viewer offered to send only, so it never
+// sends media. The video tracks are already sendonly (see transceivers.go);
+// this covers the sections pion answers on its own, such as audio, recvonly.
+// pion only accepts its own answer as local description, so this applies to
+// what is sent.
+func answerSendOnly(answerSDP string) string {
+	lines := strings.SplitAfter(answerSDP, "\n")
+	media := false
+	for i, line := range lines {
+		if strings.HasPrefix(line, "m=") {
+			media = !strings.HasPrefix(line, "m=application")
+		}
+		if !media {
+			continue
+		}
+		trimmed := strings.TrimRight(line, "\r\n")
+		switch trimmed {
+		case "a=sendrecv":
+			lines[i] = "a=sendonly" + line[len(trimmed):]
+		case "a=recvonly":
+			lines[i] = "a=inactive" + line[len(trimmed):]
+		}
+	}
+	return strings.Join(lines, "")
+}
@@ -0,0 +1,311 @@
+package main
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ROS message definitions, for messages the backend has no Go type for,
+// such as a proxied service's request and response (see ros_service.go):
+// a definition, e.g. "string mode\nbool force", is parsed into its fields,
+// and a JSON object is serialized by it, or a message deserialized into
+// one. Fields of primitive types, and arrays of them, are supported, not
+// nested messages. A time is an RFC 3339 string, a duration a number of
+// seconds; a uint8[] is an array of numbers, or base64 in a request.
+
+// rosField is a field of a message definition
+type rosField struct {
+	name   string
+	kind   string // primitive type, byte and char as uint8 and int8
+	array  bool
+	length int // a fixed array's, -1 if variable
+}
+
+// rosDefinition is a message definition's fields, in order
+type rosDefinition []rosField
+
+// rosPrimitiveSizes has the size of every fixed-size primitive type
+var rosPrimitiveSizes = map[string]int{
+	"bool": 1, "int8": 1, "uint8": 1, "int16": 2, "uint16": 2, "int32": 4, "uint32": 4,
+	"int64": 8, "uint64": 8, "float32": 4, "float64": 8, "time": 8, "duration": 8,
+}
+
+// parseROSDefinition parses a message definition, skipping comments and
+// constants
+func parseROSDefinition(text string) (rosDefinition, error) {
+	var definition rosDefinition
+	for _, line := range strings.Split(text, "\n") {
+		line, _, _ = strings.Cut(line, "#")
+		parts := strings.Fields(line)
+		if len(parts) == 0 || strings.Contains(line, "=") {
+			continue // blank, or a constant
+		}
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("invalid field %q", strings.TrimSpace(line))
+		}
+		field := rosField{name: parts[1], kind: parts[0], length: -1}
+		if kind, size, ok := strings.Cut(field.kind, "["); ok {
+			field.kind = kind
+			field.array = true
+			if size = strings.TrimSuffix(size, "]"); size != "" {
+				n, err := strconv.Atoi(size)
+				if err != nil || n < 0 {
+					return nil, fmt.Errorf("invalid array %q", parts[0])
+				}
+				field.length = n
+			}
+		}
+		switch field.kind {
+		case "byte":
+			field.kind = "uint8"
+		case "char":
+			field.kind = "int8"
+		}
+		if _, ok := rosPrimitiveSizes[field.kind]; !ok && field.kind != "string" {
+			return nil, fmt.Errorf("field %s: %s is not a primitive type", field.name, field.kind)
+		}
+		definition = append(definition, field)
+	}
+	return definition, nil
+}
+
+// encode serializes object, a JSON object, by the definition. Fields it
+// does not have are zero; fields the definition does not have are refused.
+func (d rosDefinition) encode(object json.RawMessage) ([]byte, error) {
+	values := make(map[string]json.RawMessage)
+	if len(object) > 0 && string(object) != "null" {
+		if err := json.Unmarshal(object, &values); err != nil {
+			return nil, fmt.Errorf("not an object: %v", err)
+		}
+	}
+	known := make(map[string]bool, len(d))
+	var b []byte
+	for _, field := range d {
+		known[field.name] = true
+		var err error
+		if b, err = field.encode(b, values[field.name]); err != nil {
+			return nil, fmt.Errorf("field %s: %v", field.name, err)
+		}
+	}
+	var unknown []string
+	for name := range values {
+		if !known[name] {
+			unknown = append(unknown, name)
+		}
+	}
+	if len(unknown) > 0 {
+		sort.Strings(unknown)
+		return nil, fmt.Errorf("unknown fields %s", strings.Join(unknown, ", "))
+	}
+	return b, nil
+}
+
+func (f rosField) encode(b []byte, value json.RawMessage) ([]byte, error) {
+	if !f.array {
+		return appendROSPrimitive(b, f.kind, value)
+	}
+	var items []json.RawMessage
+	if f.kind == "uint8" && len(value) > 0 && value[0] == '"' {
+		var data []byte // base64, as encoding/json has a []byte
+		if err := json.Unmarshal(value, &data); err != nil {
+			return nil, err
+		}
+		for _, v := range data {
+			items = append(items, json.RawMessage(strconv.Itoa(int(v))))
+		}
+	} else if len(value) > 0 && string(value) != "null" {
+		if err := json.Unmarshal(value, &items); err != nil {
+			return nil, fmt.Errorf("not an array")
+		}
+	}
+	switch {
+	case f.length < 0:
+		b = binary.LittleEndian.AppendUint32(b, uint32(len(items)))
+	case len(items) > f.length:
+		return nil, fmt.Errorf("%d items, not %d", len(items), f.length)
+	}
+	for i := 0; i < len(items) || i < f.length; i++ {
+		var item json.RawMessage
+		if i < len(items) {
+			item = items[i]
+		}
+		var err error
+		if b, err = appendROSPrimitive(b, f.kind, item); err != nil {
+			return nil, fmt.Errorf("item %d: %v", i, err)
+		}
+	}
+	return b, nil
+}
+
+// appendROSPrimitive serializes value, zero if absent, as kind
+func appendROSPrimitive(b []byte, kind string, value json.RawMessage) ([]byte, error) {
+	absent := len(value) == 0 || string(value) == "null"
+	switch kind {
+	case "bool":
+		var v bool
+		if !absent {
+			if err := json.Unmarshal(value, &v); err != nil {
+				return nil, fmt.Errorf("not a boolean")
+			}
+		}
+		if v {
+			return append(b, 1), nil
+		}
+		return append(b, 0), nil
+	case "string":
+		var v string
+		if !absent {
+			if err := json.Unmarshal(value, &v); err != nil {
+				return nil, fmt.Errorf("not a string")
+			}
+		}
+		return appendROSString(b, v), nil
+	case "time":
+		var v time.Time
+		if !absent {
+			if err := json.Unmarshal(value, &v); err != nil {
+				return nil, fmt.Errorf("not an RFC 3339 time")
+			}
+		}
+		if v.IsZero() {
+			return binary.LittleEndian.AppendUint64(b, 0), nil
+		}
+		b = binary.LittleEndian.AppendUint32(b, uint32(v.Unix()))
+		return binary.LittleEndian.AppendUint32(b, uint32(v.Nanosecond())), nil
+	case "duration":
+		var seconds float64
+		if !absent {
+			if err := json.Unmarshal(value, &seconds); err != nil {
+				return nil, fmt.Errorf("not a number of seconds")
+			}
+		}
+		d := time.Duration(seconds * float64(time.Second))
+		b = binary.LittleEndian.AppendUint32(b, uint32(int32(d/time.Second)))
+		return binary.LittleEndian.AppendUint32(b, uint32(int32(d%time.Second))), nil
+	case "float32", "float64":
+		var v float64
+		if !absent {
+			if err := json.Unmarshal(value, &v); err != nil {
+				return nil, fmt.Errorf("not a number")
+			}
+		}
+		if kind == "float32" {
+			return binary.LittleEndian.AppendUint32(b, math.Float32bits(float32(v))), nil
+		}
+		return appendROSFloat64(b, v), nil
+	}
+
+	// An integer, checked against its type's range
+	size := rosPrimitiveSizes[kind]
+	var bits uint64
+	if !absent {
+		text := string(value)
+		if strings.HasPrefix(kind, "u") {
+			v, err := strconv.ParseUint(text, 10, size*8)
+			if err != nil {
+				return nil, fmt.Errorf("%s is not a %s", text, kind)
+			}
+			bits = v
+		} else {
+			v, err := strconv.ParseInt(text, 10, size*8)
+			if err != nil {
+				return nil, fmt.Errorf("%s is not a %s", text, kind)
+			}
+			bits = uint64(v)
+		}
+	}
+	switch size {
+	case 1:
+		return append(b, byte(bits)), nil
+	case 2:
+		return binary.LittleEndian.AppendUint16(b, uint16(bits)), nil
+	case 4:
+		return binary.LittleEndian.AppendUint32(b, uint32(bits)), nil
+	}
+	return binary.LittleEndian.AppendUint64(b, bits), nil
+}
+
+// decode deserializes a message by the definition into a JSON object
+func (d rosDefinition) decode(data []byte) (map[string]interface{}, error) {
+	r := rosReader{data: data}
+	object := make(map[string]interface{}, len(d))
+	for _, field := range d {
+		if !field.array {
+			object[field.name] = r.primitive(field.kind)
+			continue
+		}
+		n := field.length
+		if n < 0 {
+			n = int(r.uint32())
+		}
+		if size := rosPrimitiveSizes[field.kind]; r.err != nil || n > len(r.data) || size > 0 && n > len(r.data)/size {
+			return nil, errShortROSMessage
+		}
+		items := make([]interface{}, n)
+		for i := range items {
+			items[i] = r.primitive(field.kind)
+		}
+		object[field.name] = items
+	}
+	if r.err == nil && len(r.data) > 0 {
+		return nil, fmt.Errorf("%d bytes beyond the definition", len(r.data))
+	}
+	return object, r.err
+}
+
+// primitive reads a value of kind, as JSON has it
+func (r *rosReader) primitive(kind string) interface{} {
+	switch kind {
+	case "bool":
+		return r.uint8() != 0
+	case "string":
+		return r.string()
+	case "time":
+		return r.time().UTC()
+	case "duration":
+		secs, nsecs := int32(r.uint32()), int32(r.uint32())
+		return (time.Duration(secs)*time.Second + time.Duration(nsecs)).Seconds()
+	case "float32":
+		v := r.float32()
+		if finite(float64(v)) == nil {
+			return nil
+		}
+		return measured(v)
+	case "float64":
+		return finite(r.float64())
+	case "int8":
+		return int8(r.uint8())
+	case "uint8":
+		return r.uint8()
+	case "int16":
+		return int16(r.uint16())
+	case "uint16":
+		return r.uint16()
+	case "int32":
+		return int32(r.uint32())
+	case "uint32":
+		return r.uint32()
+	}
+	field := r.next(8)
+	if field == nil {
+		return 0
+	}
+	if kind == "int64" {
+		return int64(binary.LittleEndian.Uint64(field))
+	}
+	return binary.LittleEndian.Uint64(field)
+}
+
+// finite returns v, or nil, JSON's null, if it is NaN or infinite
+func finite(v float64) interface{} {
+	if math.IsNaN(v) || math.IsInf(v, 0) {
+		return nil
+	}
+	return v
+}
@@ -0,0 +1,164 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"reflect"
+	"sort"
+	"strconv"
+	"time"
+)
+
+// ROS topic map and discovery: which camera streams which ROS topic is
+// configured in the file at rosTopicMapPath, loaded at startup, rather than
+// built in. It maps camera numbers to "ros:" entries without the prefix,
+// options included (see ros_source.go):
+//
+//	{"1": "/flir_id8/image_resized", "2": "/leopard_id1/image_resized/compressed?fps=15"}
+//
+// Cameras it maps stream their topic instead of their frame files; the
+// others keep their entry in cameraDirectories. With rosDiscoveryInterval
+// set, the master is also asked that often for the image topics it has,
+// and their list, with the camera streaming each, is published retained to
+// <thingName>/ros-topics whenever it changes, for frontends to build their
+// camera menu from.
+
+// loadROSTopicMap points the cameras in the topic map at path at their
+// topics. A missing file maps none.
+func loadROSTopicMap(path string) error {
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to read ROS topic map %s: %v", path, err)
+	}
+	var topics map[string]string
+	if err := json.Unmarshal(data, &topics); err != nil {
+		return fmt.Errorf("invalid ROS topic map %s: %v", path, err)
+	}
+	entries := make(map[int]string, len(topics))
+	for camera, topic := range topics {
+		n, err := strconv.Atoi(camera)
+		if err != nil || n < 0 {
+			return fmt.Errorf("invalid ROS topic map %s: camera %q", path, camera)
+		}
+		if topic == "" || topic[0] != '/' {
+			return fmt.Errorf("invalid ROS topic map %s: camera %d topic %q is not a global name", path, n, topic)
+		}
+		entries[n] = "ros:" + topic
+	}
+	// Only once the whole map is valid
+	for camera, entry := range entries {
+		cameraDirectories[camera] = entry
+	}
+	log.Printf("Loaded %d camera topics from %s", len(entries), path)
+	return nil
+}
+
+// discoverImageTopics returns the image topics the master has, with the
+// camera streaming each
+func discoverImageTopics() ([]ROSTopic, error) {
+	value, err := callROS(rosMaster(), "getPublishedTopics", rosNodeName, "")
+	if err != nil {
+		return nil, err
+	}
+	streamed := make(map[string]int)
+	for camera, address := range cameraDirectories {
+		if config, ok := rosImageTopic(address); ok {
+			streamed[config.device] = camera
+		}
+	}
+
+	pairs, _ := value.([]interface{})
+	topics := []ROSTopic{}
+	for _, item := range pairs {
+		pair, _ := item.([]interface{})
+		if len(pair) != 2 {
+			continue
+		}
+		name, _ := pair[0].(string)
+		msgType, _ := pair[1].(string)
+		if msgType != rosImageType && msgType != rosCompressedImageType {
+			continue
+		}
+		topics = append(topics, ROSTopic{Topic: name, Type: msgType, Camera: streamed[name]})
+	}
+	sort.Slice(topics, func(i, j int) bool { return topics[i].Topic < topics[j].Topic })
+	return topics, nil
+}
+
+// StartROSDiscovery publishes the master's image topics to
+// <thingName>/ros-topics as they change, checking every
+// rosDiscoveryInterval
+func (m *MQTTClient) StartROSDiscovery() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.stopDiscovery != nil || rosDiscoveryInterval <= 0 {
+		return
+	}
+	m.stopDiscovery = make(chan struct{})
+	go m.rosDiscoveryLoop(m.stopDiscovery)
+}
+
+// StopROSDiscovery stops publishing the master's image topics
+func (m *MQTTClient) StopROSDiscovery() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.stopDiscovery != nil {
+		close(m.stopDiscovery)
+		m.stopDiscovery = nil
+	}
+}
+
+func (m *MQTTClient) rosDiscoveryLoop(stop chan struct{}) {
+	ticker := time.NewTicker(rosDiscoveryInterval)
+	defer ticker.Stop()
+
+	var published []ROSTopic
+	failing := false // discovery is failing, already logged
+	for {
+		topics, err := discoverImageTopics()
+		switch {
+		case err != nil:
+			metrics.Inc("ros.discovery_failures")
+			if !failing {
+				log.Printf("Failed to discover ROS topics: %v", err)
+			}
+			failing = true
+		case published == nil || !reflect.DeepEqual(topics, published):
+			failing = false
+			if m.publishROSTopics(topics) {
+				published = topics
+			}
+		default:
+			failing = false
+		}
+
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// publishROSTopics retains topics on <thingName>/ros-topics, reporting
+// whether it was published
+func (m *MQTTClient) publishROSTopics(topics []ROSTopic) bool {
+	payload, err := json.Marshal(ROSTopicList{Schema: ROSTopicListSchema, Topics: topics, Time: time.Now().UTC()})
+	if err != nil {
+		log.Printf("Failed to marshal ROS topics: %v", err)
+		return false
+	}
+	if err := m.publishMessage(deviceTopic("ros-topics"), true, payload); err != nil {
+		log.Printf("Failed to publish ROS topics: %v", err)
+		return false
+	}
+	metrics.Inc("ros.discovery_published")
+	return true
+}
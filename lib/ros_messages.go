@@ -0,0 +1,417 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"math"
+	"time"
+)
+
+// ROS messages the backend decodes and encodes, in their serialization:
+// fields in order, little-endian, strings and arrays prefixed with their
+// uint32 length
+
+// ROS message types
+const (
+	rosImageType           = "sensor_msgs/Image"
+	rosCompressedImageType = "sensor_msgs/CompressedImage"
+	rosOdometryType        = "nav_msgs/Odometry"
+	rosJointStateType      = "sensor_msgs/JointState"
+	rosBatteryStateType    = "sensor_msgs/BatteryState"
+	rosNavSatFixType       = "sensor_msgs/NavSatFix"
+	rosCameraInfoType      = "sensor_msgs/CameraInfo"
+)
+
+// rosMessageType is what a publisher's connection header says of its
+// messages: its type, the MD5 sum of its definition, and the definition
+type rosMessageType struct {
+	name       string
+	md5        string
+	definition string
+}
+
+// rosTwistType is geometry_msgs/Twist, see rosTwist
+var rosTwistType = rosMessageType{
+	name: "geometry_msgs/Twist",
+	md5:  "9f195f881246fdfa2798d1d3eebca84a",
+	definition: `Vector3  linear
+Vector3  angular
+================================================================================
+MSG: geometry_msgs/Vector3
+float64 x
+float64 y
+float64 z
+`,
+}
+
+// rosBoolType is std_msgs/Bool, see encodeROSBool
+var rosBoolType = rosMessageType{
+	name:       "std_msgs/Bool",
+	md5:        "8b94c1b53db61fb6aed406028ad6332a",
+	definition: "bool data\n",
+}
+
+func encodeROSBool(value bool) []byte {
+	if value {
+		return []byte{1}
+	}
+	return []byte{0}
+}
+
+var errShortROSMessage = errors.New("truncated ROS message")
+
+// rosReader decodes a serialized message field by field. Once a field is
+// missing every read returns zero values, and err is set.
+type rosReader struct {
+	data []byte
+	err  error
+}
+
+func (r *rosReader) next(n int) []byte {
+	if r.err != nil || n < 0 || n > len(r.data) {
+		r.err = errShortROSMessage
+		return nil
+	}
+	field := r.data[:n]
+	r.data = r.data[n:]
+	return field
+}
+
+func (r *rosReader) uint8() uint8 {
+	if field := r.next(1); field != nil {
+		return field[0]
+	}
+	return 0
+}
+
+func (r *rosReader) uint16() uint16 {
+	if field := r.next(2); field != nil {
+		return binary.LittleEndian.Uint16(field)
+	}
+	return 0
+}
+
+func (r *rosReader) uint32() uint32 {
+	if field := r.next(4); field != nil {
+		return binary.LittleEndian.Uint32(field)
+	}
+	return 0
+}
+
+func (r *rosReader) float32() float32 {
+	return math.Float32frombits(r.uint32())
+}
+
+func (r *rosReader) float64() float64 {
+	if field := r.next(8); field != nil {
+		return math.Float64frombits(binary.LittleEndian.Uint64(field))
+	}
+	return 0
+}
+
+// float64s reads n float64s, or a float64[] if n is -1
+func (r *rosReader) float64s(n int) []float64 {
+	if n < 0 {
+		n = int(r.uint32())
+	}
+	if r.err != nil || n > len(r.data)/8 {
+		r.err = errShortROSMessage
+		return nil
+	}
+	values := make([]float64, n)
+	for i := range values {
+		values[i] = r.float64()
+	}
+	return values
+}
+
+func (r *rosReader) float32s() []float32 {
+	n := int(r.uint32())
+	if r.err != nil || n > len(r.data)/4 {
+		r.err = errShortROSMessage
+		return nil
+	}
+	values := make([]float32, n)
+	for i := range values {
+		values[i] = r.float32()
+	}
+	return values
+}
+
+func (r *rosReader) strings() []string {
+	n := int(r.uint32())
+	if r.err != nil || n > len(r.data)/4 {
+		r.err = errShortROSMessage
+		return nil
+	}
+	values := make([]string, n)
+	for i := range values {
+		values[i] = r.string()
+	}
+	return values
+}
+
+func (r *rosReader) time() time.Time {
+	secs, nsecs := r.uint32(), r.uint32()
+	return time.Unix(int64(secs), int64(nsecs))
+}
+
+func (r *rosReader) string() string {
+	return string(r.bytes())
+}
+
+// bytes reads a uint8[], sharing the message's data
+func (r *rosReader) bytes() []byte {
+	return r.next(int(r.uint32()))
+}
+
+func appendROSString(b []byte, s string) []byte {
+	b = binary.LittleEndian.AppendUint32(b, uint32(len(s)))
+	return append(b, s...)
+}
+
+func appendROSFloat64(b []byte, f float64) []byte {
+	return binary.LittleEndian.AppendUint64(b, math.Float64bits(f))
+}
+
+// rosHeader is a std_msgs/Header
+type rosHeader struct {
+	Seq     uint32
+	Stamp   time.Time
+	FrameID string
+}
+
+func (r *rosReader) header() rosHeader {
+	return rosHeader{Seq: r.uint32(), Stamp: r.time(), FrameID: r.string()}
+}
+
+// rosImage is a sensor_msgs/Image. Data is the message's.
+type rosImage struct {
+	Header    rosHeader
+	Height    int
+	Width     int
+	Encoding  string // e.g. rgb8, bgr8, mono8, mono16
+	BigEndian bool
+	Step      int // bytes of a row
+	Data      []byte
+}
+
+func decodeROSImage(data []byte) (rosImage, error) {
+	r := rosReader{data: data}
+	image := rosImage{
+		Header:    r.header(),
+		Height:    int(r.uint32()),
+		Width:     int(r.uint32()),
+		Encoding:  r.string(),
+		BigEndian: r.uint8() != 0,
+		Step:      int(r.uint32()),
+		Data:      r.bytes(),
+	}
+	if r.err == nil && len(image.Data) < image.Step*image.Height {
+		r.err = errShortROSMessage
+	}
+	return image, r.err
+}
+
+// rosCompressedImage is a sensor_msgs/CompressedImage. Data is the
+// message's.
+type rosCompressedImage struct {
+	Header rosHeader
+	Format string // e.g. jpeg, png, "bgr8; jpeg compressed bgr8"
+	Data   []byte
+}
+
+func decodeROSCompressedImage(data []byte) (rosCompressedImage, error) {
+	r := rosReader{data: data}
+	image := rosCompressedImage{Header: r.header(), Format: r.string(), Data: r.bytes()}
+	return image, r.err
+}
+
+// rosVector3 is a geometry_msgs/Vector3
+type rosVector3 struct {
+	X, Y, Z float64
+}
+
+func (v rosVector3) append(b []byte) []byte {
+	return appendROSFloat64(appendROSFloat64(appendROSFloat64(b, v.X), v.Y), v.Z)
+}
+
+// rosTwist is a geometry_msgs/Twist: velocity in m/s and rad/s, in the
+// robot's frame, x forward and z up
+type rosTwist struct {
+	Linear  rosVector3
+	Angular rosVector3
+}
+
+func (t rosTwist) encode() []byte {
+	return t.Angular.append(t.Linear.append(make([]byte, 0, 48)))
+}
+
+// rosOdometry is the part of a nav_msgs/Odometry streamed: the pose and
+// velocity, without their covariances
+type rosOdometry struct {
+	Header       rosHeader
+	ChildFrameID string
+	Position     rosVector3
+	Orientation  [4]float64 // quaternion, x, y, z, w
+	Twist        rosTwist
+}
+
+func decodeROSOdometry(data []byte) (rosOdometry, error) {
+	r := rosReader{data: data}
+	odometry := rosOdometry{Header: r.header(), ChildFrameID: r.string()}
+	odometry.Position = rosVector3{r.float64(), r.float64(), r.float64()}
+	copy(odometry.Orientation[:], r.float64s(4))
+	r.float64s(36) // covariance
+	odometry.Twist.Linear = rosVector3{r.float64(), r.float64(), r.float64()}
+	odometry.Twist.Angular = rosVector3{r.float64(), r.float64(), r.float64()}
+	r.float64s(36)
+	return odometry, r.err
+}
+
+// yaw returns the heading of the odometry's orientation, in rad
+func (o rosOdometry) yaw() float64 {
+	x, y, z, w := o.Orientation[0], o.Orientation[1], o.Orientation[2], o.Orientation[3]
+	return math.Atan2(2*(w*z+x*y), 1-2*(y*y+z*z))
+}
+
+// rosJointState is a sensor_msgs/JointState
+type rosJointState struct {
+	Header   rosHeader
+	Name     []string
+	Position []float64
+	Velocity []float64
+	Effort   []float64
+}
+
+func decodeROSJointState(data []byte) (rosJointState, error) {
+	r := rosReader{data: data}
+	state := rosJointState{Header: r.header(), Name: r.strings()}
+	state.Position = r.float64s(-1)
+	state.Velocity = r.float64s(-1)
+	state.Effort = r.float64s(-1)
+	return state, r.err
+}
+
+// rosBatteryState is the part of a sensor_msgs/BatteryState streamed.
+// Unmeasured values are NaN.
+type rosBatteryState struct {
+	Header     rosHeader
+	Voltage    float32
+	Current    float32
+	Percentage float32 // 0 to 1
+	Status     uint8   // POWER_SUPPLY_STATUS_*
+}
+
+// Status values of sensor_msgs/BatteryState, POWER_SUPPLY_STATUS_*
+var rosBatteryStatuses = []string{"unknown", "charging", "discharging", "not-charging", "full"}
+
+// decodeROSBatteryState decodes Noetic's BatteryState, or Melodic's,
+// without temperatures, if the message does not add up to Noetic's
+func decodeROSBatteryState(data []byte) (rosBatteryState, error) {
+	state, err := decodeBatteryState(data, true)
+	if err != nil {
+		return decodeBatteryState(data, false)
+	}
+	return state, nil
+}
+
+func decodeBatteryState(data []byte, temperatures bool) (rosBatteryState, error) {
+	r := rosReader{data: data}
+	state := rosBatteryState{Header: r.header(), Voltage: r.float32()}
+	if temperatures {
+		r.float32() // temperature
+	}
+	state.Current = r.float32()
+	r.float32() // charge
+	r.float32() // capacity
+	r.float32() // design_capacity
+	state.Percentage = r.float32()
+	state.Status = r.uint8()
+	r.uint8()    // power_supply_health
+	r.uint8()    // power_supply_technology
+	r.uint8()    // present
+	r.float32s() // cell_voltage
+	if temperatures {
+		r.float32s() // cell_temperature
+	}
+	r.string() // location
+	r.string() // serial_number
+	if r.err == nil && len(r.data) > 0 {
+		r.err = errors.New("trailing bytes in BatteryState")
+	}
+	return state, r.err
+}
+
+// rosNavSatFix is the part of a sensor_msgs/NavSatFix streamed
+type rosNavSatFix struct {
+	Header     rosHeader
+	Status     int8 // NavSatStatus STATUS_*, -1 without a fix
+	Latitude   float64
+	Longitude  float64
+	Altitude   float64
+	Covariance [9]float64 // of east, north and up, in m²
+	// CovarianceType is NavSatFix COVARIANCE_TYPE_*, 0 if unknown
+	CovarianceType uint8
+}
+
+// Fixes of sensor_msgs/NavSatStatus, STATUS_FIX onwards
+var rosNavSatFixes = []string{"gps", "sbas", "gbas"}
+
+func decodeROSNavSatFix(data []byte) (rosNavSatFix, error) {
+	r := rosReader{data: data}
+	fix := rosNavSatFix{Header: r.header(), Status: int8(r.uint8())}
+	r.uint16() // service
+	fix.Latitude = r.float64()
+	fix.Longitude = r.float64()
+	fix.Altitude = r.float64()
+	copy(fix.Covariance[:], r.float64s(9))
+	fix.CovarianceType = r.uint8()
+	return fix, r.err
+}
+
+// accuracy returns the fix's horizontal standard deviation in m, the worse
+// of east and north, or 0 if the covariance is unknown
+func (f rosNavSatFix) accuracy() float64 {
+	if f.CovarianceType == 0 {
+		return 0
+	}
+	return math.Sqrt(math.Max(f.Covariance[0], f.Covariance[4]))
+}
+
+// rosCameraInfo is a sensor_msgs/CameraInfo: a camera's calibration, for
+// images of Width by Height
+type rosCameraInfo struct {
+	Header          rosHeader
+	Height          uint32
+	Width           uint32
+	DistortionModel string
+	D               []float64 // distortion, as many as the model has
+	K               []float64 // 3x3 intrinsics, row-major
+	R               []float64 // 3x3 rectification
+	P               []float64 // 3x4 projection
+	BinningX        uint32
+	BinningY        uint32
+	ROI             rosRegionOfInterest
+}
+
+// rosRegionOfInterest is a sensor_msgs/RegionOfInterest, all zero for the
+// full image
+type rosRegionOfInterest struct {
+	XOffset, YOffset, Height, Width uint32
+	DoRectify                       bool
+}
+
+func decodeROSCameraInfo(data []byte) (rosCameraInfo, error) {
+	r := rosReader{data: data}
+	info := rosCameraInfo{Header: r.header(), Height: r.uint32(), Width: r.uint32()}
+	info.DistortionModel = r.string()
+	info.D = r.float64s(-1)
+	info.K = r.float64s(9)
+	info.R = r.float64s(9)
+	info.P = r.float64s(12)
+	info.BinningX = r.uint32()
+	info.BinningY = r.uint32()
+	info.ROI = rosRegionOfInterest{XOffset: r.uint32(), YOffset: r.uint32(), Height: r.uint32(), Width: r.uint32(), DoRectify: r.uint8() != 0}
+	return info, r.err
+}
@@ -0,0 +1,290 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+)
+
+// ROS node: the backend joins the robot's ROS graph as a node of its own,
+// rosNodeName, started with its first subscription. It registers with the
+// master at rosMasterURI, serves the node API the master and other nodes
+// call (publisherUpdate tells it of publishers coming and going) and
+// receives each subscribed topic from every publisher over TCPROS (see
+// ros_tcpros.go), connecting again rosReconnectDelay after a connection
+// fails. A node subscribes to a topic once however many of the backend's
+// sources take its messages, and unregisters as the last one closes. It
+// publishes topics too, see ros_publisher.go.
+//
+// Only ROS 1 is spoken; ROS 2 robots need a ros1_bridge.
+
+// rosMessage is one message received on a topic, serialized
+type rosMessage struct {
+	Type     string // the topic's, e.g. sensor_msgs/Image
+	Data     []byte
+	Received time.Time
+}
+
+// rosNode is the backend's ROS node
+type rosNode struct {
+	callerID     string
+	masterURI    string
+	uri          string               // of its node API
+	tcprosPort   int                  // its publications' subscribers connect to
+	topics       map[string]*rosTopic // subscribed to
+	publications map[string]*rosPublication
+	mu           sync.Mutex
+}
+
+// rosTopic is a topic the node subscribes to
+type rosTopic struct {
+	node        *rosNode
+	name        string
+	subscribers map[*rosSubscriber]bool
+	// Connections to its publishers, by node API URI, cancelled as the
+	// publisher goes
+	publishers map[string]context.CancelFunc
+}
+
+// rosSubscriber takes a topic's messages, see rosNode.subscribe
+type rosSubscriber struct {
+	topic    *rosTopic
+	messages chan rosMessage
+}
+
+var rosNodes struct {
+	node *rosNode
+	mu   sync.Mutex
+}
+
+// startROSNode returns the backend's ROS node, serving its node API from
+// the first call on
+func startROSNode() (*rosNode, error) {
+	rosNodes.mu.Lock()
+	defer rosNodes.mu.Unlock()
+
+	if rosNodes.node != nil {
+		return rosNodes.node, nil
+	}
+	listener, err := net.Listen("tcp", ":0")
+	if err != nil {
+		return nil, fmt.Errorf("failed to listen for the ROS node API: %v", err)
+	}
+	tcprosListener, err := net.Listen("tcp", ":0")
+	if err != nil {
+		listener.Close()
+		return nil, fmt.Errorf("failed to listen for TCPROS: %v", err)
+	}
+	node := &rosNode{
+		callerID:     rosNodeName,
+		masterURI:    rosMaster(),
+		uri:          fmt.Sprintf("http://%s/", net.JoinHostPort(rosHost(), fmt.Sprint(listener.Addr().(*net.TCPAddr).Port))),
+		tcprosPort:   tcprosListener.Addr().(*net.TCPAddr).Port,
+		topics:       make(map[string]*rosTopic),
+		publications: make(map[string]*rosPublication),
+	}
+	go http.Serve(listener, xmlrpcHandler("ROS node", node.handleNode))
+	go node.serveTCPROS(tcprosListener)
+	log.Printf("ROS node %s at %s, master %s", node.callerID, node.uri, node.masterURI)
+	rosNodes.node = node
+	return node, nil
+}
+
+// rosMaster returns the URI of the ROS master
+func rosMaster() string {
+	if rosMasterURI != "" {
+		return rosMasterURI
+	}
+	if uri := os.Getenv("ROS_MASTER_URI"); uri != "" {
+		return uri
+	}
+	return "http://localhost:11311/"
+}
+
+// rosHost returns the name other nodes reach the backend's node at
+func rosHost() string {
+	if rosHostname != "" {
+		return rosHostname
+	}
+	for _, variable := range []string{"ROS_HOSTNAME", "ROS_IP"} {
+		if host := os.Getenv(variable); host != "" {
+			return host
+		}
+	}
+	if host, err := os.Hostname(); err == nil {
+		return host
+	}
+	return "localhost"
+}
+
+// subscribe has the messages of topic, of any type, sent to a new
+// subscriber, which holds up to size of them before dropping the next
+func (n *rosNode) subscribe(topic string, size int) (*rosSubscriber, error) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	t, ok := n.topics[topic]
+	if !ok {
+		publishers, err := callROS(n.masterURI, "registerSubscriber", n.callerID, topic, "*", n.uri)
+		if err != nil {
+			return nil, fmt.Errorf("failed to subscribe to %s: %v", topic, err)
+		}
+		t = &rosTopic{
+			node:        n,
+			name:        topic,
+			subscribers: make(map[*rosSubscriber]bool),
+			publishers:  make(map[string]context.CancelFunc),
+		}
+		n.topics[topic] = t
+		t.updatePublishers(publishers)
+		metrics.SetGauge("ros.topics", int64(len(n.topics)))
+	}
+	subscriber := &rosSubscriber{topic: t, messages: make(chan rosMessage, size)}
+	t.subscribers[subscriber] = true
+	return subscriber, nil
+}
+
+// Close stops the subscriber's messages, closing its channel, and
+// unsubscribes the node from the topic if it was the last one
+func (s *rosSubscriber) Close() {
+	n := s.topic.node
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	t := s.topic
+	if !t.subscribers[s] {
+		return
+	}
+	delete(t.subscribers, s)
+	close(s.messages)
+	if len(t.subscribers) > 0 {
+		return
+	}
+	delete(n.topics, t.name)
+	metrics.SetGauge("ros.topics", int64(len(n.topics)))
+	t.updatePublishers(nil)
+	// With n.mu held, so a new subscription registers after this
+	if _, err := callROS(n.masterURI, "unregisterSubscriber", n.callerID, t.name, n.uri); err != nil {
+		log.Printf("Failed to unsubscribe from %s: %v", t.name, err)
+	}
+}
+
+// updatePublishers connects to the publishers in uris, a list of node API
+// URIs, it is not yet connected to, and disconnects from the others, with
+// the node's mu held
+func (t *rosTopic) updatePublishers(uris interface{}) {
+	list, _ := uris.([]interface{})
+	current := make(map[string]bool)
+	for _, item := range list {
+		uri, _ := item.(string)
+		if uri == "" {
+			continue
+		}
+		current[uri] = true
+		if _, ok := t.publishers[uri]; ok {
+			continue
+		}
+		ctx, cancel := context.WithCancel(context.Background())
+		t.publishers[uri] = cancel
+		go t.follow(ctx, uri)
+	}
+	for uri, cancel := range t.publishers {
+		if !current[uri] {
+			cancel()
+			delete(t.publishers, uri)
+		}
+	}
+}
+
+// follow receives the topic from the publisher at uri until ctx is
+// cancelled, connecting again rosReconnectDelay after the connection fails
+func (t *rosTopic) follow(ctx context.Context, uri string) {
+	for {
+		err := t.receiveTopic(ctx, uri)
+		if ctx.Err() != nil {
+			return
+		}
+		log.Printf("ROS topic %s from %s: %v, connecting again in %s", t.name, uri, err, rosReconnectDelay)
+		metrics.Inc("ros.reconnects")
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(rosReconnectDelay):
+		}
+	}
+}
+
+// deliver hands message to every subscriber with room for it
+func (t *rosTopic) deliver(message rosMessage) {
+	t.node.mu.Lock()
+	defer t.node.mu.Unlock()
+
+	metrics.Inc("ros.messages")
+	for subscriber := range t.subscribers {
+		select {
+		case subscriber.messages <- message:
+		default:
+			metrics.Inc("ros.messages_dropped")
+		}
+	}
+}
+
+// handleNode answers the node API
+func (n *rosNode) handleNode(call *xmlrpcCall) interface{} {
+	switch call.MethodName {
+	case "publisherUpdate":
+		n.mu.Lock()
+		defer n.mu.Unlock()
+		if t, ok := n.topics[call.stringParam(1)]; ok {
+			t.updatePublishers(call.param(2))
+		}
+		return rosResult(1, "", 0)
+	case "getSubscriptions":
+		n.mu.Lock()
+		defer n.mu.Unlock()
+		subscriptions := []interface{}{}
+		for name := range n.topics {
+			subscriptions = append(subscriptions, []interface{}{name, "*"})
+		}
+		return rosResult(1, "", subscriptions)
+	case "getPublications":
+		n.mu.Lock()
+		defer n.mu.Unlock()
+		publications := []interface{}{}
+		for name, p := range n.publications {
+			publications = append(publications, []interface{}{name, p.msgType.name})
+		}
+		return rosResult(1, "", publications)
+	case "getBusInfo", "getBusStats":
+		return rosResult(1, "", []interface{}{})
+	case "getMasterUri":
+		return rosResult(1, "", n.masterURI)
+	case "getPid":
+		return rosResult(1, "", os.Getpid())
+	case "paramUpdate":
+		return rosResult(1, "", 0)
+	case "shutdown":
+		log.Printf("ROS node %s asked to shut down by %s: %s, ignored", n.callerID, call.stringParam(0), call.stringParam(1))
+		return rosResult(1, "", 0)
+	case "requestTopic":
+		n.mu.Lock()
+		_, ok := n.publications[call.stringParam(1)]
+		n.mu.Unlock()
+		if !ok {
+			return rosResult(-1, "not a publisher of "+call.stringParam(1), 0)
+		}
+		protocols, _ := call.param(2).([]interface{})
+		for _, item := range protocols {
+			if protocol, _ := item.([]interface{}); len(protocol) > 0 && protocol[0] == "TCPROS" {
+				return rosResult(1, "", []interface{}{"TCPROS", rosHost(), n.tcprosPort})
+			}
+		}
+		return rosResult(-1, "only TCPROS is spoken", 0)
+	}
+	return rosResult(-1, "unsupported method "+call.MethodName, 0)
+}
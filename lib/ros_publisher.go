@@ -0,0 +1,210 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"sync"
+	"time"
+)
+
+// ROS publications: the backend's node publishes topics too, such as the
+// teleoperation bridge's cmd_vel (see teleop.go). A topic is advertised to
+// the master, which tells the topic's subscribers; each asks the node's API
+// for the topic, is pointed at the node's TCPROS port, and is sent every
+// message published from then on. A subscriber's messages wait in a queue
+// of rosPublishQueueSize, the oldest dropped for the newest when it is
+// full, so a slow subscriber gets the latest rather than holding up the
+// others. A latched topic, such as the e-stop's (see estop.go), also sends
+// its latest message to each subscriber as it connects.
+
+// rosPublishQueueSize is how many messages wait to be written to a
+// subscriber before the oldest are dropped
+const rosPublishQueueSize = 4
+
+// rosPublication is a topic the node publishes
+type rosPublication struct {
+	node        *rosNode
+	name        string
+	msgType     rosMessageType
+	latched     bool
+	latest      []byte                  // if latched
+	subscribers map[*rosConnection]bool // connected
+	// guards latest and subscribers, and not the node's mu, which is held
+	// across calls to the master: publishing never waits on one
+	mu sync.Mutex
+}
+
+// rosConnection is a subscriber's connection to a publication
+type rosConnection struct {
+	conn     net.Conn
+	callerID string
+	queue    chan []byte // closed as the subscriber is dropped
+}
+
+// advertise registers the node as a publisher of topic, of msgType, with
+// the master, once however many times it is called. If latched, each
+// subscriber is sent the latest message as it connects. The master is
+// called without n.mu, so a slow one holds up no publishing; callers
+// racing to advertise the same topic all register, which the master
+// takes as one.
+func (n *rosNode) advertise(topic string, msgType rosMessageType, latched bool) (*rosPublication, error) {
+	n.mu.Lock()
+	p, err := n.publication(topic, msgType)
+	n.mu.Unlock()
+	if p != nil || err != nil {
+		return p, err
+	}
+	if _, err := callROS(n.masterURI, "registerPublisher", n.callerID, topic, msgType.name, n.uri); err != nil {
+		return nil, fmt.Errorf("failed to advertise %s: %v", topic, err)
+	}
+
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if p, err := n.publication(topic, msgType); p != nil || err != nil {
+		return p, err
+	}
+	p = &rosPublication{node: n, name: topic, msgType: msgType, latched: latched, subscribers: make(map[*rosConnection]bool)}
+	n.publications[topic] = p
+	log.Printf("ROS node %s publishes %s on %s", n.callerID, msgType.name, topic)
+	return p, nil
+}
+
+// publication returns topic's publication if it is advertised already, of
+// msgType, with n.mu held
+func (n *rosNode) publication(topic string, msgType rosMessageType) (*rosPublication, error) {
+	p, ok := n.publications[topic]
+	if !ok {
+		return nil, nil
+	}
+	if p.msgType.name != msgType.name {
+		return nil, fmt.Errorf("%s is already published as %s", topic, p.msgType.name)
+	}
+	return p, nil
+}
+
+// publish sends a serialized message to every subscriber connected
+func (p *rosPublication) publish(data []byte) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	metrics.Inc("ros.published")
+	if p.latched {
+		p.latest = data
+	}
+	for c := range p.subscribers {
+		select {
+		case c.queue <- data:
+			continue
+		default:
+		}
+		// Full: the newest replaces the oldest
+		select {
+		case <-c.queue:
+			metrics.Inc("ros.published_dropped")
+		default:
+		}
+		select {
+		case c.queue <- data:
+		default:
+		}
+	}
+}
+
+// drop disconnects a subscriber, with p.mu held
+func (p *rosPublication) drop(c *rosConnection) {
+	if !p.subscribers[c] {
+		return
+	}
+	delete(p.subscribers, c)
+	close(c.queue)
+	c.conn.Close()
+}
+
+// serveTCPROS accepts subscribers' connections to the node's publications
+func (n *rosNode) serveTCPROS(listener net.Listener) {
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			log.Printf("ROS node %s stopped accepting TCPROS connections: %v", n.callerID, err)
+			return
+		}
+		go n.handleTCPROS(conn)
+	}
+}
+
+// handleTCPROS exchanges connection headers with a subscriber, then writes
+// the publication's messages to it until either side drops
+func (n *rosNode) handleTCPROS(conn net.Conn) {
+	conn.SetDeadline(time.Now().Add(rosTimeout))
+	reader := bufio.NewReader(conn)
+	header, err := readROSHeader(reader)
+	if err != nil {
+		conn.Close()
+		return
+	}
+
+	n.mu.Lock()
+	p, ok := n.publications[header["topic"]]
+	n.mu.Unlock()
+	var refusal string
+	switch {
+	case header["service"] != "":
+		refusal = "services are not provided"
+	case !ok:
+		refusal = "not a publisher of " + header["topic"]
+	case header["md5sum"] != "*" && header["md5sum"] != p.msgType.md5:
+		refusal = fmt.Sprintf("%s is %s, md5sum %s, not %s", p.name, p.msgType.name, p.msgType.md5, header["md5sum"])
+	}
+	if refusal != "" {
+		writeROSHeader(conn, map[string]string{"error": refusal})
+		conn.Close()
+		return
+	}
+	latching := "0"
+	if p.latched {
+		latching = "1"
+	}
+	if err := writeROSHeader(conn, map[string]string{
+		"callerid":           n.callerID,
+		"topic":              p.name,
+		"type":               p.msgType.name,
+		"md5sum":             p.msgType.md5,
+		"message_definition": p.msgType.definition,
+		"latching":           latching,
+	}); err != nil {
+		conn.Close()
+		return
+	}
+	conn.SetDeadline(time.Time{})
+
+	c := &rosConnection{conn: conn, callerID: header["callerid"], queue: make(chan []byte, rosPublishQueueSize)}
+	p.mu.Lock()
+	p.subscribers[c] = true
+	if p.latest != nil {
+		c.queue <- p.latest
+	}
+	p.mu.Unlock()
+	log.Printf("ROS topic %s: %s subscribed", p.name, c.callerID)
+
+	// Subscribers send nothing more: a read ends as they disconnect
+	go func() {
+		io.Copy(io.Discard, reader)
+		p.mu.Lock()
+		p.drop(c)
+		p.mu.Unlock()
+	}()
+	for data := range c.queue {
+		conn.SetWriteDeadline(time.Now().Add(rosTimeout))
+		if _, err := conn.Write(append(binary.LittleEndian.AppendUint32(nil, uint32(len(data))), data...)); err != nil {
+			break
+		}
+	}
+	p.mu.Lock()
+	p.drop(c)
+	p.mu.Unlock()
+	log.Printf("ROS topic %s: %s unsubscribed", p.name, c.callerID)
+}
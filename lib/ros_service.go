@@ -0,0 +1,314 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"sort"
+	"strings"
+	"time"
+)
+
+// ROS services: the operator calls the robot's services, e.g.
+// /reset_costmap or /set_mode, with ros-service on the control channel, or
+// on <thingName>/ros-service over MQTT:
+//
+//	{"id": "op-3", "service": "/set_mode", "request": {"mode": "docking"}}
+//
+// Only the services in the allowlist at rosServicesPath, loaded at
+// startup, can be called. It gives each service's type; std_srvs' Empty,
+// Trigger and SetBool are built in, other types give their request and
+// response definitions (see ros_definition.go), and their MD5 sum if the
+// service checks it:
+//
+//	{"/reset_costmap": {"type": "std_srvs/Empty"},
+//	 "/set_mode": {"type": "robot_msgs/SetMode", "request": "string mode", "response": "bool success\nstring message"}}
+//
+// The request is serialized by its definition, the service looked up with
+// the master and called over TCPROS, and its response returned as JSON in a
+// ROSServiceResult: the control channel's ack has it as its result, and
+// MQTT's is published on <thingName>/ros-service/result. A call runs on its
+// own goroutine, so a slow service holds up nothing else, at most
+// rosServiceMaxCalls at a time, and gives up after rosServiceTimeout.
+
+// ControlROSService calls an allowlisted ROS service
+const ControlROSService = "ros-service"
+
+// rosServiceMaxCalls bounds the service calls in progress
+const rosServiceMaxCalls = 4
+
+// ROSServiceCall is the payload of ros-service
+type ROSServiceCall struct {
+	ID      string          `json:"id,omitempty"`
+	Service string          `json:"service"`
+	Request json.RawMessage `json:"request,omitempty"`
+}
+
+// rosServiceType is a service's type, with its request and response
+type rosServiceType struct {
+	name     string
+	md5      string // "*" if unknown
+	request  rosDefinition
+	response rosDefinition
+}
+
+// rosServiceEntry is a service in the allowlist
+type rosServiceEntry struct {
+	Type     string `json:"type"`
+	MD5Sum   string `json:"md5sum,omitempty"`
+	Request  string `json:"request,omitempty"`
+	Response string `json:"response,omitempty"`
+}
+
+// rosStandardServices are the service types known without definitions
+var rosStandardServices = map[string]rosServiceEntry{
+	"std_srvs/Empty":   {MD5Sum: "d41d8cd98f00b204e9800998ecf8427e"},
+	"std_srvs/Trigger": {MD5Sum: "937c9679a518e3a18d831e57125ea522", Response: "bool success\nstring message"},
+	"std_srvs/SetBool": {MD5Sum: "09fb03525b03e7ea1fd3992bafd87e16", Request: "bool data", Response: "bool success\nstring message"},
+}
+
+var (
+	// rosServices are the services that can be called, by name
+	rosServices = map[string]*rosServiceType{}
+	// rosServiceCalls holds a place for each call in progress
+	rosServiceCalls = make(chan struct{}, rosServiceMaxCalls)
+
+	errROSServiceBusy = errors.New("too many service calls in progress")
+)
+
+// loadROSServices allows the services in the allowlist at path. A missing
+// file allows none.
+func loadROSServices(path string) error {
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to read ROS services %s: %v", path, err)
+	}
+	var entries map[string]rosServiceEntry
+	if err := json.Unmarshal(data, &entries); err != nil {
+		return fmt.Errorf("invalid ROS services %s: %v", path, err)
+	}
+	services := make(map[string]*rosServiceType, len(entries))
+	for name, entry := range entries {
+		if name == "" || name[0] != '/' {
+			return fmt.Errorf("invalid ROS services %s: %q is not a global name", path, name)
+		}
+		service, err := entry.serviceType()
+		if err != nil {
+			return fmt.Errorf("invalid ROS services %s: %s: %v", path, name, err)
+		}
+		services[name] = service
+	}
+	// Only once the whole allowlist is valid
+	rosServices = services
+	log.Printf("Allowed ROS services from %s: %s", path, strings.Join(rosServiceNames(), ", "))
+	return nil
+}
+
+// serviceType parses the entry's definitions, or takes a standard type's
+func (e rosServiceEntry) serviceType() (*rosServiceType, error) {
+	if e.Type == "" {
+		return nil, errors.New("no type")
+	}
+	if standard, ok := rosStandardServices[e.Type]; ok && e.Request == "" && e.Response == "" {
+		e.Request, e.Response = standard.Request, standard.Response
+		if e.MD5Sum == "" {
+			e.MD5Sum = standard.MD5Sum
+		}
+	}
+	service := &rosServiceType{name: e.Type, md5: e.MD5Sum}
+	if service.md5 == "" {
+		service.md5 = "*"
+	}
+	var err error
+	if service.request, err = parseROSDefinition(e.Request); err != nil {
+		return nil, fmt.Errorf("request: %v", err)
+	}
+	if service.response, err = parseROSDefinition(e.Response); err != nil {
+		return nil, fmt.Errorf("response: %v", err)
+	}
+	return service, nil
+}
+
+// rosServiceNames lists the allowed services
+func rosServiceNames() []string {
+	names := make([]string, 0, len(rosServices))
+	for name := range rosServices {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// rosServiceControl calls a service from the control channel, replying
+// with its ROSServiceResult once it returns
+func rosServiceControl() ControlSlowFunc {
+	return ControlSlowFunc(func(peerID string, payload json.RawMessage) (interface{}, error) {
+		var call ROSServiceCall
+		if err := json.Unmarshal(payload, &call); err != nil {
+			return nil, fmt.Errorf("invalid ros-service: %v", err)
+		}
+		result := callROSService(call)
+		if !result.OK {
+			return result, errors.New(result.Error)
+		}
+		return result, nil
+	})
+}
+
+// handleROSService calls a service from <thingName>/ros-service, with
+// mqttControlEnabled, publishing its result on <thingName>/ros-service/result
+func (m *MQTTClient) handleROSService(topic string, payload []byte) {
+	var call ROSServiceCall
+	if err := json.Unmarshal(payload, &call); err != nil {
+		log.Printf("Invalid ROS service call on %s: %v", topic, err)
+		m.sendROSServiceResult(ROSServiceResult{Schema: ROSServiceResultSchema, Error: fmt.Sprintf("invalid call: %v", err), Time: time.Now().UTC()})
+		return
+	}
+	if !mqttControlEnabled {
+		log.Printf("ROS service call %s on %s refused: %v", call.Service, topic, errMQTTControlDisabled)
+		metrics.Inc("ros.service_mqtt_refused")
+		m.sendROSServiceResult(ROSServiceResult{Schema: ROSServiceResultSchema, ID: call.ID, Service: call.Service, Error: errMQTTControlDisabled.Error(), Time: time.Now().UTC()})
+		return
+	}
+	// Off the MQTT client's goroutine, which an e-stop may be waiting on
+	go func() {
+		m.sendROSServiceResult(callROSService(call))
+	}()
+}
+
+func (m *MQTTClient) sendROSServiceResult(result ROSServiceResult) {
+	payload, err := json.Marshal(result)
+	if err != nil {
+		log.Printf("Failed to marshal ROS service result: %v", err)
+		return
+	}
+	if err := m.publish(deviceTopic("ros-service/result"), payload); err != nil {
+		log.Printf("Failed to publish ROS service result: %v", err)
+	}
+}
+
+// callROSService calls an allowed service, returning its response, or why
+// it failed, in a ROSServiceResult
+func callROSService(call ROSServiceCall) ROSServiceResult {
+	start := time.Now()
+	response, err := invokeROSService(call)
+	result := ROSServiceResult{
+		Schema:   ROSServiceResultSchema,
+		ID:       call.ID,
+		Service:  call.Service,
+		OK:       err == nil,
+		Response: response,
+		Time:     time.Now().UTC(),
+	}
+	metrics.Observe("ros.service_call", time.Since(start))
+	if err != nil {
+		metrics.Inc("ros.service_failures")
+		log.Printf("ROS service %s failed: %v", call.Service, err)
+		result.Error = err.Error()
+	} else {
+		metrics.Inc("ros.service_calls")
+	}
+	return result
+}
+
+func invokeROSService(call ROSServiceCall) (map[string]interface{}, error) {
+	service, ok := rosServices[call.Service]
+	if !ok {
+		metrics.Inc("ros.service_refused")
+		return nil, fmt.Errorf("%q is not an allowed service", call.Service)
+	}
+	request, err := service.request.encode(call.Request)
+	if err != nil {
+		return nil, fmt.Errorf("invalid request: %v", err)
+	}
+
+	select {
+	case rosServiceCalls <- struct{}{}:
+		defer func() { <-rosServiceCalls }()
+	default:
+		return nil, errROSServiceBusy
+	}
+	node, err := startROSNode()
+	if err != nil {
+		return nil, err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), rosServiceTimeout)
+	defer cancel()
+	data, err := node.callService(ctx, call.Service, service, request)
+	if err != nil {
+		return nil, err
+	}
+	response, err := service.response.decode(data)
+	if err != nil {
+		return nil, fmt.Errorf("invalid response: %v", err)
+	}
+	return response, nil
+}
+
+// callService calls service, of type srv, with a serialized request,
+// returning the serialized response: the master tells which node provides
+// it, and the call is a TCPROS connection of its own
+func (n *rosNode) callService(ctx context.Context, service string, srv *rosServiceType, request []byte) ([]byte, error) {
+	value, err := callROS(n.masterURI, "lookupService", n.callerID, service)
+	if err != nil {
+		return nil, err
+	}
+	uri, _ := value.(string)
+	address, ok := strings.CutPrefix(uri, "rosrpc://")
+	if !ok {
+		return nil, fmt.Errorf("%s is at %q, not a rosrpc URI", service, uri)
+	}
+
+	var dialer net.Dialer
+	conn, err := dialer.DialContext(ctx, "tcp", strings.TrimSuffix(address, "/"))
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+
+	if err := writeROSHeader(conn, map[string]string{
+		"callerid": n.callerID,
+		"service":  service,
+		"md5sum":   srv.md5,
+	}); err != nil {
+		return nil, err
+	}
+	reader := bufio.NewReader(conn)
+	header, err := readROSHeader(reader)
+	if err != nil {
+		return nil, fmt.Errorf("bad connection header: %v", err)
+	}
+	if header["error"] != "" {
+		return nil, errors.New(header["error"])
+	}
+	if _, err := conn.Write(append(binary.LittleEndian.AppendUint32(nil, uint32(len(request))), request...)); err != nil {
+		return nil, err
+	}
+
+	// The response is prefixed with whether the call succeeded; if not,
+	// it is the error
+	status, err := reader.ReadByte()
+	if err != nil {
+		return nil, err
+	}
+	data, err := readROSMessage(reader)
+	if err != nil {
+		return nil, err
+	}
+	if status == 0 {
+		return nil, fmt.Errorf("%s failed: %s", service, data)
+	}
+	return data, nil
+}
@@ -0,0 +1,468 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net/url"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ROS cameras: a camera whose entry in cameraDirectories is "ros:<topic>"
+// streams a ROS image topic, subscribed to by the backend's node (see
+// ros_node.go). It is captured like a camera attached to the host (see
+// camera_capture.go), ffmpeg reading the topic's images from a pipe:
+// sensor_msgs/Image as raw video, or sensor_msgs/CompressedImage, JPEG or
+// PNG as most image_transport compressed topics publish, through an
+// image2pipe input, so compressed topics cost the bus a fraction of raw
+// ones. The topic's type is learned from its publisher. Images are scaled
+// to fit the entry's size, and taken at its frame rate:
+//
+//	"ros:/leopard_id1/image_resized/compressed?size=640x512&fps=15"
+//
+// A topic published faster than the frame rate, e.g. a 60 fps camera, is
+// decimated before ffmpeg reads it, so it costs the encoder no more than
+// one at the frame rate. The every option also takes only every Nth image,
+// whatever the rate, e.g. every=2 halves a topic of 30 fps to 15:
+//
+//	"ros:/flir_id8/image_resized?every=2"
+//
+// Frames are timed by their images' header stamps rather than as they
+// arrive, so the capture-time SEI and the frames' durations tell when the
+// camera took them, however the bus delayed, bunched or dropped them. The
+// robot's clock is put on the backend's by the least delay its images came
+// with over the last rosClockSkewWindow or two (see rosClockSkew); images
+// without a stamp are timed as they arrive. The frame rate is kept by
+// skipping images by their stamps before ffmpeg reads them, and ffmpeg
+// encodes every image it reads, so each frame is mapped back to its image.
+//
+// Each run of ffmpeg waits for the topic's first image, whose type, size
+// and encoding it is started for; an image of another one ends the run, and
+// the next starts for it.
+//
+// The topic is subscribed to only while a track shows the camera: with the
+// source manager, a ROS camera is not started ahead of being shown, and
+// stops streamLinger after the last track showing it switches away, sparing
+// the robot's bus and CPU (see source_manager.go).
+
+// rosImageQueueSize is how many images wait for ffmpeg to read them before
+// the next are dropped
+const rosImageQueueSize = 2
+
+// rosClockSkewWindow is how long the least delay of a topic's images is
+// taken over, before the window after it starts over
+const rosClockSkewWindow = 10 * time.Second
+
+// rosImageTopic returns the capture a "ros:<topic>" camera entry
+// configures. ok is false for other entries.
+func rosImageTopic(address string) (config captureConfig, ok bool) {
+	spec, ok := strings.CutPrefix(address, "ros:")
+	if !ok {
+		return captureConfig{}, false
+	}
+	topic, options, _ := strings.Cut(spec, "?")
+	config = captureConfig{
+		device:  topic,
+		width:   captureWidth,
+		height:  captureHeight,
+		fps:     captureFPS,
+		bitrate: captureBitrate,
+		profile: captureProfile,
+		ros:     true,
+	}
+	values, _ := url.ParseQuery(options)
+	config.orientation = orientationOptions(values)
+	if every, err := strconv.Atoi(values.Get("every")); err == nil && every > 1 {
+		config.every = every
+	}
+	config.thermal = thermalOptionsFrom(values)
+	return captureOptions(config, values), true
+}
+
+// rosImageFormat is what ffmpeg is started to read: the type of a topic's
+// images and, for raw ones, their size and encoding
+type rosImageFormat struct {
+	codec         string // image2pipe's decoder of compressed images, mjpeg or png; "" for raw ones
+	pixelFormat   string // ffmpeg's of raw images, e.g. rgb24
+	width, height int
+	bytesPerPixel int
+}
+
+// rosPixelFormats are ffmpeg's pixel formats of the sensor_msgs/Image
+// encodings streamed, and their bytes per pixel. Big-endian 16-bit images
+// are gray16be.
+var rosPixelFormats = map[string]struct {
+	pixelFormat   string
+	bytesPerPixel int
+}{
+	"rgb8":   {"rgb24", 3},
+	"bgr8":   {"bgr24", 3},
+	"rgba8":  {"rgba", 4},
+	"bgra8":  {"bgra", 4},
+	"mono8":  {"gray", 1},
+	"8UC1":   {"gray", 1},
+	"mono16": {"gray16le", 2},
+	"16UC1":  {"gray16le", 2},
+	"yuv422": {"uyvy422", 2},
+}
+
+// rosFormat returns the format of the image message carries, and its
+// picture: the compressed image, or the raw pixels without row padding
+func rosFormat(message rosMessage) (format rosImageFormat, picture []byte, err error) {
+	switch message.Type {
+	case rosCompressedImageType:
+		image, err := decodeROSCompressedImage(message.Data)
+		if err != nil {
+			return format, nil, err
+		}
+		switch compression := strings.ToLower(image.Format); {
+		case strings.Contains(compression, "compresseddepth"):
+			return format, nil, fmt.Errorf("unsupported compressed depth image %q", image.Format)
+		case strings.Contains(compression, "png"):
+			format.codec = "png"
+		case strings.Contains(compression, "jpeg"), strings.Contains(compression, "jpg"):
+			format.codec = "mjpeg"
+		default:
+			return format, nil, fmt.Errorf("unsupported image compression %q", image.Format)
+		}
+		return format, image.Data, nil
+	case rosImageType:
+		image, err := decodeROSImage(message.Data)
+		if err != nil {
+			return format, nil, err
+		}
+		pixels, ok := rosPixelFormats[image.Encoding]
+		if !ok {
+			return format, nil, fmt.Errorf("unsupported image encoding %q", image.Encoding)
+		}
+		format = rosImageFormat{pixelFormat: pixels.pixelFormat, width: image.Width, height: image.Height, bytesPerPixel: pixels.bytesPerPixel}
+		if image.BigEndian && pixels.pixelFormat == "gray16le" {
+			format.pixelFormat = "gray16be"
+		}
+		row := image.Width * pixels.bytesPerPixel
+		if image.Step < row {
+			return format, nil, fmt.Errorf("image rows of %d bytes, %dx%d %s needs %d", image.Step, image.Width, image.Height, image.Encoding, row)
+		}
+		if image.Step == row {
+			return format, image.Data[:row*image.Height], nil
+		}
+		picture = make([]byte, 0, row*image.Height)
+		for y := 0; y < image.Height; y++ {
+			picture = append(picture, image.Data[y*image.Step:y*image.Step+row]...)
+		}
+		return format, picture, nil
+	}
+	return format, nil, fmt.Errorf("%s is not an image", message.Type)
+}
+
+// rosStamp returns the header stamp of an image message, read ahead of the
+// rest of it: both image types start with their header
+func rosStamp(message rosMessage) time.Time {
+	r := rosReader{data: message.Data}
+	return r.header().Stamp
+}
+
+// newROSCapture returns a source capturing config's topic
+func newROSCapture(config captureConfig) (*processSource, error) {
+	if _, err := config.orientation.filters(); err != nil {
+		return nil, fmt.Errorf("cannot capture %s: %v", config.device, err)
+	}
+	if _, err := config.thermal.colorizer(config.device); err != nil {
+		return nil, fmt.Errorf("cannot capture %s: %v", config.device, err)
+	}
+
+	var input *rosInput // of the current run
+	var encoder h264Encoder
+	started := false // the current run's process
+	source := &processSource{
+		name:         "ROS camera " + config.device,
+		timeout:      captureTimeout,
+		restartDelay: captureRestartDelay,
+		metric:       "ros.restarts",
+		progress:     true,
+		onDemand:     true,
+	}
+	source.prepare = func(stop <-chan struct{}) error {
+		var err error
+		started = false
+		input, err = startROSInput(config, stop)
+		return err
+	}
+	source.command = func(port int) (*exec.Cmd, error) {
+		encoder = captureEncoders.selectEncoder()
+		started = true
+		cmd := exec.Command(captureCommand, rosArgs(config, input.format, encoder, port)...)
+		// pipe:3 in the process
+		cmd.ExtraFiles = []*os.File{input.reader}
+		return cmd, nil
+	}
+	source.retime = func(frame *VideoFrame, timestamp uint32) {
+		input.retime(frame, timestamp)
+	}
+	source.afterRun = func() {
+		if input != nil {
+			input.stop()
+			input = nil
+		}
+	}
+	source.cost = func() float64 {
+		return captureCost(config, captureEncoders.selectEncoder())
+	}
+	source.ended = func(frames int, err error) {
+		// A topic without images is not the encoder's fault
+		if frames == 0 && started {
+			captureEncoders.markFailed(encoder.name)
+		}
+	}
+	return source, nil
+}
+
+// rosArgs returns the ffmpeg arguments reading config's topic, images of
+// format, from pipe 3 and encoding them with encoder, sending RTP to port
+func rosArgs(config captureConfig, format rosImageFormat, encoder h264Encoder, port int) []string {
+	args := []string{"-hide_banner", "-loglevel", "error", "-progress", "pipe:1"}
+	args = append(args, encoder.inputArgs...)
+	// The images are timestamped as if they came at the frame rate, so a
+	// frame's RTP timestamp tells which image it is (see rosInput.retime)
+	args = append(args, "-framerate", strconv.Itoa(config.fps))
+	if format.codec != "" {
+		args = append(args, "-f", "image2pipe", "-c:v", format.codec, "-i", "pipe:3")
+	} else {
+		args = append(args, "-f", "rawvideo", "-pixel_format", format.pixelFormat,
+			"-video_size", fmt.Sprintf("%dx%d", format.width, format.height), "-i", "pipe:3")
+	}
+	// Checked as the source was created
+	filters, _ := config.orientation.filters()
+	filters = append(filters, fitFilter(config.width, config.height))
+	if encoder.filter != "" {
+		filters = append(filters, encoder.filter)
+	}
+	// Every image is encoded, none dropped or repeated
+	args = append(args, "-vf", strings.Join(filters, ","), "-vsync", "passthrough")
+	return append(args, encodeArgs(config, encoder, port)...)
+}
+
+// rosInput feeds a topic's images to one run of the process, on a pipe
+type rosInput struct {
+	topic          string
+	fps            int
+	every          int // images taken, 1 in every; 0 for all
+	subscriber     *rosSubscriber
+	format         rosImageFormat // of the run, the first image's
+	first          []byte         // the first image's picture
+	reader, writer *os.File
+	fed            chan struct{} // closed as feed returns
+	// thermal colors the images if they are 16-bit, nil to leave them
+	thermal *thermalColorizer
+	// Of feed: the images' clock, how many came, and when the next image
+	// is due
+	skew      rosClockSkew
+	received  int
+	due, last time.Time // last is the capture time of the last image taken
+	// captures are the capture times of the images fed and not yet
+	// encoded, the first the image numbered base, in the order fed
+	captures []time.Time
+	base     int
+	mu       sync.Mutex
+	// Of retime: the first frame's RTP timestamp, and the last frame's
+	// capture time
+	firstTimestamp uint32
+	timed          bool
+	lastCaptured   time.Time
+}
+
+// rosClockSkew estimates the offset of the backend's clock from the
+// robot's, as the least delay images came with: the one least delayed
+// came closest to straight from the camera. The least is taken over the
+// current window and the one before it, so that the offset follows the
+// clocks drifting apart, while a window's first images do not leave it to
+// any one image.
+type rosClockSkew struct {
+	start             time.Time // of the current window
+	current, previous time.Duration
+}
+
+// observe adds an image stamped at stamp and received at received,
+// returning the offset
+func (s *rosClockSkew) observe(stamp, received time.Time) time.Duration {
+	delay := received.Sub(stamp)
+	switch {
+	case s.start.IsZero():
+		s.start, s.current, s.previous = received, delay, delay
+	case received.Sub(s.start) >= rosClockSkewWindow:
+		s.start, s.current, s.previous = received, delay, s.current
+	case delay < s.current:
+		s.current = delay
+	}
+	return min(s.current, s.previous)
+}
+
+var errROSStopped = errors.New("stopped")
+
+// startROSInput subscribes to config's topic and waits for its first
+// image, which the run is started for, until stop closes
+func startROSInput(config captureConfig, stop <-chan struct{}) (*rosInput, error) {
+	topic := config.device
+	node, err := startROSNode()
+	if err != nil {
+		return nil, err
+	}
+	subscriber, err := node.subscribe(topic, rosImageQueueSize)
+	if err != nil {
+		return nil, err
+	}
+	input := &rosInput{topic: topic, fps: config.fps, every: config.every, subscriber: subscriber, fed: make(chan struct{})}
+	// Checked as the source was created
+	input.thermal, _ = config.thermal.colorizer(topic)
+
+	timeout := time.NewTimer(captureTimeout)
+	defer timeout.Stop()
+	select {
+	case message := <-subscriber.messages:
+		format, picture, err := rosFormat(message)
+		if err != nil {
+			subscriber.Close()
+			return nil, fmt.Errorf("%s: %v", topic, err)
+		}
+		format, picture = input.thermal.colorize(format, picture)
+		input.format = format
+		input.first = append([]byte(nil), picture...)
+		// The first image is always taken
+		captured := input.captureTime(rosStamp(message), message.Received)
+		input.take(captured)
+		input.record(captured)
+	case <-timeout.C:
+		subscriber.Close()
+		return nil, fmt.Errorf("no image on %s for %s", topic, captureTimeout)
+	case <-stop:
+		subscriber.Close()
+		return nil, errROSStopped
+	}
+
+	input.reader, input.writer, err = os.Pipe()
+	if err != nil {
+		subscriber.Close()
+		return nil, err
+	}
+	// Writes wait for the process to read them, or the input to stop
+	go input.feed()
+	return input, nil
+}
+
+// feed writes the topic's images to the pipe until the input stops, or an
+// image of another format comes, closing the pipe for the process to end
+func (i *rosInput) feed() {
+	defer close(i.fed)
+	defer i.writer.Close()
+
+	if _, err := i.writer.Write(i.first); err != nil {
+		return
+	}
+	for message := range i.subscriber.messages {
+		// Images skipped are not decoded, nor raw ones' rows copied
+		captured := i.captureTime(rosStamp(message), message.Received)
+		if !i.take(captured) {
+			metrics.Inc("ros.images_skipped")
+			continue
+		}
+		format, picture, err := rosFormat(message)
+		if err != nil {
+			metrics.Inc("ros.images_invalid")
+			log.Printf("%s: %v", i.topic, err)
+			continue
+		}
+		format, picture = i.thermal.colorize(format, picture)
+		if format != i.format {
+			log.Printf("%s: images changed from %+v to %+v, restarting", i.topic, i.format, format)
+			return
+		}
+		i.record(captured)
+		if _, err := i.writer.Write(picture); err != nil {
+			return
+		}
+	}
+}
+
+// captureTime puts an image's stamp on the backend's clock, or takes when
+// it was received if it has none
+func (i *rosInput) captureTime(stamp, received time.Time) time.Time {
+	if stamp.Equal(time.Unix(0, 0)) {
+		metrics.Inc("ros.images_unstamped")
+		return received
+	}
+	return stamp.Add(i.skew.observe(stamp, received))
+}
+
+// take reports whether the image captured at captured is fed: every Nth
+// image if the entry says so, kept to the frame rate. An image a quarter of
+// a frame early is still taken, as stamps jitter.
+func (i *rosInput) take(captured time.Time) bool {
+	i.received++
+	if i.every > 1 && (i.received-1)%i.every != 0 {
+		return false
+	}
+	period := time.Second / time.Duration(i.fps)
+	switch {
+	case i.due.IsZero(), captured.Before(i.last), captured.Sub(i.due) >= period:
+		// The first image, or one after a gap or the robot's clock going
+		// back, sets the pace anew
+		i.due = captured.Add(period)
+	case captured.Before(i.due.Add(-period / 4)):
+		return false
+	default:
+		i.due = i.due.Add(period)
+	}
+	i.last = captured
+	return true
+}
+
+// record records the capture time of the image fed next, for retime
+func (i *rosInput) record(captured time.Time) {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	i.captures = append(i.captures, captured)
+}
+
+// retime times frame, the encoding of the image whose number its RTP
+// timestamp tells, by when the image was captured: its capture time, and
+// its duration since the frame before it. A frame whose image is unknown
+// keeps the process's timing.
+func (i *rosInput) retime(frame *VideoFrame, timestamp uint32) {
+	if !i.timed {
+		i.firstTimestamp, i.timed = timestamp, true
+	}
+	ticks := uint64(timestamp - i.firstTimestamp)
+	number := int((ticks*uint64(i.fps) + h264ClockRate/2) / h264ClockRate)
+
+	i.mu.Lock()
+	index := number - i.base
+	if index < 0 || index >= len(i.captures) {
+		i.mu.Unlock()
+		metrics.Inc("ros.frames_untimed")
+		return
+	}
+	captured := i.captures[index]
+	i.captures = i.captures[index+1:]
+	i.base = number + 1
+	i.mu.Unlock()
+
+	if !i.lastCaptured.IsZero() && captured.After(i.lastCaptured) {
+		frame.Duration = captured.Sub(i.lastCaptured)
+	}
+	i.lastCaptured = captured
+	frame.Captured = mediaClock.Now().Add(-time.Since(captured))
+}
+
+// stop stops the input once its run of the process ended
+func (i *rosInput) stop() {
+	// Closing the reader fails a write blocked on a process no longer
+	// reading
+	i.subscriber.Close()
+	i.reader.Close()
+	<-i.fed
+}
@@ -0,0 +1,129 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"time"
+)
+
+// TCPROS, the transport of ROS topics: after connection headers, lists of
+// key=value fields, are exchanged, each message is sent serialized,
+// prefixed with its length. Subscribers send md5sum and type "*", which
+// every publisher accepts, and learn the topic's type from the publisher's
+// header, so one subscription takes any message type.
+
+// maxROSHeaderSize bounds the connection header a peer can send
+const maxROSHeaderSize = 64 * 1024
+
+// readROSHeader reads a TCPROS connection header into its fields
+func readROSHeader(r io.Reader) (map[string]string, error) {
+	var size uint32
+	if err := binary.Read(r, binary.LittleEndian, &size); err != nil {
+		return nil, err
+	}
+	if size > maxROSHeaderSize {
+		return nil, fmt.Errorf("connection header of %d bytes", size)
+	}
+	data := make([]byte, size)
+	if _, err := io.ReadFull(r, data); err != nil {
+		return nil, err
+	}
+
+	fields := make(map[string]string)
+	for len(data) >= 4 {
+		n := binary.LittleEndian.Uint32(data)
+		if int(n) > len(data)-4 {
+			return nil, errors.New("truncated connection header")
+		}
+		key, value, _ := strings.Cut(string(data[4:4+n]), "=")
+		fields[key] = value
+		data = data[4+n:]
+	}
+	return fields, nil
+}
+
+// writeROSHeader writes a TCPROS connection header of fields
+func writeROSHeader(w io.Writer, fields map[string]string) error {
+	var data []byte
+	for key, value := range fields {
+		data = appendROSString(data, key+"="+value)
+	}
+	_, err := w.Write(append(binary.LittleEndian.AppendUint32(nil, uint32(len(data))), data...))
+	return err
+}
+
+// readROSMessage reads the next serialized message
+func readROSMessage(r io.Reader) ([]byte, error) {
+	var size uint32
+	if err := binary.Read(r, binary.LittleEndian, &size); err != nil {
+		return nil, err
+	}
+	if size > rosMaxMessageSize {
+		return nil, fmt.Errorf("message of %d bytes", size)
+	}
+	data := make([]byte, size)
+	if _, err := io.ReadFull(r, data); err != nil {
+		return nil, err
+	}
+	return data, nil
+}
+
+// receiveTopic subscribes to the topic t at the publisher whose node API is
+// at uri, handing its messages to t until ctx is cancelled or the
+// connection fails
+func (t *rosTopic) receiveTopic(ctx context.Context, uri string) error {
+	value, err := callROS(uri, "requestTopic", t.node.callerID, t.name, []interface{}{[]interface{}{"TCPROS"}})
+	if err != nil {
+		return err
+	}
+	protocol, _ := value.([]interface{})
+	if len(protocol) != 3 || protocol[0] != "TCPROS" {
+		return fmt.Errorf("%s offers %s over %v, not TCPROS", uri, t.name, value)
+	}
+	host, _ := protocol[1].(string)
+	port, _ := protocol[2].(int)
+
+	dialer := net.Dialer{Timeout: rosTimeout}
+	conn, err := dialer.DialContext(ctx, "tcp", net.JoinHostPort(host, fmt.Sprint(port)))
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	// Cancelling ends the reads below
+	stop := context.AfterFunc(ctx, func() { conn.Close() })
+	defer stop()
+
+	conn.SetDeadline(time.Now().Add(rosTimeout))
+	if err := writeROSHeader(conn, map[string]string{
+		"callerid":    t.node.callerID,
+		"topic":       t.name,
+		"md5sum":      "*",
+		"type":        "*",
+		"tcp_nodelay": "1",
+	}); err != nil {
+		return err
+	}
+	reader := bufio.NewReader(conn)
+	header, err := readROSHeader(reader)
+	if err != nil {
+		return fmt.Errorf("bad connection header: %v", err)
+	}
+	if header["error"] != "" {
+		return errors.New(header["error"])
+	}
+	conn.SetDeadline(time.Time{})
+
+	for {
+		data, err := readROSMessage(reader)
+		if err != nil {
+			return err
+		}
+		t.deliver(rosMessage{Type: header["type"], Data: data, Received: time.Now()})
+	}
+}
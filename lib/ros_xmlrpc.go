@@ -0,0 +1,222 @@
+package main
+
+import (
+	"bytes"
+	"encoding/xml"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// Just enough XML-RPC for the ROS master and node APIs (see ros_node.go):
+// string, int, boolean and double values, arrays and structs of them
+
+// xmlrpcCall is a call to, or from, an XML-RPC API
+type xmlrpcCall struct {
+	MethodName string        `xml:"methodName"`
+	Params     []xmlrpcValue `xml:"params>param>value"`
+}
+
+// xmlrpcResponse is the response to an xmlrpcCall
+type xmlrpcResponse struct {
+	Params []xmlrpcValue `xml:"params>param>value"`
+	Fault  *xmlrpcValue  `xml:"fault>value"`
+}
+
+// xmlrpcValue is one value as it is encoded; value decodes it
+type xmlrpcValue struct {
+	String  *string       `xml:"string"`
+	Int     *string       `xml:"int"`
+	I4      *string       `xml:"i4"`
+	Boolean *string       `xml:"boolean"`
+	Double  *string       `xml:"double"`
+	Array   *xmlrpcArray  `xml:"array"`
+	Struct  *xmlrpcStruct `xml:"struct"`
+	Text    string        `xml:",chardata"` // an untyped value is a string
+}
+
+type xmlrpcArray struct {
+	Values []xmlrpcValue `xml:"data>value"`
+}
+
+type xmlrpcStruct struct {
+	Members []struct {
+		Name  string      `xml:"name"`
+		Value xmlrpcValue `xml:"value"`
+	} `xml:"member"`
+}
+
+// value returns v as a string, int, bool, float64, []interface{} or
+// map[string]interface{}
+func (v xmlrpcValue) value() interface{} {
+	switch {
+	case v.String != nil:
+		return *v.String
+	case v.Int != nil:
+		n, _ := strconv.Atoi(strings.TrimSpace(*v.Int))
+		return n
+	case v.I4 != nil:
+		n, _ := strconv.Atoi(strings.TrimSpace(*v.I4))
+		return n
+	case v.Boolean != nil:
+		return strings.TrimSpace(*v.Boolean) == "1"
+	case v.Double != nil:
+		f, _ := strconv.ParseFloat(strings.TrimSpace(*v.Double), 64)
+		return f
+	case v.Array != nil:
+		values := make([]interface{}, len(v.Array.Values))
+		for i, item := range v.Array.Values {
+			values[i] = item.value()
+		}
+		return values
+	case v.Struct != nil:
+		members := make(map[string]interface{}, len(v.Struct.Members))
+		for _, member := range v.Struct.Members {
+			members[member.Name] = member.Value.value()
+		}
+		return members
+	}
+	return v.Text
+}
+
+// stringParam returns the i-th parameter as a string, "" if missing
+func (c *xmlrpcCall) stringParam(i int) string {
+	if i >= len(c.Params) {
+		return ""
+	}
+	s, _ := c.Params[i].value().(string)
+	return s
+}
+
+// param returns the i-th parameter, nil if missing
+func (c *xmlrpcCall) param(i int) interface{} {
+	if i >= len(c.Params) {
+		return nil
+	}
+	return c.Params[i].value()
+}
+
+func writeXMLRPCValue(buf *bytes.Buffer, value interface{}) {
+	buf.WriteString("<value>")
+	switch v := value.(type) {
+	case string:
+		buf.WriteString("<string>")
+		xml.EscapeText(buf, []byte(v))
+		buf.WriteString("</string>")
+	case int:
+		fmt.Fprintf(buf, "<i4>%d</i4>", v)
+	case bool:
+		if v {
+			buf.WriteString("<boolean>1</boolean>")
+		} else {
+			buf.WriteString("<boolean>0</boolean>")
+		}
+	case float64:
+		fmt.Fprintf(buf, "<double>%s</double>", strconv.FormatFloat(v, 'g', -1, 64))
+	case []interface{}:
+		buf.WriteString("<array><data>")
+		for _, item := range v {
+			writeXMLRPCValue(buf, item)
+		}
+		buf.WriteString("</data></array>")
+	case map[string]interface{}:
+		buf.WriteString("<struct>")
+		for name, member := range v {
+			buf.WriteString("<member><name>")
+			xml.EscapeText(buf, []byte(name))
+			buf.WriteString("</name>")
+			writeXMLRPCValue(buf, member)
+			buf.WriteString("</member>")
+		}
+		buf.WriteString("</struct>")
+	default:
+		panic(fmt.Sprintf("xmlrpc: unsupported value %T", value))
+	}
+	buf.WriteString("</value>")
+}
+
+// xmlrpcClient makes the calls of callXMLRPC
+var xmlrpcClient = &http.Client{Timeout: rosTimeout}
+
+// callXMLRPC calls method of the XML-RPC API at uri, returning the value
+// of its response
+func callXMLRPC(uri string, method string, params ...interface{}) (interface{}, error) {
+	var buf bytes.Buffer
+	buf.WriteString(`<?xml version="1.0"?><methodCall><methodName>`)
+	xml.EscapeText(&buf, []byte(method))
+	buf.WriteString("</methodName><params>")
+	for _, param := range params {
+		buf.WriteString("<param>")
+		writeXMLRPCValue(&buf, param)
+		buf.WriteString("</param>")
+	}
+	buf.WriteString("</params></methodCall>")
+
+	response, err := xmlrpcClient.Post(uri, "text/xml", &buf)
+	if err != nil {
+		return nil, err
+	}
+	defer response.Body.Close()
+	if response.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("%s %s: %s", uri, method, response.Status)
+	}
+	var result xmlrpcResponse
+	if err := xml.NewDecoder(response.Body).Decode(&result); err != nil {
+		return nil, fmt.Errorf("%s %s: invalid response: %v", uri, method, err)
+	}
+	if result.Fault != nil {
+		fault, _ := result.Fault.value().(map[string]interface{})
+		return nil, fmt.Errorf("%s %s: fault %v: %v", uri, method, fault["faultCode"], fault["faultString"])
+	}
+	if len(result.Params) != 1 {
+		return nil, fmt.Errorf("%s %s: response without a value", uri, method)
+	}
+	return result.Params[0].value(), nil
+}
+
+// callROS calls method of the ROS master or node API at uri, returning the
+// value of its [code, statusMessage, value] result if the call succeeded
+func callROS(uri string, method string, params ...interface{}) (interface{}, error) {
+	response, err := callXMLRPC(uri, method, params...)
+	if err != nil {
+		return nil, err
+	}
+	result, ok := response.([]interface{})
+	if !ok || len(result) != 3 {
+		return nil, fmt.Errorf("%s %s: invalid result %v", uri, method, response)
+	}
+	if code, _ := result[0].(int); code != 1 {
+		return nil, fmt.Errorf("%s %s: %v", uri, method, result[1])
+	}
+	return result[2], nil
+}
+
+// rosResult is the [code, statusMessage, value] triple every ROS API call
+// returns
+func rosResult(code int, status string, value interface{}) []interface{} {
+	return []interface{}{code, status, value}
+}
+
+// xmlrpcHandler serves XML-RPC calls with handle, which returns the value of
+// the response
+func xmlrpcHandler(name string, handle func(call *xmlrpcCall) interface{}) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var call xmlrpcCall
+		if err := xml.NewDecoder(r.Body).Decode(&call); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		var buf bytes.Buffer
+		buf.WriteString(`<?xml version="1.0"?><methodResponse><params><param>`)
+		writeXMLRPCValue(&buf, handle(&call))
+		buf.WriteString("</param></params></methodResponse>")
+
+		w.Header().Set("Content-Type", "text/xml")
+		if _, err := w.Write(buf.Bytes()); err != nil {
+			log.Printf("%s: failed to answer %s: %v", name, call.MethodName, err)
+		}
+	})
+}
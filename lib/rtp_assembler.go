@@ -0,0 +1,97 @@
+package main
+
+import (
+	"time"
+
+	"github.com/pion/rtp"
+	"github.com/pion/rtp/codecs"
+)
+
+// h264ClockRate is the RTP clock rate of H.264
+const h264ClockRate = 90000
+
+// rtpFrameAssembler joins the RTP packets of each frame into a
+// length-prefixed frame
+type rtpFrameAssembler struct {
+	depacketizer *codecs.H264Packet
+	frame        []byte
+	// spare is the frame last emitted, whose buffer is assembled into once
+	// the one after it is emitted
+	spare     []byte
+	timestamp uint32 // of the frame being assembled
+	sequence  uint16 // of the last packet
+	started   bool   // a packet has been received
+	corrupt   bool   // the frame being assembled lost a packet
+	// lastTimestamp times the frames, once one has been emitted
+	lastTimestamp uint32
+	emitted       bool
+	// parameterSets prefixes the first frame with SPS and PPS the stream
+	// announced out of band, e.g. in SDP
+	parameterSets []byte
+	clock         Clock // stamps the capture time
+}
+
+func newRTPFrameAssembler(clock Clock, sps []byte, pps []byte) *rtpFrameAssembler {
+	return &rtpFrameAssembler{
+		depacketizer:  &codecs.H264Packet{IsAVC: true},
+		parameterSets: lengthPrefixed(sps, pps),
+		clock:         clock,
+	}
+}
+
+// push adds a packet, returning the frame it completes, if any. Frames that
+// lost a packet are dropped rather than passed on corrupt.
+func (a *rtpFrameAssembler) push(packet *rtp.Packet) (VideoFrame, bool) {
+	var frame VideoFrame
+	complete := false
+	if a.started && packet.Timestamp != a.timestamp {
+		if len(a.frame) > 0 {
+			// The previous frame's marker was lost
+			frame, complete = a.emit()
+		}
+		a.frame, a.corrupt = a.frame[:0], false
+	}
+	if a.started && packet.SequenceNumber != a.sequence+1 {
+		metrics.Inc("rtp.packets_lost")
+		a.corrupt = true
+		a.depacketizer = &codecs.H264Packet{IsAVC: true}
+	}
+	a.started = true
+	a.timestamp = packet.Timestamp
+	a.sequence = packet.SequenceNumber
+
+	nals, err := a.depacketizer.Unmarshal(packet.Payload)
+	if err != nil {
+		a.corrupt = true
+	} else {
+		a.frame = append(a.frame, nals...)
+	}
+
+	if packet.Marker && !complete {
+		return a.emit()
+	}
+	return frame, complete
+}
+
+// emit returns the frame assembled so far, and starts the next
+func (a *rtpFrameAssembler) emit() (VideoFrame, bool) {
+	data, corrupt := a.frame, a.corrupt
+	a.corrupt = false
+	if corrupt || len(data) == 0 {
+		a.frame = data[:0]
+		return VideoFrame{}, false
+	}
+	// The frame stays valid until the next one is emitted
+	a.frame, a.spare = a.spare[:0], data
+
+	duration := time.Second / 30
+	if a.emitted && a.timestamp != a.lastTimestamp {
+		duration = time.Duration(a.timestamp-a.lastTimestamp) * time.Second / h264ClockRate
+	}
+	a.lastTimestamp, a.emitted = a.timestamp, true
+	if a.parameterSets != nil {
+		data = append(a.parameterSets, data...)
+		a.parameterSets = nil
+	}
+	return VideoFrame{Data: data, Duration: duration, Captured: a.clock.Now()}, true
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"sync"
+	"time"
+
+	"github.com/pion/rtp"
+	"github.com/pion/rtp/codecs"
+	"github.com/pion/webrtc/v4"
+	"github.com/pion/webrtc/v4/pkg/media"
+)
+
+// RTP forwarding: with rtpForwarding each H.264 track packetizes a frame
+// once, into packets of at most rtpMTU bytes, and forwards those packets to
+// every peer bound to it, SFU-style, rewriting only the SSRC and payload
+// type. pion's shared sample track also packetizes once per frame, so this
+// does not by itself cut CPU per viewer; it makes the packetization explicit
+// (pipeline.packetize, pipeline.rtp_packets) and lets the MTU be lowered for
+// links such as VPNs and TURN over TCP. The per-peer cost left is SRTP and
+// the socket write.
+
+// sampleTrack is a video track frames are written to as samples
+type sampleTrack interface {
+	webrtc.TrackLocal
+	WriteSample(sample media.Sample) error
+}
+
+// newVideoTrack returns an H.264 track, forwarding RTP with rtpForwarding
+func newVideoTrack(codec webrtc.RTPCodecCapability, trackID string, streamID string) (sampleTrack, error) {
+	if rtpForwarding {
+		return newForwardingTrack(codec, trackID, streamID)
+	}
+	return webrtc.NewTrackLocalStaticSample(codec, trackID, streamID)
+}
+
+// forwardingTrack packetizes samples itself and forwards the packets to
+// every binding of its RTP track
+type forwardingTrack struct {
+	*webrtc.TrackLocalStaticRTP
+	packetizer rtp.Packetizer
+	clockRate  float64
+	mu         sync.Mutex
+}
+
+func newForwardingTrack(codec webrtc.RTPCodecCapability, trackID string, streamID string) (*forwardingTrack, error) {
+	track, err := webrtc.NewTrackLocalStaticRTP(codec, trackID, streamID)
+	if err != nil {
+		return nil, err
+	}
+	// Every binding gets its own SSRC and payload type, written over these
+	return &forwardingTrack{
+		TrackLocalStaticRTP: track,
+		packetizer:          rtp.NewPacketizer(rtpMTU, 0, 0, &codecs.H264Payloader{}, rtp.NewRandomSequencer(), codec.ClockRate),
+		clockRate:           float64(codec.ClockRate),
+	}, nil
+}
+
+// WriteSample packetizes sample once and forwards its packets to every peer
+func (t *forwardingTrack) WriteSample(sample media.Sample) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	start := time.Now()
+	packets := t.packetizer.Packetize(sample.Data, uint32(sample.Duration.Seconds()*t.clockRate))
+	metrics.Observe("pipeline.packetize", time.Since(start))
+	metrics.Add("pipeline.rtp_packets", uint64(len(packets)))
+
+	// Like the sample track, a failing peer does not stop the others
+	var firstErr error
+	for _, packet := range packets {
+		if err := t.WriteRTP(packet); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return firstErr
+}
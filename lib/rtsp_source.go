@@ -0,0 +1,557 @@
+package main
+
+import (
+	"bufio"
+	"crypto/md5"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/textproto"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pion/rtp"
+	"github.com/pion/sdp/v3"
+)
+
+// RTSP sources: a camera whose entry in cameraDirectories is an rtsp://
+// URL, credentials included if it needs them, is pulled from the IP camera
+// instead of read from files. The H.264 RTP the camera sends is
+// interleaved on the RTSP connection, which gets through NAT and firewalls
+// like any TCP connection, and depacketized as it is, without re-encoding.
+// A lost connection or a camera silent for rtspTimeout is retried every
+// rtspReconnectDelay.
+//
+// The camera's GOP decides when keyframes come: RTSP has no way to ask for
+// one, so ForceKeyframe does nothing and a peer that lost packets recovers
+// at the camera's next IDR.
+
+var (
+	rtspInterleavedPattern = regexp.MustCompile(`interleaved=(\d+)`)
+	rtspDigestParamPattern = regexp.MustCompile(`(\w+)="([^"]*)"`)
+)
+
+// errSinkStopped ends an RTSP session when the sink takes no more frames
+var errSinkStopped = errors.New("sink stopped")
+
+// isRTSPURL reports whether a cameraDirectories entry is an RTSP camera
+func isRTSPURL(address string) bool {
+	return strings.HasPrefix(strings.ToLower(address), "rtsp://")
+}
+
+// rtspSource streams a camera's frames from an RTSP server
+type rtspSource struct {
+	url   *url.URL
+	stats VideoSourceStats
+	stop  chan struct{}
+	done  chan struct{}
+	conn  net.Conn // of the current session, closed by Stop to end it
+	mu    sync.Mutex
+}
+
+func newRTSPSource(address string) (*rtspSource, error) {
+	u, err := url.Parse(address)
+	if err != nil {
+		return nil, fmt.Errorf("invalid RTSP URL: %v", err)
+	}
+	if !strings.EqualFold(u.Scheme, "rtsp") || u.Host == "" {
+		return nil, fmt.Errorf("invalid RTSP URL: %s", u.Redacted())
+	}
+	return &rtspSource{url: u}, nil
+}
+
+// Start implements VideoSource
+func (s *rtspSource) Start(sink SampleSink) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.stop != nil {
+		return errors.New("RTSP source already started")
+	}
+	s.stop = make(chan struct{})
+	s.done = make(chan struct{})
+	go s.run(sink, s.stop, s.done)
+	return nil
+}
+
+// Stop implements VideoSource
+func (s *rtspSource) Stop() {
+	s.mu.Lock()
+	stop, done, conn := s.stop, s.done, s.conn
+	s.stop, s.done = nil, nil
+	if stop != nil {
+		close(stop)
+	}
+	s.mu.Unlock()
+
+	if stop != nil {
+		// Closing the connection ends a session blocked reading it
+		if conn != nil {
+			conn.Close()
+		}
+		<-done
+	}
+}
+
+// ForceKeyframe implements VideoSource, see above
+func (s *rtspSource) ForceKeyframe() {}
+
+// cpuCost implements cpuCoster: the camera does the encoding
+func (s *rtspSource) cpuCost() float64 {
+	return rtspSourceCost
+}
+
+// Stats implements VideoSource
+func (s *rtspSource) Stats() VideoSourceStats {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.stats
+}
+
+// run streams sessions from the camera, reconnecting after each ends, until
+// stop closes or the sink stops
+func (s *rtspSource) run(sink SampleSink, stop chan struct{}, done chan struct{}) {
+	defer close(done)
+
+	failing := false // sessions are failing, already reported
+	for {
+		frames, err := s.session(sink, stop)
+		select {
+		case <-stop:
+			log.Printf("Stopped RTSP stream from %s", s.url.Redacted())
+			return
+		default:
+		}
+		if err == errSinkStopped {
+			return
+		}
+		if frames > 0 {
+			failing = false
+		}
+
+		s.mu.Lock()
+		s.stats.Errors++
+		s.stats.Restarts++
+		s.mu.Unlock()
+		metrics.Inc("rtsp.reconnects")
+		log.Printf("RTSP stream from %s ended: %v, reconnecting in %s", s.url.Redacted(), err, rtspReconnectDelay)
+		if !failing {
+			sink.ReportError(fmt.Errorf("RTSP stream from %s: %v", s.url.Redacted(), err))
+		}
+		failing = true
+
+		select {
+		case <-stop:
+			return
+		case <-time.After(rtspReconnectDelay):
+		}
+	}
+}
+
+// session connects to the camera and streams its frames to sink until the
+// connection fails, returning how many it streamed
+func (s *rtspSource) session(sink SampleSink, stop chan struct{}) (int, error) {
+	conn, err := net.DialTimeout("tcp", rtspHost(s.url), rtspTimeout)
+	if err != nil {
+		return 0, err
+	}
+	s.mu.Lock()
+	select {
+	case <-stop:
+		s.mu.Unlock()
+		conn.Close()
+		return 0, nil
+	default:
+	}
+	s.conn = conn
+	s.mu.Unlock()
+	defer func() {
+		s.mu.Lock()
+		s.conn = nil
+		s.mu.Unlock()
+		conn.Close()
+	}()
+
+	c := &rtspConn{conn: conn, reader: bufio.NewReader(conn), url: s.url}
+	track, err := c.setup()
+	if err != nil {
+		return 0, err
+	}
+	log.Printf("Streaming RTSP %s: payload type %d, interleaved channel %d", s.url.Redacted(), track.payloadType, track.channel)
+
+	frames := 0
+	assembler := newRTPFrameAssembler(mediaClock, track.sps, track.pps)
+	lastKeepalive := time.Now()
+	for {
+		if time.Since(lastKeepalive) >= c.keepalive {
+			if err := c.send(c.keepaliveMethod, c.baseURI(), nil); err != nil {
+				return frames, err
+			}
+			lastKeepalive = time.Now()
+		}
+
+		conn.SetReadDeadline(time.Now().Add(rtspTimeout))
+		channel, payload, err := c.readInterleaved()
+		if err != nil {
+			return frames, err
+		}
+		if channel != track.channel {
+			continue // RTCP
+		}
+		var packet rtp.Packet
+		if err := packet.Unmarshal(payload); err != nil || packet.PayloadType != track.payloadType {
+			continue
+		}
+		frame, ok := assembler.push(&packet)
+		if !ok {
+			continue
+		}
+		if !sink.WriteFrame(frame) {
+			return frames, errSinkStopped
+		}
+		frames++
+		s.mu.Lock()
+		s.stats.Frames++
+		s.stats.Bytes += uint64(len(frame.Data))
+		s.mu.Unlock()
+	}
+}
+
+// rtspHost returns the address to dial for u, on port 554 by default
+func rtspHost(u *url.URL) string {
+	if u.Port() != "" {
+		return u.Host
+	}
+	return net.JoinHostPort(u.Hostname(), "554")
+}
+
+// rtspTrack is the H.264 stream of a session
+type rtspTrack struct {
+	payloadType uint8
+	channel     byte   // interleaved channel of its RTP
+	sps, pps    []byte // from sprop-parameter-sets, if the SDP has them
+}
+
+// rtspConn is one RTSP connection, with RTP interleaved on it
+type rtspConn struct {
+	conn    net.Conn
+	reader  *bufio.Reader
+	url     *url.URL
+	cseq    int
+	session string
+	// authorization returns the Authorization header of a request, once
+	// the server asked for credentials
+	authorization   func(method string, uri string) string
+	keepalive       time.Duration
+	keepaliveMethod string
+}
+
+// rtspResponse is the status, headers and body of an RTSP response
+type rtspResponse struct {
+	status int
+	header textproto.MIMEHeader
+	body   []byte
+}
+
+// setup describes the camera's stream, sets up its H.264 track interleaved
+// on the connection and plays it
+func (c *rtspConn) setup() (rtspTrack, error) {
+	c.keepalive = rtspKeepaliveInterval
+	c.keepaliveMethod = "OPTIONS"
+	options, err := c.request("OPTIONS", c.baseURI(), nil)
+	if err != nil {
+		return rtspTrack{}, err
+	}
+	if strings.Contains(options.header.Get("Public"), "GET_PARAMETER") {
+		c.keepaliveMethod = "GET_PARAMETER"
+	}
+
+	describe, err := c.request("DESCRIBE", c.baseURI(), map[string]string{"Accept": "application/sdp"})
+	if err != nil {
+		return rtspTrack{}, err
+	}
+	base := c.baseURI()
+	if contentBase := describe.header.Get("Content-Base"); contentBase != "" {
+		base = contentBase
+	}
+	track, control, err := parseRTSPDescription(describe.body)
+	if err != nil {
+		return rtspTrack{}, err
+	}
+
+	setup, err := c.request("SETUP", rtspControlURI(base, control), map[string]string{
+		"Transport": "RTP/AVP/TCP;unicast;interleaved=0-1",
+	})
+	if err != nil {
+		return rtspTrack{}, err
+	}
+	session, params, _ := strings.Cut(setup.header.Get("Session"), ";")
+	c.session = strings.TrimSpace(session)
+	if timeout, ok := strings.CutPrefix(strings.TrimSpace(params), "timeout="); ok {
+		if seconds, err := strconv.Atoi(timeout); err == nil && seconds > 1 {
+			c.keepalive = min(c.keepalive, time.Duration(seconds)*time.Second/2)
+		}
+	}
+	if match := rtspInterleavedPattern.FindStringSubmatch(setup.header.Get("Transport")); match != nil {
+		channel, _ := strconv.Atoi(match[1])
+		track.channel = byte(channel)
+	}
+
+	if _, err := c.request("PLAY", strings.TrimSuffix(base, "/"), map[string]string{"Range": "npt=0.000-"}); err != nil {
+		return rtspTrack{}, err
+	}
+	return track, nil
+}
+
+// parseRTSPDescription finds the H.264 video of an SDP description, and its
+// control attribute
+func parseRTSPDescription(body []byte) (rtspTrack, string, error) {
+	var description sdp.SessionDescription
+	if err := description.Unmarshal(body); err != nil {
+		return rtspTrack{}, "", fmt.Errorf("invalid SDP: %v", err)
+	}
+
+	for _, media := range description.MediaDescriptions {
+		if media.MediaName.Media != "video" {
+			continue
+		}
+		var track rtspTrack
+		found := false
+		for _, attribute := range media.Attributes {
+			if attribute.Key != "rtpmap" {
+				continue
+			}
+			payloadType, encoding, _ := strings.Cut(attribute.Value, " ")
+			if strings.HasPrefix(strings.ToUpper(encoding), "H264/") {
+				pt, err := strconv.Atoi(payloadType)
+				if err != nil {
+					continue
+				}
+				track.payloadType = uint8(pt)
+				found = true
+				break
+			}
+		}
+		if !found {
+			continue
+		}
+
+		control := ""
+		for _, attribute := range media.Attributes {
+			switch attribute.Key {
+			case "control":
+				control = attribute.Value
+			case "fmtp":
+				payloadType, params, _ := strings.Cut(attribute.Value, " ")
+				if payloadType == strconv.Itoa(int(track.payloadType)) {
+					track.sps, track.pps = parseSpropParameterSets(params)
+				}
+			}
+		}
+		return track, control, nil
+	}
+	return rtspTrack{}, "", errors.New("no H.264 video in the stream")
+}
+
+// parseSpropParameterSets returns the SPS and PPS of an H.264 fmtp line
+func parseSpropParameterSets(params string) (sps []byte, pps []byte) {
+	for _, param := range strings.Split(params, ";") {
+		value, ok := strings.CutPrefix(strings.TrimSpace(param), "sprop-parameter-sets=")
+		if !ok {
+			continue
+		}
+		for _, encoded := range strings.Split(value, ",") {
+			nal, err := base64.StdEncoding.DecodeString(encoded)
+			if err != nil || len(nal) == 0 {
+				continue
+			}
+			switch nal[0] & 0x1F {
+			case NAL_SPS:
+				sps = nal
+			case NAL_PPS:
+				pps = nal
+			}
+		}
+	}
+	return sps, pps
+}
+
+// rtspControlURI resolves a media's control attribute against base
+func rtspControlURI(base string, control string) string {
+	switch {
+	case control == "" || control == "*":
+		return base
+	case isRTSPURL(control):
+		return control
+	default:
+		return strings.TrimSuffix(base, "/") + "/" + strings.TrimPrefix(control, "/")
+	}
+}
+
+// baseURI returns the camera's URL without credentials
+func (c *rtspConn) baseURI() string {
+	u := *c.url
+	u.User = nil
+	return u.String()
+}
+
+// request sends a request and reads its response, answering a request for
+// credentials with those of the URL
+func (c *rtspConn) request(method string, uri string, headers map[string]string) (*rtspResponse, error) {
+	if err := c.send(method, uri, headers); err != nil {
+		return nil, err
+	}
+	c.conn.SetReadDeadline(time.Now().Add(rtspTimeout))
+	response, err := c.readResponse()
+	if err != nil {
+		return nil, err
+	}
+	if response.status == 401 && c.authorization == nil && c.url.User != nil {
+		if c.authorization, err = rtspAuthorization(c.url.User, response.header.Get("WWW-Authenticate")); err != nil {
+			return nil, err
+		}
+		return c.request(method, uri, headers)
+	}
+	if response.status != 200 {
+		return nil, fmt.Errorf("%s: RTSP status %d", method, response.status)
+	}
+	return response, nil
+}
+
+// send writes a request without waiting for its response
+func (c *rtspConn) send(method string, uri string, headers map[string]string) error {
+	c.cseq++
+	var request strings.Builder
+	fmt.Fprintf(&request, "%s %s RTSP/1.0\r\nCSeq: %d\r\nUser-Agent: rmcs\r\n", method, uri, c.cseq)
+	for key, value := range headers {
+		fmt.Fprintf(&request, "%s: %s\r\n", key, value)
+	}
+	if c.session != "" {
+		fmt.Fprintf(&request, "Session: %s\r\n", c.session)
+	}
+	if c.authorization != nil {
+		fmt.Fprintf(&request, "Authorization: %s\r\n", c.authorization(method, uri))
+	}
+	request.WriteString("\r\n")
+
+	c.conn.SetWriteDeadline(time.Now().Add(rtspTimeout))
+	_, err := io.WriteString(c.conn, request.String())
+	return err
+}
+
+// readResponse reads the next response, skipping interleaved packets
+// before it
+func (c *rtspConn) readResponse() (*rtspResponse, error) {
+	for {
+		first, err := c.reader.Peek(1)
+		if err != nil {
+			return nil, err
+		}
+		if first[0] != '$' {
+			break
+		}
+		if _, _, err := c.readPacket(); err != nil {
+			return nil, err
+		}
+	}
+
+	reader := textproto.NewReader(c.reader)
+	statusLine, err := reader.ReadLine()
+	if err != nil {
+		return nil, err
+	}
+	fields := strings.Fields(statusLine)
+	if len(fields) < 2 || !strings.HasPrefix(fields[0], "RTSP/") {
+		return nil, fmt.Errorf("invalid RTSP status line %q", statusLine)
+	}
+	status, err := strconv.Atoi(fields[1])
+	if err != nil {
+		return nil, fmt.Errorf("invalid RTSP status line %q", statusLine)
+	}
+	header, err := reader.ReadMIMEHeader()
+	if err != nil && len(header) == 0 {
+		return nil, err
+	}
+
+	response := &rtspResponse{status: status, header: header}
+	if length, _ := strconv.Atoi(header.Get("Content-Length")); length > 0 {
+		response.body = make([]byte, length)
+		if _, err := io.ReadFull(c.reader, response.body); err != nil {
+			return nil, err
+		}
+	}
+	return response, nil
+}
+
+// readInterleaved returns the next interleaved packet, skipping responses
+// to keepalives
+func (c *rtspConn) readInterleaved() (byte, []byte, error) {
+	for {
+		first, err := c.reader.Peek(1)
+		if err != nil {
+			return 0, nil, err
+		}
+		if first[0] == '$' {
+			return c.readPacket()
+		}
+		if _, err := c.readResponse(); err != nil {
+			return 0, nil, err
+		}
+	}
+}
+
+// readPacket reads an interleaved packet: '$', its channel, its 2-byte
+// length and the packet
+func (c *rtspConn) readPacket() (byte, []byte, error) {
+	var header [4]byte
+	if _, err := io.ReadFull(c.reader, header[:]); err != nil {
+		return 0, nil, err
+	}
+	payload := make([]byte, binary.BigEndian.Uint16(header[2:]))
+	if _, err := io.ReadFull(c.reader, payload); err != nil {
+		return 0, nil, err
+	}
+	return header[1], payload, nil
+}
+
+// rtspAuthorization answers a WWW-Authenticate challenge with the
+// credentials of user, Digest or Basic
+func rtspAuthorization(user *url.Userinfo, challenge string) (func(method string, uri string) string, error) {
+	username := user.Username()
+	password, _ := user.Password()
+	scheme, params, _ := strings.Cut(challenge, " ")
+
+	switch strings.ToLower(scheme) {
+	case "basic":
+		credentials := base64.StdEncoding.EncodeToString([]byte(username + ":" + password))
+		return func(string, string) string { return "Basic " + credentials }, nil
+	case "digest":
+		values := make(map[string]string)
+		for _, match := range rtspDigestParamPattern.FindAllStringSubmatch(params, -1) {
+			values[strings.ToLower(match[1])] = match[2]
+		}
+		realm, nonce := values["realm"], values["nonce"]
+		ha1 := md5Hex(username + ":" + realm + ":" + password)
+		return func(method string, uri string) string {
+			response := md5Hex(ha1 + ":" + nonce + ":" + md5Hex(method+":"+uri))
+			return fmt.Sprintf(`Digest username="%s", realm="%s", nonce="%s", uri="%s", response="%s"`,
+				username, realm, nonce, uri, response)
+		}, nil
+	default:
+		return nil, fmt.Errorf("unsupported RTSP authentication %q", scheme)
+	}
+}
+
+func md5Hex(s string) string {
+	sum := md5.Sum([]byte(s))
+	return hex.EncodeToString(sum[:])
+}
@@ -0,0 +1,115 @@
+//go:build linux
+
+package main
+
+import (
+	"fmt"
+	"log"
+	"math"
+	"os"
+	"os/exec"
+	"os/user"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"syscall"
+)
+
+// Encoder sandbox: the processes the backend runs, ffmpeg and GStreamer
+// pipelines of process sources (see process_source.go), the transcoder and
+// snapshots, are killed as soon as the backend dies, however it ends, so
+// none outlives a crashed host. With encoderUser they run as that user,
+// without the backend's privileges, and with encoderCgroup in that cgroup,
+// which the backend limits to encoderMemoryMax bytes and encoderCPUMax
+// cores, so a runaway encoder cannot starve the rest of the robot.
+// Processes the sandbox cannot be set up for are not started.
+
+// cgroupCPUPeriod is the period of cpu.max, in microseconds
+const cgroupCPUPeriod = 100000
+
+var encoderSandbox struct {
+	credential *syscall.Credential // of encoderUser, nil without
+	cgroup     *os.File            // encoderCgroup, nil without
+	err        error
+	once       sync.Once
+}
+
+// sandboxCommand has cmd run in the encoder sandbox, before it starts
+func sandboxCommand(cmd *exec.Cmd) error {
+	encoderSandbox.once.Do(setupSandbox)
+	if encoderSandbox.err != nil {
+		return encoderSandbox.err
+	}
+	if cmd.SysProcAttr == nil {
+		cmd.SysProcAttr = &syscall.SysProcAttr{}
+	}
+	cmd.SysProcAttr.Pdeathsig = syscall.SIGKILL
+	cmd.SysProcAttr.Credential = encoderSandbox.credential
+	if encoderSandbox.cgroup != nil {
+		cmd.SysProcAttr.UseCgroupFD = true
+		cmd.SysProcAttr.CgroupFD = int(encoderSandbox.cgroup.Fd())
+	}
+	return nil
+}
+
+// setupSandbox looks up encoderUser and limits encoderCgroup, once
+func setupSandbox() {
+	if encoderUser != "" {
+		credential, err := lookupCredential(encoderUser)
+		if err != nil {
+			encoderSandbox.err = fmt.Errorf("encoder sandbox: %v", err)
+			return
+		}
+		encoderSandbox.credential = credential
+	}
+	if encoderCgroup == "" {
+		return
+	}
+	if encoderMemoryMax > 0 {
+		if err := writeCgroup("memory.max", strconv.Itoa(encoderMemoryMax)); err != nil {
+			encoderSandbox.err = err
+			return
+		}
+	}
+	if encoderCPUMax > 0 {
+		quota := int(math.Round(encoderCPUMax * cgroupCPUPeriod))
+		if err := writeCgroup("cpu.max", fmt.Sprintf("%d %d", quota, cgroupCPUPeriod)); err != nil {
+			encoderSandbox.err = err
+			return
+		}
+	}
+	cgroup, err := os.Open(encoderCgroup)
+	if err != nil {
+		encoderSandbox.err = fmt.Errorf("encoder sandbox: %v", err)
+		return
+	}
+	encoderSandbox.cgroup = cgroup
+	log.Printf("Encoders run in cgroup %s, memory.max %d, %g cores", encoderCgroup, encoderMemoryMax, encoderCPUMax)
+}
+
+// lookupCredential returns the credential of name, a user name or ID
+func lookupCredential(name string) (*syscall.Credential, error) {
+	u, err := user.Lookup(name)
+	if err != nil {
+		if u, err = user.LookupId(name); err != nil {
+			return nil, fmt.Errorf("unknown user %s", name)
+		}
+	}
+	uid, err := strconv.ParseUint(u.Uid, 10, 32)
+	if err != nil {
+		return nil, fmt.Errorf("user %s: invalid uid %s", name, u.Uid)
+	}
+	gid, err := strconv.ParseUint(u.Gid, 10, 32)
+	if err != nil {
+		return nil, fmt.Errorf("user %s: invalid gid %s", name, u.Gid)
+	}
+	return &syscall.Credential{Uid: uint32(uid), Gid: uint32(gid)}, nil
+}
+
+// writeCgroup sets one of encoderCgroup's controls
+func writeCgroup(control string, value string) error {
+	if err := os.WriteFile(filepath.Join(encoderCgroup, control), []byte(value), 0); err != nil {
+		return fmt.Errorf("encoder sandbox: failed to set %s: %v", control, err)
+	}
+	return nil
+}
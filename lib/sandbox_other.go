@@ -0,0 +1,18 @@
+//go:build !linux
+
+package main
+
+import (
+	"errors"
+	"os/exec"
+)
+
+// sandboxCommand runs cmd as it is: the encoder sandbox (see
+// sandbox_linux.go) relies on Linux, so processes are not started at all
+// if it is asked for
+func sandboxCommand(cmd *exec.Cmd) error {
+	if encoderUser != "" || encoderCgroup != "" {
+		return errors.New("encoder sandbox: only supported on Linux")
+	}
+	return nil
+}
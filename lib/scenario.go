@@ -0,0 +1,240 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Scenario step actions
+const (
+	ScenarioSwitchCamera = "camera"
+	ScenarioOverlay      = "overlay"
+	ScenarioClearOverlay = "overlay-clear"
+	ScenarioStartRecord  = "record-start"
+	ScenarioStopRecord   = "record-stop"
+)
+
+const (
+	scenarioStopCommand   = "stop"
+	scenarioOverlayTopic  = "overlay"
+	scenarioDefaultRecord = "scenario-recording.jsonl"
+	// scenarioRecordDir holds the recordings scenarios start: a step's file
+	// is a bare name within it, as scenarios come from the broker
+	scenarioRecordDir = "recordings"
+)
+
+// ScenarioStep is one timed action, e.g.
+// {"at": "20s", "action": "camera", "camera": 3}
+type ScenarioStep struct {
+	At     string `json:"at"` // offset from scenario start, time.ParseDuration format
+	Action string `json:"action"`
+	Camera int    `json:"camera,omitempty"`
+	Text   string `json:"text,omitempty"` // overlay text
+	File   string `json:"file,omitempty"` // recording file name for record-start, in scenarioRecordDir
+
+	offset time.Duration
+}
+
+type Scenario struct {
+	Name  string         `json:"name"`
+	Loop  bool           `json:"loop"`
+	Steps []ScenarioStep `json:"steps"`
+}
+
+// ParseScenario decodes and validates a scenario script, sorting its steps
+func ParseScenario(data []byte) (*Scenario, error) {
+	var scenario Scenario
+	if err := json.Unmarshal(data, &scenario); err != nil {
+		return nil, fmt.Errorf("invalid scenario: %v", err)
+	}
+	if len(scenario.Steps) == 0 {
+		return nil, fmt.Errorf("scenario %q has no steps", scenario.Name)
+	}
+
+	for i := range scenario.Steps {
+		step := &scenario.Steps[i]
+		offset, err := time.ParseDuration(step.At)
+		if err != nil {
+			return nil, fmt.Errorf("step %d: invalid time %q: %v", i, step.At, err)
+		}
+		step.offset = offset
+
+		switch step.Action {
+		case ScenarioSwitchCamera, ScenarioOverlay, ScenarioClearOverlay, ScenarioStopRecord:
+		case ScenarioStartRecord:
+			if !validRecordName(step.File) {
+				return nil, fmt.Errorf("step %d: invalid recording file %q, a bare file name is needed", i, step.File)
+			}
+		default:
+			return nil, fmt.Errorf("step %d: unknown action %q", i, step.Action)
+		}
+	}
+
+	sort.SliceStable(scenario.Steps, func(i, j int) bool {
+		return scenario.Steps[i].offset < scenario.Steps[j].offset
+	})
+	// A loop whose steps all run at once would never wait
+	if scenario.Loop && scenario.Steps[len(scenario.Steps)-1].offset <= 0 {
+		return nil, fmt.Errorf("scenario %q loops without a delay", scenario.Name)
+	}
+	return &scenario, nil
+}
+
+// validRecordName reports whether name is empty, for the default, or a bare
+// file name, with no directory to climb out of scenarioRecordDir
+func validRecordName(name string) bool {
+	if name == "" {
+		return true
+	}
+	return name != "." && name != ".." && !strings.ContainsAny(name, `/\`) && filepath.Base(name) == name
+}
+
+func LoadScenario(path string) (*Scenario, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read scenario %s: %v", path, err)
+	}
+	return ParseScenario(data)
+}
+
+// ScenarioRunner plays one scenario at a time; starting another one
+// cancels the current run
+type ScenarioRunner struct {
+	client   *MQTTClient
+	stopChan chan struct{}
+	mu       sync.Mutex
+}
+
+func NewScenarioRunner(client *MQTTClient) *ScenarioRunner {
+	return &ScenarioRunner{client: client}
+}
+
+func (r *ScenarioRunner) Start(scenario *Scenario) {
+	r.Stop()
+
+	r.mu.Lock()
+	stopChan := make(chan struct{})
+	r.stopChan = stopChan
+	r.mu.Unlock()
+
+	go r.run(scenario, stopChan)
+}
+
+func (r *ScenarioRunner) Stop() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.stopChan != nil {
+		close(r.stopChan)
+		r.stopChan = nil
+	}
+}
+
+func (r *ScenarioRunner) run(scenario *Scenario, stopChan chan struct{}) {
+	log.Printf("Starting scenario %q (%d steps, loop: %v)", scenario.Name, len(scenario.Steps), scenario.Loop)
+	// A recording started by the scenario ends with it
+	var recorder *Recorder
+	defer func() { r.stopRecording(recorder) }()
+
+	for {
+		start := time.Now()
+		for _, step := range scenario.Steps {
+			timer := time.NewTimer(time.Until(start.Add(step.offset)))
+			select {
+			case <-stopChan:
+				timer.Stop()
+				log.Printf("Scenario %q stopped", scenario.Name)
+				return
+			case <-timer.C:
+			}
+			recorder = r.execute(step, recorder)
+		}
+
+		if !scenario.Loop {
+			break
+		}
+	}
+
+	log.Printf("Scenario %q finished", scenario.Name)
+	r.mu.Lock()
+	if r.stopChan == stopChan {
+		r.stopChan = nil
+	}
+	r.mu.Unlock()
+}
+
+// execute runs one step and returns the scenario's active recorder
+func (r *ScenarioRunner) execute(step ScenarioStep, recorder *Recorder) *Recorder {
+	log.Printf("Scenario step at %s: %s", step.At, step.Action)
+
+	switch step.Action {
+	case ScenarioSwitchCamera:
+		if err := r.client.webrtcManager.SwitchCamera(step.Camera); err != nil {
+			log.Printf("Failed to switch camera: %v", err)
+		}
+	case ScenarioOverlay, ScenarioClearOverlay:
+		// Frames are pre-encoded, so overlays are drawn by the frontend
+		payload, err := json.Marshal(map[string]string{"text": step.Text})
+		if err != nil {
+			log.Printf("Failed to marshal overlay: %v", err)
+			break
+		}
+		topic := broadcastTopic(scenarioOverlayTopic)
+		if err := r.client.publish(topic, payload); err != nil {
+			log.Printf("Failed to publish overlay: %v", err)
+		}
+	case ScenarioStartRecord:
+		file := step.File
+		if file == "" {
+			file = scenarioDefaultRecord
+		}
+		if err := os.MkdirAll(scenarioRecordDir, 0755); err != nil {
+			log.Printf("Failed to start scenario recording: %v", err)
+			break
+		}
+		// file was checked to be a bare name as the scenario was parsed
+		next, err := NewRecorder(filepath.Join(scenarioRecordDir, file))
+		if err != nil {
+			log.Printf("Failed to start scenario recording: %v", err)
+			break
+		}
+		r.stopRecording(recorder)
+		r.client.SetRecorder(next)
+		return next
+	case ScenarioStopRecord:
+		r.stopRecording(recorder)
+		return nil
+	}
+	return recorder
+}
+
+// stopRecording ends a recording started by the scenario, if any
+func (r *ScenarioRunner) stopRecording(recorder *Recorder) {
+	if recorder != nil {
+		r.client.SetRecorder(nil)
+		recorder.Close()
+	}
+}
+
+// handleScenario starts the scenario in the payload, or stops the running
+// one when the payload is "stop"
+func (m *MQTTClient) handleScenario(topic string, payload []byte) {
+	if strings.TrimSpace(string(payload)) == scenarioStopCommand {
+		m.scenarios.Stop()
+		return
+	}
+
+	scenario, err := ParseScenario(payload)
+	if err != nil {
+		log.Printf("Failed to load scenario from %s: %v", topic, err)
+		return
+	}
+	m.scenarios.Start(scenario)
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"embed"
+	"encoding/json"
+	"io/fs"
+	"net/http"
+	"path"
+	"strings"
+)
+
+// The JSON Schemas in schema/ define every stats and event message the
+// backend publishes. schema_types.go is generated from them; edit the schema
+// and run go generate, never the types. Each message carries its schema's
+// $id in a "schema" field; adding an optional field keeps the version,
+// anything else bumps it.
+//
+//go:generate go run ./cmd/schemagen -in schema -out schema_types.go
+
+//go:embed schema/*.schema.json
+var schemaFiles embed.FS
+
+// SchemaIndexEntry lists one schema at /schema
+type SchemaIndexEntry struct {
+	ID  string `json:"id"`
+	URL string `json:"url"`
+}
+
+// schemaIndex maps each schema's $id to the path it is served under
+func schemaIndex() ([]SchemaIndexEntry, error) {
+	names, err := fs.Glob(schemaFiles, "schema/*.schema.json")
+	if err != nil {
+		return nil, err
+	}
+
+	index := make([]SchemaIndexEntry, 0, len(names))
+	for _, name := range names {
+		data, err := schemaFiles.ReadFile(name)
+		if err != nil {
+			return nil, err
+		}
+		var schema struct {
+			ID string `json:"$id"`
+		}
+		if err := json.Unmarshal(data, &schema); err != nil {
+			return nil, err
+		}
+		index = append(index, SchemaIndexEntry{
+			ID:  schema.ID,
+			URL: "/schema/" + strings.TrimSuffix(path.Base(name), ".schema.json"),
+		})
+	}
+	return index, nil
+}
+
+// handleSchema serves the schema index at /schema and each schema at
+// /schema/<name>, e.g. /schema/metrics
+func handleSchema(w http.ResponseWriter, r *http.Request) {
+	name := strings.Trim(strings.TrimPrefix(r.URL.Path, "/schema"), "/")
+	if name == "" {
+		index, err := schemaIndex()
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(index)
+		return
+	}
+
+	data, err := schemaFiles.ReadFile("schema/" + path.Base(name) + ".schema.json")
+	if err != nil {
+		http.NotFound(w, r)
+		return
+	}
+	w.Header().Set("Content-Type", "application/schema+json")
+	w.Write(data)
+}
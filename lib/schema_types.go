@@ -0,0 +1,564 @@
+// Code generated by schemagen from schema/*.schema.json; DO NOT EDIT.
+
+package main
+
+import "time"
+
+// ActiveCameraSchema is the $id of active-camera.schema.json, and the value of its "schema" field
+const ActiveCameraSchema = "rmcs/active-camera/1"
+
+// ActiveCamera is the camera a video track streams, published retained on <thingName>/camera/active/<trackId> whenever it switches
+type ActiveCamera struct {
+	Schema  string `json:"schema"`
+	TrackID string `json:"trackId"`
+	Camera  int    `json:"camera"`
+	// The camera group switched to, if the switch was a group's
+	Group string    `json:"group,omitempty"`
+	Time  time.Time `json:"time"`
+}
+
+// AdminAckSchema is the $id of admin-ack.schema.json, and the value of its "schema" field
+const AdminAckSchema = "rmcs/admin-ack/1"
+
+// AdminAck is the result of an admin command, published on <thingName>/admin/ack
+type AdminAck struct {
+	Schema  string `json:"schema"`
+	ID      string `json:"id,omitempty"`
+	Command string `json:"command"`
+	OK      bool   `json:"ok"`
+	Error   string `json:"error,omitempty"`
+	// How many peers disconnect-all-peers closed, or list-peers listed
+	Peers int `json:"peers,omitempty"`
+}
+
+// CameraInfoSchema is the $id of camera-info.schema.json, and the value of its "schema" field
+const CameraInfoSchema = "rmcs/camera-info/1"
+
+// CameraInfo is a ROS camera's calibration from its sensor_msgs/CameraInfo topic, sent on the telemetry data channel and published (retained) on <thingName>/camera-info/<camera> whenever it changes; it is for the topic's images, width by height, not the video they are scaled to
+type CameraInfo struct {
+	Schema string `json:"schema"`
+	Camera int    `json:"camera"`
+	// The camera_info topic
+	Topic string `json:"topic"`
+	// The camera's optical frame
+	Frame  string `json:"frame,omitempty"`
+	Width  int    `json:"width"`
+	Height int    `json:"height"`
+	// e.g. plumb_bob or equidistant
+	DistortionModel string `json:"distortionModel"`
+	// Distortion coefficients, as many as the model has
+	D []float64 `json:"d"`
+	// Intrinsics, the 3x3 camera matrix, row-major
+	K []float64 `json:"k"`
+	// Rectification, a 3x3 rotation, row-major
+	R []float64 `json:"r"`
+	// Projection, the 3x4 matrix of the rectified image, row-major
+	P []float64 `json:"p"`
+	// Absent unless the camera bins pixels
+	BinningX int               `json:"binningX,omitempty"`
+	BinningY int               `json:"binningY,omitempty"`
+	ROI      *RegionOfInterest `json:"roi,omitempty"`
+	Time     time.Time         `json:"time"`
+}
+
+// RegionOfInterest is the part of the full image the camera sends, absent for all of it
+type RegionOfInterest struct {
+	X      int `json:"x"`
+	Y      int `json:"y"`
+	Width  int `json:"width"`
+	Height int `json:"height"`
+	// Whether the region is to be rectified
+	Rectify bool `json:"rectify"`
+}
+
+// CameraListSchema is the $id of cameras.schema.json, and the value of its "schema" field
+const CameraListSchema = "rmcs/cameras/1"
+
+// CameraList is the availability list of every camera, published retained on <thingName>/cameras
+type CameraList struct {
+	Schema  string         `json:"schema"`
+	Cameras []CameraStatus `json:"cameras"`
+}
+
+// CameraStatus is the health of one camera
+type CameraStatus struct {
+	Camera int `json:"camera"`
+	// "unknown" until the camera has streamed, then "ok" or "degraded"
+	Status string `json:"status"`
+	// Why a degraded camera is degraded
+	Reason string `json:"reason,omitempty"`
+	// When the camera entered its status
+	Since time.Time `json:"since,omitempty"`
+}
+
+// ConfigAuditSchema is the $id of config-audit.schema.json, and the value of its "schema" field
+const ConfigAuditSchema = "rmcs/config-audit/1"
+
+// ConfigAudit is a configuration change, published on <thingName>/audit/config
+type ConfigAudit struct {
+	Schema string `json:"schema"`
+	Thing  string `json:"thing"`
+	// What applied the change: startup (new build or identity since the last run), admin or api
+	Trigger string `json:"trigger"`
+	// Who applied it, e.g. the admin command ID or the C API function
+	Source  string         `json:"source,omitempty"`
+	Changes []ConfigChange `json:"changes"`
+	Time    time.Time      `json:"time"`
+}
+
+// ConfigChange is one changed setting; secrets read "[redacted]"
+type ConfigChange struct {
+	Key string `json:"key"`
+	// Previous value, absent for new settings
+	Old string `json:"old,omitempty"`
+	// Current value, absent for removed settings
+	New string `json:"new,omitempty"`
+}
+
+// E2EEKeySchema is the $id of e2ee-key.schema.json, and the value of its "schema" field
+const E2EEKeySchema = "rmcs/e2ee-key/1"
+
+// E2EEKey is the key video frames are end-to-end encrypted with, sent to each authorized peer after its answer: on the "keys" data channel to MQTT peers, as an "e2ee-key" message over WebSocket
+type E2EEKey struct {
+	Schema string `json:"schema"`
+	// The SFrame key ID (KID) of frames encrypted with the key
+	KeyID uint64 `json:"keyId"`
+	// The SFrame base key, base64
+	Key string `json:"key"`
+	// The SFrame cipher suite, AES_128_GCM_SHA256_128
+	CipherSuite string    `json:"cipherSuite"`
+	Time        time.Time `json:"time"`
+}
+
+// EStopAckSchema is the $id of estop-ack.schema.json, and the value of its "schema" field
+const EStopAckSchema = "rmcs/estop-ack/1"
+
+// EStopAck is the result of an e-stop command, the control channel reply's result, or published on <thingName>/estop/ack
+type EStopAck struct {
+	Schema string `json:"schema"`
+	// The command's, if it had one
+	ID string `json:"id,omitempty"`
+	// Whether the command engaged the e-stop, or released it
+	Engaged bool `json:"engaged"`
+	// Whether the robot was sent all of it
+	OK    bool   `json:"ok"`
+	Error string `json:"error,omitempty"`
+	// The robot's clock as it was sent
+	Time time.Time `json:"time"`
+}
+
+// GovernorStateSchema is the $id of governor.schema.json, and the value of its "schema" field
+const GovernorStateSchema = "rmcs/governor/1"
+
+// GovernorState is the CPU governor's step, published (retained) on <thingName>/governor whenever it changes
+type GovernorState struct {
+	Schema string `json:"schema"`
+	// How many steps the encoding is lowered, 0 for none
+	Level int `json:"level"`
+	// The deepest step in force: each lowers the preset, frame rate or resolution on top of those before it
+	Step string `json:"step"`
+	// The host's CPU usage that led to the step
+	CPUPercent float64 `json:"cpuPercent"`
+	// The cameras re-encoded with the step
+	Cameras []int     `json:"cameras,omitempty"`
+	Time    time.Time `json:"time"`
+}
+
+// GPSPositionSchema is the $id of gps.schema.json, and the value of its "schema" field
+const GPSPositionSchema = "rmcs/gps/1"
+
+// GPSPosition is the robot's position from sensor_msgs/NavSatFix, published (retained) on <thingName>/gps with each new fix, at most every telemetryInterval
+type GPSPosition struct {
+	Schema string `json:"schema"`
+	// In degrees, north positive
+	Latitude float64 `json:"latitude"`
+	// In degrees, east positive
+	Longitude float64 `json:"longitude"`
+	// In m above the WGS 84 ellipsoid
+	Altitude float64 `json:"altitude"`
+	// Horizontal standard deviation in m, absent if the receiver does not tell
+	Accuracy float64 `json:"accuracy,omitempty"`
+	// Whether the fix is augmented, by satellites or from the ground
+	Fix  string    `json:"fix"`
+	Time time.Time `json:"time"`
+}
+
+// LogLineSchema is the $id of log-line.schema.json, and the value of its "schema" field
+const LogLineSchema = "rmcs/log-line/1"
+
+// LogLine is a backend log line streamed to <thingName>/logs
+type LogLine struct {
+	Schema  string    `json:"schema"`
+	Time    time.Time `json:"time"`
+	Level   string    `json:"level"`
+	Message string    `json:"message"`
+}
+
+// MetricsSnapshotSchema is the $id of metrics.schema.json, and the value of its "schema" field
+const MetricsSnapshotSchema = "rmcs/metrics/1"
+
+// MetricsSnapshot is a point-in-time copy of every metric, served at /metrics and by RMCSGetMetrics
+type MetricsSnapshot struct {
+	Schema     string                       `json:"schema"`
+	Counters   map[string]uint64            `json:"counters"`
+	Gauges     map[string]int64             `json:"gauges"`
+	Histograms map[string]HistogramSnapshot `json:"histograms"`
+}
+
+// HistogramSnapshot is a latency distribution, durations in milliseconds
+type HistogramSnapshot struct {
+	Count  uint64  `json:"count"`
+	MeanMs float64 `json:"meanMs"`
+	MaxMs  float64 `json:"maxMs"`
+	// Counts keyed by bucket upper bound, "+Inf" for the rest
+	Buckets map[string]uint64 `json:"buckets"`
+}
+
+// OfferErrorSchema is the $id of offer-error.schema.json, and the value of its "schema" field
+const OfferErrorSchema = "rmcs/offer-error/1"
+
+// OfferError is why an offer got no answer, sent instead of it: on <baseTopic>/<peerId>/error over MQTT, as an "error" message over WebSocket
+type OfferError struct {
+	Schema string `json:"schema"`
+	PeerID string `json:"peerId"`
+	// peer_limit: maxPeers peers are already connected; maintenance: the backend takes no offers for now
+	Code    string `json:"code"`
+	Message string `json:"message"`
+	// The peer limit, for peer_limit errors
+	MaxPeers int `json:"maxPeers,omitempty"`
+}
+
+// PeerQualitySchema is the $id of peer-quality.schema.json, and the value of its "schema" field
+const PeerQualitySchema = "rmcs/peer-quality/1"
+
+// PeerQuality is the connection quality of one peer, published every peerStatsInterval on <baseTopic>/<peerId>/quality
+type PeerQuality struct {
+	Schema string `json:"schema"`
+	PeerID string `json:"peerId"`
+	// Connection quality from 0 (unusable) to 100, from round trip time, loss and estimated bandwidth
+	Score int64 `json:"score"`
+	// The score as 0 to 4 signal bars
+	Bars                int64     `json:"bars"`
+	RoundTripTimeMs     float64   `json:"roundTripTimeMs,omitempty"`
+	FractionLost        float64   `json:"fractionLost,omitempty"`
+	EstimatedBitrateBps int64     `json:"estimatedBitrateBps,omitempty"`
+	Time                time.Time `json:"time"`
+}
+
+// PeerStatsSchema is the $id of peer-stats.schema.json, and the value of its "schema" field
+const PeerStatsSchema = "rmcs/peer-stats/1"
+
+// PeerStats is the outbound media statistics of one peer, published every peerStatsInterval on <baseTopic>/<peerId>/stats
+type PeerStats struct {
+	Schema string `json:"schema"`
+	PeerID string `json:"peerId"`
+	// How the peer's media travels, e.g. "udp" or "turn-tcp"
+	MediaTransport string `json:"mediaTransport,omitempty"`
+	// RTP payload and header bytes sent on every track
+	BytesSent   uint64 `json:"bytesSent"`
+	PacketsSent uint64 `json:"packetsSent"`
+	// Packets the peer reported lost, from its receiver reports
+	PacketsLost int64 `json:"packetsLost"`
+	// Highest fraction of packets lost in the last receiver report of any track, 0 to 1
+	FractionLost float64 `json:"fractionLost,omitempty"`
+	// Highest round trip time of any track, from receiver reports
+	RoundTripTimeMs float64 `json:"roundTripTimeMs,omitempty"`
+	// Bits sent per second since the previous sample
+	BitrateBps int64 `json:"bitrateBps"`
+	// Bits per second the peer's link is estimated to carry, from TWCC feedback or REMB
+	EstimatedBitrateBps int64        `json:"estimatedBitrateBps,omitempty"`
+	Tracks              []TrackStats `json:"tracks,omitempty"`
+	Time                time.Time    `json:"time"`
+}
+
+// TrackStats is the outbound statistics of one video track
+type TrackStats struct {
+	TrackID         string  `json:"trackId"`
+	SSRC            uint64  `json:"ssrc"`
+	BytesSent       uint64  `json:"bytesSent"`
+	PacketsSent     uint64  `json:"packetsSent"`
+	PacketsLost     int64   `json:"packetsLost"`
+	RoundTripTimeMs float64 `json:"roundTripTimeMs,omitempty"`
+	NACKCount       uint64  `json:"nackCount,omitempty"`
+	PLICount        uint64  `json:"pliCount,omitempty"`
+	// Frames the track's stream dropped since it started because the track fell behind, per frameQueueOverflowPolicy; shared by every peer of the track
+	FramesDropped uint64 `json:"framesDropped,omitempty"`
+}
+
+// PeerTracksSchema is the $id of peer-tracks.schema.json, and the value of its "schema" field
+const PeerTracksSchema = "rmcs/peer-tracks/1"
+
+// PeerTracks is which camera each video track of a peer's answer carries, sent after the answer to peers that requested cameras: on <baseTopic>/<peerId>/tracks over MQTT, as a "tracks" message over WebSocket
+type PeerTracks struct {
+	Schema string `json:"schema"`
+	PeerID string `json:"peerId"`
+	// In the order the cameras were requested, main view first
+	Tracks []TrackLabel `json:"tracks"`
+}
+
+// TrackLabel is one video track of the answer
+type TrackLabel struct {
+	// The media ID of the track's section of the SDP
+	Mid string `json:"mid"`
+	// The track ID in the section's msid, camera-<camera>
+	TrackID string `json:"trackId"`
+	Camera  int    `json:"camera"`
+}
+
+// PeerListSchema is the $id of peers.schema.json, and the value of its "schema" field
+const PeerListSchema = "rmcs/peers/1"
+
+// PeerList is the peers the backend holds a connection for, published retained on <thingName>/peers whenever one connects or disconnects
+type PeerList struct {
+	Schema string `json:"schema"`
+	// Ordered by peer ID
+	Peers []PeerInfo `json:"peers"`
+	Time  time.Time  `json:"time"`
+}
+
+// PeerInfo is one peer's connection
+type PeerInfo struct {
+	PeerID string `json:"peerId"`
+	// The role the offer was answered with, "operator" or "viewer"
+	Role string `json:"role"`
+	// pion's connection state, e.g. "connected"
+	State string `json:"state"`
+	// How the peer's media travels, e.g. "udp" or "turn-tcp", once connected
+	MediaTransport string       `json:"mediaTransport,omitempty"`
+	Metadata       PeerMetadata `json:"metadata"`
+	// The bits per second the peer is capped at, by its role, capabilities or offer; absent if uncapped
+	MaxBitrate int `json:"maxBitrate,omitempty"`
+}
+
+// PeerMetadata is what a frontend tells about itself in its offer, so operators can tell which device each peer ID belongs to
+type PeerMetadata struct {
+	// The device's name, e.g. "Control tablet 3"
+	Name       string `json:"name,omitempty"`
+	AppVersion string `json:"appVersion,omitempty"`
+	// e.g. "android", "ios" or "web"
+	Platform string `json:"platform,omitempty"`
+}
+
+// PipelineStatsSchema is the $id of pipeline-stats.schema.json, and the value of its "schema" field
+const PipelineStatsSchema = "rmcs/pipeline-stats/1"
+
+// PipelineStats is what the source of every streaming track and simulcast layer, and every running transcoder, put through, published every pipelineStatsInterval on <thingName>/pipeline-stats
+type PipelineStats struct {
+	Schema      string            `json:"schema"`
+	Sources     []SourceStats     `json:"sources"`
+	Transcoders []TranscoderStats `json:"transcoders,omitempty"`
+	Time        time.Time         `json:"time"`
+}
+
+// SourceStats is the source of one track or simulcast layer, since it started; tracks sharing a camera's source report the same counters
+type SourceStats struct {
+	TrackID string `json:"trackId"`
+	// The simulcast layer's rung, absent for the track itself
+	Layer  string `json:"layer,omitempty"`
+	Camera int    `json:"camera"`
+	// What the frames come from
+	Kind string `json:"kind"`
+	// Frames into the source's encoder; the frames out for sources that do not encode
+	InputFrames uint64 `json:"inputFrames"`
+	// Frames the source produced
+	EncodedFrames uint64 `json:"encodedFrames"`
+	// Frames the encoder dropped, and those the track's stream dropped falling behind
+	DroppedFrames uint64 `json:"droppedFrames"`
+	// Average time a frame takes to encode, absent for sources that cannot time their encoder
+	EncodeTimeMs float64 `json:"encodeTimeMs,omitempty"`
+	// Bits produced per second since the previous sample
+	BitrateBps int64 `json:"bitrateBps"`
+	// Average time a frame went out after it was due, absent for sources that do not pace their frames
+	JitterMs float64 `json:"jitterMs,omitempty"`
+	// Most time a frame went out after it was due
+	MaxJitterMs float64 `json:"maxJitterMs,omitempty"`
+	// Times the source's process or session restarted
+	Restarts uint64 `json:"restarts"`
+	// Frames that failed to be produced
+	Errors          uint64 `json:"errors,omitempty"`
+	KeyframesForced uint64 `json:"keyframesForced,omitempty"`
+}
+
+// TranscoderStats is the re-encoding of one track to the fallback codec, over every run of its encoder
+type TranscoderStats struct {
+	TrackID string `json:"trackId"`
+	// The fallback codec's MIME type
+	Codec string `json:"codec"`
+	// The frame rate encoded
+	FPS           int    `json:"fps"`
+	InputFrames   uint64 `json:"inputFrames"`
+	EncodedFrames uint64 `json:"encodedFrames"`
+	// Frames dropped waiting for a busy encoder
+	DroppedFrames uint64 `json:"droppedFrames"`
+	// Average time from a frame going into the encoder to its re-encoded frame coming out
+	EncodeTimeMs float64 `json:"encodeTimeMs"`
+	BitrateBps   int64   `json:"bitrateBps"`
+	// Times the encoder restarted for a new frame rate
+	Restarts uint64 `json:"restarts"`
+}
+
+// ResumeTokenSchema is the $id of resume-token.schema.json, and the value of its "schema" field
+const ResumeTokenSchema = "rmcs/resume-token/1"
+
+// ResumeToken is a token a peer resumes its session with, sent after each answer: on the "keys" data channel to MQTT peers, as a "resume-token" message over WebSocket
+type ResumeToken struct {
+	Schema string `json:"schema"`
+	// Sent back as "resume" in the peer's next offer
+	Token string `json:"token"`
+	// How long after the peer's connection ends the token is accepted
+	TTLSeconds int       `json:"ttlSeconds"`
+	Time       time.Time `json:"time"`
+}
+
+// ROSServiceResultSchema is the $id of ros-service-result.schema.json, and the value of its "schema" field
+const ROSServiceResultSchema = "rmcs/ros-service-result/1"
+
+// ROSServiceResult is the result of a ROS service call, the control channel reply's result, or published on <thingName>/ros-service/result
+type ROSServiceResult struct {
+	Schema string `json:"schema"`
+	// The call's, if it had one
+	ID      string `json:"id,omitempty"`
+	Service string `json:"service"`
+	OK      bool   `json:"ok"`
+	Error   string `json:"error,omitempty"`
+	// The service's response, its fields by name, absent if the call failed or it has no fields
+	Response map[string]interface{} `json:"response,omitempty"`
+	// As the call returned
+	Time time.Time `json:"time"`
+}
+
+// ROSTopicListSchema is the $id of ros-topics.schema.json, and the value of its "schema" field
+const ROSTopicListSchema = "rmcs/ros-topics/1"
+
+// ROSTopicList is the image topics published on the ROS master, published (retained) on <thingName>/ros-topics whenever they change
+type ROSTopicList struct {
+	Schema string     `json:"schema"`
+	Topics []ROSTopic `json:"topics"`
+	Time   time.Time  `json:"time"`
+}
+
+// ROSTopic is one image topic
+type ROSTopic struct {
+	Topic string `json:"topic"`
+	// The topic's message type
+	Type string `json:"type"`
+	// The camera streaming the topic, absent if none does
+	Camera int `json:"camera,omitempty"`
+}
+
+// SignalingEventSchema is the $id of signaling-event.schema.json, and the value of its "schema" field
+const SignalingEventSchema = "rmcs/signaling-event/1"
+
+// SignalingEvent is a signaling lifecycle event mirrored to NATS or Kafka
+type SignalingEvent struct {
+	Schema string `json:"schema"`
+	Type   string `json:"type"`
+	Thing  string `json:"thing"`
+	PeerID string `json:"peerId"`
+	// Signaling transport of offer and answer events
+	Transport string `json:"transport,omitempty"`
+	// Connection state behind peer events, e.g. "disconnected" (may recover) or "closed"
+	State string `json:"state,omitempty"`
+	// Why the backend removed a peer_reaped peer: "silent" (no keepalive or ICE traffic), "stale" (stuck unconnected) or "evicted" (to admit a new peer past maxPeers)
+	Reason string `json:"reason,omitempty"`
+	// Media transport of a connected peer: udp, tcp (ICE-TCP), turn-udp, turn-tcp or turn-tls
+	MediaTransport string `json:"mediaTransport,omitempty"`
+	// Set when media of a connected peer goes over TCP, so reduced quality is expected
+	OverTCP bool      `json:"overTcp,omitempty"`
+	Time    time.Time `json:"time"`
+}
+
+// SnapshotSchema is the $id of snapshot.schema.json, and the value of its "schema" field
+const SnapshotSchema = "rmcs/snapshot/1"
+
+// Snapshot is a JPEG still of a camera for a snapshot command, published on <thingName>/snapshot/result
+type Snapshot struct {
+	Schema string `json:"schema"`
+	// The command's, for matching the result to it
+	ID     string `json:"id,omitempty"`
+	Camera int    `json:"camera"`
+	// The track showing the camera
+	TrackID string `json:"trackId,omitempty"`
+	// When the keyframe the still is decoded from was captured
+	Captured time.Time `json:"captured,omitempty"`
+	// The still, absent on error
+	JPEG  []byte `json:"jpeg,omitempty"`
+	Error string `json:"error,omitempty"`
+}
+
+// SourceErrorSchema is the $id of source-error.schema.json, and the value of its "schema" field
+const SourceErrorSchema = "rmcs/source-error/1"
+
+// SourceError is a video source failing, published on <thingName>/source-error
+type SourceError struct {
+	Schema string `json:"schema"`
+	// The track the source feeds, empty if it feeds none yet
+	TrackID string    `json:"trackId,omitempty"`
+	Camera  int       `json:"camera"`
+	Error   string    `json:"error"`
+	Time    time.Time `json:"time"`
+}
+
+// TelemetrySchema is the $id of telemetry.schema.json, and the value of its "schema" field
+const TelemetrySchema = "rmcs/telemetry/1"
+
+// Telemetry is the robot's latest odometry, joint states, battery state and GPS fix, sent every telemetryInterval on the telemetry data channel, or on <thingName>/telemetry while no peer has it open
+type Telemetry struct {
+	Schema   string        `json:"schema"`
+	Odometry *Odometry     `json:"odometry,omitempty"`
+	Joints   *JointStates  `json:"joints,omitempty"`
+	Battery  *BatteryState `json:"battery,omitempty"`
+	GPS      *GPSFix       `json:"gps,omitempty"`
+	Time     time.Time     `json:"time"`
+}
+
+// BatteryState is the robot's battery from sensor_msgs/BatteryState, absent without a recent message; what the battery does not measure is absent
+type BatteryState struct {
+	// In V
+	Voltage float64 `json:"voltage"`
+	// In A, negative while discharging
+	Current float64 `json:"current,omitempty"`
+	// Charge left, 0 to 1
+	Percentage float64 `json:"percentage,omitempty"`
+	Status     string  `json:"status"`
+}
+
+// GPSFix is the robot's position from sensor_msgs/NavSatFix, absent without a recent fix
+type GPSFix struct {
+	// In degrees, north positive
+	Latitude float64 `json:"latitude"`
+	// In degrees, east positive
+	Longitude float64 `json:"longitude"`
+	// In m above the WGS 84 ellipsoid
+	Altitude float64 `json:"altitude"`
+	// Horizontal standard deviation in m, absent if the receiver does not tell
+	Accuracy float64 `json:"accuracy,omitempty"`
+	// Whether the fix is augmented, by satellites or from the ground
+	Fix string `json:"fix"`
+}
+
+// JointStates is the robot's joints from sensor_msgs/JointState, absent without a recent message; each list is in the order of names, or absent
+type JointStates struct {
+	Names []string `json:"names"`
+	// In rad or m
+	Position []float64 `json:"position,omitempty"`
+	// In rad/s or m/s
+	Velocity []float64 `json:"velocity,omitempty"`
+	// In Nm or N
+	Effort []float64 `json:"effort,omitempty"`
+}
+
+// Odometry is the robot's pose and velocity from nav_msgs/Odometry, absent without a recent message
+type Odometry struct {
+	// The pose's frame, e.g. odom
+	Frame string `json:"frame,omitempty"`
+	// Position in m
+	X float64 `json:"x"`
+	Y float64 `json:"y"`
+	// Heading in rad, counterclockwise from x
+	Yaw float64 `json:"yaw"`
+	// Forward speed in m/s
+	Linear float64 `json:"linear"`
+	// Turn rate in rad/s, counterclockwise positive
+	Angular float64 `json:"angular"`
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+// SDP hooks: deployments adjust the SDP of every negotiation at two points,
+// without forking ProcessOffer. Offer hooks rewrite a peer's offer before
+// anything reads it, answer hooks the answer as it is sent, including
+// re-sends with gathered candidates (see CurrentAnswer). Hooks run in the
+// order they were added, after the built-in ones configured in
+// constants.go: rtxEnabled, nackEnabled, sdpProfileLevelID and
+// sdpVideoBandwidthKbps. They run with the manager locked, so they must not
+// call back into it.
+
+// SDPHook returns sdp, of an offer from or an answer to peerID, adjusted
+type SDPHook func(peerID string, sdp string) string
+
+// AddOfferHook adds a hook applied to every offer before it is answered
+func (w *WebRTCManager) AddOfferHook(hook SDPHook) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.offerHooks = append(w.offerHooks, hook)
+}
+
+// AddAnswerHook adds a hook applied to every answer sent
+func (w *WebRTCManager) AddAnswerHook(hook SDPHook) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.answerHooks = append(w.answerHooks, hook)
+}
+
+// addBuiltinSDPHooks adds the hooks constants.go asks for
+func (w *WebRTCManager) addBuiltinSDPHooks() {
+	if !rtxEnabled {
+		w.AddOfferHook(func(peerID string, offerSDP string) string {
+			return offerWithoutRTX(offerSDP)
+		})
+	}
+	if !nackEnabled {
+		w.AddAnswerHook(func(peerID string, answerSDP string) string {
+			return answerWithoutNACK(answerSDP)
+		})
+	}
+	if sdpProfileLevelID != "" {
+		w.AddAnswerHook(func(peerID string, answerSDP string) string {
+			return answerProfileLevelID(answerSDP, sdpProfileLevelID)
+		})
+	}
+	if sdpVideoBandwidthKbps > 0 {
+		w.AddAnswerHook(func(peerID string, answerSDP string) string {
+			return answerVideoBandwidth(answerSDP, sdpVideoBandwidthKbps)
+		})
+	}
+}
+
+// applySDPHooks runs hooks over sdp in order, with w.mu held
+func applySDPHooks(hooks []SDPHook, peerID string, sdp string) string {
+	for _, hook := range hooks {
+		sdp = hook(peerID, sdp)
+	}
+	return sdp
+}
+
+// answerProfileLevelID sets the H.264 profile-level-id of an answer, for
+// decoders that reject the level pion echoes from the offer
+func answerProfileLevelID(answerSDP string, profileLevelID string) string {
+	lines := strings.SplitAfter(answerSDP, "\n")
+	for i, line := range lines {
+		// e.g. "a=fmtp:102 level-asymmetry-allowed=1;packetization-mode=1;profile-level-id=42e01f"
+		trimmed := strings.TrimRight(line, "\r\n")
+		if !strings.HasPrefix(trimmed, "a=fmtp:") {
+			continue
+		}
+		format, parameters, ok := strings.Cut(trimmed, " ")
+		if !ok {
+			continue
+		}
+		fields := strings.Split(parameters, ";")
+		for j, field := range fields {
+			if key, _, _ := strings.Cut(field, "="); strings.EqualFold(strings.TrimSpace(key), "profile-level-id") {
+				fields[j] = "profile-level-id=" + profileLevelID
+			}
+		}
+		lines[i] = format + " " + strings.Join(fields, ";") + line[len(trimmed):]
+	}
+	return strings.Join(lines, "")
+}
+
+// answerVideoBandwidth caps the video sections of an answer at kbps with a
+// b=AS line, which goes after the section's c= line
+func answerVideoBandwidth(answerSDP string, kbps int) string {
+	lines := strings.SplitAfter(answerSDP, "\n")
+	var out []string
+	video := false
+	for _, line := range lines {
+		trimmed := strings.TrimRight(line, "\r\n")
+		if strings.HasPrefix(trimmed, "m=") {
+			video = strings.HasPrefix(trimmed, "m=video")
+		}
+		out = append(out, line)
+		if video && strings.HasPrefix(trimmed, "c=") {
+			out = append(out, fmt.Sprintf("b=AS:%d", kbps)+line[len(trimmed):])
+		}
+	}
+	return strings.Join(out, "")
+}
@@ -0,0 +1,143 @@
+package main
+
+import (
+	"encoding/binary"
+	"hash/crc32"
+	"log"
+)
+
+// SEI payload type for user_data_unregistered messages
+const seiUserDataUnregistered = 5
+
+// seiChecksumUUID identifies the rmcs frame checksum SEI message. Its payload
+// is a big-endian CRC-32 (IEEE) over every other NAL unit of the access unit,
+// concatenated in order without start codes.
+var seiChecksumUUID = [16]byte{
+	0x72, 0x6d, 0x63, 0x73, 0x2d, 0x63, 0x72, 0x63, // "rmcs-crc"
+	0x9a, 0x41, 0x4e, 0x0b, 0x53, 0x1f, 0x47, 0xd2,
+}
+
+// buildUserDataSEI returns an SEI NAL unit (without start code) carrying a
+// user_data_unregistered message with the given UUID and payload
+func buildUserDataSEI(uuid [16]byte, payload []byte) []byte {
+	return appendUserDataSEI(nil, uuid, payload)
+}
+
+// appendUserDataSEI appends the SEI NAL unit buildUserDataSEI returns to dst
+func appendUserDataSEI(dst []byte, uuid [16]byte, payload []byte) []byte {
+	var scratch [64]byte
+	rbsp := append(scratch[:0], seiUserDataUnregistered)
+	size := len(uuid) + len(payload)
+	for size >= 255 {
+		rbsp = append(rbsp, 0xFF)
+		size -= 255
+	}
+	rbsp = append(rbsp, byte(size))
+	rbsp = append(rbsp, uuid[:]...)
+	rbsp = append(rbsp, payload...)
+	rbsp = append(rbsp, 0x80) // rbsp_trailing_bits
+
+	dst = append(dst, NAL_TYPE_SEI)
+	return appendEmulationPrevention(dst, rbsp)
+}
+
+// addEmulationPrevention inserts 0x03 after any two zero bytes that would
+// otherwise be followed by 0x00-0x03, so the payload cannot mimic a start code
+func addEmulationPrevention(rbsp []byte) []byte {
+	return appendEmulationPrevention(make([]byte, 0, len(rbsp)+len(rbsp)/64), rbsp)
+}
+
+// appendEmulationPrevention appends rbsp to dst, escaped as
+// addEmulationPrevention does
+func appendEmulationPrevention(dst []byte, rbsp []byte) []byte {
+	zeros := 0
+	for _, b := range rbsp {
+		if zeros >= 2 && b <= 0x03 {
+			dst = append(dst, 0x03)
+			zeros = 0
+		}
+		dst = append(dst, b)
+		if b == 0x00 {
+			zeros++
+		} else {
+			zeros = 0
+		}
+	}
+	return dst
+}
+
+// frameChecksum computes the CRC-32 of a length-prefixed frame's NAL units
+func frameChecksum(data []byte) uint32 {
+	return updateFrameChecksum(0, data)
+}
+
+// updateFrameChecksum adds a length-prefixed frame's NAL units to crc, for
+// a checksum over NAL units from more than one frame
+func updateFrameChecksum(crc uint32, data []byte) uint32 {
+	i := 0
+	for i+4 <= len(data) {
+		length := binary.BigEndian.Uint32(data[i : i+4])
+		naluStartIndex := i + 4
+		naluEndIndex := naluStartIndex + int(length)
+		if naluEndIndex > len(data) {
+			break
+		}
+		crc = crc32.Update(crc, crc32.IEEETable, data[naluStartIndex:naluEndIndex])
+		i = naluEndIndex
+	}
+	return crc
+}
+
+// appendChecksumSEI appends the checksum SEI NAL unit carrying checksum,
+// the frameChecksum of the frame it goes with, to dst
+func appendChecksumSEI(dst []byte, checksum uint32) []byte {
+	var payload [4]byte
+	binary.BigEndian.PutUint32(payload[:], checksum)
+	return appendUserDataSEI(dst, seiChecksumUUID, payload[:])
+}
+
+// IntegrityReport is what clients publish on <baseTopic>/<peerId>/integrity
+// after verifying frame checksums. Counts are cumulative for the session.
+type IntegrityReport struct {
+	FramesChecked  uint64 `json:"framesChecked"`
+	CRCMismatches  uint64 `json:"crcMismatches"`
+	MissingSEI     uint64 `json:"missingSei"`
+	DecodeFailures uint64 `json:"decodeFailures"`
+}
+
+func (m *MQTTClient) handleIntegrityReport(topic string, payload []byte) {
+	peerID, ok := peerIDFromTopic(topic)
+	if !ok {
+		return
+	}
+
+	var report IntegrityReport
+	if err := unmarshalPayload(m.capabilitiesFor(peerID).Encoding, payload, &report); err != nil {
+		log.Printf("Failed to parse integrity report from %s: %v", peerID, err)
+		return
+	}
+
+	m.mu.Lock()
+	previous := m.integrityReports[peerID]
+	m.integrityReports[peerID] = report
+	m.mu.Unlock()
+
+	// Reports are cumulative, so only the increase since the last one counts
+	metrics.Add("integrity.frames_checked", delta(report.FramesChecked, previous.FramesChecked))
+	metrics.Add("integrity.crc_mismatches", delta(report.CRCMismatches, previous.CRCMismatches))
+	metrics.Add("integrity.missing_sei", delta(report.MissingSEI, previous.MissingSEI))
+	metrics.Add("integrity.decode_failures", delta(report.DecodeFailures, previous.DecodeFailures))
+
+	if report.CRCMismatches > previous.CRCMismatches {
+		log.Printf("[%s] Frame corruption reported: %d of %d frames failed checksum",
+			peerID, report.CRCMismatches, report.FramesChecked)
+	}
+}
+
+// delta returns current-previous, treating a decrease as a counter reset
+func delta(current, previous uint64) uint64 {
+	if current < previous {
+		return current
+	}
+	return current - previous
+}
@@ -0,0 +1,159 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// PeerRecord is what is remembered about a peer across restarts
+type PeerRecord struct {
+	FirstSeen  time.Time `json:"firstSeen"`
+	LastSeen   time.Time `json:"lastSeen"`
+	LastCamera int       `json:"lastCamera"`
+	Offers     int       `json:"offers"`
+}
+
+// sessionState is the on-disk layout of the session store
+type sessionState struct {
+	Camera int                    `json:"camera"`
+	Peers  map[string]*PeerRecord `json:"peers"`
+}
+
+// SessionStore persists known peers and the camera selection to a JSON file
+// so that a restarted backend can ask those peers to re-offer
+type SessionStore struct {
+	path  string
+	state sessionState
+	mu    sync.Mutex
+}
+
+// OpenSessionStore loads the store at path, starting empty if it does not exist
+func OpenSessionStore(path string) (*SessionStore, error) {
+	store := &SessionStore{
+		path: path,
+		state: sessionState{
+			Peers: make(map[string]*PeerRecord),
+		},
+	}
+
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return store, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read session store %s: %v", path, err)
+	}
+
+	if err := json.Unmarshal(data, &store.state); err != nil {
+		return nil, fmt.Errorf("invalid session store %s: %v", path, err)
+	}
+	if store.state.Peers == nil {
+		store.state.Peers = make(map[string]*PeerRecord)
+	}
+
+	log.Printf("Loaded session store %s: %d known peers, camera %d", path, len(store.state.Peers), store.state.Camera)
+	return store, nil
+}
+
+// saveLocked writes the store atomically; s.mu must be held
+func (s *SessionStore) saveLocked() {
+	data, err := json.MarshalIndent(s.state, "", "  ")
+	if err != nil {
+		log.Printf("Failed to encode session store: %v", err)
+		return
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(s.path), ".sessions-*")
+	if err != nil {
+		log.Printf("Failed to save session store: %v", err)
+		return
+	}
+	_, err = tmp.Write(data)
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), s.path)
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+		log.Printf("Failed to save session store: %v", err)
+	}
+}
+
+// PeerOffered records an offer from peerID
+func (s *SessionStore) PeerOffered(peerID string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now()
+	record, ok := s.state.Peers[peerID]
+	if !ok {
+		record = &PeerRecord{FirstSeen: now}
+		s.state.Peers[peerID] = record
+	}
+	record.LastSeen = now
+	record.LastCamera = s.state.Camera
+	record.Offers++
+	s.saveLocked()
+}
+
+// RemovePeer forgets a peer that disconnected on purpose
+func (s *SessionStore) RemovePeer(peerID string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, ok := s.state.Peers[peerID]; ok {
+		delete(s.state.Peers, peerID)
+		s.saveLocked()
+	}
+}
+
+// SetCamera records the active camera, for the store and every known peer
+func (s *SessionStore) SetCamera(cameraNumber int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.state.Camera = cameraNumber
+	for _, record := range s.state.Peers {
+		record.LastCamera = cameraNumber
+	}
+	s.saveLocked()
+}
+
+// Camera returns the last recorded camera, or 0 if none was recorded
+func (s *SessionStore) Camera() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.state.Camera
+}
+
+// Peers returns a copy of every known peer record
+func (s *SessionStore) Peers() map[string]PeerRecord {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	peers := make(map[string]PeerRecord, len(s.state.Peers))
+	for peerID, record := range s.state.Peers {
+		peers[peerID] = *record
+	}
+	return peers
+}
+
+// RequestReoffers asks every peer known from before a restart to send a new
+// offer, since their previous connections did not survive
+func (m *MQTTClient) RequestReoffers(store *SessionStore) {
+	for peerID, record := range store.Peers() {
+		topic := peerTopic(peerID, "reoffer")
+		if err := m.publish(topic, []byte("robot")); err != nil {
+			log.Printf("Failed to request re-offer from %s: %v", peerID, err)
+			continue
+		}
+		log.Printf("Requested re-offer from %s (last seen %s)", peerID, record.LastSeen.Format(time.RFC3339))
+	}
+}
@@ -0,0 +1,286 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"log"
+	"sync"
+
+	"github.com/pion/webrtc/v4"
+)
+
+// SignalingTransport delivers the backend's side of the offer/answer/candidate
+// exchange to a peer. Incoming offers, candidates and disconnects are handed
+// to a Signaler by the transport itself.
+type SignalingTransport interface {
+	// Name identifies the transport in logs
+	Name() string
+	SendAnswer(peerID string, answerSDP string) error
+	// SendCandidates sends a batch of candidates in one message, see
+	// candidate_batch.go
+	SendCandidates(peerID string, candidates []webrtc.ICECandidateInit) error
+	// SendTracks tells a peer that requested cameras which track is which
+	SendTracks(peerID string, tracks PeerTracks) error
+	// SendError tells a peer why its offer is not answered
+	SendError(peerID string, offerErr OfferError) error
+	// SendKey gives a peer the key to decrypt its video, see e2ee.go
+	SendKey(peerID string, key E2EEKey) error
+	// SendResume gives a peer the token to resume its session with, see
+	// resume.go
+	SendResume(peerID string, resume ResumeToken) error
+}
+
+// Signaler runs the offer/answer/candidate exchange against the WebRTC
+// manager independently of how the messages travel
+type Signaler struct {
+	webrtcManager *WebRTCManager
+	// offerHashes holds the hash of the offer each peer's connection answered
+	offerHashes map[string]string
+	// transports holds the name of the transport that answered each peer's
+	// connection
+	transports map[string]string
+	liveness   map[string]*peerLiveness
+	resumes    *resumeTokens
+	stopReaper chan struct{}
+	mu         sync.Mutex
+}
+
+func NewSignaler(webrtcManager *WebRTCManager) *Signaler {
+	s := &Signaler{
+		webrtcManager: webrtcManager,
+		offerHashes:   make(map[string]string),
+		transports:    make(map[string]string),
+		liveness:      make(map[string]*peerLiveness),
+		resumes:       newResumeTokens(),
+	}
+	s.watchResumes(webrtcManager.Events())
+	return s
+}
+
+// Close stops the peer reaper, if running
+func (s *Signaler) Close() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.stopReaper != nil {
+		close(s.stopReaper)
+		s.stopReaper = nil
+	}
+}
+
+func offerHash(offerSDP string) string {
+	sum := sha256.Sum256([]byte(offerSDP))
+	return hex.EncodeToString(sum[:])
+}
+
+// existingAnswer returns the current answer for peerID if its live
+// connection was created from an identical offer
+func (s *Signaler) existingAnswer(peerID string, hash string) (string, bool) {
+	s.mu.Lock()
+	answeredHash, ok := s.offerHashes[peerID]
+	s.mu.Unlock()
+
+	if !ok || answeredHash != hash {
+		return "", false
+	}
+	return s.webrtcManager.CurrentAnswer(peerID)
+}
+
+// HandleOffer answers peerID's offer and sends the answer, plus trickled
+// candidates when the peer supports them, back over transport. Candidates
+// gathered before the answer is out are held back and sent right after it,
+// since peers cannot apply candidates without a remote description.
+//
+// A redelivered or retried copy of the offer that created the peer's live
+// connection is answered again from that connection instead of replacing it.
+//
+// Offers whose token fails offerAuthMode are never answered. The token and
+// the peer's capabilities decide its role, see peerRole. Offers turned
+// away in maintenance mode or past maxPeers get an OfferError instead.
+// Offers with a valid resume token restore the capabilities of the
+// session they resume, see resume.go, but are authorized all the same: the
+// token never grants a role.
+func (s *Signaler) HandleOffer(transport SignalingTransport, peerID string, offerSDP string, token string, caps PeerCapabilities) {
+	mirrorEvent(SignalingEvent{Type: EventOfferReceived, PeerID: peerID, Transport: transport.Name()})
+
+	role, err := authorizeOffer(peerID, token)
+	if err != nil {
+		log.Printf("[%s] Offer rejected: unauthorized: %v", peerID, err)
+		metrics.Inc("signaling.offers_unauthorized")
+		return
+	}
+	caps, resumed := s.resumeCapabilities(peerID, caps)
+	caps.Role = peerRole(role, caps.Role)
+	caps.Metadata = cleanPeerMetadata(caps.Metadata)
+	if caps.Metadata != (PeerMetadata{}) {
+		log.Printf("[%s] Offer from %s", peerID, caps.Metadata)
+	}
+
+	hash := offerHash(offerSDP)
+	if answerSDP, ok := s.existingAnswer(peerID, hash); ok {
+		log.Printf("[%s] Duplicate offer, re-sending existing answer", peerID)
+		metrics.Inc("signaling.duplicate_offers")
+		if err := transport.SendAnswer(peerID, answerSDP); err != nil {
+			log.Printf("Failed to send answer: %v", err)
+		} else {
+			mirrorEvent(SignalingEvent{Type: EventAnswerSent, PeerID: peerID, Transport: transport.Name()})
+		}
+		s.sendTracks(transport, peerID)
+		s.sendKey(transport, peerID)
+		return
+	}
+
+	var (
+		mu         sync.Mutex
+		answerSent bool
+		pending    []webrtc.ICECandidateInit
+	)
+
+	batch := newCandidateBatch(func(candidates []webrtc.ICECandidateInit) {
+		if err := transport.SendCandidates(peerID, candidates); err != nil {
+			log.Printf("Failed to send ICE candidates: %v", err)
+		} else {
+			log.Printf("Sent %d ICE candidates to %s over %s", len(candidates), peerID, transport.Name())
+		}
+	})
+
+	// Non-trickle peers get every candidate in the answer
+	var onCandidate func(*webrtc.ICECandidate)
+	if caps.TrickleICE {
+		onCandidate = func(candidate *webrtc.ICECandidate) {
+			mu.Lock()
+			if !answerSent {
+				pending = append(pending, candidate.ToJSON())
+				mu.Unlock()
+				return
+			}
+			mu.Unlock()
+			batch.add(candidate.ToJSON())
+		}
+	}
+
+	// Process the offer and create an answer using real WebRTC
+	answerSDP, evicted, err := s.webrtcManager.ProcessOffer(peerID, offerSDP, caps, onCandidate)
+	if evicted != "" {
+		s.evicted(evicted)
+	}
+	if offerErr, ok := offerError(peerID, err); ok {
+		// The peer's existing connection, if any, is untouched
+		log.Printf("[%s] Offer rejected: %v", peerID, err)
+		metrics.Inc("signaling.offers_rejected")
+		if err := transport.SendError(peerID, offerErr); err != nil {
+			log.Printf("Failed to send offer error: %v", err)
+		}
+		return
+	}
+	if err != nil {
+		// The peer's existing connection, if any, is untouched
+		log.Printf("Failed to process offer: %v", err)
+		return
+	}
+
+	s.mu.Lock()
+	s.offerHashes[peerID] = hash
+	s.transports[peerID] = transport.Name()
+	s.mu.Unlock()
+	s.trackLiveness(peerID)
+	if resumed {
+		s.resumes.prime(peerID)
+		s.webrtcManager.primeStream(peerID)
+	}
+
+	if err := transport.SendAnswer(peerID, answerSDP); err != nil {
+		log.Printf("Failed to send answer: %v", err)
+	} else {
+		mirrorEvent(SignalingEvent{Type: EventAnswerSent, PeerID: peerID, Transport: transport.Name()})
+	}
+	s.sendTracks(transport, peerID)
+	s.sendKey(transport, peerID)
+	s.sendResume(transport, peerID, caps)
+
+	mu.Lock()
+	answerSent = true
+	held := pending
+	pending = nil
+	mu.Unlock()
+
+	// Candidates gathered while answering go out together
+	batch.addAll(held)
+}
+
+// sendTracks sends the camera of each track to a peer that requested
+// cameras, right after its answer
+func (s *Signaler) sendTracks(transport SignalingTransport, peerID string) {
+	tracks, ok := s.webrtcManager.PeerTracks(peerID)
+	if !ok {
+		return
+	}
+	if err := transport.SendTracks(peerID, tracks); err != nil {
+		log.Printf("Failed to send tracks: %v", err)
+	}
+}
+
+// sendKey gives the peer the frame key with e2eeEnabled, right after its
+// answer. Only peers whose offer was authorized get this far, and every
+// transport sends the key on a channel private to the peer: its WebSocket,
+// or for MQTT peers the key channel (see key_channel.go).
+func (s *Signaler) sendKey(transport SignalingTransport, peerID string) {
+	encryptor := s.webrtcManager.E2EE()
+	if encryptor == nil {
+		return
+	}
+	if err := transport.SendKey(peerID, encryptor.Key()); err != nil {
+		log.Printf("Failed to send frame key: %v", err)
+		return
+	}
+	metrics.Inc("e2ee.keys_sent")
+}
+
+// HandleCandidates adds the remote candidates received for peerID
+func (s *Signaler) HandleCandidates(peerID string, candidates []ICECandidateMessage) {
+	for _, iceMsg := range candidates {
+		if err := s.webrtcManager.AddICECandidate(peerID, iceMsg); err != nil {
+			log.Printf("Failed to add ICE candidate: %v", err)
+		}
+	}
+}
+
+// PeerTransport returns the name of the transport that answered peerID's
+// connection; ok is false if the peer has none
+func (s *Signaler) PeerTransport(peerID string) (transport string, ok bool) {
+	if !s.webrtcManager.HasPeer(peerID) {
+		return "", false
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	transport, ok = s.transports[peerID]
+	return transport, ok
+}
+
+// evicted forgets a peer the WebRTC manager disconnected to admit another,
+// see peerAdmissionPolicy
+func (s *Signaler) evicted(peerID string) {
+	metrics.Inc("signaling.peers_evicted")
+	mirrorEvent(SignalingEvent{Type: EventPeerReaped, PeerID: peerID, Reason: ReapEvicted})
+
+	s.mu.Lock()
+	delete(s.offerHashes, peerID)
+	delete(s.transports, peerID)
+	delete(s.liveness, peerID)
+	s.mu.Unlock()
+}
+
+// HandleDisconnect tears down peerID's connection
+func (s *Signaler) HandleDisconnect(peerID string) {
+	log.Printf("Disconnecting peer: %s", peerID)
+
+	if err := s.webrtcManager.DisconnectPeer(peerID); err != nil {
+		log.Printf("Failed to disconnect peer %s: %v", peerID, err)
+	}
+
+	s.mu.Lock()
+	delete(s.offerHashes, peerID)
+	delete(s.transports, peerID)
+	delete(s.liveness, peerID)
+	s.mu.Unlock()
+}
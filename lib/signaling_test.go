@@ -0,0 +1,302 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/pion/webrtc/v4"
+)
+
+// signalingTestTimeout bounds gathering and connecting each test peer
+const signalingTestTimeout = 10 * time.Second
+
+// recordingTransport keeps what a Signaler sends, in order, by peer
+type recordingTransport struct {
+	sent map[string][]sentMessage
+	mu   sync.Mutex
+}
+
+// sentMessage is an answer or a batch of candidates sent to a peer
+type sentMessage struct {
+	answer     string
+	candidates []webrtc.ICECandidateInit
+}
+
+func newRecordingTransport() *recordingTransport {
+	return &recordingTransport{sent: make(map[string][]sentMessage)}
+}
+
+func (t *recordingTransport) record(peerID string, message sentMessage) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.sent[peerID] = append(t.sent[peerID], message)
+}
+
+// messages returns what was sent to peerID so far
+func (t *recordingTransport) messages(peerID string) []sentMessage {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return append([]sentMessage(nil), t.sent[peerID]...)
+}
+
+func (t *recordingTransport) Name() string { return "test" }
+
+func (t *recordingTransport) SendAnswer(peerID string, answerSDP string) error {
+	t.record(peerID, sentMessage{answer: answerSDP})
+	return nil
+}
+
+func (t *recordingTransport) SendCandidates(peerID string, candidates []webrtc.ICECandidateInit) error {
+	t.record(peerID, sentMessage{candidates: candidates})
+	return nil
+}
+
+func (t *recordingTransport) SendTracks(peerID string, tracks PeerTracks) error  { return nil }
+func (t *recordingTransport) SendError(peerID string, offerErr OfferError) error { return nil }
+func (t *recordingTransport) SendKey(peerID string, key E2EEKey) error           { return nil }
+func (t *recordingTransport) SendResume(peerID string, resume ResumeToken) error { return nil }
+
+// testPeer is the browser side of one peer ID
+type testPeer struct {
+	connection *webrtc.PeerConnection
+	offerSDP   string
+	// answered is how many messages the transport had sent the peer before
+	// this connection's answer, which is the one after them
+	answered  int
+	connected chan struct{}
+}
+
+// newTestPeer offers to receive video, trickling its candidates
+func newTestPeer(t *testing.T) *testPeer {
+	connection, err := loopbackAPI().NewPeerConnection(webrtc.Configuration{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { connection.Close() })
+
+	peer := &testPeer{connection: connection, connected: make(chan struct{})}
+	var once sync.Once
+	connection.OnConnectionStateChange(func(state webrtc.PeerConnectionState) {
+		if state == webrtc.PeerConnectionStateConnected {
+			once.Do(func() { close(peer.connected) })
+		}
+	})
+	if _, err := connection.AddTransceiverFromKind(webrtc.RTPCodecTypeVideo, webrtc.RTPTransceiverInit{
+		Direction: webrtc.RTPTransceiverDirectionRecvonly,
+	}); err != nil {
+		t.Fatal(err)
+	}
+	offer, err := connection.CreateOffer(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := connection.SetLocalDescription(offer); err != nil {
+		t.Fatal(err)
+	}
+	peer.offerSDP = offer.SDP
+	return peer
+}
+
+// candidates waits for the peer's gathering, returning its candidates as
+// a transport hands them to the Signaler
+func (p *testPeer) candidates(t *testing.T) []ICECandidateMessage {
+	select {
+	case <-webrtc.GatheringCompletePromise(p.connection):
+	case <-time.After(signalingTestTimeout):
+		t.Fatal("test peer did not finish gathering")
+	}
+
+	var candidates []ICECandidateMessage
+	for _, line := range strings.Split(p.connection.LocalDescription().SDP, "\r\n") {
+		if strings.HasPrefix(line, "a=candidate:") {
+			candidates = append(candidates, ICECandidateMessage{Candidate: strings.TrimPrefix(line, "a="), SDPMid: "0"})
+		}
+	}
+	if len(candidates) == 0 {
+		t.Fatal("test peer gathered no candidates")
+	}
+	return candidates
+}
+
+// answer applies the answer to the peer's latest offer
+func (p *testPeer) answer(t *testing.T, transport *recordingTransport, peerID string) {
+	messages := transport.messages(peerID)
+	var answerSDP string
+	for i := len(messages) - 1; i >= 0; i-- {
+		if messages[i].answer != "" {
+			answerSDP, p.answered = messages[i].answer, i
+			break
+		}
+	}
+	if answerSDP == "" {
+		t.Fatalf("%s: no answer sent", peerID)
+	}
+	if p.connection.RemoteDescription() != nil {
+		return
+	}
+	if err := p.connection.SetRemoteDescription(webrtc.SessionDescription{Type: webrtc.SDPTypeAnswer, SDP: answerSDP}); err != nil {
+		t.Fatalf("%s: %v", peerID, err)
+	}
+}
+
+// iceUfrag returns the ICE username fragment of an SDP, which is the same
+// for every answer from one connection
+func iceUfrag(sdp string) string {
+	for _, line := range strings.Split(sdp, "\r\n") {
+		if strings.HasPrefix(line, "a=ice-ufrag:") {
+			return strings.TrimPrefix(line, "a=ice-ufrag:")
+		}
+	}
+	return ""
+}
+
+// connect trickles the candidates sent after the peer's answer to it until
+// it connects
+func (p *testPeer) connect(t *testing.T, transport *recordingTransport, peerID string) {
+	deadline := time.After(signalingTestTimeout)
+	added := p.answered + 1
+	for {
+		messages := transport.messages(peerID)
+		for ; added < len(messages); added++ {
+			for _, candidate := range messages[added].candidates {
+				if err := p.connection.AddICECandidate(candidate); err != nil {
+					t.Fatalf("%s: %v", peerID, err)
+				}
+			}
+		}
+		select {
+		case <-p.connected:
+			return
+		case <-deadline:
+			t.Fatalf("%s did not connect, %d messages sent to it", peerID, len(messages))
+		case <-time.After(20 * time.Millisecond):
+		}
+	}
+}
+
+// TestSignalingInterleaved runs two peers' offers, candidates and
+// disconnects interleaved, and checks each peer ID ends up connected to its
+// own connection, or disconnected, however they were interleaved
+func TestSignalingInterleaved(t *testing.T) {
+	tests := []struct {
+		name string
+		// steps are "<offer|reoffer|candidates|disconnect> <peer>"; reoffer
+		// sends the peer's last offer again
+		steps     []string
+		connected []string
+		gone      []string
+	}{
+		{
+			name:      "one peer",
+			steps:     []string{"offer a", "candidates a"},
+			connected: []string{"a"},
+		},
+		{
+			name:      "offers before candidates",
+			steps:     []string{"offer a", "offer b", "candidates b", "candidates a"},
+			connected: []string{"a", "b"},
+		},
+		{
+			name:      "candidates between offers",
+			steps:     []string{"offer a", "candidates a", "offer b", "candidates b"},
+			connected: []string{"a", "b"},
+		},
+		{
+			name:      "disconnect before the other's candidates",
+			steps:     []string{"offer a", "offer b", "disconnect a", "candidates b"},
+			connected: []string{"b"},
+			gone:      []string{"a"},
+		},
+		{
+			name:      "candidates of a disconnected peer",
+			steps:     []string{"offer a", "offer b", "disconnect a", "candidates a", "candidates b"},
+			connected: []string{"b"},
+			gone:      []string{"a"},
+		},
+		{
+			name:      "offer again after disconnecting",
+			steps:     []string{"offer a", "candidates a", "offer b", "disconnect a", "offer a", "candidates b", "candidates a"},
+			connected: []string{"a", "b"},
+		},
+		{
+			name:      "duplicate offer between the other's",
+			steps:     []string{"offer a", "offer b", "reoffer a", "candidates b", "reoffer b", "candidates a"},
+			connected: []string{"a", "b"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			manager, err := newWebRTCManager(true)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer manager.Close()
+			signaler := NewSignaler(manager)
+			defer signaler.Close()
+			transport := newRecordingTransport()
+
+			peers := make(map[string]*testPeer)
+			caps := PeerCapabilities{TrickleICE: true, Encoding: EncodingJSON}
+			for _, step := range tt.steps {
+				var action, peerID string
+				if _, err := fmt.Sscan(step, &action, &peerID); err != nil {
+					t.Fatalf("step %q: %v", step, err)
+				}
+				switch action {
+				case "offer":
+					peer := newTestPeer(t)
+					peers[peerID] = peer
+					signaler.HandleOffer(transport, peerID, peer.offerSDP, "", caps)
+					peer.answer(t, transport, peerID)
+				case "reoffer":
+					peer := peers[peerID]
+					answered := peer.answered
+					signaler.HandleOffer(transport, peerID, peer.offerSDP, "", caps)
+					peer.answer(t, transport, peerID)
+					messages := transport.messages(peerID)
+					if iceUfrag(messages[peer.answered].answer) != iceUfrag(messages[answered].answer) {
+						t.Fatalf("%s: duplicate offer answered from another connection", peerID)
+					}
+					peer.answered = answered
+				case "candidates":
+					signaler.HandleCandidates(peerID, peers[peerID].candidates(t))
+				case "disconnect":
+					// The browser may still trickle candidates it gathered
+					signaler.HandleDisconnect(peerID)
+				default:
+					t.Fatalf("unknown step %q", step)
+				}
+			}
+
+			for _, peerID := range tt.connected {
+				peers[peerID].connect(t, transport, peerID)
+				if !manager.HasPeer(peerID) {
+					t.Errorf("%s: connected but not a peer", peerID)
+				}
+			}
+			// Peers connect even when sent another's candidates, learning
+			// the backend's address from its checks, so look for those too
+			for _, peerID := range tt.connected {
+				for _, other := range tt.connected {
+					answer, _ := manager.CurrentAnswer(other)
+					for _, message := range transport.messages(peerID) {
+						for _, candidate := range message.candidates {
+							if other != peerID && strings.Contains(answer, "a="+candidate.Candidate) {
+								t.Errorf("%s: sent %s's candidate %s", peerID, other, candidate.Candidate)
+							}
+						}
+					}
+				}
+			}
+			for _, peerID := range tt.gone {
+				if manager.HasPeer(peerID) {
+					t.Errorf("%s: still a peer after disconnecting", peerID)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,190 @@
+package main
+
+import (
+	"log"
+	"strings"
+
+	"github.com/pion/interceptor"
+	"github.com/pion/rtcp"
+	"github.com/pion/rtp"
+	"github.com/pion/sdp/v3"
+	"github.com/pion/webrtc/v4"
+)
+
+// Simulcast: a peer whose offer asks to receive simulcast (a=simulcast:recv
+// with its RIDs, as an SFU offers) gets every video output as one sender
+// with several encodings: the output's own track, then a layer per lower
+// qualityLadder rung streamed from the camera's rendition for that rung.
+// The RIDs are assigned in the order offered, best quality first. Browsers
+// cannot receive simulcast and never offer it, so they get the plain track.
+// The first encoding is the output's track and so follows adaptive bitrate.
+
+// simulcastLayer is a lower rung of a video output, on a track of its own
+type simulcastLayer struct {
+	rung     int
+	track    sampleTrack
+	streamer *VideoStreamer
+}
+
+// newSimulcastLayers creates the layers of an output. Their tracks share
+// the output's IDs, which the encodings of one sender must.
+func newSimulcastLayers(codec webrtc.RTPCodecCapability, trackID string, streamID string) ([]*simulcastLayer, error) {
+	var layers []*simulcastLayer
+	for rung := 1; rung < len(qualityLadder); rung++ {
+		track, err := newVideoTrack(codec, trackID, streamID)
+		if err != nil {
+			return nil, err
+		}
+		layers = append(layers, &simulcastLayer{rung: rung, track: track, streamer: NewVideoStreamer(track)})
+	}
+	return layers, nil
+}
+
+// loadLayers points the output's layers at their renditions of the camera
+// in directory
+func (o *videoOutput) loadLayers(directory string) {
+	for _, layer := range o.layers {
+		rendition := renditionAt(directory, layer.rung)
+		if err := layer.streamer.LoadH264Files(rendition); err != nil {
+			log.Printf("Failed to load %s simulcast layer: %v", qualityLadder[layer.rung].Name, err)
+		}
+	}
+}
+
+// simulcastRIDs returns the RIDs offerSDP asks to receive simulcast with,
+// for each of its video sections in order; nil for sections without
+func simulcastRIDs(offerSDP string) [][]string {
+	if !simulcastEnabled {
+		return nil
+	}
+	var offer sdp.SessionDescription
+	if err := offer.UnmarshalString(offerSDP); err != nil {
+		return nil
+	}
+
+	var rids [][]string
+	for _, media := range offer.MediaDescriptions {
+		if media.MediaName.Media != "video" {
+			continue
+		}
+		var sectionRIDs []string
+		if value, ok := media.Attribute("simulcast"); ok && strings.HasPrefix(value, "recv ") {
+			for _, attribute := range media.Attributes {
+				fields := strings.Fields(attribute.Value)
+				if attribute.Key == "rid" && len(fields) >= 2 && fields[1] == "recv" {
+					sectionRIDs = append(sectionRIDs, fields[0])
+				}
+			}
+		}
+		rids = append(rids, sectionRIDs)
+	}
+	return rids
+}
+
+// addSimulcastTrack sends output to peerConnection in section, with an
+// encoding per RID, as many as the output has layers for
+func addSimulcastTrack(peerID string, peerConnection *webrtc.PeerConnection, output *videoOutput, rids []string, section videoSection, role string, onREMB func(bitrate float32)) error {
+	base := &ridTrack{TrackLocal: peerTrack(peerID, output.track, output.streamer), rid: rids[0]}
+	transceiver, err := addVideoTransceiver(peerConnection, base, section, role)
+	if err != nil {
+		return err
+	}
+	base.transceiver = transceiver
+	sender := transceiver.Sender()
+	go readRTCP(peerID, sender.ReadRTCP, output.streamer, onREMB)
+
+	for i, layer := range output.layers {
+		if i+1 >= len(rids) {
+			break
+		}
+		rid := rids[i+1]
+		if err := sender.AddEncoding(&ridTrack{TrackLocal: peerTrack(peerID, layer.track, layer.streamer), rid: rid, transceiver: base.transceiver}); err != nil {
+			return err
+		}
+		go readRTCP(peerID, func() ([]rtcp.Packet, interceptor.Attributes, error) {
+			return sender.ReadSimulcastRTCP(rid)
+		}, layer.streamer, onREMB)
+	}
+	log.Printf("[%s] Simulcast %s with RIDs %v", peerID, output.track.ID(), rids[:min(len(rids), len(output.layers)+1)])
+	return nil
+}
+
+// answerSimulcast removes the a=rid recv and a=simulcast:recv lines pion
+// copies from a simulcast offer into the answer, as if the peer were the
+// one sending simulcast. The answer's send lines stay. pion only accepts
+// its own answer as local description, so this applies to what is sent.
+func answerSimulcast(answerSDP string) string {
+	lines := strings.SplitAfter(answerSDP, "\n")
+	kept := lines[:0]
+	for _, line := range lines {
+		fields := strings.Fields(strings.TrimPrefix(line, "a=rid:"))
+		if strings.HasPrefix(line, "a=simulcast:recv ") || (strings.HasPrefix(line, "a=rid:") && len(fields) >= 2 && fields[1] == "recv") {
+			continue
+		}
+		kept = append(kept, line)
+	}
+	return strings.Join(kept, "")
+}
+
+// ridTrack is one peer's view of a shared track as a simulcast encoding. It
+// carries the encoding's RID and tags the packets sent to the peer with the
+// MID and RID header extensions, which receivers demultiplex simulcast by.
+type ridTrack struct {
+	webrtc.TrackLocal
+	rid         string
+	transceiver *webrtc.RTPTransceiver // set once added, for its MID
+}
+
+func (t *ridTrack) RID() string { return t.rid }
+
+func (t *ridTrack) Bind(ctx webrtc.TrackLocalContext) (webrtc.RTPCodecParameters, error) {
+	writer := &ridWriter{TrackLocalWriter: ctx.WriteStream()}
+	for _, extension := range ctx.HeaderExtensions() {
+		switch {
+		case extension.URI == sdp.SDESMidURI && t.transceiver != nil:
+			writer.extensions = append(writer.extensions, headerExtension{id: uint8(extension.ID), value: []byte(t.transceiver.Mid())})
+		case extension.URI == sdp.SDESRTPStreamIDURI:
+			writer.extensions = append(writer.extensions, headerExtension{id: uint8(extension.ID), value: []byte(t.rid)})
+		}
+	}
+	return t.TrackLocal.Bind(writerContext{TrackLocalContext: ctx, writer: writer})
+}
+
+// writerContext hands a shared track a writer wrapping the peer's own, to
+// tag the packets sent to that peer
+type writerContext struct {
+	webrtc.TrackLocalContext
+	writer webrtc.TrackLocalWriter
+}
+
+func (c writerContext) WriteStream() webrtc.TrackLocalWriter { return c.writer }
+
+type headerExtension struct {
+	id    uint8
+	value []byte
+}
+
+// ridWriter adds its header extensions to every packet. The shared track
+// reuses one header for all peers, so the extensions go on a copy.
+type ridWriter struct {
+	webrtc.TrackLocalWriter
+	extensions []headerExtension
+}
+
+func (w *ridWriter) WriteRTP(header *rtp.Header, payload []byte) (int, error) {
+	tagged := header.Clone()
+	for _, extension := range w.extensions {
+		if err := tagged.SetExtension(extension.id, extension.value); err != nil {
+			return 0, err
+		}
+	}
+	return w.TrackLocalWriter.WriteRTP(&tagged, payload)
+}
+
+func (w *ridWriter) Write(b []byte) (int, error) {
+	var packet rtp.Packet
+	if err := packet.Unmarshal(b); err != nil {
+		return 0, err
+	}
+	return w.WriteRTP(&packet.Header, packet.Payload)
+}
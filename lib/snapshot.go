@@ -0,0 +1,237 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os/exec"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Snapshots: a JPEG still of a camera, for incident documentation, taken
+// with the snapshot command on <thingName>/snapshot and published on
+// <thingName>/snapshot/result, or fetched from /snapshot on the metrics
+// server with snapshotHTTPEnabled. Every track keeps its last keyframe,
+// parameter sets included, taken from its frame broadcaster (see
+// broadcaster.go), and a snapshot decodes it with captureCommand, so it
+// shows the camera as of its last keyframe, at most a GOP ago; the capture
+// time says when. The JPEG is kept until the next keyframe, so snapshots
+// within a GOP decode once.
+
+// snapshotQueueSize keyframes can wait to be kept for snapshots
+const snapshotQueueSize = 2
+
+// SnapshotCommand is the payload of the snapshot command, e.g. {"id":
+// "incident-42", "camera": 2}. Camera defaults to the first track's.
+type SnapshotCommand struct {
+	ID     string `json:"id,omitempty"`
+	Camera int    `json:"camera,omitempty"`
+}
+
+// CameraSnapshot is a JPEG still of a camera
+type CameraSnapshot struct {
+	Camera   int
+	TrackID  string // showing the camera
+	Captured time.Time
+	JPEG     []byte
+}
+
+// keyframeStill holds a track's last keyframe, and its JPEG once decoded
+type keyframeStill struct {
+	keyframe []byte // Annex B, parameter sets first
+	captured time.Time
+	count    uint64 // keyframes recorded, telling which one jpeg is of
+	jpeg     []byte // nil until a snapshot decodes the keyframe
+	mu       sync.Mutex
+	// decodeMu serializes decoding, so concurrent snapshots decode once
+	decodeMu sync.Mutex
+}
+
+// recordStill keeps a keyframe of the stream for snapshots, from the
+// stream's broadcaster
+func (v *VideoStreamer) recordStill(unit AccessUnit) {
+	v.mu.Lock()
+	// Replaced, never changed, so they can be used without v.mu
+	sps, pps := v.sps, v.pps
+	v.mu.Unlock()
+	v.still.record(unit, sps, pps)
+}
+
+// record keeps the keyframe unit, with the stream's parameter sets unless
+// it has its own
+func (k *keyframeStill) record(unit AccessUnit, sps []byte, pps []byte) {
+	hasSPS := false
+	forEachAnnexBNAL(unit.Data, func(nal []byte) {
+		hasSPS = hasSPS || nal[0]&0x1F == NAL_SPS
+	})
+
+	k.mu.Lock()
+	defer k.mu.Unlock()
+
+	k.keyframe = k.keyframe[:0]
+	if !hasSPS && sps != nil && pps != nil {
+		k.keyframe = appendAnnexBNAL(k.keyframe, sps)
+		k.keyframe = appendAnnexBNAL(k.keyframe, pps)
+	}
+	k.keyframe = append(k.keyframe, unit.Data...)
+	k.captured = unit.Captured
+	k.count++
+	k.jpeg = nil
+}
+
+// snapshot returns the keyframe as JPEG, decoding it if it was not yet.
+// The stream records keyframes meanwhile: decoding is done on a copy.
+func (k *keyframeStill) snapshot() ([]byte, time.Time, error) {
+	k.decodeMu.Lock()
+	defer k.decodeMu.Unlock()
+
+	k.mu.Lock()
+	if len(k.keyframe) == 0 {
+		k.mu.Unlock()
+		return nil, time.Time{}, errors.New("no keyframe streamed yet")
+	}
+	if k.jpeg != nil {
+		defer k.mu.Unlock()
+		return k.jpeg, k.captured, nil
+	}
+	keyframe := append([]byte(nil), k.keyframe...)
+	captured, count := k.captured, k.count
+	k.mu.Unlock()
+
+	jpeg, err := decodeJPEG(keyframe)
+	if err != nil {
+		return nil, time.Time{}, err
+	}
+	k.mu.Lock()
+	if k.count == count {
+		k.jpeg = jpeg
+	}
+	k.mu.Unlock()
+	return jpeg, captured, nil
+}
+
+// decodeJPEG decodes an Annex B keyframe into a JPEG with captureCommand
+func decodeJPEG(keyframe []byte) ([]byte, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), snapshotTimeout)
+	defer cancel()
+
+	start := time.Now()
+	cmd := exec.CommandContext(ctx, captureCommand, "-hide_banner", "-loglevel", "error",
+		"-f", "h264", "-i", "pipe:0",
+		"-frames:v", "1", "-q:v", strconv.Itoa(snapshotQuality), "-f", "image2", "-c:v", "mjpeg", "pipe:1")
+	if err := sandboxCommand(cmd); err != nil {
+		return nil, err
+	}
+	cmd.Stdin = bytes.NewReader(keyframe)
+	var stdout, stderr bytes.Buffer
+	cmd.Stdout, cmd.Stderr = &stdout, &stderr
+	if err := cmd.Run(); err != nil {
+		if message := strings.TrimSpace(stderr.String()); message != "" {
+			err = fmt.Errorf("%v: %s", err, message)
+		}
+		return nil, fmt.Errorf("failed to decode keyframe: %v", err)
+	}
+	if stdout.Len() == 0 {
+		return nil, errors.New("failed to decode keyframe: no picture")
+	}
+	metrics.Observe("snapshot.decode", time.Since(start))
+	return stdout.Bytes(), nil
+}
+
+// Snapshot returns a JPEG still of cameraNumber, as of its last keyframe;
+// camera 0 is the first track's. The camera must be shown on a track.
+func (w *WebRTCManager) Snapshot(cameraNumber int) (*CameraSnapshot, error) {
+	if cameraNumber == 0 {
+		cameraNumber = int(w.outputs[0].camera.Load())
+	}
+
+	var output *videoOutput
+	for _, candidate := range w.allOutputs() {
+		if int(candidate.camera.Load()) == cameraNumber {
+			output = candidate
+			break
+		}
+	}
+	if output == nil {
+		metrics.Inc("snapshot.failures")
+		return nil, fmt.Errorf("camera %d is not on a track", cameraNumber)
+	}
+
+	jpeg, captured, err := output.streamer.still.snapshot()
+	if err != nil {
+		metrics.Inc("snapshot.failures")
+		return nil, fmt.Errorf("camera %d: %v", cameraNumber, err)
+	}
+	metrics.Inc("snapshot.taken")
+	return &CameraSnapshot{Camera: cameraNumber, TrackID: output.track.ID(), Captured: captured, JPEG: jpeg}, nil
+}
+
+// handleSnapshot takes a snapshot for <thingName>/snapshot and publishes
+// it on <thingName>/snapshot/result
+func (m *MQTTClient) handleSnapshot(topic string, payload []byte) {
+	var cmd SnapshotCommand
+	if len(bytes.TrimSpace(payload)) > 0 {
+		if err := json.Unmarshal(payload, &cmd); err != nil {
+			log.Printf("Invalid snapshot command on %s: %v", topic, err)
+			return
+		}
+	}
+	log.Printf("Snapshot of camera %d requested (id %q)", cmd.Camera, cmd.ID)
+
+	result := Snapshot{Schema: SnapshotSchema, ID: cmd.ID, Camera: cmd.Camera}
+	snapshot, err := m.webrtcManager.Snapshot(cmd.Camera)
+	if err != nil {
+		log.Printf("Failed to take snapshot: %v", err)
+		result.Error = err.Error()
+	} else {
+		result.Camera, result.TrackID = snapshot.Camera, snapshot.TrackID
+		result.Captured, result.JPEG = snapshot.Captured.UTC(), snapshot.JPEG
+	}
+
+	data, err := json.Marshal(result)
+	if err != nil {
+		log.Printf("Failed to marshal snapshot: %v", err)
+		return
+	}
+	if err := m.publish(deviceTopic("snapshot/result"), data); err != nil {
+		log.Printf("Failed to publish snapshot: %v", err)
+	}
+}
+
+// snapshotHandler serves GET /snapshot?camera=N as image/jpeg, the
+// capture time in X-Capture-Time
+func snapshotHandler(manager *WebRTCManager) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			w.Header().Set("Allow", "GET")
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		cameraNumber := 0
+		if value := r.URL.Query().Get("camera"); value != "" {
+			n, err := strconv.Atoi(value)
+			if err != nil {
+				http.Error(w, "invalid camera", http.StatusBadRequest)
+				return
+			}
+			cameraNumber = n
+		}
+
+		snapshot, err := manager.Snapshot(cameraNumber)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusServiceUnavailable)
+			return
+		}
+		w.Header().Set("Content-Type", "image/jpeg")
+		w.Header().Set("Cache-Control", "no-store")
+		w.Header().Set("X-Capture-Time", snapshot.Captured.UTC().Format(time.RFC3339Nano))
+		w.Write(snapshot.JPEG)
+	}
+}
@@ -0,0 +1,617 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"slices"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Source manager: with sourceManagerEnabled, the sources of cameras
+// streamed from sources (RTSP, GStreamer, capture and registered sources,
+// see video_source.go) run in the SourceManager rather than in the tracks
+// showing them. A camera's source runs once however many tracks and
+// simulcast layers show it, each through a sourceTap, and keeps running
+// after they switch away, so a track switching back finds its encoder
+// warm: the track takes the camera over at its next keyframe (see
+// handOverSource), forced where the source can, showing the previous
+// camera until then instead of a stopped pipeline and a starting one.
+// While streaming, the cameras in cameraDirectories streamed from sources
+// are started ahead of being shown too.
+//
+// What runs is bounded by sourceManagerCPUBudget cores, from each source's
+// estimated cost. A camera started for a track that does not fit stops the
+// least recently shown cameras no track shows until it does; one started
+// ahead is not started instead. Shown cameras run whatever the budget.
+// While the CPU governor finds the CPU saturated (see cpu_governor.go), no
+// camera is started ahead.
+//
+// Sources costing more than CPU to keep running, such as ROS cameras
+// subscribing to the robot's topics (see ros_source.go), run on demand
+// instead: they are not started ahead, and stop streamLinger after the last
+// track showing them switches away, unless one shows them again meanwhile.
+
+// Estimated CPU cost of sources, in cores, see cpuCoster
+const (
+	defaultSourceCost = 0.5  // of registered sources and GStreamer pipelines
+	rtspSourceCost    = 0.05 // depacketizing only
+	captureInputCost  = 0.1  // reading and converting a capture's frames, before encoding
+)
+
+// cpuCoster is a source that estimates the CPU it takes while running, in
+// cores
+type cpuCoster interface {
+	cpuCost() float64
+}
+
+// onDemandSource is a source run only while a track shows it, see above
+type onDemandSource interface {
+	streamsOnDemand() bool
+}
+
+// streamsOnDemand reports whether source runs only while shown
+func streamsOnDemand(source VideoSource) bool {
+	demand, ok := source.(onDemandSource)
+	return ok && demand.streamsOnDemand()
+}
+
+// sourceCost returns the estimated CPU cost of source, in cores
+func sourceCost(source VideoSource) float64 {
+	if coster, ok := source.(cpuCoster); ok {
+		return coster.cpuCost()
+	}
+	return defaultSourceCost
+}
+
+// SourceManager runs the sources of cameras, shared by the tracks showing
+// them
+type SourceManager struct {
+	budget    float64 // cores
+	sources   map[int]*sharedSource
+	saturated atomic.Bool // the CPU is, see setSaturated
+	mu        sync.Mutex
+}
+
+// NewSourceManager returns a manager running sources within budget cores
+func NewSourceManager(budget float64) *SourceManager {
+	return &SourceManager{budget: budget, sources: make(map[int]*sharedSource)}
+}
+
+// source returns a source of cameraNumber's frames from its shared source,
+// which starting it starts with factory if it is not running
+func (m *SourceManager) source(cameraNumber int, factory VideoSourceFactory) VideoSource {
+	return &sourceTap{manager: m, camera: cameraNumber, factory: factory}
+}
+
+// attach adds tap to its camera's shared source, starting the source if it
+// is not running
+func (m *SourceManager) attach(tap *sourceTap) (*sharedSource, error) {
+	var evicted []*sharedSource
+	m.mu.Lock()
+	// Sources are stopped without m.mu: one may be starting a tap itself,
+	// as a composition does (see compose_source.go)
+	defer func() {
+		m.mu.Unlock()
+		stopSources(evicted)
+	}()
+
+	shared, warm := m.sources[tap.camera]
+	if !warm {
+		source, err := tap.factory(tap.camera)
+		if err != nil {
+			return nil, fmt.Errorf("failed to open camera %d: %v", tap.camera, err)
+		}
+		var fits bool
+		if evicted, fits = m.makeRoom(sourceCost(source)); !fits {
+			log.Printf("Camera %d takes the sources running past the %.2f core CPU budget", tap.camera, m.budget)
+			metrics.Inc("sources.over_budget")
+		}
+		if shared, err = m.run(tap.camera, source); err != nil {
+			return nil, err
+		}
+	}
+	shared.attach(tap)
+	if warm {
+		metrics.Inc("sources.warm_switches")
+		shared.forceKeyframe()
+	}
+	return shared, nil
+}
+
+// prewarm starts cameraNumber's source ahead of it being shown, if it fits
+// in the budget beside the sources running
+func (m *SourceManager) prewarm(cameraNumber int, factory VideoSourceFactory) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if _, ok := m.sources[cameraNumber]; ok {
+		return
+	}
+	if m.saturated.Load() {
+		log.Printf("Not starting camera %d ahead: the CPU is saturated", cameraNumber)
+		metrics.Inc("governor.refused")
+		return
+	}
+	source, err := factory(cameraNumber)
+	if err != nil {
+		log.Printf("Failed to open camera %d: %v", cameraNumber, err)
+		return
+	}
+	if streamsOnDemand(source) {
+		return // started once shown
+	}
+	if cost := sourceCost(source); m.used()+cost > m.budget {
+		log.Printf("Not starting camera %d ahead: %.2f cores would take the sources past the %.2f core CPU budget",
+			cameraNumber, cost, m.budget)
+		return
+	}
+	if _, err := m.run(cameraNumber, source); err != nil {
+		log.Printf("Failed to start camera %d: %v", cameraNumber, err)
+		return
+	}
+	log.Printf("Started camera %d ahead of it being shown", cameraNumber)
+}
+
+// replace has cameraNumber's running source continue from a new one from
+// factory, from its first keyframe, for new settings or a new factory
+func (m *SourceManager) replace(cameraNumber int, factory VideoSourceFactory) error {
+	m.mu.Lock()
+	shared, ok := m.sources[cameraNumber]
+	m.mu.Unlock()
+	if !ok {
+		return nil // the camera starts from factory when shown
+	}
+
+	source, err := factory(cameraNumber)
+	if err != nil {
+		return fmt.Errorf("failed to open camera %d: %v", cameraNumber, err)
+	}
+	if err := shared.replace(source); err != nil {
+		return err
+	}
+	m.mu.Lock()
+	m.updateGauges()
+	m.mu.Unlock()
+	return nil
+}
+
+// setSaturated has the manager start no camera ahead while the CPU is
+// saturated
+func (m *SourceManager) setSaturated(saturated bool) {
+	m.saturated.Store(saturated)
+}
+
+// cameras returns the cameras whose sources are running
+func (m *SourceManager) cameras() []int {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	cameras := make([]int, 0, len(m.sources))
+	for cameraNumber := range m.sources {
+		cameras = append(cameras, cameraNumber)
+	}
+	return cameras
+}
+
+// stopAll stops every source, once the stream stopped
+func (m *SourceManager) stopAll() {
+	m.mu.Lock()
+	var stopped []*sharedSource
+	for cameraNumber, shared := range m.sources {
+		stopped = append(stopped, shared)
+		delete(m.sources, cameraNumber)
+	}
+	m.updateGauges()
+	m.mu.Unlock()
+	stopSources(stopped)
+}
+
+// run starts source as cameraNumber's shared source, with m.mu held
+func (m *SourceManager) run(cameraNumber int, source VideoSource) (*sharedSource, error) {
+	shared := &sharedSource{camera: cameraNumber, cost: sourceCost(source), onDemand: streamsOnDemand(source), lastShown: time.Now()}
+	if err := shared.start(source); err != nil {
+		return nil, fmt.Errorf("failed to start camera %d: %v", cameraNumber, err)
+	}
+	m.sources[cameraNumber] = shared
+	m.updateGauges()
+	return shared, nil
+}
+
+// makeRoom takes the least recently shown sources no track shows out of
+// the running ones until cost fits in the budget, with m.mu held, and
+// returns them to be stopped. fits is false if cost does not fit even so.
+func (m *SourceManager) makeRoom(cost float64) (evicted []*sharedSource, fits bool) {
+	for m.used()+cost > m.budget {
+		var oldest *sharedSource
+		for _, shared := range m.sources {
+			if shared.idle() && (oldest == nil || shared.shownAt().Before(oldest.shownAt())) {
+				oldest = shared
+			}
+		}
+		if oldest == nil {
+			return evicted, false
+		}
+		log.Printf("Stopping camera %d, not shown since %s, to stay within the CPU budget",
+			oldest.camera, oldest.shownAt().Format(time.TimeOnly))
+		metrics.Inc("sources.evictions")
+		delete(m.sources, oldest.camera)
+		evicted = append(evicted, oldest)
+	}
+	return evicted, true
+}
+
+// release stops shared, once its last tap detached, streamLinger later if
+// its source runs on demand and no tap attached meanwhile
+func (m *SourceManager) release(shared *sharedSource) {
+	if !shared.lingering() {
+		return
+	}
+	time.AfterFunc(streamLinger, func() {
+		m.mu.Lock()
+		// A tap attached and detached meanwhile has a release of its own
+		if m.sources[shared.camera] != shared || !shared.lingering() || time.Since(shared.shownAt()) < streamLinger {
+			m.mu.Unlock()
+			return
+		}
+		delete(m.sources, shared.camera)
+		m.updateGauges()
+		m.mu.Unlock()
+
+		log.Printf("Stopping camera %d, not shown for %v", shared.camera, streamLinger)
+		metrics.Inc("sources.released")
+		shared.stop()
+	})
+}
+
+// stopSources stops shared sources taken out of the running ones
+func stopSources(sources []*sharedSource) {
+	for _, shared := range sources {
+		shared.stop()
+	}
+}
+
+// used returns the cores the running sources take, with m.mu held
+func (m *SourceManager) used() float64 {
+	var used float64
+	for _, shared := range m.sources {
+		used += shared.estimatedCost()
+	}
+	return used
+}
+
+// updateGauges publishes what runs, with m.mu held
+func (m *SourceManager) updateGauges() {
+	metrics.SetGauge("sources.running", int64(len(m.sources)))
+	metrics.SetGauge("sources.cpu_millicores", int64(m.used()*1000))
+}
+
+// sharedSource is a camera's running source, writing its frames to every
+// tap attached
+type sharedSource struct {
+	camera   int
+	cost     float64
+	onDemand bool        // the source runs only while shown
+	source   VideoSource // writing to the taps
+	// next replaces source from its first keyframe, see replace
+	next VideoSource
+	// taps is replaced, never changed, so it can be written to without mu
+	taps      []*sourceTap
+	lastShown time.Time // last a tap attached or detached
+	stopped   bool
+	mu        sync.Mutex
+}
+
+// start runs source as the shared source
+func (s *sharedSource) start(source VideoSource) error {
+	s.mu.Lock()
+	s.source = source
+	s.mu.Unlock()
+	return source.Start(&sharedSink{shared: s, source: source})
+}
+
+// replace starts source beside the running one, taking over from it at its
+// first keyframe, see sharedSink. A source without a keyframe within
+// captureTimeout is given up on.
+func (s *sharedSource) replace(source VideoSource) error {
+	s.mu.Lock()
+	if s.stopped {
+		s.mu.Unlock()
+		return nil // the camera starts anew when shown
+	}
+	previous := s.next
+	s.next = source
+	s.cost = sourceCost(source)
+	s.onDemand = streamsOnDemand(source)
+	s.mu.Unlock()
+	if previous != nil {
+		previous.Stop()
+	}
+
+	if err := source.Start(&sharedSink{shared: s, source: source}); err != nil {
+		s.mu.Lock()
+		if s.next == source {
+			s.next = nil
+		}
+		s.mu.Unlock()
+		return fmt.Errorf("failed to start camera %d: %v", s.camera, err)
+	}
+	time.AfterFunc(captureTimeout, func() {
+		s.mu.Lock()
+		abandon := s.next == source
+		if abandon {
+			s.next = nil
+		}
+		s.mu.Unlock()
+		if abandon {
+			log.Printf("New source of camera %d sent no keyframe within %s, keeping the current one", s.camera, captureTimeout)
+			source.Stop()
+		}
+	})
+	return nil
+}
+
+// stop stops the shared source; its taps get no more frames
+func (s *sharedSource) stop() {
+	s.mu.Lock()
+	source, next := s.source, s.next
+	s.source, s.next = nil, nil
+	s.stopped = true
+	s.mu.Unlock()
+
+	if source != nil {
+		source.Stop()
+	}
+	if next != nil {
+		next.Stop()
+	}
+}
+
+func (s *sharedSource) attach(tap *sourceTap) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.taps = append(slices.Clip(s.taps), tap)
+	s.lastShown = time.Now()
+}
+
+func (s *sharedSource) detach(tap *sourceTap) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.taps = slices.DeleteFunc(slices.Clone(s.taps), func(t *sourceTap) bool { return t == tap })
+	s.lastShown = time.Now()
+}
+
+// lingering reports whether the source runs on demand, and no tap is
+// attached
+func (s *sharedSource) lingering() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.onDemand && len(s.taps) == 0
+}
+
+// idle reports whether no tap is attached
+func (s *sharedSource) idle() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.taps) == 0
+}
+
+func (s *sharedSource) shownAt() time.Time {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.lastShown
+}
+
+func (s *sharedSource) estimatedCost() float64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.cost
+}
+
+func (s *sharedSource) forceKeyframe() {
+	s.mu.Lock()
+	source := s.source
+	s.mu.Unlock()
+	if source != nil {
+		source.ForceKeyframe()
+	}
+}
+
+func (s *sharedSource) stats() VideoSourceStats {
+	s.mu.Lock()
+	source := s.source
+	s.mu.Unlock()
+	if source == nil {
+		return VideoSourceStats{}
+	}
+	return source.Stats()
+}
+
+// sharedSink takes the frames of one of a shared source's sources: the
+// running one, whose frames go to every tap, or the one replacing it,
+// whose frames are dropped until its first keyframe, when it takes over
+// and the running one is stopped
+type sharedSink struct {
+	shared *sharedSource
+	source VideoSource
+}
+
+// WriteFrame implements SampleSink
+func (s *sharedSink) WriteFrame(frame VideoFrame) bool {
+	shared := s.shared
+	shared.mu.Lock()
+	if shared.source != s.source {
+		if shared.next != s.source {
+			shared.mu.Unlock()
+			return false // replaced or stopped
+		}
+		if !hasIDR(frame.Data) {
+			shared.mu.Unlock()
+			return true
+		}
+		previous := shared.source
+		shared.source, shared.next = s.source, nil
+		// previous may be writing a frame, and stopping waits for it
+		go previous.Stop()
+		log.Printf("Camera %d continues from its new source", shared.camera)
+	}
+	taps := shared.taps
+	shared.mu.Unlock()
+
+	for _, tap := range taps {
+		tap.write(shared, frame)
+	}
+	return true
+}
+
+// ReportError implements SampleSink
+func (s *sharedSink) ReportError(err error) {
+	s.shared.mu.Lock()
+	running := s.shared.source == s.source
+	taps := s.shared.taps
+	s.shared.mu.Unlock()
+	if !running {
+		return
+	}
+	for _, tap := range taps {
+		tap.reportError(s.shared, err)
+	}
+}
+
+// sourceTap is one track's view of a camera's shared source, which it
+// starts with factory if it is not running
+type sourceTap struct {
+	manager *SourceManager
+	camera  int
+	factory VideoSourceFactory
+	shared  *sharedSource // attached to, while started
+	sink    SampleSink
+	// mu is held writing to sink, so Stop waits for a frame being written
+	mu sync.Mutex
+}
+
+// Start implements VideoSource
+func (t *sourceTap) Start(sink SampleSink) error {
+	t.mu.Lock()
+	if t.shared != nil {
+		t.mu.Unlock()
+		return errors.New("camera source already started")
+	}
+	t.sink = sink
+	t.mu.Unlock()
+
+	// Not attached with t.mu held: stopping a source for room waits for
+	// its frames to be written
+	shared, err := t.manager.attach(t)
+	if err != nil {
+		return err
+	}
+	t.mu.Lock()
+	t.shared = shared
+	t.mu.Unlock()
+	return nil
+}
+
+// Stop implements VideoSource. The shared source keeps running, or
+// lingers if it runs on demand.
+func (t *sourceTap) Stop() {
+	t.mu.Lock()
+	shared := t.shared
+	t.shared = nil
+	t.mu.Unlock()
+	if shared != nil {
+		shared.detach(t)
+		t.manager.release(shared)
+	}
+}
+
+// ForceKeyframe implements VideoSource, for every track the camera shows on
+func (t *sourceTap) ForceKeyframe() {
+	t.mu.Lock()
+	shared := t.shared
+	t.mu.Unlock()
+	if shared != nil {
+		shared.forceKeyframe()
+	}
+}
+
+// Stats implements VideoSource, with the shared source's stats
+func (t *sourceTap) Stats() VideoSourceStats {
+	t.mu.Lock()
+	shared := t.shared
+	t.mu.Unlock()
+	if shared == nil {
+		return VideoSourceStats{}
+	}
+	return shared.stats()
+}
+
+// write passes a frame of shared to the sink, detaching from shared once
+// the sink stops
+func (t *sourceTap) write(shared *sharedSource, frame VideoFrame) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.shared != shared {
+		return
+	}
+	if !t.sink.WriteFrame(frame) {
+		t.shared = nil
+		shared.detach(t)
+		t.manager.release(shared)
+	}
+}
+
+func (t *sourceTap) reportError(shared *sharedSource, err error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.shared == shared {
+		t.sink.ReportError(err)
+	}
+}
+
+// cameraSource returns a source of cameraNumber's frames from factory: with
+// the source manager a tap of its shared source, otherwise one of its own
+func (w *WebRTCManager) cameraSource(cameraNumber int, factory VideoSourceFactory) (VideoSource, error) {
+	if sourceManagerEnabled {
+		return w.sourceManager.source(cameraNumber, factory), nil
+	}
+	return factory(cameraNumber)
+}
+
+// showSource switches streamer to source: with the source manager at its
+// first keyframe, as the camera's encoder may already be mid-GOP
+func (w *WebRTCManager) showSource(streamer *VideoStreamer, source VideoSource) {
+	if sourceManagerEnabled {
+		handOverSource(streamer, source)
+		return
+	}
+	streamer.SetSource(source)
+}
+
+// prewarmCameras starts the sources of cameras in cameraDirectories or
+// registered ahead of them being shown, in camera order, as the budget
+// allows
+func (w *WebRTCManager) prewarmCameras() {
+	if !sourceManagerEnabled {
+		return
+	}
+	var cameras []int
+	for cameraNumber := range cameraDirectories {
+		cameras = append(cameras, cameraNumber)
+	}
+	w.sources.mu.Lock()
+	for cameraNumber := range w.sources.factories {
+		if _, ok := cameraDirectories[cameraNumber]; !ok {
+			cameras = append(cameras, cameraNumber)
+		}
+	}
+	w.sources.mu.Unlock()
+	slices.Sort(cameras)
+
+	for _, cameraNumber := range cameras {
+		if factory, ok := w.cameraFactory(cameraNumber); ok {
+			w.sourceManager.prewarm(cameraNumber, factory)
+		}
+	}
+}
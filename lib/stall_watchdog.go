@@ -0,0 +1,231 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"time"
+)
+
+// Stall watchdog: a source can go silent without failing, a ROS topic no
+// longer published or an encoder process hung, leaving its tracks frozen
+// on the last frame. While streaming, every stallCheckInterval the
+// watchdog checks when each track last got a frame from its source. After
+// stallTimeout without one the camera is reported stalled, in the
+// availability list on <thingName>/cameras and as a source error on
+// <thingName>/source-error, and its source is restarted. If it is silent
+// again, within stallRetryInterval of the restart, the track falls back to
+// frame files: the
+// camera's own if its entry is a directory, stallFallbackCamera's
+// otherwise. The camera's source is then retried every stallRetryInterval,
+// handed over at its first keyframe, so the fallback streams until the
+// source delivers again. A camera streaming frame files is only restarted.
+
+// stallState is what the watchdog knows of one track
+type stallState struct {
+	camera   int
+	stalled  bool
+	actedAt  time.Time // of the last restart, fallback or retry
+	restarts int
+	fallback VideoSource // the fallback's file source, nil without one
+	retry    VideoSource // the camera's source retried last
+}
+
+// StartStallWatchdog restarts the sources of tracks getting no frames,
+// and falls back to frame files if that does not help
+func (w *WebRTCManager) StartStallWatchdog() {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if w.stopWatchdog != nil {
+		return
+	}
+	w.stopWatchdog = make(chan struct{})
+	go w.watchdogLoop(w.stopWatchdog)
+}
+
+func (w *WebRTCManager) watchdogLoop(stop chan struct{}) {
+	ticker := time.NewTicker(stallCheckInterval)
+	defer ticker.Stop()
+
+	states := make(map[*videoOutput]*stallState)
+	for {
+		select {
+		case <-stop:
+			return
+		case now := <-ticker.C:
+			for _, output := range w.allOutputs() {
+				idle, streaming := output.streamer.idle()
+				if !streaming {
+					continue
+				}
+				camera := int(output.camera.Load())
+				state, ok := states[output]
+				if !ok || state.camera != camera || state.switchedAway(output) {
+					// New, or switched to a camera since
+					output.fallback.Store(false)
+					state = &stallState{camera: camera}
+					states[output] = state
+				}
+				w.checkStall(output, state, idle, now)
+			}
+		}
+	}
+}
+
+// switchedAway reports whether the track was switched to a camera while it
+// streamed the fallback
+func (s *stallState) switchedAway(output *videoOutput) bool {
+	if s.fallback == nil {
+		return false
+	}
+	source := output.streamer.Source()
+	return source != s.fallback && source != s.retry
+}
+
+// checkStall acts on a track that got its last frame idle ago
+func (w *WebRTCManager) checkStall(output *videoOutput, state *stallState, idle time.Duration, now time.Time) {
+	camera := state.camera
+	switch {
+	case state.fallback != nil:
+		if state.retry != nil && output.streamer.Source() == state.retry {
+			log.Printf("Camera %d streams again, ending the fallback on %s", camera, output.track.ID())
+			metrics.Inc("sources.stall_recoveries")
+			output.fallback.Store(false)
+			w.showLayers(output, camera)
+			*state = stallState{camera: camera}
+		} else if now.Sub(state.actedAt) >= stallRetryInterval {
+			state.actedAt = now
+			state.retry = w.retryStalledSource(output, camera)
+		}
+	case idle < stallTimeout:
+		if state.stalled {
+			log.Printf("Camera %d streams again on %s", camera, output.track.ID())
+			metrics.Inc("sources.stall_recoveries")
+			state.stalled = false
+		} else if state.restarts > 0 && now.Sub(state.actedAt) >= stallRetryInterval {
+			// A source stalling again soon after its restart falls back
+			state.restarts = 0
+		}
+	case state.stalled && now.Sub(state.actedAt) < stallTimeout:
+		// Waiting on the restart
+	default:
+		if !state.stalled {
+			state.stalled = true
+			metrics.Inc("sources.stalls")
+			w.cameraHealth.SetStalled(camera)
+		}
+		state.actedAt = now
+
+		directory, fallback := stallFallbackDirectory(camera)
+		if _, live := w.cameraFactory(camera); live && fallback && state.restarts > 0 {
+			w.alertStall(output, camera, fmt.Errorf("no frames for %v after a restart, falling back to %s", idle.Round(time.Second), directory))
+			if w.fallBack(output, directory) {
+				state.fallback = output.streamer.Source()
+			}
+			return
+		}
+		state.restarts++
+		w.alertStall(output, camera, fmt.Errorf("no frames for %v, restarting the source", idle.Round(time.Second)))
+		if err := w.restartStalledSource(output, camera); err != nil {
+			log.Printf("Failed to restart camera %d: %v", camera, err)
+		}
+	}
+}
+
+// alertStall reports a stalled camera as a source error
+func (w *WebRTCManager) alertStall(output *videoOutput, camera int, err error) {
+	log.Printf("Camera %d stalled on %s: %v", camera, output.track.ID(), err)
+	w.events.emitSourceError(SourceErrorEvent{TrackID: output.track.ID(), Camera: camera, Err: err})
+}
+
+// restartStalledSource starts camera's source anew: with the source
+// manager, the shared source every track showing it continues from
+func (w *WebRTCManager) restartStalledSource(output *videoOutput, camera int) error {
+	metrics.Inc("sources.stall_restarts")
+	w.switchMu.Lock()
+	defer w.switchMu.Unlock()
+
+	if factory, ok := w.cameraFactory(camera); ok && sourceManagerEnabled {
+		return w.sourceManager.replace(camera, factory)
+	}
+	return w.loadCamera(output, camera)
+}
+
+// stallFallbackDirectory returns the frame files a stalled camera falls
+// back to: its own, or stallFallbackCamera's
+func stallFallbackDirectory(camera int) (string, bool) {
+	for _, candidate := range []int{camera, stallFallbackCamera} {
+		// Addresses are not directories, finding no frame files
+		directory, ok := cameraDirectories[candidate]
+		if !ok {
+			continue
+		}
+		if _, err := findH264Files(directory); err == nil {
+			return directory, true
+		}
+	}
+	return "", false
+}
+
+// fallBack streams directory's frame files on the track and its layers in
+// place of their sources
+func (w *WebRTCManager) fallBack(output *videoOutput, directory string) bool {
+	metrics.Inc("sources.stall_fallbacks")
+	w.switchMu.Lock()
+	defer w.switchMu.Unlock()
+
+	output.fallback.Store(true)
+	if err := output.streamer.LoadH264Files(w.rendition(directory)); err != nil {
+		log.Printf("Failed to fall back to %s: %v", directory, err)
+		output.fallback.Store(false)
+		return false
+	}
+	output.loadLayers(directory)
+	return true
+}
+
+// retryStalledSource hands the track over to a new source of camera, which
+// takes over from the fallback at its first keyframe, and returns it
+func (w *WebRTCManager) retryStalledSource(output *videoOutput, camera int) VideoSource {
+	w.switchMu.Lock()
+	defer w.switchMu.Unlock()
+
+	factory, ok := w.cameraFactory(camera)
+	if !ok {
+		return nil
+	}
+	if sourceManagerEnabled {
+		// The shared source may still be the silent one
+		if err := w.sourceManager.replace(camera, factory); err != nil {
+			log.Printf("Failed to retry camera %d: %v", camera, err)
+			return nil
+		}
+	}
+	source, err := w.cameraSource(camera, factory)
+	if err != nil {
+		log.Printf("Failed to retry camera %d: %v", camera, err)
+		return nil
+	}
+	log.Printf("Retrying camera %d on %s", camera, output.track.ID())
+	handOverSource(output.streamer, source)
+	return source
+}
+
+// showLayers switches the output's simulcast layers back to camera's
+// source after a fallback
+func (w *WebRTCManager) showLayers(output *videoOutput, camera int) {
+	factory, ok := w.cameraFactory(camera)
+	if !ok {
+		return
+	}
+	w.switchMu.Lock()
+	defer w.switchMu.Unlock()
+	for _, layer := range output.layers {
+		source, err := w.cameraSource(camera, factory)
+		if err != nil {
+			log.Printf("Failed to open camera %d for the %s simulcast layer: %v", camera, qualityLadder[layer.rung].Name, err)
+			continue
+		}
+		w.showSource(layer.streamer, source)
+	}
+}
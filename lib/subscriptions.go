@@ -0,0 +1,179 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"sync"
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+)
+
+// SubscriptionState describes one registered subscription for diagnostics
+type SubscriptionState struct {
+	Name       string    `json:"name"`
+	Filter     string    `json:"filter"`
+	Subscribed bool      `json:"subscribed"`
+	LastError  string    `json:"lastError,omitempty"`
+	Since      time.Time `json:"since,omitempty"` // when it was last (re)subscribed
+	Restores   int       `json:"restores"`        // successful subscribes since registration
+}
+
+type subscription struct {
+	state   SubscriptionState
+	qos     byte
+	handler mqtt.MessageHandler
+}
+
+// SubscriptionRegistry owns every MQTT subscription. With clean sessions the
+// broker forgets them on each disconnect, so the registry marks them all
+// lost when the connection drops and subscribes them again on reconnect,
+// retrying any that fail every mqttResubscribeInterval until they succeed.
+type SubscriptionRegistry struct {
+	entries []*subscription
+	retry   *time.Timer
+	mu      sync.Mutex
+}
+
+func NewSubscriptionRegistry() *SubscriptionRegistry {
+	return &SubscriptionRegistry{}
+}
+
+// Add registers a subscription at qos; it is made on the next Restore
+func (r *SubscriptionRegistry) Add(name string, filter string, qos byte, handler mqtt.MessageHandler) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.entries = append(r.entries, &subscription{
+		state:   SubscriptionState{Name: name, Filter: filter},
+		qos:     qos,
+		handler: handler,
+	})
+}
+
+// Restore subscribes every registered filter not currently subscribed.
+// Called from the OnConnect handler after every (re)connect.
+func (r *SubscriptionRegistry) Restore(client mqtt.Client) {
+	r.mu.Lock()
+	pending := make([]*subscription, 0, len(r.entries))
+	for _, entry := range r.entries {
+		if !entry.state.Subscribed {
+			pending = append(pending, entry)
+		}
+	}
+	r.mu.Unlock()
+
+	failed := 0
+	for _, entry := range pending {
+		// Subscribing blocks on the broker, so it is done without the lock
+		err := waitToken(client.Subscribe(entry.state.Filter, entry.qos, entry.handler))
+
+		r.mu.Lock()
+		if err != nil {
+			entry.state.LastError = err.Error()
+			failed++
+		} else {
+			entry.state.Subscribed = true
+			entry.state.LastError = ""
+			entry.state.Since = time.Now()
+			entry.state.Restores++
+		}
+		r.mu.Unlock()
+
+		if err != nil {
+			log.Printf("Failed to subscribe to %s: %v", entry.state.Filter, err)
+			metrics.Inc("mqtt.subscribe_failures")
+		} else {
+			log.Printf("Subscribed to %s topic: %s", entry.state.Name, entry.state.Filter)
+		}
+	}
+	r.reportGauges()
+
+	if failed > 0 {
+		r.scheduleRetry(client)
+	}
+}
+
+// scheduleRetry restores failed subscriptions later, as long as the client
+// stays connected; a reconnect restores them anyway
+func (r *SubscriptionRegistry) scheduleRetry(client mqtt.Client) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.retry != nil {
+		r.retry.Stop()
+	}
+	r.retry = time.AfterFunc(mqttResubscribeInterval, func() {
+		if client.IsConnectionOpen() {
+			r.Restore(client)
+		}
+	})
+}
+
+// ConnectionLost marks every subscription as gone, the broker dropped them
+// with the session
+func (r *SubscriptionRegistry) ConnectionLost() {
+	r.mu.Lock()
+	for _, entry := range r.entries {
+		entry.state.Subscribed = false
+	}
+	if r.retry != nil {
+		r.retry.Stop()
+		r.retry = nil
+	}
+	r.mu.Unlock()
+	r.reportGauges()
+}
+
+// UnsubscribeAll removes every subscription from the broker before a clean
+// disconnect. Registrations are kept.
+func (r *SubscriptionRegistry) UnsubscribeAll(client mqtt.Client) {
+	r.mu.Lock()
+	if r.retry != nil {
+		r.retry.Stop()
+		r.retry = nil
+	}
+	filters := make([]string, 0, len(r.entries))
+	for _, entry := range r.entries {
+		if entry.state.Subscribed {
+			filters = append(filters, entry.state.Filter)
+		}
+		entry.state.Subscribed = false
+	}
+	r.mu.Unlock()
+
+	for _, filter := range filters {
+		if err := waitToken(client.Unsubscribe(filter)); err != nil {
+			log.Printf("Failed to unsubscribe from %s: %v", filter, err)
+		}
+	}
+	r.reportGauges()
+}
+
+// States returns the state of every subscription, in registration order
+func (r *SubscriptionRegistry) States() []SubscriptionState {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	states := make([]SubscriptionState, len(r.entries))
+	for i, entry := range r.entries {
+		states[i] = entry.state
+	}
+	return states
+}
+
+func (r *SubscriptionRegistry) JSON() ([]byte, error) {
+	return json.Marshal(r.States())
+}
+
+func (r *SubscriptionRegistry) reportGauges() {
+	active := 0
+	states := r.States()
+	for _, state := range states {
+		if state.Subscribed {
+			active++
+		}
+	}
+	metrics.SetGauge("mqtt.subscriptions_active", int64(active))
+	metrics.SetGauge("mqtt.subscriptions_missing", int64(len(states)-active))
+}
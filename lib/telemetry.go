@@ -0,0 +1,537 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"math"
+	"net/url"
+	"path"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pion/webrtc/v4"
+)
+
+// Telemetry: the backend subscribes to the robot's odometry, joint states,
+// battery state and GPS fix, telemetryOdometryTopic, telemetryJointsTopic,
+// telemetryBatteryTopic and telemetryGPSTopic, keeping the latest of each,
+// and every
+// telemetryInterval sends what it has, as a compact Telemetry, to every
+// peer on a negotiated data channel labelled "telemetry" with id
+// telemetryChannelID, in the encoding the peer selected in its
+// capabilities, JSON or CBOR. While no peer has the channel open, e.g. a
+// frontend without WebRTC, it is published on <thingName>/telemetry
+// instead. What was not received for telemetryMaxAge is left out, rather
+// than reported as current, as is the position while the receiver has no
+// fix.
+//
+// Each new fix is also published, retained, to <thingName>/gps, a
+// GPSPosition, for the operator UI to plot the robot on a map whether or not
+// it streams, at most every telemetryInterval.
+//
+// The calibration of every ROS camera (see ros_source.go) is followed too,
+// from the camera_info topic beside its image topic, e.g.
+// /flir_id8/camera_info for /flir_id8/image_resized, or the entry's info
+// option. Whenever it changes it is sent, as a CameraInfo, on every open
+// telemetry channel, and retained on <thingName>/camera-info/<camera>; a
+// channel opening is sent every camera's. Messages on the channel are told
+// apart by their schema.
+
+const (
+	telemetryChannelLabel = "telemetry"
+	// telemetryMaxBuffered skips a peer's telemetry while more than this
+	// waits to be sent to it
+	telemetryMaxBuffered = 64 * 1024
+	// telemetryQueueSize is how many messages of a topic wait to be decoded
+	telemetryQueueSize = 4
+)
+
+// telemetryChannel is a peer's telemetry data channel
+type telemetryChannel struct {
+	channel  *webrtc.DataChannel
+	encoding string
+}
+
+// telemetryFeed keeps the latest of each telemetry topic
+type telemetryFeed struct {
+	subscribers map[string]*rosSubscriber // by topic
+	failing     map[string]bool           // topics failing to subscribe, already logged
+	odometry    *Odometry
+	joints      *JointStates
+	battery     *BatteryState
+	gps         *GPSFix              // nil without a fix
+	infoCameras map[string]int       // the camera of each camera_info topic
+	cameraInfo  map[int]*CameraInfo  // latest, by camera
+	received    map[string]time.Time // each topic's latest
+	mu          sync.Mutex
+}
+
+// attachTelemetry creates the negotiated telemetry channel on
+// peerConnection, sending in encoding, for the caller to store in
+// w.telemetry. Like the control channel, it only opens if the peer creates
+// the same channel.
+func (w *WebRTCManager) attachTelemetry(peerID string, peerConnection *webrtc.PeerConnection, encoding string) (*telemetryChannel, error) {
+	negotiated := true
+	id := uint16(telemetryChannelID)
+	channel, err := peerConnection.CreateDataChannel(telemetryChannelLabel, &webrtc.DataChannelInit{
+		Negotiated: &negotiated,
+		ID:         &id,
+	})
+	if err != nil {
+		return nil, err
+	}
+	telemetry := &telemetryChannel{channel: channel, encoding: encoding}
+	channel.OnOpen(func() {
+		log.Printf("[%s] Telemetry channel open", peerID)
+		w.mu.Lock()
+		infos := make([]CameraInfo, 0, len(w.cameraInfo))
+		for _, info := range w.cameraInfo {
+			infos = append(infos, info)
+		}
+		w.mu.Unlock()
+		for _, info := range infos {
+			telemetry.send(info)
+		}
+	})
+	return telemetry, nil
+}
+
+// send sends message on the channel, in its encoding
+func (c *telemetryChannel) send(message interface{}) error {
+	payload, err := marshalPayload(c.encoding, message)
+	if err != nil {
+		return err
+	}
+	if c.encoding == EncodingCBOR {
+		return c.channel.Send(payload)
+	}
+	return c.channel.SendText(string(payload))
+}
+
+// openTelemetry returns the open telemetry channels, with w.mu held
+func (w *WebRTCManager) openTelemetry() []*telemetryChannel {
+	var channels []*telemetryChannel
+	for _, channel := range w.telemetry {
+		if channel.channel.ReadyState() == webrtc.DataChannelStateOpen {
+			channels = append(channels, channel)
+		}
+	}
+	return channels
+}
+
+// SetTelemetryFallback makes fallback receive the telemetry no peer has
+// the channel open for
+func (w *WebRTCManager) SetTelemetryFallback(fallback func(Telemetry)) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.telemetrySink = fallback
+}
+
+// SetGPSSink makes sink receive each new GPS fix
+func (w *WebRTCManager) SetGPSSink(sink func(GPSPosition)) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.gpsSink = sink
+}
+
+// SetCameraInfoSink makes sink receive each camera's calibration as it
+// changes
+func (w *WebRTCManager) SetCameraInfoSink(sink func(CameraInfo)) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.cameraInfoSink = sink
+}
+
+// StartTelemetry starts sending the robot's telemetry every
+// telemetryInterval
+func (w *WebRTCManager) StartTelemetry() {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if w.stopTelemetry != nil || telemetryInterval <= 0 {
+		return
+	}
+	w.stopTelemetry = make(chan struct{})
+	go w.telemetryLoop(w.stopTelemetry)
+}
+
+func (w *WebRTCManager) telemetryLoop(stop chan struct{}) {
+	ticker := time.NewTicker(telemetryInterval)
+	defer ticker.Stop()
+
+	feed := &telemetryFeed{
+		subscribers: make(map[string]*rosSubscriber),
+		failing:     make(map[string]bool),
+		infoCameras: make(map[string]int),
+		cameraInfo:  make(map[int]*CameraInfo),
+		received:    make(map[string]time.Time),
+	}
+	defer feed.close()
+	var fix *GPSFix                    // the last sent to the GPS sink
+	infos := make(map[int]*CameraInfo) // the last sent of each camera
+	for {
+		feed.subscribe()
+		for camera, info := range feed.latestCameraInfo() {
+			// Each message decoded is a new CameraInfo, the same
+			// calibration more often than not
+			if infos[camera] == nil || !sameCameraInfo(*info, *infos[camera]) {
+				w.sendCameraInfo(*info)
+			}
+			infos[camera] = info
+		}
+		telemetry := feed.snapshot(time.Now())
+		if telemetry.Odometry != nil || telemetry.Joints != nil || telemetry.Battery != nil || telemetry.GPS != nil {
+			w.sendTelemetry(telemetry)
+		}
+		// Each fix decoded is a new GPSFix
+		if telemetry.GPS != nil && telemetry.GPS != fix {
+			fix = telemetry.GPS
+			w.sendGPS(*fix, telemetry.Time)
+		}
+
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// sendTelemetry sends telemetry on every open telemetry channel, or to the
+// fallback if there is none
+func (w *WebRTCManager) sendTelemetry(telemetry Telemetry) {
+	w.mu.Lock()
+	channels := w.openTelemetry()
+	fallback := w.telemetrySink
+	w.mu.Unlock()
+
+	if len(channels) == 0 {
+		if fallback != nil {
+			fallback(telemetry)
+		}
+		return
+	}
+	for _, channel := range channels {
+		if channel.channel.BufferedAmount() > telemetryMaxBuffered {
+			metrics.Inc("telemetry.skipped")
+			continue
+		}
+		if err := channel.send(telemetry); err == nil {
+			metrics.Inc("telemetry.sent")
+		}
+	}
+}
+
+// sendCameraInfo sends a camera's new calibration on every open telemetry
+// channel, whether or not they are behind, and to the camera info sink
+func (w *WebRTCManager) sendCameraInfo(info CameraInfo) {
+	w.mu.Lock()
+	w.cameraInfo[info.Camera] = info
+	channels := w.openTelemetry()
+	sink := w.cameraInfoSink
+	w.mu.Unlock()
+
+	for _, channel := range channels {
+		if err := channel.send(info); err == nil {
+			metrics.Inc("telemetry.camera_info_sent")
+		}
+	}
+	if sink != nil {
+		sink(info)
+	}
+}
+
+// sendGPS sends fix, received as of now, to the GPS sink
+func (w *WebRTCManager) sendGPS(fix GPSFix, now time.Time) {
+	w.mu.Lock()
+	sink := w.gpsSink
+	w.mu.Unlock()
+
+	if sink != nil {
+		sink(GPSPosition{
+			Schema:    GPSPositionSchema,
+			Latitude:  fix.Latitude,
+			Longitude: fix.Longitude,
+			Altitude:  fix.Altitude,
+			Accuracy:  fix.Accuracy,
+			Fix:       fix.Fix,
+			Time:      now,
+		})
+	}
+}
+
+// subscribe subscribes to the telemetry topics not subscribed to yet
+func (f *telemetryFeed) subscribe() {
+	topics := []string{telemetryOdometryTopic, telemetryJointsTopic, telemetryBatteryTopic, telemetryGPSTopic}
+	f.mu.Lock()
+	for camera, address := range cameraDirectories {
+		if topic := cameraInfoTopic(address); topic != "" {
+			f.infoCameras[topic] = camera
+			topics = append(topics, topic)
+		}
+	}
+	f.mu.Unlock()
+	for _, topic := range topics {
+		if topic == "" || f.subscribers[topic] != nil {
+			continue
+		}
+		node, err := startROSNode()
+		if err == nil {
+			var subscriber *rosSubscriber
+			if subscriber, err = node.subscribe(topic, telemetryQueueSize); err == nil {
+				f.subscribers[topic] = subscriber
+				delete(f.failing, topic)
+				go f.follow(topic, subscriber)
+				continue
+			}
+		}
+		if !f.failing[topic] {
+			log.Printf("Telemetry of %s unavailable, retrying: %v", topic, err)
+			f.failing[topic] = true
+		}
+	}
+}
+
+// follow decodes the messages of topic until its subscriber closes
+func (f *telemetryFeed) follow(topic string, subscriber *rosSubscriber) {
+	for message := range subscriber.messages {
+		if err := f.update(topic, message); err != nil {
+			metrics.Inc("telemetry.invalid")
+			continue
+		}
+		f.mu.Lock()
+		f.received[topic] = message.Received
+		f.mu.Unlock()
+	}
+}
+
+// update keeps message, of topic, as the latest of its type
+func (f *telemetryFeed) update(topic string, message rosMessage) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	switch message.Type {
+	case rosOdometryType:
+		odometry, err := decodeROSOdometry(message.Data)
+		if err != nil {
+			return err
+		}
+		f.odometry = &Odometry{
+			Frame:   odometry.Header.FrameID,
+			X:       odometry.Position.X,
+			Y:       odometry.Position.Y,
+			Yaw:     odometry.yaw(),
+			Linear:  odometry.Twist.Linear.X,
+			Angular: odometry.Twist.Angular.Z,
+		}
+	case rosJointStateType:
+		state, err := decodeROSJointState(message.Data)
+		if err != nil {
+			return err
+		}
+		f.joints = &JointStates{Names: state.Name, Position: state.Position, Velocity: state.Velocity, Effort: state.Effort}
+	case rosBatteryStateType:
+		state, err := decodeROSBatteryState(message.Data)
+		if err != nil {
+			return err
+		}
+		f.battery = &BatteryState{
+			Voltage:    measured(state.Voltage),
+			Current:    measured(state.Current),
+			Percentage: measured(state.Percentage),
+			Status:     rosBatteryStatuses[0],
+		}
+		if int(state.Status) < len(rosBatteryStatuses) {
+			f.battery.Status = rosBatteryStatuses[state.Status]
+		}
+	case rosNavSatFixType:
+		fix, err := decodeROSNavSatFix(message.Data)
+		if err != nil {
+			return err
+		}
+		if fix.Status < 0 || math.IsNaN(fix.Latitude) || math.IsNaN(fix.Longitude) {
+			metrics.Inc("telemetry.gps_no_fix")
+			f.gps = nil
+			return nil
+		}
+		f.gps = &GPSFix{
+			Latitude:  fix.Latitude,
+			Longitude: fix.Longitude,
+			Altitude:  fix.Altitude,
+			Accuracy:  fix.accuracy(),
+			Fix:       rosNavSatFixes[0],
+		}
+		if math.IsNaN(f.gps.Altitude) {
+			f.gps.Altitude = 0
+		}
+		if math.IsNaN(f.gps.Accuracy) {
+			f.gps.Accuracy = 0
+		}
+		if int(fix.Status) < len(rosNavSatFixes) {
+			f.gps.Fix = rosNavSatFixes[fix.Status]
+		}
+	case rosCameraInfoType:
+		calibration, err := decodeROSCameraInfo(message.Data)
+		if err != nil {
+			return err
+		}
+		camera, ok := f.infoCameras[topic]
+		if !ok {
+			return fmt.Errorf("camera info on %s", topic)
+		}
+		f.cameraInfo[camera] = cameraInfo(camera, topic, calibration)
+	default:
+		return fmt.Errorf("unexpected %s", message.Type)
+	}
+	return nil
+}
+
+// snapshot returns the telemetry received within telemetryMaxAge of now
+func (f *telemetryFeed) snapshot(now time.Time) Telemetry {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	recent := func(topic string) bool {
+		return now.Sub(f.received[topic]) <= telemetryMaxAge
+	}
+	telemetry := Telemetry{Schema: TelemetrySchema, Time: now.UTC()}
+	if recent(telemetryOdometryTopic) {
+		telemetry.Odometry = f.odometry
+	}
+	if recent(telemetryJointsTopic) {
+		telemetry.Joints = f.joints
+	}
+	if recent(telemetryBatteryTopic) {
+		telemetry.Battery = f.battery
+	}
+	if recent(telemetryGPSTopic) {
+		telemetry.GPS = f.gps
+	}
+	return telemetry
+}
+
+// latestCameraInfo returns the latest calibration of each camera
+func (f *telemetryFeed) latestCameraInfo() map[int]*CameraInfo {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	infos := make(map[int]*CameraInfo, len(f.cameraInfo))
+	for camera, info := range f.cameraInfo {
+		infos[camera] = info
+	}
+	return infos
+}
+
+func (f *telemetryFeed) close() {
+	for _, subscriber := range f.subscribers {
+		subscriber.Close()
+	}
+}
+
+// cameraInfoTopic returns the camera_info topic of a "ros:<topic>" camera
+// entry: its info option, or the one beside its image topic, leaving out
+// the image transport, e.g. /cam/camera_info for /cam/image_raw/compressed.
+// It is "" for other entries.
+func cameraInfoTopic(address string) string {
+	spec, ok := strings.CutPrefix(address, "ros:")
+	if !ok {
+		return ""
+	}
+	topic, options, _ := strings.Cut(spec, "?")
+	if values, _ := url.ParseQuery(options); values.Has("info") {
+		return values.Get("info")
+	}
+	topic = strings.TrimSuffix(topic, "/compressed")
+	return path.Join(path.Dir(topic), "camera_info")
+}
+
+// cameraInfo returns a camera's calibration as it is sent
+func cameraInfo(camera int, topic string, calibration rosCameraInfo) *CameraInfo {
+	info := &CameraInfo{
+		Schema:          CameraInfoSchema,
+		Camera:          camera,
+		Topic:           topic,
+		Frame:           calibration.Header.FrameID,
+		Width:           int(calibration.Width),
+		Height:          int(calibration.Height),
+		DistortionModel: calibration.DistortionModel,
+		D:               calibration.D,
+		K:               calibration.K,
+		R:               calibration.R,
+		P:               calibration.P,
+		Time:            time.Now().UTC(),
+	}
+	if info.D == nil {
+		info.D = []float64{}
+	}
+	if calibration.BinningX > 1 || calibration.BinningY > 1 {
+		info.BinningX, info.BinningY = int(calibration.BinningX), int(calibration.BinningY)
+	}
+	if roi := calibration.ROI; roi.Width > 0 && roi.Height > 0 {
+		info.ROI = &RegionOfInterest{X: int(roi.XOffset), Y: int(roi.YOffset), Width: int(roi.Width), Height: int(roi.Height), Rectify: roi.DoRectify}
+	}
+	return info
+}
+
+// sameCameraInfo reports whether a and b are the same calibration
+func sameCameraInfo(a, b CameraInfo) bool {
+	a.Time, b.Time = time.Time{}, time.Time{}
+	return reflect.DeepEqual(a, b)
+}
+
+// measured returns a float32 of a ROS message as the float64 of the same
+// decimal, 0.8 rather than 0.800000011920929, or 0 if it is unmeasured
+// (NaN)
+func measured(value float32) float64 {
+	if math.IsNaN(float64(value)) || math.IsInf(float64(value), 0) {
+		return 0
+	}
+	f, _ := strconv.ParseFloat(strconv.FormatFloat(float64(value), 'g', -1, 32), 64)
+	return f
+}
+
+// publishTelemetry publishes telemetry on <thingName>/telemetry
+func (m *MQTTClient) publishTelemetry(telemetry Telemetry) {
+	payload, err := marshalPayload(EncodingJSON, telemetry)
+	if err != nil {
+		log.Printf("Failed to marshal telemetry: %v", err)
+		return
+	}
+	if err := m.publish(deviceTopic("telemetry"), payload); err != nil {
+		log.Printf("Failed to publish telemetry: %v", err)
+		return
+	}
+	metrics.Inc("telemetry.published")
+}
+
+// publishGPS retains position on <thingName>/gps
+func (m *MQTTClient) publishGPS(position GPSPosition) {
+	payload, err := json.Marshal(position)
+	if err != nil {
+		log.Printf("Failed to marshal GPS position: %v", err)
+		return
+	}
+	if err := m.publishMessage(deviceTopic("gps"), true, payload); err != nil {
+		log.Printf("Failed to publish GPS position: %v", err)
+		return
+	}
+	metrics.Inc("telemetry.gps_published")
+}
+
+// publishCameraInfo retains info on <thingName>/camera-info/<camera>
+func (m *MQTTClient) publishCameraInfo(info CameraInfo) {
+	payload, err := json.Marshal(info)
+	if err != nil {
+		log.Printf("Failed to marshal camera info: %v", err)
+		return
+	}
+	if err := m.publishMessage(deviceTopic(fmt.Sprintf("camera-info/%d", info.Camera)), true, payload); err != nil {
+		log.Printf("Failed to publish camera info: %v", err)
+		return
+	}
+	metrics.Inc("telemetry.camera_info_published")
+}
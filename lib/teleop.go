@@ -0,0 +1,259 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"math"
+	"sync"
+	"time"
+)
+
+// Teleoperation: an operator drives the robot with drive on the control
+// channel, or on <thingName>/drive over MQTT, e.g.
+// {"linear": 0.5, "angular": -0.2}: forward speed in m/s and turn rate in
+// rad/s, counterclockwise positive, as ROS has them. Each command is checked
+// against teleopMaxLinear and teleopMaxAngular and published as a
+// geometry_msgs/Twist on teleopTopic, the robot's cmd_vel, from the
+// backend's ROS node (see ros_publisher.go).
+//
+// At most teleopMaxRate commands a second are published: one coming sooner
+// after the last waits its turn, replacing any already waiting, so the
+// robot follows the latest command, a stop included, without the bus
+// carrying every joystick sample. With no command for teleopTimeout, the
+// robot is sent a stop, so a peer that drops mid-drive leaves it standing.
+// The e-stop (see estop.go) sends its stop at once, whatever the rate, and
+// commands are refused until it is released.
+
+// ControlDrive drives the robot
+const ControlDrive = "drive"
+
+// DriveCommand is the payload of drive
+type DriveCommand struct {
+	Linear  float64 `json:"linear"`  // m/s, forward positive
+	Angular float64 `json:"angular"` // rad/s, counterclockwise positive
+}
+
+var (
+	errTeleopDisabled = errors.New("teleoperation is disabled")
+	errEStopEngaged   = errors.New("the e-stop is engaged")
+)
+
+// validate checks the command is within the robot's limits
+func (c DriveCommand) validate() error {
+	switch {
+	case math.IsNaN(c.Linear) || math.Abs(c.Linear) > teleopMaxLinear:
+		return fmt.Errorf("linear speed %g m/s beyond ±%g", c.Linear, teleopMaxLinear)
+	case math.IsNaN(c.Angular) || math.Abs(c.Angular) > teleopMaxAngular:
+		return fmt.Errorf("angular speed %g rad/s beyond ±%g", c.Angular, teleopMaxAngular)
+	}
+	return nil
+}
+
+func (c DriveCommand) twist() rosTwist {
+	return rosTwist{Linear: rosVector3{X: c.Linear}, Angular: rosVector3{Z: c.Angular}}
+}
+
+// teleopBridge publishes drive commands to teleopTopic
+type teleopBridge struct {
+	publication *rosPublication // nil until advertised
+	last        time.Time       // the last command was published
+	moving      bool            // the last command published was not a stop
+	pending     *DriveCommand   // waiting for its turn, see flush
+	flush       *time.Timer     // publishes pending
+	deadman     *time.Timer     // stops the robot after teleopTimeout
+	commands    uint64          // received, telling the deadman of the last
+	halted      bool            // by the e-stop, refusing commands
+	mu          sync.Mutex
+}
+
+// driveControl drives the robot from the control channel
+func driveControl(manager *WebRTCManager) ControlHandler {
+	return ControlHandlerFunc(func(peerID string, payload json.RawMessage) error {
+		var command DriveCommand
+		if err := json.Unmarshal(payload, &command); err != nil {
+			return fmt.Errorf("invalid drive: %v", err)
+		}
+		return manager.Drive(command)
+	})
+}
+
+// errMQTTControlDisabled refuses control over MQTT, see mqttControlEnabled
+var errMQTTControlDisabled = errors.New("control over MQTT is disabled")
+
+// handleDrive drives the robot from <thingName>/drive, with
+// mqttControlEnabled
+func (m *MQTTClient) handleDrive(topic string, payload []byte) {
+	if !mqttControlEnabled {
+		metrics.Inc("teleop.mqtt_refused")
+		log.Printf("Drive on %s refused: %v", topic, errMQTTControlDisabled)
+		return
+	}
+	var command DriveCommand
+	if err := json.Unmarshal(payload, &command); err != nil {
+		log.Printf("Invalid drive on %s: %v", topic, err)
+		return
+	}
+	if err := m.webrtcManager.Drive(command); err != nil {
+		log.Printf("Failed to drive: %v", err)
+	}
+}
+
+// Drive publishes command to the robot's cmd_vel, as soon as teleopMaxRate
+// allows
+func (w *WebRTCManager) Drive(command DriveCommand) error {
+	if teleopTopic == "" {
+		return errTeleopDisabled
+	}
+	if err := command.validate(); err != nil {
+		metrics.Inc("teleop.invalid")
+		return err
+	}
+	return w.teleop.drive(command)
+}
+
+// advertiseTeleop advertises teleopTopic ahead of the first command, so
+// the robot's subscribers are connected by then
+func (w *WebRTCManager) advertiseTeleop() error {
+	if teleopTopic == "" {
+		return nil
+	}
+	return w.teleop.advertise()
+}
+
+// advertise advertises teleopTopic if it is not yet. The master is called
+// without b.mu, so a slow one holds up neither halt nor the commands
+// already advertised for.
+func (b *teleopBridge) advertise() error {
+	b.mu.Lock()
+	advertised := b.publication != nil
+	b.mu.Unlock()
+	if advertised {
+		return nil
+	}
+	node, err := startROSNode()
+	if err != nil {
+		return err
+	}
+	publication, err := node.advertise(teleopTopic, rosTwistType, false)
+	if err != nil {
+		return err
+	}
+	b.mu.Lock()
+	b.publication = publication
+	b.mu.Unlock()
+	return nil
+}
+
+func (b *teleopBridge) drive(command DriveCommand) error {
+	b.mu.Lock()
+	halted := b.halted
+	b.mu.Unlock()
+	if halted {
+		return errEStopEngaged
+	}
+	if err := b.advertise(); err != nil {
+		return err
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	// The e-stop may have engaged while advertising
+	if b.halted {
+		return errEStopEngaged
+	}
+	metrics.Inc("teleop.commands")
+	b.commands++
+	if b.deadman != nil {
+		b.deadman.Stop()
+	}
+	if teleopTimeout > 0 {
+		commands := b.commands
+		b.deadman = time.AfterFunc(teleopTimeout, func() { b.timeout(commands) })
+	}
+
+	wait := time.Until(b.last.Add(time.Second / teleopMaxRate))
+	if wait <= 0 {
+		b.publish(command)
+		return nil
+	}
+	if b.pending != nil {
+		metrics.Inc("teleop.coalesced")
+	}
+	b.pending = &command
+	if b.flush == nil {
+		b.flush = time.AfterFunc(wait, b.publishPending)
+	}
+	return nil
+}
+
+// publish sends command to the robot, with b.mu held
+func (b *teleopBridge) publish(command DriveCommand) {
+	b.publication.publish(command.twist().encode())
+	b.last = time.Now()
+	b.moving = command != DriveCommand{}
+}
+
+// halt stops the robot at once, dropping any command waiting its turn, and
+// refuses commands until resumed
+func (b *teleopBridge) halt() error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.halted = true
+	b.pending = nil
+	if b.flush != nil {
+		b.flush.Stop()
+		b.flush = nil
+	}
+	if b.deadman != nil {
+		b.deadman.Stop()
+		b.deadman = nil
+	}
+	if b.publication == nil {
+		// Not advertised, so the robot was sent nothing to stop, and no
+		// subscriber is connected to be sent a stop
+		return nil
+	}
+	b.publish(DriveCommand{})
+	return nil
+}
+
+// resume accepts commands again after halt
+func (b *teleopBridge) resume() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.halted = false
+}
+
+// publishPending publishes the command that waited for its turn
+func (b *teleopBridge) publishPending() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.flush = nil
+	if b.pending != nil {
+		b.publish(*b.pending)
+		b.pending = nil
+	}
+}
+
+// timeout stops the robot teleopTimeout after the last command, unless
+// another came after the commands-th
+func (b *teleopBridge) timeout(commands uint64) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.commands != commands {
+		return
+	}
+	b.deadman = nil
+	b.pending = nil
+	if !b.moving {
+		return
+	}
+	log.Printf("No drive command for %v, stopping the robot", teleopTimeout)
+	metrics.Inc("teleop.timeouts")
+	b.publish(DriveCommand{})
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"os/exec"
+	"strings"
+	"sync"
+)
+
+// Test pattern: camera 0 is built in, unless cameraDirectories has an entry
+// for it. It streams SMPTE colour bars with the time and a frame counter
+// drawn over them, generated by captureCommand's lavfi input and encoded like
+// a captured camera (see camera_capture.go), so a field technician can check
+// that peers connect and video flows with no camera attached. An ffmpeg
+// built without drawtext streams its moving testsrc pattern instead, which
+// has a counter of its own. The same pattern can be put on any camera with
+// "capture:testpattern".
+
+// testPatternCamera is the camera number of the built-in test pattern
+const testPatternCamera = 0
+
+// testPatternDevice is the capture device generating the test pattern
+const testPatternDevice = "testpattern"
+
+// ffmpegFilters lists captureCommand's filters, once
+var ffmpegFilters struct {
+	once    sync.Once
+	filters map[string]bool
+}
+
+// cameraAddress returns cameraNumber's entry in cameraDirectories, or for
+// testPatternCamera without one the test pattern's. ok is false for
+// cameras that do not exist.
+func cameraAddress(cameraNumber int) (address string, ok bool) {
+	if address, ok := cameraDirectories[cameraNumber]; ok {
+		return address, true
+	}
+	if cameraNumber == testPatternCamera {
+		return "capture:" + testPatternDevice, true
+	}
+	return "", false
+}
+
+// testPatternInputArgs returns the ffmpeg arguments generating the test
+// pattern at config's resolution and frame rate
+func testPatternInputArgs(config captureConfig) []string {
+	size := fmt.Sprintf("size=%dx%d:rate=%d", config.width, config.height, config.fps)
+	graph := "testsrc=" + size
+	if ffmpegHasFilter("drawtext") {
+		graph = "smptehdbars=" + size + ",drawtext=text='%{localtime\\:%X} frame %{n}'" +
+			":fontsize=h/12:fontcolor=white:box=1:boxcolor=black@0.6:boxborderw=8" +
+			":x=(w-text_w)/2:y=h-text_h-h/10"
+	}
+	return []string{"-re", "-f", "lavfi", "-i", graph}
+}
+
+// ffmpegHasFilter reports whether captureCommand has the filter name,
+// assuming it does if the list cannot be had
+func ffmpegHasFilter(name string) bool {
+	ffmpegFilters.once.Do(func() {
+		ffmpegFilters.filters = probeFFmpegFilters(captureCommand)
+	})
+	return ffmpegFilters.filters == nil || ffmpegFilters.filters[name]
+}
+
+// probeFFmpegFilters returns the filters command lists, nil if it cannot be
+// run
+func probeFFmpegFilters(command string) map[string]bool {
+	output, err := exec.Command(command, "-hide_banner", "-filters").Output()
+	if err != nil {
+		log.Printf("Failed to list %s filters: %v", command, err)
+		return nil
+	}
+	filters := make(map[string]bool)
+	for _, line := range strings.Split(string(output), "\n") {
+		// " TSC drawtext          V->V       Draw text on top of video frames"
+		fields := strings.Fields(line)
+		if len(fields) >= 3 && strings.Contains(fields[2], "->") {
+			filters[fields[1]] = true
+		}
+	}
+	return filters
+}
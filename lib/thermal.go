@@ -0,0 +1,266 @@
+package main
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"log"
+	"math"
+	"net/url"
+	"strconv"
+	"sync"
+)
+
+// Thermal cameras: a ROS camera (see ros_source.go) whose topic publishes
+// 16-bit images, mono16 or 16UC1 as FLIR thermal cameras do, is streamed in
+// false color with the colormap option: each image's counts are taken as
+// temperatures, normalized over a range and colored, inferno from black
+// through purple and orange to yellow, or gray from black to white, into
+// bgr24 before ffmpeg reads it.
+//
+//	"ros:/flir_id8/image_resized?colormap=inferno&min=20&max=40"
+//
+// min and max are the range in °C, colder being the first color and hotter
+// the last; without them each image is normalized over its own coldest and
+// hottest pixels. Counts are taken as radiometric, scale kelvin each,
+// thermalScale (0.01 K, as FLIR's high resolution TLinear mode) unless the
+// entry's scale says otherwise. set-thermal-range, on MQTT or the control
+// channel, changes the range at once, without restarting the stream:
+//
+//	{"camera": 1, "min": 15, "max": 60}
+//
+// and {"camera": 1} goes back to normalizing each image. The range lasts
+// until the backend restarts, over camera switches.
+
+// ControlSetThermalRange changes the range of a thermal camera's colors
+const ControlSetThermalRange = "set-thermal-range"
+
+// thermalScale is the kelvin of a count of a thermal camera's images
+const thermalScale = 0.01
+
+// absoluteZero is 0 K in °C
+const absoluteZero = -273.15
+
+// ThermalRange is the payload of set-thermal-range. Camera defaults to the
+// first track's; without Min and Max, each image is normalized over its own.
+type ThermalRange struct {
+	Camera int      `json:"camera,omitempty"`
+	Min    *float64 `json:"min,omitempty"`
+	Max    *float64 `json:"max,omitempty"`
+}
+
+// thermalOptions is how a ROS camera's 16-bit images are colored
+type thermalOptions struct {
+	colormap string // a name in thermalColormaps, "" to stream images as they are
+	min, max string // the range in °C, "" to normalize each image
+	scale    string // kelvin per count, "" for thermalScale
+}
+
+// thermalColormaps are the colormaps by name, blue, green and red for each
+// of 256 levels, coldest first
+var thermalColormaps = map[string]*[256][3]byte{
+	"inferno": polynomialColormap([7][3]float64{
+		{0.0002189403691192265, 0.001651004631001012, -0.01948089843709184},
+		{0.1065134194856116, 0.5639564367884091, 3.932712388889277},
+		{11.60249308247187, -3.972853965665698, -15.9423941062914},
+		{-41.70399613139459, 17.43639888205313, 44.35414519872813},
+		{77.162935699427, -33.40235894210092, -81.80730925738993},
+		{-71.31942824499214, 32.62606426397723, 73.20951985803202},
+		{25.13112622477341, -12.24266895238567, -23.07032500287172},
+	}),
+	"gray": polynomialColormap([7][3]float64{{0, 0, 0}, {1, 1, 1}}),
+}
+
+// thermalRanges are the ranges set-thermal-range set, by topic
+var thermalRanges struct {
+	byTopic map[string]ThermalRange
+	mu      sync.Mutex
+}
+
+// polynomialColormap returns the colormap whose red, green and blue at t,
+// from 0 to 1, are polynomials in t with coefficients, lowest order first
+func polynomialColormap(coefficients [7][3]float64) *[256][3]byte {
+	var colormap [256][3]byte
+	for level := range colormap {
+		t := float64(level) / 255
+		for channel := 0; channel < 3; channel++ {
+			v := 0.0
+			for order := len(coefficients) - 1; order >= 0; order-- {
+				v = v*t + coefficients[order][channel]
+			}
+			// bgr24 has the channels the other way around
+			colormap[level][2-channel] = byte(math.Round(255 * math.Max(0, math.Min(1, v))))
+		}
+	}
+	return &colormap
+}
+
+// thermalOptionsFrom returns the thermal options of a camera entry
+func thermalOptionsFrom(values url.Values) thermalOptions {
+	return thermalOptions{colormap: values.Get("colormap"), min: values.Get("min"), max: values.Get("max"), scale: values.Get("scale")}
+}
+
+// colorizer returns the colorizer of topic's images the options set, nil
+// for none
+func (o thermalOptions) colorizer(topic string) (*thermalColorizer, error) {
+	if o.colormap == "" {
+		return nil, nil
+	}
+	colormap, ok := thermalColormaps[o.colormap]
+	if !ok {
+		return nil, fmt.Errorf("unknown colormap %q", o.colormap)
+	}
+	c := &thermalColorizer{topic: topic, colormap: colormap, scale: thermalScale}
+	if o.scale != "" {
+		scale, err := strconv.ParseFloat(o.scale, 64)
+		if err != nil || !(scale > 0) {
+			return nil, fmt.Errorf("invalid scale %q", o.scale)
+		}
+		c.scale = scale
+	}
+	if o.min != "" || o.max != "" {
+		low, errLow := strconv.ParseFloat(o.min, 64)
+		high, errHigh := strconv.ParseFloat(o.max, 64)
+		if errLow != nil || errHigh != nil {
+			return nil, fmt.Errorf("invalid range %q to %q, min and max need each other", o.min, o.max)
+		}
+		c.entry = ThermalRange{Min: &low, Max: &high}
+		if err := c.entry.validate(); err != nil {
+			return nil, err
+		}
+	}
+	return c, nil
+}
+
+// validate checks the range is either automatic or from colder to hotter
+func (r ThermalRange) validate() error {
+	switch {
+	case r.Min == nil && r.Max == nil:
+		return nil
+	case r.Min == nil || r.Max == nil:
+		return fmt.Errorf("min and max need each other")
+	case !(*r.Min < *r.Max) || *r.Min < absoluteZero || math.IsInf(*r.Max, 0):
+		return fmt.Errorf("invalid range %g to %g °C", *r.Min, *r.Max)
+	}
+	return nil
+}
+
+// thermalColorizer colors a topic's 16-bit images
+type thermalColorizer struct {
+	topic    string
+	colormap *[256][3]byte
+	scale    float64
+	entry    ThermalRange // the entry's range
+	buffer   []byte       // the last image colored, reused for the next
+}
+
+// colorize colors picture, 16-bit gray of format, returning it in bgr24.
+// Other images are returned as they are. The picture returned is valid
+// until the next is colored.
+func (c *thermalColorizer) colorize(format rosImageFormat, picture []byte) (rosImageFormat, []byte) {
+	var order binary.ByteOrder
+	switch {
+	case c == nil:
+		return format, picture
+	case format.pixelFormat == "gray16le":
+		order = binary.LittleEndian
+	case format.pixelFormat == "gray16be":
+		order = binary.BigEndian
+	default:
+		return format, picture
+	}
+	pixels := len(picture) / 2
+
+	// The range in counts
+	var low, high float64
+	if r := c.currentRange(); r.Min != nil {
+		low, high = (*r.Min-absoluteZero)/c.scale, (*r.Max-absoluteZero)/c.scale
+	} else {
+		coldest, hottest := uint16(math.MaxUint16), uint16(0)
+		for i := 0; i < pixels; i++ {
+			v := order.Uint16(picture[2*i:])
+			coldest, hottest = min(coldest, v), max(hottest, v)
+		}
+		low, high = float64(coldest), float64(hottest)
+	}
+	levels := 255 / math.Max(high-low, 1)
+
+	if cap(c.buffer) < 3*pixels {
+		c.buffer = make([]byte, 3*pixels)
+	}
+	out := c.buffer[:3*pixels]
+	for i := 0; i < pixels; i++ {
+		level := (float64(order.Uint16(picture[2*i:])) - low) * levels
+		color := &c.colormap[int(math.Max(0, math.Min(255, level)))]
+		copy(out[3*i:3*i+3], color[:])
+	}
+	format.pixelFormat, format.bytesPerPixel = "bgr24", 3
+	return format, out
+}
+
+// currentRange returns the range set-thermal-range set for the topic, or
+// else the entry's
+func (c *thermalColorizer) currentRange() ThermalRange {
+	thermalRanges.mu.Lock()
+	defer thermalRanges.mu.Unlock()
+	if r, ok := thermalRanges.byTopic[c.topic]; ok {
+		return r
+	}
+	return c.entry
+}
+
+// SetThermalRange colors a thermal camera's images over r from now on;
+// camera 0 is the first track's
+func (w *WebRTCManager) SetThermalRange(r ThermalRange) error {
+	if err := r.validate(); err != nil {
+		return err
+	}
+	if r.Camera == 0 {
+		r.Camera = int(w.outputs[0].camera.Load())
+	}
+	address, _ := cameraAddress(r.Camera)
+	config, ok := rosImageTopic(address)
+	if !ok || config.thermal.colormap == "" {
+		return fmt.Errorf("camera %d is not a thermal camera", r.Camera)
+	}
+
+	thermalRanges.mu.Lock()
+	if thermalRanges.byTopic == nil {
+		thermalRanges.byTopic = make(map[string]ThermalRange)
+	}
+	thermalRanges.byTopic[config.device] = r
+	thermalRanges.mu.Unlock()
+	if r.Min != nil {
+		log.Printf("Camera %d thermal range: %g to %g °C", r.Camera, *r.Min, *r.Max)
+	} else {
+		log.Printf("Camera %d thermal range: each image's own", r.Camera)
+	}
+	metrics.Inc("thermal.range_changes")
+	return nil
+}
+
+// thermalRangeControl changes a thermal camera's range from the control
+// channel, the payload being ThermalRange
+func thermalRangeControl(manager *WebRTCManager) ControlHandler {
+	return ControlHandlerFunc(func(peerID string, payload json.RawMessage) error {
+		var r ThermalRange
+		if err := json.Unmarshal(payload, &r); err != nil {
+			return fmt.Errorf("invalid %s payload: %v", ControlSetThermalRange, err)
+		}
+		return manager.SetThermalRange(r)
+	})
+}
+
+// handleThermalRange changes a thermal camera's range from
+// <thingName>/set-thermal-range
+func (m *MQTTClient) handleThermalRange(topic string, payload []byte) {
+	log.Printf("%s request received on topic %s: %s", ControlSetThermalRange, topic, string(payload))
+	var r ThermalRange
+	if err := json.Unmarshal(payload, &r); err != nil {
+		log.Printf("Invalid %s payload: %v", ControlSetThermalRange, err)
+		return
+	}
+	if err := m.webrtcManager.SetThermalRange(r); err != nil {
+		log.Printf("Failed to %s: %v", ControlSetThermalRange, err)
+	}
+}
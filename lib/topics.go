@@ -0,0 +1,87 @@
+package main
+
+import (
+	"regexp"
+	"strings"
+)
+
+// Topic template placeholders. Templates are configured in constants.go and
+// every topic the backend publishes or subscribes to is built from them.
+// {thing} expands to the device identity's topic prefix, by default thingName.
+const (
+	placeholderThing   = "{thing}"
+	placeholderPeer    = "{peer}"
+	placeholderChannel = "{channel}"
+)
+
+// peerTopicPattern matches topics built from peerTopicTemplate, capturing
+// the peer ID and channel
+var peerTopicPattern = compileTopicPattern(peerTopicTemplate)
+
+func expandTopic(template, peerID, channel string) string {
+	return strings.NewReplacer(
+		placeholderThing, identity.topicThing(),
+		placeholderPeer, peerID,
+		placeholderChannel, channel,
+	).Replace(template)
+}
+
+// peerTopic is the topic for one peer's channel, e.g. its "offer" or "answer"
+func peerTopic(peerID, channel string) string {
+	return expandTopic(peerTopicTemplate, peerID, channel)
+}
+
+// peerTopicFilter subscribes to channel for every peer. {peer} must occupy
+// a whole topic level for the "+" wildcard to work.
+func peerTopicFilter(channel string) string {
+	return peerTopic("+", channel)
+}
+
+// deviceTopic is a per-robot command topic, e.g. "camera"
+func deviceTopic(channel string) string {
+	return expandTopic(deviceTopicTemplate, "", channel)
+}
+
+// broadcastTopic is a topic for every peer of this robot, e.g. "disconnect-tractor"
+func broadcastTopic(channel string) string {
+	return expandTopic(broadcastTopicTemplate, "", channel)
+}
+
+func compileTopicPattern(template string) *regexp.Regexp {
+	pattern := regexp.QuoteMeta(template)
+	pattern = strings.ReplaceAll(pattern, regexp.QuoteMeta(placeholderThing), regexp.QuoteMeta(identity.topicThing()))
+	pattern = strings.Replace(pattern, regexp.QuoteMeta(placeholderPeer), "(?P<peer>[^/]+)", 1)
+	pattern = strings.Replace(pattern, regexp.QuoteMeta(placeholderChannel), "(?P<channel>.+)", 1)
+	return regexp.MustCompile("^" + pattern + "$")
+}
+
+// parsePeerTopic splits a topic built from peerTopicTemplate into its peer
+// ID and channel
+func parsePeerTopic(topic string) (peerID string, channel string, ok bool) {
+	match := peerTopicPattern.FindStringSubmatch(topic)
+	if match == nil {
+		return "", "", false
+	}
+	return match[peerTopicPattern.SubexpIndex("peer")], match[peerTopicPattern.SubexpIndex("channel")], true
+}
+
+// peerIDFromTopic extracts the peer ID from a per-peer topic
+func peerIDFromTopic(topic string) (string, bool) {
+	peerID, _, ok := parsePeerTopic(topic)
+	return peerID, ok
+}
+
+// topicKind reduces a published topic to its channel (answer,
+// candidate/rmcs, ...) so metrics are not keyed by peer ID
+func topicKind(topic string) string {
+	if _, channel, ok := parsePeerTopic(topic); ok {
+		return channel
+	}
+	for _, template := range []string{broadcastTopicTemplate, deviceTopicTemplate} {
+		prefix, _, found := strings.Cut(expandTopic(template, "", placeholderChannel), placeholderChannel)
+		if found && strings.HasPrefix(topic, prefix) {
+			return strings.TrimPrefix(topic, prefix)
+		}
+	}
+	return topic
+}
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"slices"
+	"strings"
+
+	"github.com/pion/sdp/v3"
+	"github.com/pion/webrtc/v4"
+)
+
+// Transceivers: each output is sent on a transceiver of its own, created
+// with an explicit direction and pinned to the mid of the offer's video
+// section it answers, rather than left to pion's matching by kind and
+// direction. The n-th output always lands in the n-th video section the peer
+// receives in, whatever the other sections' directions, so answers are
+// deterministic and a re-offer keeps every camera on its m-line. Stricter
+// clients also get sendonly where we never receive, instead of sendrecv:
+// pion turns a sendonly transceiver sendrecv for a sendrecv offer, so those
+// sections are marked sendonly in the answer sent, see answerDirections.
+
+// videoSection is one video m-line of an offer
+type videoSection struct {
+	mid string
+	// direction is the offer's, from the peer's side
+	direction webrtc.RTPTransceiverDirection
+}
+
+// receives reports whether the peer receives media in the section
+func (s videoSection) receives() bool {
+	return s.direction == webrtc.RTPTransceiverDirectionRecvonly || s.direction == webrtc.RTPTransceiverDirectionSendrecv
+}
+
+// offerVideoSections returns the video sections of offerSDP in order
+func offerVideoSections(offerSDP string) []videoSection {
+	var offer sdp.SessionDescription
+	if err := offer.UnmarshalString(offerSDP); err != nil {
+		return nil // pion reports the offer's error
+	}
+
+	var sections []videoSection
+	for _, media := range offer.MediaDescriptions {
+		if media.MediaName.Media != "video" {
+			continue
+		}
+		mid, _ := media.Attribute("mid")
+		direction := webrtc.RTPTransceiverDirectionSendrecv
+		for _, candidate := range []webrtc.RTPTransceiverDirection{
+			webrtc.RTPTransceiverDirectionSendonly,
+			webrtc.RTPTransceiverDirectionRecvonly,
+			webrtc.RTPTransceiverDirectionInactive,
+		} {
+			if _, ok := media.Attribute(candidate.String()); ok {
+				direction = candidate
+			}
+		}
+		sections = append(sections, videoSection{mid: mid, direction: direction})
+	}
+	return sections
+}
+
+// sendDirection is the direction of the transceiver answering section:
+// sendonly, unless the peer also sends in it and its media is received, see
+// incoming_media.go
+func sendDirection(section videoSection, role string) webrtc.RTPTransceiverDirection {
+	if section.direction == webrtc.RTPTransceiverDirectionSendrecv && incomingMediaEnabled && role != RoleViewer {
+		return webrtc.RTPTransceiverDirectionSendrecv
+	}
+	return webrtc.RTPTransceiverDirectionSendonly
+}
+
+// addVideoTransceiver sends track on a new transceiver answering section
+func addVideoTransceiver(peerConnection *webrtc.PeerConnection, track webrtc.TrackLocal, section videoSection, role string) (*webrtc.RTPTransceiver, error) {
+	transceiver, err := peerConnection.AddTransceiverFromTrack(track, webrtc.RTPTransceiverInit{
+		Direction: sendDirection(section, role),
+	})
+	if err != nil {
+		return nil, err
+	}
+	// Without a mid pion matches the section by kind and direction
+	if section.mid != "" {
+		if err := transceiver.SetMid(section.mid); err != nil {
+			return nil, err
+		}
+	}
+	return transceiver, nil
+}
+
+// answerDirections marks the sections of an answer with the given mids
+// sendonly
+func answerDirections(answerSDP string, sendOnlyMids []string) string {
+	if len(sendOnlyMids) == 0 {
+		return answerSDP
+	}
+	lines := strings.SplitAfter(answerSDP, "\n")
+	for start := 0; start < len(lines); {
+		end := start + 1
+		for end < len(lines) && !strings.HasPrefix(lines[end], "m=") {
+			end++
+		}
+		// The session section has no mid and is never marked
+		mid := ""
+		for _, line := range lines[start:end] {
+			if value, ok := strings.CutPrefix(strings.TrimRight(line, "\r\n"), "a=mid:"); ok {
+				mid = value
+			}
+		}
+		if mid != "" && slices.Contains(sendOnlyMids, mid) {
+			for i := start; i < end; i++ {
+				if trimmed := strings.TrimRight(lines[i], "\r\n"); trimmed == "a=sendrecv" {
+					lines[i] = "a=sendonly" + lines[i][len(trimmed):]
+				}
+			}
+		}
+		start = end
+	}
+	return strings.Join(lines, "")
+}
@@ -0,0 +1,310 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"math"
+	"os/exec"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pion/sdp/v3"
+	"github.com/pion/webrtc/v4"
+	"github.com/pion/webrtc/v4/pkg/media"
+	"github.com/pion/webrtc/v4/pkg/media/ivfreader"
+)
+
+// Codec fallback: the frames are recorded as H.264 only, so peers that
+// cannot decode it (their offer has no H.264) get codecFallback instead,
+// re-encoded from every output's samples by an ffmpeg process. The
+// processes only run while such a peer is connected, and stop when the last
+// one leaves. Keyframe requests
+// rewind the H.264 stream to its last IDR, which ffmpeg turns into a
+// keyframe of its own. Under pressure the frame rate they encode is
+// lowered, see adaptive_fps.go. Each frame out is timed from its frame in,
+// found from its IVF timestamp, for the pipeline stats.
+
+// transcodeQueueSize samples (one second) can wait for a busy encoder
+// before the newest are dropped
+const transcodeQueueSize = 30
+
+// transcodeTimedFrames frames in are remembered to time the frames out,
+// more than the queue and the encoder can hold
+const transcodeTimedFrames = 128
+
+// transcoder re-encodes one output to a track of the fallback codec with
+// the output's IDs
+type transcoder struct {
+	track    *webrtc.TrackLocalStaticSample
+	duration time.Duration // of each frame
+	// inputFPS is the output's frame rate, the encoder's input's, which
+	// numbers the frames in by their timestamps
+	inputFPS int
+	fps      int // encoded, see adaptive_fps.go
+	// frames are the output's samples, consumed from the next IDR on while
+	// the encoder runs, as it cannot decode before one
+	frames          *FrameBroadcaster
+	consumer        *FrameConsumer
+	stop            chan struct{}
+	requestKeyframe func() // of the output, for a restarted encoder
+	stats           VideoSourceStats
+	mu              sync.Mutex
+}
+
+// transcoderRun is one run of the encoder: when each frame went in
+type transcoderRun struct {
+	inputFPS  int
+	written   uint64 // frames in
+	writtenAt [transcodeTimedFrames]time.Time
+	mu        sync.Mutex
+}
+
+func newTranscoder(trackID string, streamID string, duration time.Duration, frames *FrameBroadcaster) (*transcoder, error) {
+	track, err := webrtc.NewTrackLocalStaticSample(
+		webrtc.RTPCodecCapability{MimeType: codecFallback, ClockRate: 90000},
+		trackID,
+		streamID,
+	)
+	if err != nil {
+		return nil, err
+	}
+	inputFPS := max(1, int(math.Round(float64(time.Second)/float64(duration))))
+	return &transcoder{track: track, duration: duration, inputFPS: inputFPS, fps: frameRateSteps[0], frames: frames}, nil
+}
+
+// start runs the encoder if it is not running yet
+func (t *transcoder) start() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if t.stop != nil {
+		return
+	}
+	t.startEncoder()
+}
+
+// startEncoder runs the encoder, with t.mu held
+func (t *transcoder) startEncoder() {
+	cmd := exec.Command(transcoderCommand, transcoderArgs(t.inputFPS, t.fps)...)
+	if err := sandboxCommand(cmd); err != nil {
+		log.Printf("Failed to start transcoder: %v", err)
+		metrics.Inc("transcode.failures")
+		return
+	}
+	cmd.Stderr = log.Writer()
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		log.Printf("Failed to start transcoder: %v", err)
+		return
+	}
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		log.Printf("Failed to start transcoder: %v", err)
+		return
+	}
+	if err := cmd.Start(); err != nil {
+		log.Printf("Failed to start transcoder %s: %v", transcoderCommand, err)
+		metrics.Inc("transcode.failures")
+		return
+	}
+
+	t.stop = make(chan struct{})
+	run := &transcoderRun{inputFPS: t.inputFPS}
+	t.consumer = t.frames.Subscribe("transcoder", transcodeQueueSize, func(unit AccessUnit) {
+		t.writeInput(stdin, run, unit.Data)
+	})
+	go t.readOutput(stdout, run, t.stop)
+	go func() {
+		if err := cmd.Wait(); err != nil {
+			log.Printf("Transcoder for %s exited: %v", t.track.ID(), err)
+		}
+	}()
+	go func(stop chan struct{}) {
+		<-stop
+		stdin.Close()
+		cmd.Process.Kill()
+	}(t.stop)
+	log.Printf("Transcoding %s to %s at %d FPS", t.track.ID(), codecFallback, t.fps)
+}
+
+// setFrameRate has the encoder encode fps frames per second, restarting
+// it from the next keyframe if it is running
+func (t *transcoder) setFrameRate(fps int) {
+	t.mu.Lock()
+	if t.fps == fps {
+		t.mu.Unlock()
+		return
+	}
+	t.fps = fps
+	running := t.stop != nil
+	if running {
+		t.stopRun()
+		t.stats.Restarts++
+		t.startEncoder()
+	}
+	t.mu.Unlock()
+
+	if running && t.requestKeyframe != nil {
+		t.requestKeyframe()
+	}
+}
+
+// lag returns how far behind the stream the encoder is: the samples
+// waiting for it
+func (t *transcoder) lag() time.Duration {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.consumer == nil {
+		return 0
+	}
+	return time.Duration(t.consumer.Pending()) * t.duration
+}
+
+// Stats returns what the encoder went through, over every run
+func (t *transcoder) Stats() VideoSourceStats {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	stats := t.stats
+	if t.consumer != nil {
+		stats.Dropped += t.consumer.Dropped()
+	}
+	return stats
+}
+
+// stopEncoder stops the encoder if it is running
+func (t *transcoder) stopEncoder() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if t.stop != nil {
+		t.stopRun()
+	}
+}
+
+// stopRun stops the encoder's run, with t.mu held
+func (t *transcoder) stopRun() {
+	t.frames.Unsubscribe(t.consumer)
+	t.stats.Dropped += t.consumer.Dropped()
+	close(t.stop)
+	t.stop, t.consumer = nil, nil
+}
+
+// writeInput writes a sample to the encoder of run
+func (t *transcoder) writeInput(stdin io.Writer, run *transcoderRun, data []byte) {
+	if _, err := stdin.Write(data); err != nil {
+		return
+	}
+	run.mu.Lock()
+	run.writtenAt[run.written%transcodeTimedFrames] = time.Now()
+	run.written++
+	run.mu.Unlock()
+	t.mu.Lock()
+	t.stats.InputFrames++
+	t.mu.Unlock()
+}
+
+// encodeTime returns how long ago the frame in whose timestamp is
+// timestamp timebase units went in, false if it is not remembered
+func (r *transcoderRun) encodeTime(timestamp uint64, timebase float64) (time.Duration, bool) {
+	index := uint64(math.Round(float64(timestamp) * timebase * float64(r.inputFPS)))
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if index >= r.written || r.written-index > transcodeTimedFrames {
+		return 0, false
+	}
+	return time.Since(r.writtenAt[index%transcodeTimedFrames]), true
+}
+
+// readOutput writes the encoder's IVF frames to the track until it exits
+// or is stopped
+func (t *transcoder) readOutput(stdout io.Reader, run *transcoderRun, stop <-chan struct{}) {
+	reader, header, err := ivfreader.NewWith(stdout)
+	if err != nil {
+		log.Printf("Transcoder for %s produced no output: %v", t.track.ID(), err)
+		return
+	}
+	timebase := float64(header.TimebaseNumerator) / float64(max(header.TimebaseDenominator, 1))
+	for {
+		frame, frameHeader, err := reader.ParseNextFrame()
+		if err != nil {
+			return
+		}
+		took, timed := run.encodeTime(frameHeader.Timestamp, timebase)
+		select {
+		case <-stop:
+			// A restarted encoder writes to the track from now on
+			return
+		default:
+		}
+		if err := t.track.WriteSample(media.Sample{Data: frame, Duration: t.duration}); err != nil && err != io.ErrClosedPipe {
+			log.Printf("Write error: %v", err)
+		}
+		metrics.Inc("transcode.frames")
+		t.mu.Lock()
+		t.stats.Frames++
+		t.stats.Bytes += uint64(len(frame))
+		if timed {
+			t.stats.EncodeTime += took
+			t.stats.TimedFrames++
+		}
+		t.mu.Unlock()
+	}
+}
+
+// transcoderArgs makes ffmpeg read H.264 at inputFPS on stdin and write IVF
+// on stdout, buffering as little as it can, encoding fps frames per second
+func transcoderArgs(inputFPS int, fps int) []string {
+	args := []string{
+		"-hide_banner", "-loglevel", "error",
+		"-fflags", "nobuffer", "-probesize", "32", "-analyzeduration", "0",
+		"-f", "h264", "-framerate", strconv.Itoa(inputFPS), "-i", "pipe:0",
+	}
+	if fps < inputFPS {
+		// Dropped once decoded: each frame references the previous one,
+		// so frames missing from the input would corrupt the picture
+		args = append(args, "-vf", fmt.Sprintf("fps=%d", fps))
+	}
+	if codecFallback == webrtc.MimeTypeVP9 {
+		args = append(args, "-c:v", "libvpx-vp9", "-row-mt", "1")
+	} else {
+		args = append(args, "-c:v", "libvpx")
+	}
+	return append(args,
+		"-deadline", "realtime", "-cpu-used", "8", "-b:v", fmt.Sprint(frameRateBitrate(fps)),
+		"-force_key_frames", "source", "-f", "ivf", "pipe:1",
+	)
+}
+
+// needsFallback reports whether offerSDP's video has no H.264 but
+// codecFallback
+func needsFallback(offerSDP string) bool {
+	if codecFallback == "" {
+		return false
+	}
+	var offer sdp.SessionDescription
+	if err := offer.UnmarshalString(offerSDP); err != nil {
+		return false
+	}
+
+	fallbackName := strings.TrimPrefix(codecFallback, "video/")
+	hasH264, hasFallback := false, false
+	for _, media := range offer.MediaDescriptions {
+		if media.MediaName.Media != "video" {
+			continue
+		}
+		for _, attribute := range media.Attributes {
+			if attribute.Key != "rtpmap" {
+				continue
+			}
+			// e.g. "96 VP8/90000"
+			_, encoding, _ := strings.Cut(attribute.Value, " ")
+			name, _, _ := strings.Cut(encoding, "/")
+			hasH264 = hasH264 || strings.EqualFold(name, "H264")
+			hasFallback = hasFallback || strings.EqualFold(name, fallbackName)
+		}
+	}
+	return !hasH264 && hasFallback
+}
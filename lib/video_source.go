@@ -0,0 +1,212 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"sync"
+	"time"
+)
+
+// Video sources: a VideoStreamer writes the frames of one VideoSource at a
+// time to its track. Sources only produce frames, a directory of files (see
+// file_source.go) or anything else able to deliver H.264; the streamer is
+// the SampleSink they all feed, and does the rest the same way for each:
+// caching parameter sets and adding them to keyframes, SEI, encryption,
+// queueing and writing samples. Sources are interchangeable on a running
+// stream, and cameras registered with RegisterCameraSource are switched to
+// like any camera of files.
+
+// VideoFrame is one access unit from a source
+type VideoFrame struct {
+	// Data holds the frame's NAL units, each prefixed with its 4-byte
+	// big-endian length, as the frame files store them
+	Data     []byte
+	Duration time.Duration
+	Captured time.Time // when the frame was captured, or read
+}
+
+// SampleSink takes the frames of a VideoSource
+type SampleSink interface {
+	// WriteFrame hands over the next frame. It returns false once the
+	// stream stopped, and the source should stop too. The frame's data is
+	// the source's again once it returns: sinks copy what they keep.
+	WriteFrame(frame VideoFrame) bool
+	// ReportError tells of frames failing to be produced, once per run of
+	// failures
+	ReportError(err error)
+}
+
+// VideoSource produces H.264 frames for a SampleSink
+type VideoSource interface {
+	// Start produces frames into sink until Stop, without blocking
+	Start(sink SampleSink) error
+	// Stop stops producing frames, and returns once no more are written
+	Stop()
+	// ForceKeyframe has the source continue from a keyframe as soon as it
+	// can, for a decoder that lost packets. Requests are already coalesced.
+	ForceKeyframe()
+	Stats() VideoSourceStats
+}
+
+// VideoSourceStats counts what a source produced, and what its encoder
+// went through (see pipeline_stats.go)
+type VideoSourceStats struct {
+	Frames    uint64 // frames written to the sink
+	Errors    uint64 // frames that failed to be produced
+	Keyframes uint64 // keyframes forced
+	Bytes     uint64 // of the frames written
+	Restarts  uint64 // of the source's process or session, for any reason
+	// Frames into the source's encoder and those it dropped; 0 for sources
+	// that do not encode, or cannot tell
+	InputFrames uint64
+	Dropped     uint64
+	// EncodeTime is the total time TimedFrames frames took to encode, for
+	// sources that can time their encoder
+	EncodeTime  time.Duration
+	TimedFrames uint64
+	// Jitter is the total time PacedFrames frames went out after they were
+	// due, and MaxJitter the most one did, for sources that pace their
+	// frames (see frame_pacer.go)
+	Jitter      time.Duration
+	MaxJitter   time.Duration
+	PacedFrames uint64
+}
+
+// VideoSourceFactory creates a source of cameraNumber's frames, each time
+// the camera is switched to
+type VideoSourceFactory func(cameraNumber int) (VideoSource, error)
+
+// cameraSources holds the cameras streamed from registered sources instead
+// of files
+type cameraSources struct {
+	factories map[int]VideoSourceFactory
+	// settings changed at runtime for captured cameras, see
+	// capture_settings.go
+	settings map[int]CaptureSettings
+	mu       sync.Mutex
+}
+
+func (c *cameraSources) factory(cameraNumber int) (VideoSourceFactory, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	factory, ok := c.factories[cameraNumber]
+	return factory, ok
+}
+
+// RegisterCameraSource streams cameraNumber from the sources factory
+// creates rather than from its directory in cameraDirectories, switching
+// the tracks already showing it. Such a camera has no quality ladder
+// renditions: simulcast layers get a source of their own at the same
+// quality, or share the camera's with the source manager (see
+// source_manager.go), and adaptive bitrate leaves it as it is.
+func (w *WebRTCManager) RegisterCameraSource(cameraNumber int, factory VideoSourceFactory) error {
+	w.sources.mu.Lock()
+	if w.sources.factories == nil {
+		w.sources.factories = make(map[int]VideoSourceFactory)
+	}
+	w.sources.factories[cameraNumber] = factory
+	w.sources.mu.Unlock()
+	log.Printf("Camera %d streams from a registered source", cameraNumber)
+	if sourceManagerEnabled {
+		if err := w.sourceManager.replace(cameraNumber, factory); err != nil {
+			log.Printf("Failed to replace camera %d's running source: %v", cameraNumber, err)
+		}
+	}
+
+	w.switchMu.Lock()
+	defer w.switchMu.Unlock()
+	for _, output := range w.allOutputs() {
+		if int(output.camera.Load()) != cameraNumber {
+			continue
+		}
+		if err := w.loadCamera(output, cameraNumber); err != nil {
+			w.events.emitSourceError(SourceErrorEvent{TrackID: output.track.ID(), Camera: cameraNumber, Err: err})
+			return err
+		}
+	}
+	return nil
+}
+
+// cameraFactory returns the factory of cameraNumber's sources: the one
+// registered for it, or RTSP, GStreamer or capture sources for an rtsp://
+// URL, a "gst:<name>" pipeline, a "capture:<device>" camera or a
+// "compose:<main>,<inset>" composition (see compose_source.go) in
+// cameraDirectories, or camera 0's test pattern (see test_pattern.go). ok is
+// false for cameras streamed from files.
+func (w *WebRTCManager) cameraFactory(cameraNumber int) (VideoSourceFactory, bool) {
+	if factory, ok := w.sources.factory(cameraNumber); ok {
+		return factory, true
+	}
+	address, _ := cameraAddress(cameraNumber)
+	if isRTSPURL(address) {
+		return func(int) (VideoSource, error) {
+			return newRTSPSource(address)
+		}, true
+	}
+	if name, ok := gstreamerPipeline(address); ok {
+		return func(cameraNumber int) (VideoSource, error) {
+			return newGStreamerSource(name, cameraNumber)
+		}, true
+	}
+	if config, ok := captureDevice(address); ok {
+		return func(cameraNumber int) (VideoSource, error) {
+			config = w.sources.captureOverrides(cameraNumber, config)
+			return newCameraCapture(governed(config, int(w.governorLevel.Load())))
+		}, true
+	}
+	if config, ok := composeCameras(address); ok {
+		return func(int) (VideoSource, error) {
+			config := config
+			config.output = governed(config.output, int(w.governorLevel.Load()))
+			return w.newComposition(config)
+		}, true
+	}
+	return nil, false
+}
+
+// validCamera reports whether cameraNumber has a registered source or an
+// entry in cameraDirectories, or is the test pattern
+func (w *WebRTCManager) validCamera(cameraNumber int) bool {
+	if _, ok := w.sources.factory(cameraNumber); ok {
+		return true
+	}
+	_, ok := cameraAddress(cameraNumber)
+	return ok
+}
+
+// errInvalidCamera is the error for a camera validCamera does not know
+func errInvalidCamera(cameraNumber int) error {
+	return fmt.Errorf("invalid camera number: %d (not a configured camera)", cameraNumber)
+}
+
+// loadCamera switches output, and its simulcast layers, to cameraNumber
+func (w *WebRTCManager) loadCamera(output *videoOutput, cameraNumber int) error {
+	if factory, ok := w.cameraFactory(cameraNumber); ok {
+		source, err := w.cameraSource(cameraNumber, factory)
+		if err != nil {
+			return fmt.Errorf("failed to open camera %d: %v", cameraNumber, err)
+		}
+		w.showSource(output.streamer, source)
+		for _, layer := range output.layers {
+			layerSource, err := w.cameraSource(cameraNumber, factory)
+			if err != nil {
+				log.Printf("Failed to open camera %d for the %s simulcast layer: %v", cameraNumber, qualityLadder[layer.rung].Name, err)
+				continue
+			}
+			w.showSource(layer.streamer, layerSource)
+		}
+		output.setStreamedCamera(cameraNumber)
+		return nil
+	}
+
+	directory, ok := cameraDirectories[cameraNumber]
+	if !ok {
+		return errInvalidCamera(cameraNumber)
+	}
+	if err := output.streamer.LoadH264Files(w.rendition(directory)); err != nil {
+		return fmt.Errorf("failed to load camera %d files: %v", cameraNumber, err)
+	}
+	output.loadLayers(directory)
+	output.setStreamedCamera(cameraNumber)
+	return nil
+}
@@ -1,19 +1,14 @@
 package main
 
 import (
-	"encoding/binary"
-	"fmt"
+	"errors"
+	"hash/crc32"
 	"io"
 	"log"
-	"os"
-	"path/filepath"
-	"sort"
-	"strconv"
-	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
-	"github.com/pion/webrtc/v4"
 	"github.com/pion/webrtc/v4/pkg/media"
 )
 
@@ -24,296 +19,445 @@ const (
 	NAL_IDR = 5 // IDR frame
 )
 
+// VideoStreamer writes the frames of its VideoSource to one video track,
+// as the SampleSink every kind of source feeds, see video_source.go
 type VideoStreamer struct {
-	track       *webrtc.TrackLocalStaticSample
-	frameFiles  []string
+	track       sampleTrack
+	source      VideoSource
 	isStreaming bool
-	stopChan    chan bool
-	mu          sync.Mutex
-
-	// Cached NAL units like C++ implementation
-	sps     []byte // Type 7
-	pps     []byte // Type 8
-	lastIDR []byte // Type 5
+	// handoff is the latest source handed over to the streamer at its
+	// first keyframe, until it is, see handOverSource
+	handoff *handoffSink
+	// queue takes frames to writeLoop while streaming; writerDone closes
+	// when writeLoop exits, after stopWriter closes
+	queue      *FrameQueue
+	stopWriter chan struct{}
+	writerDone chan struct{}
+	// framesDropped counts the frames the queue's overflow policy dropped,
+	// over every run
+	framesDropped atomic.Uint64
+	clock         Clock
+	// gop holds the packets since the last keyframe, see gop_cache.go
+	gop gopCache
+	// still holds the last keyframe, for snapshots, see snapshot.go
+	still keyframeStill
+	// frames fans the samples out to consumers besides the track, see
+	// broadcaster.go
+	frames FrameBroadcaster
+	// Keyframe requests from RTCP, see RequestKeyframe. parameterSetsPending
+	// adds the parameter sets to the next IDR frame.
+	parameterSetsPending bool
+	lastKeyframeRequest  time.Time
+	// onFrame, if set, sees every frame from the source, still
+	// length-prefixed
+	onFrame func(data []byte)
+	// encryptor, if set, encrypts every sample written to the track, see
+	// e2ee.go
+	encryptor *FrameEncryptor
+	// onError, if set, hears of frames failing to stream, once per run of
+	// failures
+	onError func(err error)
+	mu      sync.Mutex
+	// captureTime is the capture time of the sample being written, in Unix
+	// nanoseconds, see capture_time.go
+	captureTime atomic.Int64
+	// Stamped into the frame info SEI, see frame_info.go: the SEI versions
+	// stamped, as a mask of version bits, the camera streamed and the
+	// sequence number of the last frame
+	seiVersions   atomic.Uint32
+	camera        atomic.Int32
+	frameSequence atomic.Uint32
+	// lastFrame is when the source last wrote a frame, in Unix nanoseconds,
+	// see stall_watchdog.go
+	lastFrame atomic.Int64
+
+	// Parameter sets of the frames streamed, for keyframe requests
+	sps []byte // Type 7
+	pps []byte // Type 8
 
 	// Timing management
 	fps              uint32
 	sampleDurationUs uint64 // microseconds per frame
-	sampleTimeUs     uint64 // current sample timestamp in microseconds
-	frameCounter     int
 }
 
-func NewVideoStreamer(track *webrtc.TrackLocalStaticSample) *VideoStreamer {
+func NewVideoStreamer(track sampleTrack) *VideoStreamer {
 	fps := uint32(30)
-	return &VideoStreamer{
+	streamer := &VideoStreamer{
 		track:            track,
-		stopChan:         make(chan bool),
+		clock:            mediaClock,
 		fps:              fps,
 		sampleDurationUs: 1000000 / uint64(fps), // 33333 microseconds per frame at 30 FPS
-		frameCounter:     -1,
 	}
+	streamer.seiVersions.Store(seiVersionMask(supportedSEIVersions()...))
+	streamer.frames.SubscribeKeyframes("snapshot", snapshotQueueSize, streamer.recordStill)
+	return streamer
 }
 
-func (v *VideoStreamer) LoadH264Files(directory string) error {
+// SetClock replaces the clock that paces the stream, before it starts
+func (v *VideoStreamer) SetClock(clock Clock) {
 	v.mu.Lock()
 	defer v.mu.Unlock()
-
-	files, err := filepath.Glob(filepath.Join(directory, "*.h264"))
-	if err != nil {
-		return err
+	v.clock = clock
+	if source, ok := v.source.(*fileSource); ok {
+		source.setClock(clock)
 	}
+}
 
-	if len(files) == 0 {
-		return fmt.Errorf("no H.264 files found in %s", directory)
-	}
+// SetFrameObserver registers fn to see every frame from the source, only
+// valid during the call
+func (v *VideoStreamer) SetFrameObserver(fn func(data []byte)) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	v.onFrame = fn
+}
 
-	// Sort files numerically like C++ implementation
-	sort.Slice(files, func(i, j int) bool {
-		numI := extractFileNumber(filepath.Base(files[i]))
-		numJ := extractFileNumber(filepath.Base(files[j]))
-		return numI < numJ
-	})
+// SetErrorObserver registers fn to hear of frames failing to stream
+func (v *VideoStreamer) SetErrorObserver(fn func(err error)) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	v.onError = fn
+}
 
-	v.frameFiles = files
-	log.Printf("Loaded %d H.264 files from %s", len(files), directory)
+// Frames returns the broadcaster of the samples the track is given, for
+// consumers such as recorders
+func (v *VideoStreamer) Frames() *FrameBroadcaster {
+	return &v.frames
+}
 
-	// Parse first file to get initial NAL units
-	if len(files) > 0 {
-		v.parseInitialNALUnits(files[0])
-	}
+// SetEncryptor has every sample encrypted with encryptor before it is
+// written to the track; observers and Frames consumers still see it in the
+// clear
+func (v *VideoStreamer) SetEncryptor(encryptor *FrameEncryptor) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	v.encryptor = encryptor
+}
 
-	// Reset frame counter to start from beginning with new files
-	v.frameCounter = -1
+// CaptureTime returns the capture time of the sample being written to the
+// track, for writers tagging its packets
+func (v *VideoStreamer) CaptureTime() time.Time {
+	return time.Unix(0, v.captureTime.Load())
+}
 
-	return nil
+// Source returns the source of the track's frames, nil if none is set
+func (v *VideoStreamer) Source() VideoSource {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	return v.source
 }
 
-func extractFileNumber(filename string) int {
-	// Extract number from "sample-123.h264"
-	parts := strings.Split(filename, "-")
-	if len(parts) < 2 {
-		return 0
+// SetSource replaces the source of the track's frames; a running stream
+// carries on from the new source
+func (v *VideoStreamer) SetSource(source VideoSource) {
+	v.mu.Lock()
+	previous := v.source
+	v.source = source
+	v.handoff = nil
+	streaming := v.isStreaming
+	v.mu.Unlock()
+
+	if previous == source {
+		return
+	}
+	v.gop.reset()
+	if !streaming {
+		return
+	}
+	if previous != nil {
+		previous.Stop()
 	}
-	numStr := strings.TrimSuffix(parts[1], ".h264")
-	num, _ := strconv.Atoi(numStr)
-	return num
+	v.startSource(source)
 }
 
-func (v *VideoStreamer) parseInitialNALUnits(filepath string) error {
-	data, err := os.ReadFile(filepath)
-	if err != nil {
-		return err
-	}
+// setHandoff makes handoff the source handed over next, superseding any
+// other still waiting for its keyframe
+func (v *VideoStreamer) setHandoff(handoff *handoffSink) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	v.handoff = handoff
+}
 
-	// Parse NAL units with 4-byte length prefix
-	i := 0
-	for i < len(data) {
-		if i+4 > len(data) {
-			break
-		}
+// handOver makes handoff's source, already started on it, the streamer's,
+// stopping the previous one. Returns false if the stream stopped or another
+// source was switched to meanwhile.
+func (v *VideoStreamer) handOver(handoff *handoffSink) bool {
+	v.mu.Lock()
+	if !v.isStreaming || v.handoff != handoff {
+		v.mu.Unlock()
+		return false
+	}
+	previous := v.source
+	source := handoff.source
+	v.source, v.handoff = source, nil
+	v.mu.Unlock()
 
-		// Read 4-byte length (big-endian)
-		length := binary.BigEndian.Uint32(data[i : i+4])
-		naluStartIndex := i + 4
-		naluEndIndex := naluStartIndex + int(length)
+	if previous != nil && previous != source {
+		previous.Stop()
+	}
+	return true
+}
 
-		if naluEndIndex > len(data) {
-			break
-		}
+// streaming reports whether the stream is running
+func (v *VideoStreamer) streaming() bool {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	return v.isStreaming
+}
 
-		// Get NAL unit type from header
-		if naluStartIndex < len(data) {
-			nalType := data[naluStartIndex] & 0x1F
-
-			// Store ONLY the NAL unit data (without length prefix)
-			nalUnitData := data[naluStartIndex:naluEndIndex]
-
-			switch nalType {
-			case NAL_SPS:
-				v.sps = make([]byte, len(nalUnitData))
-				copy(v.sps, nalUnitData)
-				log.Printf("Cached SPS NAL unit (%d bytes)", len(v.sps))
-			case NAL_PPS:
-				v.pps = make([]byte, len(nalUnitData))
-				copy(v.pps, nalUnitData)
-				log.Printf("Cached PPS NAL unit (%d bytes)", len(v.pps))
-			case NAL_IDR:
-				v.lastIDR = make([]byte, len(nalUnitData))
-				copy(v.lastIDR, nalUnitData)
-				log.Printf("Cached IDR NAL unit (%d bytes)", len(v.lastIDR))
-			}
-		}
+// startSource starts source writing to the streamer
+func (v *VideoStreamer) startSource(source VideoSource) {
+	if err := source.Start(v); err != nil {
+		log.Printf("ERROR: Failed to start video source: %v", err)
+		v.ReportError(err)
+	}
+}
 
-		i = naluEndIndex
+// LoadH264Files streams the frame files of directory from the next frame
+// on, replacing any other source
+func (v *VideoStreamer) LoadH264Files(directory string) error {
+	files, err := findH264Files(directory)
+	if err != nil {
+		return err
 	}
 
+	v.files().useFiles(files)
+	log.Printf("Loaded %d H.264 files from %s", len(files), directory)
 	return nil
 }
 
-func (v *VideoStreamer) getInitialNALUnits() []byte {
-	// Return SPS + PPS + IDR in Annex B format for WebRTC
-	var result []byte
-	startCode := []byte{0x00, 0x00, 0x00, 0x01}
-
-	if v.sps != nil {
-		result = append(result, startCode...)
-		result = append(result, v.sps...)
-	}
-	if v.pps != nil {
-		result = append(result, startCode...)
-		result = append(result, v.pps...)
-	}
-	if v.lastIDR != nil {
-		result = append(result, startCode...)
-		result = append(result, v.lastIDR...)
+// files returns the streamer's file source, replacing any other source with
+// one without files
+func (v *VideoStreamer) files() *fileSource {
+	v.mu.Lock()
+	if source, ok := v.source.(*fileSource); ok {
+		v.mu.Unlock()
+		return source
 	}
+	source := newFileSource(v.clock, time.Duration(v.sampleDurationUs)*time.Microsecond)
+	v.mu.Unlock()
 
-	return result
+	v.SetSource(source)
+	return source
 }
 
 func (v *VideoStreamer) StartStreaming() {
 	v.mu.Lock()
-	defer v.mu.Unlock()
-
 	if v.isStreaming {
+		v.mu.Unlock()
 		return
 	}
-
 	v.isStreaming = true
-	v.frameCounter = -1
-	v.sampleTimeUs = 0
+	v.lastFrame.Store(time.Now().UnixNano())
+	v.queue = NewFrameQueue(frameQueueSize, frameQueueOverflowPolicy, v.clock, &v.framesDropped)
+	v.stopWriter = make(chan struct{})
+	v.writerDone = make(chan struct{})
+	go v.writeLoop(v.queue, v.stopWriter, v.writerDone)
+	source := v.source
+	v.mu.Unlock()
 
-	go v.streamLoop()
+	if source == nil {
+		log.Println("ERROR: No video source, cannot stream")
+		v.ReportError(errors.New("no video source"))
+		return
+	}
+	v.startSource(source)
 }
 
+// StopStreaming stops the source and discards the frames still queued
 func (v *VideoStreamer) StopStreaming() {
 	v.mu.Lock()
-	defer v.mu.Unlock()
+	if !v.isStreaming {
+		v.mu.Unlock()
+		return
+	}
+	v.isStreaming = false
+	close(v.stopWriter)
+	v.queue, v.stopWriter, v.writerDone = nil, nil, nil
+	source := v.source
+	v.mu.Unlock()
+	v.gop.reset()
 
-	if v.isStreaming {
-		v.stopChan <- true
-		v.isStreaming = false
+	if source != nil {
+		source.Stop()
 	}
 }
 
-func (v *VideoStreamer) streamLoop() {
-	log.Println("Starting proper video stream with microsecond timing")
+// ReportError implements SampleSink
+func (v *VideoStreamer) ReportError(err error) {
+	v.mu.Lock()
+	onError := v.onError
+	v.mu.Unlock()
+	if onError != nil {
+		onError(err)
+	}
+}
+
+// WriteFrame implements SampleSink: it converts the frame to Annex B,
+// with the parameter sets if a keyframe was requested and SEI, and queues
+// it for writeLoop, so a slow track write delays only the writer and
+// queueing latency shows up in the pipeline metrics. The sample is built
+// in one pooled buffer, see frame_buffers.go.
+func (v *VideoStreamer) WriteFrame(frame VideoFrame) bool {
+	idr, hasSPS := false, false
+	forEachNAL(frame.Data, func(nal []byte) {
+		switch nal[0] & 0x1F {
+		case NAL_IDR:
+			idr = true
+		case NAL_SPS:
+			hasSPS = true
+		}
+	})
 
-	// Safety check - no files to stream
 	v.mu.Lock()
-	if len(v.frameFiles) == 0 {
+	queue, writerDone := v.queue, v.writerDone
+	if queue == nil {
 		v.mu.Unlock()
-		log.Println("ERROR: No H264 files loaded, cannot stream")
-		return
+		return false
+	}
+	v.cacheParameterSets(frame.Data)
+	// A decoder recovering from loss may have lost the parameter sets too
+	var parameterSets [][]byte
+	if idr && v.parameterSetsPending {
+		v.parameterSetsPending = false
+		if !hasSPS {
+			parameterSets = [][]byte{v.sps, v.pps}
+		}
 	}
+	onFrame := v.onFrame
+	v.lastFrame.Store(time.Now().UnixNano())
 	v.mu.Unlock()
 
-	// Send initial NAL units immediately
-	if initialData := v.getInitialNALUnits(); len(initialData) > 0 {
-		v.track.WriteSample(media.Sample{
-			Data:     initialData,
-			Duration: time.Duration(v.sampleDurationUs) * time.Microsecond,
-		})
-		// log.Printf("Sent initial NAL units (%d bytes)", len(initialData))
+	if onFrame != nil {
+		onFrame(frame.Data)
 	}
 
-	// Create ticker with microsecond precision
-	ticker := time.NewTicker(time.Duration(v.sampleDurationUs) * time.Microsecond)
-	defer ticker.Stop()
-
-	// startTime := time.Now()
-	framesSent := 0
-
-	for {
-		select {
-		case <-v.stopChan:
-			log.Printf("Stopping stream. Sent %d frames", framesSent)
-			return
-
-		case <-ticker.C:
-			v.mu.Lock()
-			v.frameCounter++
-			if v.frameCounter >= len(v.frameFiles) {
-				if v.frameCounter > 0 {
-					// Loop back to start
-					v.frameCounter = 0
-					log.Println("Looping video")
-				}
-			}
+	// Stamp the frame for peers without abs-capture-time, with each SEI
+	// version negotiated. They go before the checksum SEI is built so the
+	// checksum covers them.
+	var scratch [128]byte
+	var captureTimeSEI, frameInfoSEI []byte
+	versions := v.seiVersions.Load()
+	sequence := v.frameSequence.Add(1)
+	if versions&seiVersionMask(seiVersionCaptureTime) != 0 {
+		captureTimeSEI = appendCaptureTimeSEI(scratch[:0], frame.Captured)
+	}
+	if versions&seiVersionMask(seiVersionFrameInfo) != 0 {
+		rest := scratch[len(captureTimeSEI):len(captureTimeSEI)]
+		frameInfoSEI = appendFrameInfoSEI(rest, int(v.camera.Load()), sequence, frame.Captured)
+	}
 
-			// Read frame file
-			filepath := v.frameFiles[v.frameCounter]
-			v.mu.Unlock()
-			data, err := os.ReadFile(filepath)
-			if err != nil {
-				log.Printf("Failed to read frame %d: %v", v.frameCounter, err)
-				continue
-			}
+	size := len(frame.Data) + 2*len(scratch)
+	for _, nal := range parameterSets {
+		size += len(annexBStartCode) + len(nal)
+	}
+	buffer := getFrameBuffer(size)
+	data := *buffer
+
+	// Prefix the frame with its checksum SEI so clients can detect corruption
+	if seiFrameChecksum {
+		checksum := crc32.Update(0, crc32.IEEETable, captureTimeSEI)
+		checksum = crc32.Update(checksum, crc32.IEEETable, frameInfoSEI)
+		for _, nal := range parameterSets {
+			checksum = crc32.Update(checksum, crc32.IEEETable, nal)
+		}
+		checksum = updateFrameChecksum(checksum, frame.Data)
+		data = appendChecksumSEI(append(data, annexBStartCode...), checksum)
+	}
+	if captureTimeSEI != nil {
+		data = appendAnnexBNAL(data, captureTimeSEI)
+	}
+	if frameInfoSEI != nil {
+		data = appendAnnexBNAL(data, frameInfoSEI)
+	}
+	for _, nal := range parameterSets {
+		if nal != nil {
+			data = appendAnnexBNAL(data, nal)
+		}
+	}
+	data = appendAnnexB(data, frame.Data)
+	*buffer = data
+	v.frames.Publish(AccessUnit{Data: data, Captured: frame.Captured, Keyframe: idr})
 
-			// Convert to Annex B format for WebRTC
-			annexBData := v.convertToAnnexB(data)
-
-			// Update timing
-			v.sampleTimeUs += v.sampleDurationUs
-
-			// Send frame with proper duration
-			err = v.track.WriteSample(media.Sample{
-				Data:     annexBData,
-				Duration: time.Duration(v.sampleDurationUs) * time.Microsecond,
-			})
-
-			if err != nil {
-				if err == io.ErrClosedPipe {
-					log.Println("Track closed")
-					return
-				}
-				log.Printf("Write error: %v", err)
-				continue
-			}
+	return queue.Push(queuedFrame{data: data, buffer: buffer, duration: frame.Duration, captured: frame.Captured, keyframe: idr}, writerDone)
+}
 
-			framesSent++
+// idle returns how long ago the source wrote its last frame; streaming is
+// false if the stream is stopped
+func (v *VideoStreamer) idle() (idle time.Duration, streaming bool) {
+	v.mu.Lock()
+	streaming = v.isStreaming
+	v.mu.Unlock()
+	return time.Since(time.Unix(0, v.lastFrame.Load())), streaming
+}
 
-			// Log progress
-			// if framesSent%30 == 0 {
-			// 	elapsed := time.Since(startTime).Seconds()
-			// 	expectedTime := float64(framesSent) / float64(v.fps)
-			// 	drift := elapsed - expectedTime
+// FramesDropped returns how many frames the stream dropped because the track
+// fell behind, see frameQueueOverflowPolicy
+func (v *VideoStreamer) FramesDropped() uint64 {
+	return v.framesDropped.Load()
+}
 
-			// 	log.Printf("Sent %d frames | Elapsed: %.2fs | Expected: %.2fs | Drift: %.3fs | File: %s",
-			// 		framesSent, elapsed, expectedTime, drift, filepath)
-			// }
+// cacheParameterSets keeps the SPS and PPS of a frame, with v.mu held
+func (v *VideoStreamer) cacheParameterSets(data []byte) {
+	forEachNAL(data, func(nal []byte) {
+		switch nal[0] & 0x1F {
+		case NAL_SPS:
+			v.sps = append([]byte(nil), nal...)
+		case NAL_PPS:
+			v.pps = append([]byte(nil), nal...)
 		}
-	}
+	})
 }
 
-func (v *VideoStreamer) convertToAnnexB(data []byte) []byte {
-	// Convert length-prefixed format to Annex B format for WebRTC
-	var result []byte
-	startCode := []byte{0x00, 0x00, 0x00, 0x01}
+// writeLoop writes queued frames to the track until stop closes, closing
+// done when it exits so the reader notices if the track went away
+func (v *VideoStreamer) writeLoop(queue *FrameQueue, stop <-chan struct{}, done chan struct{}) {
+	defer close(done)
 
-	i := 0
-	for i < len(data) {
-		if i+4 > len(data) {
-			break
+	framesSent := 0
+	// The track's payloader can hold on to a sample's trailing parameter
+	// sets until the next one, so each buffer is released a sample late
+	var written queuedFrame
+	defer func() { written.release() }()
+	for {
+		var frame queuedFrame
+		select {
+		case <-stop:
+			log.Printf("Writer stopped. Sent %d frames", framesSent)
+			return
+		case frame = <-queue.Frames():
 		}
-
-		// Read 4-byte length (big-endian)
-		length := binary.BigEndian.Uint32(data[i : i+4])
-		naluStartIndex := i + 4
-		naluEndIndex := naluStartIndex + int(length)
-
-		if naluEndIndex > len(data) {
-			break
+		queue.Received(frame)
+		v.mu.Lock()
+		encryptor := v.encryptor
+		v.mu.Unlock()
+		data := frame.data
+		if encryptor != nil {
+			data = encryptor.Encrypt(data)
 		}
 
-		// Append start code and NAL unit data
-		result = append(result, startCode...)
-		result = append(result, data[naluStartIndex:naluEndIndex]...)
+		// Send frame with proper duration; tagging writers read its capture
+		// time while it is written
+		v.captureTime.Store(frame.captured.UnixNano())
+		start := time.Now()
+		err := v.track.WriteSample(media.Sample{
+			Data:     data,
+			Duration: frame.duration,
+		})
+		metrics.Observe("pipeline.track_write", time.Since(start))
+		written.release()
+		written = frame
+
+		if err != nil {
+			if err == io.ErrClosedPipe {
+				log.Println("Track closed")
+				return
+			}
+			log.Printf("Write error: %v", err)
+			continue
+		}
 
-		i = naluEndIndex
+		framesSent++
 	}
-
-	return result
 }
 
 // func getCurrentTimeMicroseconds() uint64 {
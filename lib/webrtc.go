@@ -1,20 +1,80 @@
 package main
 
 import (
+	"errors"
 	"fmt"
+	"io"
 	"log"
 	"sync"
+	"sync/atomic"
+	"time"
 
+	"github.com/pion/interceptor/pkg/cc"
+	"github.com/pion/interceptor/pkg/stats"
 	"github.com/pion/webrtc/v4"
 )
 
 type WebRTCManager struct {
+	api             *webrtc.API
+	mediaSockets    []io.Closer       // DSCP-marked UDP socket and ICE-TCP listener, if configured
+	transports      map[string]string // media transport of each connected peer
 	peerConnections map[string]*webrtc.PeerConnection
-	videoTrack      *webrtc.TrackLocalStaticSample
-	videoStreamer   *VideoStreamer
-	mu              sync.Mutex
+	statsGetters    map[string]stats.Getter // RTP stats of each peer connection
+	statsSamples    map[string]peerStatsSample
+	pipelineSamples map[string]pipelineSample // bytes of each pipeline, see pipeline_stats.go
+	newStats        stats.Getter              // set by captureStats during NewPeerConnection
+	bandwidth       map[string]*peerBandwidth
+	newEstimator    cc.BandwidthEstimator // set by captureEstimator during NewPeerConnection
+	rung            atomic.Int32          // current qualityLadder rung
+	stopABR         chan struct{}         // see StartAdaptiveBitrate
+	fpsStep         atomic.Int32          // current frameRateSteps step
+	stopFPS         chan struct{}         // see StartAdaptiveFrameRate
+	stopWatchdog    chan struct{}         // see StartStallWatchdog
+	governorLevel   atomic.Int32          // current governorSteps level
+	stopGovernor    chan struct{}         // see StartCPUGovernor
+	switchMu        sync.Mutex            // serializes camera and quality switches
+	outputs         []*videoOutput        // video tracks every peer receives
+	cameraOutputs   map[int]*videoOutput  // a track per camera, see camera_tracks.go
+	outputsMu       sync.Mutex            // guards cameraOutputs
+	peerCameras     map[string][]int      // cameras each peer requested a track for
+	sendOnlyMids    map[string][]string   // video sections answered sendonly, see transceivers.go
+	simulcastPeers  map[string]bool       // peers receiving simulcast, see simulcast.go
+	transcodedPeers map[string]bool       // peers receiving codecFallback, see transcoder.go
+	seiVersions     map[string]int        // SEI version negotiated with each peer, see frame_info.go
+	stateSince      map[string]time.Time  // when each peer entered its connection state
+	peerCreated     map[string]time.Time  // when each peer's connection was created
+	peerRoles       map[string]string     // role each peer was answered with, see roles.go
+	sessions        *SessionStore         // optional, persists peers and camera
+	cameraHealth    *CameraHealth
+	controls        *ControlRouter
+	events          *EventBus
+	sources         cameraSources           // cameras streamed from registered sources, see video_source.go
+	sourceManager   *SourceManager          // sources kept running, see source_manager.go
+	peerMetadata    map[string]PeerMetadata // what each peer told about itself, see peer_metadata.go
+	offerHooks      []SDPHook               // see sdp_hooks.go
+	answerHooks     []SDPHook
+	e2ee            *FrameEncryptor              // nil unless e2eeEnabled
+	incomingSink    IncomingMediaSink            // see incoming_media.go
+	jpegViews       map[jpegViewKey]*jpegView    // see mjpeg_view.go
+	teleop          teleopBridge                 // see teleop.go
+	estop           estopBridge                  // see estop.go
+	telemetry       map[string]*telemetryChannel // each peer's, see telemetry.go
+	keyChannels     map[string]*keyChannel       // each peer's, see key_channel.go
+	telemetrySink   func(Telemetry)              // takes telemetry no channel is open for
+	gpsSink         func(GPSPosition)            // takes each new GPS fix
+	cameraInfo      map[int]CameraInfo           // the latest sent, by camera
+	cameraInfoSink  func(CameraInfo)             // takes each camera's as it changes
+	stopTelemetry   chan struct{}                // see StartTelemetry
+	linger          *time.Timer                  // pending stop of an idle stream, see linger.go
+	lingerMu        sync.Mutex                   // guards linger
+	// maintenance rejects new offers while set, see SetMaintenance
+	maintenance bool
+	mu          sync.Mutex
 }
 
+// errMaintenance is returned for offers received in maintenance mode
+var errMaintenance = errors.New("backend is in maintenance mode")
+
 // ICECandidateMessage represents an ICE candidate from Flutter
 type ICECandidateMessage struct {
 	Candidate     string `json:"candidate"`
@@ -23,83 +83,407 @@ type ICECandidateMessage struct {
 }
 
 func NewWebRTCManager() (*WebRTCManager, error) {
-	// We'll create peer connections on demand now
+	return newWebRTCManager(false)
+}
 
+// newWebRTCManager is NewWebRTCManager, with loopbackCandidates offering
+// candidates on the loopback interface for tests, see newMediaAPI
+func newWebRTCManager(loopbackCandidates bool) (*WebRTCManager, error) {
+	// We'll create peer connections on demand now, from an API carrying the
+	// interface and DSCP settings
+	manager := &WebRTCManager{
+		transports:      make(map[string]string),
+		peerConnections: make(map[string]*webrtc.PeerConnection),
+		statsGetters:    make(map[string]stats.Getter),
+		statsSamples:    make(map[string]peerStatsSample),
+		pipelineSamples: make(map[string]pipelineSample),
+		bandwidth:       make(map[string]*peerBandwidth),
+		simulcastPeers:  make(map[string]bool),
+		transcodedPeers: make(map[string]bool),
+		seiVersions:     make(map[string]int),
+		stateSince:      make(map[string]time.Time),
+		peerCreated:     make(map[string]time.Time),
+		peerRoles:       make(map[string]string),
+		peerMetadata:    make(map[string]PeerMetadata),
+		cameraOutputs:   make(map[int]*videoOutput),
+		peerCameras:     make(map[string][]int),
+		sendOnlyMids:    make(map[string][]string),
+		jpegViews:       make(map[jpegViewKey]*jpegView),
+		telemetry:       make(map[string]*telemetryChannel),
+		keyChannels:     make(map[string]*keyChannel),
+		cameraInfo:      make(map[int]CameraInfo),
+		cameraHealth:    NewCameraHealth(),
+		controls:        NewControlRouter(),
+		events:          NewEventBus(),
+		sourceManager:   NewSourceManager(sourceManagerCPUBudget),
+	}
+	countEvents(manager.events)
+	manager.addBuiltinSDPHooks()
+	mirrorPeerEvents(manager.events)
+	// One key for the process's lifetime, see e2ee.go
+	if e2eeEnabled {
+		encryptor, err := NewFrameEncryptor(0)
+		if err != nil {
+			return nil, err
+		}
+		manager.e2ee = encryptor
+	}
+	api, mediaSockets, err := newMediaAPI(manager.captureStats, manager.captureEstimator, loopbackCandidates)
+	if err != nil {
+		return nil, fmt.Errorf("failed to set up media network: %v", err)
+	}
+	manager.api = api
+	manager.mediaSockets = mediaSockets
+	manager.controls.Register(ControlCamera, cameraControl(manager))
+	manager.controls.Register(ControlCameraGroup, cameraGroupControl(manager))
+	manager.controls.Register(ControlSetBitrate, captureSettingsControl(manager, ControlSetBitrate))
+	manager.controls.Register(ControlSetResolution, captureSettingsControl(manager, ControlSetResolution))
+	manager.controls.Register(ControlSetProfile, captureSettingsControl(manager, ControlSetProfile))
+	manager.controls.Register(ControlSetThermalRange, thermalRangeControl(manager))
+	manager.controls.Register(ControlJPEGView, jpegViewControl(manager))
+	manager.controls.Register(ControlDrive, driveControl(manager))
+	manager.controls.Register(ControlEStop, estopControl(manager))
+	manager.controls.Register(ControlROSService, rosServiceControl())
+
+	for i := 0; i < videoOutputCount; i++ {
+		output, err := newVideoOutput(i)
+		if err != nil {
+			for _, socket := range mediaSockets {
+				socket.Close()
+			}
+			return nil, err
+		}
+		if cameraHealthEnabled {
+			output.streamer.SetFrameObserver(func(data []byte) {
+				// Fallback frames are not the camera's, see stall_watchdog.go
+				if output.fallback.Load() {
+					return
+				}
+				manager.cameraHealth.Observe(int(output.camera.Load()), data)
+			})
+		}
+		manager.reportSourceErrors(output)
+		output.setEncryptor(manager.e2ee)
+		manager.outputs = append(manager.outputs, output)
+
+		// Load default cameras: 1 on the first output, 2 on the second, ...
+		defaultCamera := i + 1
+		if manager.validCamera(defaultCamera) {
+			if err := manager.loadCamera(output, defaultCamera); err != nil {
+				log.Printf("ERROR: Failed to load default camera: %v", err)
+				manager.events.emitSourceError(SourceErrorEvent{TrackID: output.track.ID(), Camera: defaultCamera, Err: err})
+				// Don't continue if no files found
+			} else {
+				log.Printf("Loaded default camera %d", defaultCamera)
+			}
+			output.camera.Store(int32(defaultCamera))
+		}
+	}
+	return manager, nil
+}
+
+// videoOutput is one video track, fed from one camera at a time
+type videoOutput struct {
+	track      sampleTrack
+	streamer   *VideoStreamer
+	layers     []*simulcastLayer // with simulcastEnabled
+	transcoder *transcoder       // with codecFallback set
+	camera     atomic.Int32      // camera currently streamed
+	fallback   atomic.Bool       // streaming frame files for a stalled camera
+}
+
+// newVideoOutput creates the index-th video track. The first keeps the
+// original "video" track ID; the others are "video-2", "video-3", ... in
+// streams of their own, so clients can lay them out on separate screens.
+func newVideoOutput(index int) (*videoOutput, error) {
+	trackID, streamID := "video", "stream"
+	if index > 0 {
+		trackID = fmt.Sprintf("video-%d", index+1)
+		streamID = fmt.Sprintf("stream-%d", index+1)
+	}
+	return newVideoOutputWithIDs(trackID, streamID)
+}
+
+func newVideoOutputWithIDs(trackID string, streamID string) (*videoOutput, error) {
 	// Create a video track for H264 with proper codec parameters
-	videoTrack, err := webrtc.NewTrackLocalStaticSample(
-		webrtc.RTPCodecCapability{
-			MimeType:    webrtc.MimeTypeH264,
-			ClockRate:   90000,
-			Channels:    0,
-			SDPFmtpLine: "level-asymmetry-allowed=1;packetization-mode=1;profile-level-id=42001f",
-		},
-		"video",
-		"stream",
-	)
+	codec := webrtc.RTPCodecCapability{
+		MimeType:    webrtc.MimeTypeH264,
+		ClockRate:   90000,
+		Channels:    0,
+		SDPFmtpLine: "level-asymmetry-allowed=1;packetization-mode=1;profile-level-id=42001f",
+	}
+	videoTrack, err := newVideoTrack(codec, trackID, streamID)
 	if err != nil {
 		return nil, err
 	}
 
 	// Create proper video streamer based on libdatachannel C++ reference
-	videoStreamer := NewVideoStreamer(videoTrack)
-
-	// Load default camera (camera 1)
-	defaultCamera := 1
-	cameraMap := map[int]string{
-		1: "h264/flir_id8_image_resized_30fps",
-		2: "h264/leopard_id1_image_resized_30fps",
-		3: "h264/leopard_id3_image_resized_30fps",
-		4: "h264/leopard_id4_image_resized_30fps",
-		5: "h264/leopard_id5_image_resized_30fps",
-		6: "h264/leopard_id6_image_resized_30fps",
-		7: "h264/leopard_id7_image_resized_30fps",
-	}
-
-	if defaultDir, ok := cameraMap[defaultCamera]; ok {
-		if err := videoStreamer.LoadH264Files(defaultDir); err != nil {
-			log.Printf("ERROR: Failed to load default camera %d files: %v", defaultCamera, err)
-			// Don't continue if no files found
-		} else {
-			log.Printf("Loaded default camera %d: %s", defaultCamera, defaultDir)
+	output := &videoOutput{track: videoTrack, streamer: NewVideoStreamer(videoTrack)}
+	if simulcastEnabled {
+		if output.layers, err = newSimulcastLayers(codec, trackID, streamID); err != nil {
+			return nil, err
+		}
+	}
+	if codecFallback != "" {
+		frameDuration := time.Duration(output.streamer.sampleDurationUs) * time.Microsecond
+		if output.transcoder, err = newTranscoder(trackID, streamID, frameDuration, output.streamer.Frames()); err != nil {
+			return nil, err
+		}
+		output.transcoder.requestKeyframe = func() {
+			output.streamer.RequestKeyframe(trackID, "Frame rate change")
 		}
 	}
+	return output, nil
+}
 
-	return &WebRTCManager{
-		peerConnections: make(map[string]*webrtc.PeerConnection),
-		videoTrack:      videoTrack,
-		videoStreamer:   videoStreamer,
-	}, nil
+// startStreaming starts every output, and their simulcast layers and
+// transcoders if a peer receives them
+func (w *WebRTCManager) startStreaming() {
+	w.mu.Lock()
+	simulcast := len(w.simulcastPeers) > 0
+	transcoded := len(w.transcodedPeers) > 0
+	w.mu.Unlock()
+
+	w.lingerMu.Lock()
+	defer w.lingerMu.Unlock()
+	if w.cancelLinger() {
+		log.Println("Peer connected while the video stream lingered, keeping it")
+		metrics.Inc("pipeline.linger_resumed")
+	}
+
+	for _, output := range w.allOutputs() {
+		output.streamer.StartStreaming()
+		if simulcast {
+			for _, layer := range output.layers {
+				layer.streamer.StartStreaming()
+			}
+		}
+		if transcoded && output.transcoder != nil {
+			output.transcoder.start()
+		}
+	}
+	w.prewarmCameras()
+}
+
+// stopUnusedTranscoders stops the transcoders once no peer receives them,
+// with w.mu held
+func (w *WebRTCManager) stopUnusedTranscoders() {
+	if len(w.transcodedPeers) > 0 {
+		return
+	}
+	for _, output := range w.allOutputs() {
+		if output.transcoder != nil {
+			output.transcoder.stopEncoder()
+		}
+	}
+}
+
+// stopStreaming stops every output, simulcast layer and transcoder
+func (w *WebRTCManager) stopStreaming() {
+	for _, output := range w.allOutputs() {
+		output.streamer.StopStreaming()
+		for _, layer := range output.layers {
+			layer.streamer.StopStreaming()
+		}
+		if output.transcoder != nil {
+			output.transcoder.stopEncoder()
+		}
+	}
+	w.sourceManager.stopAll()
+}
+
+// Events returns the bus of lifecycle events, for subscribing to them
+func (w *WebRTCManager) Events() *EventBus {
+	return w.events
+}
+
+// reportSourceErrors raises the frames of output failing to stream as
+// source errors of the camera it streams
+func (w *WebRTCManager) reportSourceErrors(output *videoOutput) {
+	output.streamer.SetErrorObserver(func(err error) {
+		w.events.emitSourceError(SourceErrorEvent{TrackID: output.track.ID(), Camera: int(output.camera.Load()), Err: err})
+	})
 }
 
-func (w *WebRTCManager) ProcessOffer(peerID string, offerSDP string) (string, error) {
+// Controls returns the router of control channel messages, for registering
+// handlers
+func (w *WebRTCManager) Controls() *ControlRouter {
+	return w.controls
+}
+
+// CameraHealth returns the per-camera availability tracker
+func (w *WebRTCManager) CameraHealth() *CameraHealth {
+	return w.cameraHealth
+}
+
+// ProcessOffer answers peerID's offer. Non-trickle peers get the answer only
+// once ICE gathering finishes, with every local candidate embedded in it.
+// onCandidate, if set, receives the local candidates of this connection; it
+// is attached before gathering starts so none are missed. evicted is the
+// peer disconnected to admit peerID with AdmitEvictOldest. An offer that
+// fails leaves every connection, peerID's existing one included, as it was.
+func (w *WebRTCManager) ProcessOffer(peerID string, offerSDP string, caps PeerCapabilities, onCandidate func(*webrtc.ICECandidate)) (string, string, error) {
+	peerConnection, gatherComplete, answerSDP, evicted, err := w.negotiate(peerID, offerSDP, caps, onCandidate)
+	if err == nil && w.sessions != nil {
+		w.sessions.PeerOffered(peerID)
+	}
+	if err != nil || caps.TrickleICE {
+		return answerSDP, evicted, err
+	}
+
+	// Wait outside the manager lock, gathering can take several seconds
+	select {
+	case <-gatherComplete:
+		log.Printf("[%s] ICE gathering complete, embedding candidates in answer", peerID)
+	case <-time.After(iceGatheringTimeout):
+		log.Printf("[%s] ICE gathering timed out, answering with candidates gathered so far", peerID)
+	}
+
+	localDescription := peerConnection.LocalDescription()
+	if localDescription == nil {
+		return "", evicted, fmt.Errorf("no local description for %s", peerID)
+	}
+	return w.outgoingAnswer(peerID, localDescription.SDP), evicted, nil
+}
+
+// negotiate applies the offer to a new connection and sets the answer, and
+// only then replaces any existing connection for peerID. The returned channel closes when ICE gathering completes
+// and is only set up for peers without trickle ICE. evicted is the peer
+// disconnected to make room for peerID, if any.
+func (w *WebRTCManager) negotiate(peerID string, offerSDP string, caps PeerCapabilities, onCandidate func(*webrtc.ICECandidate)) (_ *webrtc.PeerConnection, _ <-chan struct{}, _ string, evicted string, _ error) {
 	w.mu.Lock()
 	defer w.mu.Unlock()
 
-	// Close existing connection if any
-	if existingPC, exists := w.peerConnections[peerID]; exists {
-		log.Printf("Closing existing peer connection for %s", peerID)
-		existingPC.Close()
+	if w.maintenance {
+		return nil, nil, "", evicted, errMaintenance
+	}
+	// The peer making room is only disconnected once the offer is applied
+	// and the new connection stored, so an offer failing evicts no one
+	evictee := ""
+	if w.admissionFull(peerID) {
+		if peerAdmissionPolicy == AdmitEvictOldest {
+			evictee = w.oldestViewer()
+		}
+		if evictee == "" {
+			return nil, nil, "", evicted, errPeerLimit
+		}
+	}
+	offerSDP = applySDPHooks(w.offerHooks, peerID, offerSDP)
+
+	var outputs []*videoOutput
+	if offerReceivesVideo(offerSDP) {
+		var err error
+		if outputs, err = w.peerOutputs(caps.Cameras); err != nil {
+			return nil, nil, "", evicted, err
+		}
+	} else {
+		log.Printf("[%s] Offer receives no video, sending none", peerID)
 	}
 
 	// Create new peer connection
 	config := webrtc.Configuration{
-		ICEServers: []webrtc.ICEServer{
-			{
-				URLs: []string{"stun:stun.l.google.com:19302"},
-			},
-		},
+		ICEServers: iceServers(),
 	}
 
-	peerConnection, err := webrtc.NewPeerConnection(config)
+	peerConnection, err := w.api.NewPeerConnection(config)
 	if err != nil {
-		return "", err
+		return nil, nil, "", evicted, err
+	}
+	// Nothing is stored until the offer is applied and answered: a failing
+	// offer closes its own connection and leaves the peer's existing one,
+	// and every other peer, as they were
+	stored := false
+	defer func() {
+		if !stored {
+			peerConnection.Close()
+		}
+	}()
+	statsGetter, estimator := w.newStats, w.newEstimator
+	w.newStats, w.newEstimator = nil, nil
+
+	// Add the video tracks to the new peer connection, transcoded for peers
+	// without H.264 and as simulcast where the offer asks for it
+	onREMB := func(bitrate float32) {
+		w.recordREMB(peerID, peerConnection, bitrate)
+	}
+	if caps.Role == RoleViewer {
+		log.Printf("[%s] Answering as viewer: sendonly media, no control channel", peerID)
+	}
+	maxBitrate := peerMaxBitrate(caps, offerSDP)
+	if maxBitrate > 0 {
+		log.Printf("[%s] Capped at %d kbps", peerID, maxBitrate/1000)
+	}
+	transcoded := needsFallback(offerSDP)
+	if transcoded && w.e2ee != nil {
+		return nil, nil, "", evicted, fmt.Errorf("offer has no H.264, and %s video cannot be end-to-end encrypted", codecFallback)
+	}
+	if transcoded {
+		log.Printf("[%s] Offer has no H.264, answering with %s", peerID, codecFallback)
+	}
+	// Outputs go to the video sections the peer receives in, in order, see
+	// transceivers.go
+	sections := offerVideoSections(offerSDP)
+	var receiving []int
+	for index, section := range sections {
+		if section.receives() {
+			receiving = append(receiving, index)
+		}
+	}
+	if len(outputs) > len(receiving) {
+		log.Printf("[%s] Offer receives %d video tracks, sending %d of %d", peerID, len(receiving), len(receiving), len(outputs))
+		outputs = outputs[:len(receiving)]
+	}
+	layerRIDs := simulcastRIDs(offerSDP)
+	simulcast := false
+	var sendOnly []string
+	for i, output := range outputs {
+		index := receiving[i]
+		section := sections[index]
+		if sendDirection(section, caps.Role) == webrtc.RTPTransceiverDirectionSendonly {
+			sendOnly = append(sendOnly, section.mid)
+		}
+		var transceiver *webrtc.RTPTransceiver
+		if transcoded {
+			if transceiver, err = addVideoTransceiver(peerConnection, output.transcoder.track, section, caps.Role); err == nil {
+				go readRTCP(peerID, transceiver.Sender().ReadRTCP, output.streamer, onREMB)
+			}
+		} else if index < len(layerRIDs) && len(layerRIDs[index]) > 1 && len(output.layers) > 0 {
+			err = addSimulcastTrack(peerID, peerConnection, output, layerRIDs[index], section, caps.Role, onREMB)
+			simulcast = true
+		} else {
+			if transceiver, err = addVideoTransceiver(peerConnection, peerTrack(peerID, output.track, output.streamer), section, caps.Role); err == nil {
+				go readRTCP(peerID, transceiver.Sender().ReadRTCP, output.streamer, onREMB)
+			}
+		}
+		if err != nil {
+			return nil, nil, "", evicted, err
+		}
 	}
 
-	// Add the video track to the new peer connection
-	_, err = peerConnection.AddTrack(w.videoTrack)
-	if err != nil {
-		peerConnection.Close()
-		return "", err
+	// Viewers never get the control channel
+	if controlChannelEnabled && caps.Role != RoleViewer {
+		if err := w.controls.attach(peerID, peerConnection); err != nil {
+			return nil, nil, "", evicted, fmt.Errorf("failed to create control channel: %v", err)
+		}
+	}
+	var telemetry *telemetryChannel
+	if telemetryInterval > 0 {
+		if telemetry, err = w.attachTelemetry(peerID, peerConnection, caps.Encoding); err != nil {
+			return nil, nil, "", evicted, fmt.Errorf("failed to create telemetry channel: %v", err)
+		}
+	}
+	var keys *keyChannel
+	if resumeTokenTTL > 0 || w.e2ee != nil {
+		if keys, err = w.attachKeyChannel(peerID, peerConnection, caps.Encoding); err != nil {
+			return nil, nil, "", evicted, fmt.Errorf("failed to create key channel: %v", err)
+		}
+	}
+
+	// Operators' own camera and microphone, see incoming_media.go
+	if incomingMediaEnabled && caps.Role != RoleViewer {
+		peerConnection.OnTrack(func(track *webrtc.TrackRemote, _ *webrtc.RTPReceiver) {
+			w.receiveTrack(peerID, peerConnection, track)
+		})
 	}
 
 	// Set up connection state handlers
@@ -109,15 +493,35 @@ func (w *WebRTCManager) ProcessOffer(peerID string, offerSDP string) (string, er
 
 	peerConnection.OnConnectionStateChange(func(state webrtc.PeerConnectionState) {
 		log.Printf("[%s] WebRTC connection state changed: %s", peerID, state.String())
+		w.mu.Lock()
+		if w.peerConnections[peerID] == peerConnection {
+			w.stateSince[peerID] = time.Now()
+		}
+		w.mu.Unlock()
 
 		switch state {
 		case webrtc.PeerConnectionStateConnected:
 			log.Printf("[%s] WebRTC connected, starting video stream", peerID)
-			w.videoStreamer.StartStreaming()
+			transport := w.trackTransport(peerID, peerConnection)
+			w.events.emitPeerConnected(PeerEvent{PeerID: peerID, State: state.String(), MediaTransport: transport})
+			w.startStreaming()
+			// A stream already running is mid-GOP. The GOP cache primes
+			// the tracks it is on instead, but not transcoded ones.
+			w.mu.Lock()
+			transcoded := w.transcodedPeers[peerID]
+			w.mu.Unlock()
+			if !gopCacheEnabled || transcoded {
+				w.RequestPeerKeyframe(peerID, "New peer")
+			}
 		case webrtc.PeerConnectionStateDisconnected, webrtc.PeerConnectionStateFailed, webrtc.PeerConnectionStateClosed:
 			log.Printf("[%s] WebRTC disconnected", peerID)
+			w.events.emitPeerDisconnected(PeerEvent{PeerID: peerID, State: state.String()})
 			// Check if any peers are still connected
 			w.mu.Lock()
+			if w.peerConnections[peerID] == peerConnection {
+				delete(w.transports, peerID)
+				w.reportTransports()
+			}
 			hasConnected := false
 			for id, pc := range w.peerConnections {
 				if id != peerID && pc.ConnectionState() == webrtc.PeerConnectionStateConnected {
@@ -128,15 +532,11 @@ func (w *WebRTCManager) ProcessOffer(peerID string, offerSDP string) (string, er
 			w.mu.Unlock()
 
 			if !hasConnected {
-				log.Println("No peers connected, stopping video stream")
-				w.videoStreamer.StopStreaming()
+				w.idleStreaming()
 			}
 		}
 	})
 
-	// Store the peer connection
-	w.peerConnections[peerID] = peerConnection
-
 	offer := webrtc.SessionDescription{
 		Type: webrtc.SDPTypeOffer,
 		SDP:  offerSDP,
@@ -145,23 +545,99 @@ func (w *WebRTCManager) ProcessOffer(peerID string, offerSDP string) (string, er
 	// Set the remote description (offer)
 	err = peerConnection.SetRemoteDescription(offer)
 	if err != nil {
-		return "", err
+		return nil, nil, "", evicted, err
 	}
 
 	// Create an answer
 	answer, err := peerConnection.CreateAnswer(nil)
 	if err != nil {
-		return "", err
+		return nil, nil, "", evicted, err
+	}
+
+	// Bound to this connection rather than looked up by peer ID later, so a
+	// quick re-offer cannot receive the previous connection's candidates
+	if onCandidate != nil {
+		peerConnection.OnICECandidate(func(candidate *webrtc.ICECandidate) {
+			if candidate != nil {
+				onCandidate(candidate)
+			}
+		})
+	}
+
+	var gatherComplete <-chan struct{}
+	if !caps.TrickleICE {
+		gatherComplete = webrtc.GatheringCompletePromise(peerConnection)
 	}
 
 	// Set the local description (answer)
 	err = peerConnection.SetLocalDescription(answer)
 	if err != nil {
-		return "", err
+		return nil, nil, "", evicted, err
+	}
+
+	if evictee != "" {
+		log.Printf("[%s] Peer limit of %d reached, evicting oldest peer %s", peerID, maxPeers, evictee)
+		w.disconnectLocked(evictee)
+		evicted = evictee
+	}
+
+	// Close existing connection if any
+	if existingPC, exists := w.peerConnections[peerID]; exists {
+		log.Printf("Closing existing peer connection for %s", peerID)
+		existingPC.Close()
+		delete(w.transports, peerID)
+		w.reportTransports()
+		w.forgetStats(peerID)
+		delete(w.simulcastPeers, peerID)
+		delete(w.transcodedPeers, peerID)
+		delete(w.seiVersions, peerID)
+		delete(w.peerCameras, peerID)
+		delete(w.sendOnlyMids, peerID)
+		delete(w.stateSince, peerID)
+		delete(w.peerCreated, peerID)
+		delete(w.peerRoles, peerID)
+		delete(w.peerMetadata, peerID)
+		w.stopJPEGViews(peerID)
+		delete(w.telemetry, peerID)
+		delete(w.keyChannels, peerID)
+	}
+
+	// Store the peer connection
+	stored = true
+	w.peerConnections[peerID] = peerConnection
+	w.statsGetters[peerID] = statsGetter
+	w.bandwidth[peerID] = &peerBandwidth{estimator: estimator, limit: maxBitrate}
+	w.stateSince[peerID] = time.Now()
+	w.peerCreated[peerID] = time.Now()
+	w.peerRoles[peerID] = caps.Role
+	w.peerMetadata[peerID] = caps.Metadata
+	if telemetry != nil {
+		w.telemetry[peerID] = telemetry
+	}
+	if keys != nil {
+		w.keyChannels[peerID] = keys
+	}
+	if simulcast {
+		w.simulcastPeers[peerID] = true
+	}
+	if transcoded {
+		w.transcodedPeers[peerID] = true
+	}
+	// The peer's previous connection may have been the last transcoded
+	w.stopUnusedTranscoders()
+	w.seiVersions[peerID] = negotiateSEIVersion(caps)
+	w.updateSEIVersions()
+	if len(caps.Cameras) > 0 {
+		w.peerCameras[peerID] = caps.Cameras
+	}
+	// The peer's previous connection may have requested other cameras
+	w.dropUnusedCameraOutputs()
+	if len(sendOnly) > 0 {
+		w.sendOnlyMids[peerID] = sendOnly
 	}
 
 	log.Println("Created WebRTC answer")
-	return answer.SDP, nil
+	return peerConnection, gatherComplete, applySDPHooks(w.answerHooks, peerID, sentAnswer(answer.SDP, simulcast, caps.Role, sendOnly)), evicted, nil
 }
 
 func (w *WebRTCManager) AddICECandidate(peerID string, candidateData ICECandidateMessage) error {
@@ -189,61 +665,242 @@ func (w *WebRTCManager) AddICECandidate(peerID string, candidateData ICECandidat
 	return nil
 }
 
-func (w *WebRTCManager) SetupICECandidateHandler(peerID string, handler func(*webrtc.ICECandidate)) {
+// outgoingAnswer returns peerID's local description as sent to the peer,
+// see sentAnswer and the answer hooks (sdp_hooks.go)
+func (w *WebRTCManager) outgoingAnswer(peerID string, answerSDP string) string {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	answerSDP = sentAnswer(answerSDP, w.simulcastPeers[peerID], w.peerRoles[peerID], w.sendOnlyMids[peerID])
+	return applySDPHooks(w.answerHooks, peerID, answerSDP)
+}
+
+// sentAnswer adapts pion's answer for a peer with the given simulcast, role
+// and sendonly video sections to what is sent to it
+func sentAnswer(answerSDP string, simulcast bool, role string, sendOnlyMids []string) string {
+	if simulcast {
+		answerSDP = answerSimulcast(answerSDP)
+	}
+	answerSDP = answerDirections(answerSDP, sendOnlyMids)
+	if role == RoleViewer {
+		answerSDP = answerSendOnly(answerSDP)
+	}
+	return answerSDP
+}
+
+// CurrentAnswer returns the local description of peerID's connection, which
+// by now may include gathered candidates, as long as the connection is usable
+func (w *WebRTCManager) CurrentAnswer(peerID string) (string, bool) {
 	w.mu.Lock()
 	peerConnection, exists := w.peerConnections[peerID]
 	w.mu.Unlock()
 
 	if !exists {
-		log.Printf("No peer connection found for %s when setting up ICE handler", peerID)
-		return
+		return "", false
+	}
+
+	switch peerConnection.ConnectionState() {
+	case webrtc.PeerConnectionStateFailed, webrtc.PeerConnectionStateClosed:
+		return "", false
 	}
 
-	peerConnection.OnICECandidate(func(candidate *webrtc.ICECandidate) {
-		if candidate != nil {
-			handler(candidate)
+	localDescription := peerConnection.LocalDescription()
+	if localDescription == nil {
+		return "", false
+	}
+	return w.outgoingAnswer(peerID, localDescription.SDP), true
+}
+
+// PeerIDs returns the IDs of all current peer connections
+func (w *WebRTCManager) PeerIDs() []string {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	peerIDs := make([]string, 0, len(w.peerConnections))
+	for peerID := range w.peerConnections {
+		peerIDs = append(peerIDs, peerID)
+	}
+	return peerIDs
+}
+
+// BytesReceived returns the bytes received over all of peerID's ICE
+// candidate pairs; consent checks and RTCP keep it growing for live peers
+func (w *WebRTCManager) BytesReceived(peerID string) (uint64, bool) {
+	w.mu.Lock()
+	peerConnection, exists := w.peerConnections[peerID]
+	w.mu.Unlock()
+
+	if !exists {
+		return 0, false
+	}
+
+	var total uint64
+	for _, stats := range peerConnection.GetStats() {
+		if pairStats, ok := stats.(webrtc.ICECandidatePairStats); ok {
+			total += pairStats.BytesReceived
 		}
-	})
+	}
+	return total, true
+}
+
+// StalePeers returns the peers that have been out of the connected state
+// for longer than timeout, with the state each is stuck in
+func (w *WebRTCManager) StalePeers(timeout time.Duration) map[string]webrtc.PeerConnectionState {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	now := time.Now()
+	stale := make(map[string]webrtc.PeerConnectionState)
+	for peerID, peerConnection := range w.peerConnections {
+		state := peerConnection.ConnectionState()
+		if state != webrtc.PeerConnectionStateConnected && now.Sub(w.stateSince[peerID]) > timeout {
+			stale[peerID] = state
+		}
+	}
+	return stale
+}
+
+// trackTransport records how peerID's media travels once it connects; TCP
+// sessions get a warning, their video will stall on loss
+func (w *WebRTCManager) trackTransport(peerID string, peerConnection *webrtc.PeerConnection) string {
+	transport := selectedTransport(peerConnection)
+	if overTCP(transport) {
+		log.Printf("[%s] Media is over TCP (%s), expect reduced quality", peerID, transport)
+	} else {
+		log.Printf("[%s] Media transport: %s", peerID, transport)
+	}
+	metrics.Inc("webrtc.sessions." + transport)
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.peerConnections[peerID] == peerConnection {
+		w.transports[peerID] = transport
+		w.reportTransports()
+	}
+	return transport
+}
+
+// PeerTransport returns the media transport of a connected peer, and whether
+// it goes over TCP
+func (w *WebRTCManager) PeerTransport(peerID string) (transport string, tcp bool, ok bool) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	transport, ok = w.transports[peerID]
+	return transport, overTCP(transport), ok
+}
+
+// reportTransports updates the TCP session gauge, with w.mu held
+func (w *WebRTCManager) reportTransports() {
+	tcp := 0
+	for _, transport := range w.transports {
+		if overTCP(transport) {
+			tcp++
+		}
+	}
+	metrics.SetGauge("webrtc.peers_over_tcp", int64(tcp))
+}
+
+// HasPeer reports whether this instance holds a peer connection for peerID
+func (w *WebRTCManager) HasPeer(peerID string) bool {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	_, exists := w.peerConnections[peerID]
+	return exists
+}
+
+// SetMaintenance turns maintenance mode on or off. Existing connections are
+// left alone; new offers fail with errMaintenance until it is turned off.
+func (w *WebRTCManager) SetMaintenance(on bool) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	w.maintenance = on
+	log.Printf("Maintenance mode: %v", on)
+}
+
+func (w *WebRTCManager) InMaintenance() bool {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.maintenance
 }
 
 func (w *WebRTCManager) SwitchCamera(cameraNumber int) error {
 	log.Printf("SwitchCamera called with camera number: %d", cameraNumber)
 
-	// Map camera numbers to directories
-	cameraMap := map[int]string{
-		1: "h264/flir_id8_image_resized_30fps",
-		2: "h264/leopard_id1_image_resized_30fps",
-		3: "h264/leopard_id3_image_resized_30fps",
-		4: "h264/leopard_id4_image_resized_30fps",
-		5: "h264/leopard_id5_image_resized_30fps",
-		6: "h264/leopard_id6_image_resized_30fps",
-		7: "h264/leopard_id7_image_resized_30fps",
+	if !w.validCamera(cameraNumber) {
+		return errInvalidCamera(cameraNumber)
 	}
 
-	directory, ok := cameraMap[cameraNumber]
-	if !ok {
-		return fmt.Errorf("invalid camera number: %d (must be 1-7)", cameraNumber)
-	}
+	log.Printf("Switching to camera %d", cameraNumber)
 
-	log.Printf("Switching to camera %d: %s", cameraNumber, directory)
+	w.switchMu.Lock()
+	defer w.switchMu.Unlock()
 
-	// Load new H.264 files
-	if err := w.videoStreamer.LoadH264Files(directory); err != nil {
-		return fmt.Errorf("failed to load camera %d files: %v", cameraNumber, err)
+	// Load the camera at the current quality, on the first output
+	output := w.outputs[0]
+	if err := w.loadCamera(output, cameraNumber); err != nil {
+		w.events.emitSourceError(SourceErrorEvent{TrackID: output.track.ID(), Camera: cameraNumber, Err: err})
+		return err
 	}
 
-	log.Printf("Successfully loaded files for camera %d from: %s", cameraNumber, directory)
+	log.Printf("Successfully switched to camera %d", cameraNumber)
+	output.camera.Store(int32(cameraNumber))
+	w.events.emitCameraSwitched(CameraEvent{TrackID: output.track.ID(), Camera: cameraNumber})
+
+	if w.sessions != nil {
+		w.sessions.SetCamera(cameraNumber)
+	}
 	return nil
 }
 
+// SetSessionStore persists peers and camera selection to store from now on,
+// restoring the camera that was active when it was last saved
+func (w *WebRTCManager) SetSessionStore(store *SessionStore) {
+	if cameraNumber := store.Camera(); cameraNumber != 0 {
+		log.Printf("Restoring camera %d from session store", cameraNumber)
+		if err := w.SwitchCamera(cameraNumber); err != nil {
+			log.Printf("Failed to restore camera: %v", err)
+		}
+	}
+
+	w.mu.Lock()
+	w.sessions = store
+	w.mu.Unlock()
+}
+
 func (w *WebRTCManager) DisconnectPeer(peerID string) error {
 	w.mu.Lock()
 	defer w.mu.Unlock()
+	return w.disconnectLocked(peerID)
+}
 
+// disconnectLocked closes peerID's connection and forgets it; w.mu must be
+// held
+func (w *WebRTCManager) disconnectLocked(peerID string) error {
 	if peerConnection, exists := w.peerConnections[peerID]; exists {
 		log.Printf("Disconnecting peer: %s", peerID)
 		err := peerConnection.Close()
 		delete(w.peerConnections, peerID)
+		delete(w.transports, peerID)
+		w.reportTransports()
+		w.forgetStats(peerID)
+		delete(w.simulcastPeers, peerID)
+		delete(w.transcodedPeers, peerID)
+		w.stopUnusedTranscoders()
+		delete(w.seiVersions, peerID)
+		delete(w.peerCameras, peerID)
+		w.dropUnusedCameraOutputs()
+		delete(w.sendOnlyMids, peerID)
+		delete(w.stateSince, peerID)
+		delete(w.peerCreated, peerID)
+		delete(w.peerRoles, peerID)
+		delete(w.peerMetadata, peerID)
+		w.stopJPEGViews(peerID)
+		delete(w.telemetry, peerID)
+		delete(w.keyChannels, peerID)
+		w.updateSEIVersions()
+		if w.sessions != nil {
+			w.sessions.RemovePeer(peerID)
+		}
 
 		// Check if any peers are still connected
 		hasConnected := false
@@ -255,8 +912,7 @@ func (w *WebRTCManager) DisconnectPeer(peerID string) error {
 		}
 
 		if !hasConnected {
-			log.Println("No peers connected after disconnect, stopping video stream")
-			w.videoStreamer.StopStreaming()
+			w.idleStreaming()
 		}
 
 		return err
@@ -276,6 +932,49 @@ func (w *WebRTCManager) Close() error {
 	}
 
 	w.peerConnections = make(map[string]*webrtc.PeerConnection)
-	w.videoStreamer.StopStreaming()
+	w.lingerMu.Lock()
+	w.cancelLinger()
+	w.lingerMu.Unlock()
+	w.stopStreaming()
+	w.transports = make(map[string]string)
+	w.reportTransports()
+	w.statsGetters = make(map[string]stats.Getter)
+	w.statsSamples = make(map[string]peerStatsSample)
+	w.pipelineSamples = make(map[string]pipelineSample)
+	w.bandwidth = make(map[string]*peerBandwidth)
+	w.simulcastPeers = make(map[string]bool)
+	w.transcodedPeers = make(map[string]bool)
+	w.seiVersions = make(map[string]int)
+	w.peerCameras = make(map[string][]int)
+	w.sendOnlyMids = make(map[string][]string)
+	w.stateSince = make(map[string]time.Time)
+	w.peerCreated = make(map[string]time.Time)
+	w.peerRoles = make(map[string]string)
+	w.peerMetadata = make(map[string]PeerMetadata)
+	if w.stopABR != nil {
+		close(w.stopABR)
+		w.stopABR = nil
+	}
+	if w.stopFPS != nil {
+		close(w.stopFPS)
+		w.stopFPS = nil
+	}
+	w.telemetry = make(map[string]*telemetryChannel)
+	w.keyChannels = make(map[string]*keyChannel)
+	if w.stopTelemetry != nil {
+		close(w.stopTelemetry)
+		w.stopTelemetry = nil
+	}
+	if w.stopWatchdog != nil {
+		close(w.stopWatchdog)
+		w.stopWatchdog = nil
+	}
+	if w.stopGovernor != nil {
+		close(w.stopGovernor)
+		w.stopGovernor = nil
+	}
+	for _, socket := range w.mediaSockets {
+		socket.Close()
+	}
 	return nil
 }
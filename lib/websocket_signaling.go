@@ -0,0 +1,310 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/pion/webrtc/v4"
+)
+
+// WebSocketMessage is the JSON envelope exchanged with WebSocket peers.
+// Peers send "offer" (sdp, optional trickleIce, cameras, token, resume and
+// maxBitrate), "candidate" (candidates) and "keepalive"; the backend
+// replies with "answer" (sdp), "candidate", "resume-token" (resumeToken)
+// and, to peers that requested cameras, "tracks" (tracks).
+type WebSocketMessage struct {
+	Type        string                `json:"type"`
+	SDP         string                `json:"sdp,omitempty"`
+	TrickleICE  *bool                 `json:"trickleIce,omitempty"`
+	Cameras     []int                 `json:"cameras,omitempty"`
+	Role        string                `json:"role,omitempty"`
+	Token       string                `json:"token,omitempty"`
+	Metadata    *PeerMetadata         `json:"metadata,omitempty"`
+	Resume      string                `json:"resume,omitempty"`
+	MaxBitrate  int                   `json:"maxBitrate,omitempty"`
+	SEIVersions []int                 `json:"seiVersions,omitempty"`
+	Candidates  []ICECandidateMessage `json:"candidates,omitempty"`
+	Tracks      *PeerTracks           `json:"tracks,omitempty"`
+	Error       *OfferError           `json:"error,omitempty"`
+	E2EEKey     *E2EEKey              `json:"e2eeKey,omitempty"`
+	ResumeToken *ResumeToken          `json:"resumeToken,omitempty"`
+}
+
+// webSocketPeer serialises writes, gorilla connections allow one writer at a time
+type webSocketPeer struct {
+	conn    *websocket.Conn
+	writeMu sync.Mutex
+}
+
+func (p *webSocketPeer) send(msg WebSocketMessage) error {
+	p.writeMu.Lock()
+	defer p.writeMu.Unlock()
+
+	p.conn.SetWriteDeadline(time.Now().Add(5 * time.Second))
+	return p.conn.WriteJSON(msg)
+}
+
+// WebSocketSignalingServer lets peers signal directly over a WebSocket at
+// /signaling?peerId=<id>, for deployments without an MQTT broker
+type WebSocketSignalingServer struct {
+	addr     string
+	signaler *Signaler
+	server   *http.Server
+	upgrader websocket.Upgrader
+	peers    map[string]*webSocketPeer
+	mu       sync.Mutex
+}
+
+func NewWebSocketSignalingServer(addr string, signaler *Signaler) *WebSocketSignalingServer {
+	return &WebSocketSignalingServer{
+		addr:     addr,
+		signaler: signaler,
+		upgrader: websocket.Upgrader{
+			// Lab benches and demos serve the frontend from anywhere
+			CheckOrigin: func(r *http.Request) bool { return true },
+		},
+		peers: make(map[string]*webSocketPeer),
+	}
+}
+
+// Start listens on the configured address and serves in the background
+func (s *WebSocketSignalingServer) Start() error {
+	listener, err := net.Listen("tcp", s.addr)
+	if err != nil {
+		return fmt.Errorf("failed to listen on %s: %v", s.addr, err)
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/signaling", s.handleConnection)
+	s.server = &http.Server{Handler: mux}
+
+	go func() {
+		if err := s.server.Serve(listener); err != nil && err != http.ErrServerClosed {
+			log.Printf("WebSocket signaling server stopped: %v", err)
+		}
+	}()
+
+	log.Printf("WebSocket signaling listening on %s/signaling", listener.Addr())
+	return nil
+}
+
+func (s *WebSocketSignalingServer) Close() {
+	if s.server != nil {
+		s.server.Close()
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for peerID, peer := range s.peers {
+		peer.conn.Close()
+		delete(s.peers, peerID)
+	}
+}
+
+func (s *WebSocketSignalingServer) handleConnection(w http.ResponseWriter, r *http.Request) {
+	// A peer ID connected over another transport, or with a socket of its
+	// own, is not this client's to signal for: it would get the peer's
+	// answer, key and resume token, and tear its connection down on leaving
+	peerID := r.URL.Query().Get("peerId")
+	if peerID != "" && s.claimedElsewhere(peerID) {
+		log.Printf("WebSocket peer %s (%s) refused: the ID is connected over another transport", peerID, r.RemoteAddr)
+		metrics.Inc("signaling.websocket_ids_refused")
+		http.Error(w, "peer ID in use", http.StatusConflict)
+		return
+	}
+	if peerID != "" && s.hasSocket(peerID) {
+		log.Printf("WebSocket peer %s (%s) refused: the ID has a live socket", peerID, r.RemoteAddr)
+		metrics.Inc("signaling.websocket_ids_refused")
+		http.Error(w, "peer ID in use", http.StatusConflict)
+		return
+	}
+
+	conn, err := s.upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		log.Printf("WebSocket upgrade failed: %v", err)
+		return
+	}
+
+	if peerID == "" {
+		peerID = newPeerID("ws")
+	}
+	peer := &webSocketPeer{conn: conn}
+
+	// A reconnecting peer's previous socket is gone by now; one still
+	// live means another client took the ID while this one upgraded
+	s.mu.Lock()
+	if _, live := s.peers[peerID]; live {
+		s.mu.Unlock()
+		log.Printf("WebSocket peer %s (%s) refused: the ID has a live socket", peerID, r.RemoteAddr)
+		metrics.Inc("signaling.websocket_ids_refused")
+		conn.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.ClosePolicyViolation, "peer ID in use"), time.Now().Add(time.Second))
+		conn.Close()
+		return
+	}
+	s.peers[peerID] = peer
+	s.mu.Unlock()
+
+	log.Printf("WebSocket peer connected: %s (%s)", peerID, r.RemoteAddr)
+
+	for {
+		var msg WebSocketMessage
+		if err := conn.ReadJSON(&msg); err != nil {
+			if !websocket.IsCloseError(err, websocket.CloseNormalClosure, websocket.CloseGoingAway) {
+				log.Printf("WebSocket read from %s failed: %v", peerID, err)
+			}
+			break
+		}
+		// The ID may have connected over another transport since
+		if s.claimedElsewhere(peerID) {
+			log.Printf("WebSocket peer %s closed: the ID is connected over another transport", peerID)
+			metrics.Inc("signaling.websocket_ids_refused")
+			break
+		}
+
+		switch msg.Type {
+		case "offer":
+			caps := defaultPeerCapabilities()
+			if msg.TrickleICE != nil {
+				caps.TrickleICE = *msg.TrickleICE
+			}
+			caps.Cameras = msg.Cameras
+			caps.Role = msg.Role
+			if msg.Metadata != nil {
+				caps.Metadata = *msg.Metadata
+			}
+			caps.Resume = msg.Resume
+			caps.MaxBitrate = msg.MaxBitrate
+			caps.SEIVersions = msg.SEIVersions
+			s.signaler.HandleOffer(s, peerID, msg.SDP, msg.Token, caps)
+		case "candidate":
+			s.signaler.HandleCandidates(peerID, msg.Candidates)
+		case "keepalive":
+			s.signaler.HandleKeepalive(peerID)
+		default:
+			log.Printf("Unknown WebSocket message type from %s: %s", peerID, msg.Type)
+		}
+	}
+
+	s.mu.Lock()
+	delete(s.peers, peerID)
+	s.mu.Unlock()
+
+	conn.Close()
+	if !s.claimedElsewhere(peerID) {
+		s.signaler.HandleDisconnect(peerID)
+	}
+}
+
+// claimedElsewhere reports whether peerID has a connection answered over
+// a transport other than this one
+func (s *WebSocketSignalingServer) claimedElsewhere(peerID string) bool {
+	transport, ok := s.signaler.PeerTransport(peerID)
+	return ok && transport != s.Name()
+}
+
+// hasSocket reports whether peerID has a live socket
+func (s *WebSocketSignalingServer) hasSocket(peerID string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	_, ok := s.peers[peerID]
+	return ok
+}
+
+// newPeerID returns a random ID for a peer that did not name itself, e.g.
+// "ws-1f0c..."
+func newPeerID(prefix string) string {
+	b := make([]byte, 8)
+	if _, err := rand.Read(b); err != nil {
+		return fmt.Sprintf("%s-%d", prefix, time.Now().UnixNano())
+	}
+	return prefix + "-" + hex.EncodeToString(b)
+}
+
+func (s *WebSocketSignalingServer) peer(peerID string) (*webSocketPeer, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	peer, ok := s.peers[peerID]
+	if !ok {
+		return nil, fmt.Errorf("no WebSocket connection for %s", peerID)
+	}
+	return peer, nil
+}
+
+// Name implements SignalingTransport
+func (s *WebSocketSignalingServer) Name() string {
+	return "websocket"
+}
+
+// SendAnswer implements SignalingTransport
+func (s *WebSocketSignalingServer) SendAnswer(peerID string, answerSDP string) error {
+	peer, err := s.peer(peerID)
+	if err != nil {
+		return err
+	}
+	return peer.send(WebSocketMessage{Type: "answer", SDP: answerSDP})
+}
+
+// SendCandidates implements SignalingTransport
+func (s *WebSocketSignalingServer) SendCandidates(peerID string, candidates []webrtc.ICECandidateInit) error {
+	peer, err := s.peer(peerID)
+	if err != nil {
+		return err
+	}
+
+	messages := make([]ICECandidateMessage, 0, len(candidates))
+	for _, candidate := range candidates {
+		msg := ICECandidateMessage{Candidate: candidate.Candidate}
+		if candidate.SDPMid != nil {
+			msg.SDPMid = *candidate.SDPMid
+		}
+		if candidate.SDPMLineIndex != nil {
+			msg.SDPMLineIndex = *candidate.SDPMLineIndex
+		}
+		messages = append(messages, msg)
+	}
+	return peer.send(WebSocketMessage{Type: "candidate", Candidates: messages})
+}
+
+// SendTracks implements SignalingTransport
+func (s *WebSocketSignalingServer) SendTracks(peerID string, tracks PeerTracks) error {
+	peer, err := s.peer(peerID)
+	if err != nil {
+		return err
+	}
+	return peer.send(WebSocketMessage{Type: "tracks", Tracks: &tracks})
+}
+
+// SendError implements SignalingTransport
+func (s *WebSocketSignalingServer) SendError(peerID string, offerErr OfferError) error {
+	peer, err := s.peer(peerID)
+	if err != nil {
+		return err
+	}
+	return peer.send(WebSocketMessage{Type: "error", Error: &offerErr})
+}
+
+// SendKey implements SignalingTransport
+func (s *WebSocketSignalingServer) SendKey(peerID string, key E2EEKey) error {
+	peer, err := s.peer(peerID)
+	if err != nil {
+		return err
+	}
+	return peer.send(WebSocketMessage{Type: "e2ee-key", E2EEKey: &key})
+}
+
+// SendResume implements SignalingTransport
+func (s *WebSocketSignalingServer) SendResume(peerID string, resume ResumeToken) error {
+	peer, err := s.peer(peerID)
+	if err != nil {
+		return err
+	}
+	return peer.send(WebSocketMessage{Type: "resume-token", ResumeToken: &resume})
+}
@@ -0,0 +1,245 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+
+	"github.com/pion/webrtc/v4"
+)
+
+// maxWHIPOfferSize bounds the SDP offer read from a WHIP or WHEP request
+const maxWHIPOfferSize = 64 * 1024
+
+// whipResult is how HandleOffer answered one WHIP or WHEP offer
+type whipResult struct {
+	answerSDP string
+	offerErr  *OfferError
+}
+
+// WHIPServer serves WHIP (RFC 9725) ingest at /whip and WHEP playback at
+// /whep, so standard players and encoders such as OBS, GStreamer's
+// whipsink/whepsrc and browsers can exchange a single offer and answer over
+// HTTP instead of the custom protocol. The bearer token is the offer token.
+// WHEP peers are viewers; WHIP peers send their media as operators, which
+// takes incomingMediaEnabled. Each session is a resource at
+// /whip/<peerId> or /whep/<peerId> that a DELETE disconnects.
+type WHIPServer struct {
+	addr     string
+	signaler *Signaler
+	server   *http.Server
+	// results holds the outcome of the offers being answered, by peer
+	results map[string]*whipResult
+	mu      sync.Mutex
+}
+
+func NewWHIPServer(addr string, signaler *Signaler) *WHIPServer {
+	return &WHIPServer{
+		addr:     addr,
+		signaler: signaler,
+		results:  make(map[string]*whipResult),
+	}
+}
+
+// Start listens on the configured address and serves in the background
+func (s *WHIPServer) Start() error {
+	listener, err := net.Listen("tcp", s.addr)
+	if err != nil {
+		return fmt.Errorf("failed to listen on %s: %v", s.addr, err)
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/whip", s.handleEndpoint)
+	mux.HandleFunc("/whep", s.handleEndpoint)
+	mux.HandleFunc("/whip/", s.handleResource)
+	mux.HandleFunc("/whep/", s.handleResource)
+	s.server = &http.Server{Handler: mux}
+
+	go func() {
+		if err := s.server.Serve(listener); err != nil && err != http.ErrServerClosed {
+			log.Printf("WHIP/WHEP server stopped: %v", err)
+		}
+	}()
+
+	log.Printf("WHIP/WHEP listening on %s/whip and /whep", listener.Addr())
+	return nil
+}
+
+func (s *WHIPServer) Close() {
+	if s.server != nil {
+		s.server.Close()
+	}
+}
+
+// allowCORS lets browser players on other origins use the endpoints
+func allowCORS(w http.ResponseWriter) {
+	header := w.Header()
+	header.Set("Access-Control-Allow-Origin", "*")
+	header.Set("Access-Control-Allow-Methods", "POST, DELETE, OPTIONS")
+	header.Set("Access-Control-Allow-Headers", "Authorization, Content-Type")
+	header.Set("Access-Control-Expose-Headers", "Location")
+}
+
+// handleEndpoint answers the offer POSTed to /whip or /whep with a new session
+func (s *WHIPServer) handleEndpoint(w http.ResponseWriter, r *http.Request) {
+	allowCORS(w)
+	switch r.Method {
+	case http.MethodOptions:
+		w.WriteHeader(http.StatusNoContent)
+		return
+	case http.MethodPost:
+	default:
+		w.Header().Set("Allow", "POST, OPTIONS")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	if contentType := r.Header.Get("Content-Type"); !strings.HasPrefix(contentType, "application/sdp") {
+		http.Error(w, "offer must be application/sdp", http.StatusUnsupportedMediaType)
+		return
+	}
+	offer, err := io.ReadAll(io.LimitReader(r.Body, maxWHIPOfferSize))
+	if err != nil {
+		http.Error(w, "failed to read offer", http.StatusBadRequest)
+		return
+	}
+
+	// Encoders never request cameras or open the control channel, and
+	// expect every candidate in the answer
+	endpoint := strings.TrimPrefix(r.URL.Path, "/")
+	caps := defaultPeerCapabilities()
+	caps.TrickleICE = false
+	if endpoint == "whep" {
+		caps.Role = RoleViewer
+		metrics.Inc("whep.offers")
+	} else {
+		if !incomingMediaEnabled {
+			http.Error(w, "ingest is disabled", http.StatusForbidden)
+			return
+		}
+		metrics.Inc("whip.offers")
+	}
+
+	peerID := newPeerID(endpoint)
+	token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+
+	result := &whipResult{}
+	s.mu.Lock()
+	s.results[peerID] = result
+	s.mu.Unlock()
+
+	s.signaler.HandleOffer(s, peerID, string(offer), token, caps)
+
+	s.mu.Lock()
+	delete(s.results, peerID)
+	s.mu.Unlock()
+
+	switch {
+	case result.offerErr != nil:
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Retry-After", "30")
+		w.WriteHeader(http.StatusServiceUnavailable)
+		json.NewEncoder(w).Encode(result.offerErr)
+	case result.answerSDP == "":
+		// Unauthorized, or an offer the manager could not answer; the log
+		// says which
+		http.Error(w, "offer not answered", http.StatusForbidden)
+	default:
+		w.Header().Set("Content-Type", "application/sdp")
+		w.Header().Set("Location", "/"+endpoint+"/"+peerID)
+		w.WriteHeader(http.StatusCreated)
+		io.WriteString(w, result.answerSDP)
+	}
+}
+
+// handleResource ends the session at /whip/<peerId> or /whep/<peerId> on
+// DELETE. Trickle and ICE restarts over PATCH are not supported.
+func (s *WHIPServer) handleResource(w http.ResponseWriter, r *http.Request) {
+	allowCORS(w)
+	endpoint, peerID, _ := strings.Cut(strings.TrimPrefix(r.URL.Path, "/"), "/")
+	if !strings.HasPrefix(peerID, endpoint+"-") || strings.Contains(peerID, "/") {
+		http.NotFound(w, r)
+		return
+	}
+
+	switch r.Method {
+	case http.MethodOptions:
+		w.WriteHeader(http.StatusNoContent)
+	case http.MethodDelete:
+		if _, exists := s.signaler.webrtcManager.CurrentAnswer(peerID); !exists {
+			http.NotFound(w, r)
+			return
+		}
+		s.signaler.HandleDisconnect(peerID)
+		w.WriteHeader(http.StatusOK)
+	default:
+		w.Header().Set("Allow", "DELETE, OPTIONS")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+func (s *WHIPServer) result(peerID string) (*whipResult, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	result, ok := s.results[peerID]
+	if !ok {
+		return nil, fmt.Errorf("no pending WHIP/WHEP offer for %s", peerID)
+	}
+	return result, nil
+}
+
+// Name implements SignalingTransport
+func (s *WHIPServer) Name() string {
+	return "whip"
+}
+
+// SendAnswer implements SignalingTransport, the answer is the response to
+// the POST being handled
+func (s *WHIPServer) SendAnswer(peerID string, answerSDP string) error {
+	result, err := s.result(peerID)
+	if err != nil {
+		return err
+	}
+	result.answerSDP = answerSDP
+	return nil
+}
+
+// SendCandidates implements SignalingTransport. WHIP and WHEP peers do not
+// trickle, their candidates are all in the answer.
+func (s *WHIPServer) SendCandidates(peerID string, candidates []webrtc.ICECandidateInit) error {
+	return fmt.Errorf("WHIP/WHEP peer %s does not trickle", peerID)
+}
+
+// SendTracks implements SignalingTransport; WHEP peers get the default
+// track only
+func (s *WHIPServer) SendTracks(peerID string, tracks PeerTracks) error {
+	return nil
+}
+
+// SendKey implements SignalingTransport. WHIP and WHEP have no message to
+// carry a key, so their peers cannot decrypt end-to-end encrypted video.
+func (s *WHIPServer) SendKey(peerID string, key E2EEKey) error {
+	return fmt.Errorf("WHIP/WHEP peer %s cannot receive the frame key", peerID)
+}
+
+// SendResume implements SignalingTransport. Every WHIP and WHEP POST is a
+// new peer, so there is no session to resume.
+func (s *WHIPServer) SendResume(peerID string, resume ResumeToken) error {
+	return nil
+}
+
+// SendError implements SignalingTransport
+func (s *WHIPServer) SendError(peerID string, offerErr OfferError) error {
+	result, err := s.result(peerID)
+	if err != nil {
+		return err
+	}
+	result.offerErr = &offerErr
+	return nil
+}
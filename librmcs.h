@@ -25,6 +25,18 @@ extern const char *_GoStringPtr(_GoString_ s);
 
 #include <stdlib.h>
 
+typedef int (*RMCSControlCallback)(const char* peerId, const char* type, const char* payload);
+
+static int rmcsCallControl(RMCSControlCallback callback, const char* peerId, const char* type, const char* payload) {
+	return callback(peerId, type, payload);
+}
+
+typedef void (*RMCSMediaCallback)(const char* peerId, const char* kind, const char* codec, const void* data, int size, unsigned int timestamp);
+
+static void rmcsCallMedia(RMCSMediaCallback callback, const char* peerId, const char* kind, const char* codec, const void* data, int size, unsigned int timestamp) {
+	callback(peerId, kind, codec, data, size, timestamp);
+}
+
 #line 1 "cgo-generated-wrapper"
 
 
@@ -89,9 +101,23 @@ extern "C" {
 
 extern int RMCSInit(void);
 extern int RMCSSwitchCamera(int cameraNumber);
+extern int RMCSSwitchCameraGroup(char* name);
 extern int RMCSStop(void);
 extern int RMCSGetStatus(void);
 extern int RMCSSetLogFile(char* filename);
+extern int RMCSStartRecording(char* filename);
+extern int RMCSStopRecording(void);
+extern int RMCSReplay(char* filename, int realtime);
+extern int RMCSRunScenario(char* filename);
+extern int RMCSStopScenario(void);
+extern char* RMCSGetMetrics(void);
+extern char* RMCSGetSubscriptions(void);
+extern char* RMCSGetCameras(void);
+extern char* RMCSGetPeerStats(char* peerID);
+extern char* RMCSGetPeers(void);
+extern char* RMCSGetPipelineStats(void);
+extern void RMCSSetControlCallback(RMCSControlCallback callback);
+extern void RMCSSetMediaCallback(RMCSMediaCallback callback);
 
 #ifdef __cplusplus
 }